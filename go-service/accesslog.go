@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the request ID in both directions. An incoming
+// one is kept when it looks like an ID, so a proxy's ID follows the request
+// through; otherwise one is generated.
+const RequestIDHeader = "X-Request-ID"
+
+const requestIDContextKey = "request_id"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID is the ID accessLogMiddleware gave the request.
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDContextKey)
+}
+
+// accessLogMiddleware assigns the request ID and logs one line per request
+// through slog, so LOG_FORMAT=json gives one JSON object per request. The
+// path is redacted as in the rest of the logs; probes are not logged.
+func accessLogMiddleware(c *gin.Context) {
+	id := c.GetHeader(RequestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = newRandomID()
+	}
+	c.Set(requestIDContextKey, id)
+	c.Header(RequestIDHeader, id)
+
+	start := time.Now()
+	c.Next()
+	if slices.Contains(probePaths, c.Request.URL.Path) {
+		return
+	}
+
+	path := c.Request.URL.Path
+	if c.Request.URL.RawQuery != "" {
+		path += "?" + c.Request.URL.RawQuery
+	}
+	status := c.Writer.Status()
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("method", c.Request.Method),
+		slog.String("path", redactURL(path)),
+		slog.Int("status", status),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("client_ip", clientIP(c)),
+	}
+	if code := c.Param("code"); code != "" {
+		attrs = append(attrs, slog.String("short_code", code))
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, slog.String("error", c.Errors.String()))
+	}
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelWarn
+	}
+	slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminToken guards every /admin route. When unset the admin API is disabled.
+var adminToken = getEnv("ADMIN_TOKEN", "")
+
+func (s *Server) requireAdmin(c *gin.Context) {
+	if s.isAdminCaller(c) {
+		c.Next()
+		return
+	}
+	if adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin API disabled"})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+}
+
+// hasAdminToken reports whether the request carries the admin token, in
+// X-Admin-Token or as a bearer token.
+func hasAdminToken(c *gin.Context) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := c.GetHeader("X-Admin-Token")
+	if token == "" {
+		token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+func (s *Server) registerAdminRoutes(r *gin.Engine) {
+	// The dashboard page is public; everything it loads needs the token.
+	r.GET("/admin/ui", adminUI)
+
+	admin := r.Group("/admin", s.requireAdmin)
+	admin.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	admin.GET("/stats", getAdminStats)
+	admin.DELETE("/stats/high-water", deleteAdminStatsHighWater)
+	admin.GET("/log-level", getLogLevel)
+	admin.PUT("/log-level", putLogLevel)
+	admin.PUT("/slow-thresholds", putSlowThresholds)
+	admin.GET("/log-sampling", getLogSampling)
+	admin.PUT("/log-sampling", putLogSampling)
+	admin.GET("/chaos", getChaos)
+	admin.PUT("/chaos", putChaos)
+	admin.DELETE("/chaos", deleteChaos)
+	admin.GET("/debug/capture", getDebugCapture)
+	admin.PUT("/debug/capture", putDebugCapture)
+	admin.GET("/debug/requests", getDebugRequests)
+	admin.DELETE("/debug/requests", deleteDebugRequests)
+	admin.POST("/self-test", s.postSelfTest)
+	admin.POST("/verify", s.postVerify)
+	admin.GET("/export/clicks", s.exportClicks)
+	admin.GET("/redirect-limit", getRedirectLimit)
+	admin.PUT("/redirect-limit", putRedirectLimit)
+	admin.GET("/namespace", s.getNamespace)
+	admin.GET("/probe", s.getProbe)
+	admin.POST("/canonical/backfill", s.postCanonicalBackfill)
+	admin.GET("/maintenance", getMaintenance)
+	admin.PUT("/maintenance", putMaintenance)
+	admin.POST("/codes/pregenerate", s.postPregenerateCodes)
+	admin.PUT("/codes/:code", s.attachPregeneratedCode)
+	admin.GET("/api-keys", s.listAPIKeys)
+	admin.POST("/api-keys", s.createAPIKey)
+	admin.DELETE("/api-keys/:id", s.revokeAPIKey)
+	admin.GET("/usage", s.getAdminUsage)
+	admin.GET("/shadow-mismatches", s.listShadowMismatches)
+
+	storage := admin.Group("/storage", s.requireStorageMigration)
+	storage.GET("/migration", s.getStorageMigration)
+	storage.POST("/reconcile", s.postStorageReconcile)
+	storage.POST("/cutover", s.postStorageCutover)
+	storage.POST("/abort", s.postStorageAbort)
+}
+
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": logLevel.Level().String()})
+}
+
+type logLevelRequest struct {
+	Level string `json:"level" binding:"required"`
+	// Duration optionally reverts the change, e.g. "10m".
+	Duration string `json:"duration"`
+}
+
+func putLogLevel(c *gin.Context) {
+	var req logLevelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	level, ok := parseLogLevel(req.Level)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "level must be one of debug, info, warn, error"})
+		return
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+			return
+		}
+		duration = d
+	}
+
+	setLogLevel(level, duration)
+	c.JSON(http.StatusOK, gin.H{"level": level.String(), "revert_after": req.Duration})
+}
+
+type slowThresholdsRequest struct {
+	DB    string `json:"db"`
+	Redis string `json:"redis"`
+	HTTP  string `json:"http"`
+}
+
+func putSlowThresholds(c *gin.Context) {
+	var req slowThresholdsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := []struct {
+		value     string
+		threshold *atomic.Int64
+	}{
+		{req.DB, &slowDBThreshold},
+		{req.Redis, &slowRedisThreshold},
+		{req.HTTP, &slowHTTPThreshold},
+	}
+	for _, u := range updates {
+		if u.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(u.value); err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration: " + u.value})
+			return
+		}
+	}
+	for _, u := range updates {
+		if u.value != "" {
+			d, _ := time.ParseDuration(u.value)
+			u.threshold.Store(int64(d))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"db":    time.Duration(slowDBThreshold.Load()).String(),
+		"redis": time.Duration(slowRedisThreshold.Load()).String(),
+		"http":  time.Duration(slowHTTPThreshold.Load()).String(),
+	})
+}
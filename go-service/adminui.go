@@ -0,0 +1,38 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed templates/admin.html
+var adminUIFS embed.FS
+
+var adminUITemplate = template.Must(template.ParseFS(adminUIFS, "templates/admin.html"))
+
+// adminUI serves GET /admin/ui, a small dashboard for deployments without a
+// frontend. The page itself holds no data: its script asks for the admin
+// token and calls the existing admin and stats endpoints with it, so the UI
+// can do nothing the token couldn't do through the API. The token is sent
+// as a header, which cross-site requests can't set (CORS only allows
+// Content-Type), so mutating calls need no separate CSRF token.
+func adminUI(c *gin.Context) {
+	if adminToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin API disabled"})
+		return
+	}
+
+	nonce := newRandomID()
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Security-Policy", "default-src 'none'; script-src 'nonce-"+nonce+"'; style-src 'nonce-"+nonce+"'; connect-src 'self'; form-action 'none'; frame-ancestors 'none'")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Status(http.StatusOK)
+	if err := adminUITemplate.Execute(c.Writer, struct{ Nonce string }{nonce}); err != nil {
+		log.Printf("Error rendering admin UI: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Renaming a link (PATCH /api/urls/:code with short_code) keeps the old
+// code as an alias of it, so printed materials carrying the old code keep
+// working: a redirect for an alias is served, and counted, as the link. An
+// alias is held for ALIAS_RETENTION after the rename (0 holds it until it
+// is released); until then no new link can take the code, and the link's
+// owner can give it up early with DELETE /api/urls/:code/aliases/:alias.
+// A resolver-only edge forgets the old code and only answers it when it
+// proxies misses upstream.
+var aliasRetention = getEnvDuration("ALIAS_RETENTION", 365*24*time.Hour)
+
+var errAliasRetained = errors.New("code is a retained alias")
+
+// liveAliasCondition matches the link_aliases rows that haven't expired.
+const liveAliasCondition = "(expires_at IS NULL OR datetime(expires_at) > datetime())"
+
+type linkAlias struct {
+	Alias     string `json:"alias"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// resolveAlias is the code of the link alias is a live alias of.
+func (s *Server) resolveAlias(ctx context.Context, alias string) (string, bool) {
+	var shortCode string
+	err := s.db.QueryRowContext(ctx, "SELECT short_code FROM link_aliases WHERE alias = ? AND "+liveAliasCondition, alias).Scan(&shortCode)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error resolving alias %s: %v", alias, err)
+	}
+	return shortCode, err == nil
+}
+
+// loadLinkAliases returns a link's live aliases, oldest first.
+func loadLinkAliases(ctx context.Context, q sqlQueryer, shortCode string) ([]linkAlias, error) {
+	rows, err := q.QueryContext(ctx, "SELECT alias, created_at, expires_at FROM link_aliases WHERE short_code = ? AND "+liveAliasCondition+" ORDER BY created_at, alias", shortCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aliases := []linkAlias{}
+	for rows.Next() {
+		var a linkAlias
+		var expiresAt sql.NullString
+		if err := rows.Scan(&a.Alias, &a.CreatedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		a.ExpiresAt = expiresAt.String
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+// renamedLinkTables are the tables whose rows follow a link to its new
+// code.
+var renamedLinkTables = []string{"clicks", "conversions", "click_counters", "clicks_hourly", "link_metadata", "link_claims"}
+
+// renameLinkTx moves the link at oldCode, with its clicks, counters and
+// metadata, to newCode, and keeps oldCode as an alias of it. newCode must
+// be free: not a link, a reserved code or another link's live alias. One
+// of the link's own aliases may be taken back. Its earlier aliases follow
+// it, and resolver edges are told oldCode is gone.
+func renameLinkTx(ctx context.Context, tx *sql.Tx, oldCode, newCode string, now time.Time) error {
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM urls WHERE short_code = ?)
+		OR EXISTS (SELECT 1 FROM code_reservations WHERE short_code = ?)`, newCode, newCode).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return errAliasTaken
+	}
+	var target string
+	err := tx.QueryRowContext(ctx, "SELECT short_code FROM link_aliases WHERE alias = ? AND "+liveAliasCondition, newCode).Scan(&target)
+	if err == nil && target != oldCode {
+		return errAliasRetained
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	// An expired alias, or one of the link's own, is given up.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM link_aliases WHERE alias = ?", newCode); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE urls SET short_code = ? WHERE short_code = ?", newCode, oldCode); err != nil {
+		if isUniqueViolation(err) {
+			return errAliasTaken
+		}
+		return err
+	}
+	for _, table := range renamedLinkTables {
+		// Rows left under newCode by a link long gone belong to nothing.
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE short_code = ?", newCode); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET short_code = ? WHERE short_code = ?", newCode, oldCode); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE link_aliases SET short_code = ? WHERE short_code = ?", newCode, oldCode); err != nil {
+		return err
+	}
+	var expiresAt any
+	if aliasRetention > 0 {
+		expiresAt = now.Add(aliasRetention).UTC().Format(time.RFC3339)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO link_aliases (alias, short_code, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		oldCode, newCode, now.UTC().Format(time.RFC3339), expiresAt); err != nil {
+		return err
+	}
+	// The update trigger only records the new code.
+	payload, _ := json.Marshal(map[string]string{"short_code": oldCode})
+	_, err = tx.ExecContext(ctx, "INSERT INTO url_changes (op, short_code, payload) VALUES ('delete', ?, ?)", oldCode, string(payload))
+	return err
+}
+
+// flushLinkCounts writes this instance's buffered clicks to the database
+// ahead of a rename, so few are left under the old code.
+func (s *Server) flushLinkCounts(ctx context.Context) {
+	if err := s.flushClickRollups(ctx); err != nil {
+		log.Printf("Error flushing click rollups: %v", err)
+	}
+	if s.rdb == nil {
+		return
+	}
+	if err := s.flushClickCounters(ctx); err != nil && !redisUnavailable(err) {
+		log.Printf("Error flushing click counters: %v", err)
+	}
+}
+
+// releaseAlias serves DELETE /api/urls/:code/aliases/:alias, which frees a
+// link's alias for new links at once. Only the link's owner, or an admin,
+// may release it.
+func (s *Server) releaseAlias(c *gin.Context) {
+	shortCode, alias := c.Param("code"), c.Param("alias")
+	ctx := c.Request.Context()
+	var owner sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT owner FROM urls WHERE short_code = ?", shortCode).Scan(&owner)
+	if err == nil && !s.isAdminCaller(c) && (!owner.Valid || owner.String != c.GetString(ownerContextKey)) {
+		err = sql.ErrNoRows
+	}
+	var res sql.Result
+	if err == nil {
+		res, err = s.execWithRetry(ctx, "DELETE FROM link_aliases WHERE alias = ? AND short_code = ?", alias, shortCode)
+	}
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alias not found"})
+		return
+	case errors.Is(err, errDBBusy):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	slog.Info("link alias released", "audit", true, "by", clientIP(c), "owner", c.GetString(ownerContextKey),
+		"short_code", shortCode, "alias", alias)
+	c.Status(http.StatusNoContent)
+}
+
+// reapLinkAliases frees aliases past their retention.
+func (s *Server) reapLinkAliases(ctx context.Context) error {
+	res, err := s.execWithRetry(ctx, "DELETE FROM link_aliases WHERE expires_at IS NOT NULL AND datetime(expires_at) <= datetime()")
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Released %d expired link aliases", n)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// createOwnedLink stores a link owned by owner.
+func createOwnedLink(t *testing.T, owner string) string {
+	t.Helper()
+	code := "al-" + newRandomID()[:10]
+	if _, err := testServer.store.Create(context.Background(), ShortenRequest{LongURL: "https://example.com/" + code}, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testServer.db.Exec("UPDATE urls SET owner = ? WHERE short_code = ?", owner, code); err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+type renameResponse struct {
+	ShortCode string            `json:"short_code"`
+	Metadata  map[string]string `json:"metadata"`
+	Clicks    int64             `json:"clicks"`
+	Aliases   []linkAlias       `json:"aliases"`
+	Code      string            `json:"code"`
+}
+
+func renameLink(t *testing.T, code, newCode, key string) (int, renameResponse) {
+	t.Helper()
+	w := serveTest(testServer.newRouter(), http.MethodPatch, "/api/urls/"+code, `{"short_code":"`+newCode+`"}`, "X-API-Key: "+key)
+	var resp renameResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestRenameLink(t *testing.T) {
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	code := createOwnedLink(t, ownerID)
+	other := createOwnedLink(t, ownerID)
+	if _, err := testServer.db.Exec("INSERT INTO link_metadata (short_code, key, value) VALUES (?, 'campaign', 'spring')", code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testServer.db.Exec("INSERT INTO clicks (short_code, clicked_at) VALUES (?, datetime())", code); err != nil {
+		t.Fatal(err)
+	}
+	newCode := "al-" + newRandomID()[:10]
+
+	for _, tt := range []struct {
+		name, to, key string
+		want          int
+	}{
+		{"another key", newCode, otherKey, http.StatusNotFound},
+		{"invalid code", "no spaces", key, http.StatusBadRequest},
+		{"reserved code", "admin", key, http.StatusBadRequest},
+		{"taken code", other, key, http.StatusConflict},
+	} {
+		if got, resp := renameLink(t, code, tt.to, tt.key); got != tt.want {
+			t.Errorf("rename with %s = %d (%+v), want %d", tt.name, got, resp, tt.want)
+		}
+	}
+
+	status, renamed := renameLink(t, code, newCode, key)
+	if status != http.StatusOK || renamed.ShortCode != newCode || len(renamed.Aliases) != 1 || renamed.Aliases[0].Alias != code || renamed.Aliases[0].ExpiresAt == "" {
+		t.Fatalf("rename = %d: %+v", status, renamed)
+	}
+
+	w := serveTest(r, http.MethodGet, "/api/urls/"+newCode, "", "X-API-Key: "+key)
+	var link renameResponse
+	json.Unmarshal(w.Body.Bytes(), &link)
+	if w.Code != http.StatusOK || link.Metadata["campaign"] != "spring" || link.Clicks != 1 || len(link.Aliases) != 1 || link.Aliases[0].Alias != code {
+		t.Errorf("renamed link = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/api/urls/"+code, "", "X-API-Key: "+key); w.Code != http.StatusNotFound {
+		t.Errorf("old code's metadata = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodGet, "/"+code, ""); w.Header().Get("Location") != "https://example.com/"+code {
+		t.Errorf("redirect from the old code = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	var forgotten int
+	if err := testServer.db.QueryRow("SELECT COUNT(*) FROM url_changes WHERE op = 'delete' AND short_code = ?", code).Scan(&forgotten); err != nil || forgotten != 1 {
+		t.Errorf("change feed has %d deletes of the old code (%v), want 1", forgotten, err)
+	}
+
+	// The alias can't be claimed by another link.
+	w = serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/claim","custom_alias":"`+code+`"}`, "X-API-Key: "+otherKey)
+	var denied renameResponse
+	json.Unmarshal(w.Body.Bytes(), &denied)
+	if w.Code != http.StatusConflict || denied.Code != "alias_retained" {
+		t.Errorf("shorten with a retained alias = %d: %s", w.Code, w.Body)
+	}
+	if status, resp := renameLink(t, other, code, key); status != http.StatusConflict || resp.Code != "alias_retained" {
+		t.Errorf("renaming another link to a retained alias = %d: %+v", status, resp)
+	}
+
+	// Renaming back gives the alias up.
+	status, renamed = renameLink(t, newCode, code, key)
+	if status != http.StatusOK || len(renamed.Aliases) != 1 || renamed.Aliases[0].Alias != newCode {
+		t.Errorf("rename back = %d: %+v", status, renamed)
+	}
+}
+
+func TestReleaseAlias(t *testing.T) {
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	code := createOwnedLink(t, ownerID)
+	newCode := "al-" + newRandomID()[:10]
+	if status, resp := renameLink(t, code, newCode, key); status != http.StatusOK {
+		t.Fatalf("rename = %d: %+v", status, resp)
+	}
+
+	release := "/api/urls/" + newCode + "/aliases/" + code
+	if w := serveTest(r, http.MethodDelete, release, "", "X-API-Key: "+otherKey); w.Code != http.StatusNotFound {
+		t.Errorf("release by another key = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodDelete, "/api/urls/"+newCode+"/aliases/no-such-alias", "", "X-API-Key: "+key); w.Code != http.StatusNotFound {
+		t.Errorf("release of an unknown alias = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodDelete, release, "", "X-API-Key: "+key); w.Code != http.StatusNoContent {
+		t.Fatalf("release = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/"+code, ""); w.Code != http.StatusNotFound {
+		t.Errorf("redirect from a released alias = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/claim","custom_alias":"`+code+`"}`, "X-API-Key: "+otherKey); w.Code != http.StatusOK {
+		t.Errorf("shorten with a released alias = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestReleaseOwnerlessAlias(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	code := createOwnedLink(t, "")
+	newCode := "al-" + newRandomID()[:10]
+	if w := serveTest(r, http.MethodPatch, "/api/urls/"+code, `{"short_code":"`+newCode+`"}`, "Authorization: Bearer "+testAdminToken); w.Code != http.StatusOK {
+		t.Fatalf("rename = %d: %s", w.Code, w.Body)
+	}
+	if _, err := testServer.db.Exec("UPDATE urls SET owner = NULL WHERE short_code = ?", newCode); err != nil {
+		t.Fatal(err)
+	}
+
+	// With no owner, only an admin may release it.
+	release := "/api/urls/" + newCode + "/aliases/" + code
+	if w := serveTest(r, http.MethodDelete, release, "", "X-API-Key: "+key); w.Code != http.StatusNotFound {
+		t.Errorf("release by a key = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodDelete, release, "", "Authorization: Bearer "+testAdminToken); w.Code != http.StatusNoContent {
+		t.Errorf("release by an admin = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestExpiredAliases(t *testing.T) {
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	code := createOwnedLink(t, ownerID)
+	expired, reaped := "al-"+newRandomID()[:10], "al-"+newRandomID()[:10]
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	for _, alias := range []string{expired, reaped} {
+		if _, err := testServer.db.Exec("INSERT INTO link_aliases (alias, short_code, created_at, expires_at) VALUES (?, ?, ?, ?)", alias, code, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if w := serveTest(r, http.MethodGet, "/"+expired, ""); w.Code != http.StatusNotFound {
+		t.Errorf("redirect from an expired alias = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/claim","custom_alias":"`+expired+`"}`, "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Errorf("shorten with an expired alias = %d: %s", w.Code, w.Body)
+	}
+	if err := testServer.reapLinkAliases(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var left int
+	if err := testServer.db.QueryRow("SELECT COUNT(*) FROM link_aliases WHERE alias = ?", reaped).Scan(&left); err != nil || left != 0 {
+		t.Errorf("%d expired aliases left after reaping (%v)", left, err)
+	}
+}
+
+func TestAliasClicksCountForLink(t *testing.T) {
+	s, store, _ := newFakeServer(t)
+	code, alias := "al-"+newRandomID()[:10], "al-"+newRandomID()[:10]
+	store.links[code] = storedLink{LongURL: "https://example.com/canonical", Status: linkStatusActive}
+	if _, err := testServer.db.Exec("INSERT INTO link_aliases (alias, short_code, created_at) VALUES (?, ?, datetime())", alias, code); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveTest(s.newRouter(), http.MethodGet, "/"+alias, "")
+	if w.Header().Get("Location") != "https://example.com/canonical" {
+		t.Fatalf("redirect from an alias = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	select {
+	case job := <-s.clickQueue:
+		s.clickJobs.Done()
+		if job.shortCode != code {
+			t.Errorf("click counted for %q, want %q", job.shortCode, code)
+		}
+	default:
+		t.Error("no click was counted")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API keys identify internal callers without an IdP. A key is sent as
+// X-API-Key or as a bearer token, wherever requireOAuth runs, and its ID
+// becomes the owner of what the caller creates, so links are kept apart
+// per key as they are per OAuth owner. Admin keys also pass requireAdmin
+// and may read and delete any link. The admin token is the bootstrap key:
+// it is accepted as an admin key and creates the first keys through
+// /admin/api-keys. Unless API_KEYS_REQUIRED is turned off, callers of
+// every /api/* route but the signed service callbacks and the conversion
+// pixel must present a key or, when OAuth is on, a token. Trusted keys,
+// and admin keys, may skip the destination check. A key's tier sets what
+// its caller may do when creating links; see tier.go.
+var apiKeysRequired = getEnvBool("API_KEYS_REQUIRED", true)
+
+// A key is "<id>.<secret>"; only the secret's hash is stored.
+const apiKeyIDPrefix = "ak_"
+
+// apiKeyAdminContextKey and apiKeyTrustedContextKey are set on the gin
+// context for admin and trusted keys.
+const (
+	apiKeyAdminContextKey   = "api_key_admin"
+	apiKeyTrustedContextKey = "api_key_trusted"
+)
+
+// apiKey is a verified key.
+type apiKey struct {
+	ID             string
+	Admin, Trusted bool
+	Tier           string
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// apiKeyFromRequest returns the key the request presents, if any. Bearer
+// tokens count only when they look like a key, so JWTs pass through.
+func apiKeyFromRequest(c *gin.Context) (string, bool) {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key, true
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if ok && strings.HasPrefix(token, apiKeyIDPrefix) {
+		return token, true
+	}
+	return "", false
+}
+
+// verifyAPIKey looks key up by its ID and compares the secret's hash in
+// constant time.
+func (s *Server) verifyAPIKey(ctx context.Context, key string) (apiKey, error) {
+	id, secret, ok := strings.Cut(key, ".")
+	if !ok || !strings.HasPrefix(id, apiKeyIDPrefix) || secret == "" {
+		return apiKey{}, errInvalidAPIKey
+	}
+	k := apiKey{ID: id}
+	var secretHash string
+	err := s.db.QueryRowContext(ctx, "SELECT secret_hash, admin, trusted, tier FROM api_keys WHERE id = ? AND revoked_at IS NULL", id).Scan(&secretHash, &k.Admin, &k.Trusted, &k.Tier)
+	if err == sql.ErrNoRows {
+		// Hash anyway, so unknown IDs take as long as wrong secrets.
+		subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(hashAPIKeySecret("")))
+		return apiKey{}, errInvalidAPIKey
+	}
+	if err != nil {
+		return apiKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(secretHash)) != 1 {
+		return apiKey{}, errInvalidAPIKey
+	}
+	return k, nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticateAPIKey is authenticateCaller for a request presenting key.
+func (s *Server) authenticateAPIKey(c *gin.Context, key string) bool {
+	k, err := s.verifyAPIKey(c.Request.Context(), key)
+	if errors.Is(err, errInvalidAPIKey) {
+		log.Printf("Rejected API key from %s", clientIP(c))
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key", "code": "invalid_api_key"})
+		return false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	c.Set(ownerContextKey, k.ID)
+	c.Set(apiKeyAdminContextKey, k.Admin)
+	c.Set(apiKeyTrustedContextKey, k.Admin || k.Trusted)
+	c.Set(tierContextKey, apiKeyTier(k))
+	recordAPICall(c, k.ID)
+	return true
+}
+
+// isAdminCaller reports whether the request carries the admin token or an
+// admin key.
+func (s *Server) isAdminCaller(c *gin.Context) bool {
+	if c.GetBool(apiKeyAdminContextKey) || hasAdminToken(c) {
+		return true
+	}
+	key, ok := apiKeyFromRequest(c)
+	if !ok {
+		return false
+	}
+	k, err := s.verifyAPIKey(c.Request.Context(), key)
+	if err != nil || !k.Admin {
+		return false
+	}
+	recordAPICall(c, k.ID)
+	return true
+}
+
+// requireOwnerOrAdmin lets admins through and otherwise requires an
+// authenticated owner; the handler checks that the owner owns the link.
+func (s *Server) requireOwnerOrAdmin(c *gin.Context) {
+	if s.isAdminCaller(c) {
+		c.Next()
+		return
+	}
+	if !s.authenticateCaller(c) {
+		return
+	}
+	if c.GetString(ownerContextKey) == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing API key or admin token", "code": "unauthenticated"})
+		return
+	}
+	c.Next()
+}
+
+type apiKeyRequest struct {
+	Name  string `json:"name" binding:"required"`
+	Admin bool   `json:"admin"`
+	// Trusted lets the key send skip_verification.
+	Trusted bool `json:"trusted"`
+	// Tier names the key's tier policy, standard by default.
+	Tier string `json:"tier"`
+}
+
+// createAPIKey serves POST /admin/api-keys. The key is only ever returned
+// here.
+func (s *Server) createAPIKey(c *gin.Context) {
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is too long"})
+		return
+	}
+	if req.Tier == "" {
+		req.Tier = tierStandard
+	}
+	if _, ok := tierPolicies[req.Tier]; !ok || req.Tier == tierAnonymous {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tier " + strconv.Quote(req.Tier) + " is not a configured tier", "code": "invalid_request"})
+		return
+	}
+	id, secret := apiKeyIDPrefix+newRandomID()[:16], newRandomID()+newRandomID()
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	if _, err := s.execWithRetry(c.Request.Context(), "INSERT INTO api_keys (id, name, secret_hash, admin, trusted, tier, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, req.Name, hashAPIKeySecret(secret), req.Admin, req.Trusted, req.Tier, createdAt); err != nil {
+		if isBusyError(err) {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	slog.Info("API key created", "audit", true, "by", clientIP(c), "key_id", id, "name", req.Name, "admin", req.Admin, "trusted", req.Trusted, "tier", req.Tier)
+	c.JSON(http.StatusCreated, gin.H{"id": id, "key": id + "." + secret, "name": req.Name, "admin": req.Admin, "trusted": req.Trusted, "tier": req.Tier, "created_at": createdAt})
+}
+
+// listAPIKeys serves GET /admin/api-keys, without secrets.
+func (s *Server) listAPIKeys(c *gin.Context) {
+	rows, err := s.db.QueryContext(c.Request.Context(), "SELECT id, name, admin, trusted, tier, created_at, revoked_at FROM api_keys ORDER BY created_at, id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+	keys := []gin.H{}
+	for rows.Next() {
+		var id, name, tier, createdAt string
+		var admin, trusted bool
+		var revokedAt sql.NullString
+		if err := rows.Scan(&id, &name, &admin, &trusted, &tier, &createdAt, &revokedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		keys = append(keys, gin.H{"id": id, "name": name, "admin": admin, "trusted": trusted, "tier": tier, "created_at": createdAt, "revoked_at": nullIfEmpty(revokedAt.String)})
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// revokeAPIKey serves DELETE /admin/api-keys/:id. Links the key created
+// stay owned by its ID.
+func (s *Server) revokeAPIKey(c *gin.Context) {
+	id := c.Param("id")
+	res, err := s.execWithRetry(c.Request.Context(), "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL",
+		time.Now().UTC().Format(time.RFC3339), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found or already revoked"})
+		return
+	}
+	slog.Info("API key revoked", "audit", true, "by", clientIP(c), "key_id", id)
+	c.Status(http.StatusNoContent)
+}
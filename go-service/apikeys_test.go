@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "urlshortener/shortenerpb"
+)
+
+func TestAPIRoutesRequireKey(t *testing.T) {
+	r := testServer.newRouter()
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/keys-required", ReuseExisting: new(bool)}, "")
+	_, key := newTestAPIKey(t, false)
+
+	for _, route := range []struct{ method, path, body string }{
+		{http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/keys-required"}`},
+		{http.MethodGet, "/api/urls/" + link.ShortCode, ""},
+		{http.MethodGet, "/api/qr/" + link.ShortCode, ""},
+		{http.MethodGet, "/api/stats/" + link.ShortCode, ""},
+		{http.MethodGet, "/api/stats/" + link.ShortCode + "/timeseries", ""},
+		{http.MethodGet, "/api/events/schema", ""},
+		{http.MethodGet, "/api/settings/timezone", ""},
+	} {
+		if w := serveTest(r, route.method, route.path, route.body); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a key = %d, want 401", route.method, route.path, w.Code)
+		}
+		for _, auth := range []string{"X-API-Key: " + key, "Authorization: Bearer " + testAdminToken} {
+			if w := serveTest(r, route.method, route.path, route.body, auth); w.Code == http.StatusUnauthorized {
+				t.Errorf("%s %s with %s = 401: %s", route.method, route.path, strings.SplitN(auth, ":", 2)[0], w.Body)
+			}
+		}
+	}
+}
+
+func TestHomepageFormRequiresNoKeys(t *testing.T) {
+	r := testServer.newRouter()
+	if w := serveTest(r, http.MethodGet, "/", "", "Accept: text/html"); strings.Contains(w.Body.String(), `name="csrf_token"`) {
+		t.Error("homepage shows the shorten form while API keys are required")
+	}
+	form := url.Values{"long_url": {"https://example.com/home"}, "csrf_token": {"t"}}
+	w := serveTest(r, http.MethodPost, "/", form.Encode(), "Content-Type: application/x-www-form-urlencoded", "Cookie: "+csrfCookieName+"=t")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("POST / while API keys are required = %d, want 401", w.Code)
+	}
+
+	apiKeysRequired = false
+	t.Cleanup(func() { apiKeysRequired = true })
+	if w := serveTest(r, http.MethodGet, "/", "", "Accept: text/html"); !strings.Contains(w.Body.String(), `name="csrf_token"`) {
+		t.Error("homepage hides the shorten form with API keys off")
+	}
+}
+
+func TestStatsOnlyForOwnerAndAdmins(t *testing.T) {
+	r := testServer.newRouter()
+	ownerID, ownerKey := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	_, adminKey := newTestAPIKey(t, true)
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/owned-stats", ReuseExisting: new(bool)}, ownerID)
+
+	saved := statsShareSecret
+	statsShareSecret = "test-share-secret"
+	t.Cleanup(func() { statsShareSecret = saved })
+	share := newStatsShareToken(link.ShortCode, newRandomID(), []string{statsScopeSummary, statsScopeTimeseries}, time.Now().Add(time.Hour))
+
+	for _, path := range []string{"/api/stats/" + link.ShortCode, "/api/stats/" + link.ShortCode + "/timeseries"} {
+		for _, tt := range []struct {
+			name   string
+			target string
+			header string
+			want   int
+		}{
+			{"owner", path, "X-API-Key: " + ownerKey, http.StatusOK},
+			{"other key", path, "X-API-Key: " + otherKey, http.StatusNotFound},
+			{"admin key", path, "X-API-Key: " + adminKey, http.StatusOK},
+			{"admin token", path, "X-Admin-Token: " + testAdminToken, http.StatusOK},
+			{"share link", path + "?share=" + url.QueryEscape(share), "", http.StatusOK},
+		} {
+			var headers []string
+			if tt.header != "" {
+				headers = append(headers, tt.header)
+			}
+			if w := serveTest(r, http.MethodGet, tt.target, "", headers...); w.Code != tt.want {
+				t.Errorf("GET %s as %s = %d, want %d: %s", path, tt.name, w.Code, tt.want, w.Body)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		caller grpcCaller
+		want   codes.Code
+	}{
+		{"owner", grpcCaller{owner: ownerID}, codes.OK},
+		{"other owner", grpcCaller{owner: "someone-else"}, codes.NotFound},
+		{"admin", grpcCaller{admin: true}, codes.OK},
+	} {
+		ctx := context.WithValue(context.Background(), grpcCallerKey{}, tt.caller)
+		_, err := grpcShortener{Server: testServer}.GetStats(ctx, &pb.GetStatsRequest{ShortCode: link.ShortCode})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("GetStats as %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOwnerlessStatsOnlyForAdmins(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	_, adminKey := newTestAPIKey(t, true)
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/ownerless-stats", ReuseExisting: new(bool)}, "")
+	saved := statsShareSecret
+	statsShareSecret = "test-share-secret"
+	t.Cleanup(func() { statsShareSecret = saved })
+
+	for _, tt := range []struct {
+		name, header   string
+		stats, sharing int
+	}{
+		{"key", "X-API-Key: " + key, http.StatusNotFound, http.StatusNotFound},
+		{"admin key", "X-API-Key: " + adminKey, http.StatusOK, http.StatusCreated},
+	} {
+		if w := serveTest(r, http.MethodGet, "/api/stats/"+link.ShortCode, "", tt.header); w.Code != tt.stats {
+			t.Errorf("stats as %s = %d, want %d: %s", tt.name, w.Code, tt.stats, w.Body)
+		}
+		if w := serveTest(r, http.MethodPost, "/api/urls/"+link.ShortCode+"/stats/share", `{}`, tt.header); w.Code != tt.sharing {
+			t.Errorf("share as %s = %d, want %d: %s", tt.name, w.Code, tt.sharing, w.Body)
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		caller grpcCaller
+		want   codes.Code
+	}{
+		{"no owner", grpcCaller{}, codes.NotFound},
+		{"admin", grpcCaller{admin: true}, codes.OK},
+	} {
+		ctx := context.WithValue(context.Background(), grpcCallerKey{}, tt.caller)
+		_, err := grpcShortener{Server: testServer}.GetStats(ctx, &pb.GetStatsRequest{ShortCode: link.ShortCode})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("GetStats as %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDebugCaptureRedactsAPIKey(t *testing.T) {
+	debugCaptureUntil.Store(time.Now().Add(time.Minute).UnixNano())
+	t.Cleanup(func() {
+		debugCaptureUntil.Store(0)
+		debugCaptures.clear()
+	})
+	r := gin.New()
+	r.Use(debugCaptureMiddleware)
+	r.GET("/api/ping", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	serveTest(r, http.MethodGet, "/api/ping", "", "X-API-Key: ak_secret.value")
+
+	captures := debugCaptures.list(func(capturedExchange) bool { return true })
+	if len(captures) == 0 {
+		t.Fatal("nothing captured")
+	}
+	if got := captures[len(captures)-1].RequestHeaders["X-Api-Key"]; got != redactedValue {
+		t.Errorf("captured X-API-Key = %q, want it redacted", got)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// App is where extensions hook into the service without patching main(): a
+// file in this package registers from its init() with the Register and On
+// methods on app. The built-in periodic jobs use the same registry.
+//
+// Startup hooks run in registration order once the database and Redis are
+// up; an error stops the service. Background jobs then start. On SIGINT or
+// SIGTERM the jobs are stopped, waiting for a running pass to finish, and
+// shutdown hooks run in reverse registration order. Every hook gets its own
+// timeout.
+type App struct {
+	mu         sync.Mutex
+	publishers []namedPublisher
+	jobs       []backgroundJob
+	routes     []func(*gin.RouterGroup)
+	startup    []appHook
+	shutdown   []appHook
+
+	stopJobs context.CancelFunc
+	jobsDone sync.WaitGroup
+}
+
+// ClickPublisher receives every click event after the built-in Redis/HTTP
+// publish. It runs on a click publisher worker, so it should not block for
+// long; an error is logged and counted.
+type ClickPublisher func(ctx context.Context, event ClickEvent) error
+
+type namedPublisher struct {
+	name    string
+	publish ClickPublisher
+}
+
+type backgroundJob struct {
+	name     string
+	interval time.Duration
+	run      func(context.Context) error
+}
+
+type appHook struct {
+	name    string
+	timeout time.Duration
+	fn      func(context.Context) error
+}
+
+var app = &App{}
+
+var (
+	// appJobStats has runs, errors and last_duration_ms per background job.
+	appJobStats = expvar.NewMap("background_jobs")
+	// appPublisherStats has publishes and errors per extension publisher.
+	appPublisherStats = expvar.NewMap("click_publishers")
+)
+
+// RegisterPublisher adds a publisher for click events.
+func (a *App) RegisterPublisher(name string, p ClickPublisher) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.publishers = append(a.publishers, namedPublisher{name, p})
+}
+
+// takePublisher removes the publisher called name, for an event
+// destination to call instead.
+func (a *App) takePublisher(name string) (ClickPublisher, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, p := range a.publishers {
+		if p.name == name {
+			a.publishers = slices.Delete(slices.Clone(a.publishers), i, i+1)
+			return p.publish, true
+		}
+	}
+	return nil, false
+}
+
+// RegisterBackgroundJob runs fn once at startup and then every interval
+// until shutdown. A pass never overlaps the previous one. Jobs that write
+// should return early when inMaintenance() is true.
+func (a *App) RegisterBackgroundJob(name string, interval time.Duration, fn func(context.Context) error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.jobs = append(a.jobs, backgroundJob{name, interval, fn})
+}
+
+// RegisterRoutes adds routes next to the built-in API. They are not served
+// on a resolver-only edge.
+func (a *App) RegisterRoutes(fn func(*gin.RouterGroup)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.routes = append(a.routes, fn)
+}
+
+// OnStartup adds a hook run before background jobs start and before the
+// service takes traffic.
+func (a *App) OnStartup(name string, timeout time.Duration, fn func(context.Context) error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.startup = append(a.startup, appHook{name, timeout, fn})
+}
+
+// OnShutdown adds a hook run when the service stops, after background jobs
+// have stopped. Hooks registered later run earlier.
+func (a *App) OnShutdown(name string, timeout time.Duration, fn func(context.Context) error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.shutdown = append(a.shutdown, appHook{name, timeout, fn})
+}
+
+// start runs the startup hooks and starts the background jobs. Hooks may
+// register more jobs.
+func (a *App) start() {
+	a.mu.Lock()
+	startup := a.startup
+	a.mu.Unlock()
+	for _, h := range startup {
+		if err := h.call(); err != nil {
+			log.Fatalf("Startup hook %s failed: %v", h.name, err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var jobCtx context.Context
+	jobCtx, a.stopJobs = context.WithCancel(context.Background())
+	for _, job := range a.jobs {
+		a.jobsDone.Add(1)
+		go func() {
+			defer a.jobsDone.Done()
+			job.loop(jobCtx)
+		}()
+	}
+}
+
+// stop stops the background jobs and runs the shutdown hooks. A hook that
+// fails or times out is logged and the rest still run.
+func (a *App) stop() {
+	a.mu.Lock()
+	stopJobs, shutdown := a.stopJobs, a.shutdown
+	a.mu.Unlock()
+	if stopJobs != nil {
+		stopJobs()
+		a.jobsDone.Wait()
+	}
+	for i := len(shutdown) - 1; i >= 0; i-- {
+		h := shutdown[i]
+		if err := h.call(); err != nil {
+			log.Printf("Shutdown hook %s failed: %v", h.name, err)
+		}
+	}
+}
+
+// registerRoutes mounts the extension routes on r.
+func (a *App) registerRoutes(r *gin.Engine) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, fn := range a.routes {
+		fn(&r.RouterGroup)
+	}
+}
+
+// publish hands event to the extension publishers.
+func (a *App) publish(ctx context.Context, event ClickEvent) {
+	a.mu.Lock()
+	publishers := a.publishers
+	a.mu.Unlock()
+	for _, p := range publishers {
+		if err := p.publish(ctx, event); err != nil {
+			appPublisherStats.Add(p.name+".errors", 1)
+			log.Printf("Click publisher %s failed: %v", p.name, err)
+			continue
+		}
+		appPublisherStats.Add(p.name+".publishes", 1)
+	}
+}
+
+func (h appHook) call() error {
+	hookCtx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.fn(hookCtx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-hookCtx.Done():
+		return hookCtx.Err()
+	}
+}
+
+func (job backgroundJob) loop(ctx context.Context) {
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := job.run(ctx)
+		appJobStats.Add(job.name+".runs", 1)
+		setGauge(appJobStats, job.name+".last_duration_ms", time.Since(start).Milliseconds())
+		if err != nil && ctx.Err() == nil {
+			appJobStats.Add(job.name+".errors", 1)
+			log.Printf("Background job %s failed: %v", job.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
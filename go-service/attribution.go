@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Conversion attribution: each click remembers itself in Redis under the
+// visitor's attribution key for CONVERSION_ATTRIBUTION_WINDOW, and a
+// conversion pixel hit on the same code within that window is stored with
+// the click's id and the click-to-conversion latency. Anything else is
+// recorded as unattributed. A window of 0 turns attribution off.
+var conversionAttributionWindow = getEnvDuration("CONVERSION_ATTRIBUTION_WINDOW", 7*24*time.Hour)
+
+const attributionKeyPrefix = "attr:"
+
+// attributionVisitor returns the raw key a click is remembered under, or ""
+// when attribution is off or the visitor opted out. It is hashed on the
+// publisher worker, off the redirect path.
+func (s *Server) attributionVisitor(c *gin.Context) string {
+	if conversionAttributionWindow <= 0 || s.rdb == nil || resolverOnly || trackingOptedOut(c) {
+		return ""
+	}
+	return clientIP(c) + "|" + c.Request.UserAgent()
+}
+
+// attributionKey is the Redis key for a visitor's latest click on a code.
+// Unlike visitorHash it does not rotate daily, since the window spans days,
+// but it only ever lives in Redis and expires with the window.
+func attributionKey(shortCode, visitor string) string {
+	sum := sha256.Sum256([]byte(visitorHashSalt + "|attribution|" + visitor))
+	return attributionKeyPrefix + shortCode + ":" + hex.EncodeToString(sum[:16])
+}
+
+// rememberClick records clickID as the visitor's latest click on shortCode.
+func (s *Server) rememberClick(ctx context.Context, shortCode, visitor, clickID string, clickedAt time.Time) {
+	value := clickID + "|" + strconv.FormatInt(clickedAt.UnixMilli(), 10)
+	if err := s.rdb.Set(ctx, attributionKey(shortCode, visitor), value, conversionAttributionWindow).Err(); err != nil && !redisUnavailable(err) {
+		log.Printf("Error remembering click for attribution on %s: %v", shortCode, err)
+	}
+}
+
+// attributeConversion finds the visitor's click that a conversion at the
+// given time belongs to. ok is false when there is none within the window.
+func (s *Server) attributeConversion(ctx context.Context, shortCode, visitor string, at time.Time) (clickID string, latency time.Duration, ok bool) {
+	if visitor == "" {
+		return "", 0, false
+	}
+	value, err := s.rdb.Get(ctx, attributionKey(shortCode, visitor)).Result()
+	if err != nil {
+		if err != redis.Nil && !redisUnavailable(err) {
+			log.Printf("Error looking up attribution for %s: %v", shortCode, err)
+		}
+		return "", 0, false
+	}
+	clickID, millis, found := strings.Cut(value, "|")
+	ms, err := strconv.ParseInt(millis, 10, 64)
+	if !found || err != nil {
+		return "", 0, false
+	}
+	latency = at.Sub(time.UnixMilli(ms))
+	if latency < 0 || latency > conversionAttributionWindow {
+		return "", 0, false
+	}
+	return clickID, latency, true
+}
+
+// attributionStats adds attributed and unattributed conversion counts and
+// the median click-to-conversion time to a stats response.
+func (s *Server) attributionStats(ctx context.Context, shortCode string, conversions int64, response gin.H) error {
+	var attributed int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM conversions WHERE short_code = ? AND click_id IS NOT NULL", shortCode).Scan(&attributed); err != nil {
+		return err
+	}
+	response["attributed_conversions"] = attributed
+	response["unattributed_conversions"] = conversions - attributed
+	if attributed == 0 {
+		response["median_time_to_convert_seconds"] = nil
+		return nil
+	}
+
+	// The middle one or two latencies, depending on the count's parity.
+	rows, err := s.db.QueryContext(ctx, `SELECT click_latency_ms FROM conversions WHERE short_code = ? AND click_id IS NOT NULL
+		ORDER BY click_latency_ms LIMIT ? OFFSET ?`, shortCode, 2-attributed%2, (attributed-1)/2)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var sum, n int64
+	for rows.Next() {
+		var ms sql.NullInt64
+		if err := rows.Scan(&ms); err != nil {
+			return err
+		}
+		sum += ms.Int64
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n > 0 {
+		response["median_time_to_convert_seconds"] = float64(sum) / float64(n) / 1000
+	}
+	return nil
+}
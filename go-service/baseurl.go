@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Short URLs handed out in responses start with BASE_URL, e.g.
+// https://sho.rt or https://example.com/s. Unset, they are built from the
+// request: its Host, or X-Forwarded-Host and X-Forwarded-Proto when it came
+// through a trusted proxy (TRUSTED_PROXIES).
+var baseURL = strings.TrimRight(getEnv("BASE_URL", ""), "/")
+
+// initBaseURL rejects a BASE_URL that would produce broken links.
+func initBaseURL() {
+	if baseURL == "" {
+		return
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil ||
+		u.RawQuery != "" || u.Fragment != "" {
+		log.Fatalf("Invalid BASE_URL %q: must be an absolute http(s) URL without credentials, query or fragment", baseURL)
+	}
+}
+
+// publicBaseURL is the scheme, host and any path prefix short URLs are
+// served under for this request, without a trailing slash.
+func publicBaseURL(c *gin.Context) string {
+	if baseURL != "" {
+		return baseURL
+	}
+	scheme, host := "http", c.Request.Host
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if peer, err := parseRemoteAddr(c.Request.RemoteAddr); err == nil && trustedProxies.Contains(peer) {
+		if proto := firstHeaderValue(c.GetHeader("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost := firstHeaderValue(c.GetHeader("X-Forwarded-Host")); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+// firstHeaderValue is the first of a comma-separated header's values, which
+// is the one the outermost proxy set.
+func firstHeaderValue(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.ToLower(strings.TrimSpace(first))
+}
+
+// shortURLFor is the public URL of shortCode under base, as returned by
+// publicBaseURL.
+func shortURLFor(base, shortCode string) string {
+	return base + "/" + shortCode
+}
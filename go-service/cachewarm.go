@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// New links are written through to the cache, so their first redirect is
+// as fast as the rest. With CACHE_WARM_ON_START the CACHE_WARM_COUNT most
+// recently created, or with CACHE_WARM_ORDER=clicks most clicked, links are
+// also loaded into Redis when the server starts. /readyz answers 503 until
+// warming is done, for at most CACHE_WARM_TIMEOUT; without Redis there is
+// nothing to warm.
+var (
+	cacheWarmOnStart = getEnvBool("CACHE_WARM_ON_START", false)
+	cacheWarmCount   = getEnvInt("CACHE_WARM_COUNT", 10000)
+	cacheWarmOrder   = getEnv("CACHE_WARM_ORDER", "recent")
+	cacheWarmTimeout = getEnvDuration("CACHE_WARM_TIMEOUT", 30*time.Second)
+)
+
+// cacheWarmBatch is how many entries go to Redis in one pipeline.
+const cacheWarmBatch = 500
+
+// cacheWarming is set while startup warming runs.
+var cacheWarming atomic.Bool
+
+var cacheWarmOrders = map[string]string{
+	"recent": "u.created_at DESC, u.id DESC",
+	"clicks": "u.imported_clicks + COALESCE(cc.clicks, 0) DESC, u.id DESC",
+}
+
+// cacheNewLink writes the cache entry of a link just created under
+// shortCode, as its first redirect would. Links redirect doesn't cache
+// straight away, such as challenge, scheduled, password-protected or
+// quarantined ones, only lose any not-found entry.
+func (s *Server) cacheNewLink(ctx context.Context, req ShortenRequest, shortCode string) {
+	if s.rdb == nil {
+		return
+	}
+	if req.isTest || req.Challenge || req.ActiveFrom != nil || req.Password != "" || initialScanStatus(req.isTest) != nil || req.flagged() {
+		s.forgetNotFound(ctx, shortCode)
+		return
+	}
+	_, expires := req.linkTimes()
+	expiresAt := sql.NullString{String: expires, Valid: expires != ""}
+	ttl := linkCacheTTL(expiresAt, time.Now())
+	if ttl <= 0 {
+		s.forgetNotFound(ctx, shortCode)
+		return
+	}
+	// A not-found entry replaced may be held locally by any instance.
+	previous, err := s.rdb.SetArgs(ctx, urlCacheKey(shortCode), encodeCachedLink(req.LongURL, req.Hot, req.RedirectType, expiresAt, req.UTM.encode()),
+		redis.SetArgs{TTL: ttl, Get: true}).Result()
+	if err != nil && err != redis.Nil && !redisUnavailable(err) {
+		log.Printf("Error caching new link %s: %v", shortCode, err)
+	}
+	if previous == notFoundSentinel || err != nil && err != redis.Nil {
+		s.invalidateLocalLinks(ctx, shortCode)
+	}
+}
+
+// startCacheWarming warms the cache in the background when
+// CACHE_WARM_ON_START is set.
+func (s *Server) startCacheWarming() {
+	if !cacheWarmOnStart || s.rdb == nil {
+		return
+	}
+	orderBy, ok := cacheWarmOrders[cacheWarmOrder]
+	if !ok {
+		log.Fatalf("Invalid CACHE_WARM_ORDER %q: must be recent or clicks", cacheWarmOrder)
+	}
+	cacheWarming.Store(true)
+	go func() {
+		defer cacheWarming.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), cacheWarmTimeout)
+		defer cancel()
+		start := time.Now()
+		n, err := s.warmCache(ctx, orderBy)
+		if err != nil {
+			log.Printf("Cache warming stopped after %d links: %v", n, err)
+			return
+		}
+		log.Printf("Warmed the cache with %d links in %s", n, time.Since(start).Round(time.Millisecond))
+	}()
+}
+
+// warmCache loads up to cacheWarmCount links redirect would cache, in
+// orderBy order, without replacing entries already there.
+func (s *Server) warmCache(ctx context.Context, orderBy string) (int, error) {
+	now := time.Now()
+	nowRFC3339 := now.UTC().Format(time.RFC3339)
+	rows, err := s.db.QueryContext(ctx, `SELECT u.short_code, u.long_url, u.hot, u.redirect_type, u.expires_at, u.utm
+		FROM urls u LEFT JOIN click_counters cc ON cc.short_code = u.short_code
+		WHERE u.is_test = 0 AND u.status = 'active' AND u.challenge = 0 AND u.password_hash IS NULL AND (u.active_from IS NULL OR u.activated = 1 AND u.active_from <= ?)
+			AND (u.expires_at IS NULL OR u.expires_at > ?) AND (u.scan_status IS NULL OR NOT u.`+scanBlockedCondition+`)
+		ORDER BY `+orderBy+` LIMIT ?`, nowRFC3339, nowRFC3339, cacheWarmCount)
+	if err != nil {
+		return 0, err
+	}
+	type entry struct {
+		key   string
+		value string
+		ttl   time.Duration
+	}
+	var entries []entry
+	for rows.Next() {
+		var shortCode, longURL string
+		var hot bool
+		var redirectType sql.NullInt64
+		var expiresAt, utm sql.NullString
+		if err := rows.Scan(&shortCode, &longURL, &hot, &redirectType, &expiresAt, &utm); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if ttl := linkCacheTTL(expiresAt, now); ttl > 0 {
+			entries = append(entries, entry{urlCacheKey(shortCode), encodeCachedLink(longURL, hot, int(redirectType.Int64), expiresAt, utm.String), ttl})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	warmed := 0
+	for i := 0; i < len(entries); i += cacheWarmBatch {
+		batch := entries[i:min(i+cacheWarmBatch, len(entries))]
+		_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, e := range batch {
+				pipe.SetNX(ctx, e.key, e.value, e.ttl)
+			}
+			return nil
+		})
+		if err != nil {
+			return warmed, err
+		}
+		warmed += len(batch)
+	}
+	return warmed, nil
+}
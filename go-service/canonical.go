@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reusing links compares destinations by canonical hash, not by the stored
+// long_url: a canonicalization profile decides which differences don't make
+// two URLs different links. The stored and redirected URL is never changed;
+// a reused link keeps the destination it was created with. Owners may set
+// their own profile; everyone else gets the one from CANONICAL_* settings.
+// Links keep the hash computed when they were stored, so after a profile
+// changes, -backfill-canonical or POST /admin/canonical/backfill recomputes
+// them.
+type canonicalProfile struct {
+	// SortQuery orders query parameters, so ?a=1&b=2 matches ?b=2&a=1.
+	SortQuery bool `json:"sort_query"`
+	// IgnoreParams are query parameters left out, such as ref or utm_*,
+	// matched as REDACT_QUERY_PARAMS is.
+	IgnoreParams []string `json:"ignore_params"`
+	// StripFragment leaves out the #fragment. Off by default, since
+	// single-page apps route by fragment.
+	StripFragment bool `json:"strip_fragment"`
+
+	ignore []redactRule
+}
+
+// maxCanonicalIgnoreParams caps an owner's ignore list.
+const maxCanonicalIgnoreParams = 50
+
+// canonicalBackfillBatch is how many links a backfill reads at a time.
+const canonicalBackfillBatch = 500
+
+var globalCanonicalProfile = newCanonicalProfile(canonicalProfile{
+	SortQuery:     getEnvBool("CANONICAL_SORT_QUERY", true),
+	IgnoreParams:  splitList(getEnv("CANONICAL_IGNORE_PARAMS", "")),
+	StripFragment: getEnvBool("CANONICAL_STRIP_FRAGMENT", false),
+})
+
+func newCanonicalProfile(p canonicalProfile) *canonicalProfile {
+	if p.IgnoreParams == nil {
+		p.IgnoreParams = []string{}
+	}
+	p.ignore = parseRedactParams(strings.Join(p.IgnoreParams, ","))
+	return &p
+}
+
+// canonicalURL is the form of longURL, as normalizeLongURL returns it, that
+// equal destinations share under p. The host is already lowercase.
+func (p *canonicalProfile) canonicalURL(longURL string) string {
+	u, err := url.Parse(longURL)
+	if err != nil {
+		return longURL
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	var pairs []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if pair == "" || matchesParamRule(p.ignore, queryKey(pair)) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	if p.SortQuery {
+		slices.Sort(pairs)
+	}
+
+	var b strings.Builder
+	b.WriteString(u.Scheme + "://" + u.Host + path)
+	if len(pairs) > 0 {
+		b.WriteString("?" + strings.Join(pairs, "&"))
+	}
+	if u.Fragment != "" && !p.StripFragment {
+		b.WriteString("#" + u.EscapedFragment())
+	}
+	return b.String()
+}
+
+// hash is what urls.canonical_hash holds for longURL under p.
+func (p *canonicalProfile) hash(longURL string) string {
+	sum := sha256.Sum256([]byte(p.canonicalURL(longURL)))
+	return hex.EncodeToString(sum[:])
+}
+
+// validate rejects a profile an owner may not store.
+func (p *canonicalProfile) validate() error {
+	if len(p.IgnoreParams) > maxCanonicalIgnoreParams {
+		return fmt.Errorf("ignore_params may list at most %d parameters", maxCanonicalIgnoreParams)
+	}
+	for _, name := range p.IgnoreParams {
+		if strings.TrimSuffix(strings.TrimSpace(name), "*") == "" {
+			return errors.New("ignore_params entries must not be empty")
+		}
+	}
+	return nil
+}
+
+// ownerCanonicalProfile is the owner's profile, or the global one if the
+// owner has none.
+func (s *Server) ownerCanonicalProfile(ctx context.Context, owner string) (*canonicalProfile, error) {
+	if owner == "" {
+		return globalCanonicalProfile, nil
+	}
+	var raw string
+	err := s.db.QueryRowContext(ctx, "SELECT profile FROM owner_canonical_profiles WHERE owner = ?", owner).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return globalCanonicalProfile, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p canonicalProfile
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		return nil, fmt.Errorf("canonical profile of %s: %w", owner, err)
+	}
+	return newCanonicalProfile(p), nil
+}
+
+// getCanonicalProfile serves GET /api/settings/canonical.
+func (s *Server) getCanonicalProfile(c *gin.Context) {
+	profile, err := s.ownerCanonicalProfile(c.Request.Context(), c.GetString(ownerContextKey))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"profile": profile, "inherited": profile == globalCanonicalProfile})
+}
+
+// putCanonicalProfile serves PUT /api/settings/canonical, which sets the
+// owner's profile. Links already stored keep their hashes until a backfill.
+func (s *Server) putCanonicalProfile(c *gin.Context) {
+	owner := c.GetString(ownerContextKey)
+	if owner == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A canonicalization profile needs an authenticated owner"})
+		return
+	}
+	var p canonicalProfile
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := p.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	profile := newCanonicalProfile(p)
+	raw, err := json.Marshal(profile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store profile"})
+		return
+	}
+	_, err = s.execWithRetry(c.Request.Context(), `INSERT INTO owner_canonical_profiles (owner, profile) VALUES (?, ?)
+		ON CONFLICT (owner) DO UPDATE SET profile = excluded.profile, updated_at = datetime()`, owner, string(raw))
+	writeCanonicalProfileResult(c, err, profile)
+}
+
+// deleteCanonicalProfile serves DELETE /api/settings/canonical, returning
+// the owner to the global profile.
+func (s *Server) deleteCanonicalProfile(c *gin.Context) {
+	_, err := s.execWithRetry(c.Request.Context(), "DELETE FROM owner_canonical_profiles WHERE owner = ?", c.GetString(ownerContextKey))
+	writeCanonicalProfileResult(c, err, globalCanonicalProfile)
+}
+
+func writeCanonicalProfileResult(c *gin.Context, err error, profile *canonicalProfile) {
+	if errors.Is(err, errDBBusy) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"profile": profile, "inherited": profile == globalCanonicalProfile})
+}
+
+// canonicalBackfillReport counts the links a backfill looked at and the
+// hashes it changed.
+type canonicalBackfillReport struct {
+	Scanned int64 `json:"scanned"`
+	Updated int64 `json:"updated"`
+}
+
+// backfillCanonicalHashes recomputes canonical_hash for every link, or for
+// one owner's, under the profiles in effect now. It works in batches so
+// writers are not blocked for long.
+func (s *Server) backfillCanonicalHashes(ctx context.Context, owner string) (canonicalBackfillReport, error) {
+	var report canonicalBackfillReport
+	profiles := map[string]*canonicalProfile{}
+	var lastID int64
+	for {
+		type link struct {
+			id            int64
+			longURL, hash string
+			owner         sql.NullString
+		}
+		query := "SELECT id, long_url, COALESCE(canonical_hash, ''), owner FROM urls WHERE id > ?"
+		args := []any{lastID}
+		if owner != "" {
+			query += " AND owner = ?"
+			args = append(args, owner)
+		}
+		rows, err := s.db.QueryContext(ctx, query+" ORDER BY id LIMIT ?", append(args, canonicalBackfillBatch)...)
+		if err != nil {
+			return report, err
+		}
+		var batch []link
+		for rows.Next() {
+			var l link
+			if err := rows.Scan(&l.id, &l.longURL, &l.hash, &l.owner); err != nil {
+				rows.Close()
+				return report, err
+			}
+			batch = append(batch, l)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return report, err
+		}
+		if len(batch) == 0 {
+			return report, nil
+		}
+
+		for _, l := range batch {
+			lastID = l.id
+			report.Scanned++
+			profile, ok := profiles[l.owner.String]
+			if !ok {
+				if profile, err = s.ownerCanonicalProfile(ctx, l.owner.String); err != nil {
+					return report, err
+				}
+				profiles[l.owner.String] = profile
+			}
+			hash := profile.hash(l.longURL)
+			if hash == l.hash {
+				continue
+			}
+			if _, err := s.execWithRetry(ctx, "UPDATE urls SET canonical_hash = ? WHERE id = ?", hash, l.id); err != nil {
+				return report, err
+			}
+			report.Updated++
+		}
+	}
+}
+
+// postCanonicalBackfill serves POST /admin/canonical/backfill?owner=.
+func (s *Server) postCanonicalBackfill(c *gin.Context) {
+	if inMaintenance() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service is in maintenance mode, try again later", "code": "maintenance"})
+		return
+	}
+	report, err := s.backfillCanonicalHashes(c.Request.Context(), c.Query("owner"))
+	if err != nil {
+		log.Printf("Canonical hash backfill failed after %d links: %v", report.Scanned, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Backfill failed", "scanned": report.Scanned, "updated": report.Updated})
+		return
+	}
+	log.Printf("Canonical hash backfill: %d links scanned, %d updated", report.Scanned, report.Updated)
+	c.JSON(http.StatusOK, report)
+}
+
+// runCanonicalBackfillCLI is -backfill-canonical: it recomputes every
+// link's hash, prints the report as JSON and returns the exit code.
+func (s *Server) runCanonicalBackfillCLI() int {
+	report, err := s.backfillCanonicalHashes(context.Background(), "")
+	if err != nil {
+		log.Printf("Canonical hash backfill failed after %d links: %v", report.Scanned, err)
+		return 1
+	}
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(os.Stdout, string(out))
+	return 0
+}
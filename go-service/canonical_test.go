@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	sorted := newCanonicalProfile(canonicalProfile{SortQuery: true, IgnoreParams: []string{"ref", "utm_*"}})
+	unsorted := newCanonicalProfile(canonicalProfile{})
+	stripped := newCanonicalProfile(canonicalProfile{SortQuery: true, StripFragment: true})
+	tests := []struct {
+		name    string
+		profile *canonicalProfile
+		in      string
+		want    string
+	}{
+		{"params sorted", sorted, "https://shop.example.com/item?size=m&color=red", "https://shop.example.com/item?color=red&size=m"},
+		{"order kept without sorting", unsorted, "https://shop.example.com/item?size=m&color=red", "https://shop.example.com/item?size=m&color=red"},
+		{"ignored keys dropped", sorted, "https://shop.example.com/item?ref=mail&color=red&UTM_Source=x", "https://shop.example.com/item?color=red"},
+		{"only ignored keys", sorted, "https://shop.example.com/item?ref=mail", "https://shop.example.com/item"},
+		{"repeated and empty params", sorted, "https://shop.example.com/?b=2&&a=1&a=0", "https://shop.example.com/?a=0&a=1&b=2"},
+		{"empty path", sorted, "https://shop.example.com", "https://shop.example.com/"},
+		{"fragment kept by default", sorted, "https://app.example.com/#/cart?x=1", "https://app.example.com/#/cart?x=1"},
+		{"fragment stripped", stripped, "https://app.example.com/page?b=1&a=2#top", "https://app.example.com/page?a=2&b=1"},
+		{"escaping kept", sorted, "https://shop.example.com/a%20b?q=x%26y", "https://shop.example.com/a%20b?q=x%26y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.profile.canonicalURL(tt.in); got != tt.want {
+				t.Errorf("canonicalURL(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+	if sorted.hash("https://shop.example.com/item?a=1&b=2") != sorted.hash("https://shop.example.com/item?b=2&a=1&ref=x") {
+		t.Error("equivalent URLs hash differently")
+	}
+}
+
+// shortenAs shortens body with key, returning the response.
+func shortenAs(t *testing.T, r http.Handler, key, body string) ShortenResponse {
+	t.Helper()
+	w := serveTest(r, http.MethodPost, "/api/shorten", body, "X-API-Key: "+key)
+	var resp ShortenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("shorten %s = %d: %s", body, w.Code, w.Body)
+	}
+	return resp
+}
+
+func TestShortenReusesByCanonicalURL(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	if w := serveTest(r, http.MethodPut, "/api/settings/canonical", `{"sort_query":true,"ignore_params":["ref"]}`, "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Fatalf("put profile = %d: %s", w.Code, w.Body)
+	}
+
+	first := shortenAs(t, r, key, `{"long_url":"https://shop.example.com/item?color=red&size=m"}`)
+	for _, long := range []string{
+		"https://Shop.Example.com/item?size=m&color=red",
+		"https://shop.example.com/item?color=red&ref=newsletter&size=m",
+	} {
+		resp := shortenAs(t, r, key, `{"long_url":"`+long+`"}`)
+		if resp.ShortCode != first.ShortCode || !resp.Reused {
+			t.Errorf("%s got %s (reused %v), want %s", long, resp.ShortCode, resp.Reused, first.ShortCode)
+		}
+	}
+	// The stored destination is the one the link was created with.
+	var stored string
+	testServer.db.QueryRow("SELECT long_url FROM urls WHERE short_code = ?", first.ShortCode).Scan(&stored)
+	if stored != "https://shop.example.com/item?color=red&size=m" {
+		t.Errorf("stored long_url = %q", stored)
+	}
+
+	for _, long := range []string{
+		"https://shop.example.com/item?color=blue&size=m",
+		"https://shop.example.com/item?color=red&size=m#reviews",
+	} {
+		if resp := shortenAs(t, r, key, `{"long_url":"`+long+`"}`); resp.ShortCode == first.ShortCode || resp.Reused {
+			t.Errorf("%s reused %s", long, first.ShortCode)
+		}
+	}
+	if resp := shortenAs(t, r, key, `{"long_url":"https://shop.example.com/item?size=m&color=red","reuse_existing":false}`); resp.ShortCode == first.ShortCode {
+		t.Error("reuse_existing false reused the link")
+	}
+	// Another owner has the global profile, which keeps ref.
+	other := shortenAs(t, r, otherKey, `{"long_url":"https://shop.example.com/item?color=red&size=m"}`)
+	if resp := shortenAs(t, r, otherKey, `{"long_url":"https://shop.example.com/item?ref=x&color=red&size=m"}`); resp.ShortCode == other.ShortCode {
+		t.Error("the global profile ignored ref")
+	}
+
+	if w := serveTest(r, http.MethodDelete, "/api/settings/canonical", "", "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Errorf("delete profile = %d: %s", w.Code, w.Body)
+	}
+	w := serveTest(r, http.MethodGet, "/api/settings/canonical", "", "X-API-Key: "+key)
+	var got struct{ Inherited bool }
+	if json.Unmarshal(w.Body.Bytes(), &got); !got.Inherited {
+		t.Errorf("profile after delete = %s, want the global one", w.Body)
+	}
+	if w := serveTest(r, http.MethodPut, "/api/settings/canonical", `{"ignore_params":["*"]}`, "X-API-Key: "+key); w.Code != http.StatusBadRequest {
+		t.Errorf("put an empty ignore entry = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCanonicalBackfill(t *testing.T) {
+	r := testServer.newRouter()
+	owner, key := newTestAPIKey(t, false)
+	old := shortenAs(t, r, key, `{"long_url":"https://docs.example.com/guide?ref=blog&page=2"}`)
+
+	// A new profile leaves stored hashes alone until the backfill.
+	serveTest(r, http.MethodPut, "/api/settings/canonical", `{"sort_query":true,"ignore_params":["ref"]}`, "X-API-Key: "+key)
+	profile, err := testServer.ownerCanonicalProfile(context.Background(), owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashOf := func(code string) string {
+		var hash string
+		testServer.db.QueryRow("SELECT canonical_hash FROM urls WHERE short_code = ?", code).Scan(&hash)
+		return hash
+	}
+	want := profile.hash("https://docs.example.com/guide?page=2")
+	if hashOf(old.ShortCode) == want {
+		t.Fatal("the stored hash changed with the profile")
+	}
+
+	w := serveTest(r, http.MethodPost, "/admin/canonical/backfill?owner="+owner, "", "Authorization: Bearer "+testAdminToken)
+	var report canonicalBackfillReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || report.Scanned != 1 || report.Updated != 1 {
+		t.Fatalf("backfill = %d: %s", w.Code, w.Body)
+	}
+	if hashOf(old.ShortCode) != want {
+		t.Error("the backfill didn't recompute the hash")
+	}
+	if resp := shortenAs(t, r, key, `{"long_url":"https://docs.example.com/guide?page=2"}`); resp.ShortCode != old.ShortCode {
+		t.Errorf("after the backfill got %s, want the old link %s reused", resp.ShortCode, old.ShortCode)
+	}
+
+	// Nothing left to change the second time.
+	report, err = testServer.backfillCanonicalHashes(context.Background(), owner)
+	if err != nil || report.Scanned != 1 || report.Updated != 0 {
+		t.Errorf("second backfill = %+v, %v", report, err)
+	}
+}
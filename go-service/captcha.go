@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tiers whose policy asks for a CAPTCHA (see tier.go) must solve one once
+// CAPTCHA_SECRET is set. API callers send the solved token as
+// X-Captcha-Token, gRPC callers as captcha-token metadata, and the
+// homepage form, which shows the widget for CAPTCHA_SITE_KEY, as its
+// captcha_token field. Tokens are checked with CAPTCHA_VERIFY_URL, which
+// speaks the siteverify protocol Turnstile, hCaptcha and reCAPTCHA share.
+var (
+	captchaSecret    = getEnv("CAPTCHA_SECRET", "")
+	captchaSiteKey   = getEnv("CAPTCHA_SITE_KEY", "")
+	captchaVerifyURL = getEnv("CAPTCHA_VERIFY_URL", "https://challenges.cloudflare.com/turnstile/v0/siteverify")
+)
+
+const (
+	captchaHeader    = "X-Captcha-Token"
+	captchaFormField = "captcha_token"
+)
+
+var captchaClient = &http.Client{Timeout: 5 * time.Second, Transport: newOutboundTransport()}
+
+// captchaTokenFrom is the CAPTCHA token the request carries, if any.
+func captchaTokenFrom(c *gin.Context) string {
+	if token := c.GetHeader(captchaHeader); token != "" {
+		return token
+	}
+	if strings.HasPrefix(c.ContentType(), "application/x-www-form-urlencoded") {
+		return c.PostForm(captchaFormField)
+	}
+	return ""
+}
+
+// verifyCaptcha asks the provider whether token was solved by the client
+// at remoteIP. An error means the provider couldn't say.
+func verifyCaptcha(ctx context.Context, token, remoteIP string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	form := url.Values{"secret": {captchaSecret}, "response": {token}, "remoteip": {remoteIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, captchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("CAPTCHA provider answered " + resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
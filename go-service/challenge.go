@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed templates/challenge.html
+var challengeFS embed.FS
+
+var challengeTemplate = template.Must(template.ParseFS(challengeFS, "templates/challenge.html"))
+
+const challengeCookieName = "sc_challenge"
+
+// challengeTokenTTL bounds how long a solved challenge stays valid.
+var challengeTokenTTL = getEnvDuration("CHALLENGE_TOKEN_TTL", 5*time.Minute)
+
+// challengeSecret signs challenge tokens. Without CHALLENGE_SECRET a random
+// per-process key is used, so tokens don't survive restarts.
+var challengeSecret = []byte(getEnv("CHALLENGE_SECRET", newRandomID()))
+
+// challengeToken binds a token to the code, the client, its issue time and
+// a nonce, so no two challenges share a token. A client has to run the
+// page's script to store it as a cookie and come back with it, which
+// headless scrapers that don't run JS never do.
+func challengeToken(shortCode, client string, issued time.Time, nonce string) string {
+	ts := strconv.FormatInt(issued.Unix(), 10)
+	mac := hmac.New(sha256.New, challengeSecret)
+	mac.Write([]byte(shortCode + "|" + client + "|" + ts + "|" + nonce))
+	return ts + "." + nonce + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validChallengeToken(token, shortCode, client string, now time.Time) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	issued := time.Unix(unix, 0)
+	if now.Sub(issued) > challengeTokenTTL || issued.After(now.Add(time.Minute)) {
+		return false
+	}
+	expected := challengeToken(shortCode, client, issued, parts[1])
+	return hmac.Equal([]byte(token), []byte(expected))
+}
+
+// challengeSpentPrefix keys the tokens already used in Redis.
+const challengeSpentPrefix = "challenge:spent:"
+
+// challengeSpentLocal holds the tokens used while Redis is unavailable,
+// each until it would have expired anyway.
+var challengeSpentLocal = struct {
+	sync.Mutex
+	m         map[string]time.Time
+	lastSweep time.Time
+}{m: map[string]time.Time{}}
+
+// spendChallengeToken marks a valid token used and reports whether it was
+// still unused. Clearing the cookie is up to the client, so a replayed
+// cookie is refused here: a SETNX in Redis, shared by every replica, or
+// this instance's memory without Redis.
+func (s *Server) spendChallengeToken(ctx context.Context, token string, now time.Time) bool {
+	if s.rdb != nil {
+		fresh, err := s.rdb.SetNX(ctx, challengeSpentPrefix+token, 1, challengeTokenTTL+time.Minute).Result()
+		if err == nil {
+			return fresh
+		}
+		if !redisUnavailable(err) {
+			log.Printf("Error spending challenge token, falling back to memory: %v", err)
+		}
+	}
+	local := &challengeSpentLocal
+	local.Lock()
+	defer local.Unlock()
+	if now.Sub(local.lastSweep) > challengeTokenTTL {
+		for t, expires := range local.m {
+			if now.After(expires) {
+				delete(local.m, t)
+			}
+		}
+		local.lastSweep = now
+	}
+	if _, spent := local.m[token]; spent {
+		return false
+	}
+	local.m[token] = now.Add(challengeTokenTTL + time.Minute)
+	return true
+}
+
+// passesChallenge reports whether the request carries a solved challenge.
+// When it doesn't, the challenge page has been written and the hit is
+// counted as challenged instead of as a click.
+func (s *Server) passesChallenge(c *gin.Context, shortCode string) bool {
+	client := clientIP(c) + "|" + c.Request.UserAgent()
+	now := time.Now()
+
+	if token, err := c.Cookie(challengeCookieName); err == nil && validChallengeToken(token, shortCode, client, now) &&
+		s.spendChallengeToken(c.Request.Context(), token, now) {
+		// Single use: clear it so the next visit is challenged again.
+		c.SetCookie(challengeCookieName, "", -1, "/"+shortCode, "", false, true)
+		return true
+	}
+
+	go s.recordChallenged(context.WithoutCancel(c.Request.Context()), shortCode)
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	err := challengeTemplate.Execute(c.Writer, map[string]any{
+		"CookieName": challengeCookieName,
+		"Token":      challengeToken(shortCode, client, now, newRandomID()[:16]),
+		"Path":       "/" + shortCode,
+		"MaxAge":     int(challengeTokenTTL.Seconds()),
+	})
+	if err != nil {
+		log.Printf("Error rendering challenge for %s: %v", shortCode, err)
+	}
+	return false
+}
+
+func (s *Server) recordChallenged(ctx context.Context, shortCode string) {
+	if inMaintenance() {
+		return
+	}
+	if err := s.store.AddChallenged(ctx, shortCode); err != nil {
+		log.Printf("Error recording challenged hit for %s: %v", shortCode, err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var challengeTokenInPage = regexp.MustCompile(`"=" \+ "([^"]+)"`)
+
+func TestChallengeTokenSingleUse(t *testing.T) {
+	for _, withRedis := range []bool{false, true} {
+		name := "local"
+		if withRedis {
+			name = "redis"
+		}
+		t.Run(name, func(t *testing.T) {
+			if withRedis {
+				useRedis(t)
+			}
+			link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/challenged-" + name, Challenge: true}, "")
+			r := redirectEngine()
+
+			w := serveTest(r, http.MethodGet, "/"+link.ShortCode, "")
+			m := challengeTokenInPage.FindStringSubmatch(w.Body.String())
+			if w.Code != http.StatusOK || m == nil {
+				t.Fatalf("first visit = %d without a token: %s", w.Code, w.Body)
+			}
+			cookie := "Cookie: " + challengeCookieName + "=" + m[1]
+			if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, "", cookie); w.Code != defaultRedirectStatus {
+				t.Fatalf("visit with the solved challenge = %d, want %d", w.Code, defaultRedirectStatus)
+			}
+			if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, "", cookie); w.Code != http.StatusOK {
+				t.Errorf("replayed challenge cookie = %d, want the challenge page again", w.Code)
+			}
+		})
+	}
+}
+
+func TestChallengeTokensDiffer(t *testing.T) {
+	now := time.Now()
+	a := challengeToken("abc", "client", now, newRandomID()[:16])
+	b := challengeToken("abc", "client", now, newRandomID()[:16])
+	if a == b {
+		t.Error("two challenges in the same second got the same token")
+	}
+	if !validChallengeToken(a, "abc", "client", now) || validChallengeToken(a, "abd", "client", now) {
+		t.Error("token not bound to its code")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The change feed is the url_changes table, filled by triggers on urls
+// (migration 10). seq is assigned by SQLite inside the writing transaction,
+// so it is strictly increasing across instances and committed rows never
+// leave holes.
+var (
+	changesRetention = getEnvDuration("CHANGES_RETENTION", 7*24*time.Hour)
+	changesMaxWait   = getEnvDuration("CHANGES_MAX_WAIT", 30*time.Second)
+)
+
+const (
+	changesDefaultLimit = 100
+	changesMaxLimit     = 1000
+	changesPollInterval = 250 * time.Millisecond
+)
+
+type urlChange struct {
+	Seq       int64           `json:"seq"`
+	Op        string          `json:"op"`
+	ShortCode string          `json:"code"`
+	Payload   json.RawMessage `json:"payload"`
+	Timestamp string          `json:"ts"`
+}
+
+// getChanges serves GET /api/changes?since_seq=&limit=&wait=. With wait
+// (up to CHANGES_MAX_WAIT) it long-polls until a change after since_seq
+// arrives. A since_seq older than the retained window gets 410 so the client
+// knows to resync rather than silently miss changes.
+func (s *Server) getChanges(c *gin.Context) {
+	since, err := strconv.ParseInt(c.DefaultQuery("since_seq", "0"), 10, 64)
+	if err != nil || since < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "since_seq must be a non-negative integer"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(changesDefaultLimit)))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+		return
+	}
+	limit = min(limit, changesMaxLimit)
+	var wait time.Duration
+	if w := c.Query("wait"); w != "" {
+		if wait, err = time.ParseDuration(w); err != nil || wait < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wait must be a duration such as 30s"})
+			return
+		}
+		wait = min(wait, changesMaxWait)
+	}
+
+	var oldest int64
+	if err := s.db.QueryRowContext(c.Request.Context(), "SELECT COALESCE(MIN(seq), 0) FROM url_changes").Scan(&oldest); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if oldest > 0 && since < oldest-1 {
+		c.JSON(http.StatusGone, gin.H{"error": "since_seq is older than the retained changes", "oldest_seq": oldest})
+		return
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		changes, err := s.changesSince(c.Request.Context(), since, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if len(changes) > 0 || !time.Now().Before(deadline) {
+			next := since
+			if len(changes) > 0 {
+				next = changes[len(changes)-1].Seq
+			}
+			c.JSON(http.StatusOK, gin.H{"changes": changes, "next_seq": next})
+			return
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(changesPollInterval):
+		}
+	}
+}
+
+func (s *Server) changesSince(ctx context.Context, since int64, limit int) ([]urlChange, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT seq, op, short_code, payload, created_at FROM url_changes WHERE seq > ? ORDER BY seq LIMIT ?", since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []urlChange{}
+	for rows.Next() {
+		var ch urlChange
+		var payload string
+		if err := rows.Scan(&ch.Seq, &ch.Op, &ch.ShortCode, &payload, &ch.Timestamp); err != nil {
+			return nil, err
+		}
+		ch.Payload = json.RawMessage(payload)
+		changes = append(changes, ch)
+	}
+	return changes, rows.Err()
+}
+
+func (s *Server) registerChangesCompactor() {
+	app.RegisterBackgroundJob("changes_compactor", time.Hour, s.compactChanges)
+}
+
+// compactChanges drops changes older than CHANGES_RETENTION. It only ever
+// removes a prefix of the feed (everything up to the newest expired seq),
+// so the retained window has no gaps.
+func (s *Server) compactChanges(ctx context.Context) error {
+	if inMaintenance() {
+		return nil
+	}
+	cutoff := time.Now().UTC().Add(-changesRetention).Format(time.RFC3339)
+	res, err := s.db.ExecContext(ctx, `DELETE FROM url_changes WHERE seq <= (SELECT COALESCE(MAX(seq), 0) FROM url_changes WHERE created_at < ?)`, cutoff)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Compacted %d url_changes rows", n)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Chaos targets that faults can be injected into.
+const (
+	chaosTargetCache = "cache"
+	chaosTargetStore = "store"
+	chaosTargetHTTP  = "http"
+)
+
+// chaosEnabled gates fault injection entirely. Without CHAOS_ENABLED=true the
+// admin endpoint refuses configuration and every hook is a no-op.
+var chaosEnabled = getEnvBool("CHAOS_ENABLED", false)
+
+var errChaosInjected = errors.New("chaos: injected fault")
+
+var chaosStats = expvar.NewMap("chaos")
+
+type chaosTargetConfig struct {
+	ErrorRate   float64       `json:"error_rate"`
+	LatencyRate float64       `json:"latency_rate"`
+	Latency     time.Duration `json:"-"`
+	LatencyText string        `json:"latency"`
+}
+
+type chaosConfig struct {
+	Targets   map[string]chaosTargetConfig `json:"targets"`
+	ExpiresAt time.Time                    `json:"expires_at"`
+}
+
+var activeChaos atomic.Pointer[chaosConfig]
+
+// chaosInject applies the active configuration for target: it may sleep
+// and/or return errChaosInjected. Injected latency honours ctx, like a slow
+// backend behind a client timeout would. Expired configurations are dropped.
+func chaosInject(ctx context.Context, target string) error {
+	cfg := activeChaos.Load()
+	if cfg == nil {
+		return nil
+	}
+	if time.Now().After(cfg.ExpiresAt) {
+		if activeChaos.CompareAndSwap(cfg, nil) {
+			slog.Info("chaos configuration expired")
+		}
+		return nil
+	}
+	t, ok := cfg.Targets[target]
+	if !ok {
+		return nil
+	}
+
+	if t.Latency > 0 && rand.Float64() < t.LatencyRate {
+		chaosStats.Add(target+"_latency", 1)
+		slog.Warn("chaos: injected latency", "chaos", true, "target", target, "latency", t.Latency)
+		timer := time.NewTimer(t.Latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if rand.Float64() < t.ErrorRate {
+		chaosStats.Add(target+"_errors", 1)
+		slog.Warn("chaos: injected error", "chaos", true, "target", target)
+		return errChaosInjected
+	}
+	return nil
+}
+
+// chaosRedisHook injects cache faults before commands reach Redis.
+type chaosRedisHook struct{}
+
+func (chaosRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (chaosRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := chaosInject(ctx, chaosTargetCache); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (chaosRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := chaosInject(ctx, chaosTargetCache); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+type chaosRequest struct {
+	TTL     string                       `json:"ttl" binding:"required"`
+	Targets map[string]chaosTargetConfig `json:"targets" binding:"required"`
+}
+
+func getChaos(c *gin.Context) {
+	cfg := activeChaos.Load()
+	if cfg == nil || time.Now().After(cfg.ExpiresAt) {
+		c.JSON(http.StatusOK, gin.H{"enabled": chaosEnabled, "active": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": chaosEnabled, "active": true, "config": cfg})
+}
+
+func putChaos(c *gin.Context) {
+	if !chaosEnabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Chaos injection disabled; set CHAOS_ENABLED=true"})
+		return
+	}
+
+	var req chaosRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive duration"})
+		return
+	}
+
+	for name, t := range req.Targets {
+		switch name {
+		case chaosTargetCache, chaosTargetStore, chaosTargetHTTP:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown chaos target: " + name})
+			return
+		}
+		if t.ErrorRate < 0 || t.ErrorRate > 1 || t.LatencyRate < 0 || t.LatencyRate > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Rates must be between 0 and 1"})
+			return
+		}
+		if t.LatencyText != "" {
+			d, err := time.ParseDuration(t.LatencyText)
+			if err != nil || d < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid latency for " + name})
+				return
+			}
+			t.Latency = d
+		}
+		req.Targets[name] = t
+	}
+
+	cfg := &chaosConfig{Targets: req.Targets, ExpiresAt: time.Now().Add(ttl)}
+	activeChaos.Store(cfg)
+	slog.Warn("chaos configuration activated", "chaos", true, "targets", len(cfg.Targets), "expires_at", cfg.ExpiresAt)
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "active": true, "config": cfg})
+}
+
+func deleteChaos(c *gin.Context) {
+	activeChaos.Store(nil)
+	slog.Info("chaos configuration cleared")
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Links created without an owner come back with a one-time claim token.
+// Whoever holds it can later take the link into an account with
+// POST /api/urls/:code/claim and a bearer token. Only the token's SHA-256
+// is stored, and it is valid for CLAIM_TOKEN_TTL (0 stops issuing them).
+// Used and expired tokens are kept, so a second attempt gets told which.
+var claimTokenTTL = getEnvDuration("CLAIM_TOKEN_TTL", 30*24*time.Hour)
+
+var (
+	errClaimTokenInvalid = errors.New("invalid claim token")
+	errClaimTokenUsed    = errors.New("claim token already used")
+	errClaimTokenExpired = errors.New("claim token expired")
+)
+
+// linkClaim is a claim token issued for a new link, as the response
+// reports it.
+type linkClaim struct {
+	Token     string
+	ExpiresAt string
+}
+
+// newLinkClaim returns a claim token for req's link, or nil when req has
+// an owner or claims are off.
+func (req ShortenRequest) newLinkClaim(now time.Time) *linkClaim {
+	if req.owner != "" || req.isTest || claimTokenTTL <= 0 {
+		return nil
+	}
+	return &linkClaim{Token: newRandomID(), ExpiresAt: now.Add(claimTokenTTL).UTC().Format(time.RFC3339)}
+}
+
+// store records the claim's hash for shortCode in tx.
+func (claim *linkClaim) store(ctx context.Context, tx *sql.Tx, shortCode string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO link_claims (short_code, token_hash, expires_at) VALUES (?, ?, ?)",
+		shortCode, hashClaimToken(claim.Token), claim.ExpiresAt)
+	return err
+}
+
+func hashClaimToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// claimRequest is the body of POST /api/urls/:code/claim.
+type claimRequest struct {
+	ClaimToken string `json:"claim_token" binding:"required"`
+}
+
+// claimURL serves POST /api/urls/:code/claim. A valid, unused token makes
+// the caller the link's owner and is used up; the link's canonical hash is
+// recomputed under the new owner's profile so reuse finds it.
+func (s *Server) claimURL(c *gin.Context) {
+	owner := c.GetString(ownerContextKey)
+	if owner == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Claiming a link needs an authenticated owner", "code": "owner_required"})
+		return
+	}
+	var req claimRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	shortCode := c.Param("code")
+	profile, err := s.ownerCanonicalProfile(c.Request.Context(), owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	err = s.claimLink(c.Request.Context(), shortCode, req.ClaimToken, owner, profile, time.Now())
+	switch {
+	case errors.Is(err, errClaimTokenInvalid):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Claim token is not valid for this link", "code": "claim_token_invalid"})
+		return
+	case errors.Is(err, errClaimTokenUsed):
+		c.JSON(http.StatusConflict, gin.H{"error": "Claim token has already been used", "code": "claim_token_used"})
+		return
+	case errors.Is(err, errClaimTokenExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "Claim token has expired", "code": "claim_token_expired"})
+		return
+	case errors.Is(err, errDBBusy):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	slog.Info("link claimed", "audit", true, "by", clientIP(c), "owner", owner, "short_code", shortCode)
+	c.JSON(http.StatusOK, gin.H{"short_code": shortCode, "owner": owner})
+}
+
+// claimLink hands shortCode to owner if token is its unused, unexpired
+// claim token. A link without a claim, and a token that doesn't match,
+// are both errClaimTokenInvalid, so codes can't be probed for claims.
+func (s *Server) claimLink(ctx context.Context, shortCode, token, owner string, profile *canonicalProfile, now time.Time) error {
+	return s.txWithRetry(ctx, func(tx *sql.Tx) error {
+		var tokenHash, expiresAt, longURL string
+		var claimedAt sql.NullString
+		err := tx.QueryRowContext(ctx, `SELECT k.token_hash, k.expires_at, k.claimed_at, u.long_url
+			FROM link_claims k JOIN urls u ON u.short_code = k.short_code WHERE k.short_code = ?`, shortCode).
+			Scan(&tokenHash, &expiresAt, &claimedAt, &longURL)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errClaimTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hashClaimToken(token))) != 1 {
+			return errClaimTokenInvalid
+		}
+		if claimedAt.Valid {
+			return errClaimTokenUsed
+		}
+		if expiry, err := time.Parse(time.RFC3339, expiresAt); err != nil || !now.Before(expiry) {
+			return errClaimTokenExpired
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE urls SET owner = ?, canonical_hash = ? WHERE short_code = ? AND owner IS NULL",
+			owner, profile.hash(longURL), shortCode)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errClaimTokenUsed
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE link_claims SET claimed_at = ?, claimed_by = ? WHERE short_code = ?",
+			now.UTC().Format(time.RFC3339), owner, shortCode)
+		return err
+	})
+}
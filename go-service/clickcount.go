@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Authoritative per-code click counts. Each click served here, or ingested
+// from an edge, does an INCR on clicks:<code> and marks the code dirty in a
+// sorted set scored by its latest click; a flusher moves the counts into
+// the click_counters table in batches. Without Redis, or when it fails,
+// the click goes straight to SQLite instead, so counts are never only in a
+// process's memory. In maintenance mode that write is skipped.
+var clickCounterFlushInterval = getEnvDuration("CLICK_COUNTER_FLUSH_INTERVAL", 10*time.Second)
+
+const (
+	clickCounterKeyPrefix  = "clicks:"
+	clickCounterDirtyKey   = "clicks_dirty"
+	clickCounterFlushBatch = 500
+)
+
+func clickCounterKey(shortCode string) string {
+	return clickCounterKeyPrefix + shortCode
+}
+
+// countClick adds one click to shortCode's counter.
+func (s *Server) countClick(ctx context.Context, shortCode string, at time.Time) {
+	if s.rdb != nil {
+		_, err := s.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+			p.Incr(ctx, clickCounterKey(shortCode))
+			p.ZAddGT(ctx, clickCounterDirtyKey, redis.Z{Score: float64(at.UnixMilli()), Member: shortCode})
+			return nil
+		})
+		if err == nil {
+			return
+		}
+		if !redisUnavailable(err) {
+			log.Printf("Error counting click for %s in Redis, writing to the database: %v", shortCode, err)
+		}
+	}
+	if inMaintenance() {
+		return
+	}
+	if err := s.addClickCount(ctx, shortCode, 1, at); err != nil {
+		log.Printf("Error counting click for %s: %v", shortCode, err)
+	}
+}
+
+// addClickCount adds n clicks to the stored counter of an existing link.
+func (s *Server) addClickCount(ctx context.Context, shortCode string, n int64, last time.Time) error {
+	_, err := s.execWithRetry(ctx, `INSERT INTO click_counters (short_code, clicks, last_clicked_at)
+		SELECT ?, CAST(? AS INTEGER), ? WHERE EXISTS (SELECT 1 FROM urls WHERE short_code = ?)
+		ON CONFLICT (short_code) DO UPDATE SET clicks = click_counters.clicks + excluded.clicks,
+			last_clicked_at = CASE WHEN excluded.last_clicked_at > click_counters.last_clicked_at
+				THEN excluded.last_clicked_at ELSE click_counters.last_clicked_at END`,
+		shortCode, n, last.UTC().Format(time.RFC3339), shortCode)
+	return err
+}
+
+func (s *Server) registerClickCounterFlusher() {
+	if s.rdb == nil {
+		return
+	}
+	app.RegisterBackgroundJob("click_counter_flusher", clickCounterFlushInterval, func(ctx context.Context) error {
+		if inMaintenance() {
+			return nil
+		}
+		// Counters written while Redis is unavailable went to the
+		// database, so there is nothing to flush until it is back.
+		err := s.flushClickCounters(ctx)
+		if err == nil {
+			clickCountersFlushedAt.Store(time.Now().Unix())
+		}
+		if err != nil && !redisUnavailable(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// flushClickCounters moves every dirty counter into the database. A click
+// racing the flush re-marks its code, so it is picked up next time; a
+// failed write puts the count back in Redis.
+func (s *Server) flushClickCounters(ctx context.Context) error {
+	for {
+		dirty, err := s.rdb.ZPopMin(ctx, clickCounterDirtyKey, clickCounterFlushBatch).Result()
+		if err != nil {
+			return err
+		}
+		for i, z := range dirty {
+			shortCode := z.Member.(string)
+			n, err := s.rdb.GetDel(ctx, clickCounterKey(shortCode)).Int64()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				// The GetDel may not have happened, so this code is left
+				// marked along with the ones not reached yet.
+				s.rdb.ZAddGT(ctx, clickCounterDirtyKey, dirty[i:]...)
+				return err
+			}
+			if err := s.addClickCount(ctx, shortCode, n, time.UnixMilli(int64(z.Score))); err != nil {
+				// countClickBack re-marks this code; leave the codes not
+				// reached yet marked for the next flush.
+				s.countClickBack(ctx, shortCode, n, z)
+				if rest := dirty[i+1:]; len(rest) > 0 {
+					s.rdb.ZAddGT(ctx, clickCounterDirtyKey, rest...)
+				}
+				return err
+			}
+		}
+		if len(dirty) < clickCounterFlushBatch {
+			return nil
+		}
+	}
+}
+
+func (s *Server) countClickBack(ctx context.Context, shortCode string, n int64, z redis.Z) {
+	_, err := s.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		p.IncrBy(ctx, clickCounterKey(shortCode), n)
+		p.ZAddGT(ctx, clickCounterDirtyKey, z)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Lost %d clicks for %s: %v", n, shortCode, err)
+	}
+}
+
+// clickCountersBuffered reports whether clicks are counted in Redis and
+// flushed, rather than written to the database as they happen.
+func (s *Server) clickCountersBuffered() bool {
+	return s.rdb != nil
+}
+
+// storedClickTotals returns a code's clicks flushed to the database and
+// its last click time as of then ("" if never clicked).
+func (s *Server) storedClickTotals(ctx context.Context, shortCode string) (int64, string, error) {
+	var clicks int64
+	var last sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT clicks, last_clicked_at FROM click_counters WHERE short_code = ?", shortCode).Scan(&clicks, &last)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, "", err
+	}
+	return clicks, last.String, nil
+}
+
+// pendingClickTotals returns a code's clicks counted in Redis but not
+// flushed yet, and the latest one's time ("" if none).
+func (s *Server) pendingClickTotals(ctx context.Context, shortCode string) (int64, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisRequestTimeout)
+	defer cancel()
+	var pending *redis.StringCmd
+	var latest *redis.FloatCmd
+	_, err := s.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		pending = p.Get(ctx, clickCounterKey(shortCode))
+		latest = p.ZScore(ctx, clickCounterDirtyKey, shortCode)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, "", err
+	}
+	var last string
+	if score, err := latest.Result(); err == nil {
+		last = time.UnixMilli(int64(score)).UTC().Format(time.RFC3339)
+	}
+	n, err := pending.Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, last, nil
+	}
+	return n, last, err
+}
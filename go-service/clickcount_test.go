@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestClickCountersFlushConcurrentClicks(t *testing.T) {
+	useRedis(t)
+	ctx := context.Background()
+	a := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/count-a", ReuseExisting: new(bool)}, "")
+	b := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/count-b", ReuseExisting: new(bool)}, "")
+
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code := a.ShortCode
+			if i%4 == 0 {
+				code = b.ShortCode
+			}
+			testServer.countClick(ctx, code, time.Now())
+		}()
+	}
+	wg.Wait()
+	if err := testServer.flushClickCounters(ctx); err != nil {
+		t.Fatalf("flushClickCounters: %v", err)
+	}
+
+	for code, want := range map[string]int64{a.ShortCode: 75, b.ShortCode: 25} {
+		stored, _, err := testServer.storedClickTotals(ctx, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending, _, err := testServer.pendingClickTotals(ctx, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != want || pending != 0 {
+			t.Errorf("%s: stored %d, pending %d; want %d flushed", code, stored, pending, want)
+		}
+	}
+}
+
+// failingGetDel fails the first GETDEL it sees.
+type failingGetDel struct {
+	mu     sync.Mutex
+	failed bool
+}
+
+func (h *failingGetDel) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *failingGetDel) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.mu.Lock()
+		fail := cmd.Name() == "getdel" && !h.failed
+		h.failed = h.failed || fail
+		h.mu.Unlock()
+		if fail {
+			err := errors.New("injected GETDEL failure")
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *failingGetDel) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestClickCountersFlushKeepsCodeOnGetDelError(t *testing.T) {
+	useRedis(t)
+	ctx := context.Background()
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/count-getdel", ReuseExisting: new(bool)}, "")
+	for range 3 {
+		testServer.countClick(ctx, link.ShortCode, time.Now())
+	}
+
+	testServer.rdb.AddHook(&failingGetDel{})
+	if err := testServer.flushClickCounters(ctx); err == nil {
+		t.Fatal("flushClickCounters succeeded despite the GETDEL failure")
+	}
+	if _, err := testServer.rdb.ZScore(ctx, clickCounterDirtyKey, link.ShortCode).Result(); err != nil {
+		t.Fatalf("code no longer marked dirty after the failed flush: %v", err)
+	}
+
+	if err := testServer.flushClickCounters(ctx); err != nil {
+		t.Fatalf("second flushClickCounters: %v", err)
+	}
+	if stored, _, _ := testServer.storedClickTotals(ctx, link.ShortCode); stored != 3 {
+		t.Errorf("stored clicks = %d, want 3", stored)
+	}
+}
+
+// clickStats is the part of GET /api/stats/:code about click counts.
+type clickStats struct {
+	TotalClicks   int64  `json:"total_clicks"`
+	LastClickedAt string `json:"last_clicked_at"`
+	CreatedAt     string `json:"created_at"`
+}
+
+func getClickStats(t *testing.T, code string) clickStats {
+	t.Helper()
+	w := serveTest(testServer.newRouter(), http.MethodGet, "/api/stats/"+code, "", "Authorization: Bearer "+testAdminToken)
+	var stats clickStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("stats of %s = %d: %s", code, w.Code, w.Body)
+	}
+	return stats
+}
+
+// TestClickCountsUnderConcurrentRedirects redirects from many goroutines
+// while counters are being flushed, and expects every click in the stats,
+// both before and after the last flush.
+func TestClickCountsUnderConcurrentRedirects(t *testing.T) {
+	useRedis(t)
+	withLocalCache(t, 100)
+	// Every redirect has to be served, however slowly, for its click to
+	// be counted.
+	withRedirectBudget(t, 10*time.Second, time.Second)
+	ctx := context.Background()
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/count-redirects", ReuseExisting: new(bool)}, "")
+	r := redirectEngine()
+
+	const redirects = 200
+	var wg sync.WaitGroup
+	for i := range redirects {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, ""); w.Code != defaultRedirectStatus {
+				t.Errorf("redirect = %d", w.Code)
+			}
+			if i%50 == 0 {
+				testServer.flushClickCounters(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+	testServer.clickJobs.Wait()
+
+	stats := getClickStats(t, link.ShortCode)
+	if stats.TotalClicks != redirects || stats.LastClickedAt == "" || stats.CreatedAt == "" {
+		t.Errorf("stats before the last flush = %+v, want %d clicks", stats, redirects)
+	}
+	if err := testServer.flushClickCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := getClickStats(t, link.ShortCode); stats.TotalClicks != redirects {
+		t.Errorf("total_clicks after flushing = %d, want %d", stats.TotalClicks, redirects)
+	}
+}
+
+// TestClickCountsWithoutRedis counts straight into the database, so the
+// counts survive a restart without Redis.
+func TestClickCountsWithoutRedis(t *testing.T) {
+	ctx := context.Background()
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/count-no-redis", ReuseExisting: new(bool)}, "")
+	clickedAt := time.Now().Add(-time.Minute)
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testServer.countClick(ctx, link.ShortCode, clickedAt)
+		}()
+	}
+	wg.Wait()
+
+	stored, last, err := testServer.storedClickTotals(ctx, link.ShortCode)
+	if err != nil || stored != 50 || last != clickedAt.UTC().Format(time.RFC3339) {
+		t.Errorf("stored totals = %d, %q (%v); want 50 at %s", stored, last, err, clickedAt.UTC().Format(time.RFC3339))
+	}
+	if stats := getClickStats(t, link.ShortCode); stats.TotalClicks != 50 {
+		t.Errorf("total_clicks = %d, want 50", stats.TotalClicks)
+	}
+
+	// A code that isn't a link is not counted.
+	testServer.countClick(ctx, "no-such-link", clickedAt)
+	if stored, _, _ := testServer.storedClickTotals(ctx, "no-such-link"); stored != 0 {
+		t.Errorf("a missing code got %d clicks", stored)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Click export for the data warehouse: GET /admin/export/clicks streams a
+// time range on demand, and with CLICK_EXPORT_DIR set a background job
+// writes one gzipped file per UTC day plus a manifest of finished days.
+// Rows are read in short keyset pages so ingestion never waits on an export.
+var (
+	clickExportDir      = getEnv("CLICK_EXPORT_DIR", "")
+	clickExportFormat   = getEnv("CLICK_EXPORT_FORMAT", clickExportNDJSON)
+	clickExportInterval = getEnvDuration("CLICK_EXPORT_INTERVAL", time.Hour)
+	// clickExportLag leaves room for late clicks before a day is closed.
+	clickExportLag = getEnvDuration("CLICK_EXPORT_LAG", time.Hour)
+)
+
+const (
+	clickExportCSV    = "csv"
+	clickExportNDJSON = "ndjson"
+
+	clickExportPageSize    = 1000
+	clickExportManifestKey = "clicks/manifest.json"
+)
+
+// clickExportColumns is the CSV header; NDJSON uses the same names.
+var clickExportColumns = []string{"id", "click_id", "short_code", "clicked_at", "received_at"}
+
+type clickExportRow struct {
+	ID         int64  `json:"id"`
+	ClickID    string `json:"click_id,omitempty"`
+	ShortCode  string `json:"short_code"`
+	ClickedAt  string `json:"clicked_at"`
+	ReceivedAt string `json:"received_at,omitempty"`
+}
+
+// clickCursor is a position in clicked_at order: the click with id ID,
+// clicked at At (as SQLite's datetime() renders it). The zero value is the
+// start.
+type clickCursor struct {
+	At string
+	ID int64
+}
+
+// forEachClick calls fn for every click with from <= clicked_at < to that
+// comes after cursor, in clicked_at order. Each page is read and its rows
+// closed before fn runs, so a slow consumer holds no read lock.
+func (s *Server) forEachClick(ctx context.Context, from, to time.Time, cursor clickCursor, fn func(clickExportRow) error) error {
+	fromArg, toArg := from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339)
+	lastAt, lastID := cursor.At, cursor.ID
+	for {
+		rows, err := s.db.QueryContext(ctx, `SELECT id, click_id, short_code, clicked_at, received_at, datetime(clicked_at)
+			FROM clicks
+			WHERE datetime(clicked_at) >= datetime(?) AND datetime(clicked_at) < datetime(?)
+				AND (datetime(clicked_at), id) > (?, ?)
+			ORDER BY datetime(clicked_at), id LIMIT ?`, fromArg, toArg, lastAt, lastID, clickExportPageSize)
+		if err != nil {
+			return err
+		}
+		page := make([]clickExportRow, 0, clickExportPageSize)
+		for rows.Next() {
+			var row clickExportRow
+			var clickID, receivedAt sql.NullString
+			if err := rows.Scan(&row.ID, &clickID, &row.ShortCode, &row.ClickedAt, &receivedAt, &lastAt); err != nil {
+				rows.Close()
+				return err
+			}
+			row.ClickID, row.ReceivedAt = clickID.String, receivedAt.String
+			page = append(page, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, row := range page {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if len(page) < clickExportPageSize {
+			return nil
+		}
+		lastID = page[len(page)-1].ID
+	}
+}
+
+// clickRowWriter encodes export rows in one of the export formats.
+type clickRowWriter interface {
+	Write(clickExportRow) error
+	Flush() error
+}
+
+func newClickRowWriter(format string, w io.Writer) clickRowWriter {
+	if format == clickExportCSV {
+		cw := csv.NewWriter(w)
+		cw.Write(clickExportColumns)
+		return csvClickWriter{cw}
+	}
+	return ndjsonClickWriter{json.NewEncoder(w)}
+}
+
+type csvClickWriter struct{ w *csv.Writer }
+
+func (c csvClickWriter) Write(row clickExportRow) error {
+	return c.w.Write([]string{strconv.FormatInt(row.ID, 10), row.ClickID, row.ShortCode, row.ClickedAt, row.ReceivedAt})
+}
+
+func (c csvClickWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonClickWriter struct{ enc *json.Encoder }
+
+func (n ndjsonClickWriter) Write(row clickExportRow) error { return n.enc.Encode(row) }
+func (n ndjsonClickWriter) Flush() error                   { return nil }
+
+// exportClicks serves GET /admin/export/clicks?from=&to=&format=. from/to
+// take RFC3339 or YYYY-MM-DD (UTC); the default is the last 24 hours.
+//
+// An interrupted export resumes with the same from/to and cursor set to the
+// id of the last row received. With format=ndjson&progress=true a
+// {"type":"progress"} frame with rows so far and the cursor follows each
+// page, and a {"type":"done"} frame ends a complete export.
+func (s *Server) exportClicks(c *gin.Context) {
+	format := c.DefaultQuery("format", clickExportNDJSON)
+	if format != clickExportCSV && format != clickExportNDJSON {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or ndjson"})
+		return
+	}
+	progress := c.Query("progress") == "true"
+	if progress && format != clickExportNDJSON {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "progress frames need format=ndjson"})
+		return
+	}
+
+	var err error
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		if to, err = parseStatsTime(v, time.UTC); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be RFC3339 or YYYY-MM-DD"})
+			return
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := c.Query("from"); v != "" {
+		if from, err = parseStatsTime(v, time.UTC); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be RFC3339 or YYYY-MM-DD"})
+			return
+		}
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	var cursor clickCursor
+	if v := c.Query("cursor"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor must be the id of the last row received"})
+			return
+		}
+		err = s.db.QueryRowContext(c.Request.Context(), "SELECT datetime(clicked_at) FROM clicks WHERE id = ?", id).Scan(&cursor.At)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor row no longer exists; restart from the start or a later from"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		cursor.ID = id
+	}
+
+	contentType := "application/x-ndjson"
+	if format == clickExportCSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="clicks-`+from.UTC().Format("20060102T150405Z")+`.`+format+`"`)
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	w := newClickRowWriter(format, c.Writer)
+	frames := json.NewEncoder(c.Writer)
+	count, last := 0, cursor.ID
+	err = s.forEachClick(c.Request.Context(), from, to, cursor, func(row clickExportRow) error {
+		if err := w.Write(row); err != nil {
+			return err
+		}
+		last = row.ID
+		if count++; count%clickExportPageSize == 0 {
+			w.Flush()
+			if progress {
+				frames.Encode(gin.H{"type": "progress", "rows": count, "cursor": strconv.FormatInt(last, 10)})
+			}
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && progress {
+		err = frames.Encode(gin.H{"type": "done", "rows": count, "cursor": strconv.FormatInt(last, 10)})
+	}
+	if err != nil {
+		// Headers are gone; a truncated body is all the client can see.
+		log.Printf("Error streaming click export: %v", err)
+	}
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore is where scheduled exports are written. Put must replace key
+// atomically, so readers never see a half-written partition or manifest.
+// The filesystem store is the default; an S3-compatible store can be
+// plugged in by assigning clickExportStore before registerClickExporter runs.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// fsBlobStore keeps blobs as files under root, keys being relative paths.
+type fsBlobStore struct {
+	root string
+}
+
+func (s fsBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	path := filepath.Join(s.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s fsBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+var clickExportStore BlobStore
+
+type clickExportPartition struct {
+	Day        string `json:"day"`
+	Key        string `json:"key"`
+	Rows       int    `json:"rows"`
+	ExportedAt string `json:"exported_at"`
+}
+
+// clickExportManifest lists finished days in order. The next run resumes
+// the day after the last one.
+type clickExportManifest struct {
+	Format     string                 `json:"format"`
+	Partitions []clickExportPartition `json:"partitions"`
+}
+
+func (s *Server) registerClickExporter() {
+	if clickExportDir == "" {
+		return
+	}
+	if clickExportFormat != clickExportCSV && clickExportFormat != clickExportNDJSON {
+		log.Fatalf("Invalid CLICK_EXPORT_FORMAT %q: must be csv or ndjson", clickExportFormat)
+	}
+	if clickExportStore == nil {
+		clickExportStore = fsBlobStore{root: clickExportDir}
+	}
+	app.RegisterBackgroundJob("click_exporter", clickExportInterval, func(ctx context.Context) error {
+		return s.runClickExport(ctx, time.Now())
+	})
+}
+
+// runClickExport writes every closed day that isn't in the manifest yet,
+// updating the manifest after each one.
+func (s *Server) runClickExport(ctx context.Context, now time.Time) error {
+	manifest, err := loadClickExportManifest(ctx)
+	if err != nil {
+		return err
+	}
+	if manifest.Format != "" && manifest.Format != clickExportFormat {
+		return errors.New("manifest format is " + manifest.Format + "; CLICK_EXPORT_FORMAT can't change once exports exist")
+	}
+	manifest.Format = clickExportFormat
+
+	var day time.Time
+	if n := len(manifest.Partitions); n > 0 {
+		last, err := time.Parse(time.DateOnly, manifest.Partitions[n-1].Day)
+		if err != nil {
+			return err
+		}
+		day = last.AddDate(0, 0, 1)
+	} else {
+		var first sql.NullString
+		if err := s.db.QueryRowContext(ctx, "SELECT MIN(datetime(clicked_at)) FROM clicks").Scan(&first); err != nil {
+			return err
+		}
+		if !first.Valid {
+			return nil
+		}
+		t, err := time.Parse(time.DateTime, first.String)
+		if err != nil {
+			return err
+		}
+		day = t.Truncate(24 * time.Hour)
+	}
+
+	for ; !day.AddDate(0, 0, 1).Add(clickExportLag).After(now); day = day.AddDate(0, 0, 1) {
+		partition, err := s.exportClickPartition(ctx, day)
+		if err != nil {
+			return err
+		}
+		manifest.Partitions = append(manifest.Partitions, partition)
+		buf, _ := json.MarshalIndent(manifest, "", "  ")
+		if err := clickExportStore.Put(ctx, clickExportManifestKey, bytes.NewReader(buf)); err != nil {
+			return err
+		}
+		log.Printf("Exported %d clicks for %s to %s", partition.Rows, partition.Day, partition.Key)
+	}
+	return nil
+}
+
+// exportClickPartition streams one day, gzipped, into the store.
+func (s *Server) exportClickPartition(ctx context.Context, day time.Time) (clickExportPartition, error) {
+	p := clickExportPartition{
+		Day: day.Format(time.DateOnly),
+		Key: "clicks/dt=" + day.Format(time.DateOnly) + "/clicks." + clickExportFormat + ".gz",
+	}
+
+	pr, pw := io.Pipe()
+	rows := make(chan int, 1)
+	go func() {
+		gz := gzip.NewWriter(pw)
+		w := newClickRowWriter(clickExportFormat, gz)
+		n := 0
+		err := s.forEachClick(ctx, day, day.AddDate(0, 0, 1), clickCursor{}, func(row clickExportRow) error {
+			n++
+			return w.Write(row)
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+		rows <- n
+	}()
+
+	err := clickExportStore.Put(ctx, p.Key, pr)
+	pr.CloseWithError(err)
+	p.Rows = <-rows
+	p.ExportedAt = time.Now().UTC().Format(time.RFC3339)
+	return p, err
+}
+
+func loadClickExportManifest(ctx context.Context) (clickExportManifest, error) {
+	var m clickExportManifest
+	r, err := clickExportStore.Get(ctx, clickExportManifestKey)
+	if errors.Is(err, errBlobNotFound) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+	return m, json.NewDecoder(r).Decode(&m)
+}
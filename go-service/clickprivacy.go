@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/netip"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Click events carry the visitor's referrer, user agent, accept-language
+// and IP, the last as clientIP resolves it behind TRUSTED_PROXIES.
+// PRIVACY_MODE decides what is published of the IP: "raw" (the default),
+// "truncate" to its /24 or /48 network, or "hash" with VISITOR_HASH_SALT.
+// Visitors who opted out of tracking get neither IP nor user agent
+// published, and the referrer is redacted as URLs in logs are.
+const (
+	privacyModeRaw      = "raw"
+	privacyModeTruncate = "truncate"
+	privacyModeHash     = "hash"
+)
+
+var privacyMode = getEnv("PRIVACY_MODE", privacyModeRaw)
+
+// maxClickHeaderLen caps each header copied into a click event, so a
+// client can't make events arbitrarily large.
+const maxClickHeaderLen = 512
+
+func init() {
+	switch privacyMode {
+	case privacyModeRaw, privacyModeTruncate, privacyModeHash:
+	default:
+		log.Fatalf("Invalid PRIVACY_MODE %q: must be raw, truncate or hash", privacyMode)
+	}
+}
+
+// clickVisitor is what a click event says about who clicked, captured on
+// the request goroutine and cleaned up on the publisher worker.
+type clickVisitor struct {
+	referrer       string
+	userAgent      string
+	clientIP       string
+	acceptLanguage string
+	// country and city are set by locate.
+	country, city string
+}
+
+func newClickVisitor(c *gin.Context) clickVisitor {
+	v := clickVisitor{referrer: c.Request.Referer(), acceptLanguage: c.GetHeader("Accept-Language")}
+	if !trackingOptedOut(c) {
+		v.userAgent, v.clientIP = c.Request.UserAgent(), clientIP(c)
+	}
+	return v
+}
+
+// locate looks up where the visitor is, before the IP is anonymized.
+func (v *clickVisitor) locate() {
+	v.country, v.city = clickGeo(v.clientIP)
+}
+
+// fill sets the event's visitor fields as PRIVACY_MODE allows.
+func (v clickVisitor) fill(event *ClickEvent) {
+	if v.referrer != "" {
+		event.Referrer = truncateUTF8(redactURL(v.referrer), maxClickHeaderLen)
+	}
+	event.UserAgent = truncateUTF8(v.userAgent, maxClickHeaderLen)
+	event.AcceptLanguage = truncateUTF8(v.acceptLanguage, maxClickHeaderLen)
+	event.ClientIP = anonymizeIP(v.clientIP)
+	event.Country, event.City = v.country, v.city
+}
+
+// anonymizeIP applies PRIVACY_MODE to ip.
+func anonymizeIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	switch privacyMode {
+	case privacyModeTruncate:
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return ""
+		}
+		bits := 48
+		if addr.Is4() {
+			bits = 24
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return ""
+		}
+		return prefix.Addr().String()
+	case privacyModeHash:
+		sum := sha256.Sum256([]byte(visitorHashSalt + "|ip|" + ip))
+		return hex.EncodeToString(sum[:16])
+	}
+	return ip
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Click rollups keep hourly click counts per code and visitor country ("" when
+// unknown; see geoip.go) in the clicks_hourly table, so
+// GET /api/stats/:code/timeseries and /api/urls/:code/stats/countries work
+// without the Python service's clicks. The publisher workers add each click to an in-process
+// buffer, which cannot fail or block; a flusher writes the buffer to the
+// database every CLICK_ROLLUP_FLUSH_INTERVAL and on shutdown, keeping what
+// it couldn't write for the next try. Hours older than
+// CLICK_ROLLUP_RETENTION (0 keeps them) are pruned hourly.
+var (
+	clickRollupFlushInterval = getEnvDuration("CLICK_ROLLUP_FLUSH_INTERVAL", 10*time.Second)
+	clickRollupRetention     = getEnvDuration("CLICK_ROLLUP_RETENTION", 90*24*time.Hour)
+)
+
+// clickRollupMaxPending bounds the buffer while the database is
+// unavailable; clicks for hours beyond it are dropped.
+const clickRollupMaxPending = 100000
+
+var clickRollupsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "urlshortener_click_rollups_dropped_total",
+	Help: "Clicks left out of the hourly rollups because the unflushed buffer was full.",
+})
+
+type clickRollupKey struct {
+	shortCode string
+	hour      int64
+	country   string
+}
+
+// clickRollupBuffer counts clicks per code, UTC hour and country until
+// they are flushed.
+type clickRollupBuffer struct {
+	mu     sync.Mutex
+	counts map[clickRollupKey]int64
+}
+
+var clickRollups = &clickRollupBuffer{counts: map[clickRollupKey]int64{}}
+
+func (b *clickRollupBuffer) add(shortCode, country string, at time.Time, n int64) {
+	key := clickRollupKey{shortCode, at.Unix() / 3600, country}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.counts[key]; !ok && len(b.counts) >= clickRollupMaxPending {
+		clickRollupsDropped.Add(float64(n))
+		return
+	}
+	b.counts[key] += n
+}
+
+func (b *clickRollupBuffer) take() map[clickRollupKey]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counts := b.counts
+	b.counts = map[clickRollupKey]int64{}
+	return counts
+}
+
+// pending adds shortCode's unflushed hours to counts, by hour start, over
+// every country.
+func (b *clickRollupBuffer) pending(shortCode string, counts map[time.Time]int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, n := range b.counts {
+		if key.shortCode == shortCode {
+			counts[time.Unix(key.hour*3600, 0).UTC()] += n
+		}
+	}
+}
+
+// pendingCountries adds shortCode's unflushed clicks in hours from from
+// and before to to counts, by country.
+func (b *clickRollupBuffer) pendingCountries(shortCode string, from, to time.Time, counts map[string]int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, n := range b.counts {
+		hour := time.Unix(key.hour*3600, 0)
+		if key.shortCode == shortCode && !hour.Before(from) && hour.Before(to) {
+			counts[key.country] += n
+		}
+	}
+}
+
+// startClickRollups registers the flusher and pruner. It runs before the
+// click publishers start, so its shutdown hook flushes after they drain.
+func (s *Server) startClickRollups() {
+	app.OnShutdown("click_rollups", 5*time.Second, s.flushClickRollups)
+	app.RegisterBackgroundJob("click_rollup_flusher", clickRollupFlushInterval, func(ctx context.Context) error {
+		if inMaintenance() {
+			return nil
+		}
+		return s.flushClickRollups(ctx)
+	})
+	if clickRollupRetention <= 0 {
+		return
+	}
+	app.RegisterBackgroundJob("click_rollup_pruner", time.Hour, func(ctx context.Context) error {
+		if inMaintenance() {
+			return nil
+		}
+		cutoff := time.Now().UTC().Add(-clickRollupRetention).Truncate(time.Hour).Format(time.RFC3339)
+		res, err := s.execWithRetry(ctx, "DELETE FROM clicks_hourly WHERE hour < ?", cutoff)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Pruned %d hourly click rollups before %s", n, cutoff)
+		}
+		return nil
+	})
+}
+
+// flushClickRollups adds the buffered counts to clicks_hourly, and to the
+// daily usage of the links' owners along with the buffered key usage (see
+// usage.go), in one transaction, putting them back in the buffers if it
+// fails. Counts for links deleted meanwhile are dropped.
+func (s *Server) flushClickRollups(ctx context.Context) error {
+	counts, usage := clickRollups.take(), keyUsage.take()
+	if len(counts) == 0 && len(usage) == 0 {
+		return nil
+	}
+	err := s.txWithRetry(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `INSERT INTO clicks_hourly (short_code, hour, country, clicks)
+			SELECT ?, ?, ?, CAST(? AS INTEGER) WHERE EXISTS (SELECT 1 FROM urls WHERE short_code = ?)
+			ON CONFLICT (short_code, hour, country) DO UPDATE SET clicks = clicks_hourly.clicks + excluded.clicks`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		ownerStmt, err := tx.PrepareContext(ctx, `INSERT INTO key_usage_daily (owner, day, clicks)
+			SELECT owner, ?, CAST(? AS INTEGER) FROM urls WHERE short_code = ? AND owner IS NOT NULL
+			ON CONFLICT (owner, day) DO UPDATE SET clicks = key_usage_daily.clicks + excluded.clicks`)
+		if err != nil {
+			return err
+		}
+		defer ownerStmt.Close()
+		for key, n := range counts {
+			at := time.Unix(key.hour*3600, 0).UTC()
+			if _, err := stmt.ExecContext(ctx, key.shortCode, at.Format(time.RFC3339), key.country, n, key.shortCode); err != nil {
+				return err
+			}
+			if _, err := ownerStmt.ExecContext(ctx, at.Format(time.DateOnly), n, key.shortCode); err != nil {
+				return err
+			}
+		}
+		return flushKeyUsage(ctx, tx, usage)
+	})
+	if err != nil {
+		for key, n := range counts {
+			clickRollups.add(key.shortCode, key.country, time.Unix(key.hour*3600, 0), n)
+		}
+		for key, n := range usage {
+			day, _ := time.Parse(time.DateOnly, key.day)
+			keyUsage.add(key.owner, day, n)
+		}
+	}
+	return err
+}
+
+// clickRollupSeries is shortCode's clicks in r from the hourly rollups,
+// including this instance's unflushed clicks. Hours are UTC, so day
+// buckets in a zone whose offset isn't whole hours are off by the
+// fraction.
+func (s *Server) clickRollupSeries(ctx context.Context, shortCode string, r statsRange) ([]statsBucket, error) {
+	from := r.bucketStart(r.From).UTC().Truncate(time.Hour)
+	rows, err := s.db.QueryContext(ctx, "SELECT hour, clicks FROM clicks_hourly WHERE short_code = ? AND hour >= ? AND hour < ?",
+		shortCode, from.Format(time.RFC3339), r.To.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := map[time.Time]int64{}
+	for rows.Next() {
+		var hour string
+		var n int64
+		if err := rows.Scan(&hour, &n); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339, hour); err == nil {
+			hours[t] += n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	clickRollups.pending(shortCode, hours)
+
+	counts := map[time.Time]int64{}
+	for hour, n := range hours {
+		if !hour.Before(from) && hour.Before(r.To) {
+			counts[r.bucketStart(hour)] += n
+		}
+	}
+	return r.series(counts), nil
+}
+
+// getStatsTimeseries serves GET /api/stats/:code/timeseries with from=,
+// to=, granularity= and tz= as GET /api/stats/:code reads them: clicks per
+// bucket from the local rollups rather than the click rows. Buckets from
+// before CLICK_ROLLUP_RETENTION count 0.
+func (s *Server) getStatsTimeseries(c *gin.Context) {
+	shortCode := c.Param("code")
+	if !statsScopeAllowed(c, statsScopeTimeseries) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Share link does not cover timeseries"})
+		return
+	}
+	r, err := parseStatsRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var activeFrom, owner sql.NullString
+	err = s.db.QueryRowContext(ctx, "SELECT active_from, owner FROM urls WHERE short_code = ?", shortCode).Scan(&activeFrom, &owner)
+	// Scheduled links stay out of public stats until they are live.
+	if err == nil && (!linkActive(activeFrom, time.Now()) || !s.statsReadable(c, owner)) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	buckets, err := s.clickRollupSeries(ctx, shortCode, r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"short_code": shortCode, "meta": r.meta(), "timeseries": buckets})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With CLICK_EVENTS_MODE=stream, click events are appended to the
+// click_events Redis stream, capped near CLICK_EVENTS_STREAM_MAXLEN, instead
+// of published on the channel of that name, so a consumer group picks up
+// what was added while it was down. Events that can't be added wait in
+// memory, up to CLICK_EVENTS_RETRY_BUFFER of them, and are retried with
+// backoff; beyond that, and at shutdown, they are spilled to the
+// pending_events table, which is drained once Redis takes events again.
+// The default, pubsub, keeps the channel and the HTTP fallback for
+// subscribers that don't read the stream.
+const (
+	clickEventsModePubSub = "pubsub"
+	clickEventsModeStream = "stream"
+)
+
+var (
+	clickEventsMode        = getEnv("CLICK_EVENTS_MODE", clickEventsModePubSub)
+	clickStreamMaxLen      = int64(getEnvInt("CLICK_EVENTS_STREAM_MAXLEN", 100000))
+	clickStreamRetryBuffer = getEnvInt("CLICK_EVENTS_RETRY_BUFFER", 10000)
+)
+
+const (
+	clickStreamKey = "click_events"
+	// clickStreamBatch is how many events one retry sends or one drain of
+	// pending_events reads.
+	clickStreamBatch           = 100
+	clickStreamMinRetryBackoff = time.Second
+	clickStreamMaxRetryBackoff = 30 * time.Second
+)
+
+var clickStreamStats = expvar.NewMap("click_stream")
+
+// clickOutbox holds encoded events waiting to be added to the stream.
+type clickOutbox struct {
+	s      *Server
+	mu     sync.Mutex
+	events []string
+	// sending is held while buffered events are on their way to Redis, so
+	// shutdown doesn't spill them at the same time.
+	sending sync.Mutex
+	wake    chan struct{}
+	spilled atomic.Bool // pending_events may have rows
+}
+
+// startClickStream checks CLICK_EVENTS_MODE and, in stream mode, starts the
+// retry loop. Events spilled by an earlier run are drained by it too.
+func (s *Server) startClickStream() {
+	switch clickEventsMode {
+	case clickEventsModePubSub:
+		return
+	case clickEventsModeStream:
+	default:
+		log.Fatalf("Invalid CLICK_EVENTS_MODE %q: must be pubsub or stream", clickEventsMode)
+	}
+	s.outbox.spilled.Store(true)
+	go s.outbox.retryLoop()
+}
+
+// streamMode reports whether click events go to the Redis stream.
+func (s *Server) streamMode() bool {
+	return clickEventsMode == clickEventsModeStream && s.rdb != nil && !resolverOnly
+}
+
+// xaddArgs appends payload to the stream, trimming it near the cap.
+func xaddArgs(payload string) *redis.XAddArgs {
+	return &redis.XAddArgs{Stream: clickStreamKey, MaxLen: clickStreamMaxLen, Approx: true, Values: []any{"event", payload}}
+}
+
+// publish adds one encoded event to the stream, or leaves it to the retry
+// loop. While events are waiting it queues behind them.
+func (o *clickOutbox) publish(ctx context.Context, payload string) {
+	o.mu.Lock()
+	waiting := len(o.events) > 0
+	o.mu.Unlock()
+	if !waiting {
+		err := o.s.rdb.XAdd(ctx, xaddArgs(payload)).Err()
+		if err == nil {
+			countClickEvents("stream", "ok", 1)
+			return
+		}
+		countClickEvents("stream", "error", 1)
+		if !redisUnavailable(err) {
+			log.Printf("Redis XADD error: %v, retrying in the background", err)
+		}
+	}
+	o.enqueue(ctx, payload)
+}
+
+// enqueue buffers payload for the retry loop, spilling it to
+// pending_events when the buffer is full.
+func (o *clickOutbox) enqueue(ctx context.Context, payload string) {
+	o.mu.Lock()
+	full := len(o.events) >= clickStreamRetryBuffer
+	if !full {
+		o.events = append(o.events, payload)
+		setGauge(clickStreamStats, "buffered", int64(len(o.events)))
+	}
+	o.mu.Unlock()
+	if full {
+		if err := o.s.spillClickEvents(ctx, []string{payload}); err != nil {
+			log.Printf("Lost click event, retry buffer full and spill failed: %v", err)
+			return
+		}
+		o.spilled.Store(true)
+		countClickEvents("stream", "spilled", 1)
+	} else {
+		countClickEvents("stream", "buffered", 1)
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retryLoop sends buffered events, then spilled ones, backing off from a
+// second up to clickStreamMaxRetryBackoff while Redis refuses them.
+func (o *clickOutbox) retryLoop() {
+	backoff := clickStreamMinRetryBackoff
+	for {
+		select {
+		case <-o.wake:
+		case <-time.After(backoff):
+		}
+		if err := o.flush(context.Background()); err != nil {
+			backoff = min(backoff*2, clickStreamMaxRetryBackoff)
+			continue
+		}
+		backoff = clickStreamMinRetryBackoff
+	}
+}
+
+// flush sends what is buffered, oldest first, then drains pending_events.
+func (o *clickOutbox) flush(ctx context.Context) error {
+	o.sending.Lock()
+	defer o.sending.Unlock()
+	for {
+		o.mu.Lock()
+		batch := o.events[:min(len(o.events), clickStreamBatch)]
+		o.mu.Unlock()
+		if len(batch) == 0 {
+			break
+		}
+		if err := o.s.xaddBatch(ctx, batch); err != nil {
+			return err
+		}
+		o.mu.Lock()
+		o.events = o.events[len(batch):]
+		setGauge(clickStreamStats, "buffered", int64(len(o.events)))
+		o.mu.Unlock()
+		countClickEvents("stream", "ok", len(batch))
+	}
+	if o.spilled.Load() {
+		return o.drainPending(ctx)
+	}
+	return nil
+}
+
+// drainPending moves spilled events to the stream in id order, deleting
+// each batch once Redis has it.
+func (o *clickOutbox) drainPending(ctx context.Context) error {
+	for {
+		rows, err := o.s.db.QueryContext(ctx, "SELECT id, payload FROM pending_events ORDER BY id LIMIT ?", clickStreamBatch)
+		if err != nil {
+			return err
+		}
+		var ids []any
+		var payloads []string
+		for rows.Next() {
+			var id int64
+			var payload string
+			if err := rows.Scan(&id, &payload); err != nil {
+				rows.Close()
+				return err
+			}
+			ids, payloads = append(ids, id), append(payloads, payload)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			o.spilled.Store(false)
+			return nil
+		}
+		if err := o.s.xaddBatch(ctx, payloads); err != nil {
+			return err
+		}
+		placeholders := strings.Repeat(", ?", len(ids))[2:]
+		if _, err := o.s.execWithRetry(ctx, "DELETE FROM pending_events WHERE id IN ("+placeholders+")", ids...); err != nil {
+			return err
+		}
+		clickStreamStats.Add("drained", int64(len(ids)))
+		countClickEvents("stream", "ok", len(ids))
+		log.Printf("Drained %d spilled click events to the stream", len(ids))
+	}
+}
+
+// xaddBatch adds payloads to the stream in one round trip.
+func (s *Server) xaddBatch(ctx context.Context, payloads []string) error {
+	cmds, err := s.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, payload := range payloads {
+			p.XAdd(ctx, xaddArgs(payload))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spillClickEvents stores payloads in pending_events.
+func (s *Server) spillClickEvents(ctx context.Context, payloads []string) error {
+	err := s.txWithRetry(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO pending_events (payload) VALUES (?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, payload := range payloads {
+			if _, err := stmt.ExecContext(ctx, payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		clickStreamStats.Add("spilled", int64(len(payloads)))
+	}
+	return err
+}
+
+// spillClickOutbox is part of shutdown: one last try at the stream, then
+// whatever is still buffered goes to pending_events for the next run.
+func (s *Server) spillClickOutbox(ctx context.Context) error {
+	if !s.streamMode() {
+		return nil
+	}
+	o := &s.outbox
+	o.sending.Lock()
+	defer o.sending.Unlock()
+	o.mu.Lock()
+	events := o.events
+	o.events = nil
+	setGauge(clickStreamStats, "buffered", 0)
+	o.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+	if err := s.xaddBatch(ctx, events); err == nil {
+		countClickEvents("stream", "ok", len(events))
+		return nil
+	}
+	if err := s.spillClickEvents(ctx, events); err != nil {
+		return fmt.Errorf("spilling buffered click events: %w", err)
+	}
+	log.Printf("Spilled %d buffered click events to pending_events", len(events))
+	return nil
+}
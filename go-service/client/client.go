@@ -0,0 +1,445 @@
+// Package client is a typed Go client for the URL shortener API. It only
+// depends on net/http.
+//
+//	c := client.New("http://localhost:8000", client.WithAPIKey(key))
+//	link, err := c.Shorten(ctx, client.ShortenRequest{LongURL: "https://example.com/"})
+//	info, err := c.Get(ctx, link.ShortCode)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors returned by Client methods, wrapped in an *APIError. Use errors.Is
+// to test for them.
+var (
+	ErrBadRequest   = errors.New("shortener: bad request")
+	ErrUnauthorized = errors.New("shortener: unauthorized")
+	ErrForbidden    = errors.New("shortener: forbidden")
+	ErrNotFound     = errors.New("shortener: not found")
+	ErrConflict     = errors.New("shortener: conflict")
+	ErrGone         = errors.New("shortener: gone")
+	ErrInvalid      = errors.New("shortener: unprocessable request")
+	ErrRateLimited  = errors.New("shortener: rate limited")
+	ErrUnavailable  = errors.New("shortener: service unavailable")
+	ErrServer       = errors.New("shortener: server error")
+)
+
+// ErrProtected is returned by Expand for a password-protected link whose
+// destination the caller may not see, and by Visit for one that asks for
+// its password.
+var ErrProtected = errors.New("shortener: destination is password protected")
+
+// errorCodes maps the "code" field of an error response to its error. The
+// code decides before the status, which can mislead: a 451 is a link that
+// is gone, a 504 a timeout worth retrying, and a 401 may be a password
+// prompt. Without a known code the status decides.
+var errorCodes = map[string]error{
+	"invalid_request":             ErrBadRequest,
+	"invalid_idempotency_key":     ErrBadRequest,
+	"unauthenticated":             ErrUnauthorized,
+	"invalid_token":               ErrUnauthorized,
+	"invalid_api_key":             ErrUnauthorized,
+	"owner_required":              ErrUnauthorized,
+	"password_required":           ErrProtected,
+	"password_incorrect":          ErrProtected,
+	"admin_only":                  ErrForbidden,
+	"skip_verification_forbidden": ErrForbidden,
+	"claim_token_invalid":         ErrForbidden,
+	"scan_rejected":               ErrForbidden,
+	"link_deleted":                ErrGone,
+	"link_expired":                ErrGone,
+	"link_disabled":               ErrGone,
+	"link_legal_block":            ErrGone,
+	"claim_token_expired":         ErrGone,
+	"alias_retained":              ErrConflict,
+	"already_owner":               ErrConflict,
+	"claim_token_used":            ErrConflict,
+	"idempotency_key_in_progress": ErrConflict,
+	"idempotency_key_reused":      ErrConflict,
+	"profile_exists":              ErrConflict,
+	"invalid_transfer_target":     ErrInvalid,
+	"maintenance":                 ErrUnavailable,
+	"pending_scan":                ErrUnavailable,
+	"request_timeout":             ErrUnavailable,
+	"short_code_collision":        ErrUnavailable,
+	"database_error":              ErrServer,
+}
+
+// APIError is a non-2xx response. Message and Code are the "error" and
+// "code" fields of the response body; Code is empty when there is none.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Code       string
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("shortener: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("shortener: %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	if err, ok := errorCodes[e.Code]; ok {
+		return err
+	}
+	switch {
+	case e.StatusCode == http.StatusBadRequest:
+		return ErrBadRequest
+	case e.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusForbidden:
+		return ErrForbidden
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusConflict:
+		return ErrConflict
+	case e.StatusCode == http.StatusGone:
+		return ErrGone
+	case e.StatusCode == http.StatusUnprocessableEntity:
+		return ErrInvalid
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode == http.StatusServiceUnavailable:
+		return ErrUnavailable
+	case e.StatusCode >= 500:
+		return ErrServer
+	}
+	return nil
+}
+
+// Client calls the shortener API. The zero value is not usable; use New.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+	apiKey     string
+	maxRetries int
+	maxWait    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http.Client (10s timeout).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithBearerToken sends "Authorization: Bearer <token>" on every request.
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithAPIKey sends key as X-API-Key on every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithRetries sets how often 429 and 503 responses are retried (default 3)
+// and the longest Retry-After the client will wait (default 10s).
+func WithRetries(maxRetries int, maxWait time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.maxWait = maxWait
+	}
+}
+
+// New returns a Client for the service at baseURL, e.g.
+// "http://localhost:8000".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		maxRetries: 3,
+		maxWait:    10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ShortenRequest mirrors the POST /api/shorten body.
+type ShortenRequest struct {
+	LongURL       string     `json:"long_url"`
+	OGTitle       string     `json:"og_title,omitempty"`
+	OGDescription string     `json:"og_description,omitempty"`
+	OGImage       string     `json:"og_image,omitempty"`
+	Challenge     bool       `json:"challenge,omitempty"`
+	ActiveFrom    *time.Time `json:"active_from,omitempty"`
+	Hot           bool       `json:"hot,omitempty"`
+}
+
+// Link is a created short link.
+type Link struct {
+	ShortCode  string `json:"short_code"`
+	ShortURL   string `json:"short_url"`
+	LongURL    string `json:"long_url"`
+	ActiveFrom string `json:"active_from,omitempty"`
+	Verified   bool   `json:"verified,omitempty"`
+}
+
+// LinkInfo is the GET /api/urls/:code response. LongURL and ResolvedURL
+// are empty for a password-protected link the caller doesn't own.
+type LinkInfo struct {
+	ShortCode          string            `json:"short_code"`
+	ShortURL           string            `json:"short_url"`
+	LongURL            string            `json:"long_url,omitempty"`
+	CreatedAt          string            `json:"created_at"`
+	Clicks             int64             `json:"clicks"`
+	Status             string            `json:"status"`
+	ActiveFrom         string            `json:"active_from,omitempty"`
+	ExpiresAt          string            `json:"expires_at,omitempty"`
+	Expired            bool              `json:"expired,omitempty"`
+	ScanStatus         string            `json:"scan_status,omitempty"`
+	ResolvedURL        string            `json:"resolved_url,omitempty"`
+	ResolvedStatus     int               `json:"resolved_status,omitempty"`
+	DestinationProblem string            `json:"destination_problem,omitempty"`
+	PasswordProtected  bool              `json:"password_protected,omitempty"`
+	Notes              string            `json:"notes,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// ListOptions filters and pages GET /api/urls. Zero fields are left to the
+// service's defaults.
+type ListOptions struct {
+	Limit int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+	// Sort is created_at or clicks; Order asc or desc.
+	Sort, Order string
+	// Query matches codes and destinations.
+	Query string
+	// Status is active, disabled, expired or deleted.
+	Status string
+}
+
+// LinkSummary is one link of a List page.
+type LinkSummary struct {
+	ShortCode  string `json:"short_code"`
+	ShortURL   string `json:"short_url"`
+	LongURL    string `json:"long_url"`
+	Clicks     int64  `json:"clicks"`
+	Status     string `json:"status"`
+	CreatedAt  string `json:"created_at,omitempty"`
+	ScanStatus string `json:"scan_status,omitempty"`
+	// Owner is only set for admins.
+	Owner string `json:"owner,omitempty"`
+}
+
+// LinkPage is a page of List. NextCursor is empty on the last page.
+type LinkPage struct {
+	URLs       []LinkSummary `json:"urls"`
+	Total      int64         `json:"total"`
+	Limit      int           `json:"limit"`
+	NextCursor string        `json:"next_cursor"`
+}
+
+// Stats is the GET /api/stats/:code response without a range block.
+// Clicks counts the click rows the analytics service has stored;
+// TotalClicks is the service's own counter and includes every redirect.
+type Stats struct {
+	ShortCode      string  `json:"short_code"`
+	CreatedAt      string  `json:"created_at"`
+	Clicks         int64   `json:"clicks"`
+	TotalClicks    int64   `json:"total_clicks"`
+	Challenged     int64   `json:"challenged"`
+	Conversions    int64   `json:"conversions"`
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+// Shorten creates a short link.
+func (c *Client) Shorten(ctx context.Context, req ShortenRequest) (*Link, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var link Link
+	if err := c.do(ctx, http.MethodPost, "/api/shorten", body, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// Stats returns click and conversion totals for a code.
+func (c *Client) Stats(ctx context.Context, shortCode string) (*Stats, error) {
+	var stats Stats
+	if err := c.do(ctx, http.MethodGet, "/api/stats/"+url.PathEscape(shortCode), nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Get looks a link up without redirecting, so no click is counted.
+func (c *Client) Get(ctx context.Context, shortCode string) (*LinkInfo, error) {
+	var info LinkInfo
+	if err := c.do(ctx, http.MethodGet, "/api/urls/"+url.PathEscape(shortCode), nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Expand returns the destination of a code. It looks the link up like Get
+// and counts no click; see Visit for resolving it as a visitor would.
+func (c *Client) Expand(ctx context.Context, shortCode string) (string, error) {
+	info, err := c.Get(ctx, shortCode)
+	if err != nil {
+		return "", err
+	}
+	if info.LongURL == "" && info.PasswordProtected {
+		return "", ErrProtected
+	}
+	return info.LongURL, nil
+}
+
+// Visit resolves a code like a visitor would, without following the
+// redirect, and returns where it points. It is counted as a click.
+func (c *Client) Visit(ctx context.Context, shortCode string) (string, error) {
+	hc := *c.httpClient
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	resp, err := c.send(ctx, &hc, http.MethodGet, "/"+url.PathEscape(shortCode), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location"), nil
+	case http.StatusOK:
+		// Challenge, preview and password pages; there is no destination
+		// to report.
+		return "", &APIError{StatusCode: resp.StatusCode, Message: "link requires a browser"}
+	}
+	return "", decodeAPIError(resp)
+}
+
+// Delete deletes a link the caller owns, or any link for admins. The link
+// is marked deleted and keeps its code and clicks; with hard it is removed
+// with all its rows.
+func (c *Client) Delete(ctx context.Context, shortCode string, hard bool) error {
+	path := "/api/urls/" + url.PathEscape(shortCode)
+	if hard {
+		path += "?hard=true"
+	}
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// List returns a page of the caller's links, or every link for admins.
+func (c *Client) List(ctx context.Context, opts ListOptions) (*LinkPage, error) {
+	q := url.Values{}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	for param, v := range map[string]string{"cursor": opts.Cursor, "sort": opts.Sort, "order": opts.Order, "q": opts.Query, "status": opts.Status} {
+		if v != "" {
+			q.Set(param, v)
+		}
+	}
+	path := "/api/urls"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var page LinkPage
+	if err := c.do(ctx, http.MethodGet, path, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out any) error {
+	resp, err := c.send(ctx, c.httpClient, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeAPIError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send performs the request, retrying 429 and 503 after Retry-After (or a
+// short backoff when the header is missing).
+func (c *Client) send(ctx context.Context, hc *http.Client, method, path string, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Accept", "application/json")
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if c.apiKey != "" {
+			req.Header.Set("X-API-Key", c.apiKey)
+		}
+
+		resp, err := hc.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if attempt >= c.maxRetries || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+			return resp, nil
+		}
+
+		wait := retryAfter(resp.Header.Get("Retry-After"), attempt)
+		if wait > c.maxWait {
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func retryAfter(header string, attempt int) time.Duration {
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return time.Duration(250<<attempt) * time.Millisecond
+}
+
+func decodeAPIError(resp *http.Response) error {
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	var envelope struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&envelope) == nil {
+		if envelope.Error != "" {
+			apiErr.Message = envelope.Error
+		}
+		apiErr.Code = envelope.Code
+	}
+	return apiErr
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"urlshortener/client"
+)
+
+// newAPIClient is a client of testServer's router, served over HTTP.
+func newAPIClient(t *testing.T, opts ...client.Option) *client.Client {
+	t.Helper()
+	srv := httptest.NewServer(testServer.newRouter())
+	t.Cleanup(srv.Close)
+	return client.New(srv.URL, opts...)
+}
+
+func TestClientLinkLifecycle(t *testing.T) {
+	withLocalCache(t, 0)
+	_, key := newTestAPIKey(t, false)
+	c := newAPIClient(t, client.WithAPIKey(key))
+	ctx := context.Background()
+
+	link, err := c.Shorten(ctx, client.ShortenRequest{LongURL: "https://example.com/client"})
+	if err != nil || link.ShortCode == "" || link.LongURL != "https://example.com/client" {
+		t.Fatalf("Shorten = %+v, %v", link, err)
+	}
+	if info, err := c.Get(ctx, link.ShortCode); err != nil || info.LongURL != link.LongURL || info.Status != linkStatusActive {
+		t.Errorf("Get = %+v, %v", info, err)
+	}
+	if got, err := c.Expand(ctx, link.ShortCode); err != nil || got != link.LongURL {
+		t.Errorf("Expand = %q, %v", got, err)
+	}
+	testServer.clickJobs.Wait()
+	if stats, err := c.Stats(ctx, link.ShortCode); err != nil || stats.TotalClicks != 0 {
+		t.Errorf("Stats after Expand = %+v, %v; want no click counted", stats, err)
+	}
+	if got, err := c.Visit(ctx, link.ShortCode); err != nil || got != link.LongURL {
+		t.Errorf("Visit = %q, %v", got, err)
+	}
+	// The click is queued once the redirect is answered.
+	var stats *client.Stats
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		testServer.clickJobs.Wait()
+		if stats, err = c.Stats(ctx, link.ShortCode); err != nil || stats.TotalClicks == 1 {
+			break
+		}
+	}
+	if err != nil || stats.TotalClicks != 1 {
+		t.Errorf("Stats after Visit = %+v, %v", stats, err)
+	}
+	page, err := c.List(ctx, client.ListOptions{Limit: 10})
+	if err != nil || page.Total != 1 || len(page.URLs) != 1 || page.URLs[0].ShortCode != link.ShortCode {
+		t.Errorf("List = %+v, %v; want just the key's link", page, err)
+	}
+
+	if err := c.Delete(ctx, link.ShortCode, false); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	var apiErr *client.APIError
+	if _, err := c.Visit(ctx, link.ShortCode); !errors.Is(err, client.ErrGone) || !errors.As(err, &apiErr) || apiErr.Code != "link_deleted" {
+		t.Errorf("Visit of a deleted link = %v, want ErrGone with code link_deleted", err)
+	}
+	if err := c.Delete(ctx, link.ShortCode, true); err != nil {
+		t.Fatalf("hard Delete: %v", err)
+	}
+	if _, err := c.Get(ctx, link.ShortCode); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Get after a hard delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientVisitEachRedirectStatus(t *testing.T) {
+	withLocalCache(t, 0)
+	c := newAPIClient(t)
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect} {
+		withRedirectStatus(t, status, time.Minute)
+		link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/client-visit/" + strconv.Itoa(status)}, "")
+		if got, err := c.Visit(context.Background(), link.ShortCode); err != nil || got != "https://example.com/client-visit/"+strconv.Itoa(status) {
+			t.Errorf("Visit with %d = %q, %v", status, got, err)
+		}
+	}
+}
+
+func TestClientErrorCodes(t *testing.T) {
+	withLocalCache(t, 0)
+	ctx := context.Background()
+	ownerID, key := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	c := newAPIClient(t, client.WithAPIKey(key))
+	owned := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/client-owned", ReuseExisting: new(bool)}, ownerID)
+	blocked := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/client-blocked", ReuseExisting: new(bool)}, "")
+	if _, err := testServer.db.Exec("UPDATE urls SET status = ? WHERE short_code = ?", linkStatusLegalBlock, blocked.ShortCode); err != nil {
+		t.Fatal(err)
+	}
+	protected := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/client-protected", Password: "hunter22"}, "")
+
+	for _, tt := range []struct {
+		name   string
+		call   func() error
+		want   error
+		status int
+		code   string
+	}{
+		{"no key", func() error {
+			_, err := newAPIClient(t).Shorten(ctx, client.ShortenRequest{LongURL: "https://example.com/"})
+			return err
+		}, client.ErrUnauthorized, http.StatusUnauthorized, "unauthenticated"},
+		{"unknown key", func() error {
+			_, err := newAPIClient(t, client.WithAPIKey("ak_unknown.secret")).Shorten(ctx, client.ShortenRequest{LongURL: "https://example.com/"})
+			return err
+		}, client.ErrUnauthorized, http.StatusUnauthorized, "invalid_api_key"},
+		{"another key's link", func() error {
+			_, err := newAPIClient(t, client.WithAPIKey(otherKey)).Get(ctx, owned.ShortCode)
+			return err
+		}, client.ErrNotFound, http.StatusNotFound, ""},
+		{"legal block", func() error {
+			_, err := c.Visit(ctx, blocked.ShortCode)
+			return err
+		}, client.ErrGone, http.StatusUnavailableForLegalReasons, "link_legal_block"},
+		{"password prompt", func() error {
+			_, err := c.Visit(ctx, protected.ShortCode)
+			return err
+		}, client.ErrProtected, http.StatusUnauthorized, "password_required"},
+		{"maintenance", func() error {
+			maintenanceMode.Store(true)
+			defer maintenanceMode.Store(false)
+			_, err := newAPIClient(t, client.WithAPIKey(key), client.WithRetries(0, 0)).Shorten(ctx, client.ShortenRequest{LongURL: "https://example.com/"})
+			return err
+		}, client.ErrUnavailable, http.StatusServiceUnavailable, "maintenance"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			var apiErr *client.APIError
+			if !errors.Is(err, tt.want) || !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status || apiErr.Code != tt.code {
+				t.Errorf("err = %#v, want %v from a %d with code %q", err, tt.want, tt.status, tt.code)
+			}
+		})
+	}
+
+	// A password prompt is not a bad key.
+	if _, err := c.Visit(ctx, protected.ShortCode); errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Visit of a protected link = %v, want it apart from ErrUnauthorized", err)
+	}
+	if _, err := c.Expand(ctx, protected.ShortCode); !errors.Is(err, client.ErrProtected) {
+		t.Errorf("Expand of a protected link = %v, want ErrProtected", err)
+	}
+}
+
+func TestClientRetriesMaintenance(t *testing.T) {
+	saved := maintenanceRetryAfter
+	maintenanceRetryAfter = time.Second
+	t.Cleanup(func() { maintenanceRetryAfter = saved })
+	_, key := newTestAPIKey(t, false)
+	c := newAPIClient(t, client.WithAPIKey(key), client.WithRetries(2, 2*time.Second))
+
+	maintenanceMode.Store(true)
+	time.AfterFunc(200*time.Millisecond, func() { maintenanceMode.Store(false) })
+	t.Cleanup(func() { maintenanceMode.Store(false) })
+	start := time.Now()
+	link, err := c.Shorten(context.Background(), client.ShortenRequest{LongURL: "https://example.com/client-retry"})
+	if err != nil || link.ShortCode == "" {
+		t.Fatalf("Shorten = %+v, %v", link, err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Shorten took %s, want it to wait the Retry-After", elapsed)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trustedProxies lists the proxies whose X-Forwarded-For we believe. Empty
+// means the direct peer is always the client.
+var trustedProxies = mustParseCIDRSet(getEnv("TRUSTED_PROXIES", ""))
+
+// cidrSet is a list of prefixes; single addresses are stored as /32 or /128.
+type cidrSet []netip.Prefix
+
+func parseCIDRSet(list string) (cidrSet, error) {
+	var set cidrSet
+	for _, item := range splitList(list) {
+		if strings.Contains(item, "/") {
+			p, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", item, err)
+			}
+			if p.Addr().Is4In6() {
+				p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+			}
+			set = append(set, p.Masked())
+			continue
+		}
+		addr, err := parseIP(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q: %w", item, err)
+		}
+		set = append(set, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return set, nil
+}
+
+func mustParseCIDRSet(list string) cidrSet {
+	set, err := parseCIDRSet(list)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// Contains reports whether addr falls inside any prefix. Zones are ignored
+// and IPv4-mapped IPv6 addresses match their IPv4 prefixes.
+func (s cidrSet) Contains(addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
+	for _, p := range s {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings returns the prefixes in a form gin.SetTrustedProxies accepts.
+func (s cidrSet) Strings() []string {
+	out := make([]string, len(s))
+	for i, p := range s {
+		out[i] = p.String()
+	}
+	return out
+}
+
+// parseIP parses a bare address, tolerating brackets and zone identifiers,
+// and normalizes IPv4-mapped IPv6 to plain IPv4.
+func parseIP(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if inner, ok := strings.CutPrefix(s, "["); ok {
+		// An unbalanced bracket is malformed, not a bare address.
+		if s, ok = strings.CutSuffix(inner, "]"); !ok {
+			return netip.Addr{}, errors.New("unbalanced brackets")
+		}
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// parseRemoteAddr parses an http.Request.RemoteAddr such as "1.2.3.4:5678",
+// "[2001:db8::1]:54321" or "[fe80::1%eth0]:80". A missing port is tolerated.
+func parseRemoteAddr(remoteAddr string) (netip.Addr, error) {
+	if remoteAddr == "" {
+		return netip.Addr{}, errors.New("empty address")
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// No port (or not host:port at all); try the whole string.
+		host = remoteAddr
+	}
+	return parseIP(host)
+}
+
+// clientAddr resolves the client IP for a request. X-Forwarded-For is only
+// honoured when the direct peer is a trusted proxy, and is walked from the
+// right so a client cannot spoof entries in front of our own proxies.
+func clientAddr(c *gin.Context) netip.Addr {
+	peer, err := parseRemoteAddr(c.Request.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	if len(trustedProxies) == 0 || !trustedProxies.Contains(peer) {
+		return peer
+	}
+
+	hops := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseIP(hops[i])
+		if err != nil {
+			break
+		}
+		if !trustedProxies.Contains(addr) {
+			return addr
+		}
+		peer = addr
+	}
+	return peer
+}
+
+// clientIP is clientAddr as a string, "" when it could not be determined.
+func clientIP(c *gin.Context) string {
+	addr := clientAddr(c)
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.WithZone("").String()
+}
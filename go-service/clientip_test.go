@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRemoteAddr(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "1.2.3.4:5678", want: "1.2.3.4"},
+		{in: "1.2.3.4", want: "1.2.3.4"},
+		{in: "[2001:db8::1]:54321", want: "2001:db8::1"},
+		{in: "2001:db8::1", want: "2001:db8::1"},
+		{in: "[2001:db8::1]", want: "2001:db8::1"},
+		{in: "[::ffff:192.0.2.7]:80", want: "192.0.2.7"},
+		{in: "::ffff:192.0.2.7", want: "192.0.2.7"},
+		{in: "[fe80::1%eth0]:80", want: "fe80::1%eth0"},
+		{in: "fe80::1%25", want: "fe80::1%25"},
+		{in: "", wantErr: true},
+		{in: "localhost:80", wantErr: true},
+		{in: "1.2.3:80", wantErr: true},
+		{in: "[2001:db8::1:80", wantErr: true},
+		{in: "256.1.1.1:80", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRemoteAddr(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRemoteAddr(%q) = %s, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("parseRemoteAddr(%q) = %s, %v; want %s", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestCIDRSetContains(t *testing.T) {
+	set, err := parseCIDRSet("10.0.0.0/8, 2001:db8::/32, 192.0.2.1, ::ffff:198.51.100.0/120")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"2001:db8:1::5", true},
+		{"fe80::1%eth0", false},
+		{"2001:db8::7%eth0", true},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"198.51.100.200", true},
+	}
+	for _, tt := range tests {
+		if got := set.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", "2001:db8::/200"} {
+		if _, err := parseCIDRSet(bad); err == nil {
+			t.Errorf("parseCIDRSet(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	saved := trustedProxies
+	trustedProxies = mustParseCIDRSet("10.0.0.0/8, fd00::/8")
+	t.Cleanup(func() { trustedProxies = saved })
+
+	tests := []struct {
+		name, remoteAddr, forwardedFor, want string
+	}{
+		{"direct v4", "203.0.113.9:4000", "", "203.0.113.9"},
+		{"direct v6", "[2001:db8::9]:4000", "", "2001:db8::9"},
+		{"direct zoned", "[fe80::9%eth0]:4000", "", "fe80::9"},
+		{"untrusted peer can't forward", "203.0.113.9:4000", "198.51.100.1", "203.0.113.9"},
+		{"trusted proxy", "10.0.0.2:80", "198.51.100.1", "198.51.100.1"},
+		{"trusted v6 proxy", "[fd00::2]:80", "2001:db8::1", "2001:db8::1"},
+		{"spoofed hop ignored", "10.0.0.2:80", "6.6.6.6, 198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"mapped hop", "10.0.0.2:80", "::ffff:198.51.100.4", "198.51.100.4"},
+		{"only proxies", "10.0.0.2:80", "10.0.0.3", "10.0.0.3"},
+		{"malformed hop stops the walk", "10.0.0.2:80", "198.51.100.1, junk", "10.0.0.2"},
+		{"malformed peer", "not-an-address", "", ""},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Request.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			c.Request.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := clientIP(c); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
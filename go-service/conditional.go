@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/urls and /api/export answer conditional requests, so a sync job
+// polling them gets a 304 until something changed. Every change to links,
+// their metadata or their click counters bumps a version in link_modified,
+// from triggers in the writing transaction: one row per owner and one,
+// under the owner '', for everyone. The version lives in the database, so
+// every instance sees the same one, with or without Redis. A link expiring
+// changes the listings without a write, so the newest expiry that has
+// passed counts as a change too. The ETag is exact; Last-Modified, being
+// whole seconds, can't tell two changes within a second apart, so clients
+// should prefer If-None-Match, which wins when both are sent.
+
+// linkVersion is the state of the links an owner (or, for "", everyone)
+// can list.
+type linkVersion struct {
+	owner      string
+	version    int64
+	modifiedAt time.Time
+	// expired is when the newest passed expiry passed.
+	expired time.Time
+}
+
+// loadLinkVersion reads owner's version as of now.
+func (s *Server) loadLinkVersion(ctx context.Context, owner string, now time.Time) (linkVersion, error) {
+	v := linkVersion{owner: owner}
+	var modifiedAt string
+	err := s.db.QueryRowContext(ctx, "SELECT version, modified_at FROM link_modified WHERE owner = ?", owner).Scan(&v.version, &modifiedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return v, err
+	}
+	v.modifiedAt, _ = time.Parse(time.DateTime, modifiedAt)
+
+	query, args := "SELECT MAX(expires_at) FROM urls WHERE expires_at <= ?", []any{now.UTC().Format(time.RFC3339)}
+	if owner != "" {
+		query, args = query+" AND owner = ?", append(args, owner)
+	}
+	var expired sql.NullString
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&expired); err != nil {
+		return v, err
+	}
+	v.expired, _ = time.Parse(time.RFC3339, expired.String)
+	return v, nil
+}
+
+// lastModified is the later of the last write and the last expiry.
+func (v linkVersion) lastModified() time.Time {
+	if v.expired.After(v.modifiedAt) {
+		return v.expired.UTC()
+	}
+	return v.modifiedAt.UTC()
+}
+
+func (v linkVersion) etag() string {
+	scope := "all"
+	if v.owner != "" {
+		sum := sha256.Sum256([]byte(v.owner))
+		scope = hex.EncodeToString(sum[:6])
+	}
+	return `W/"` + scope + "-" + strconv.FormatInt(v.version, 10) + "-" + strconv.FormatInt(v.expired.Unix(), 10) + `"`
+}
+
+// notModified sets the validators for v and answers 304 if the request's
+// conditions say the client is up to date, reporting whether it did.
+func notModified(c *gin.Context, v linkVersion) bool {
+	etag, lastModified := v.etag(), v.lastModified()
+	c.Header("ETag", etag)
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+	c.Header("Cache-Control", "private, no-cache")
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				c.Status(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !lastModified.IsZero() && !lastModified.After(since) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
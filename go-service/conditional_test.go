@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConditionalListURLs(t *testing.T) {
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	auth := "X-API-Key: " + key
+	shorten := func(key string) string {
+		t.Helper()
+		code := "cg-" + newRandomID()[:10]
+		if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/`+code+`","custom_alias":"`+code+`"}`, "X-API-Key: "+key); w.Code != http.StatusOK {
+			t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+		}
+		return code
+	}
+	code := shorten(key)
+
+	w := serveTest(r, http.MethodGet, "/api/urls", "", auth)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("list = %d with ETag %q and Last-Modified %q", w.Code, etag, lastModified)
+	}
+	unchanged := func(what string) {
+		t.Helper()
+		if w := serveTest(r, http.MethodGet, "/api/urls", "", auth, "If-None-Match: "+etag); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match after %s = %d, want %d", what, w.Code, http.StatusNotModified)
+		}
+	}
+	changed := func(what string) {
+		t.Helper()
+		w := serveTest(r, http.MethodGet, "/api/urls", "", auth, "If-None-Match: "+etag)
+		if w.Code != http.StatusOK {
+			t.Errorf("If-None-Match after %s = %d, want %d", what, w.Code, http.StatusOK)
+		}
+		etag = w.Header().Get("ETag")
+	}
+
+	unchanged("nothing")
+	if w := serveTest(r, http.MethodGet, "/api/urls", "", auth, "If-Modified-Since: "+lastModified); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since = %d, want %d", w.Code, http.StatusNotModified)
+	}
+	shorten(otherKey)
+	unchanged("another owner's shorten")
+
+	shorten(key)
+	changed("a shorten")
+	if w := serveTest(r, http.MethodPatch, "/api/urls/"+code, `{"metadata":{"team":"growth"}}`, auth); w.Code != http.StatusOK {
+		t.Fatalf("patch = %d: %s", w.Code, w.Body)
+	}
+	changed("a metadata edit")
+	if _, err := testServer.db.Exec("INSERT INTO click_counters (short_code, clicks) VALUES (?, 3)", code); err != nil {
+		t.Fatal(err)
+	}
+	changed("a click counter flush")
+
+	// A link expiring is a change though nothing was written.
+	now := time.Now()
+	if _, err := testServer.db.Exec("UPDATE urls SET expires_at = ? WHERE short_code = ?", now.Add(time.Hour).UTC().Format(time.RFC3339), code); err != nil {
+		t.Fatal(err)
+	}
+	before, err := testServer.loadLinkVersion(context.Background(), ownerID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := testServer.loadLinkVersion(context.Background(), ownerID, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.etag() == after.etag() || !after.lastModified().After(before.lastModified()) {
+		t.Errorf("versions before and after an expiry are %+v and %+v", before, after)
+	}
+}
+
+func TestConditionalExport(t *testing.T) {
+	r := testServer.newRouter()
+	admin := "Authorization: Bearer " + testAdminToken
+	w := serveTest(r, http.MethodGet, "/api/export?format=csv", "", admin)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("export = %d with ETag %q", w.Code, etag)
+	}
+	if w := serveTest(r, http.MethodGet, "/api/export?format=csv", "", admin, "If-None-Match: "+etag); w.Code != http.StatusNotModified {
+		t.Errorf("export with a current ETag = %d, want %d", w.Code, http.StatusNotModified)
+	}
+	code := "cg-" + newRandomID()[:10]
+	if _, err := testServer.store.Create(context.Background(), ShortenRequest{LongURL: "https://example.com/" + code}, code); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveTest(r, http.MethodGet, "/api/export?format=csv", "", admin, "If-None-Match: "+etag); w.Code != http.StatusOK {
+		t.Errorf("export after a new link = %d, want %d", w.Code, http.StatusOK)
+	}
+}
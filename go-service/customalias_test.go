@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateCustomAlias(t *testing.T) {
+	tests := []struct {
+		alias string
+		ok    bool
+	}{
+		{"promo2024", true},
+		{"Spring_Sale-24", true},
+		{"abc", true},
+		{strings.Repeat("a", 32), true},
+		{"ab", false},
+		{strings.Repeat("a", 33), false},
+		{"no spaces", false},
+		{"bad/slash", false},
+		{"dot.ted", false},
+		{"ünïcode", false},
+		{"promo%20", false},
+		{"api", false},
+		{"API", false},
+		{"health", false},
+		{"Healthz", false},
+		{"readyz", false},
+		{"metrics", false},
+		{"admin", false},
+		{"static", false},
+		{"apis", true},
+	}
+	for _, tt := range tests {
+		if err := validateCustomAlias(tt.alias); (err == nil) != tt.ok {
+			t.Errorf("validateCustomAlias(%q) = %v, want ok %v", tt.alias, err, tt.ok)
+		}
+	}
+}
+
+func TestShortenWithCustomAlias(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	auth := "X-API-Key: " + key
+	alias := "promo-" + newRandomID()[:8]
+
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/promo","custom_alias":"`+alias+`"}`, auth)
+	var created ShortenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("shorten with an alias = %d: %s", w.Code, w.Body)
+	}
+	if created.ShortCode != alias || !strings.HasSuffix(created.ShortURL, "/"+alias) || created.LongURL != "https://example.com/promo" {
+		t.Errorf("response = %+v, want the alias as the code", created)
+	}
+	if w := serveTest(redirectEngine(), http.MethodGet, "/"+alias, ""); w.Code != defaultRedirectStatus || w.Header().Get("Location") != "https://example.com/promo" {
+		t.Errorf("redirect of the alias = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/other","custom_alias":"`+alias+`"}`, auth)
+	var conflict struct{ Error string }
+	json.Unmarshal(w.Body.Bytes(), &conflict)
+	if w.Code != http.StatusConflict || !strings.Contains(conflict.Error, "already taken") {
+		t.Errorf("shorten with a taken alias = %d: %s", w.Code, w.Body)
+	}
+
+	for _, bad := range []string{"no spaces", "x", "bad/slash", "api", "Health"} {
+		w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/bad","custom_alias":"`+bad+`"}`, auth)
+		var resp struct{ Error string }
+		if json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusBadRequest || !strings.Contains(resp.Error, "custom_alias") {
+			t.Errorf("shorten with alias %q = %d: %s", bad, w.Code, w.Body)
+		}
+	}
+}
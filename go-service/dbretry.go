@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// dbBusyMaxWait bounds how long a write keeps retrying SQLITE_BUSY/LOCKED
+// when the caller's context has no earlier deadline.
+var dbBusyMaxWait = getEnvDuration("DB_BUSY_MAX_WAIT", 2*time.Second)
+
+// dbBusyStats counts busy retries; a steady climb is the signal that a
+// single SQLite writer is no longer enough.
+var dbBusyStats = expvar.NewMap("db_busy")
+
+// errDBBusy is returned once retries are exhausted. Handlers map it to 503.
+var errDBBusy = errors.New("database busy")
+
+const (
+	dbBusyInitialBackoff = 5 * time.Millisecond
+	dbBusyMaxBackoff     = 200 * time.Millisecond
+)
+
+// isBusyError reports whether err is SQLite's busy or locked error, or the
+// Postgres errors that likewise clear up on a retry: a serialization
+// failure, a deadlock or a lock that wasn't available.
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	switch postgresErrorCode(err) {
+	case pgSerializationFailure, pgDeadlockDetected, pgLockNotAvailable:
+		return true
+	}
+	return false
+}
+
+// execWithRetry runs a write, retrying busy/locked errors with jittered
+// exponential backoff until ctx's deadline or dbBusyMaxWait, whichever is
+// sooner. Other errors are returned straight away.
+func (s *Server) execWithRetry(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return dbExecWithRetry(ctx, s.db, query, args...)
+}
+
+// txWithRetry runs fn in a transaction and commits it, rerunning the whole
+// transaction on busy/locked errors as execWithRetry does. fn must not have
+// effects outside tx.
+func (s *Server) txWithRetry(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return dbTxWithRetry(ctx, s.db, fn)
+}
+
+// dbExecWithRetry is execWithRetry on db.
+func dbExecWithRetry(ctx context.Context, db *sql.DB, query string, args ...any) (sql.Result, error) {
+	var res sql.Result
+	err := retryBusy(ctx, func() error {
+		var err error
+		res, err = db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+// dbTxWithRetry is txWithRetry on db.
+func dbTxWithRetry(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	return retryBusy(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// inSavepoint runs fn in a savepoint of tx and rolls back to it when fn
+// fails, so the transaction can go on without fn's statements. SQLite
+// carries on after a failed statement anyway; Postgres fails the whole
+// transaction unless the statement ran in a savepoint.
+func inSavepoint(ctx context.Context, tx *sql.Tx, fn func() error) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT retry_point"); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT retry_point"); rbErr != nil {
+			return errors.Join(err, rbErr)
+		}
+		tx.ExecContext(ctx, "RELEASE SAVEPOINT retry_point")
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT retry_point")
+	return err
+}
+
+func retryBusy(ctx context.Context, fn func() error) error {
+	deadline := time.Now().Add(dbBusyMaxWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	backoff := dbBusyInitialBackoff
+	for {
+		err := fn()
+		if err == nil || !isBusyError(err) {
+			return err
+		}
+
+		wait := backoff/2 + rand.N(backoff)
+		if time.Now().Add(wait).After(deadline) {
+			dbBusyStats.Add("exhausted", 1)
+			return fmt.Errorf("%w: %v", errDBBusy, err)
+		}
+		dbBusyStats.Add("retries", 1)
+
+		select {
+		case <-ctx.Done():
+			dbBusyStats.Add("exhausted", 1)
+			return fmt.Errorf("%w: %v", errDBBusy, err)
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, dbBusyMaxBackoff)
+	}
+}
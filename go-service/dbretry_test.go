@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newBusyServer is a Server on its own SQLite file that reports busy at
+// once rather than waiting in SQLite, and a function that holds the write
+// lock from another connection, as a long-running transaction would, until
+// the returned release is called.
+func newBusyServer(t *testing.T) (*Server, func() (release func())) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "busy.db") + "?_busy_timeout=0"
+	s, err := NewServer(Config{DatabaseURL: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	holder, err := sql.Open(timedSQLiteDriverName, sqliteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { holder.Close() })
+
+	hold := func() func() {
+		conn, err := holder.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+			t.Fatal(err)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "ROLLBACK")
+			conn.Close()
+		}
+	}
+	return s, hold
+}
+
+func busyCount(name string) int64 {
+	if v, ok := dbBusyStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestExecWithRetryWaitsOutATransaction(t *testing.T) {
+	s, hold := newBusyServer(t)
+	retries := busyCount("retries")
+
+	release := hold()
+	time.AfterFunc(150*time.Millisecond, release)
+	start := time.Now()
+	if _, err := s.execWithRetry(context.Background(), "INSERT INTO urls (short_code, long_url) VALUES (?, ?)", "busy-1", "https://example.com/busy"); err != nil {
+		t.Fatalf("execWithRetry while a transaction held the lock for 150ms: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("the write took %s, want it done soon after the lock was released", elapsed)
+	}
+	if busyCount("retries") == retries {
+		t.Error("no busy retries counted")
+	}
+}
+
+func TestExecWithRetryGivesUp(t *testing.T) {
+	s, hold := newBusyServer(t)
+	defer hold()()
+	saved := dbBusyMaxWait
+	dbBusyMaxWait = 100 * time.Millisecond
+	t.Cleanup(func() { dbBusyMaxWait = saved })
+
+	exhausted := busyCount("exhausted")
+	start := time.Now()
+	_, err := s.execWithRetry(context.Background(), "INSERT INTO urls (short_code, long_url) VALUES (?, ?)", "busy-2", "https://example.com/busy")
+	if !errors.Is(err, errDBBusy) {
+		t.Fatalf("execWithRetry with the lock held = %v, want errDBBusy", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("gave up after %s, want about DB_BUSY_MAX_WAIT", elapsed)
+	}
+	if busyCount("exhausted") != exhausted+1 {
+		t.Errorf("exhausted = %d, want %d", busyCount("exhausted"), exhausted+1)
+	}
+
+	// An earlier request deadline wins over DB_BUSY_MAX_WAIT.
+	dbBusyMaxWait = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := s.txWithRetry(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO urls (short_code, long_url) VALUES (?, ?)", "busy-3", "https://example.com/busy")
+		return err
+	}); err == nil || time.Since(start) > 300*time.Millisecond {
+		t.Errorf("txWithRetry under a 50ms deadline = %v after %s", err, time.Since(start))
+	}
+}
+
+func TestShortenWhileDatabaseLocked(t *testing.T) {
+	s, hold := newBusyServer(t)
+	saved := dbBusyMaxWait
+	dbBusyMaxWait = 100 * time.Millisecond
+	t.Cleanup(func() { dbBusyMaxWait = saved })
+	r := s.newRouter()
+	admin := "Authorization: Bearer " + testAdminToken
+
+	release := hold()
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/locked"}`, admin)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("shorten with the database locked = %d (Retry-After %q): %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+	release()
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/locked"}`, admin); w.Code != http.StatusOK {
+		t.Errorf("shorten once the lock was released = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Debug capture records full /api/* requests and responses for support
+// sessions. It is off by default, switched on through the admin API and
+// always switches itself off again.
+var (
+	debugCaptureEntries     = getEnvInt("DEBUG_CAPTURE_ENTRIES", 200)
+	debugCaptureMaxBody     = getEnvInt("DEBUG_CAPTURE_MAX_BODY", 8*1024)
+	debugCaptureMaxDuration = getEnvDuration("DEBUG_CAPTURE_MAX_DURATION", time.Hour)
+
+	// debugCaptureUntil is the UnixNano at which capture stops; 0 is off.
+	debugCaptureUntil atomic.Int64
+	debugCaptures     = newCaptureRing(debugCaptureEntries)
+)
+
+// redactedHeaders never appear in captures.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Admin-Token", "X-API-Key", SignatureHeader}
+
+type capturedExchange struct {
+	ID                int64             `json:"id"`
+	Time              string            `json:"time"`
+	Method            string            `json:"method"`
+	Path              string            `json:"path"`
+	Status            int               `json:"status"`
+	DurationMS        float64           `json:"duration_ms"`
+	ClientIP          string            `json:"client_ip"`
+	RequestHeaders    map[string]string `json:"request_headers"`
+	RequestBody       string            `json:"request_body"`
+	RequestTruncated  bool              `json:"request_truncated"`
+	ResponseBody      string            `json:"response_body"`
+	ResponseTruncated bool              `json:"response_truncated"`
+}
+
+type captureRing struct {
+	mu      sync.Mutex
+	entries []capturedExchange
+	next    int
+	seq     int64
+}
+
+func newCaptureRing(size int) *captureRing {
+	if size < 1 {
+		size = 1
+	}
+	return &captureRing{entries: make([]capturedExchange, 0, size)}
+}
+
+func (r *captureRing) add(e capturedExchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	e.ID = r.seq
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// list returns matching entries, newest first.
+func (r *captureRing) list(match func(capturedExchange) bool) []capturedExchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := []capturedExchange{}
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		e := r.entries[(r.next+i)%len(r.entries)]
+		if match(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (r *captureRing) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = r.entries[:0]
+	r.next = 0
+}
+
+func debugCaptureActive(now time.Time) bool {
+	return now.UnixNano() < debugCaptureUntil.Load()
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest.
+type cappedBuffer struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - len(b.buf); room > 0 {
+		if len(p) > room {
+			b.buf = append(b.buf, p[:room]...)
+			b.truncated = true
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+type captureResponseWriter struct {
+	gin.ResponseWriter
+	body *cappedBuffer
+}
+
+func (w captureResponseWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w captureResponseWriter) WriteString(s string) (int, error) {
+	w.body.Write([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// debugCaptureMiddleware tees /api/* bodies into the ring while capture is
+// on. The redirect route is never captured. Bodies are only recorded as far
+// as the handler reads them, and never beyond DEBUG_CAPTURE_MAX_BODY.
+func debugCaptureMiddleware(c *gin.Context) {
+	start := time.Now()
+	if !debugCaptureActive(start) || !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		c.Next()
+		return
+	}
+
+	reqBody := &cappedBuffer{max: debugCaptureMaxBody}
+	if c.Request.Body != nil {
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(c.Request.Body, reqBody), c.Request.Body}
+	}
+	respBody := &cappedBuffer{max: debugCaptureMaxBody}
+	c.Writer = captureResponseWriter{ResponseWriter: c.Writer, body: respBody}
+
+	c.Next()
+
+	headers := map[string]string{}
+	for name := range c.Request.Header {
+		headers[name] = c.Request.Header.Get(name)
+	}
+	for _, name := range redactedHeaders {
+		if _, ok := headers[http.CanonicalHeaderKey(name)]; ok {
+			headers[http.CanonicalHeaderKey(name)] = redactedValue
+		}
+	}
+
+	debugCaptures.add(capturedExchange{
+		Time:              start.UTC().Format(time.RFC3339Nano),
+		Method:            c.Request.Method,
+		Path:              redactURL(c.Request.URL.RequestURI()),
+		Status:            c.Writer.Status(),
+		DurationMS:        float64(time.Since(start).Microseconds()) / 1000,
+		ClientIP:          clientIP(c),
+		RequestHeaders:    headers,
+		RequestBody:       redactCapturedBody(reqBody.buf, c.ContentType(), c.GetHeader("Content-Encoding")),
+		RequestTruncated:  reqBody.truncated,
+		ResponseBody:      redactCapturedBody(respBody.buf, c.Writer.Header().Get("Content-Type"), c.Writer.Header().Get("Content-Encoding")),
+		ResponseTruncated: respBody.truncated,
+	})
+}
+
+// redactCapturedBody applies the log redaction rules to a captured body:
+// sensitive JSON keys and form fields are masked, and URLs inside JSON go
+// through redactURL. Binary and compressed bodies are not kept.
+func redactCapturedBody(body []byte, contentType, contentEncoding string) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if contentEncoding != "" || !utf8.Valid(body) {
+		return "[" + strconv.Itoa(len(body)) + " bytes not shown]"
+	}
+
+	// Sniff JSON rather than trusting Content-Type: misbehaving clients are
+	// exactly the ones that get it wrong.
+	var v any
+	if json.Unmarshal(body, &v) == nil {
+		if out, err := json.Marshal(redactJSONValue(v)); err == nil {
+			return string(out)
+		}
+	}
+	if strings.Contains(contentType, "x-www-form-urlencoded") {
+		return redactQuery(string(body))
+	}
+	return string(body)
+}
+
+func redactJSONValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			if isSensitiveParam(k) {
+				v[k] = redactedValue
+			} else {
+				v[k] = redactJSONValue(item)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactJSONValue(item)
+		}
+	case string:
+		if strings.Contains(v, "://") {
+			return redactURL(v)
+		}
+	}
+	return v
+}
+
+type debugCaptureRequest struct {
+	Enabled bool `json:"enabled"`
+	// Duration defaults to and is capped at DEBUG_CAPTURE_MAX_DURATION.
+	Duration string `json:"duration"`
+}
+
+func getDebugCapture(c *gin.Context) {
+	c.JSON(http.StatusOK, debugCaptureStatus())
+}
+
+func putDebugCapture(c *gin.Context) {
+	var req debugCaptureRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.Enabled {
+		debugCaptureUntil.Store(0)
+		log.Printf("Debug capture disabled")
+		c.JSON(http.StatusOK, debugCaptureStatus())
+		return
+	}
+
+	duration := debugCaptureMaxDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+			return
+		}
+		duration = min(d, debugCaptureMaxDuration)
+	}
+	debugCaptureUntil.Store(time.Now().Add(duration).UnixNano())
+	log.Printf("Debug capture enabled for %s", duration)
+	c.JSON(http.StatusOK, debugCaptureStatus())
+}
+
+func debugCaptureStatus() gin.H {
+	status := gin.H{"enabled": debugCaptureActive(time.Now())}
+	if until := debugCaptureUntil.Load(); status["enabled"] == true {
+		status["until"] = time.Unix(0, until).UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// getDebugRequests serves GET /admin/debug/requests?path=&status=. path
+// matches by prefix; status is an exact code or a class like 4xx.
+func getDebugRequests(c *gin.Context) {
+	path := c.Query("path")
+	status := strings.ToLower(c.Query("status"))
+	entries := debugCaptures.list(func(e capturedExchange) bool {
+		if path != "" && !strings.HasPrefix(e.Path, path) {
+			return false
+		}
+		if status != "" {
+			code := strconv.Itoa(e.Status)
+			if strings.HasSuffix(status, "xx") {
+				return strings.HasPrefix(code, strings.TrimSuffix(status, "xx"))
+			}
+			return code == status
+		}
+		return true
+	})
+	c.JSON(http.StatusOK, gin.H{"capture": debugCaptureStatus(), "requests": entries})
+}
+
+func deleteDebugRequests(c *gin.Context) {
+	debugCaptures.clear()
+	c.Status(http.StatusNoContent)
+}
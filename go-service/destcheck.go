@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// With VERIFY_DESTINATION on, every way of creating a link (POST
+// /api/shorten, each item of /api/shorten/batch, the homepage form and the
+// Shorten RPC) fetches the destination before storing it, following up to
+// VERIFY_DESTINATION_MAX_REDIRECTS redirects, all within
+// VERIFY_DESTINATION_TIMEOUT. A destination that resolves to a non-public
+// address, redirects back into this shortener, answers 4xx/5xx or can't be
+// reached is refused with 422, or, with VERIFY_DESTINATION_ACTION=flag,
+// stored held back like a link waiting for a safety scan. Where the
+// destination ended up and its status are stored with the link. Trusted
+// API keys may send skip_verification. A destination OUTBOUND_POLICY_FILE
+// doesn't let us fetch now is not checked, the reason returned as
+// destination_check_skipped.
+var (
+	verifyDestination             = getEnvBool("VERIFY_DESTINATION", false)
+	verifyDestinationTimeout      = getEnvDuration("VERIFY_DESTINATION_TIMEOUT", 3*time.Second)
+	verifyDestinationMaxRedirects = getEnvInt("VERIFY_DESTINATION_MAX_REDIRECTS", 5)
+	verifyDestinationAction       = getEnv("VERIFY_DESTINATION_ACTION", "reject")
+)
+
+// destinationMaxBody is how much of a response body is read before the
+// connection is dropped.
+const destinationMaxBody = 64 * 1024
+
+// Problems a destination check finds, stored in urls.destination_problem
+// and returned as the code of a refusal.
+const (
+	destinationNonPublic        = "destination_non_public"
+	destinationLoop             = "destination_loop"
+	destinationTooManyRedirects = "destination_too_many_redirects"
+	destinationHTTPError        = "destination_http_error"
+	destinationUnreachable      = "destination_unreachable"
+)
+
+var (
+	errDestinationLoop             = errors.New("destination redirects back into this shortener")
+	errDestinationTooManyRedirects = errors.New("destination redirects too many times")
+)
+
+var destinationChecksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "urlshortener_destination_checks_total",
+	Help: "Destination checks of new links by result: ok, skipped, or the problem found.",
+}, []string{"result"})
+
+// destinationTransport only reaches public addresses, like the domain
+// verifier's.
+var destinationTransport = &http.Transport{
+	Proxy:                 guardedProxy,
+	DialContext:           guardedDialContext(&net.Dialer{Timeout: 2 * time.Second}),
+	TLSHandshakeTimeout:   2 * time.Second,
+	ResponseHeaderTimeout: 3 * time.Second,
+	MaxIdleConns:          10,
+	IdleConnTimeout:       30 * time.Second,
+}
+
+func initDestinationCheck() {
+	if verifyDestinationAction != "reject" && verifyDestinationAction != "flag" {
+		log.Fatalf("Invalid VERIFY_DESTINATION_ACTION %q: must be reject or flag", verifyDestinationAction)
+	}
+}
+
+// destinationCheck is what checking a destination found. Problem is empty
+// for a usable destination.
+type destinationCheck struct {
+	ResolvedURL string
+	Status      int
+	Problem     string
+	Detail      string
+	// Skipped is why an outbound policy stopped the check, which then
+	// found nothing.
+	Skipped string
+}
+
+// checkDestination fetches longURL, HEAD first and GET when HEAD isn't
+// allowed, treating ownHosts as this shortener.
+func checkDestination(ctx context.Context, longURL string, ownHosts map[string]bool) destinationCheck {
+	check := destinationCheck{ResolvedURL: longURL}
+	if u, err := url.Parse(longURL); err == nil && ownHosts[strings.ToLower(u.Host)] {
+		check.Problem, check.Detail = destinationLoop, errDestinationLoop.Error()
+		return check
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, verifyDestinationTimeout)
+	defer cancel()
+	client := &http.Client{
+		Transport: &outboundPolicyTransport{feature: "destination_check", base: destinationTransport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			check.ResolvedURL = req.URL.String()
+			if ownHosts[strings.ToLower(req.URL.Host)] {
+				return errDestinationLoop
+			}
+			if len(via) > verifyDestinationMaxRedirects {
+				return errDestinationTooManyRedirects
+			}
+			return nil
+		},
+	}
+	resp, err := fetchDestination(ctx, client, http.MethodHead, longURL)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		resp, err = fetchDestination(ctx, client, http.MethodGet, longURL)
+	}
+	if err != nil {
+		if reason := outboundSkipReason(err); reason != "" {
+			return destinationCheck{ResolvedURL: longURL, Skipped: reason}
+		}
+		switch {
+		case errors.Is(err, errNonPublicAddress):
+			check.Problem, check.Detail = destinationNonPublic, "destination resolves to a non-public address"
+		case errors.Is(err, errDestinationLoop):
+			check.Problem, check.Detail = destinationLoop, errDestinationLoop.Error()
+		case errors.Is(err, errDestinationTooManyRedirects):
+			check.Problem, check.Detail = destinationTooManyRedirects, errDestinationTooManyRedirects.Error()
+		case errors.Is(err, context.DeadlineExceeded):
+			check.Problem, check.Detail = destinationUnreachable, "destination did not answer within "+verifyDestinationTimeout.String()
+		default:
+			check.Problem, check.Detail = destinationUnreachable, "destination could not be reached"
+		}
+		return check
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, destinationMaxBody))
+
+	check.ResolvedURL, check.Status = resp.Request.URL.String(), resp.StatusCode
+	if resp.StatusCode >= 400 {
+		check.Problem, check.Detail = destinationHTTPError, "destination answered "+resp.Status
+	}
+	return check
+}
+
+func fetchDestination(ctx context.Context, client *http.Client, method, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "url-shortener-destination-check")
+	return client.Do(req)
+}
+
+// shortenerHosts are the hosts a destination must not lead back to.
+func shortenerHosts(c *gin.Context) map[string]bool {
+	hosts := map[string]bool{strings.ToLower(c.Request.Host): true}
+	if u, err := url.Parse(publicBaseURL(c)); err == nil {
+		hosts[strings.ToLower(u.Host)] = true
+	}
+	return hosts
+}
+
+// verifyShortenDestination runs the destination check for req, keeping
+// the result on it. It reports false, having answered, when the request is
+// refused.
+func (s *Server) verifyShortenDestination(c *gin.Context, req *ShortenRequest) bool {
+	if !verifyDestination {
+		return true
+	}
+	if req.SkipVerification {
+		if !c.GetBool(apiKeyTrustedContextKey) && !s.isAdminCaller(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "skip_verification requires a trusted API key", "code": "skip_verification_forbidden"})
+			return false
+		}
+		destinationChecksTotal.WithLabelValues("skipped").Inc()
+		return true
+	}
+
+	check, refused := runDestinationCheck(c.Request.Context(), req, shortenerHosts(c), clientIP(c))
+	if !refused {
+		return true
+	}
+	response := gin.H{"error": "long_url failed the destination check: " + check.Detail, "code": check.Problem, "resolved_url": check.ResolvedURL}
+	if check.Status != 0 {
+		response["resolved_status"] = check.Status
+	}
+	c.JSON(http.StatusUnprocessableEntity, response)
+	return false
+}
+
+// runDestinationCheck checks req's destination, keeping the result on req,
+// and reports whether VERIFY_DESTINATION_ACTION refuses the link. from
+// names the caller in the log.
+func runDestinationCheck(ctx context.Context, req *ShortenRequest, hosts map[string]bool, from string) (destinationCheck, bool) {
+	check := checkDestination(ctx, req.LongURL, hosts)
+	req.destination = &check
+	if check.Skipped != "" {
+		destinationChecksTotal.WithLabelValues("skipped").Inc()
+		log.Printf("Destination check of %s from %s skipped: %s", redactURL(req.LongURL), from, check.Skipped)
+		return check, false
+	}
+	if check.Problem == "" {
+		destinationChecksTotal.WithLabelValues("ok").Inc()
+		return check, false
+	}
+	destinationChecksTotal.WithLabelValues(check.Problem).Inc()
+	log.Printf("Destination check of %s from %s: %s (%s)", redactURL(req.LongURL), from, check.Problem, redactURL(check.ResolvedURL))
+	return check, verifyDestinationAction != "flag"
+}
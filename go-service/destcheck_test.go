@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// withDestinationCheck turns VERIFY_DESTINATION on with action for the rest
+// of the test and returns a server whose /ok answers 200 and everything
+// else 404. The check may reach it although it is on loopback.
+func withDestinationCheck(tb testing.TB, action string) *httptest.Server {
+	tb.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	savedOn, savedAction, savedTransport := verifyDestination, verifyDestinationAction, destinationTransport
+	verifyDestination, verifyDestinationAction, destinationTransport = true, action, &http.Transport{}
+	tb.Cleanup(func() {
+		verifyDestination, verifyDestinationAction, destinationTransport = savedOn, savedAction, savedTransport
+		srv.Close()
+	})
+	return srv
+}
+
+func TestShortenBatchChecksDestinations(t *testing.T) {
+	srv := withDestinationCheck(t, "reject")
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+
+	body := `[{"long_url":"` + srv.URL + `/ok"},{"long_url":"` + srv.URL + `/missing"},{"long_url":"` + srv.URL + `/ok?skip","skip_verification":true}]`
+	w := serveTest(r, http.MethodPost, "/api/shorten/batch", body, "X-API-Key: "+key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /api/shorten/batch = %d: %s", w.Code, w.Body)
+	}
+	var resp struct{ Results []shortenBatchResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ status, code string }{
+		{"created", ""},
+		{"invalid", destinationHTTPError},
+		{"invalid", "skip_verification_forbidden"},
+	}
+	for i, tt := range want {
+		if got := resp.Results[i]; got.Status != tt.status || got.Code != tt.code {
+			t.Errorf("item %d = %s/%s, want %s/%s", i, got.Status, got.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestShortenBatchFlagsDestinations(t *testing.T) {
+	srv := withDestinationCheck(t, "flag")
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+
+	w := serveTest(r, http.MethodPost, "/api/shorten/batch", `[{"long_url":"`+srv.URL+`/flagged"}]`, "X-API-Key: "+key)
+	var resp struct{ Results []shortenBatchResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 {
+		t.Fatalf("POST /api/shorten/batch = %d: %s", w.Code, w.Body)
+	}
+	if resp.Results[0].Status != "created" {
+		t.Fatalf("flagged item = %+v, want created", resp.Results[0])
+	}
+	var problem string
+	if err := testServer.db.QueryRow("SELECT destination_problem FROM urls WHERE short_code = ?", resp.Results[0].ShortCode).Scan(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem != destinationHTTPError {
+		t.Errorf("destination_problem = %q, want %q", problem, destinationHTTPError)
+	}
+}
+
+func TestHomepageShortenChecksDestination(t *testing.T) {
+	srv := withDestinationCheck(t, "reject")
+	apiKeysRequired = false
+	t.Cleanup(func() { apiKeysRequired = true })
+	r := testServer.newRouter()
+
+	for path, want := range map[string]int{"/ok": http.StatusOK, "/missing": http.StatusUnprocessableEntity} {
+		form := url.Values{"long_url": {srv.URL + path}, "csrf_token": {"t"}}
+		w := serveTest(r, http.MethodPost, "/", form.Encode(), "Content-Type: application/x-www-form-urlencoded", "Cookie: "+csrfCookieName+"=t")
+		if w.Code != want {
+			t.Errorf("POST / with %s = %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Domain verification lets an owner prove control of a destination domain,
+// either with a DNS TXT record or a meta tag on the site's home page. Links
+// from that owner to that domain (or its subdomains) are then reported as
+// verified.
+var (
+	domainVerifyInterval   = getEnvDuration("DOMAIN_VERIFY_INTERVAL", time.Minute)
+	domainReverifyInterval = getEnvDuration("DOMAIN_REVERIFY_INTERVAL", 24*time.Hour)
+	// domainPendingTTL stops checking claims nobody completed.
+	domainPendingTTL = getEnvDuration("DOMAIN_PENDING_TTL", 7*24*time.Hour)
+)
+
+const (
+	domainVerifyTXTPrefix = "_shortener-verify."
+	domainVerifyMetaName  = "shortener-verify"
+	domainVerifyMaxBody   = 256 * 1024
+
+	domainMethodDNS  = "dns"
+	domainMethodMeta = "meta"
+
+	domainStatusPending  = "pending"
+	domainStatusVerified = "verified"
+	domainStatusRevoked  = "revoked"
+)
+
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+var (
+	metaTagPattern     = regexp.MustCompile(`(?is)<meta\b[^>]*>`)
+	metaNamePattern    = regexp.MustCompile(`(?is)\bname\s*=\s*["']?([^"'\s>]+)`)
+	metaContentPattern = regexp.MustCompile(`(?is)\bcontent\s*=\s*["']?([^"'\s>]+)`)
+)
+
+var errNonPublicAddress = errors.New("refusing to connect to a non-public address")
+
+// verifierClient fetches user-supplied sites, so it only reaches public
+// addresses (checked after DNS resolution, or before handing the request to
+// a proxy), caps redirects, never sends credentials and keeps to
+// OUTBOUND_POLICY_FILE.
+var verifierClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &outboundPolicyTransport{feature: "domain_verifier", base: &http.Transport{
+		Proxy:                 guardedProxy,
+		DialContext:           guardedDialContext(&net.Dialer{Timeout: 5 * time.Second}),
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("too many redirects")
+		}
+		return nil
+	},
+}
+
+// normalizeDomain lowercases d and rejects IPs, ports and anything that is
+// not a plain multi-label hostname.
+func normalizeDomain(d string) (string, bool) {
+	d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+	if len(d) > 253 || !domainPattern.MatchString(d) {
+		return "", false
+	}
+	return d, true
+}
+
+type domainVerifyRequest struct {
+	Domain string `json:"domain" binding:"required"`
+	// Method is "dns" (default) or "meta".
+	Method string `json:"method"`
+}
+
+// requestDomainVerification serves POST /api/domains/verify. It issues (or
+// re-issues) the owner's token for a domain and schedules a check.
+func (s *Server) requestDomainVerification(c *gin.Context) {
+	owner := c.GetString(ownerContextKey)
+	if owner == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Domain verification requires an authenticated owner"})
+		return
+	}
+
+	var req domainVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	domain, ok := normalizeDomain(req.Domain)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "domain must be a hostname such as example.com"})
+		return
+	}
+	if req.Method == "" {
+		req.Method = domainMethodDNS
+	}
+	if req.Method != domainMethodDNS && req.Method != domainMethodMeta {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "method must be dns or meta"})
+		return
+	}
+
+	// Keep an existing token so a proof already in place stays valid.
+	token := newRandomID()
+	_, err := s.db.ExecContext(c.Request.Context(), `INSERT INTO domain_verifications (owner, domain, token, method) VALUES (?, ?, ?, ?)
+		ON CONFLICT (owner, domain) DO UPDATE SET method = excluded.method,
+			status = CASE WHEN domain_verifications.status = 'revoked' THEN 'pending' ELSE domain_verifications.status END,
+			created_at = CASE WHEN domain_verifications.status = 'revoked' THEN datetime() ELSE domain_verifications.created_at END`,
+		owner, domain, token, req.Method)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	var status string
+	if err := s.db.QueryRowContext(c.Request.Context(), "SELECT token, status FROM domain_verifications WHERE owner = ? AND domain = ?", owner, domain).Scan(&token, &status); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	go s.checkDomain(context.WithoutCancel(c.Request.Context()), owner, domain)
+
+	response := gin.H{"domain": domain, "method": req.Method, "status": status, "token": token}
+	if req.Method == domainMethodDNS {
+		response["instructions"] = fmt.Sprintf("Add a TXT record %s%s with the value %s=%s", domainVerifyTXTPrefix, domain, domainVerifyMetaName, token)
+	} else {
+		response["instructions"] = fmt.Sprintf(`Serve <meta name="%s" content="%s"> on https://%s/`, domainVerifyMetaName, token, domain)
+	}
+	c.JSON(http.StatusAccepted, response)
+}
+
+// listDomains serves GET /api/domains for the authenticated owner.
+func (s *Server) listDomains(c *gin.Context) {
+	owner := c.GetString(ownerContextKey)
+	if owner == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Domain verification requires an authenticated owner"})
+		return
+	}
+
+	rows, err := s.db.QueryContext(c.Request.Context(), `SELECT domain, method, status, COALESCE(verified_at, ''), COALESCE(checked_at, '')
+		FROM domain_verifications WHERE owner = ? ORDER BY domain`, owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	domains := []gin.H{}
+	for rows.Next() {
+		var domain, method, status, verifiedAt, checkedAt string
+		if err := rows.Scan(&domain, &method, &status, &verifiedAt, &checkedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		domains = append(domains, gin.H{"domain": domain, "method": method, "status": status, "verified_at": verifiedAt, "checked_at": checkedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"domains": domains})
+}
+
+// checkDomain looks for the proof once and records the outcome. A verified
+// domain whose proof is gone is revoked; a pending one stays pending.
+func (s *Server) checkDomain(ctx context.Context, owner, domain string) {
+	var token, method, status string
+	err := s.db.QueryRowContext(ctx, "SELECT token, method, status FROM domain_verifications WHERE owner = ? AND domain = ?", owner, domain).
+		Scan(&token, &method, &status)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading domain verification for %s: %v", domain, err)
+		}
+		return
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	proven, err := domainProofPresent(checkCtx, domain, method, token)
+	if reason := outboundSkipReason(err); reason != "" {
+		// Tried again next round, the claim left as it was.
+		log.Printf("Domain verification check for %s skipped: %s", domain, reason)
+		return
+	}
+	if err != nil {
+		log.Printf("Domain verification check for %s failed: %v", domain, err)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	switch {
+	case proven:
+		_, err = s.db.ExecContext(ctx, `UPDATE domain_verifications SET status = 'verified', checked_at = ?,
+			verified_at = CASE WHEN status = 'verified' THEN verified_at ELSE ? END
+			WHERE owner = ? AND domain = ?`, now, now, owner, domain)
+		if status != domainStatusVerified {
+			log.Printf("Domain %s verified for owner %s", domain, owner)
+		}
+	case status == domainStatusVerified:
+		_, err = s.db.ExecContext(ctx, "UPDATE domain_verifications SET status = 'revoked', checked_at = ? WHERE owner = ? AND domain = ?", now, owner, domain)
+		log.Printf("Domain %s verification revoked for owner %s: proof not found", domain, owner)
+	default:
+		_, err = s.db.ExecContext(ctx, "UPDATE domain_verifications SET checked_at = ? WHERE owner = ? AND domain = ?", now, owner, domain)
+	}
+	if err != nil {
+		log.Printf("Error recording domain verification for %s: %v", domain, err)
+	}
+}
+
+func domainProofPresent(ctx context.Context, domain, method, token string) (bool, error) {
+	want := domainVerifyMetaName + "=" + token
+	if method == domainMethodDNS {
+		records, err := net.DefaultResolver.LookupTXT(ctx, domainVerifyTXTPrefix+domain)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return false, nil
+			}
+			return false, err
+		}
+		for _, r := range records {
+			if strings.TrimSpace(r) == want {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, (&url.URL{Scheme: "https", Host: domain, Path: "/"}).String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "url-shortener-domain-verifier")
+	resp, err := verifierClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, domainVerifyMaxBody))
+	if err != nil {
+		return false, err
+	}
+	for _, tag := range metaTagPattern.FindAll(body, -1) {
+		name := metaNamePattern.FindSubmatch(tag)
+		content := metaContentPattern.FindSubmatch(tag)
+		if name != nil && content != nil && strings.EqualFold(string(name[1]), domainVerifyMetaName) && string(content[1]) == token {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// registerDomainVerifier checks pending claims every DOMAIN_VERIFY_INTERVAL
+// and re-checks verified domains every DOMAIN_REVERIFY_INTERVAL.
+func (s *Server) registerDomainVerifier() {
+	app.RegisterBackgroundJob("domain_verifier", domainVerifyInterval, s.verifyDueDomains)
+}
+
+func (s *Server) verifyDueDomains(ctx context.Context) error {
+	if inMaintenance() {
+		return nil
+	}
+	now := time.Now().UTC()
+	rows, err := s.db.QueryContext(ctx, `SELECT owner, domain FROM domain_verifications
+		WHERE (status = 'pending' AND datetime(created_at) >= datetime(?))
+		   OR (status = 'verified' AND (checked_at IS NULL OR datetime(checked_at) < datetime(?)))`,
+		now.Add(-domainPendingTTL).Format(time.RFC3339), now.Add(-domainReverifyInterval).Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("listing domains to verify: %w", err)
+	}
+	type due struct{ owner, domain string }
+	var list []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.owner, &d.domain); err == nil {
+			list = append(list, d)
+		}
+	}
+	rows.Close()
+
+	for _, d := range list {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.checkDomain(ctx, d.owner, d.domain)
+	}
+	return nil
+}
+
+// linkVerified reports whether owner has a verified claim on longURL's host
+// or one of its parent domains.
+func (s *Server) linkVerified(ctx context.Context, owner, longURL string) bool {
+	if owner == "" {
+		return false
+	}
+	u, err := url.Parse(longURL)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+	var candidates []any
+	for h := host; strings.Contains(h, "."); h = h[strings.Index(h, ".")+1:] {
+		candidates = append(candidates, h)
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+	args := append([]any{owner}, candidates...)
+	var n int
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM domain_verifications WHERE owner = ? AND status = 'verified'
+		AND domain IN (?`+strings.Repeat(", ?", len(candidates)-1)+`)`, args...).Scan(&n)
+	return err == nil && n > 0
+}
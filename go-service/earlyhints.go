@@ -0,0 +1,148 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Early hints: for hot links, GET /:code first sends a 103 with a
+// Link: rel=preconnect to the destination origin, so browsers start DNS and
+// TLS while the redirect is still on its way. A link is hot when flagged at
+// creation or, with EARLY_HINTS_TOP_N set, when it was among the N most
+// clicked codes of the previous EARLY_HINTS_WINDOW in this process.
+var (
+	earlyHintsEnabled = getEnvBool("EARLY_HINTS_ENABLED", false)
+	earlyHintsTopN    = getEnvInt("EARLY_HINTS_TOP_N", 0)
+	earlyHintsWindow  = getEnvDuration("EARLY_HINTS_WINDOW", 5*time.Minute)
+)
+
+// cachedLink is the Redis cache record for a short code. The origin is
+// precomputed so the cache-hit path never parses the URL.
+type cachedLink struct {
+	LongURL string `json:"u"`
+	Origin  string `json:"o,omitempty"`
+	Hot     bool   `json:"h,omitempty"`
+	// RedirectType is the link's own redirect status, 0 for REDIRECT_STATUS.
+	RedirectType int `json:"r,omitempty"`
+	// ExpiresAt is the link's expiry as a Unix time, 0 if it has none.
+	ExpiresAt int64 `json:"e,omitempty"`
+	// UTM is the link's stored utm column; LongURL is always the base URL
+	// it is merged into.
+	UTM string `json:"m,omitempty"`
+}
+
+func newCachedLink(longURL string, hot bool, redirectType int, expiresAt sql.NullString, utm string) cachedLink {
+	link := cachedLink{LongURL: longURL, Origin: destinationOrigin(longURL), Hot: hot, RedirectType: redirectType, UTM: utm}
+	if t, err := time.Parse(time.RFC3339, expiresAt.String); expiresAt.Valid && err == nil {
+		link.ExpiresAt = t.Unix()
+	}
+	return link
+}
+
+func encodeCachedLink(longURL string, hot bool, redirectType int, expiresAt sql.NullString, utm string) string {
+	data, _ := json.Marshal(newCachedLink(longURL, hot, redirectType, expiresAt, utm))
+	return string(data)
+}
+
+// decodeCachedLink also accepts the older plain-URL cache values, which no
+// URL can be confused with since none starts with "{".
+func decodeCachedLink(value string) cachedLink {
+	var link cachedLink
+	if strings.HasPrefix(value, "{") && json.Unmarshal([]byte(value), &link) == nil && link.LongURL != "" {
+		return link
+	}
+	return cachedLink{LongURL: value, Origin: destinationOrigin(value)}
+}
+
+// destinationOrigin returns scheme://host for http(s) URLs and "" otherwise.
+func destinationOrigin(longURL string) string {
+	u, err := url.Parse(longURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// sendEarlyHints writes a 103 ahead of the redirect. It is a no-op when
+// disabled, for HTTP/1.0 clients (which can't take informational
+// responses) and when the writer can't be unwrapped.
+func sendEarlyHints(c *gin.Context, origin string) {
+	if !earlyHintsEnabled || origin == "" || !c.Request.ProtoAtLeast(1, 1) {
+		return
+	}
+	// gin's writer only records the status until the body is written, so
+	// the 103 has to go to the underlying writer.
+	u, ok := c.Writer.(interface{ Unwrap() http.ResponseWriter })
+	if !ok {
+		return
+	}
+	w := u.Unwrap()
+	w.Header().Add("Link", "<"+origin+">; rel=preconnect")
+	w.WriteHeader(http.StatusEarlyHints)
+}
+
+// hotLinkTracker counts clicks per code for the current window and keeps
+// the previous window's top N for lookups on the redirect path.
+type hotLinkTracker struct {
+	mu     sync.Mutex
+	counts map[string]int
+	top    atomic.Pointer[map[string]bool]
+}
+
+var hotLinks = &hotLinkTracker{counts: map[string]int{}}
+
+func (h *hotLinkTracker) record(code string) {
+	h.mu.Lock()
+	h.counts[code]++
+	h.mu.Unlock()
+}
+
+func (h *hotLinkTracker) isHot(code string) bool {
+	top := h.top.Load()
+	return top != nil && (*top)[code]
+}
+
+func (h *hotLinkTracker) rotate(n int) {
+	h.mu.Lock()
+	counts := h.counts
+	h.counts = map[string]int{}
+	h.mu.Unlock()
+
+	codes := slices.SortedFunc(maps.Keys(counts), func(a, b string) int {
+		return cmp.Compare(counts[b], counts[a])
+	})
+	top := make(map[string]bool, n)
+	for _, code := range codes[:min(n, len(codes))] {
+		top[code] = true
+	}
+	h.top.Store(&top)
+}
+
+// recordHotLinkClick runs on the click publisher workers.
+func recordHotLinkClick(code string) {
+	if earlyHintsEnabled && earlyHintsTopN > 0 {
+		hotLinks.record(code)
+	}
+}
+
+func registerHotLinkTracker() {
+	if !earlyHintsEnabled || earlyHintsTopN <= 0 {
+		return
+	}
+	app.RegisterBackgroundJob("hot_link_tracker", earlyHintsWindow, func(context.Context) error {
+		hotLinks.rotate(earlyHintsTopN)
+		return nil
+	})
+}
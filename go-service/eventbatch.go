@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP event delivery settings. With EVENT_BATCH_SIZE=1 (the default) every
+// event is POSTed to /api/events individually, exactly as before.
+var (
+	eventBatchSize     = getEnvInt("EVENT_BATCH_SIZE", 1)
+	eventBatchInterval = getEnvDuration("EVENT_BATCH_INTERVAL", 1*time.Second)
+
+	// Gzip is opt-in because the receiving side has to understand it.
+	eventGzipEnabled  = getEnvBool("EVENT_GZIP", false)
+	eventGzipMinBytes = getEnvInt("EVENT_GZIP_MIN_BYTES", 1024)
+)
+
+// gzipRejectedUntil holds a unix timestamp until which compression is skipped
+// because the receiver answered 415 Unsupported Media Type.
+var gzipRejectedUntil atomic.Int64
+
+const gzipRejectBackoff = 10 * time.Minute
+
+var eventPayloadStats = expvar.NewMap("event_payloads")
+
+var httpEventQueue chan ClickEvent
+
+// httpEventFlush asks the batcher to send everything it holds now; it
+// closes the channel it is handed once done.
+var httpEventFlush = make(chan chan struct{})
+
+// startHTTPEventBatcher starts the goroutine that groups HTTP fallback events
+// into batches. It is a no-op when batching is disabled.
+func (s *Server) startHTTPEventBatcher() {
+	if eventBatchSize <= 1 {
+		return
+	}
+	httpEventQueue = make(chan ClickEvent, eventBatchSize*4)
+
+	go func() {
+		ticker := time.NewTicker(eventBatchInterval)
+		defer ticker.Stop()
+
+		batch := make([]ClickEvent, 0, eventBatchSize)
+		for {
+			select {
+			case event := <-httpEventQueue:
+				batch = append(batch, event)
+				if len(batch) < eventBatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			case done := <-httpEventFlush:
+				for len(httpEventQueue) > 0 {
+					if batch = append(batch, <-httpEventQueue); len(batch) == eventBatchSize {
+						s.sendEventBatchHTTP(batch)
+						batch = batch[:0]
+					}
+				}
+				if len(batch) > 0 {
+					s.sendEventBatchHTTP(batch)
+				}
+				batch = batch[:0]
+				close(done)
+				continue
+			}
+			s.sendEventBatchHTTP(batch)
+			batch = batch[:0]
+		}
+	}()
+}
+
+// flushHTTPEvents sends the events the batcher holds and waits until they
+// are delivered or ctx ends.
+func flushHTTPEvents(ctx context.Context) error {
+	if httpEventQueue == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case httpEventFlush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) sendEventBatchHTTP(batch []ClickEvent) {
+	jsonData, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("Error marshaling event batch: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clickPublishTimeout)
+	defer cancel()
+	status, err := s.postEventPayload(ctx, "/api/events/batch", jsonData)
+	if err != nil {
+		countClickEvents("http", "error", len(batch))
+		log.Printf("Error sending event batch to Python service: %v", err)
+		return
+	}
+	if status != http.StatusOK {
+		countClickEvents("http", "error", len(batch))
+		log.Printf("Python service returned status %d for batch of %d events", status, len(batch))
+		return
+	}
+	countClickEvents("http", "ok", len(batch))
+	eventPayloadStats.Add("batches_sent", 1)
+	log.Printf("Click event batch sent via HTTP: %d events", len(batch))
+}
+
+// postEventPayload POSTs a JSON payload to the Python service, gzip-compressing
+// it when enabled and large enough. A 415 answer disables compression for a
+// while and the payload is resent uncompressed.
+func (s *Server) postEventPayload(ctx context.Context, path string, jsonData []byte) (int, error) {
+	eventPayloadStats.Add("bytes_uncompressed", int64(len(jsonData)))
+	signature := signServiceRequest(jsonData)
+
+	if shouldGzipPayload(len(jsonData)) {
+		compressed, err := gzipBytes(jsonData)
+		if err == nil {
+			status, err := s.doEventPost(ctx, path, compressed, "gzip", signature)
+			if err != nil || status != http.StatusUnsupportedMediaType {
+				return status, err
+			}
+			log.Printf("Python service rejected gzip payload, sending uncompressed")
+			eventPayloadStats.Add("gzip_rejected", 1)
+			gzipRejectedUntil.Store(time.Now().Add(gzipRejectBackoff).Unix())
+		} else {
+			log.Printf("Error compressing event payload: %v", err)
+		}
+	}
+
+	return s.doEventPost(ctx, path, jsonData, "", signature)
+}
+
+func shouldGzipPayload(size int) bool {
+	return eventGzipEnabled &&
+		size >= eventGzipMinBytes &&
+		time.Now().Unix() >= gzipRejectedUntil.Load()
+}
+
+// doEventPost sends body as-is. The signature, when present, always covers the
+// uncompressed JSON so receivers verify after decoding Content-Encoding.
+func (s *Server) doEventPost(ctx context.Context, path string, body []byte, contentEncoding, signature string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.PythonServiceURL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if signature != "" {
+		req.Header.Set(SignatureHeader, signature)
+	}
+
+	resp, err := s.python.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection goes back to the idle pool.
+	io.Copy(io.Discard, resp.Body)
+
+	eventPayloadStats.Add("bytes_sent", int64(len(body)))
+	if contentEncoding == "gzip" {
+		eventPayloadStats.Add("gzip_payloads", 1)
+	}
+	return resp.StatusCode, nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
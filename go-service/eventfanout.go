@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// With EVENT_DESTINATIONS_FILE set, click and lifecycle events go to every
+// destination that YAML file lists whose filter they pass, instead of to
+// Redis alone:
+//
+//	destinations:
+//	  - name: analytics
+//	    type: redis        # the built-in stream or Pub/Sub, with its HTTP fallback
+//	  - name: datalake
+//	    type: publisher    # a publisher registered with app.RegisterPublisher
+//	    publisher: kafka
+//	  - name: partner
+//	    type: webhook
+//	    url: https://partner.example.com/clicks
+//	    secret: s3cret
+//	    filter:
+//	      events: [click]
+//	      tags: [partner]
+//
+// A filter's events, tags, domains and owners each match any of their
+// values, and an event has to match every one that is set; no filter
+// matches everything. A link's tags are the comma-separated values of its
+// "tags" metadata, its domain is the destination's host, which a parent
+// domain matches too, and its owner the API key ID. They are read as the
+// event is published and remembered for eventLinkCacheTTL.
+//
+// Each destination has its own queue of queue_size events (default 1000)
+// and workers (default 2), so a slow or failing one never holds up the
+// others or the click workers: when its queue is full its events are
+// dropped. A webhook gets up to max_attempts tries (default 3), backing off
+// from a second, signed as webhooks.go signs them when it has a secret.
+// Publisher destinations get clicks only, and a publisher one names is no
+// longer also called for every click. Shutdown waits for the queues to
+// empty. urlshortener_event_destination_events_total counts each
+// destination's delivered, filtered, failed and dropped events.
+var eventDestinationsFile = getEnv("EVENT_DESTINATIONS_FILE", "")
+
+const (
+	eventDestinationRedis     = "redis"
+	eventDestinationWebhook   = "webhook"
+	eventDestinationPublisher = "publisher"
+
+	eventLinkCacheTTL  = time.Minute
+	eventLinkCacheSize = 10000
+)
+
+// eventDestinationBackoff is the wait before a destination's second try.
+var eventDestinationBackoff = time.Second
+
+var eventDestinationEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "urlshortener_event_destination_events_total",
+	Help: "Events per fan-out destination by outcome (delivered, filtered, failed or dropped).",
+}, []string{"destination", "outcome"})
+
+// eventFilter picks the events a destination gets.
+type eventFilter struct {
+	Events  []string `yaml:"events"`
+	Tags    []string `yaml:"tags"`
+	Domains []string `yaml:"domains"`
+	Owners  []string `yaml:"owners"`
+}
+
+// needsLink reports whether f looks at the link an event is about.
+func (f eventFilter) needsLink() bool {
+	return len(f.Tags) > 0 || len(f.Domains) > 0 || len(f.Owners) > 0
+}
+
+// eventDestinationConfig is one entry of EVENT_DESTINATIONS_FILE.
+type eventDestinationConfig struct {
+	Name        string      `yaml:"name"`
+	Type        string      `yaml:"type"`
+	URL         string      `yaml:"url"`
+	Secret      string      `yaml:"secret"`
+	Publisher   string      `yaml:"publisher"`
+	QueueSize   int         `yaml:"queue_size"`
+	Workers     int         `yaml:"workers"`
+	MaxAttempts int         `yaml:"max_attempts"`
+	Filter      eventFilter `yaml:"filter"`
+}
+
+// parseEventDestinations reads the destinations from a YAML document,
+// rejecting unknown fields.
+func parseEventDestinations(data []byte) ([]eventDestinationConfig, error) {
+	var doc struct {
+		Destinations []eventDestinationConfig `yaml:"destinations"`
+	}
+	if err := yaml.UnmarshalWithOptions(data, &doc, yaml.Strict()); err != nil {
+		return nil, err
+	}
+	if len(doc.Destinations) == 0 {
+		return nil, errors.New("no destinations")
+	}
+	return doc.Destinations, nil
+}
+
+// linkAttributes are what filters see of the link an event is about.
+type linkAttributes struct {
+	owner, domain string
+	tags          []string
+}
+
+// matches reports whether an event of eventType about link passes f. link
+// is only called when f needs it.
+func (f eventFilter) matches(eventType string, link func() linkAttributes) bool {
+	if len(f.Events) > 0 && !slices.Contains(f.Events, eventType) {
+		return false
+	}
+	if !f.needsLink() {
+		return true
+	}
+	attrs := link()
+	if len(f.Owners) > 0 && !slices.Contains(f.Owners, attrs.owner) {
+		return false
+	}
+	if len(f.Domains) > 0 && !matchesAnyDomain(attrs.domain, f.Domains) {
+		return false
+	}
+	if len(f.Tags) > 0 && !slicesOverlap(f.Tags, attrs.tags) {
+		return false
+	}
+	return true
+}
+
+func slicesOverlap(a, b []string) bool {
+	for _, v := range a {
+		if slices.Contains(b, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyDomain reports whether host is one of domains or under one.
+func matchesAnyDomain(host string, domains []string) bool {
+	if host == "" {
+		return false
+	}
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventSink delivers one event, a ClickEvent or a LifecycleEvent.
+type eventSink func(ctx context.Context, eventType string, event any) error
+
+type queuedEvent struct {
+	eventType string
+	event     any
+}
+
+// eventDestination is a configured destination and its queue.
+type eventDestination struct {
+	name        string
+	filter      eventFilter
+	send        eventSink
+	clicksOnly  bool
+	maxAttempts int
+	workers     int
+	queue       chan queuedEvent
+	// pending counts events queued and not yet delivered or given up on.
+	pending sync.WaitGroup
+}
+
+// eventFanout is the EventPublisher with EVENT_DESTINATIONS_FILE set.
+type eventFanout struct {
+	s            *Server
+	destinations []*eventDestination
+
+	linksMu sync.Mutex
+	links   map[string]cachedLinkAttributes
+}
+
+type cachedLinkAttributes struct {
+	attrs   linkAttributes
+	expires time.Time
+}
+
+// newEventFanout checks configs and builds their destinations. Publisher
+// destinations take their publishers out of app's.
+func newEventFanout(s *Server, configs []eventDestinationConfig) (*eventFanout, error) {
+	f := &eventFanout{s: s, links: map[string]cachedLinkAttributes{}}
+	seen := map[string]bool{}
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("destination %d has no name", i+1)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("destination %q is listed twice", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		d, err := newEventDestination(s, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("destination %q: %w", cfg.Name, err)
+		}
+		f.destinations = append(f.destinations, d)
+	}
+	return f, nil
+}
+
+func newEventDestination(s *Server, cfg eventDestinationConfig) (*eventDestination, error) {
+	d := &eventDestination{name: cfg.Name, filter: cfg.Filter, maxAttempts: 1, workers: 2}
+	for _, e := range cfg.Filter.Events {
+		if !webhookEventTypes[e] {
+			return nil, errors.New("unknown event " + strconv.Quote(e) + " in filter")
+		}
+	}
+	for i, domain := range d.filter.Domains {
+		d.filter.Domains[i] = strings.ToLower(strings.TrimPrefix(domain, "."))
+	}
+	switch cfg.Type {
+	case eventDestinationRedis:
+		d.send = redisSink(redisPublisher{s})
+	case eventDestinationWebhook:
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("url must be an http or https URL")
+		}
+		d.send = webhookSink(newWebhookClient(), cfg.Name, cfg.URL, cfg.Secret)
+		d.maxAttempts = 3
+	case eventDestinationPublisher:
+		p, ok := app.takePublisher(cfg.Publisher)
+		if !ok {
+			return nil, errors.New("no publisher named " + strconv.Quote(cfg.Publisher) + " is registered")
+		}
+		d.send = publisherSink(p)
+		d.clicksOnly = true
+	default:
+		return nil, errors.New("type must be redis, webhook or publisher")
+	}
+	if cfg.MaxAttempts < 0 || cfg.QueueSize < 0 || cfg.Workers < 0 {
+		return nil, errors.New("max_attempts, queue_size and workers must not be negative")
+	}
+	if cfg.MaxAttempts > 0 {
+		d.maxAttempts = cfg.MaxAttempts
+	}
+	if cfg.Workers > 0 {
+		d.workers = cfg.Workers
+	}
+	queueSize := 1000
+	if cfg.QueueSize > 0 {
+		queueSize = cfg.QueueSize
+	}
+	d.queue = make(chan queuedEvent, queueSize)
+	return d, nil
+}
+
+// redisSink hands events to the built-in publisher, which counts and
+// retries its own failures.
+func redisSink(p redisPublisher) eventSink {
+	return func(ctx context.Context, eventType string, event any) error {
+		switch e := event.(type) {
+		case ClickEvent:
+			p.PublishClick(ctx, e)
+		case LifecycleEvent:
+			p.PublishLifecycle(ctx, e)
+		}
+		return nil
+	}
+}
+
+func publisherSink(p ClickPublisher) eventSink {
+	return func(ctx context.Context, eventType string, event any) error {
+		return p(ctx, event.(ClickEvent))
+	}
+}
+
+// webhookSink POSTs each event as JSON with X-Webhook-Event and, when
+// there is a secret, the webhook timestamp and signature headers.
+func webhookSink(client *http.Client, name, endpoint, secret string) eventSink {
+	return func(ctx context.Context, eventType string, event any) error {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "urlshortener-events")
+		req.Header.Set("X-Webhook-Event", eventType)
+		if secret != "" {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set("X-Webhook-Timestamp", ts)
+			req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(secret, ts, body))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s returned status %d", name, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// startEventFanout reads EVENT_DESTINATIONS_FILE, when set, and publishes
+// through its destinations from then on.
+func (s *Server) startEventFanout() {
+	if eventDestinationsFile == "" {
+		return
+	}
+	data, err := os.ReadFile(eventDestinationsFile)
+	if err != nil {
+		log.Fatalf("Error reading EVENT_DESTINATIONS_FILE: %v", err)
+	}
+	configs, err := parseEventDestinations(data)
+	if err != nil {
+		log.Fatalf("Invalid EVENT_DESTINATIONS_FILE: %v", err)
+	}
+	f, err := newEventFanout(s, configs)
+	if err != nil {
+		log.Fatalf("Invalid EVENT_DESTINATIONS_FILE: %v", err)
+	}
+	f.start()
+	s.events = f
+	log.Printf("Publishing events to %d destinations", len(f.destinations))
+}
+
+// start starts every destination's workers.
+func (f *eventFanout) start() {
+	for _, d := range f.destinations {
+		for i := 0; i < d.workers; i++ {
+			go func() {
+				for q := range d.queue {
+					d.deliver(q)
+					d.pending.Done()
+				}
+			}()
+		}
+	}
+}
+
+func (f *eventFanout) PublishClick(ctx context.Context, event ClickEvent) {
+	f.publish(ctx, eventClick, event.ShortCode, event)
+}
+
+func (f *eventFanout) PublishLifecycle(ctx context.Context, event LifecycleEvent) {
+	if event.Type == eventQuotaWarning {
+		// It is about an owner rather than a link.
+		f.publishAbout(event.Type, func() linkAttributes { return linkAttributes{owner: event.Owner} }, event)
+		return
+	}
+	f.publish(ctx, event.Type, event.ShortCode, event)
+}
+
+// publish queues event for the destinations it passes the filter of. The
+// link is looked up at most once, and only if a filter needs it.
+func (f *eventFanout) publish(ctx context.Context, eventType, shortCode string, event any) {
+	var attrs *linkAttributes
+	f.publishAbout(eventType, func() linkAttributes {
+		if attrs == nil {
+			a := f.linkAttributes(ctx, shortCode)
+			attrs = &a
+		}
+		return *attrs
+	}, event)
+}
+
+// publishAbout is publish with what filters see of the event's subject.
+func (f *eventFanout) publishAbout(eventType string, link func() linkAttributes, event any) {
+	for _, d := range f.destinations {
+		if d.clicksOnly && eventType != eventClick || !d.filter.matches(eventType, link) {
+			eventDestinationEvents.WithLabelValues(d.name, "filtered").Inc()
+			continue
+		}
+		d.pending.Add(1)
+		select {
+		case d.queue <- queuedEvent{eventType, event}:
+		default:
+			d.pending.Done()
+			eventDestinationEvents.WithLabelValues(d.name, "dropped").Inc()
+		}
+	}
+}
+
+// deliver sends q, retrying with backoff up to maxAttempts times.
+func (d *eventDestination) deliver(q queuedEvent) {
+	backoff := eventDestinationBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), clickPublishTimeout)
+		err := d.send(ctx, q.eventType, q.event)
+		cancel()
+		if err == nil {
+			eventDestinationEvents.WithLabelValues(d.name, "delivered").Inc()
+			return
+		}
+		if attempt >= d.maxAttempts {
+			eventDestinationEvents.WithLabelValues(d.name, "failed").Inc()
+			log.Printf("Event destination %s failed after %d attempts: %v", d.name, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// drain waits for every queued event to be delivered or given up on.
+func (f *eventFanout) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		for _, d := range f.destinations {
+			d.pending.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("event destinations still delivering: %w", ctx.Err())
+	}
+}
+
+// linkAttributes looks up what filters see of shortCode, remembering it
+// for eventLinkCacheTTL. A link that can't be read has none.
+func (f *eventFanout) linkAttributes(ctx context.Context, shortCode string) linkAttributes {
+	now := time.Now()
+	f.linksMu.Lock()
+	cached, ok := f.links[shortCode]
+	f.linksMu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.attrs
+	}
+
+	var attrs linkAttributes
+	var tags string
+	err := f.s.db.QueryRowContext(ctx, `SELECT COALESCE(u.owner, ''), COALESCE(u.destination_host, ''), COALESCE(m.value, '') FROM urls u
+		LEFT JOIN link_metadata m ON m.short_code = u.short_code AND m.key = 'tags' WHERE u.short_code = ?`, shortCode).Scan(&attrs.owner, &attrs.domain, &tags)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error looking up %s for event filters: %v", shortCode, err)
+		return attrs
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			attrs.tags = append(attrs.tags, tag)
+		}
+	}
+
+	f.linksMu.Lock()
+	if len(f.links) >= eventLinkCacheSize {
+		clear(f.links)
+	}
+	f.links[shortCode] = cachedLinkAttributes{attrs, now.Add(eventLinkCacheTTL)}
+	f.linksMu.Unlock()
+	return attrs
+}
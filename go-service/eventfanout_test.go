@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// eventEndpoint is a webhook destination's endpoint, recording the events
+// it is sent.
+type eventEndpoint struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []string
+}
+
+func newEventEndpoint(t *testing.T) *eventEndpoint {
+	t.Helper()
+	e := &eventEndpoint{}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.events = append(e.events, r.Header.Get("X-Webhook-Event")+" "+string(body))
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// received is what was sent, in sorted order, since workers deliver
+// concurrently.
+func (e *eventEndpoint) received() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Sorted(slices.Values(e.events))
+}
+
+// startTestFanout builds and starts a fanout of configs on testServer.
+func startTestFanout(t *testing.T, configs []eventDestinationConfig) *eventFanout {
+	t.Helper()
+	f, err := newEventFanout(testServer, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.start()
+	return f
+}
+
+func destinationCount(name, outcome string) float64 {
+	return testutil.ToFloat64(eventDestinationEvents.WithLabelValues(name, outcome))
+}
+
+func TestParseEventDestinations(t *testing.T) {
+	configs, err := parseEventDestinations([]byte(`
+destinations:
+  - name: analytics
+    type: redis
+  - name: partner
+    type: webhook
+    url: https://partner.example.com/clicks
+    max_attempts: 5
+    filter:
+      events: [click]
+      tags: [partner]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs[1].MaxAttempts != 5 || configs[1].Filter.Tags[0] != "partner" || configs[1].Filter.Events[0] != eventClick {
+		t.Errorf("configs = %+v", configs)
+	}
+	if _, err := parseEventDestinations([]byte("destinations:\n  - name: a\n    type: redis\n    filters: {}\n")); err == nil {
+		t.Error("an unknown field was accepted")
+	}
+	if _, err := parseEventDestinations([]byte("destinations: []\n")); err == nil {
+		t.Error("no destinations were accepted")
+	}
+
+	for _, configs := range [][]eventDestinationConfig{
+		{{Type: eventDestinationRedis}},
+		{{Name: "a", Type: eventDestinationRedis}, {Name: "a", Type: eventDestinationRedis}},
+		{{Name: "a", Type: "kafka"}},
+		{{Name: "a", Type: eventDestinationWebhook, URL: "ftp://example.com"}},
+		{{Name: "a", Type: eventDestinationPublisher, Publisher: "no-such-publisher"}},
+		{{Name: "a", Type: eventDestinationRedis, Filter: eventFilter{Events: []string{"url_renamed"}}}},
+		{{Name: "a", Type: eventDestinationRedis, QueueSize: -1}},
+	} {
+		if _, err := newEventFanout(testServer, configs); err == nil {
+			t.Errorf("%+v was accepted", configs)
+		}
+	}
+}
+
+func TestEventFanoutFilters(t *testing.T) {
+	ctx := context.Background()
+	ownerID, _ := newTestAPIKey(t, false)
+	code := "ef-" + newRandomID()[:10]
+	if _, err := testServer.store.Create(ctx, ShortenRequest{LongURL: "https://shop.partner.example.com/" + code}, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testServer.db.Exec("UPDATE urls SET owner = ?, destination_host = 'shop.partner.example.com' WHERE short_code = ?", ownerID, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testServer.db.Exec("INSERT INTO link_metadata (short_code, key, value) VALUES (?, 'tags', 'sale, partner')", code); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints := map[string]*eventEndpoint{}
+	filters := map[string]eventFilter{
+		"all":         {},
+		"partner":     {Events: []string{eventClick}, Tags: []string{"partner"}},
+		"other-tag":   {Tags: []string{"internal"}},
+		"domain":      {Domains: []string{"Example.com"}},
+		"owner":       {Owners: []string{ownerID}, Events: []string{eventURLDeleted}},
+		"other-owner": {Owners: []string{"someone-else"}},
+	}
+	var configs []eventDestinationConfig
+	prefix := "ef-" + newRandomID()[:6] + "-"
+	for name, filter := range filters {
+		endpoints[name] = newEventEndpoint(t)
+		configs = append(configs, eventDestinationConfig{Name: prefix + name, Type: eventDestinationWebhook, URL: endpoints[name].URL, Filter: filter})
+	}
+	f := startTestFanout(t, configs)
+
+	f.PublishClick(ctx, ClickEvent{ShortCode: code, ClickedAt: time.Now().Format(time.RFC3339)})
+	f.PublishLifecycle(ctx, LifecycleEvent{Type: eventURLDeleted, ShortCode: code})
+	if err := f.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"all":         {eventClick, eventURLDeleted},
+		"partner":     {eventClick},
+		"other-tag":   nil,
+		"domain":      {eventClick, eventURLDeleted},
+		"owner":       {eventURLDeleted},
+		"other-owner": nil,
+	}
+	for name, types := range want {
+		got := endpoints[name].received()
+		if len(got) != len(types) {
+			t.Errorf("%s got %q, want %v", name, got, types)
+			continue
+		}
+		for i, eventType := range types {
+			if !strings.HasPrefix(got[i], eventType+" ") || !strings.Contains(got[i], code) {
+				t.Errorf("%s event %d = %q, want a %s for %s", name, i, got[i], eventType, code)
+			}
+		}
+		if delivered, filtered := destinationCount(prefix+name, "delivered"), destinationCount(prefix+name, "filtered"); delivered != float64(len(types)) || filtered != float64(2-len(types)) {
+			t.Errorf("%s counted %v delivered, %v filtered", name, delivered, filtered)
+		}
+	}
+}
+
+func TestEventFanoutSlowDestination(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fast := newEventEndpoint(t)
+	name := "slow-" + newRandomID()[:8]
+	f := startTestFanout(t, []eventDestinationConfig{
+		{Name: name, Type: eventDestinationWebhook, URL: slow.URL, QueueSize: 1, Workers: 1},
+		{Name: name + "-fast", Type: eventDestinationWebhook, URL: fast.URL},
+	})
+
+	ctx := context.Background()
+	for range 5 {
+		f.PublishClick(ctx, ClickEvent{ShortCode: "slow"})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fast.received()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(fast.received()); got != 5 {
+		t.Errorf("fast destination got %d events while the slow one was stuck, want 5", got)
+	}
+	// One event is being sent and one waits; the rest are dropped.
+	if dropped := destinationCount(name, "dropped"); dropped < 3 {
+		t.Errorf("slow destination dropped %v events, want at least 3", dropped)
+	}
+	close(release)
+	if err := f.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventFanoutRetries(t *testing.T) {
+	saved := eventDestinationBackoff
+	eventDestinationBackoff = time.Millisecond
+	t.Cleanup(func() { eventDestinationBackoff = saved })
+	var mu sync.Mutex
+	attempts := 0
+	var signature string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		signature = r.Header.Get("X-Webhook-Signature")
+		if attempts%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer endpoint.Close()
+	name := "retry-" + newRandomID()[:8]
+	f := startTestFanout(t, []eventDestinationConfig{
+		{Name: name, Type: eventDestinationWebhook, URL: endpoint.URL, Secret: "s3cret", MaxAttempts: 2, Filter: eventFilter{Events: []string{eventClick}}},
+		{Name: name + "-once", Type: eventDestinationWebhook, URL: endpoint.URL, MaxAttempts: 1, Filter: eventFilter{Events: []string{eventURLCreated}}},
+	})
+	ctx := context.Background()
+	f.PublishClick(ctx, ClickEvent{ShortCode: "retry"})
+	if err := f.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 || destinationCount(name, "delivered") != 1 || !strings.HasPrefix(signature, "sha256=") {
+		t.Errorf("%d attempts, %v delivered, signature %q", attempts, destinationCount(name, "delivered"), signature)
+	}
+	f.PublishLifecycle(ctx, LifecycleEvent{Type: eventURLCreated, ShortCode: "retry"})
+	if err := f.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if destinationCount(name+"-once", "failed") != 1 {
+		t.Errorf("a destination with one attempt counted %v failures, want 1", destinationCount(name+"-once", "failed"))
+	}
+}
+
+func TestEventFanoutPublisher(t *testing.T) {
+	name := "fanout-" + newRandomID()[:8]
+	var mu sync.Mutex
+	var got []ClickEvent
+	app.RegisterPublisher(name, func(ctx context.Context, event ClickEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, event)
+		return nil
+	})
+	f := startTestFanout(t, []eventDestinationConfig{{Name: name, Type: eventDestinationPublisher, Publisher: name}})
+
+	ctx := context.Background()
+	// The publisher is only called through the destination now.
+	app.publish(ctx, ClickEvent{ShortCode: "direct"})
+	f.PublishClick(ctx, ClickEvent{ShortCode: "routed"})
+	f.PublishLifecycle(ctx, LifecycleEvent{Type: eventURLCreated, ShortCode: "routed"})
+	if err := f.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if b, _ := json.Marshal(got); len(got) != 1 || got[0].ShortCode != "routed" {
+		t.Errorf("publisher got %s, want the routed click only", b)
+	}
+	if destinationCount(name, "filtered") != 1 {
+		t.Errorf("lifecycle event counted %v filtered, want 1", destinationCount(name, "filtered"))
+	}
+}
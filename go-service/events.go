@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// clickJob is the minimal data captured on the request goroutine; everything
+// else (event build, encoding, logging) happens on a publisher worker.
+type clickJob struct {
+	shortCode string
+	clickedAt time.Time
+	cacheHit  bool
+	degraded  bool
+	// visitor is the raw attribution key, "" when not attributing.
+	visitor   string
+	requestID string
+	who       clickVisitor
+}
+
+// clickQueueSize is how many clicks may wait for a publisher worker.
+const clickQueueSize = 4096
+
+var clickEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "urlshortener_click_events_dropped_total",
+	Help: "Clicks dropped because the publisher queue was full.",
+})
+
+// clickPublishTimeout bounds the work a publisher worker does for one click.
+var clickPublishTimeout = getEnvDuration("CLICK_PUBLISH_TIMEOUT", 5*time.Second)
+
+var eventBufPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// startClickPublishers starts the workers that drain s.clickQueue. Their
+// shutdown hook runs before Redis and the database are closed.
+func (s *Server) startClickPublishers(n int) {
+	app.OnShutdown("click_events", 10*time.Second, s.drainClickEvents)
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range s.clickQueue {
+				s.handleClickJob(job)
+			}
+		}()
+	}
+}
+
+// enqueueClick hands a click on c off to the publisher workers. If the
+// queue is full the click is dropped and counted rather than slowing the
+// redirect down or piling up goroutines behind a stalled sink.
+func (s *Server) enqueueClick(c *gin.Context, shortCode string, cacheHit, degraded bool) {
+	job := clickJob{
+		shortCode: shortCode,
+		clickedAt: time.Now(),
+		cacheHit:  cacheHit,
+		degraded:  degraded,
+		visitor:   s.attributionVisitor(c),
+		requestID: requestID(c),
+		who:       newClickVisitor(c),
+	}
+	s.enqueueClickJob(job)
+}
+
+// enqueueClickJob is enqueueClick for a click captured outside a gin
+// request.
+func (s *Server) enqueueClickJob(job clickJob) {
+	s.clickJobs.Add(1)
+	select {
+	case s.clickQueue <- job:
+	default:
+		s.clickJobs.Done()
+		clickEventsDropped.Inc()
+	}
+}
+
+// handleClickJob records and publishes one click under its own deadline,
+// detached from the redirect, which has usually been answered by now.
+func (s *Server) handleClickJob(job clickJob) {
+	defer s.clickJobs.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), clickPublishTimeout)
+	defer cancel()
+	if job.cacheHit {
+		slog.Debug("cache hit", "short_code", job.shortCode)
+	}
+	s.recordRealtimeClick(ctx, job.shortCode, job.clickedAt)
+	recordHotLinkClick(job.shortCode)
+	s.countClick(ctx, job.shortCode, job.clickedAt)
+	job.who.locate()
+	clickRollups.add(job.shortCode, job.who.country, job.clickedAt, 1)
+	clickID := newRandomID()
+	if job.visitor != "" {
+		s.rememberClick(ctx, job.shortCode, job.visitor, clickID, job.clickedAt)
+	}
+	s.publishClickEvent(ctx, job, clickID)
+}
+
+// drainClickEvents waits for every accepted click to be published, and
+// for the event destinations to deliver them, then sends the HTTP fallback events still waiting for a batch and spills
+// stream events still waiting for Redis.
+func (s *Server) drainClickEvents(ctx context.Context) error {
+	published := make(chan struct{})
+	go func() {
+		s.clickJobs.Wait()
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-ctx.Done():
+		return fmt.Errorf("click events still publishing: %w", ctx.Err())
+	}
+	if f, ok := s.events.(*eventFanout); ok {
+		if err := f.drain(ctx); err != nil {
+			return err
+		}
+	}
+	if err := s.spillClickOutbox(ctx); err != nil {
+		return err
+	}
+	return flushHTTPEvents(ctx)
+}
+
+// encodeEvent JSON-encodes v into a pooled buffer. The caller must hand the
+// buffer back with releaseEventBuf once the bytes are no longer referenced.
+func encodeEvent(v any) (*bytes.Buffer, error) {
+	buf := eventBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		releaseEventBuf(buf)
+		return nil, err
+	}
+	// Encoder appends a newline that json.Marshal would not; drop it so the
+	// payload stays byte-for-byte identical.
+	buf.Truncate(buf.Len() - 1)
+	return buf, nil
+}
+
+func releaseEventBuf(buf *bytes.Buffer) {
+	// Don't keep unusually large buffers alive in the pool.
+	if buf.Cap() > 64<<10 {
+		return
+	}
+	eventBufPool.Put(buf)
+}
+
+// EventPublisher carries click and lifecycle events to their consumers.
+// Delivery is best effort: failures are logged and counted, not returned,
+// since the redirect or write that caused the event has already happened.
+type EventPublisher interface {
+	PublishClick(ctx context.Context, event ClickEvent)
+	PublishLifecycle(ctx context.Context, event LifecycleEvent)
+}
+
+// publishClickEvent hands the click to the extension publishers and to
+// s.events.
+func (s *Server) publishClickEvent(ctx context.Context, job clickJob, clickID string) {
+	event := ClickEvent{
+		ClickID:   clickID,
+		ShortCode: job.shortCode,
+		ClickedAt: job.clickedAt.Format(time.RFC3339),
+		Degraded:  job.degraded,
+		RequestID: job.requestID,
+	}
+	job.who.fill(&event)
+	defer app.publish(ctx, event)
+	s.events.PublishClick(ctx, event)
+}
+
+// redisPublisher is the EventPublisher of a Server: clicks go to the Redis
+// stream or Pub/Sub, falling back to the Python service over HTTP, and
+// lifecycle events to Pub/Sub only.
+type redisPublisher struct {
+	s *Server
+}
+
+func (p redisPublisher) PublishClick(ctx context.Context, event ClickEvent) {
+	s := p.s
+	if s.streamMode() {
+		buf, err := encodeEvent(event)
+		if err != nil {
+			log.Printf("Error marshaling event: %v", err)
+			return
+		}
+		s.outbox.publish(ctx, buf.String())
+		releaseEventBuf(buf)
+		return
+	}
+
+	// Try Redis Pub/Sub first. A resolver-only edge has no consumer on
+	// its Redis, so it always forwards over HTTP.
+	if s.rdb != nil && !resolverOnly {
+		buf, err := encodeEvent(event)
+		if err != nil {
+			log.Printf("Error marshaling event: %v", err)
+			return
+		}
+
+		err = s.rdb.Publish(ctx, "click_events", buf.Bytes()).Err()
+		releaseEventBuf(buf)
+		if err != nil {
+			countClickEvents("redis", "error", 1)
+			if !redisUnavailable(err) {
+				log.Printf("Redis publish error: %v, falling back to HTTP", err)
+			}
+			// Fallback to HTTP if Redis fails
+			s.sendClickEventHTTP(ctx, event)
+		} else {
+			countClickEvents("redis", "ok", 1)
+			slog.Debug("click event published to Redis", "short_code", event.ShortCode)
+		}
+	} else {
+		// No Redis available, use HTTP fallback
+		s.sendClickEventHTTP(ctx, event)
+	}
+}
+
+// PublishLifecycle publishes to Redis when connected. There is no HTTP
+// fallback.
+func (p redisPublisher) PublishLifecycle(ctx context.Context, event LifecycleEvent) {
+	if p.s.rdb == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling lifecycle event: %v", err)
+		return
+	}
+	if err := p.s.rdb.Publish(ctx, lifecycleChannel, data).Err(); err != nil && !redisUnavailable(err) {
+		log.Printf("Redis publish error for lifecycle event %s: %v", event.Type, err)
+	}
+}
+
+func (s *Server) sendClickEventHTTP(ctx context.Context, event ClickEvent) {
+	if httpEventQueue != nil {
+		select {
+		case httpEventQueue <- event:
+			countClickEvents("http", "queued", 1)
+			return
+		default:
+			// Batch queue is full; deliver this one on its own.
+		}
+	}
+
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling event: %v", err)
+		return
+	}
+
+	status, err := s.postEventPayload(ctx, "/api/events", jsonData)
+	if err != nil {
+		countClickEvents("http", "error", 1)
+		log.Printf("Error sending event to Python service: %v", err)
+		return
+	}
+
+	if status != http.StatusOK {
+		countClickEvents("http", "error", 1)
+		log.Printf("Python service returned status: %d", status)
+	} else {
+		countClickEvents("http", "ok", 1)
+		log.Printf("Click event sent via HTTP for: %s", event.ShortCode)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/events/schema documents every event the service emits as a JSON
+// Schema per type and version, with an example payload. The properties
+// come from the Go structs by reflection and the examples are marshaled
+// from them, so neither can drift from what is sent; only the field
+// descriptions are kept here, and startup fails if a field has none or a
+// description names a field that is gone. A field consumers should stop
+// reading is listed in deprecated, and stays in the schema until the
+// version changes. New optional fields don't change the version, so
+// consumers must ignore properties they don't know.
+type eventSchemaSpec struct {
+	typ      string
+	version  int
+	title    string
+	channels []string
+	example  any
+	fields   map[string]string
+	// formats gives string fields a JSON Schema format.
+	formats    map[string]string
+	deprecated []string
+}
+
+var eventSchemaSpecs = []eventSchemaSpec{
+	{
+		typ:      "click",
+		version:  1,
+		title:    "A redirect served for a short code",
+		channels: []string{"redis pub/sub click_events", "redis stream click_events (field event)", "POST /api/events", "POST /api/events/batch"},
+		example: ClickEvent{
+			ClickID:        "3f8a2c0d9b1e4f7a8c6d5e4f3a2b1c0d",
+			ShortCode:      "aB3dE9",
+			ClickedAt:      "2026-01-02T15:04:05Z",
+			RequestID:      "9c1b7e2f4a6d8c0e2b4a6c8e0f2d4b6a",
+			Referrer:       "https://news.example.com/article",
+			UserAgent:      "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0",
+			ClientIP:       "203.0.113.0",
+			AcceptLanguage: "en-US,en;q=0.9",
+			Country:        "DE",
+		},
+		fields: map[string]string{
+			"click_id":        "Random id of the click; conversions refer to it.",
+			"short_code":      "The code that was requested.",
+			"clicked_at":      "When the redirect was served, in UTC.",
+			"is_test":         "Set on synthetic self-test events, which consumers must drop.",
+			"degraded":        "Set when the redirect ran out of latency budget and skipped optional work.",
+			"request_id":      "The redirect's X-Request-ID, as in the access log.",
+			"referrer":        "The Referer header, with sensitive query values masked.",
+			"user_agent":      "The User-Agent header; omitted for visitors who opted out of tracking.",
+			"client_ip":       "The visitor's IP, raw, truncated to its /24 or /48, or hashed, as PRIVACY_MODE says; omitted for visitors who opted out of tracking.",
+			"accept_language": "The Accept-Language header.",
+			"country":         "The ISO 3166 country code of the visitor's IP, when GEOIP_DB covers it.",
+			"city":            "The city of the visitor's IP, when GEOIP_DB has one; only with PRIVACY_MODE=raw.",
+		},
+		formats: map[string]string{"clicked_at": "date-time"},
+	},
+	lifecycleEventSchema(eventURLCreated, "A link was created"),
+	lifecycleEventSchema(eventURLActivated, "A scheduled link went live, on its first redirect after active_from"),
+	lifecycleEventSchema(eventURLDeleted, "A link was deleted"),
+	lifecycleEventSchema(eventURLExpiringSoon, "A link expires within EXPIRY_WARNING_BEFORE; sent once per expiry"),
+	lifecycleEventSchema(eventQuotaWarning, "An owner's use of a quota passed a QUOTA_WARNING_THRESHOLDS percentage; sent once per threshold and period"),
+	lifecycleEventSchema(eventConversion, "The conversion pixel recorded a conversion; sent once per visitor, code and day"),
+}
+
+// lifecycleEventSchema describes one type of LifecycleEvent.
+func lifecycleEventSchema(typ, title string) eventSchemaSpec {
+	example := LifecycleEvent{
+		EventID:    "5e2d8a1c3b4f6e7d9a0b1c2d3e4f5a6b",
+		Type:       typ,
+		ShortCode:  "aB3dE9",
+		OccurredAt: "2026-01-02T15:04:05Z",
+	}
+	if typ == eventURLExpiringSoon {
+		example.ExpiresAt = "2026-01-05T15:00:00Z"
+	}
+	if typ == eventQuotaWarning {
+		example.ShortCode, example.Owner = "", "k1a2b3c4"
+		example.Quota = &QuotaWarning{Policy: policyLinkQuota, Threshold: 80, Limit: 1000, Remaining: 200, Period: "2026-01-02"}
+	}
+	if typ == eventConversion {
+		example.Conversion = &Conversion{Attributed: true, ClickID: "3f8a2c0d9b1e4f7a8c6d5e4f3a2b1c0d", ClickLatencyMS: 5400000}
+	}
+	return eventSchemaSpec{
+		typ:      typ,
+		version:  1,
+		title:    title,
+		channels: []string{"redis pub/sub " + lifecycleChannel},
+		example:  example,
+		fields: map[string]string{
+			"event_id":    "Random id of the event, for deduplication.",
+			"type":        "The event type.",
+			"short_code":  "The link's code; empty on quota_warning.",
+			"occurred_at": "When it happened, in UTC.",
+			"expires_at":  "When the link expires, in UTC; set on url_expiring_soon only.",
+			"owner":       "The owner nearing its quota; set on quota_warning only.",
+			"quota":       "The quota (rate_limit or link_quota), the threshold passed, the limit, what is left and the period (minute or UTC day); set on quota_warning only.",
+			"conversion":  "Whether the conversion was attributed to a click within CONVERSION_ATTRIBUTION_WINDOW and, if so, the click's click_id and the milliseconds since it; set on conversion only.",
+		},
+		formats: map[string]string{"occurred_at": "date-time", "expires_at": "date-time"},
+	}
+}
+
+// eventSchemas is what GET /api/events/schema returns, built once.
+var eventSchemas = buildEventSchemas()
+
+func buildEventSchemas() []gin.H {
+	docs := make([]gin.H, 0, len(eventSchemaSpecs))
+	for _, spec := range eventSchemaSpecs {
+		schema, err := spec.schema()
+		if err != nil {
+			log.Fatalf("Event schema %s v%d: %v", spec.typ, spec.version, err)
+		}
+		example, err := json.Marshal(spec.example)
+		if err != nil {
+			log.Fatalf("Event schema %s v%d example: %v", spec.typ, spec.version, err)
+		}
+		docs = append(docs, gin.H{
+			"type":       spec.typ,
+			"version":    spec.version,
+			"channels":   spec.channels,
+			"deprecated": append([]string{}, spec.deprecated...),
+			"schema":     schema,
+			"example":    json.RawMessage(example),
+		})
+	}
+	return docs
+}
+
+// schema reflects spec.example's struct into a JSON Schema object. Fields
+// without omitempty are required.
+func (spec eventSchemaSpec) schema() (gin.H, error) {
+	t := reflect.TypeOf(spec.example)
+	properties := gin.H{}
+	required := []string{}
+	seen := map[string]bool{}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" || name == "" {
+			continue
+		}
+		description, ok := spec.fields[name]
+		if !ok {
+			return nil, fmt.Errorf("field %s has no description", name)
+		}
+		seen[name] = true
+		property := gin.H{"type": jsonSchemaType(field.Type), "description": description}
+		if format := spec.formats[name]; format != "" {
+			property["format"] = format
+		}
+		if name == "type" {
+			property["const"] = spec.typ
+		}
+		if slices.Contains(spec.deprecated, name) {
+			property["deprecated"] = true
+		}
+		properties[name] = property
+		if !slices.Contains(strings.Split(opts, ","), "omitempty") {
+			required = append(required, name)
+		}
+	}
+	for name := range spec.fields {
+		if !seen[name] {
+			return nil, fmt.Errorf("description for unknown field %s", name)
+		}
+	}
+	return gin.H{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"$id":                  "urn:urlshortener:event:" + spec.typ + ":v" + strconv.Itoa(spec.version),
+		"title":                spec.title,
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": true,
+	}, nil
+}
+
+func jsonSchemaType(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return "string"
+}
+
+// getEventSchemas serves GET /api/events/schema.
+func getEventSchemas(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"events": eventSchemas})
+}
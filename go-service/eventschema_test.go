@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkEventSchema validates payload against a schema built by
+// eventSchemaSpec.schema: required fields, property types, the type
+// const and date-time formats.
+func checkEventSchema(schema gin.H, payload []byte) error {
+	var event map[string]any
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	for _, name := range schema["required"].([]string) {
+		if _, ok := event[name]; !ok {
+			return fmt.Errorf("required field %s is missing", name)
+		}
+	}
+	for name, value := range event {
+		property, ok := schema["properties"].(gin.H)[name].(gin.H)
+		if !ok {
+			continue
+		}
+		if got, want := jsonValueType(value), property["type"]; got != want && !(got == "integer" && want == "number") {
+			return fmt.Errorf("%s is %s, the schema says %s", name, got, want)
+		}
+		if want, ok := property["const"]; ok && value != want {
+			return fmt.Errorf("%s is %v, the schema says %v", name, value, want)
+		}
+		if property["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, value.(string)); err != nil {
+				return fmt.Errorf("%s is not a date-time: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func jsonValueType(v any) string {
+	switch v := v.(type) {
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "null"
+}
+
+// emittedEventSamples publishes one event of every type the way the
+// service does, through a fake server, and returns what was published.
+func emittedEventSamples(t *testing.T) []any {
+	t.Helper()
+	s, _, events := newFakeServer(t)
+	r := s.newRouter()
+	ctx := context.Background()
+	now := time.Now()
+	admin := "Authorization: Bearer " + testAdminToken
+
+	code := "schema-" + newRandomID()[:8]
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/schema","custom_alias":"`+code+`"}`, admin); w.Code != http.StatusOK {
+		t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/"+code, "", "Referer: https://news.example/a", "Accept-Language: en"); w.Code != defaultRedirectStatus {
+		t.Fatalf("redirect = %d: %s", w.Code, w.Body)
+	}
+	select {
+	case job := <-s.clickQueue:
+		s.publishClickEvent(ctx, job, newRandomID())
+	default:
+		t.Fatal("the redirect queued no click")
+	}
+	s.markActivated(ctx, code)
+	if w := serveTest(r, http.MethodDelete, "/api/urls/"+code, "", admin); w.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d: %s", w.Code, w.Body)
+	}
+
+	createExpiringLink(t, "", now.Add(time.Hour))
+	if _, err := s.warnExpiringLinks(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	s.warnQuotas(ctx, "schema-"+newRandomID()[:8], []quotaUsage{{policy: policyLinkQuota, limit: 10, remaining: 1, period: linkQuotaPeriod(now)}}, now)
+	converted := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/schema-conversion", ReuseExisting: new(bool)}, "")
+	s.recordConversion(ctx, converted.ShortCode, newRandomID(), "", now.UTC().Format(time.DateOnly), now)
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	var samples []any
+	for _, e := range events.clicks {
+		samples = append(samples, e)
+	}
+	for _, e := range events.lifecycle {
+		samples = append(samples, e)
+	}
+	return samples
+}
+
+func TestEmittedEventsMatchSchemas(t *testing.T) {
+	schemas := map[string]gin.H{}
+	for _, spec := range eventSchemaSpecs {
+		schema, err := spec.schema()
+		if err != nil {
+			t.Fatalf("%s: %v", spec.typ, err)
+		}
+		example, _ := json.Marshal(spec.example)
+		if err := checkEventSchema(schema, example); err != nil {
+			t.Errorf("%s example: %v", spec.typ, err)
+		}
+		schemas[spec.typ] = schema
+	}
+
+	seen := map[string]bool{}
+	for _, sample := range emittedEventSamples(t) {
+		typ := eventClick
+		if e, ok := sample.(LifecycleEvent); ok {
+			typ = e.Type
+		}
+		seen[typ] = true
+		schema, ok := schemas[typ]
+		if !ok {
+			t.Errorf("%s is emitted but has no schema", typ)
+			continue
+		}
+		payload, err := json.Marshal(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEventSchema(schema, payload); err != nil {
+			t.Errorf("%s: %v in %s", typ, err, payload)
+		}
+	}
+	// Every type a webhook may subscribe to is one the service emits.
+	for typ := range webhookEventTypes {
+		if !seen[typ] {
+			t.Errorf("no %s event was emitted to check", typ)
+		}
+		if _, ok := schemas[typ]; !ok {
+			t.Errorf("%s has no schema", typ)
+		}
+	}
+	for typ := range schemas {
+		if !webhookEventTypes[typ] {
+			t.Errorf("schema for %s, which is never emitted", typ)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"html/template"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Links with expires_at answer 410 Gone once it has passed. They are
+// deleted, with their clicks and conversions, after a further
+// EXPIRED_LINK_RETENTION, and from then on are plain 404s.
+//
+// EXPIRY_WARNING_BEFORE (0 turns it off) ahead of the expiry, the reaper
+// sends a url_expiring_soon event, once: expiry_warned_at records it, and
+// a renewal clears it. For EXPIRED_LINK_GRACE_PERIOD after the expiry, an
+// expired link shows browsers a page saying so, and its owner can still
+// renew it with POST /api/urls/:code/renew; it isn't reaped before then.
+var (
+	expiredLinkRetention = getEnvDuration("EXPIRED_LINK_RETENTION", 7*24*time.Hour)
+	expiryWarningBefore  = getEnvDuration("EXPIRY_WARNING_BEFORE", 72*time.Hour)
+	expiredLinkGrace     = getEnvDuration("EXPIRED_LINK_GRACE_PERIOD", 0)
+)
+
+const expiredLinkReapBatch = 500
+
+//go:embed templates/expired.html
+var expiredFS embed.FS
+
+var expiredTemplate = template.Must(template.ParseFS(expiredFS, "templates/expired.html"))
+
+// resolveExpiry turns ttl_seconds into expires_at and checks the result.
+func resolveExpiry(req *ShortenRequest, now time.Time) error {
+	if req.TTLSeconds < 0 {
+		return errors.New("ttl_seconds must be positive")
+	}
+	if req.TTLSeconds > 0 {
+		if req.ExpiresAt != nil {
+			return errors.New("set either expires_at or ttl_seconds, not both")
+		}
+		req.ExpiresAt = &linkTime{Time: now.Add(time.Duration(req.TTLSeconds) * time.Second)}
+	}
+	if req.ExpiresAt == nil {
+		return nil
+	}
+	if !req.ExpiresAt.After(now) {
+		return errors.New("expires_at must be in the future")
+	}
+	if req.ActiveFrom != nil && !req.ExpiresAt.After(req.ActiveFrom.Time) {
+		return errors.New("expires_at must be after active_from")
+	}
+	return nil
+}
+
+// linkExpired reports whether a link with the given expires_at has expired
+// at now. Links without expires_at never expire.
+func linkExpired(expiresAt sql.NullString, now time.Time) bool {
+	if !expiresAt.Valid {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, expiresAt.String)
+	if err != nil {
+		return false
+	}
+	return !now.Before(t)
+}
+
+// linkCacheTTL is how long a link may be served from Redis: an hour, or
+// less when it expires sooner, so the cache never outlives the link.
+func linkCacheTTL(expiresAt sql.NullString, now time.Time) time.Duration {
+	ttl := time.Hour
+	if t, err := time.Parse(time.RFC3339, expiresAt.String); expiresAt.Valid && err == nil {
+		ttl = min(ttl, t.Sub(now))
+	}
+	return ttl
+}
+
+// registerExpiredLinkReaper deletes links whose retention after expiry is
+// over, or recycles dead links' codes when CODE_RECYCLING is on; see
+// recycling.go. Links ever under legal_block are kept. Expired code
+// reservations and link aliases are released too. A resolver-only edge
+// leaves this to its upstream, whose deletes reach it through the diff feed.
+func (s *Server) registerExpiredLinkReaper() {
+	if resolverOnly {
+		return
+	}
+	app.RegisterBackgroundJob("expired_link_reaper", time.Hour, func(ctx context.Context) error {
+		if inMaintenance() {
+			return nil
+		}
+		if err := s.reapCodeReservations(ctx); err != nil {
+			return err
+		}
+		if err := s.reapLinkAliases(ctx); err != nil {
+			return err
+		}
+		if n, err := s.warnExpiringLinks(ctx, time.Now()); err != nil {
+			return err
+		} else if n > 0 {
+			log.Printf("Sent expiry warnings for %d links", n)
+		}
+		if codeRecycling {
+			n, err := s.recycleDeadLinks(ctx, time.Now())
+			if n > 0 {
+				log.Printf("Recycled the codes of %d dead links", n)
+			}
+			return err
+		}
+		cutoff := time.Now().UTC().Add(-max(expiredLinkRetention, expiredLinkGrace)).Format(time.RFC3339)
+		for {
+			n, err := s.reapExpiredLinks(ctx, cutoff)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				log.Printf("Deleted %d expired links", n)
+			}
+			if n < expiredLinkReapBatch {
+				return nil
+			}
+		}
+	})
+}
+
+// reapExpiredLinks deletes up to one batch of links that expired before
+// cutoff, together with the rows that refer to them.
+func (s *Server) reapExpiredLinks(ctx context.Context, cutoff string) (int, error) {
+	codes, err := s.queryStrings(ctx, "SELECT short_code FROM urls WHERE expires_at < ? AND legal_blocked = 0 LIMIT ?", cutoff, expiredLinkReapBatch)
+	if err != nil || len(codes) == 0 {
+		return 0, err
+	}
+	_, err = deleteLinks(ctx, s.db, codes)
+	return len(codes), err
+}
+
+// warnExpiringLinks sends url_expiring_soon for the links expiring within
+// EXPIRY_WARNING_BEFORE of now that haven't had it, returning how many it
+// sent. Each link is marked before its event goes out, so instances
+// running the reaper together don't both send it.
+func (s *Server) warnExpiringLinks(ctx context.Context, now time.Time) (int, error) {
+	if expiryWarningBefore <= 0 {
+		return 0, nil
+	}
+	sent := 0
+	for {
+		rows, err := s.db.QueryContext(ctx, `SELECT short_code, expires_at FROM urls WHERE expiry_warned_at IS NULL AND expires_at > ? AND expires_at <= ?
+			AND status = 'active' AND is_test = 0 LIMIT ?`,
+			now.UTC().Format(time.RFC3339), now.UTC().Add(expiryWarningBefore).Format(time.RFC3339), expiredLinkReapBatch)
+		if err != nil {
+			return sent, err
+		}
+		var expiring []LifecycleEvent
+		for rows.Next() {
+			event := LifecycleEvent{Type: eventURLExpiringSoon}
+			if err := rows.Scan(&event.ShortCode, &event.ExpiresAt); err != nil {
+				rows.Close()
+				return sent, err
+			}
+			expiring = append(expiring, event)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return sent, err
+		}
+		for _, event := range expiring {
+			res, err := s.execWithRetry(ctx, "UPDATE urls SET expiry_warned_at = ? WHERE short_code = ? AND expiry_warned_at IS NULL AND expires_at = ?",
+				now.UTC().Format(time.RFC3339), event.ShortCode, event.ExpiresAt)
+			if err != nil {
+				return sent, err
+			}
+			if n, _ := res.RowsAffected(); n == 1 {
+				s.publishLifecycle(context.WithoutCancel(ctx), event)
+				sent++
+			}
+		}
+		if len(expiring) < expiredLinkReapBatch {
+			return sent, nil
+		}
+	}
+}
+
+// renewableUntil is when a link that expired at expiresAt can no longer
+// be renewed.
+func renewableUntil(expiresAt time.Time) time.Time {
+	return expiresAt.Add(expiredLinkGrace)
+}
+
+// writeLinkExpired answers a hit on a link that expired at expiresAt:
+// during the grace period, a page for browsers and JSON saying until when
+// it can be renewed, and a plain 410 after.
+func writeLinkExpired(c *gin.Context, expiresAt time.Time) {
+	until := renewableUntil(expiresAt)
+	if expiredLinkGrace <= 0 || !time.Now().Before(until) {
+		c.JSON(http.StatusGone, gin.H{"error": "Short URL has expired"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	if strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusGone)
+		if err := expiredTemplate.Execute(c.Writer, map[string]any{"ExpiredAt": expiresAt.UTC().Format(time.RFC1123)}); err != nil {
+			log.Printf("Error rendering expired page: %v", err)
+		}
+		return
+	}
+	c.JSON(http.StatusGone, gin.H{"error": "Short URL has expired", "code": "link_expired",
+		"expired_at": expiresAt.UTC().Format(time.RFC3339), "renewable_until": until.UTC().Format(time.RFC3339)})
+}
+
+// renewRequest sets the new expiry as shortening does.
+type renewRequest struct {
+	ExpiresAt  *linkTime `json:"expires_at"`
+	TTLSeconds int       `json:"ttl_seconds"`
+}
+
+var (
+	errNoExpiry     = errors.New("link never expires")
+	errRenewalEnded = errors.New("renewal period is over")
+	errNotExtended  = errors.New("new expiry is not later")
+)
+
+// renewURL serves POST /api/urls/:code/renew, moving a link's expiry later
+// while it is live or in its grace period. The new expiry is subject to
+// the caller's tier, as at creation.
+func (s *Server) renewURL(c *gin.Context) {
+	shortCode := c.Param("code")
+	var body renewRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	now := time.Now()
+	req := ShortenRequest{ExpiresAt: body.ExpiresAt, TTLSeconds: body.TTLSeconds, tier: callerTier(c)}
+	err := resolveExpiry(&req, now)
+	if err == nil && req.ExpiresAt == nil {
+		err = errors.New("expires_at or ttl_seconds is required")
+	}
+	if err == nil {
+		err = applyTierPolicy(&req, now)
+	}
+	var denial *policyDenial
+	if errors.As(err, &denial) {
+		writePolicyDenial(c, denial)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	newExpiry := req.ExpiresAt.UTC().Format(time.RFC3339)
+
+	ctx := c.Request.Context()
+	owner, admin := c.GetString(ownerContextKey), s.isAdminCaller(c)
+	var oldExpiry string
+	err = s.txWithRetry(ctx, func(tx *sql.Tx) error {
+		var linkOwner, expiresAt sql.NullString
+		var status string
+		err := tx.QueryRowContext(ctx, "SELECT owner, expires_at, status FROM urls WHERE short_code = ? AND is_test = 0", shortCode).Scan(&linkOwner, &expiresAt, &status)
+		if err == nil && !admin && (!linkOwner.Valid || linkOwner.String != owner) {
+			err = sql.ErrNoRows
+		}
+		if err != nil {
+			return err
+		}
+		if status == linkStatusDeleted {
+			return errLinkDeleted
+		}
+		expired, err := time.Parse(time.RFC3339, expiresAt.String)
+		if !expiresAt.Valid || err != nil {
+			return errNoExpiry
+		}
+		if !now.Before(renewableUntil(expired)) {
+			return errRenewalEnded
+		}
+		if !req.ExpiresAt.After(expired) {
+			return errNotExtended
+		}
+		oldExpiry = expiresAt.String
+		_, err = tx.ExecContext(ctx, "UPDATE urls SET expires_at = ?, expiry_warned_at = NULL WHERE short_code = ?", newExpiry, shortCode)
+		return err
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	case errors.Is(err, errLinkDeleted):
+		c.JSON(http.StatusGone, gin.H{"error": "Short URL has been deleted", "code": "link_deleted"})
+		return
+	case errors.Is(err, errNoExpiry):
+		c.JSON(http.StatusConflict, gin.H{"error": "Short URL never expires", "code": "no_expiry"})
+		return
+	case errors.Is(err, errRenewalEnded):
+		c.JSON(http.StatusGone, gin.H{"error": "Short URL has expired and can no longer be renewed", "code": "link_expired"})
+		return
+	case errors.Is(err, errNotExtended):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The new expiry must be later than the current one", "code": "invalid_request"})
+		return
+	case errors.Is(err, errDBBusy):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	s.purgeLinkCache(ctx, shortCode)
+	slog.Info("link renewed", "audit", true, "by", clientIP(c), "owner", owner, "short_code", shortCode, "old", oldExpiry, "new", newExpiry)
+	c.JSON(http.StatusOK, gin.H{"short_code": shortCode, "expires_at": newExpiry, "previous_expires_at": oldExpiry})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createExpiringLink stores a link expiring at expiresAt, owned by owner.
+func createExpiringLink(t *testing.T, owner string, expiresAt time.Time) string {
+	t.Helper()
+	code := "ex-" + newRandomID()[:10]
+	if _, err := testServer.store.Create(context.Background(), ShortenRequest{LongURL: "https://example.com/" + code}, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testServer.db.Exec("UPDATE urls SET expires_at = ?, owner = ? WHERE short_code = ?",
+		expiresAt.UTC().Format(time.RFC3339), nullIfEmpty(owner), code); err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestExpiryWarnings(t *testing.T) {
+	s, _, events := newFakeServer(t)
+	ctx := context.Background()
+	now := time.Now()
+	soon := createExpiringLink(t, "", now.Add(time.Hour))
+	later := createExpiringLink(t, "", now.Add(expiryWarningBefore+time.Hour))
+	past := createExpiringLink(t, "", now.Add(-time.Hour))
+
+	warned := func() []LifecycleEvent {
+		t.Helper()
+		if _, err := s.warnExpiringLinks(ctx, now); err != nil {
+			t.Fatal(err)
+		}
+		var mine []LifecycleEvent
+		for _, e := range events.lifecycle {
+			if e.ShortCode == soon || e.ShortCode == later || e.ShortCode == past {
+				mine = append(mine, e)
+			}
+		}
+		return mine
+	}
+	got := warned()
+	if len(got) != 1 || got[0].Type != eventURLExpiringSoon || got[0].ShortCode != soon || got[0].ExpiresAt == "" {
+		t.Fatalf("events after the first run = %+v, want one %s for %s", got, eventURLExpiringSoon, soon)
+	}
+	if got := warned(); len(got) != 1 {
+		t.Errorf("a second run sent %d more warnings", len(got)-1)
+	}
+
+	// Once renewed, a link is warned again ahead of its new expiry.
+	if _, err := testServer.db.Exec("UPDATE urls SET expires_at = ?, expiry_warned_at = NULL WHERE short_code = ?",
+		now.Add(2*time.Hour).UTC().Format(time.RFC3339), soon); err != nil {
+		t.Fatal(err)
+	}
+	if got := warned(); len(got) != 2 || got[1].ShortCode != soon {
+		t.Errorf("events after renewing = %+v, want a second warning for %s", got, soon)
+	}
+}
+
+func TestExpiredLinkGracePeriod(t *testing.T) {
+	saved := expiredLinkGrace
+	expiredLinkGrace = 24 * time.Hour
+	t.Cleanup(func() { expiredLinkGrace = saved })
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	now := time.Now()
+	code := createExpiringLink(t, ownerID, now.Add(-time.Hour))
+	gone := createExpiringLink(t, ownerID, now.Add(-25*time.Hour))
+
+	w := serveTest(r, http.MethodGet, "/"+code, "")
+	var expired struct {
+		Code           string
+		RenewableUntil string `json:"renewable_until"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &expired)
+	if w.Code != http.StatusGone || expired.Code != "link_expired" || expired.RenewableUntil == "" {
+		t.Errorf("expired link in its grace period = %d: %s", w.Code, w.Body)
+	}
+	w = serveTest(r, http.MethodGet, "/"+code, "", "Accept: text/html")
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), "<html") {
+		t.Errorf("expired link for a browser = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/"+gone, ""); w.Code != http.StatusGone || strings.Contains(w.Body.String(), "renewable_until") {
+		t.Errorf("link past its grace period = %d: %s", w.Code, w.Body)
+	}
+
+	renew := `{"ttl_seconds":86400}`
+	if w := serveTest(r, http.MethodPost, "/api/urls/"+code+"/renew", renew, "X-API-Key: "+otherKey); w.Code != http.StatusNotFound {
+		t.Errorf("renew by another key = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodPost, "/api/urls/"+gone+"/renew", renew, "X-API-Key: "+key); w.Code != http.StatusGone {
+		t.Errorf("renew past the grace period = %d, want %d", w.Code, http.StatusGone)
+	}
+	w = serveTest(r, http.MethodPost, "/api/urls/"+code+"/renew", renew, "X-API-Key: "+key)
+	var renewed struct {
+		ExpiresAt         string `json:"expires_at"`
+		PreviousExpiresAt string `json:"previous_expires_at"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &renewed)
+	if w.Code != http.StatusOK || renewed.PreviousExpiresAt == "" || renewed.ExpiresAt <= renewed.PreviousExpiresAt {
+		t.Fatalf("renew = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/"+code, ""); w.Code != defaultRedirectStatus && w.Code != http.StatusFound {
+		t.Errorf("redirect after renewing = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestRenewRequests(t *testing.T) {
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	code := createExpiringLink(t, ownerID, time.Now().Add(time.Hour))
+	never := createExpiringLink(t, ownerID, time.Now())
+	if _, err := testServer.db.Exec("UPDATE urls SET expires_at = NULL WHERE short_code = ?", never); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		code, body string
+		want       int
+	}{
+		{code, `{}`, http.StatusBadRequest},
+		{code, `{"ttl_seconds":60}`, http.StatusBadRequest},
+		{code, `{"ttl_seconds":60,"expires_at":"2099-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{never, `{"ttl_seconds":86400}`, http.StatusConflict},
+		{"no-such-code", `{"ttl_seconds":86400}`, http.StatusNotFound},
+	} {
+		if w := serveTest(r, http.MethodPost, "/api/urls/"+tt.code+"/renew", tt.body, "X-API-Key: "+key); w.Code != tt.want {
+			t.Errorf("renew %s with %s = %d: %s, want %d", tt.code, tt.body, w.Code, w.Body, tt.want)
+		}
+	}
+	w := serveTest(r, http.MethodPost, "/api/urls/"+code+"/renew", `{"expires_at":"2099-01-01T00:00:00Z"}`, "Authorization: Bearer "+testAdminToken)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "2099-01-01T00:00:00Z") {
+		t.Errorf("admin renew = %d: %s", w.Code, w.Body)
+	}
+
+	// A link with no owner is renewed only by an admin, even by callers
+	// without a key.
+	apiKeysRequired = false
+	t.Cleanup(func() { apiKeysRequired = true })
+	ownerless := createExpiringLink(t, "", time.Now().Add(time.Hour))
+	for _, headers := range [][]string{{"X-API-Key: " + key}, nil} {
+		if w := serveTest(r, http.MethodPost, "/api/urls/"+ownerless+"/renew", `{"ttl_seconds":86400}`, headers...); w.Code != http.StatusNotFound {
+			t.Errorf("renew of an ownerless link with %v = %d, want %d", headers, w.Code, http.StatusNotFound)
+		}
+	}
+	if w := serveTest(r, http.MethodPost, "/api/urls/"+ownerless+"/renew", `{"ttl_seconds":86400}`, "Authorization: Bearer "+testAdminToken); w.Code != http.StatusOK {
+		t.Errorf("admin renew of an ownerless link = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestResolveExpiry(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *linkTime { return &linkTime{Time: now.Add(d)} }
+	tests := []struct {
+		name string
+		req  ShortenRequest
+		want time.Time
+		ok   bool
+	}{
+		{"no expiry", ShortenRequest{}, time.Time{}, true},
+		{"ttl_seconds", ShortenRequest{TTLSeconds: 3600}, now.Add(time.Hour), true},
+		{"expires_at", ShortenRequest{ExpiresAt: at(time.Minute)}, now.Add(time.Minute), true},
+		{"both", ShortenRequest{TTLSeconds: 60, ExpiresAt: at(time.Minute)}, time.Time{}, false},
+		{"negative ttl", ShortenRequest{TTLSeconds: -1}, time.Time{}, false},
+		{"past", ShortenRequest{ExpiresAt: at(-time.Second)}, time.Time{}, false},
+		{"now", ShortenRequest{ExpiresAt: at(0)}, time.Time{}, false},
+		{"before active_from", ShortenRequest{ActiveFrom: at(time.Hour), ExpiresAt: at(time.Minute)}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		err := resolveExpiry(&tt.req, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: resolveExpiry = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && !tt.want.IsZero() && (tt.req.ExpiresAt == nil || !tt.req.ExpiresAt.Equal(tt.want)) {
+			t.Errorf("%s: expires_at = %v, want %s", tt.name, tt.req.ExpiresAt, tt.want)
+		}
+	}
+}
+
+func TestLinkCacheTTL(t *testing.T) {
+	now := time.Now()
+	expires := func(d time.Duration) sql.NullString {
+		return sql.NullString{String: now.Add(d).UTC().Format(time.RFC3339), Valid: true}
+	}
+	if got := linkCacheTTL(sql.NullString{}, now); got != time.Hour {
+		t.Errorf("TTL without expiry = %s, want an hour", got)
+	}
+	if got := linkCacheTTL(expires(24*time.Hour), now); got != time.Hour {
+		t.Errorf("TTL of a link expiring tomorrow = %s, want an hour", got)
+	}
+	if got := linkCacheTTL(expires(10*time.Minute), now); got > 10*time.Minute || got < 9*time.Minute {
+		t.Errorf("TTL of a link expiring in 10 minutes = %s, want its remaining lifetime", got)
+	}
+}
+
+// TestLinkExpiresWhileCached populates both caches, lets the link expire
+// before either entry goes, and redirects again.
+func TestLinkExpiresWhileCached(t *testing.T) {
+	mr := useRedis(t)
+	withLocalCache(t, 100)
+	r := redirectEngine()
+	expiresAt := time.Now().Add(1500 * time.Millisecond).Truncate(time.Second)
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/signed-download", ExpiresAt: &linkTime{Time: expiresAt}}, "")
+
+	if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, ""); w.Code != defaultRedirectStatus {
+		t.Fatalf("redirect before the expiry = %d", w.Code)
+	}
+	if ttl := mr.TTL(urlCacheKey(link.ShortCode)); ttl <= 0 || ttl > time.Until(expiresAt)+time.Second {
+		t.Errorf("cache TTL = %s with %s left to live", ttl, time.Until(expiresAt))
+	}
+	if _, ok := localLinks.get(link.ShortCode, time.Now()); !ok {
+		t.Fatal("the redirect left the link out of the local cache")
+	}
+
+	time.Sleep(time.Until(expiresAt) + 10*time.Millisecond)
+	// miniredis only expires keys when told to, so the Redis entry is still
+	// there, as it would be with a clock a little behind.
+	if !mr.Exists(urlCacheKey(link.ShortCode)) {
+		t.Fatal("the Redis entry is gone")
+	}
+	if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, ""); w.Code != http.StatusGone {
+		t.Errorf("redirect from the local cache after the expiry = %d, want %d", w.Code, http.StatusGone)
+	}
+	withLocalCache(t, 0)
+	if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, ""); w.Code != http.StatusGone {
+		t.Errorf("redirect from Redis after the expiry = %d, want %d", w.Code, http.StatusGone)
+	}
+	mr.Del(urlCacheKey(link.ShortCode))
+	if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, ""); w.Code != http.StatusGone || mr.Exists(urlCacheKey(link.ShortCode)) {
+		t.Errorf("redirect from the database after the expiry = %d, cached again %v", w.Code, mr.Exists(urlCacheKey(link.ShortCode)))
+	}
+}
+
+func TestReapExpiredLinks(t *testing.T) {
+	now := time.Now()
+	old := createExpiringLink(t, "", now.Add(-expiredLinkRetention-time.Hour))
+	recent := createExpiringLink(t, "", now.Add(-time.Hour))
+	if _, err := testServer.db.Exec("INSERT INTO clicks (short_code, clicked_at) VALUES (?, datetime())", old); err != nil {
+		t.Fatal(err)
+	}
+
+	cutoff := now.UTC().Add(-expiredLinkRetention).Format(time.RFC3339)
+	for {
+		n, err := testServer.reapExpiredLinks(context.Background(), cutoff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < expiredLinkReapBatch {
+			break
+		}
+	}
+	for code, want := range map[string]bool{old: false, recent: true} {
+		var n int
+		testServer.db.QueryRow("SELECT COUNT(*) FROM urls WHERE short_code = ?", code).Scan(&n)
+		if (n == 1) != want {
+			t.Errorf("%s kept = %v, want %v", code, n == 1, want)
+		}
+	}
+	var clicks int
+	testServer.db.QueryRow("SELECT COUNT(*) FROM clicks WHERE short_code = ?", old).Scan(&clicks)
+	if clicks != 0 {
+		t.Errorf("%d clicks of the reaped link left", clicks)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// GEOIP_DB is a CSV of network,country[,city] rows: non-overlapping CIDR
+// blocks with their ISO 3166 country code and, optionally, city, as GeoIP
+// vendors' CSV editions can be cut down to. It is loaded at startup, and
+// each click gets the country and city of the visitor's IP, looked up on
+// the publisher worker before PRIVACY_MODE touches the IP. A city is only
+// kept with PRIVACY_MODE=raw: it would place a visitor whose IP was
+// truncated or hashed more precisely than the IP now does. Without
+// GEOIP_DB, or for an IP it doesn't cover or a visitor who opted out of
+// tracking, the country is unknown.
+var geoIPPath = getEnv("GEOIP_DB", "")
+
+// maxGeoCityLen caps a city name, from the database or an ingested event.
+const maxGeoCityLen = 128
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// geoRange is one block of a geoDB.
+type geoRange struct {
+	first, last   netip.Addr
+	country, city string
+}
+
+// geoDB finds the block an IP is in, by binary search over blocks sorted
+// by first address.
+type geoDB struct {
+	ranges []geoRange
+}
+
+// geoIP is the loaded GEOIP_DB, nil without one.
+var geoIP *geoDB
+
+// loadGeoIP loads GEOIP_DB when it is set.
+func loadGeoIP() {
+	if geoIPPath == "" {
+		return
+	}
+	f, err := os.Open(geoIPPath)
+	if err != nil {
+		log.Fatalf("Error opening GEOIP_DB: %v", err)
+	}
+	defer f.Close()
+	db, err := parseGeoDB(f)
+	if err != nil {
+		log.Fatalf("Invalid GEOIP_DB: %v", err)
+	}
+	geoIP = db
+	log.Printf("Loaded %d GeoIP networks", len(db.ranges))
+}
+
+// parseGeoDB reads a GEOIP_DB CSV. A first row that isn't a network is
+// taken for a header.
+func parseGeoDB(r io.Reader) (*geoDB, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	db := &geoDB{}
+	for line := 1; ; line++ {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(row[0]))
+		if err != nil && line == 1 {
+			continue
+		}
+		if err != nil || len(row) < 2 {
+			return nil, fmt.Errorf("line %d: want network,country[,city]", line)
+		}
+		country := strings.ToUpper(strings.TrimSpace(row[1]))
+		if !countryCodePattern.MatchString(country) {
+			return nil, fmt.Errorf("line %d: %q is not a country code", line, row[1])
+		}
+		g := geoRange{first: prefix.Masked().Addr(), last: lastAddr(prefix), country: country}
+		if len(row) > 2 {
+			g.city = truncateUTF8(strings.TrimSpace(row[2]), maxGeoCityLen)
+		}
+		db.ranges = append(db.ranges, g)
+	}
+	slices.SortFunc(db.ranges, func(a, b geoRange) int { return a.first.Compare(b.first) })
+	for i := 1; i < len(db.ranges); i++ {
+		if db.ranges[i].first.Compare(db.ranges[i-1].last) <= 0 {
+			return nil, fmt.Errorf("networks starting at %s and %s overlap", db.ranges[i-1].first, db.ranges[i].first)
+		}
+	}
+	return db, nil
+}
+
+// lastAddr is the last address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Masked().Addr()
+	b := a.AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	last, _ := netip.AddrFromSlice(b)
+	return last
+}
+
+// lookup is the country and city of ip, "" when it isn't covered.
+func (db *geoDB) lookup(ip string) (country, city string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", ""
+	}
+	addr = addr.Unmap()
+	i, _ := slices.BinarySearchFunc(db.ranges, addr, func(g geoRange, a netip.Addr) int { return g.first.Compare(a) })
+	if i < len(db.ranges) && db.ranges[i].first == addr {
+		return db.ranges[i].country, db.ranges[i].city
+	}
+	if i == 0 || db.ranges[i-1].last.Compare(addr) < 0 {
+		return "", ""
+	}
+	return db.ranges[i-1].country, db.ranges[i-1].city
+}
+
+// clickGeo is what a click from ip records of where it came from: the
+// country, and the city only as PRIVACY_MODE allows.
+func clickGeo(ip string) (country, city string) {
+	if geoIP == nil || ip == "" {
+		return "", ""
+	}
+	country, city = geoIP.lookup(ip)
+	if privacyMode != privacyModeRaw {
+		city = ""
+	}
+	return country, city
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testGeoDB = `network,country,city
+203.0.113.0/25,de,Berlin
+203.0.113.128/25,FR,
+198.51.100.0/24,US,"Portland, OR"
+2001:db8::/32,JP,Tokyo
+`
+
+func TestGeoDBLookup(t *testing.T) {
+	db, err := parseGeoDB(strings.NewReader(testGeoDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ ip, country, city string }{
+		{"203.0.113.0", "DE", "Berlin"},
+		{"203.0.113.127", "DE", "Berlin"},
+		{"203.0.113.128", "FR", ""},
+		{"203.0.113.255", "FR", ""},
+		{"198.51.100.7", "US", "Portland, OR"},
+		{"::ffff:198.51.100.7", "US", "Portland, OR"},
+		{"2001:db8:1::1", "JP", "Tokyo"},
+		{"198.51.99.255", "", ""},
+		{"203.0.114.0", "", ""},
+		{"192.0.2.1", "", ""},
+		{"not an ip", "", ""},
+	} {
+		if country, city := db.lookup(tt.ip); country != tt.country || city != tt.city {
+			t.Errorf("lookup(%s) = %q, %q, want %q, %q", tt.ip, country, city, tt.country, tt.city)
+		}
+	}
+
+	for _, bad := range []string{
+		"203.0.113.0/24,DE\n203.0.113.128/25,FR\n",
+		"203.0.113.0/24,Germany\n",
+		"203.0.113.0/24,DE\nnot-a-network,FR\n",
+		"203.0.113.0/24\n",
+	} {
+		if _, err := parseGeoDB(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestClickGeoPrivacy(t *testing.T) {
+	db, err := parseGeoDB(strings.NewReader(testGeoDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDB, savedMode := geoIP, privacyMode
+	t.Cleanup(func() { geoIP, privacyMode = savedDB, savedMode })
+	geoIP = db
+
+	if country, city := clickGeo("203.0.113.9"); country != "DE" || city != "Berlin" {
+		t.Errorf("raw mode = %q, %q, want DE, Berlin", country, city)
+	}
+	for _, mode := range []string{privacyModeTruncate, privacyModeHash} {
+		privacyMode = mode
+		if country, city := clickGeo("203.0.113.9"); country != "DE" || city != "" {
+			t.Errorf("%s mode = %q, %q, want the country alone", mode, country, city)
+		}
+	}
+	if country, _ := clickGeo(""); country != "" {
+		t.Errorf("a visitor who opted out was placed in %q", country)
+	}
+}
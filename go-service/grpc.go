@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	pb "urlshortener/shortenerpb"
+)
+
+// With GRPC_ENABLED, other internal services can use the Shortener service
+// of shortenerpb/shortener.proto on GRPC_ADDR instead of the REST API. Its
+// RPCs go through the same validation, storage, caches and events as the
+// routes they mirror. Callers authenticate as they would there: the admin
+// token, an API key or an OAuth token as "authorization: Bearer ...", or an
+// API key in x-api-key. Responses carry short URLs, so BASE_URL must be set;
+// there is no Host to build them from. Resolver-only instances don't serve
+// gRPC.
+var (
+	grpcEnabled = getEnvBool("GRPC_ENABLED", false)
+	grpcAddr    = getEnv("GRPC_ADDR", ":9000")
+)
+
+var grpcRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "urlshortener_grpc_requests_total",
+	Help: "gRPC requests by method and status code.",
+}, []string{"method", "code"})
+
+// initGRPC rejects a gRPC setup that couldn't build short URLs.
+func initGRPC() {
+	if grpcEnabled && baseURL == "" {
+		log.Fatal("Invalid GRPC_ENABLED: BASE_URL must be set for the gRPC server's short URLs")
+	}
+}
+
+// startGRPC serves the Shortener service on grpcAddr until shutdown, when
+// in-flight calls get a second to finish.
+func (s *Server) startGRPC() {
+	if !grpcEnabled || resolverOnly {
+		return
+	}
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatalf("Error listening on GRPC_ADDR %s: %v", grpcAddr, err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(s.grpcInterceptor))
+	pb.RegisterShortenerServer(srv, grpcShortener{Server: s})
+	app.OnShutdown("grpc", time.Second, func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			srv.Stop()
+		}
+		return nil
+	})
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Fatalf("gRPC server error: %v", err)
+		}
+	}()
+	log.Printf("gRPC server starting on %s", grpcAddr)
+}
+
+// grpcCaller is who a gRPC call authenticated as; the zero value is an
+// anonymous caller, allowed where requireOAuth would let one through.
+type grpcCaller struct {
+	owner string
+	admin bool
+	tier  string
+}
+
+type grpcCallerKey struct{}
+
+func grpcCallerFrom(ctx context.Context) grpcCaller {
+	caller, _ := ctx.Value(grpcCallerKey{}).(grpcCaller)
+	return caller
+}
+
+// grpcWriteMethods are the RPCs maintenanceGuard would refuse.
+var grpcWriteMethods = map[string]bool{"Shorten": true, "Delete": true}
+
+// grpcInterceptor authenticates each call, applies the middleware the
+// mirrored routes run (maintenance mode, the shorten rate limit and
+// Idempotency-Key as idempotency-key metadata), runs it under
+// REQUEST_TIMEOUT and counts it.
+func (s *Server) grpcInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	resp, err := s.grpcIntercept(ctx, method, info.FullMethod, req, handler)
+	grpcRequestsTotal.WithLabelValues(method, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+func (s *Server) grpcIntercept(ctx context.Context, method, fullMethod string, req any, handler grpc.UnaryHandler) (any, error) {
+	caller, err := s.grpcAuthenticate(ctx)
+	if err != nil {
+		log.Printf("Rejected gRPC %s from %s: %v", method, grpcPeer(ctx), err)
+		return nil, err
+	}
+	if grpcWriteMethods[method] && inMaintenance() {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(maintenanceRetryAfter.Seconds()))))
+		return nil, status.Error(codes.Unavailable, "service is in maintenance mode, try again later")
+	}
+	if method == "Shorten" {
+		var captchaToken string
+		if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("captcha-token")) > 0 {
+			captchaToken = md.Get("captcha-token")[0]
+		}
+		usages, d := s.checkShortenCaller(ctx, caller.tier, caller.owner, grpcPeer(ctx), false, captchaToken)
+		if d != nil {
+			return nil, grpcPolicyError(ctx, d)
+		}
+		s.warnQuotas(ctx, caller.owner, usages, time.Now())
+	}
+	if requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+	ctx = context.WithValue(ctx, grpcCallerKey{}, caller)
+	if method == "Shorten" {
+		return s.grpcIdempotent(ctx, fullMethod, caller, req.(proto.Message), handler)
+	}
+	return handler(ctx, req)
+}
+
+// grpcIdempotent is idempotency for a call: with idempotency-key metadata,
+// a retry with the same key and request gets the first call's response
+// back, marked by idempotent-replayed header metadata. A stored error is
+// replayed too, unless it is one a retry could get past.
+func (s *Server) grpcIdempotent(ctx context.Context, fullMethod string, caller grpcCaller, req proto.Message, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if values := md.Get("idempotency-key"); len(values) > 0 {
+		key = values[0]
+	}
+	if key == "" {
+		return handler(ctx, req)
+	}
+	if len(key) > idempotencyMaxKeyLen {
+		return nil, status.Error(codes.InvalidArgument, "idempotency-key must be at most "+strconv.Itoa(idempotencyMaxKeyLen)+" characters")
+	}
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "encoding request")
+	}
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+	who := caller.owner
+	if who == "" {
+		who = "ip:" + grpcPeer(ctx)
+	}
+	scoped := sha256.Sum256([]byte(fullMethod + "\x00" + who + "\x00" + key))
+	storeKey := hex.EncodeToString(scoped[:])
+
+	store, existing, err := s.claimIdempotencyKey(ctx, storeKey, fingerprint)
+	if err != nil {
+		log.Printf("Error claiming idempotency key: %v", err)
+		return nil, grpcStoreError(err)
+	}
+	if existing != nil {
+		switch {
+		case existing.Fingerprint != fingerprint:
+			return nil, status.Error(codes.InvalidArgument, "idempotency-key was already used with a different request")
+		case existing.Status == 0:
+			return nil, status.Error(codes.Aborted, "a request with this idempotency-key is still in progress")
+		}
+		grpc.SetHeader(ctx, metadata.Pairs("idempotent-replayed", "true"))
+		return grpcReplay(existing)
+	}
+
+	resp, callErr := handler(ctx, req)
+	ctx = context.WithoutCancel(ctx)
+	rec := idempotencyRecord{Fingerprint: fingerprint, Status: http.StatusOK, ContentType: grpcResponseContentType}
+	switch status.Code(callErr) {
+	case codes.OK:
+		rec.Body, err = proto.Marshal(resp.(proto.Message))
+	case codes.Unavailable, codes.Internal, codes.DeadlineExceeded, codes.Unknown, codes.Canceled:
+		if err := store.release(ctx, storeKey); err != nil {
+			log.Printf("Error releasing idempotency key: %v", err)
+		}
+		return resp, callErr
+	default:
+		rec.Status, rec.ContentType = http.StatusBadRequest, grpcStatusContentType
+		rec.Body, err = proto.Marshal(status.Convert(callErr).Proto())
+	}
+	if err == nil {
+		err = store.complete(ctx, storeKey, rec)
+	}
+	if err != nil {
+		log.Printf("Error storing idempotent response: %v", err)
+	}
+	return resp, callErr
+}
+
+// Content types of idempotency records kept for gRPC calls.
+const (
+	grpcResponseContentType = "application/x-protobuf; message=ShortenResponse"
+	grpcStatusContentType   = "application/x-protobuf; message=google.rpc.Status"
+)
+
+// grpcReplay decodes a record grpcIdempotent stored.
+func grpcReplay(rec *idempotencyRecord) (any, error) {
+	switch rec.ContentType {
+	case grpcResponseContentType:
+		resp := &pb.ShortenResponse{}
+		if err := proto.Unmarshal(rec.Body, resp); err != nil {
+			return nil, status.Error(codes.Internal, "decoding stored response")
+		}
+		return resp, nil
+	case grpcStatusContentType:
+		st := &spb.Status{}
+		if err := proto.Unmarshal(rec.Body, st); err != nil {
+			return nil, status.Error(codes.Internal, "decoding stored response")
+		}
+		return nil, status.ErrorProto(st)
+	}
+	// A key reused from the REST route can't get here: keys are per method.
+	return nil, status.Error(codes.Internal, "stored response is not a gRPC one")
+}
+
+// grpcAuthenticate is authenticateCaller, with isAdminCaller's admin token,
+// for the call's metadata.
+func (s *Server) grpcAuthenticate(ctx context.Context) (grpcCaller, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	key := first("x-api-key")
+	token, bearer := strings.CutPrefix(first("authorization"), "Bearer ")
+	if bearer && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return grpcCaller{admin: true, tier: tierAdmin}, nil
+	}
+	if key == "" && bearer && strings.HasPrefix(token, apiKeyIDPrefix) {
+		key = token
+	}
+	if key != "" {
+		k, err := s.verifyAPIKey(ctx, key)
+		if errors.Is(err, errInvalidAPIKey) {
+			return grpcCaller{}, status.Error(codes.Unauthenticated, "invalid API key")
+		}
+		if err != nil {
+			return grpcCaller{}, status.Error(codes.Internal, "database error")
+		}
+		keyUsage.add(k.ID, time.Now(), keyUsageCounts{apiCalls: 1})
+		return grpcCaller{owner: k.ID, admin: k.Admin, tier: apiKeyTier(k)}, nil
+	}
+	if oauthJWKSURL == "" {
+		if apiKeysRequired {
+			return grpcCaller{}, status.Error(codes.Unauthenticated, "missing API key")
+		}
+		return grpcCaller{tier: tierAnonymous}, nil
+	}
+	if !bearer || token == "" {
+		return grpcCaller{}, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	claims, err := verifyJWT(token, time.Now())
+	if err != nil {
+		return grpcCaller{}, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	owner, _ := claims[oauthOwnerClaim].(string)
+	if owner == "" {
+		return grpcCaller{}, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	return grpcCaller{owner: owner, tier: tierStandard}, nil
+}
+
+// grpcPeer is the caller's address, for logs.
+func grpcPeer(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// grpcStoreError maps the database errors the handlers answer 503 and 500
+// for.
+func grpcStoreError(err error) error {
+	if errors.Is(err, errDBBusy) || isBusyError(err) {
+		return status.Error(codes.Unavailable, "database busy, try again")
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, "request timed out")
+	}
+	return status.Error(codes.Internal, "database error")
+}
+
+// grpcPolicyError is the status for a tier policy denial, as
+// writePolicyDenial answers it over HTTP.
+func grpcPolicyError(ctx context.Context, d *policyDenial) error {
+	if d.wait > 0 {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(max(1, int(math.Ceil(d.wait.Seconds()))))))
+	}
+	code := codes.PermissionDenied
+	switch d.status {
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, strings.ToLower(d.message[:1])+d.message[1:]+" ("+d.tier+" tier, "+d.policy+" policy)")
+}
+
+// grpcShortener is the Shortener service of a Server.
+type grpcShortener struct {
+	pb.UnimplementedShortenerServer
+	*Server
+}
+
+// Shorten is createShortURL.
+func (g grpcShortener) Shorten(ctx context.Context, in *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	caller := grpcCallerFrom(ctx)
+	req := ShortenRequest{
+		LongURL:       in.LongUrl,
+		CustomAlias:   in.CustomAlias,
+		TTLSeconds:    int(in.TtlSeconds),
+		Timezone:      in.Timezone,
+		RedirectType:  int(in.RedirectType),
+		Password:      in.Password,
+		Notes:         in.Notes,
+		ReuseExisting: in.ReuseExisting,
+		owner:         caller.owner,
+		tier:          caller.tier,
+		baseURL:       baseURL,
+	}
+	if len(in.Metadata) > 0 {
+		req.Metadata = in.Metadata
+	}
+	if in.ExpiresAt != "" {
+		quoted, _ := json.Marshal(in.ExpiresAt)
+		req.ExpiresAt = &linkTime{}
+		if err := req.ExpiresAt.UnmarshalJSON(quoted); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "expires_at: "+err.Error())
+		}
+	}
+	defaultTimezone, err := g.ownerTimezone(ctx, req.owner)
+	if err == nil {
+		req.canonical, err = g.ownerCanonicalProfile(ctx, req.owner)
+	}
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+	if err := prepareShortenRequest(&req, defaultTimezone, time.Now()); err != nil {
+		var denial *policyDenial
+		if errors.As(err, &denial) {
+			return nil, grpcPolicyError(ctx, denial)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if verifyDestination {
+		hosts := map[string]bool{}
+		if u, err := url.Parse(baseURL); err == nil {
+			hosts[strings.ToLower(u.Host)] = true
+		}
+		if check, refused := runDestinationCheck(ctx, &req, hosts, grpcPeer(ctx)); refused {
+			return nil, status.Error(codes.FailedPrecondition, "long_url failed the destination check: "+check.Detail)
+		}
+	}
+
+	response, err := g.storeShortURL(ctx, req)
+	if errors.Is(err, errAliasTaken) {
+		return nil, status.Error(codes.AlreadyExists, "custom_alias "+strconv.Quote(req.CustomAlias)+" is already taken")
+	}
+	if errors.Is(err, errNoFreeShortCode) {
+		return nil, status.Error(codes.Unavailable, "every generated short code collided with an existing one, try again")
+	}
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+	return &pb.ShortenResponse{
+		ShortCode:          response.ShortCode,
+		ShortUrl:           response.ShortURL,
+		LongUrl:            response.LongURL,
+		ExpiresAt:          response.ExpiresAt,
+		RedirectType:       int32(response.RedirectType),
+		Reused:             response.Reused,
+		DestinationProblem: response.DestinationProblem,
+	}, nil
+}
+
+// Resolve is getURL plus, with record_click, the click a redirect would
+// have counted. Only links a redirect would follow without a password
+// record one.
+func (g grpcShortener) Resolve(ctx context.Context, in *pb.ResolveRequest) (*pb.ResolveResponse, error) {
+	caller := grpcCallerFrom(ctx)
+	link, err := g.store.GetLongURL(ctx, in.ShortCode)
+	now := time.Now()
+	if err == nil && (!linkActive(link.ActiveFrom, now) || link.Owner.Valid && link.Owner.String != caller.owner && !caller.admin) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "short URL not found")
+	}
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+
+	response := &pb.ResolveResponse{
+		Status:            effectiveLinkStatus(link.Status, link.ExpiresAt, now),
+		ExpiresAt:         link.ExpiresAt.String,
+		RedirectStatus:    int32(redirectStatus(int(link.RedirectType.Int64), link.ExpiresAt.Valid)),
+		PasswordProtected: link.PasswordHash.Valid,
+	}
+	if destinationVisible(link.PasswordHash, link.Owner, caller.owner, caller.admin) {
+		response.LongUrl = link.LongURL
+	}
+	// A protected link only counts unlocked hits, and there is no unlock
+	// over gRPC.
+	if in.RecordClick && response.Status == linkStatusActive && !scanBlocked(link.ScanStatus) && !link.IsTest && !link.PasswordHash.Valid {
+		g.enqueueClickJob(clickJob{shortCode: in.ShortCode, clickedAt: now})
+		response.ClickRecorded = true
+	}
+	return response, nil
+}
+
+// Delete is deleteURL.
+func (g grpcShortener) Delete(ctx context.Context, in *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	caller := grpcCallerFrom(ctx)
+	shortCode := in.ShortCode
+	if !caller.admin {
+		if caller.owner == "" {
+			return nil, status.Error(codes.Unauthenticated, "missing API key or admin token")
+		}
+		link, err := g.store.GetLongURL(ctx, shortCode)
+		if err == sql.ErrNoRows || err == nil && link.Owner.String != caller.owner {
+			return nil, status.Error(codes.NotFound, "short URL not found")
+		}
+		if err != nil {
+			return nil, grpcStoreError(err)
+		}
+	}
+
+	deleted, err := g.store.Delete(ctx, shortCode, in.Hard)
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+	if !deleted {
+		return nil, status.Error(codes.NotFound, "short URL not found")
+	}
+	if !in.Hard {
+		g.purgeLinkCache(ctx, shortCode)
+		g.publishLifecycleEvent(context.WithoutCancel(ctx), eventURLDeleted, shortCode)
+		slog.Info("link status changed", "audit", true, "by", grpcPeer(ctx), "owner", caller.owner,
+			"short_code", shortCode, "new", linkStatusDeleted)
+		return &pb.DeleteResponse{}, nil
+	}
+
+	g.purgeDeletedLink(ctx, shortCode)
+	g.publishLifecycleEvent(context.WithoutCancel(ctx), eventURLDeleted, shortCode)
+	log.Printf("Deleted short URL %s (by %s over gRPC)", shortCode, grpcPeer(ctx))
+	return &pb.DeleteResponse{}, nil
+}
+
+// GetStats is getStats without a range. A source that can't be read
+// fails the call with Unavailable, where getStats answers 503.
+func (g grpcShortener) GetStats(ctx context.Context, in *pb.GetStatsRequest) (*pb.GetStatsResponse, error) {
+	caller := grpcCallerFrom(ctx)
+	link, err := g.store.Stats(ctx, in.ShortCode)
+	now := time.Now()
+	if err == nil && (!linkActive(link.ActiveFrom, now) || !caller.admin && (!link.Owner.Valid || link.Owner.String != caller.owner)) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "short URL not found")
+	}
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+
+	meta := newStatsMeta()
+	if freshAsOf, err := g.rawClicksFreshness(ctx); err != nil {
+		meta.unavailable(statsSourceRawClicks, "database error reading clicks")
+	} else {
+		meta.ok(statsSourceRawClicks, freshAsOf)
+	}
+	stats := gin.H{}
+	g.summaryStats(ctx, in.ShortCode, link.ImportedClicks, meta, now, stats)
+	if !meta.available() {
+		return nil, status.Error(codes.Unavailable, "stats sources unavailable, try again")
+	}
+	response := &pb.GetStatsResponse{
+		ShortCode: in.ShortCode,
+		CreatedAt: link.CreatedAt,
+		Status:    effectiveLinkStatus(link.Status, link.ExpiresAt, now),
+	}
+	response.Clicks, _ = stats["clicks"].(int64)
+	response.Conversions, _ = stats["conversions"].(int64)
+	response.ConversionRate, _ = stats["conversion_rate"].(float64)
+	response.TotalClicks, _ = stats["total_clicks"].(int64)
+	response.LastClickedAt, _ = stats["last_clicked_at"].(string)
+	return response, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "urlshortener/shortenerpb"
+)
+
+// grpcTestClient serves the Shortener service as startGRPC does, over an
+// in-memory connection.
+func grpcTestClient(tb testing.TB) pb.ShortenerClient {
+	tb.Helper()
+	saved := baseURL
+	baseURL = "http://short.test"
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(testServer.grpcInterceptor))
+	pb.RegisterShortenerServer(srv, grpcShortener{Server: testServer})
+	go srv.Serve(lis)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+		baseURL = saved
+	})
+	return pb.NewShortenerClient(conn)
+}
+
+// withGRPCAuth is ctx sending key as x-api-key, plus any other metadata
+// pairs.
+func withGRPCAuth(ctx context.Context, key string, kv ...string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, append([]string{"x-api-key", key}, kv...)...)
+}
+
+// TestShortenRESTGRPCParity sends the same requests to POST /api/shorten
+// and the Shorten RPC, and to DELETE /api/urls/:code and Delete, and
+// expects matching outcomes.
+func TestShortenRESTGRPCParity(t *testing.T) {
+	r := testServer.newRouter()
+	client := grpcTestClient(t)
+	ownerID, key := newTestAPIKey(t, false)
+	taken := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/parity-taken", CustomAlias: "parity-taken"}, ownerID)
+	others := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/parity-others", ReuseExisting: new(bool)}, "someone-else")
+
+	shortenCases := []struct {
+		name     string
+		body     string
+		in       *pb.ShortenRequest
+		wantHTTP int
+		wantGRPC codes.Code
+	}{
+		{"valid", `{"long_url":"https://example.com/parity"}`, &pb.ShortenRequest{LongUrl: "https://example.com/parity"}, http.StatusOK, codes.OK},
+		{"bad scheme", `{"long_url":"ftp://example.com/parity"}`, &pb.ShortenRequest{LongUrl: "ftp://example.com/parity"}, http.StatusBadRequest, codes.InvalidArgument},
+		{"alias taken", `{"long_url":"https://example.com/parity-2","custom_alias":"parity-taken"}`, &pb.ShortenRequest{LongUrl: "https://example.com/parity-2", CustomAlias: "parity-taken"}, http.StatusConflict, codes.AlreadyExists},
+	}
+	for _, tt := range shortenCases {
+		t.Run("shorten "+tt.name, func(t *testing.T) {
+			w := serveTest(r, http.MethodPost, "/api/shorten", tt.body, "X-API-Key: "+key)
+			_, err := client.Shorten(withGRPCAuth(context.Background(), key), tt.in)
+			if w.Code != tt.wantHTTP || status.Code(err) != tt.wantGRPC {
+				t.Errorf("REST %d, gRPC %v; want %d, %v", w.Code, status.Code(err), tt.wantHTTP, tt.wantGRPC)
+			}
+		})
+	}
+
+	t.Run("delete someone else's link", func(t *testing.T) {
+		w := serveTest(r, http.MethodDelete, "/api/urls/"+others.ShortCode, "", "X-API-Key: "+key)
+		_, err := client.Delete(withGRPCAuth(context.Background(), key), &pb.DeleteRequest{ShortCode: others.ShortCode})
+		if w.Code != http.StatusNotFound || status.Code(err) != codes.NotFound {
+			t.Errorf("REST %d, gRPC %v; want 404, NotFound", w.Code, status.Code(err))
+		}
+	})
+
+	t.Run("maintenance", func(t *testing.T) {
+		maintenanceMode.Store(true)
+		defer maintenanceMode.Store(false)
+		w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/parity"}`, "X-API-Key: "+key)
+		var header metadata.MD
+		_, err := client.Shorten(withGRPCAuth(context.Background(), key), &pb.ShortenRequest{LongUrl: "https://example.com/parity"}, grpc.Header(&header))
+		if w.Code != http.StatusServiceUnavailable || status.Code(err) != codes.Unavailable {
+			t.Errorf("shorten: REST %d, gRPC %v; want 503, Unavailable", w.Code, status.Code(err))
+		}
+		if got := header.Get("retry-after"); len(got) == 0 || got[0] != w.Header().Get("Retry-After") {
+			t.Errorf("gRPC retry-after %v, REST Retry-After %q", got, w.Header().Get("Retry-After"))
+		}
+		w = serveTest(r, http.MethodDelete, "/api/urls/"+taken.ShortCode, "", "X-API-Key: "+key)
+		_, err = client.Delete(withGRPCAuth(context.Background(), key), &pb.DeleteRequest{ShortCode: taken.ShortCode})
+		if w.Code != http.StatusServiceUnavailable || status.Code(err) != codes.Unavailable {
+			t.Errorf("delete: REST %d, gRPC %v; want 503, Unavailable", w.Code, status.Code(err))
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		saved := tierPolicies[tierStandard]
+		tierPolicies[tierStandard] = tierPolicy{ShortenPerMinute: 1, ShortenBurst: 1, CustomAlias: true, Batch: true}
+		defer func() { tierPolicies[tierStandard] = saved }()
+		for i, want := range []codes.Code{codes.OK, codes.ResourceExhausted} {
+			w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/parity-limit"}`, "X-API-Key: "+key)
+			_, err := client.Shorten(withGRPCAuth(context.Background(), key), &pb.ShortenRequest{LongUrl: "https://example.com/parity-limit"})
+			wantHTTP := map[codes.Code]int{codes.OK: http.StatusOK, codes.ResourceExhausted: http.StatusTooManyRequests}[want]
+			if w.Code != wantHTTP || status.Code(err) != want {
+				t.Errorf("request %d: REST %d, gRPC %v; want %d, %v", i+1, w.Code, status.Code(err), wantHTTP, want)
+			}
+		}
+	})
+
+	t.Run("idempotency", func(t *testing.T) {
+		in := &pb.ShortenRequest{LongUrl: "https://example.com/parity-idem", ReuseExisting: new(bool)}
+		body := `{"long_url":"https://example.com/parity-idem","reuse_existing":false}`
+		var restCodes, grpcCodes []string
+		var replayed metadata.MD
+		for range 2 {
+			w := serveTest(r, http.MethodPost, "/api/shorten", body, "X-API-Key: "+key, "Idempotency-Key: parity-1")
+			var resp ShortenResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			restCodes = append(restCodes, resp.ShortCode)
+
+			out, err := client.Shorten(withGRPCAuth(context.Background(), key, "idempotency-key", "parity-1"), in, grpc.Header(&replayed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			grpcCodes = append(grpcCodes, out.ShortCode)
+		}
+		if restCodes[0] == "" || restCodes[0] != restCodes[1] || grpcCodes[0] != grpcCodes[1] {
+			t.Errorf("retries created new links: REST %v, gRPC %v", restCodes, grpcCodes)
+		}
+		if got := replayed.Get("idempotent-replayed"); len(got) == 0 || got[0] != "true" {
+			t.Errorf("gRPC replay not marked: %v", replayed)
+		}
+
+		w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/parity-other"}`, "X-API-Key: "+key, "Idempotency-Key: parity-1")
+		_, err := client.Shorten(withGRPCAuth(context.Background(), key, "idempotency-key", "parity-1"), &pb.ShortenRequest{LongUrl: "https://example.com/parity-other"})
+		if w.Code != http.StatusUnprocessableEntity || status.Code(err) != codes.InvalidArgument {
+			t.Errorf("reused key: REST %d, gRPC %v; want 422, InvalidArgument", w.Code, status.Code(err))
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// probePaths are hit every few seconds by orchestrators and scrapers; they
+// are left out of the access log.
+var probePaths = []string{"/healthz", "/readyz", metricsPath}
+
+// readyProbeTimeout bounds each dependency check in /readyz.
+const readyProbeTimeout = 2 * time.Second
+
+// healthz serves GET /healthz, the liveness probe: the process is up and
+// serving HTTP. It checks no dependency, so an outage of one doesn't get
+// the container restarted.
+func healthz(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz serves GET /readyz, the readiness probe. SQLite must answer a
+// read or the instance is unavailable (503). Redis is optional, so when it
+// stops answering, or the breaker has it marked unavailable, the instance is
+// only degraded, as it is in maintenance mode, since redirects are still
+// served. While the cache is being warmed at startup it is not ready yet.
+func (s *Server) readyz(c *gin.Context) {
+	checks := gin.H{}
+	dbCheck, dbOK := probeDependency(c.Request.Context(), func(ctx context.Context) error {
+		var one int
+		return s.db.QueryRowContext(ctx, "SELECT 1 FROM schema_migrations LIMIT 1").Scan(&one)
+	})
+	checks["database"] = dbCheck
+
+	redisOK := true
+	if s.rdb == nil {
+		checks["redis"] = gin.H{"status": "disabled"}
+	} else {
+		checks["redis"], redisOK = probeDependency(c.Request.Context(), func(ctx context.Context) error {
+			return s.rdb.Ping(ctx).Err()
+		})
+	}
+
+	maintenance := inMaintenance()
+	warming := cacheWarming.Load()
+	if warming {
+		checks["cache_warm"] = gin.H{"status": "warming"}
+	}
+	response := gin.H{
+		"status":      "ready",
+		"degraded":    !redisOK || maintenance,
+		"maintenance": maintenance,
+		"checks":      checks,
+	}
+	status := http.StatusOK
+	switch {
+	case !dbOK:
+		response["status"] = "unavailable"
+		status = http.StatusServiceUnavailable
+	case warming:
+		response["status"] = "warming"
+		status = http.StatusServiceUnavailable
+	case !redisOK || maintenance:
+		response["status"] = "degraded"
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, response)
+}
+
+// probeDependency runs check with readyProbeTimeout and reports its status
+// and latency.
+func probeDependency(ctx context.Context, check func(context.Context) error) (gin.H, bool) {
+	ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	result := gin.H{"status": "up", "latency_ms": float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result["status"] = "down"
+		result["error"] = err.Error()
+	}
+	return result, err == nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed templates/home.html
+var homeFS embed.FS
+
+var homeTemplate = template.Must(template.ParseFS(homeFS, "templates/home.html"))
+
+// apiVersion is reported by the service index at GET /.
+const apiVersion = "1"
+
+// reservedCodes can never be claimed as short codes because they would be
+// shadowed by, or shadow, a route. The root itself is served by homepage
+// and never reaches redirect, so it is not counted as a click.
+var reservedCodes = map[string]bool{
+	"api":   true,
+	"admin": true,
+}
+
+const csrfCookieName = "sc_csrf"
+
+// apiIndex lists the public endpoints for clients that ask for JSON at /.
+var apiIndex = []gin.H{
+	{"method": "POST", "path": "/api/shorten", "description": "Create a short URL"},
+	{"method": "POST", "path": "/api/shorten/batch", "description": "Create up to SHORTEN_BATCH_MAX short URLs at once (?dry_run=true to only validate)"},
+	{"method": "GET", "path": "/:code", "description": "Redirect to the long URL"},
+	{"method": "GET", "path": "/api/urls", "description": "List your short URLs, filtered by q, status, domain, has_expiry, broken, created_after, created_before, scan_status or meta.<key>, sorted by [-]created_at, [-]clicks or [-]last_accessed_at"},
+	{"method": "GET", "path": "/api/urls/:code", "description": "Inspect a short URL without redirecting"},
+	{"method": "GET", "path": "/api/qr/:code", "description": "QR code of a short URL, as png or svg, size 64-1024 pixels"},
+	{"method": "POST", "path": "/api/scan-results", "description": "Deliver a malware scan verdict (signed)"},
+	{"method": "PATCH", "path": "/api/urls/:code", "description": "Edit a short URL's notes, metadata and status (active or disabled), or rename it, keeping the old code as an alias"},
+	{"method": "DELETE", "path": "/api/urls/:code", "description": "Revoke a short URL, keeping its history unless hard=true (owner or admin)"},
+	{"method": "POST", "path": "/api/urls/:code/claim", "description": "Take ownership of a link created without an owner, using its claim token"},
+	{"method": "POST", "path": "/api/urls/:code/transfer", "description": "Give a short URL to another API key (owner or admin)"},
+	{"method": "DELETE", "path": "/api/urls/:code/aliases/:alias", "description": "Release a renamed short URL's old code for new links (owner or admin)"},
+	{"method": "POST", "path": "/api/urls/:code/renew", "description": "Move an expiring or recently expired short URL's expiry later (owner or admin)"},
+	{"method": "GET", "path": "/api/keys/self/usage", "description": "Links created, clicks and API calls per day for your key between from= and to= (YYYY-MM-DD)"},
+	{"method": "GET", "path": "/api/stats/:code", "description": "Clicks and conversions for a code"},
+	{"method": "GET", "path": "/api/stats/:code/timeseries", "description": "Clicks per hour or day for a code, from local rollups"},
+	{"method": "GET", "path": "/api/urls/:code/stats/countries", "description": "Clicks per visitor country for a code, and per city with cities=true"},
+	{"method": "GET", "path": "/api/stats/realtime", "description": "Clicks in the last minute"},
+	{"method": "GET", "path": "/api/pixel/:code.gif", "description": "Conversion tracking pixel"},
+	{"method": "POST", "path": "/api/events", "description": "Signed click event ingest"},
+	{"method": "POST", "path": "/api/events/batch", "description": "Signed click event batch ingest"},
+	{"method": "GET", "path": "/api/events/schema", "description": "JSON Schemas and examples of the events the service emits"},
+	{"method": "PUT", "path": "/api/settings/timezone", "description": "Set the default timezone for local schedule and expiry times"},
+	{"method": "PUT", "path": "/api/settings/canonical", "description": "Set how long URLs are compared when reusing links"},
+	{"method": "POST", "path": "/api/domains/verify", "description": "Start proving control of a destination domain"},
+	{"method": "GET", "path": "/api/domains", "description": "Domain verification status"},
+}
+
+type homePage struct {
+	CSRFToken string
+	// FormEnabled is false when the API requires API keys or bearer
+	// tokens, which a plain browser form can't send.
+	FormEnabled bool
+	LongURL     string
+	// CaptchaSiteKey shows the CAPTCHA widget the anonymous tier needs.
+	CaptchaSiteKey string
+	Result         *ShortenResponse
+	Error          string
+}
+
+// homepage serves GET /: a service index for JSON clients, otherwise a small
+// page with a shorten form.
+func homepage(c *gin.Context) {
+	if c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+		c.JSON(http.StatusOK, gin.H{
+			"service":     "url-shortener",
+			"api_version": apiVersion,
+			"endpoints":   apiIndex,
+		})
+		return
+	}
+	renderHome(c, http.StatusOK, homePage{})
+}
+
+// homepageShorten handles the form POST from the homepage. It takes a form
+// body rather than JSON, so it is protected with a double-submit token: the
+// form field must match the SameSite=Strict cookie set with the page, which
+// a cross-site form cannot read or send.
+func (s *Server) homepageShorten(c *gin.Context) {
+	if !homeFormEnabled() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Use the API with an API key or bearer token"})
+		return
+	}
+
+	cookie, err := c.Cookie(csrfCookieName)
+	token := c.PostForm("csrf_token")
+	if err != nil || token == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(token)) != 1 || !sameOrigin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid form token"})
+		return
+	}
+
+	page := homePage{LongURL: c.PostForm("long_url")}
+	longURL, err := normalizeLongURL(page.LongURL)
+	if err != nil {
+		page.Error = "Enter an http or https URL."
+		if err.(*longURLError).Code == longURLTooLong {
+			page.Error = "That URL is too long."
+		}
+		renderHome(c, http.StatusBadRequest, page)
+		return
+	}
+
+	req := ShortenRequest{LongURL: longURL, tier: tierAnonymous, baseURL: publicBaseURL(c)}
+	var denial *policyDenial
+	if err := applyTierPolicy(&req, time.Now()); errors.As(err, &denial) {
+		page.Error = denial.message + "."
+		renderHome(c, denial.status, page)
+		return
+	}
+	if verifyDestination {
+		if check, refused := runDestinationCheck(c.Request.Context(), &req, shortenerHosts(c), clientIP(c)); refused {
+			page.Error = "That destination can't be shortened: " + check.Detail + "."
+			renderHome(c, http.StatusUnprocessableEntity, page)
+			return
+		}
+	}
+
+	response, err := s.storeShortURL(c.Request.Context(), req)
+	if errors.Is(err, errDBBusy) || errors.Is(err, errNoFreeShortCode) {
+		page.Error = "The service is busy, please try again."
+		c.Header("Retry-After", "1")
+		renderHome(c, http.StatusServiceUnavailable, page)
+		return
+	}
+	if err != nil {
+		page.Error = "Failed to create short URL."
+		renderHome(c, http.StatusInternalServerError, page)
+		return
+	}
+	logSampledShorten(c, response.ShortCode, response.LongURL, "")
+	page.Result = &response
+	page.LongURL = ""
+	renderHome(c, http.StatusOK, page)
+}
+
+// sameOrigin rejects requests whose Origin names another host. Browsers
+// send Origin on form POSTs; its absence is left to the token check.
+func sameOrigin(c *gin.Context) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == c.Request.Host
+}
+
+// homeFormEnabled reports whether the homepage form may shorten links
+// without credentials.
+func homeFormEnabled() bool {
+	return oauthJWKSURL == "" && !apiKeysRequired
+}
+
+func renderHome(c *gin.Context, status int, page homePage) {
+	page.FormEnabled = homeFormEnabled()
+	if policyFor(tierAnonymous).Captcha && captchaSecret != "" {
+		page.CaptchaSiteKey = captchaSiteKey
+	}
+	if page.FormEnabled {
+		page.CSRFToken = newRandomID()
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(csrfCookieName, page.CSRFToken, 3600, "/", "", false, true)
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(status)
+	if err := homeTemplate.Execute(c.Writer, page); err != nil {
+		log.Printf("Error rendering homepage: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+var pythonHTTPStats = expvar.NewMap("python_http")
+
+func (s *Server) initPythonClient() {
+	transport := &http.Transport{
+		Proxy: outboundProxy,
+		DialContext: (&net.Dialer{
+			Timeout:   getEnvDuration("PYTHON_HTTP_DIAL_TIMEOUT", 1*time.Second),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          getEnvInt("PYTHON_HTTP_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost:   getEnvInt("PYTHON_HTTP_MAX_IDLE_CONNS_PER_HOST", 32),
+		MaxConnsPerHost:       getEnvInt("PYTHON_HTTP_MAX_CONNS_PER_HOST", 0),
+		IdleConnTimeout:       getEnvDuration("PYTHON_HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+		TLSHandshakeTimeout:   2 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		},
+		ForceAttemptHTTP2: getEnvBool("PYTHON_HTTP2", false),
+	}
+
+	s.python = &http.Client{
+		Timeout:   getEnvDuration("PYTHON_HTTP_TIMEOUT", 2*time.Second),
+		Transport: &pooledStatsTransport{base: transport},
+	}
+}
+
+// pooledStatsTransport records connection reuse so pool behaviour is visible
+// under /admin/debug/vars.
+type pooledStatsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *pooledStatsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				pythonHTTPStats.Add("conns_reused", 1)
+			} else {
+				pythonHTTPStats.Add("conns_new", 1)
+			}
+			if info.WasIdle {
+				pythonHTTPStats.Add("conns_from_idle_pool", 1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	pythonHTTPStats.Add("requests", 1)
+	pythonHTTPStats.Add("in_flight", 1)
+	defer pythonHTTPStats.Add("in_flight", -1)
+
+	if err := chaosInject(req.Context(), chaosTargetHTTP); err != nil {
+		pythonHTTPStats.Add("errors", 1)
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	logIfSlow(&slowHTTPThreshold, "http", req.Method+" "+req.URL.Path, time.Since(start))
+	if err != nil {
+		pythonHTTPStats.Add("errors", 1)
+	}
+	return resp, err
+}
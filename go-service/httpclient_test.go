@@ -0,0 +1,86 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func pythonHTTPCount(name string) int64 {
+	if v, ok := pythonHTTPStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestPythonClientStaysWithinMaxConns(t *testing.T) {
+	const maxConns, requests = 4, 64
+	t.Setenv("PYTHON_HTTP_MAX_CONNS_PER_HOST", strconv.Itoa(maxConns))
+	t.Setenv("PYTHON_HTTP_TIMEOUT", "10s")
+
+	var opened, open, peak atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+			n := open.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+		case http.StateClosed, http.StateHijacked:
+			open.Add(-1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	s := &Server{}
+	s.initPythonClient()
+	t.Cleanup(s.python.CloseIdleConnections)
+	before := map[string]int64{}
+	for _, name := range []string{"requests", "errors", "conns_new", "conns_reused"} {
+		before[name] = pythonHTTPCount(name)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := s.python.Post(srv.URL+"/api/events", "application/json", nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("request failed: %v", err)
+	}
+
+	if opened.Load() > maxConns || peak.Load() > maxConns {
+		t.Errorf("opened %d connections, %d at once; want at most %d", opened.Load(), peak.Load(), maxConns)
+	}
+	got := func(name string) int64 { return pythonHTTPCount(name) - before[name] }
+	if got("requests") != requests || got("errors") != 0 {
+		t.Errorf("requests went up by %d and errors by %d, want %d and 0", got("requests"), got("errors"), requests)
+	}
+	if got("conns_new") != opened.Load() || got("conns_new")+got("conns_reused") != requests {
+		t.Errorf("conns_new went up by %d and conns_reused by %d, want %d new of %d", got("conns_new"), got("conns_reused"), opened.Load(), requests)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// POST /api/shorten and /api/shorten/batch honour an Idempotency-Key
+// header. The first request with a key claims it, and its response is kept
+// for IDEMPOTENCY_TTL; a retry with the same key and body gets that response
+// back, marked Idempotent-Replayed, instead of creating another link. A
+// retry with a different body gets 422, and one arriving while the first is
+// still running 409. Keys are per route and caller, anonymous callers by
+// IP. Records live in Redis, or in sqlite while Redis is unavailable; a
+// claim is a SETNX or an insert under the table's primary key, so two
+// requests can never both run. 5xx responses are not kept, so the request
+// can be retried.
+var idempotencyTTL = getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+
+// idempotencyPendingTTL bounds how long the claim of a request that never
+// finished, e.g. because the process died, blocks its key.
+const idempotencyPendingTTL = time.Minute
+
+const (
+	idempotencyKeyPrefix = "idem:"
+	idempotencyMaxKeyLen = 255
+)
+
+// idempotencyRecord is a claimed key: the hash of the request body and,
+// once the first request has finished, its response.
+type idempotencyRecord struct {
+	Fingerprint string `json:"f"`
+	// Status is 0 while the first request is running.
+	Status      int    `json:"s,omitempty"`
+	ContentType string `json:"t,omitempty"`
+	Body        []byte `json:"b,omitempty"`
+}
+
+// idempotencyStore is where a claimed key's record lives.
+type idempotencyStore interface {
+	complete(ctx context.Context, key string, rec idempotencyRecord) error
+	release(ctx context.Context, key string) error
+}
+
+type bufferedResponseWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w bufferedResponseWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w bufferedResponseWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotency runs the request once per Idempotency-Key; see above. It
+// goes after authentication, since keys are per caller.
+func (s *Server) idempotency(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > idempotencyMaxKeyLen {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most " + strconv.Itoa(idempotencyMaxKeyLen) + " characters", "code": "invalid_idempotency_key"})
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+	caller := c.GetString(ownerContextKey)
+	if caller == "" {
+		caller = "ip:" + clientIP(c)
+	}
+	scoped := sha256.Sum256([]byte(c.FullPath() + "\x00" + caller + "\x00" + key))
+	storeKey := hex.EncodeToString(scoped[:])
+
+	ctx := c.Request.Context()
+	store, existing, err := s.claimIdempotencyKey(ctx, storeKey, fingerprint)
+	if err != nil {
+		log.Printf("Error claiming idempotency key: %v", err)
+		if isBusyError(err) {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if existing != nil {
+		switch {
+		case existing.Fingerprint != fingerprint:
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request", "code": "idempotency_key_reused"})
+		case existing.Status == 0:
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress", "code": "idempotency_key_in_progress"})
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(existing.Status, existing.ContentType, existing.Body)
+			c.Abort()
+		}
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	c.Writer = bufferedResponseWriter{ResponseWriter: c.Writer, body: buf}
+	c.Next()
+
+	ctx = context.WithoutCancel(ctx)
+	if status := c.Writer.Status(); status >= 500 {
+		if err := store.release(ctx, storeKey); err != nil {
+			log.Printf("Error releasing idempotency key: %v", err)
+		}
+		return
+	}
+	rec := idempotencyRecord{Fingerprint: fingerprint, Status: c.Writer.Status(), ContentType: c.Writer.Header().Get("Content-Type"), Body: buf.Bytes()}
+	if err := store.complete(ctx, storeKey, rec); err != nil {
+		log.Printf("Error storing idempotent response: %v", err)
+	}
+}
+
+// claimIdempotencyKey claims key for a request with fingerprint. When the
+// key is already claimed it returns the record instead, and no store.
+func (s *Server) claimIdempotencyKey(ctx context.Context, key, fingerprint string) (idempotencyStore, *idempotencyRecord, error) {
+	if s.rdb != nil {
+		claimed, rec, err := s.claimRedisIdempotencyKey(ctx, key, fingerprint)
+		if err == nil && !claimed {
+			return nil, rec, nil
+		}
+		if err == nil {
+			// A record written while Redis was down still counts.
+			rec, err := s.sqliteIdempotencyRecord(ctx, key)
+			if err != nil || rec != nil {
+				s.rdb.Del(ctx, idempotencyKeyPrefix+key)
+				return nil, rec, err
+			}
+			return redisIdempotency{s}, nil, nil
+		}
+		if !redisUnavailable(err) {
+			log.Printf("Error claiming idempotency key in Redis, falling back to sqlite: %v", err)
+		}
+	}
+
+	now := time.Now().UTC()
+	res, err := s.execWithRetry(ctx, `INSERT INTO idempotency_keys (key, fingerprint, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET fingerprint = excluded.fingerprint, status = NULL, content_type = NULL, body = NULL, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at < ?`,
+		key, fingerprint, now.Add(idempotencyPendingTTL).Format(time.RFC3339), now.Format(time.RFC3339))
+	if err != nil {
+		return nil, nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return sqliteIdempotency{s}, nil, nil
+	}
+	rec, err := s.sqliteIdempotencyRecord(ctx, key)
+	if rec == nil && err == nil {
+		rec = &idempotencyRecord{Fingerprint: fingerprint}
+	}
+	return nil, rec, err
+}
+
+type redisIdempotency struct{ s *Server }
+
+// claimRedisIdempotencyKey is claimIdempotencyKey in Redis, returning the
+// record when the key is taken.
+func (s *Server) claimRedisIdempotencyKey(ctx context.Context, key, fingerprint string) (bool, *idempotencyRecord, error) {
+	data, _ := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+	claimed, err := s.rdb.SetNX(ctx, idempotencyKeyPrefix+key, data, idempotencyPendingTTL).Result()
+	if err != nil || claimed {
+		return claimed, nil, err
+	}
+	rec, err := s.redisIdempotencyRecord(ctx, key)
+	if err == redis.Nil {
+		// Released or expired just now: a retry will claim it.
+		return false, &idempotencyRecord{Fingerprint: fingerprint}, nil
+	}
+	return false, rec, err
+}
+
+func (s *Server) redisIdempotencyRecord(ctx context.Context, key string) (*idempotencyRecord, error) {
+	data, err := s.rdb.Get(ctx, idempotencyKeyPrefix+key).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var rec idempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (r redisIdempotency) complete(ctx context.Context, key string, rec idempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return r.s.rdb.Set(ctx, idempotencyKeyPrefix+key, data, idempotencyTTL).Err()
+}
+
+func (r redisIdempotency) release(ctx context.Context, key string) error {
+	return r.s.rdb.Del(ctx, idempotencyKeyPrefix+key).Err()
+}
+
+type sqliteIdempotency struct{ s *Server }
+
+// sqliteIdempotencyRecord returns key's unexpired record, or nil.
+func (s *Server) sqliteIdempotencyRecord(ctx context.Context, key string) (*idempotencyRecord, error) {
+	var rec idempotencyRecord
+	var status sql.NullInt64
+	var contentType sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE key = ? AND expires_at >= ?",
+		key, time.Now().UTC().Format(time.RFC3339)).Scan(&rec.Fingerprint, &status, &contentType, &rec.Body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec.Status, rec.ContentType = int(status.Int64), contentType.String
+	return &rec, nil
+}
+
+func (r sqliteIdempotency) complete(ctx context.Context, key string, rec idempotencyRecord) error {
+	_, err := r.s.execWithRetry(ctx, "UPDATE idempotency_keys SET status = ?, content_type = ?, body = ?, expires_at = ? WHERE key = ?",
+		rec.Status, rec.ContentType, rec.Body, time.Now().Add(idempotencyTTL).UTC().Format(time.RFC3339), key)
+	return err
+}
+
+func (r sqliteIdempotency) release(ctx context.Context, key string) error {
+	_, err := r.s.execWithRetry(ctx, "DELETE FROM idempotency_keys WHERE key = ?", key)
+	return err
+}
+
+// registerIdempotencyKeyReaper deletes expired sqlite records; Redis
+// expires its own.
+func (s *Server) registerIdempotencyKeyReaper() {
+	if resolverOnly {
+		return
+	}
+	app.RegisterBackgroundJob("idempotency_key_reaper", time.Hour, func(ctx context.Context) error {
+		if inMaintenance() {
+			return nil
+		}
+		res, err := s.execWithRetry(ctx, "DELETE FROM idempotency_keys WHERE expires_at < ?", time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Deleted %d expired idempotency keys", n)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	importMaxBytes  = int64(getEnvInt("IMPORT_MAX_BYTES", 10<<20))
+	importMaxRows   = getEnvInt("IMPORT_MAX_ROWS", 10000)
+	importBatchSize = max(getEnvInt("IMPORT_BATCH_SIZE", 500), 1)
+	importWorkers   = getEnvInt("IMPORT_WORKERS", 4)
+)
+
+// importRecord is one link from an external export, mapped onto our fields.
+type importRecord struct {
+	OldURL    string
+	BackHalf  string
+	LongURL   string
+	CreatedAt time.Time
+	Clicks    int64
+}
+
+type importResult struct {
+	OldURL    string `json:"old_url,omitempty"`
+	LongURL   string `json:"long_url"`
+	ShortCode string `json:"short_code,omitempty"`
+	ShortURL  string `json:"short_url,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// importTimeLayouts covers the timestamp shapes seen in shortener exports.
+var importTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseImportTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0)
+	}
+	for _, layout := range importTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// backHalfOf extracts the code part of a foreign short link, e.g. "abc123"
+// from "https://bit.ly/abc123" or "bit.ly/abc123".
+func backHalfOf(link string) string {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return ""
+	}
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(u.Path, "/")
+}
+
+// errTooManyRows stops an import at IMPORT_MAX_ROWS.
+var errTooManyRows = errors.New("too many rows")
+
+// parseCSVImport reads a header-driven CSV, calling emit for each row.
+// columns maps our field names to the header names used by the export
+// format.
+func parseCSVImport(r io.Reader, columns map[string]string, emit func(importRecord) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return errors.New("CSV header missing")
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := index[columns["long_url"]]; !ok {
+		return errors.New("CSV has no " + columns["long_url"] + " column")
+	}
+
+	field := func(row []string, name string) string {
+		i, ok := index[columns[name]]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	for n := 0; ; n++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n >= importMaxRows {
+			return errTooManyRows
+		}
+		clicks, _ := strconv.ParseInt(field(row, "clicks"), 10, 64)
+		link := field(row, "link")
+		backHalf := field(row, "short_code")
+		if backHalf == "" {
+			backHalf = backHalfOf(link)
+		}
+		err = emit(importRecord{
+			OldURL:    link,
+			BackHalf:  backHalf,
+			LongURL:   field(row, "long_url"),
+			CreatedAt: parseImportTime(field(row, "created_at")),
+			Clicks:    clicks,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// bitlyLink is the JSON shape of a Bitly link export entry.
+type bitlyLink struct {
+	Link    string          `json:"link"`
+	LongURL string          `json:"long_url"`
+	Created string          `json:"created"`
+	Tags    []string        `json:"tags"`
+	Clicks  json.RawMessage `json:"clicks"`
+}
+
+// parseBitlyJSON decodes the export array one element at a time.
+func parseBitlyJSON(r io.Reader, emit func(importRecord) error) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return errors.New("invalid Bitly JSON export")
+	}
+	for n := 0; dec.More(); n++ {
+		if n >= importMaxRows {
+			return errTooManyRows
+		}
+		var l bitlyLink
+		if err := dec.Decode(&l); err != nil {
+			return errors.New("invalid Bitly JSON export")
+		}
+		clicks, _ := strconv.ParseInt(strings.Trim(string(l.Clicks), `"`), 10, 64)
+		err := emit(importRecord{
+			OldURL:    l.Link,
+			BackHalf:  backHalfOf(l.Link),
+			LongURL:   l.LongURL,
+			CreatedAt: parseImportTime(l.Created),
+			Clicks:    clicks,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ndjsonLink is our own line-oriented import shape.
+type ndjsonLink struct {
+	ShortCode string `json:"short_code"`
+	LongURL   string `json:"long_url"`
+	CreatedAt string `json:"created_at"`
+	Clicks    int64  `json:"clicks"`
+}
+
+func parseNDJSONImport(r io.Reader, emit func(importRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	n := 0
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if n >= importMaxRows {
+			return errTooManyRows
+		}
+		n++
+		var l ndjsonLink
+		if err := json.Unmarshal(text, &l); err != nil {
+			return errors.New("invalid JSON on line " + strconv.Itoa(line))
+		}
+		err := emit(importRecord{
+			OldURL:    l.ShortCode,
+			BackHalf:  l.ShortCode,
+			LongURL:   l.LongURL,
+			CreatedAt: parseImportTime(l.CreatedAt),
+			Clicks:    l.Clicks,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+var importFormats = []string{"bitly", "csv", "ndjson"}
+
+// parseImport streams the records of an export in the given format to emit,
+// stopping at the first error emit returns.
+func parseImport(format string, r io.Reader, emit func(importRecord) error) error {
+	switch format {
+	case "bitly":
+		// A Bitly export is either a JSON array or a CSV.
+		br := bufio.NewReader(r)
+		for {
+			b, err := br.ReadByte()
+			if err != nil {
+				return errors.New("empty Bitly export")
+			}
+			if !unicode.IsSpace(rune(b)) {
+				br.UnreadByte()
+				break
+			}
+		}
+		if b, _ := br.Peek(1); b[0] == '[' {
+			return parseBitlyJSON(br, emit)
+		}
+		return parseCSVImport(br, map[string]string{
+			"link": "link", "long_url": "long_url", "created_at": "created", "clicks": "clicks",
+		}, emit)
+	case "csv":
+		return parseCSVImport(r, map[string]string{
+			"short_code": "short_code", "long_url": "long_url", "created_at": "created_at", "clicks": "clicks",
+		}, emit)
+	case "ndjson":
+		return parseNDJSONImport(r, emit)
+	}
+	return errors.New("format must be one of bitly, csv, ndjson")
+}
+
+// importItem is a record after validation; failed holds why it can't be
+// imported, "" when it can.
+type importItem struct {
+	rec    importRecord
+	failed string
+}
+
+func validateImportRecord(rec importRecord) importItem {
+	if rec.LongURL == "" {
+		return importItem{rec: rec, failed: "long_url is empty"}
+	}
+	longURL, err := normalizeLongURL(rec.LongURL)
+	if err != nil {
+		return importItem{rec: rec, failed: err.Error()}
+	}
+	rec.LongURL = longURL
+	return importItem{rec: rec}
+}
+
+// importLink inserts one validated record with insert, claiming its
+// original back-half when it is free and falling back to a generated code
+// otherwise.
+func importLink(item importItem, insert func(code string, rec importRecord) error) importResult {
+	rec := item.rec
+	result := importResult{OldURL: rec.OldURL, LongURL: rec.LongURL}
+	if item.failed != "" {
+		result.Status = "failed"
+		result.Error = item.failed
+		return result
+	}
+
+	if shortCodePattern.MatchString(rec.BackHalf) && !reservedCodes[rec.BackHalf] {
+		err := insert(rec.BackHalf, rec)
+		if err == nil {
+			result.ShortCode = rec.BackHalf
+			result.Status = "claimed"
+			return result
+		}
+		if !isUniqueViolation(err) {
+			result.Status = "failed"
+			result.Error = "Database error"
+			return result
+		}
+	}
+
+	for range shortCodeAttempts {
+		code, err := generateShortCode()
+		if err != nil {
+			break
+		}
+		err = insert(code, rec)
+		recordShortCodeDraw(isUniqueViolation(err))
+		if err == nil {
+			result.ShortCode = code
+			result.Status = "generated"
+			return result
+		}
+		if !isUniqueViolation(err) {
+			break
+		}
+	}
+	result.Status = "failed"
+	result.Error = "Failed to create short URL"
+	return result
+}
+
+// writeImportBatch imports a batch in one transaction, recording each
+// result in import_mappings alongside the link.
+func (s *Server) writeImportBatch(ctx context.Context, importID string, batch []importItem) ([]importResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	insertURL, err := tx.PrepareContext(ctx, "INSERT INTO urls (short_code, long_url, created_at, imported_clicks, canonical_hash, destination_host) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+	defer insertURL.Close()
+	insertMapping, err := tx.PrepareContext(ctx, `INSERT INTO import_mappings (import_id, old_url, long_url, short_code, status, error)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer insertMapping.Close()
+
+	releaseReservation, err := tx.PrepareContext(ctx, "DELETE FROM code_reservations WHERE short_code = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer releaseReservation.Close()
+
+	// A failed insert is rolled back on its own, so the batch goes on.
+	insert := func(code string, rec importRecord) error {
+		return inSavepoint(ctx, tx, func() error {
+			// A record whose old back-half is a pregenerated code attaches
+			// its destination to it.
+			if code == rec.BackHalf {
+				if _, err := releaseReservation.ExecContext(ctx, code); err != nil {
+					return err
+				}
+			}
+			createdAt := rec.CreatedAt
+			if createdAt.IsZero() {
+				createdAt = time.Now()
+			}
+			_, err := insertURL.ExecContext(ctx, code, rec.LongURL, createdAt.UTC().Format("2006-01-02 15:04:05"), rec.Clicks,
+				globalCanonicalProfile.hash(rec.LongURL), destinationHost(rec.LongURL))
+			return err
+		})
+	}
+	results := make([]importResult, 0, len(batch))
+	for _, item := range batch {
+		res := importLink(item, insert)
+		if _, err := insertMapping.ExecContext(ctx, importID, res.OldURL, res.LongURL, res.ShortCode, res.Status, res.Error); err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	var codes []string
+	for _, res := range results {
+		if res.Status == "claimed" || res.Status == "generated" {
+			codes = append(codes, res.ShortCode)
+		}
+	}
+	s.forgetNotFound(ctx, codes...)
+	return results, nil
+}
+
+// importLinks serves POST /api/import. The body is streamed through a
+// bounded pipeline (parser, IMPORT_WORKERS validators, a writer committing
+// IMPORT_BATCH_SIZE rows per transaction), so memory stays flat however
+// large the file and a slow database slows the upload instead of buffering
+// it. If the client goes away, the batch in hand is committed and the
+// import stops there; the report has exactly the rows that were written.
+//
+// With ?progress=true the response is NDJSON: a progress frame after each
+// batch, then a done or error frame. Otherwise it is one JSON object with
+// every row's result, as before. Rows written before a parse error are
+// kept either way.
+func (s *Server) importLinks(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if !slices.Contains(importFormats, format) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of bitly, csv, ndjson"})
+		return
+	}
+	progress := c.Query("progress") == "true"
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, importMaxBytes)
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	records := make(chan importRecord, importBatchSize)
+	items := make(chan importItem, importBatchSize)
+	parsed := make(chan error, 1)
+	go func() {
+		defer close(records)
+		parsed <- parseImport(format, body, func(rec importRecord) error {
+			select {
+			case records <- rec:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	var workers sync.WaitGroup
+	for range max(importWorkers, 1) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for rec := range records {
+				select {
+				case items <- validateImportRecord(rec):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(items)
+	}()
+
+	importID := newRandomID()
+	frames := json.NewEncoder(c.Writer)
+	if progress {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Cache-Control", "no-store")
+		c.Status(http.StatusOK)
+	}
+
+	// Writes outlive a cancelled request so the last batch lands whole.
+	writeCtx := context.WithoutCancel(ctx)
+	var results []importResult
+	counts := map[string]int{}
+	base := publicBaseURL(c)
+	batch := make([]importItem, 0, importBatchSize)
+	flush := func() error {
+		written, err := s.writeImportBatch(writeCtx, importID, batch)
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
+		for i, res := range written {
+			counts[res.Status]++
+			if res.ShortCode != "" {
+				written[i].ShortURL = shortURLFor(base, res.ShortCode)
+			}
+		}
+		if progress {
+			frames.Encode(gin.H{"type": "progress", "processed": importedRows(counts), "failed": counts["failed"]})
+			c.Writer.Flush()
+		} else {
+			results = append(results, written...)
+		}
+		return nil
+	}
+
+	var err error
+	for item := range items {
+		batch = append(batch, item)
+		if len(batch) == importBatchSize {
+			if err = flush(); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	if err != nil {
+		// Stop the parser and validators; the upload itself is abandoned.
+		cancel()
+		log.Printf("Import %s failed writing to the database: %v", importID, err)
+		importFailed(c, progress, frames, http.StatusInternalServerError, "Database error", importID, counts)
+		return
+	}
+
+	summary := gin.H{
+		"import_id":  importID,
+		"claimed":    counts["claimed"],
+		"generated":  counts["generated"],
+		"failed":     counts["failed"],
+		"report_url": "/api/import/" + importID + "/report",
+	}
+	if c.Request.Context().Err() != nil {
+		log.Printf("Import %s (%s) cancelled by the client after %d rows", importID, format, importedRows(counts))
+		return
+	}
+	if parseErr := <-parsed; parseErr != nil {
+		status, message := http.StatusBadRequest, parseErr.Error()
+		var tooLarge *http.MaxBytesError
+		if errors.As(parseErr, &tooLarge) {
+			status, message = http.StatusRequestEntityTooLarge, "Import file too large"
+		}
+		log.Printf("Import %s (%s) stopped: %v", importID, format, parseErr)
+		importFailed(c, progress, frames, status, message, importID, counts)
+		return
+	}
+
+	log.Printf("Import %s (%s): %d claimed, %d generated, %d failed",
+		importID, format, counts["claimed"], counts["generated"], counts["failed"])
+	if progress {
+		summary["type"] = "done"
+		frames.Encode(summary)
+		return
+	}
+	if results == nil {
+		results = []importResult{}
+	}
+	summary["results"] = results
+	c.JSON(http.StatusOK, summary)
+}
+
+// importedRows is how many rows an import has written, whatever their
+// status.
+func importedRows(counts map[string]int) int {
+	return counts["claimed"] + counts["generated"] + counts["failed"]
+}
+
+// importFailed reports an import that stopped early, with what it wrote
+// before stopping. Nothing is reported when no row was written.
+func importFailed(c *gin.Context, progress bool, frames *json.Encoder, status int, message, importID string, counts map[string]int) {
+	response := gin.H{"error": message}
+	if importedRows(counts) > 0 {
+		response["import_id"] = importID
+		response["claimed"], response["generated"], response["failed"] = counts["claimed"], counts["generated"], counts["failed"]
+		response["report_url"] = "/api/import/" + importID + "/report"
+	}
+	if progress {
+		response["type"] = "error"
+		frames.Encode(response)
+		return
+	}
+	c.JSON(status, response)
+}
+
+// importReport downloads the old -> new mapping for an import as CSV so
+// customers can set up their own redirects.
+func (s *Server) importReport(c *gin.Context) {
+	importID := c.Param("id")
+	rows, err := s.db.QueryContext(c.Request.Context(), `SELECT old_url, long_url, short_code, status, error
+		FROM import_mappings WHERE import_id = ? ORDER BY id`, importID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	base := publicBaseURL(c)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"old_url", "long_url", "short_code", "short_url", "status", "error"})
+	n := 0
+	for rows.Next() {
+		var oldURL, longURL, code, status, errMsg string
+		if err := rows.Scan(&oldURL, &longURL, &code, &status, &errMsg); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		shortURL := ""
+		if code != "" {
+			shortURL = shortURLFor(base, code)
+		}
+		w.Write([]string{oldURL, longURL, code, shortURL, status, errMsg})
+		n++
+	}
+	w.Flush()
+
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import not found"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="import-`+importID+`.csv"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newImportServer opens a server on its own database, so the rows a large
+// import writes don't slow every other test.
+func newImportServer(tb testing.TB) *Server {
+	tb.Helper()
+	s, err := NewServer(Config{DatabaseURL: filepath.Join(tb.TempDir(), "import.db")})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
+
+// withImportLimits sets IMPORT_MAX_ROWS and IMPORT_MAX_BYTES for the rest
+// of the test.
+func withImportLimits(tb testing.TB, rows int, bytes int64) {
+	savedRows, savedBytes := importMaxRows, importMaxBytes
+	importMaxRows, importMaxBytes = rows, bytes
+	tb.Cleanup(func() { importMaxRows, importMaxBytes = savedRows, savedBytes })
+}
+
+// syntheticCSV generates an import of n rows as it is read, so the file
+// itself never sits in memory. Every 100th row has a bad URL.
+type syntheticCSV struct {
+	n, row int
+	buf    []byte
+	read   atomic.Int64
+}
+
+func newSyntheticCSV(n int) *syntheticCSV {
+	return &syntheticCSV{n: n, buf: []byte("short_code,long_url,created_at,clicks\n")}
+}
+
+func (f *syntheticCSV) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.row == f.n {
+			return 0, io.EOF
+		}
+		long := "https://example.com/synthetic/" + strconv.Itoa(f.row)
+		if f.row%100 == 99 {
+			long = "not a url"
+		}
+		f.buf = fmt.Appendf(f.buf, "imp%07d,%s,2024-01-02 03:04:05,%d\n", f.row, long, f.row%7)
+		f.row++
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	f.read.Add(int64(n))
+	return n, nil
+}
+
+type importFrame struct {
+	Type      string
+	Processed int
+	Failed    int
+	Claimed   int
+	Generated int
+	Error     string
+}
+
+func readImportFrames(t *testing.T, body io.Reader) []importFrame {
+	t.Helper()
+	var frames []importFrame
+	sc := bufio.NewScanner(body)
+	for sc.Scan() {
+		var f importFrame
+		if err := json.Unmarshal(sc.Bytes(), &f); err != nil {
+			t.Fatalf("frame %q: %v", sc.Text(), err)
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// TestImportLargeFileInBoundedMemory streams a few hundred thousand rows
+// and samples the heap all along: it must stay flat, not grow with the file.
+func TestImportLargeFileInBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("imports 200000 rows")
+	}
+	const rows = 200000
+	s := newImportServer(t)
+	withImportLimits(t, rows, 1<<30)
+	r := s.newRouter()
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	var sampler sync.WaitGroup
+	sampler.Add(1)
+	go func() {
+		defer sampler.Done()
+		tick := time.NewTicker(20 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				if m.HeapInuse > peak.Load() {
+					peak.Store(m.HeapInuse)
+				}
+			}
+		}
+	}()
+
+	file := newSyntheticCSV(rows)
+	req := httptest.NewRequest(http.MethodPost, "/api/import?format=csv&progress=true", file)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	close(done)
+	sampler.Wait()
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("import = %d, %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	frames := readImportFrames(t, w.Body)
+	if len(frames) != rows/importBatchSize+1 {
+		t.Fatalf("%d frames, want a progress frame per batch of %d and a done frame", len(frames), importBatchSize)
+	}
+	for i, f := range frames[:len(frames)-1] {
+		if f.Type != "progress" || f.Processed != (i+1)*importBatchSize || f.Failed > f.Processed {
+			t.Fatalf("frame %d = %+v", i, f)
+		}
+	}
+	last := frames[len(frames)-1]
+	if last.Type != "done" || last.Claimed != rows-rows/100 || last.Failed != rows/100 {
+		t.Errorf("done frame = %+v", last)
+	}
+	var stored int
+	s.db.QueryRow("SELECT COUNT(*) FROM urls").Scan(&stored)
+	if stored != rows-rows/100 {
+		t.Errorf("%d links stored, want %d", stored, rows-rows/100)
+	}
+
+	// The file alone is close to the bound; an import keeping every row's
+	// result, as the plain JSON response does, grows several times past it.
+	const bound = 16 << 20
+	if grew := int64(peak.Load()) - int64(baseline); grew > bound {
+		t.Errorf("heap grew by %d MB importing a %d MB file, want under %d MB", grew>>20, file.read.Load()>>20, bound>>20)
+	}
+}
+
+// cancelAfter cancels the request once n bytes of it were read, as a client
+// disconnecting mid-upload does.
+type cancelAfter struct {
+	r      io.Reader
+	n      int64
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfter) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		c.cancel()
+		return 0, context.Canceled
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	return n, err
+}
+
+func TestImportCancelledStopsAtBatchBoundary(t *testing.T) {
+	const rows = 20000
+	s := newImportServer(t)
+	withImportLimits(t, rows, 1<<30)
+	r := s.newRouter()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := &cancelAfter{r: newSyntheticCSV(rows), n: 256 << 10, cancel: cancel}
+	req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/api/import?format=csv&progress=true", body)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	frames := readImportFrames(t, w.Body)
+	if len(frames) == 0 {
+		t.Fatal("no progress before the client went away")
+	}
+	for i, f := range frames {
+		if f.Type != "progress" {
+			t.Fatalf("frame %d = %+v; a cancelled import ends without a done or error frame", i, f)
+		}
+		if i < len(frames)-1 && f.Processed != (i+1)*importBatchSize {
+			t.Errorf("frame %d processed %d, want %d", i, f.Processed, (i+1)*importBatchSize)
+		}
+	}
+	processed := frames[len(frames)-1].Processed
+	if processed >= rows {
+		t.Fatalf("processed %d rows, want the import cut short", processed)
+	}
+
+	// Each batch commits whole: what was reported is exactly what is stored,
+	// the mappings included.
+	var links, mappings int
+	s.db.QueryRow("SELECT COUNT(*) FROM urls").Scan(&links)
+	s.db.QueryRow("SELECT COUNT(*) FROM import_mappings").Scan(&mappings)
+	if mappings != processed || links != processed-frames[len(frames)-1].Failed {
+		t.Errorf("stored %d links and %d mappings, want %d rows as reported", links, mappings, processed)
+	}
+}
+
+type exportLine struct {
+	Type   string
+	ID     int64
+	Rows   int
+	Cursor string
+}
+
+func TestClickExportResumesFromCursor(t *testing.T) {
+	const clicks = 2500
+	s := newImportServer(t)
+	r := s.newRouter()
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := range clicks {
+		// Clicks arrive out of order; the export is in clicked_at order.
+		at := base.Add(time.Duration((i*7919)%clicks) * time.Second)
+		if _, err := tx.Exec("INSERT INTO clicks (short_code, clicked_at) VALUES (?, ?)", "exp", at.Format(time.RFC3339)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	export := func(query string) (rows []int64, frames []exportLine) {
+		t.Helper()
+		w := serveTest(r, http.MethodGet, "/admin/export/clicks?from=2024-03-01&to=2024-03-02&progress=true"+query, "", "Authorization: Bearer "+testAdminToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("export %s = %d: %s", query, w.Code, w.Body)
+		}
+		for line := range strings.Lines(w.Body.String()) {
+			var l exportLine
+			json.Unmarshal([]byte(line), &l)
+			if l.Type == "" {
+				rows = append(rows, l.ID)
+			} else {
+				frames = append(frames, l)
+			}
+		}
+		return rows, frames
+	}
+
+	all, frames := export("")
+	if len(all) != clicks || len(frames) != 3 || frames[0].Type != "progress" || frames[0].Rows != clickExportPageSize || frames[2].Type != "done" {
+		t.Fatalf("full export: %d rows, frames %+v", len(all), frames)
+	}
+	// Resuming from the first frame's cursor gives exactly the rest.
+	rest, frames := export("&cursor=" + frames[0].Cursor)
+	if len(rest) != clicks-clickExportPageSize || frames[len(frames)-1].Type != "done" {
+		t.Fatalf("resumed export: %d rows, frames %+v", len(rest), frames)
+	}
+	for i, id := range rest {
+		if all[clickExportPageSize+i] != id {
+			t.Fatalf("resumed row %d is click %d, want %d", i, id, all[clickExportPageSize+i])
+		}
+	}
+
+	for _, query := range []string{"&cursor=abc", "&cursor=999999", "&format=csv"} {
+		if w := serveTest(r, http.MethodGet, "/admin/export/clicks?progress=true"+query, "", "Authorization: Bearer "+testAdminToken); w.Code != http.StatusBadRequest {
+			t.Errorf("export %s = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits for the self-hosted event ingestion endpoints.
+var (
+	eventIngestMaxBytes = int64(getEnvInt("EVENT_INGEST_MAX_BYTES", 1<<20))
+	eventIngestMaxBatch = getEnvInt("EVENT_INGEST_MAX_BATCH", 1000)
+)
+
+const maxShortCodeLen = 64
+
+// newRandomID returns a random 128-bit hex identifier.
+func newRandomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// readEventBody reads a capped, optionally gzip-encoded request body and
+// verifies its service signature.
+func readEventBody(c *gin.Context) ([]byte, int, error) {
+	if serviceSigningSecret == "" {
+		return nil, http.StatusForbidden, errors.New("Event ingestion requires SERVICE_SIGNING_SECRET")
+	}
+	body, status, err := readCappedBody(c)
+	if err != nil {
+		return nil, status, err
+	}
+	if err := verifyServiceRequest(c.GetHeader(SignatureHeader), body); err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	return body, http.StatusOK, nil
+}
+
+// readIngestBody is readEventBody for the event ingestion endpoints, which
+// also take an API key from a sender that doesn't sign. A signature, when
+// present, is checked instead of the key.
+func (s *Server) readIngestBody(c *gin.Context) ([]byte, int, error) {
+	key, ok := apiKeyFromRequest(c)
+	if !ok || c.GetHeader(SignatureHeader) != "" {
+		return readEventBody(c)
+	}
+	k, err := s.verifyAPIKey(c.Request.Context(), key)
+	if errors.Is(err, errInvalidAPIKey) {
+		log.Printf("Rejected API key from %s", clientIP(c))
+		return nil, http.StatusUnauthorized, errors.New("Invalid API key")
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("Database error")
+	}
+	recordAPICall(c, k.ID)
+	return readCappedBody(c)
+}
+
+// readCappedBody reads a request body of at most eventIngestMaxBytes,
+// decompressed if it is gzip-encoded.
+func readCappedBody(c *gin.Context) ([]byte, int, error) {
+	var reader io.Reader = http.MaxBytesReader(c.Writer, c.Request.Body, eventIngestMaxBytes)
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("Invalid gzip body")
+		}
+		defer zr.Close()
+		// Cap the decompressed size too, so a small bomb can't expand freely.
+		reader = io.LimitReader(zr, eventIngestMaxBytes+1)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, http.StatusRequestEntityTooLarge, errors.New("Payload too large")
+		}
+		return nil, http.StatusBadRequest, errors.New("Invalid request body")
+	}
+	if int64(len(body)) > eventIngestMaxBytes {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("Payload too large")
+	}
+	return body, http.StatusOK, nil
+}
+
+func validateClickEvent(event *ClickEvent) error {
+	if event.ShortCode == "" || len(event.ShortCode) > maxShortCodeLen {
+		return errors.New("short_code is required")
+	}
+	if len(event.ClickID) > maxShortCodeLen {
+		return errors.New("click_id is too long")
+	}
+	if event.RequestID != "" && !requestIDPattern.MatchString(event.RequestID) {
+		return errors.New("request_id is invalid")
+	}
+	if _, err := time.Parse(time.RFC3339, event.ClickedAt); err != nil {
+		return errors.New("clicked_at must be RFC3339")
+	}
+	if event.Country != "" && !countryCodePattern.MatchString(event.Country) {
+		return errors.New("country must be an ISO 3166 country code")
+	}
+	if len(event.City) > maxGeoCityLen {
+		return errors.New("city is too long")
+	}
+	return nil
+}
+
+// storeClickEvent inserts and counts a click, ignoring duplicates by
+// click_id and self-test events. It reports whether a new row was written.
+func (s *Server) storeClickEvent(ctx context.Context, event ClickEvent) (bool, error) {
+	if event.IsTest {
+		return false, nil
+	}
+	var clickID any
+	if event.ClickID != "" {
+		clickID = event.ClickID
+	}
+	res, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO clicks (click_id, short_code, clicked_at, country, city) VALUES (?, ?, ?, ?, ?)",
+		clickID, event.ShortCode, event.ClickedAt, nullIfEmpty(event.Country), nullIfEmpty(event.City))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		clickedAt, _ := time.Parse(time.RFC3339, event.ClickedAt)
+		s.countClick(ctx, event.ShortCode, clickedAt)
+		clickRollups.add(event.ShortCode, event.Country, clickedAt, 1)
+	}
+	return n > 0, nil
+}
+
+func (s *Server) ingestEvent(c *gin.Context) {
+	body, status, err := s.readIngestBody(c)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	var event ClickEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event data"})
+		return
+	}
+	if err := validateClickEvent(&event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := s.storeClickEvent(c.Request.Context(), event); err != nil {
+		log.Printf("Error storing ingested event: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func (s *Server) ingestEventBatch(c *gin.Context) {
+	body, status, err := s.readIngestBody(c)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	var events []ClickEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event batch"})
+		return
+	}
+	if len(events) > eventIngestMaxBatch {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Too many events in batch"})
+		return
+	}
+
+	processed, duplicates, invalid := 0, 0, 0
+	for i := range events {
+		if validateClickEvent(&events[i]) != nil {
+			invalid++
+			continue
+		}
+		inserted, err := s.storeClickEvent(c.Request.Context(), events[i])
+		if err != nil {
+			log.Printf("Error storing ingested event: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if inserted {
+			processed++
+		} else {
+			duplicates++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"processed":  processed,
+		"duplicates": duplicates,
+		"invalid":    invalid,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withServiceSigningSecret sets the service signing secret for the rest of
+// the test, "" for none.
+func withServiceSigningSecret(tb testing.TB, secret string) {
+	saved, savedPrevious := serviceSigningSecret, serviceSigningSecretPrevious
+	serviceSigningSecret, serviceSigningSecretPrevious = secret, ""
+	tb.Cleanup(func() { serviceSigningSecret, serviceSigningSecretPrevious = saved, savedPrevious })
+}
+
+func TestIngestEventAuth(t *testing.T) {
+	_, key := newTestAPIKey(t, false)
+	r := testServer.newRouter()
+	event := func(clickID string) string {
+		return `{"short_code":"ingest-auth","click_id":"` + clickID + `","clicked_at":"` + time.Now().UTC().Format(time.RFC3339) + `"}`
+	}
+	sign := func(body string) string {
+		return SignatureHeader + ": " + SignPayload("whsec_ingest", time.Now(), []byte(body))
+	}
+
+	for _, tt := range []struct {
+		name   string
+		secret string
+		target string
+		// headers builds the request's headers for its body.
+		headers func(body string) []string
+		want    int
+	}{
+		{"signed", "whsec_ingest", "/api/events", func(b string) []string { return []string{sign(b)} }, http.StatusOK},
+		{"signed batch", "whsec_ingest", "/api/events/batch", func(b string) []string { return []string{sign(b)} }, http.StatusOK},
+		{"signed with another secret", "whsec_other", "/api/events", func(b string) []string { return []string{sign(b)} }, http.StatusUnauthorized},
+		{"API key", "whsec_ingest", "/api/events", func(string) []string { return []string{"X-API-Key: " + key} }, http.StatusOK},
+		{"API key as a bearer token", "whsec_ingest", "/api/events", func(string) []string { return []string{"Authorization: Bearer " + key} }, http.StatusOK},
+		{"API key batch", "whsec_ingest", "/api/events/batch", func(string) []string { return []string{"X-API-Key: " + key} }, http.StatusOK},
+		{"API key without a secret configured", "", "/api/events", func(string) []string { return []string{"X-API-Key: " + key} }, http.StatusOK},
+		{"unknown API key", "whsec_ingest", "/api/events", func(string) []string { return []string{"X-API-Key: ak_unknown.secret"} }, http.StatusUnauthorized},
+		{"bad signature with a valid key", "whsec_ingest", "/api/events", func(string) []string {
+			return []string{"X-API-Key: " + key, SignatureHeader + ": t=1700000000,v1=00"}
+		}, http.StatusUnauthorized},
+		{"neither", "whsec_ingest", "/api/events", func(string) []string { return nil }, http.StatusUnauthorized},
+		{"neither without a secret configured", "", "/api/events", func(string) []string { return nil }, http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			withServiceSigningSecret(t, tt.secret)
+			clickID := newRandomID()
+			body := event(clickID)
+			if tt.target == "/api/events/batch" {
+				body = "[" + body + "]"
+			}
+			w := serveTest(r, http.MethodPost, tt.target, body, tt.headers(body)...)
+			if w.Code != tt.want {
+				t.Fatalf("ingest = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			var stored int
+			if err := testServer.db.QueryRow("SELECT COUNT(*) FROM clicks WHERE click_id = ?", clickID).Scan(&stored); err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.want == http.StatusOK; (stored == 1) != want {
+				t.Errorf("%d clicks stored, want one stored: %v", stored, want)
+			}
+		})
+	}
+}
+
+func TestScanResultsRequireSignature(t *testing.T) {
+	withServiceSigningSecret(t, "whsec_ingest")
+	_, key := newTestAPIKey(t, true)
+	w := serveTest(testServer.newRouter(), http.MethodPost, "/api/scan-results", `{"short_code":"abc","verdict":"clean"}`, "X-API-Key: "+key)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("scan result with only an API key = %d, want 401: %s", w.Code, w.Body)
+	}
+}
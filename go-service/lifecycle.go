@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// lifecycleChannel carries link lifecycle events, separate from the click
+// stream so click consumers don't have to filter them out.
+const lifecycleChannel = "url_events"
+
+// Lifecycle event types.
+const (
+	eventURLCreated   = "url_created"
+	eventURLActivated = "url_activated"
+	eventURLDeleted   = "url_deleted"
+	// eventURLExpiringSoon is sent once per expiry, EXPIRY_WARNING_BEFORE
+	// ahead of it; see expiry.go.
+	eventURLExpiringSoon = "url_expiring_soon"
+	// eventQuotaWarning is sent to an owner nearing a quota, once per
+	// threshold and period; see quota.go. It is about no link.
+	eventQuotaWarning = "quota_warning"
+	// eventConversion is sent for each conversion the pixel records; see
+	// pixel.go.
+	eventConversion = "conversion"
+)
+
+type LifecycleEvent struct {
+	EventID    string `json:"event_id"`
+	Type       string `json:"type"`
+	ShortCode  string `json:"short_code"`
+	OccurredAt string `json:"occurred_at"`
+	// ExpiresAt is set on url_expiring_soon.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// Owner and Quota are set on quota_warning.
+	Owner string        `json:"owner,omitempty"`
+	Quota *QuotaWarning `json:"quota,omitempty"`
+	// Conversion is set on conversion.
+	Conversion *Conversion `json:"conversion,omitempty"`
+}
+
+// publishLifecycleEvent hands the event to the webhooks and to s.events.
+func (s *Server) publishLifecycleEvent(ctx context.Context, eventType, shortCode string) {
+	s.publishLifecycle(ctx, LifecycleEvent{Type: eventType, ShortCode: shortCode})
+}
+
+// publishLifecycle publishes event, giving it an ID and time.
+func (s *Server) publishLifecycle(ctx context.Context, event LifecycleEvent) {
+	event.EventID = newRandomID()
+	event.OccurredAt = time.Now().UTC().Format(time.RFC3339)
+	if event.Type == eventQuotaWarning {
+		log.Printf("Lifecycle event %s for owner %s", event.Type, event.Owner)
+	} else {
+		log.Printf("Lifecycle event %s for %s", event.Type, event.ShortCode)
+	}
+	notifyWebhooks(event.Type, event.EventID, event.ShortCode, event)
+	s.events.PublishLifecycle(ctx, event)
+}
+
+// linkActive reports whether a link with the given active_from is live at
+// now. Links without active_from are always live.
+func linkActive(activeFrom sql.NullString, now time.Time) bool {
+	if !activeFrom.Valid {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, activeFrom.String)
+	if err != nil {
+		return true
+	}
+	return !now.Before(t)
+}
+
+// markActivated flips the activated flag once and fires url_activated for
+// the caller that won the update. In maintenance mode the flag stays unset
+// and a later redirect fires the event.
+func (s *Server) markActivated(ctx context.Context, shortCode string) {
+	if inMaintenance() {
+		return
+	}
+	activated, err := s.store.MarkActivated(ctx, shortCode)
+	if err != nil {
+		log.Printf("Error marking %s activated: %v", shortCode, err)
+		return
+	}
+	if activated {
+		s.publishLifecycleEvent(ctx, eventURLActivated, shortCode)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notes and metadata are context teams attach to links: a ticket number, an
+// owner's email, an internal campaign ID. They are shown only to the link's
+// owner, and redirects, the change feed and public stats never read them.
+var (
+	linkNotesMaxLen         = getEnvInt("LINK_NOTES_MAX_LENGTH", 2000)
+	linkMetadataMaxKeys     = getEnvInt("LINK_METADATA_MAX_KEYS", 20)
+	linkMetadataMaxValueLen = getEnvInt("LINK_METADATA_MAX_VALUE_LENGTH", 256)
+)
+
+// metadataKeyPattern keeps keys usable as ?meta.<key>= list filters.
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+var errTooManyMetadataKeys = errors.New("too many metadata keys")
+
+type linkAnnotations struct {
+	Notes    string
+	Metadata map[string]string
+}
+
+// sqlQueryer is a *sql.DB or a *sql.Tx.
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func validateNotes(notes string) error {
+	if utf8.RuneCountInString(notes) > linkNotesMaxLen {
+		return fmt.Errorf("notes must be at most %d characters", linkNotesMaxLen)
+	}
+	return nil
+}
+
+func validateMetadataEntry(key, value string) error {
+	if !metadataKeyPattern.MatchString(key) {
+		return fmt.Errorf("metadata key %q must be 1-64 letters, digits, '_', '.' or '-'", key)
+	}
+	if utf8.RuneCountInString(value) > linkMetadataMaxValueLen {
+		return fmt.Errorf("metadata value for %q must be at most %d characters", key, linkMetadataMaxValueLen)
+	}
+	return nil
+}
+
+// validateLinkAnnotations checks the notes and metadata of a new link.
+func validateLinkAnnotations(notes string, metadata map[string]string) error {
+	if err := validateNotes(notes); err != nil {
+		return err
+	}
+	if len(metadata) > linkMetadataMaxKeys {
+		return fmt.Errorf("metadata may have at most %d keys", linkMetadataMaxKeys)
+	}
+	for key, value := range metadata {
+		if err := validateMetadataEntry(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertLinkMetadata stores the metadata of a link created in tx.
+func insertLinkMetadata(ctx context.Context, tx *sql.Tx, shortCode string, metadata map[string]string) error {
+	for key, value := range metadata {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO link_metadata (short_code, key, value) VALUES (?, ?, ?)", shortCode, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadLinkMetadata returns a link's metadata, empty if it has none.
+func loadLinkMetadata(ctx context.Context, q sqlQueryer, shortCode string) (map[string]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT key, value FROM link_metadata WHERE short_code = ?", shortCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	metadata := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		metadata[key] = value
+	}
+	return metadata, rows.Err()
+}
+
+// patchURL serves PATCH /api/urls/:code, which edits a link's notes,
+// metadata and status, and renames it. notes replaces the notes, ""
+// clearing them; metadata is merged into the existing keys, a null value
+// removing its key; status pauses the link with "disabled" and re-enables
+// it with "active"; short_code moves the link to a new code, keeping the
+// old one as an alias (see aliases.go). Only admins may set or lift
+// "legal_block", or rename a blocked link. Deleted links can't be edited.
+// Only the link's owner, or an admin, may edit it. What changed is written
+// to the audit log.
+func (s *Server) patchURL(c *gin.Context) {
+	shortCode := c.Param("code")
+	var req struct {
+		Notes    *string            `json:"notes"`
+		Metadata map[string]*string `json:"metadata"`
+		Status   *string            `json:"status"`
+		// ShortCode renames the link.
+		ShortCode *string `json:"short_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	admin := s.isAdminCaller(c)
+	if req.Status != nil && *req.Status != linkStatusActive && *req.Status != linkStatusDisabled && *req.Status != linkStatusLegalBlock {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be active, disabled or legal_block"})
+		return
+	}
+	if req.Status != nil && *req.Status == linkStatusLegalBlock && !admin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins may set legal_block", "code": "admin_only"})
+		return
+	}
+	if req.Notes != nil {
+		if err := validateNotes(*req.Notes); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	for key, value := range req.Metadata {
+		if value == nil {
+			continue
+		}
+		if err := validateMetadataEntry(key, *value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	rename := req.ShortCode != nil && *req.ShortCode != shortCode
+	if rename {
+		if err := validateCode("short_code", *req.ShortCode); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	owner := c.GetString(ownerContextKey)
+	if rename {
+		s.flushLinkCounts(ctx)
+	}
+	var before, after linkAnnotations
+	var statusBefore, statusAfter string
+	newCode := shortCode
+	err := s.txWithRetry(ctx, func(tx *sql.Tx) error {
+		code := shortCode
+		var linkOwner, notes sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT owner, notes, status FROM urls WHERE short_code = ? AND is_test = 0", code).Scan(&linkOwner, &notes, &statusBefore)
+		if err == nil && !admin && (!linkOwner.Valid || linkOwner.String != owner) {
+			err = sql.ErrNoRows
+		}
+		if err != nil {
+			return err
+		}
+		if statusBefore == linkStatusDeleted {
+			return errLinkDeleted
+		}
+		if rename {
+			if statusBefore == linkStatusLegalBlock && !admin {
+				return errLegalBlock
+			}
+			if err := renameLinkTx(ctx, tx, code, *req.ShortCode, time.Now()); err != nil {
+				return err
+			}
+			code = *req.ShortCode
+		}
+		newCode = code
+		statusAfter = statusBefore
+		if req.Status != nil && *req.Status != statusBefore {
+			if statusBefore == linkStatusLegalBlock && !admin {
+				return errLegalBlock
+			}
+			statusAfter = *req.Status
+			if _, err := tx.ExecContext(ctx, "UPDATE urls SET status = ?, status_changed_at = datetime(), legal_blocked = CASE WHEN ? = 1 THEN 1 ELSE legal_blocked END WHERE short_code = ?",
+				statusAfter, statusAfter == linkStatusLegalBlock, code); err != nil {
+				return err
+			}
+		}
+		metadata, err := loadLinkMetadata(ctx, tx, code)
+		if err != nil {
+			return err
+		}
+		before = linkAnnotations{Notes: notes.String, Metadata: metadata}
+		after = linkAnnotations{Notes: notes.String, Metadata: maps.Clone(metadata)}
+
+		if req.Notes != nil {
+			after.Notes = *req.Notes
+			if _, err := tx.ExecContext(ctx, "UPDATE urls SET notes = ? WHERE short_code = ?", nullIfEmpty(*req.Notes), code); err != nil {
+				return err
+			}
+		}
+		for key, value := range req.Metadata {
+			if value == nil {
+				delete(after.Metadata, key)
+				_, err = tx.ExecContext(ctx, "DELETE FROM link_metadata WHERE short_code = ? AND key = ?", code, key)
+			} else {
+				after.Metadata[key] = *value
+				_, err = tx.ExecContext(ctx, `INSERT INTO link_metadata (short_code, key, value) VALUES (?, ?, ?)
+					ON CONFLICT (short_code, key) DO UPDATE SET value = excluded.value`, code, key, *value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(after.Metadata) > linkMetadataMaxKeys {
+			return errTooManyMetadataKeys
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	case errors.Is(err, errLinkDeleted):
+		c.JSON(http.StatusGone, gin.H{"error": "Short URL has been deleted", "code": "link_deleted"})
+		return
+	case errors.Is(err, errLegalBlock):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins may lift legal_block", "code": "admin_only"})
+		return
+	case errors.Is(err, errAliasTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "short_code " + strconv.Quote(*req.ShortCode) + " is already taken"})
+		return
+	case errors.Is(err, errAliasRetained):
+		c.JSON(http.StatusConflict, gin.H{"error": "short_code " + strconv.Quote(*req.ShortCode) + " is held as another link's alias", "code": "alias_retained"})
+		return
+	case errors.Is(err, errTooManyMetadataKeys):
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("metadata may have at most %d keys", linkMetadataMaxKeys)})
+		return
+	case errors.Is(err, errDBBusy):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	response := gin.H{"short_code": newCode, "notes": after.Notes, "metadata": after.Metadata, "status": statusAfter}
+	if rename {
+		s.purgeLinkCache(ctx, shortCode)
+		s.forgetNotFound(ctx, newCode)
+		slog.Info("link renamed", "audit", true, "by", clientIP(c), "owner", owner,
+			"short_code", newCode, "old", shortCode)
+		aliases, err := loadLinkAliases(ctx, s.db, newCode)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		response["aliases"] = aliases
+	}
+	auditAnnotationsChange(c, newCode, before, after)
+	if statusAfter != statusBefore {
+		s.purgeLinkCache(ctx, newCode)
+		slog.Info("link status changed", "audit", true, "by", clientIP(c), "owner", owner,
+			"short_code", newCode, "old", statusBefore, "new", statusAfter)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// auditAnnotationsChange logs the old and new value of the notes and of
+// each metadata key a PATCH changed; a missing key is null.
+func auditAnnotationsChange(c *gin.Context, shortCode string, before, after linkAnnotations) {
+	change := func(from, to any) map[string]any { return map[string]any{"old": from, "new": to} }
+	diff := map[string]any{}
+	if before.Notes != after.Notes {
+		diff["notes"] = change(nullIfEmpty(before.Notes), nullIfEmpty(after.Notes))
+	}
+	for key, old := range before.Metadata {
+		if value, ok := after.Metadata[key]; !ok {
+			diff["metadata."+key] = change(old, nil)
+		} else if value != old {
+			diff["metadata."+key] = change(old, value)
+		}
+	}
+	for key, value := range after.Metadata {
+		if _, ok := before.Metadata[key]; !ok {
+			diff["metadata."+key] = change(nil, value)
+		}
+	}
+	if len(diff) == 0 {
+		return
+	}
+	slog.Info("link annotations changed", "audit", true, "by", clientIP(c), "owner", c.GetString(ownerContextKey),
+		"short_code", shortCode, "diff", diff)
+}
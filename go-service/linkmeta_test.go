@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestPatchURLOwnerCheck(t *testing.T) {
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	owned := createOwnedLink(t, ownerID)
+	// A link created without a key has no owner; only admins may edit it.
+	ownerless := "al-" + newRandomID()[:10]
+	if _, err := testServer.store.Create(context.Background(), ShortenRequest{LongURL: "https://example.com/" + ownerless}, ownerless); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := "Authorization: Bearer " + testAdminToken
+	for _, tt := range []struct {
+		name, code, auth string
+		want             int
+	}{
+		{"owner", owned, "X-API-Key: " + key, http.StatusOK},
+		{"another key", owned, "X-API-Key: " + otherKey, http.StatusNotFound},
+		{"ownerless by a key", ownerless, "X-API-Key: " + key, http.StatusNotFound},
+		{"ownerless by an admin", ownerless, admin, http.StatusOK},
+	} {
+		if w := serveTest(r, http.MethodPatch, "/api/urls/"+tt.code, `{"notes":"checked"}`, tt.auth); w.Code != tt.want {
+			t.Errorf("patch by %s = %d: %s, want %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getURL serves GET /api/urls/:code: where a code points, without
+// redirecting. Nothing is published or counted, so moderation tools can
+// inspect destinations freely. Scheduled links stay hidden until they are
+// live, as in stats. A link with an owner, notes, metadata and aliases
+// included, is only shown to that owner and to admins.
+func (s *Server) getURL(c *gin.Context) {
+	shortCode := c.Param("code")
+
+	var longURL, createdAt string
+	var activeFrom, expiresAt, timezone, owner, notes, scanStatus, resolvedURL, destinationProblem, passwordHash, utm, webhookURL sql.NullString
+	var resolvedStatus sql.NullInt64
+	var clicks int64
+	var status string
+	err := s.db.QueryRowContext(c.Request.Context(), `SELECT long_url, created_at, active_from, expires_at, timezone, owner, notes, scan_status, status,
+			resolved_url, resolved_status, destination_problem, password_hash, utm, webhook_url,
+			imported_clicks + (SELECT COUNT(*) FROM clicks WHERE clicks.short_code = urls.short_code)
+		FROM urls WHERE short_code = ?`, shortCode).
+		Scan(&longURL, &createdAt, &activeFrom, &expiresAt, &timezone, &owner, &notes, &scanStatus, &status, &resolvedURL, &resolvedStatus, &destinationProblem, &passwordHash, &utm, &webhookURL, &clicks)
+	admin := s.isAdminCaller(c)
+	if err == nil && (!linkActive(activeFrom, time.Now()) || owner.Valid && owner.String != c.GetString(ownerContextKey) && !admin) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// A protected link's destination is only for its owner and admins;
+	// anyone else has to unlock it.
+	visible := destinationVisible(passwordHash, owner, c.GetString(ownerContextKey), admin)
+	response := gin.H{
+		"short_code": shortCode,
+		"short_url":  shortURLFor(publicBaseURL(c), shortCode),
+		"created_at": createdAt,
+		"clicks":     clicks,
+		"status":     effectiveLinkStatus(status, expiresAt, time.Now()),
+	}
+	if activeFrom.Valid {
+		response["active_from"] = activeFrom.String
+	}
+	if expiresAt.Valid {
+		response["expires_at"] = expiresAt.String
+		response["expired"] = linkExpired(expiresAt, time.Now())
+	}
+	if scanStatus.Valid {
+		response["scan_status"] = scanStatus.String
+	}
+	if visible {
+		response["long_url"] = longURL
+	}
+	if resolvedURL.Valid && visible {
+		response["resolved_url"] = resolvedURL.String
+	}
+	if resolvedStatus.Valid {
+		response["resolved_status"] = resolvedStatus.Int64
+	}
+	if destinationProblem.Valid {
+		response["destination_problem"] = destinationProblem.String
+	}
+	if passwordHash.Valid {
+		response["password_protected"] = true
+	}
+	if u := decodeLinkUTM(utm.String); u != nil {
+		response["utm"] = u
+	}
+	if webhookURL.Valid {
+		response["webhook_url"] = webhookURL.String
+	}
+	localTimes(response, timezone, map[string]sql.NullString{"active_from": activeFrom, "expires_at": expiresAt})
+	metadata, err := loadLinkMetadata(c.Request.Context(), s.reader(c.Request.Context()), shortCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	aliases, err := loadLinkAliases(c.Request.Context(), s.reader(c.Request.Context()), shortCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	response["notes"] = notes.String
+	response["metadata"] = metadata
+	response["aliases"] = aliases
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+// deleteURL serves DELETE /api/urls/:code for admins and the link's owner.
+// The link is marked deleted, keeping its clicks and its code, and leaves
+// the cache at once; with ?hard=true it goes from the database with all
+// its rows instead. Either way url_deleted is published so downstream
+// analytics can mark it revoked.
+func (s *Server) deleteURL(c *gin.Context) {
+	shortCode := c.Param("code")
+	if !s.isAdminCaller(c) {
+		// The owner may be deleting a link they just made.
+		link, err := s.store.GetLongURL(primaryContext(c.Request.Context()), shortCode)
+		if err == sql.ErrNoRows || err == nil && link.Owner.String != c.GetString(ownerContextKey) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+	hard := c.Query("hard") == "true"
+	deleted, err := s.store.Delete(c.Request.Context(), shortCode, hard)
+	if err != nil {
+		if isBusyError(err) || errors.Is(err, errDBBusy) {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	}
+	if !hard {
+		s.purgeLinkCache(c.Request.Context(), shortCode)
+		s.publishLifecycleEvent(context.WithoutCancel(c.Request.Context()), eventURLDeleted, shortCode)
+		slog.Info("link status changed", "audit", true, "by", clientIP(c), "owner", c.GetString(ownerContextKey),
+			"short_code", shortCode, "new", linkStatusDeleted)
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	s.purgeDeletedLink(c.Request.Context(), shortCode)
+	s.publishLifecycleEvent(context.WithoutCancel(c.Request.Context()), eventURLDeleted, shortCode)
+	log.Printf("Deleted short URL %s (by %s)", shortCode, clientIP(c))
+	c.Status(http.StatusNoContent)
+}
+
+// purgeDeletedLink drops what Redis and the local cache hold for a link
+// deleteLinks removed.
+func (s *Server) purgeDeletedLink(ctx context.Context, shortCode string) {
+	if s.rdb != nil {
+		s.rdb.ZRem(ctx, clickCounterDirtyKey, shortCode)
+		if err := s.rdb.Del(ctx, urlCacheKey(shortCode), clickCounterKey(shortCode)).Err(); err != nil && !redisUnavailable(err) {
+			log.Printf("Error purging cache for deleted %s: %v", shortCode, err)
+		}
+	}
+	s.invalidateLocalLinks(ctx, shortCode)
+}
+
+// deleteLinks deletes links with their clicks, conversions, counters,
+// metadata and aliases in one transaction, so no orphans are left for the verifier to
+// find, and returns how many links existed.
+func deleteLinks(ctx context.Context, db *sql.DB, codes []string) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n, err := deleteLinksTx(ctx, tx, codes)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// deleteLinksTx is deleteLinks in the caller's transaction.
+func deleteLinksTx(ctx context.Context, tx *sql.Tx, codes []string) (int64, error) {
+	placeholders := strings.Repeat(", ?", len(codes))[2:]
+	args := make([]any, len(codes))
+	for i, code := range codes {
+		args[i] = code
+	}
+	for _, table := range []string{"clicks", "conversions", "click_counters", "clicks_hourly", "link_metadata", "link_claims", "link_aliases"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE short_code IN ("+placeholders+")", args...); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM urls WHERE short_code IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
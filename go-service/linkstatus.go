@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A link's lifecycle is urls.status: active, disabled (paused through
+// PATCH /api/urls/:code, and re-enabled the same way), legal_block (set and
+// lifted by admins the same way) or deleted. DELETE /api/urls/:code only
+// marks a link deleted, keeping its clicks and its code, unless ?hard=true
+// is given. Disabled and deleted links answer 410, blocked ones 451.
+// "expired" is never stored: an active link past its expires_at reads as
+// expired in listings and stats. urls.legal_blocked stays set once a link
+// was blocked, so its code is never recycled.
+const (
+	linkStatusActive     = "active"
+	linkStatusDisabled   = "disabled"
+	linkStatusLegalBlock = "legal_block"
+	linkStatusExpired    = "expired"
+	linkStatusDeleted    = "deleted"
+)
+
+// linkStatusCondition matches links that may be served.
+const linkStatusCondition = "status = 'active'"
+
+var (
+	errLinkDeleted = errors.New("link is deleted")
+	errLegalBlock  = errors.New("link is under legal block")
+)
+
+// effectiveLinkStatus is the status a link with the stored status and
+// expires_at is shown with at now.
+func effectiveLinkStatus(status string, expiresAt sql.NullString, now time.Time) string {
+	if status == linkStatusActive && linkExpired(expiresAt, now) {
+		return linkStatusExpired
+	}
+	return status
+}
+
+// linkStatusFilter is the condition on urls u for a ?status= filter, "" for
+// an unknown status.
+func linkStatusFilter(status string, now time.Time) (string, []any) {
+	nowRFC3339 := now.UTC().Format(time.RFC3339)
+	switch status {
+	case linkStatusActive:
+		return "u.status = 'active' AND (u.expires_at IS NULL OR u.expires_at > ?)", []any{nowRFC3339}
+	case linkStatusExpired:
+		return "u.status = 'active' AND u.expires_at <= ?", []any{nowRFC3339}
+	case linkStatusDisabled, linkStatusLegalBlock, linkStatusDeleted:
+		return "u.status = ?", []any{status}
+	}
+	return "", nil
+}
+
+// writeLinkUnavailable answers for a link that isn't active.
+func writeLinkUnavailable(c *gin.Context, status string) {
+	c.Header("Cache-Control", "no-store")
+	switch status {
+	case linkStatusDeleted:
+		c.JSON(http.StatusGone, gin.H{"error": "Short URL has been deleted", "code": "link_deleted"})
+		return
+	case linkStatusLegalBlock:
+		c.JSON(http.StatusUnavailableForLegalReasons, gin.H{"error": "Short URL is unavailable for legal reasons", "code": "link_legal_block"})
+		return
+	}
+	c.JSON(http.StatusGone, gin.H{"error": "Short URL has been disabled", "code": "link_disabled"})
+}
+
+// purgeLinkCache drops a link's cache entry after its status changed, so
+// the next redirect reads the new status from the database.
+func (s *Server) purgeLinkCache(ctx context.Context, shortCode string) {
+	// Redis goes first, so no instance refills its local entry from it.
+	if s.rdb != nil {
+		if err := s.rdb.Del(ctx, urlCacheKey(shortCode)).Err(); err != nil && !redisUnavailable(err) {
+			log.Printf("Error purging cache for %s: %v", shortCode, err)
+		}
+	}
+	s.invalidateLocalLinks(ctx, shortCode)
+}
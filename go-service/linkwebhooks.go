@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A link created with a webhook_url gets every click on it POSTed there as
+// a click webhook, besides the WEBHOOK_CLICK_SAMPLE_RATE sample account
+// webhooks get. The URL is the link owner's choice, so it is only ever
+// dialled at a public address, and its deliveries are signed with the
+// owner's link webhook secret, made with their first link webhook and
+// returned once, as webhook_secret, in that link's creation response. An
+// owner may have LINK_WEBHOOKS_PER_OWNER links with a webhook; 0 turns link
+// webhooks off. A link's deliveries are queued, retried and logged as those
+// of a webhook of its own, with the ID "link-<code>", so
+// GET /api/webhooks/link-<code>/deliveries lists them. Every click delivery
+// is logged with its link's code, which ?short_code= filters on.
+var linkWebhooksPerOwner = getEnvInt("LINK_WEBHOOKS_PER_OWNER", 100)
+
+const (
+	linkWebhookIDPrefix = "link-"
+	// linkWebhookCacheTTL is how long a link's webhook is remembered
+	// between its clicks.
+	linkWebhookCacheTTL = 30 * time.Second
+)
+
+var errLinkWebhookLimit = errors.New("link webhook limit reached")
+
+// linkWebhookClient sends link webhooks, refusing non-public addresses.
+var linkWebhookClient *http.Client
+
+func newLinkWebhookClient() *http.Client {
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			Proxy:               guardedProxy,
+			DialContext:         guardedDialContext(&net.Dialer{Timeout: webhookTimeout, KeepAlive: 30 * time.Second}),
+			MaxIdleConnsPerHost: webhookWorkers,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// validateLinkWebhook checks req's webhook_url. A host resolving to a
+// private address is refused when dialled; localhost and private literal
+// addresses are refused here already.
+func validateLinkWebhook(req *ShortenRequest) error {
+	if linkWebhooksPerOwner <= 0 {
+		return errors.New("webhook_url is not enabled")
+	}
+	if req.owner == "" {
+		return errors.New("webhook_url needs an API key")
+	}
+	if err := validateWebhookURL(req.WebhookURL); err != nil {
+		return errors.New("webhook_url " + err.Error())
+	}
+	u, _ := url.Parse(req.WebhookURL)
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("webhook_url must be a public address")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && checkPublicAddr(addr) != nil {
+		return errors.New("webhook_url must be a public address")
+	}
+	return nil
+}
+
+// checkLinkWebhookLimit refuses owner adding more link webhooks than
+// LINK_WEBHOOKS_PER_OWNER allows. Deleted links don't count.
+func (s *Server) checkLinkWebhookLimit(ctx context.Context, owner string, adding int) error {
+	var have int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM urls WHERE owner = ? AND webhook_url IS NOT NULL AND status != ?",
+		owner, linkStatusDeleted).Scan(&have); err != nil {
+		return err
+	}
+	if have+adding > linkWebhooksPerOwner {
+		return errLinkWebhookLimit
+	}
+	return nil
+}
+
+// issueLinkWebhookSecret makes owner's link webhook secret if there isn't
+// one yet, returning it only then.
+func (s *Server) issueLinkWebhookSecret(ctx context.Context, owner string) string {
+	secret := newRandomID() + newRandomID()
+	res, err := s.execWithRetry(ctx, "INSERT INTO link_webhook_secrets (owner, secret, created_at) VALUES (?, ?, ?) ON CONFLICT (owner) DO NOTHING",
+		owner, secret, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		// The next link webhook tries again.
+		log.Printf("Error making link webhook secret for %s: %v", owner, err)
+		return ""
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ""
+	}
+	return secret
+}
+
+// limitBatchLinkWebhooks marks the valid batch items past owner's link
+// webhook limit invalid.
+func (s *Server) limitBatchLinkWebhooks(ctx context.Context, reqs []ShortenRequest, valid []bool, results []shortenBatchResult) error {
+	adding := 0
+	for i, req := range reqs {
+		if valid[i] && req.WebhookURL != "" {
+			adding++
+			if err := s.checkLinkWebhookLimit(ctx, req.owner, adding); errors.Is(err, errLinkWebhookLimit) {
+				valid[i] = false
+				results[i].Status, results[i].Error, results[i].Code = "invalid", "webhook_url would exceed the owner's link webhook limit", "link_webhook_limit"
+				adding--
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// linkWebhooks remembers links' webhooks, and links without one, for
+// linkWebhookCacheTTL.
+var linkWebhooks = &linkWebhookCache{entries: map[string]cachedLinkWebhook{}}
+
+type linkWebhookCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedLinkWebhook
+}
+
+type cachedLinkWebhook struct {
+	hook  webhook
+	ok    bool
+	until time.Time
+}
+
+func (c *linkWebhookCache) get(shortCode string, now time.Time) (cachedLinkWebhook, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[shortCode]
+	return e, ok && now.Before(e.until)
+}
+
+func (c *linkWebhookCache) put(shortCode string, e cachedLinkWebhook) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= 10000 {
+		clear(c.entries)
+	}
+	c.entries[shortCode] = e
+}
+
+// linkWebhookFor is the webhook of the link at shortCode, if it has one.
+func (s *Server) linkWebhookFor(ctx context.Context, shortCode string) (webhook, bool, error) {
+	now := time.Now()
+	if e, ok := linkWebhooks.get(shortCode, now); ok {
+		return e.hook, e.ok, nil
+	}
+	hook := webhook{ID: linkWebhookIDPrefix + shortCode, Events: []string{eventClick}, shortCode: shortCode, guarded: true}
+	err := s.db.QueryRowContext(ctx, `SELECT u.webhook_url, k.secret FROM urls u JOIN link_webhook_secrets k ON k.owner = u.owner
+		WHERE u.short_code = ? AND u.webhook_url IS NOT NULL`, shortCode).Scan(&hook.URL, &hook.secret)
+	if err != nil && err != sql.ErrNoRows {
+		return webhook{}, false, err
+	}
+	linkWebhooks.put(shortCode, cachedLinkWebhook{hook: hook, ok: err == nil, until: now.Add(linkWebhookCacheTTL)})
+	return hook, err == nil, nil
+}
+
+// lookupWebhook finds an account webhook, or a link's by its
+// "link-<code>" ID.
+func (s *Server) lookupWebhook(ctx context.Context, id string) (webhook, bool, error) {
+	if shortCode, ok := strings.CutPrefix(id, linkWebhookIDPrefix); ok {
+		return s.linkWebhookFor(ctx, shortCode)
+	}
+	hook, ok := findWebhook(id)
+	return hook, ok, nil
+}
+
+// publishLinkWebhook is the click publisher sending each click to its
+// link's webhook.
+func (s *Server) publishLinkWebhook(ctx context.Context, event ClickEvent) error {
+	if event.IsTest {
+		return nil
+	}
+	hook, ok, err := s.linkWebhookFor(ctx, event.ShortCode)
+	if err != nil || !ok {
+		return err
+	}
+	body, err := json.Marshal(webhookClickPayload{Type: eventClick, ClickEvent: event})
+	if err != nil {
+		return err
+	}
+	enqueueWebhook(webhookDelivery{hook: hook, eventID: event.ClickID, event: eventClick, shortCode: event.ShortCode, body: body, attempt: 1})
+	return nil
+}
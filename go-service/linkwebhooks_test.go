@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// shortenWithWebhook creates a link with webhookURL for key's owner.
+func shortenWithWebhook(t *testing.T, key, webhookURL string) (int, ShortenResponse, string) {
+	t.Helper()
+	w := serveTest(testServer.newRouter(), http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/hooked","webhook_url":"`+webhookURL+`"}`, "X-API-Key: "+key)
+	var resp ShortenResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var denied struct{ Code string }
+	json.Unmarshal(w.Body.Bytes(), &denied)
+	return w.Code, resp, denied.Code
+}
+
+func TestLinkWebhookValidation(t *testing.T) {
+	if err := validateLinkWebhook(&ShortenRequest{WebhookURL: "https://hooks.example.com/"}); err == nil {
+		t.Error("webhook_url without an owner was accepted")
+	}
+	_, key := newTestAPIKey(t, false)
+	for _, raw := range []string{"ftp://hooks.example.com/", "http://localhost:8080/", "http://127.0.0.1/", "http://10.1.2.3/", "http://[::1]/"} {
+		if status, resp, _ := shortenWithWebhook(t, key, raw); status != http.StatusBadRequest {
+			t.Errorf("webhook_url %s = %d (%+v), want %d", raw, status, resp, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLinkWebhookDelivery(t *testing.T) {
+	savedQueue, savedClient := webhookQueue, linkWebhookClient
+	webhookQueue = make(chan webhookDelivery, 10)
+	// The endpoint is on loopback, which the guarded client refuses.
+	linkWebhookClient = newWebhookClient()
+	t.Cleanup(func() { webhookQueue, linkWebhookClient = savedQueue, savedClient })
+	var received *http.Request
+	var receivedBody []byte
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+	}))
+	defer endpoint.Close()
+
+	r := testServer.newRouter()
+	admin := "Authorization: Bearer " + testAdminToken
+	_, key := newTestAPIKey(t, false)
+	status, first, _ := shortenWithWebhook(t, key, "https://hooks.example.com/first")
+	if status != http.StatusOK || first.WebhookSecret == "" {
+		t.Fatalf("first link webhook = %d: %+v", status, first)
+	}
+	status, second, _ := shortenWithWebhook(t, key, "https://hooks.example.com/second")
+	if status != http.StatusOK || second.WebhookSecret != "" || second.ShortCode == first.ShortCode {
+		t.Fatalf("second link webhook = %d: %+v", status, second)
+	}
+	w := serveTest(r, http.MethodGet, "/api/urls/"+first.ShortCode, "", "X-API-Key: "+key)
+	if !strings.Contains(w.Body.String(), `"webhook_url":"https://hooks.example.com/first"`) {
+		t.Errorf("link = %d: %s", w.Code, w.Body)
+	}
+
+	// A click is queued for the link's webhook, signed with the owner's
+	// secret and retried on its own.
+	ctx := context.Background()
+	if err := testServer.publishLinkWebhook(ctx, ClickEvent{ClickID: "click-1", ShortCode: first.ShortCode}); err != nil {
+		t.Fatal(err)
+	}
+	d := <-webhookQueue
+	if d.hook.ID != "link-"+first.ShortCode || d.hook.URL != "https://hooks.example.com/first" || d.hook.secret != first.WebhookSecret || !d.hook.guarded || d.shortCode != first.ShortCode {
+		t.Fatalf("queued delivery = %+v", d)
+	}
+	if err := testServer.publishLinkWebhook(ctx, ClickEvent{ClickID: "click-2", ShortCode: "no-such-link"}); err != nil || len(webhookQueue) != 0 {
+		t.Errorf("a click on a link without a webhook queued %d deliveries (%v)", len(webhookQueue), err)
+	}
+	d.hook.URL = endpoint.URL
+	testServer.deliverWebhook(d)
+	if received == nil || received.Header.Get("X-Webhook-Signature") != "sha256="+webhookSignature(first.WebhookSecret, received.Header.Get("X-Webhook-Timestamp"), receivedBody) {
+		t.Fatalf("delivery was not signed with the owner's secret: %v", received)
+	}
+	if !strings.Contains(string(receivedBody), `"short_code":"`+first.ShortCode+`"`) {
+		t.Errorf("delivered %s", receivedBody)
+	}
+
+	w = serveTest(r, http.MethodGet, "/api/webhooks/link-"+first.ShortCode+"/deliveries?short_code="+first.ShortCode, "", admin)
+	var page struct {
+		Deliveries []struct {
+			EventID   string `json:"event_id"`
+			ShortCode string `json:"short_code"`
+		}
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if w.Code != http.StatusOK || len(page.Deliveries) != 1 || page.Deliveries[0].EventID != "click-1" || page.Deliveries[0].ShortCode != first.ShortCode {
+		t.Errorf("link deliveries = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/api/webhooks/link-"+first.ShortCode+"/deliveries?short_code=other", "", admin); strings.Contains(w.Body.String(), "click-1") {
+		t.Errorf("deliveries filtered by another code = %s", w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/api/webhooks/link-no-such-link/deliveries", "", admin); w.Code != http.StatusNotFound {
+		t.Errorf("deliveries of a link without a webhook = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestLinkWebhookRefusesPrivateAddresses(t *testing.T) {
+	saved := linkWebhookClient
+	linkWebhookClient = newLinkWebhookClient()
+	t.Cleanup(func() { linkWebhookClient = saved })
+	reached := false
+	endpoint := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { reached = true }))
+	defer endpoint.Close()
+
+	// A public-looking name may still resolve to a private address.
+	hook := webhook{ID: "link-ssrf", URL: endpoint.URL, secret: "s", guarded: true}
+	status, _, err := postWebhook(webhookDelivery{hook: hook, eventID: "click-1", event: eventClick, body: []byte(`{}`), attempt: 1})
+	if reached || err == nil || !strings.Contains(err.Error(), errNonPublicAddress.Error()) {
+		t.Errorf("delivery to a loopback address = %d, %v; reached %v", status, err, reached)
+	}
+}
+
+func TestLinkWebhookLimit(t *testing.T) {
+	saved := linkWebhooksPerOwner
+	linkWebhooksPerOwner = 2
+	t.Cleanup(func() { linkWebhooksPerOwner = saved })
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	for i := range 2 {
+		if status, resp, _ := shortenWithWebhook(t, key, "https://hooks.example.com/"); status != http.StatusOK {
+			t.Fatalf("link webhook %d = %d: %+v", i+1, status, resp)
+		}
+	}
+	if status, _, code := shortenWithWebhook(t, key, "https://hooks.example.com/"); status != http.StatusConflict || code != "link_webhook_limit" {
+		t.Errorf("link webhook past the limit = %d %q, want %d link_webhook_limit", status, code, http.StatusConflict)
+	}
+	w := serveTest(r, http.MethodPost, "/api/shorten/batch", `[{"long_url":"https://example.com/a","webhook_url":"https://hooks.example.com/"},{"long_url":"https://example.com/b"}]`, "X-API-Key: "+key)
+	var batch struct{ Results []shortenBatchResult }
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	if w.Code != http.StatusOK || len(batch.Results) != 2 || batch.Results[0].Code != "link_webhook_limit" || batch.Results[1].Status != "created" {
+		t.Errorf("batch past the limit = %d: %s", w.Code, w.Body)
+	}
+	// A plain request for the same destination gets a link of its own.
+	w = serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/hooked"}`, "X-API-Key: "+key)
+	if strings.Contains(w.Body.String(), `"reused":true`) {
+		t.Errorf("a plain link reused a link with a webhook: %s", w.Body)
+	}
+}
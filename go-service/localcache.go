@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Redirect looks a code up in a small in-process LRU of LOCAL_CACHE_SIZE
+// links (0 turns it off) before going to Redis. It holds what the Redis
+// cache holds, filled as Redis entries are read or written by redirect, so
+// links Redis never caches, such as password-protected, challenge or
+// quarantined ones, never get here either, and an entry never outlives its
+// link's expiry. Whatever purges a Redis entry evicts the local one too and
+// publishes the code on the cache_invalidate channel, which every instance
+// subscribes to. An entry lasts at most LOCAL_CACHE_TTL, which bounds how
+// stale a replica that missed an invalidation, e.g. while Redis was down,
+// can be. Codes Redis holds as missing (see negativecache.go) are kept
+// apart, at most LOCAL_NEGATIVE_CACHE_SIZE of them, so a flood of misses
+// never pushes links out.
+var (
+	localCacheSize         = getEnvInt("LOCAL_CACHE_SIZE", 10000)
+	localCacheTTL          = getEnvDuration("LOCAL_CACHE_TTL", 30*time.Second)
+	localNegativeCacheSize = getEnvInt("LOCAL_NEGATIVE_CACHE_SIZE", 1000)
+)
+
+const cacheInvalidateChannel = "cache_invalidate"
+
+var (
+	localCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortener_local_cache_lookups_total",
+		Help: "In-process link cache lookups by result (hit, miss, or negative_hit for a code cached as missing).",
+	}, []string{"result"})
+	localCacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortener_local_cache_evictions_total",
+		Help: "Entries dropped from the in-process link cache by reason (capacity, negative_capacity, expired or invalidated).",
+	}, []string{"reason"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "urlshortener_local_cache_entries",
+		Help: "Links in the in-process link cache.",
+	}, func() float64 { return float64(localLinks.len()) })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "urlshortener_local_cache_negative_entries",
+		Help: "Missing codes in the in-process link cache.",
+	}, func() float64 { return float64(localLinks.missLen()) })
+)
+
+type localCacheEntry struct {
+	shortCode string
+	link      cachedLink
+	expires   time.Time
+}
+
+// linkLRU is a fixed-size LRU of cached links, with a separate one of
+// missing codes. The zero value, and one of size 0, caches nothing.
+type linkLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+
+	missSize    int
+	missOrder   *list.List
+	missEntries map[string]*list.Element
+}
+
+var localLinks = &linkLRU{}
+
+func newLinkLRU(size, missSize int) *linkLRU {
+	if size <= 0 {
+		missSize = 0
+	}
+	return &linkLRU{size: size, order: list.New(), entries: make(map[string]*list.Element, size),
+		missSize: missSize, missOrder: list.New(), missEntries: make(map[string]*list.Element, missSize)}
+}
+
+func (l *linkLRU) get(shortCode string, now time.Time) (cachedLink, bool) {
+	if l.size <= 0 {
+		return cachedLink{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.entries[shortCode]
+	if !ok {
+		localCacheLookups.WithLabelValues("miss").Inc()
+		return cachedLink{}, false
+	}
+	e := el.Value.(*localCacheEntry)
+	if !now.Before(e.expires) {
+		l.remove(el, "expired")
+		localCacheLookups.WithLabelValues("miss").Inc()
+		return cachedLink{}, false
+	}
+	l.order.MoveToFront(el)
+	localCacheLookups.WithLabelValues("hit").Inc()
+	return e.link, true
+}
+
+// put caches link for at most localCacheTTL, and never past its expiry.
+func (l *linkLRU) put(shortCode string, link cachedLink, now time.Time) {
+	if l.size <= 0 {
+		return
+	}
+	expires := now.Add(localCacheTTL)
+	if link.ExpiresAt != 0 {
+		if at := time.Unix(link.ExpiresAt, 0); at.Before(expires) {
+			expires = at
+		}
+	}
+	if !now.Before(expires) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.missEntries[shortCode]; ok {
+		l.removeMiss(el, "invalidated")
+	}
+	if el, ok := l.entries[shortCode]; ok {
+		e := el.Value.(*localCacheEntry)
+		e.link, e.expires = link, expires
+		l.order.MoveToFront(el)
+		return
+	}
+	l.entries[shortCode] = l.order.PushFront(&localCacheEntry{shortCode, link, expires})
+	if l.order.Len() > l.size {
+		l.remove(l.order.Back(), "capacity")
+	}
+}
+
+// getMiss reports whether shortCode is cached as missing.
+func (l *linkLRU) getMiss(shortCode string, now time.Time) bool {
+	if l.missSize <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.missEntries[shortCode]
+	if !ok {
+		return false
+	}
+	if !now.Before(el.Value.(*localCacheEntry).expires) {
+		l.removeMiss(el, "expired")
+		return false
+	}
+	l.missOrder.MoveToFront(el)
+	localCacheLookups.WithLabelValues("negative_hit").Inc()
+	return true
+}
+
+// putMiss caches shortCode as missing until expires, pushing out only
+// other missing codes.
+func (l *linkLRU) putMiss(shortCode string, expires time.Time) {
+	if l.missSize <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.missEntries[shortCode]; ok {
+		el.Value.(*localCacheEntry).expires = expires
+		l.missOrder.MoveToFront(el)
+		return
+	}
+	l.missEntries[shortCode] = l.missOrder.PushFront(&localCacheEntry{shortCode: shortCode, expires: expires})
+	if l.missOrder.Len() > l.missSize {
+		l.removeMiss(l.missOrder.Back(), "negative_capacity")
+	}
+}
+
+func (l *linkLRU) evict(shortCodes ...string) {
+	if l.size <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, code := range shortCodes {
+		if el, ok := l.entries[code]; ok {
+			l.remove(el, "invalidated")
+		}
+		if el, ok := l.missEntries[code]; ok {
+			l.removeMiss(el, "invalidated")
+		}
+	}
+}
+
+func (l *linkLRU) removeMiss(el *list.Element, reason string) {
+	l.missOrder.Remove(el)
+	delete(l.missEntries, el.Value.(*localCacheEntry).shortCode)
+	localCacheEvictions.WithLabelValues(reason).Inc()
+}
+
+func (l *linkLRU) missLen() int {
+	if l.missSize <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.missOrder.Len()
+}
+
+func (l *linkLRU) remove(el *list.Element, reason string) {
+	l.order.Remove(el)
+	delete(l.entries, el.Value.(*localCacheEntry).shortCode)
+	localCacheEvictions.WithLabelValues(reason).Inc()
+}
+
+func (l *linkLRU) len() int {
+	if l.size <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// startLocalCache sets up the local cache and, with Redis, listens for
+// invalidations from the other instances.
+func (s *Server) startLocalCache() {
+	if localCacheSize < 0 {
+		log.Fatalf("Invalid LOCAL_CACHE_SIZE %d: must be at least 0", localCacheSize)
+	}
+	if localNegativeCacheSize < 0 {
+		log.Fatalf("Invalid LOCAL_NEGATIVE_CACHE_SIZE %d: must be at least 0", localNegativeCacheSize)
+	}
+	localLinks = newLinkLRU(localCacheSize, localNegativeCacheSize)
+	if localCacheSize == 0 || s.rdb == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pubsub := s.rdb.Subscribe(ctx, cacheInvalidateChannel)
+	app.OnShutdown("cache_invalidate", time.Second, func(context.Context) error {
+		cancel()
+		return pubsub.Close()
+	})
+	go func() {
+		// The channel survives reconnects; while Redis is down entries
+		// age out after localCacheTTL.
+		for msg := range pubsub.Channel() {
+			localLinks.evict(strings.Fields(msg.Payload)...)
+		}
+	}()
+}
+
+// invalidateLocalLinks evicts codes here and, through Redis, on every
+// other instance.
+func (s *Server) invalidateLocalLinks(ctx context.Context, shortCodes ...string) {
+	if localCacheSize == 0 || len(shortCodes) == 0 {
+		return
+	}
+	localLinks.evict(shortCodes...)
+	if s.rdb == nil {
+		return
+	}
+	if err := s.rdb.Publish(ctx, cacheInvalidateChannel, strings.Join(shortCodes, " ")).Err(); err != nil && !redisUnavailable(err) {
+		log.Printf("Error publishing cache invalidation: %v", err)
+	}
+}
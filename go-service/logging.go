@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// logLevel backs the default slog handler and can be changed at runtime via
+// PUT /admin/log-level or SIGUSR1. log.Printf output is logged at INFO.
+var logLevel = new(slog.LevelVar)
+
+// Slow-operation thresholds; a zero threshold disables that category.
+var (
+	slowDBThreshold    atomic.Int64
+	slowRedisThreshold atomic.Int64
+	slowHTTPThreshold  atomic.Int64
+)
+
+// initLogging sets up slog from LOG_LEVEL and LOG_FORMAT: "text" (the
+// default, for local runs) or "json", one object per line for log
+// aggregators.
+func initLogging() {
+	if level, ok := parseLogLevel(getEnv("LOG_LEVEL", "info")); ok {
+		logLevel.Set(level)
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format := getEnv("LOG_FORMAT", "text"); format {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	default:
+		log.Fatalf("Invalid LOG_FORMAT %q: must be text or json", format)
+	}
+
+	slowDBThreshold.Store(int64(getEnvDuration("SLOW_DB_THRESHOLD", 100*time.Millisecond)))
+	slowRedisThreshold.Store(int64(getEnvDuration("SLOW_REDIS_THRESHOLD", 50*time.Millisecond)))
+	slowHTTPThreshold.Store(int64(getEnvDuration("SLOW_HTTP_THRESHOLD", 500*time.Millisecond)))
+
+	go cycleLogLevelOnSignal()
+}
+
+func parseLogLevel(s string) (slog.Level, bool) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, false
+	}
+	return level, true
+}
+
+// logLevelCycle is the order SIGUSR1 steps through.
+var logLevelCycle = []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+func cycleLogLevelOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	for range sigs {
+		next := logLevelCycle[0]
+		for i, level := range logLevelCycle {
+			if level == logLevel.Level() {
+				next = logLevelCycle[(i+1)%len(logLevelCycle)]
+				break
+			}
+		}
+		setLogLevel(next, 0)
+	}
+}
+
+var (
+	logLevelRevertMu    sync.Mutex
+	logLevelRevertTimer *time.Timer
+)
+
+// setLogLevel changes the level. A positive duration reverts to the previous
+// level afterwards, so a debugging session can't be left on by accident.
+func setLogLevel(level slog.Level, duration time.Duration) {
+	logLevelRevertMu.Lock()
+	defer logLevelRevertMu.Unlock()
+
+	if logLevelRevertTimer != nil {
+		logLevelRevertTimer.Stop()
+		logLevelRevertTimer = nil
+	}
+
+	previous := logLevel.Level()
+	logLevel.Set(level)
+	log.Printf("Log level changed from %s to %s", previous, level)
+
+	if duration > 0 {
+		logLevelRevertTimer = time.AfterFunc(duration, func() {
+			logLevel.Set(previous)
+			log.Printf("Log level reverted to %s", previous)
+		})
+	}
+}
+
+// logIfSlow emits a WARN line when an operation exceeded its threshold.
+func logIfSlow(threshold *atomic.Int64, kind, op string, elapsed time.Duration) {
+	limit := time.Duration(threshold.Load())
+	if limit <= 0 || elapsed < limit {
+		return
+	}
+	slog.Warn("slow operation", "kind", kind, "op", op, "duration", elapsed, "threshold", limit)
+}
+
+// slowRedisHook times every Redis command and pipeline.
+type slowRedisHook struct{}
+
+func (slowRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := next(ctx, network, addr)
+		logIfSlow(&slowRedisThreshold, "redis", "dial", time.Since(start))
+		return conn, err
+	}
+}
+
+func (slowRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		logIfSlow(&slowRedisThreshold, "redis", cmd.Name(), time.Since(start))
+		return err
+	}
+}
+
+func (slowRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		logIfSlow(&slowRedisThreshold, "redis", "pipeline", time.Since(start))
+		return err
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// One request in LOG_SAMPLE_SHORTEN creations and one in
+// LOG_SAMPLE_REDIRECT redirects is logged at INFO with what it did, so what
+// people shorten and how redirects are served can be seen without logging
+// every one. 0 turns a sample off. Whether a request is sampled depends
+// only on its request ID, so every sampled line of one request, across
+// routes and replicas, is logged together. PUT /admin/log-sampling changes
+// the rates at runtime.
+var (
+	logSampleShorten  atomic.Int64
+	logSampleRedirect atomic.Int64
+)
+
+var logSampleRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "urlshortener_log_sample_rate",
+	Help: "Fraction of requests whose sampled log lines are written, by route kind (0 when off).",
+}, []string{"kind"})
+
+func initLogSampling() {
+	setLogSample(&logSampleShorten, "shorten", int64(getEnvInt("LOG_SAMPLE_SHORTEN", 0)))
+	setLogSample(&logSampleRedirect, "redirect", int64(getEnvInt("LOG_SAMPLE_REDIRECT", 0)))
+}
+
+func setLogSample(sample *atomic.Int64, kind string, n int64) {
+	sample.Store(max(n, 0))
+	rate := 0.0
+	if n > 0 {
+		rate = 1 / float64(n)
+	}
+	logSampleRate.WithLabelValues(kind).Set(rate)
+}
+
+// logSampled reports whether the request with requestID is in the 1-in-n
+// sample.
+func logSampled(sample *atomic.Int64, requestID string) bool {
+	n := sample.Load()
+	if n <= 0 || requestID == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(requestID))
+	return binary.BigEndian.Uint64(sum[:8])%uint64(n) == 0
+}
+
+// logSampledShorten logs a link c's request created, if it is sampled.
+func logSampledShorten(c *gin.Context, shortCode, longURL, owner string) {
+	if !logSampled(&logSampleShorten, requestID(c)) {
+		return
+	}
+	host := ""
+	if u, err := url.Parse(longURL); err == nil {
+		host = u.Hostname()
+	}
+	slog.Info("sampled shorten", "request_id", requestID(c), "short_code", shortCode,
+		"long_url", redactURL(longURL), "host", host, "owner", owner)
+}
+
+// logSampledRedirect logs a served redirect if c's request is sampled.
+func logSampledRedirect(c *gin.Context, outcome string, elapsed time.Duration) {
+	if !logSampled(&logSampleRedirect, requestID(c)) {
+		return
+	}
+	slog.Info("sampled redirect", "request_id", requestID(c), "short_code", c.Param("code"),
+		"served_by", outcome, "status", c.Writer.Status(), "duration", elapsed)
+}
+
+type logSamplingRequest struct {
+	Shorten  *int64 `json:"shorten"`
+	Redirect *int64 `json:"redirect"`
+}
+
+// getLogSampling serves GET /admin/log-sampling.
+func getLogSampling(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"shorten": logSampleShorten.Load(), "redirect": logSampleRedirect.Load()})
+}
+
+// putLogSampling serves PUT /admin/log-sampling; each rate given, as the N
+// of 1-in-N, replaces the current one.
+func putLogSampling(c *gin.Context) {
+	var req logSamplingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, n := range []*int64{req.Shorten, req.Redirect} {
+		if n != nil && *n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Sample rates must be 0 (off) or N for 1 in N"})
+			return
+		}
+	}
+	if req.Shorten != nil {
+		setLogSample(&logSampleShorten, "shorten", *req.Shorten)
+	}
+	if req.Redirect != nil {
+		setLogSample(&logSampleRedirect, "redirect", *req.Redirect)
+	}
+	slog.Info("log sampling changed", "audit", true, "by", clientIP(c), "shorten", logSampleShorten.Load(), "redirect", logSampleRedirect.Load())
+	getLogSampling(c)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxLongURLLen caps the destination length accepted for new links.
+var maxLongURLLen = getEnvInt("MAX_LONG_URL_LENGTH", 2048)
+
+// Machine-readable codes returned with a rejected long_url.
+const (
+	longURLInvalid           = "invalid_url"
+	longURLTooLong           = "url_too_long"
+	longURLUnsupportedScheme = "unsupported_scheme"
+	longURLMissingHost       = "missing_host"
+)
+
+// longURLError is a client-facing validation failure; Code goes into the
+// response next to the message.
+type longURLError struct {
+	Code    string
+	Message string
+}
+
+func (e *longURLError) Error() string { return e.Message }
+
+// longURLErrorCode returns err's code if it is a *longURLError, else "".
+func longURLErrorCode(err error) string {
+	var urlErr *longURLError
+	if errors.As(err, &urlErr) {
+		return urlErr.Code
+	}
+	return ""
+}
+
+// normalizeLongURL validates a destination and returns the form to store:
+// the scheme and host are lowercased and a default port is dropped, so
+// "HTTP://Example.com:80/" and "http://example.com/" store the same string.
+// Everything after the host is kept byte-for-byte, since redirects must
+// send the destination exactly as it was given.
+func normalizeLongURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > maxLongURLLen {
+		return "", &longURLError{longURLTooLong, "long_url must be at most " + strconv.Itoa(maxLongURLLen) + " characters"}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return "", &longURLError{longURLInvalid, "long_url must be an absolute URL"}
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", &longURLError{longURLUnsupportedScheme, "long_url must use http or https"}
+	}
+	if u.Opaque != "" || u.Hostname() == "" {
+		return "", &longURLError{longURLMissingHost, "long_url must have a host"}
+	}
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	// Swap in the new scheme and authority and copy the rest of the
+	// original string, rather than calling u.String(), which would
+	// re-encode the path.
+	rest := raw[len(u.Scheme)+len("://"):]
+	authority, tail := rest, ""
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority, tail = rest[:i], rest[i:]
+	}
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		host = authority[:at+1] + host
+	}
+	return scheme + "://" + host + tail, nil
+}
@@ -1,50 +1,224 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
 	"database/sql"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/redis/go-redis/v9"
 )
 
-var db *sql.DB
-var rdb *redis.Client
-var ctx = context.Background()
-
-// pythonServiceURL can be overridden by PYTHON_SERVICE_URL environment variable (kept for backward compatibility)
-var pythonServiceURL = getEnv("PYTHON_SERVICE_URL", "http://localhost:5000")
-
 type ShortenRequest struct {
 	LongURL string `json:"long_url" binding:"required"`
+
+	// Optional social preview overrides shown to link-unfurling crawlers.
+	OGTitle       string `json:"og_title,omitempty"`
+	OGDescription string `json:"og_description,omitempty"`
+	OGImage       string `json:"og_image,omitempty"`
+
+	// Challenge serves a JS interstitial before redirecting so that only
+	// real browsers are counted as clicks.
+	Challenge bool `json:"challenge,omitempty"`
+
+	// ActiveFrom keeps the link dark (404) until the given time.
+	ActiveFrom *linkTime `json:"active_from,omitempty"`
+
+	// ExpiresAt makes the link answer 410 Gone from the given time on.
+	// TTLSeconds is the same, relative to now; set at most one of them.
+	ExpiresAt  *linkTime `json:"expires_at,omitempty"`
+	TTLSeconds int       `json:"ttl_seconds,omitempty"`
+
+	// Timezone is the IANA zone that active_from and expires_at without
+	// an offset are read in, defaulting to the owner's, then UTC.
+	Timezone string `json:"timezone,omitempty"`
+
+	// Hot sends 103 Early Hints for the destination (EARLY_HINTS_ENABLED).
+	Hot bool `json:"hot,omitempty"`
+
+	// RedirectType is the status this link redirects with (301, 302, 307
+	// or 308) instead of REDIRECT_STATUS.
+	RedirectType int `json:"redirect_type,omitempty"`
+
+	// Notes and Metadata are the caller's own context for the link, such
+	// as a ticket number. They never affect redirects.
+	Notes    string            `json:"notes,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// UTM is campaign tracking merged into the destination on each
+	// redirect; see linkUTM.
+	UTM *linkUTM `json:"utm,omitempty"`
+
+	// CustomAlias replaces the generated code, e.g. "promo2024".
+	CustomAlias string `json:"custom_alias,omitempty"`
+
+	// Password protects the link: it only redirects once the password is
+	// given. Only its bcrypt hash is stored.
+	Password string `json:"password,omitempty"`
+
+	// SkipVerification skips the VERIFY_DESTINATION check; only trusted
+	// API keys may send it.
+	SkipVerification bool `json:"skip_verification,omitempty"`
+
+	// ReuseExisting returns the caller's existing plain link to an
+	// equivalent long_url, as its canonicalization profile compares them,
+	// instead of minting a new code. It defaults to true; send false to get
+	// a unique code, e.g. one per campaign.
+	ReuseExisting *bool `json:"reuse_existing,omitempty"`
+
+	// WebhookURL receives every click on the link as a click webhook; see
+	// linkwebhooks.go. It needs an API key.
+	WebhookURL string `json:"webhook_url,omitempty"`
+
+	// Profile names the owner's settings profile filling in what the
+	// request leaves unset; see settingsprofiles.go. Without it, the
+	// owner's default profile does.
+	Profile string `json:"profile,omitempty"`
+
+	// isTest marks self-test links; it cannot be set through the API.
+	isTest bool
+	// owner is the authenticated caller, when there is one.
+	owner string
+	// tier is the caller's tier, whose policy applies; "" for admins'
+	// own tools.
+	tier string
+	// baseURL is the publicBaseURL the response's short_url uses.
+	baseURL string
+	// canonical is the owner's canonicalization profile; nil means the
+	// global one.
+	canonical *canonicalProfile
+	// settingsProfile is the profile applied, and fromProfile what it
+	// filled in.
+	settingsProfile string
+	fromProfile     []string
+	// destination is the destination check's result, nil when none ran.
+	destination *destinationCheck
+	// passwordHash is the bcrypt hash of Password.
+	passwordHash string
+	// claim is the claim token stored with a new link without an owner.
+	claim *linkClaim
 }
 
 type ShortenResponse struct {
-	ShortCode string `json:"short_code"`
-	ShortURL  string `json:"short_url"`
-	LongURL   string `json:"long_url"`
+	ShortCode  string `json:"short_code"`
+	ShortURL   string `json:"short_url"`
+	LongURL    string `json:"long_url"`
+	ActiveFrom string `json:"active_from,omitempty"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+	// Timezone and the _local times are set for links with a timezone.
+	Timezone        string `json:"timezone,omitempty"`
+	ActiveFromLocal string `json:"active_from_local,omitempty"`
+	ExpiresAtLocal  string `json:"expires_at_local,omitempty"`
+	// Verified is set when the owner has proven control of the destination.
+	Verified bool `json:"verified,omitempty"`
+	// RedirectType is set for links created with one.
+	RedirectType int `json:"redirect_type,omitempty"`
+	// UTM is set for links created with campaign defaults.
+	UTM *linkUTM `json:"utm,omitempty"`
+	// Reused is set when an existing link was returned instead of a new one.
+	Reused bool `json:"reused,omitempty"`
+	// ResolvedURL and ResolvedStatus are where the destination check ended
+	// up; DestinationProblem is set for a link it flagged, which is held
+	// back until reviewed.
+	ResolvedURL        string `json:"resolved_url,omitempty"`
+	ResolvedStatus     int    `json:"resolved_status,omitempty"`
+	DestinationProblem string `json:"destination_problem,omitempty"`
+	// DestinationCheckSkipped is why an outbound policy kept the
+	// destination from being checked.
+	DestinationCheckSkipped string `json:"destination_check_skipped,omitempty"`
+	// ClaimToken is returned once for a new link without an owner; see
+	// claimURL.
+	ClaimToken          string `json:"claim_token,omitempty"`
+	ClaimTokenExpiresAt string `json:"claim_token_expires_at,omitempty"`
+	// WebhookSecret is returned once, with the owner's first link webhook.
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	// Settings is what the link was created with when a settings profile
+	// applied.
+	Settings *linkSettings `json:"settings,omitempty"`
 }
 
+// reusesExisting reports whether req may be answered with an existing link.
+// Only plain links are shared: an alias, preview overrides, notes, metadata,
+// a webhook or any redirect behaviour means the caller wants a link of their own. A
+// flagged destination always gets a new link, held back for review, and a
+// password-protected one a link of its own.
+func (req ShortenRequest) reusesExisting() bool {
+	if req.ReuseExisting != nil && !*req.ReuseExisting || req.flagged() || req.Password != "" {
+		return false
+	}
+	return !req.isTest && req.CustomAlias == "" && req.OGTitle == "" && req.OGDescription == "" && req.OGImage == "" &&
+		!req.Challenge && req.ActiveFrom == nil && req.ExpiresAt == nil && !req.Hot && req.RedirectType == 0 && req.UTM == nil && req.Notes == "" && len(req.Metadata) == 0 &&
+		req.WebhookURL == ""
+}
+
+// canonicalHash is the hash req's long_url is stored and reused under.
+func (req ShortenRequest) canonicalHash() string {
+	if req.canonical == nil {
+		return globalCanonicalProfile.hash(req.LongURL)
+	}
+	return req.canonical.hash(req.LongURL)
+}
+
+// reusableLinkCondition matches the links reusesExisting requests may share.
+const reusableLinkCondition = `is_test = 0 AND status = 'active' AND og_title IS NULL AND og_description IS NULL AND og_image IS NULL
+	AND challenge = 0 AND active_from IS NULL AND expires_at IS NULL AND hot = 0 AND redirect_type IS NULL AND utm IS NULL AND notes IS NULL
+	AND webhook_url IS NULL AND NOT EXISTS (SELECT 1 FROM link_metadata m WHERE m.short_code = urls.short_code)`
+
 type ClickEvent struct {
+	ClickID   string `json:"click_id,omitempty"`
 	ShortCode string `json:"short_code"`
 	ClickedAt string `json:"clicked_at"`
+	// IsTest marks synthetic self-test events, which consumers must drop.
+	IsTest bool `json:"is_test,omitempty"`
+	// Degraded marks clicks whose redirect ran out of latency budget and
+	// skipped optional work.
+	Degraded bool `json:"degraded,omitempty"`
+	// RequestID is the redirect's X-Request-ID, as in the access log.
+	RequestID string `json:"request_id,omitempty"`
+	// Referrer, UserAgent, ClientIP and AcceptLanguage describe the
+	// visitor; see clickVisitor for what PRIVACY_MODE leaves of them.
+	Referrer       string `json:"referrer,omitempty"`
+	UserAgent      string `json:"user_agent,omitempty"`
+	ClientIP       string `json:"client_ip,omitempty"`
+	AcceptLanguage string `json:"accept_language,omitempty"`
+	// Country and City are where ClientIP is, as geoip.go finds it.
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
 }
 
-func initDB() {
+// databaseURL is DATABASE_URL, or DB_PATH (which the container image sets):
+// a postgres:// URL, or the path of the SQLite file.
+func databaseURL() string {
+	return getEnv("DATABASE_URL", getEnv("DB_PATH", "./go.db"))
+}
+
+// openDB opens s.cfg.DatabaseURL, migrates its schema and sets up the
+// store on it.
+func (s *Server) openDB() error {
+	if s.cfg.postgres() {
+		return s.openPostgres()
+	}
 	var err error
-	db, err = sql.Open("sqlite3", "./go.db")
+	s.db, err = sql.Open(timedSQLiteDriverName, sqliteDSN(s.cfg.DatabaseURL))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	configureDBPool(s.db)
 
 	createTableSQL := `CREATE TABLE IF NOT EXISTS urls (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -53,28 +227,87 @@ func initDB() {
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);`
 
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := s.db.Exec(createTableSQL); err != nil {
+		s.db.Close()
+		return err
+	}
+	if err := s.runMigrations(); err != nil {
+		s.db.Close()
+		return err
+	}
+	if s.store, err = newSQLStore(s.db); err != nil {
+		s.db.Close()
+		return err
+	}
+	if len(s.cfg.DatabaseReadURLs) > 0 {
+		log.Println("DATABASE_READ_URLS is ignored on SQLite")
 	}
 
 	log.Println("Database initialized successfully")
+	return nil
+}
+
+// nullIfEmpty maps "" to NULL for optional text columns.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullIfZero maps 0 to NULL for optional integer columns.
+func nullIfZero(n int) any {
+	if n == 0 {
+		return nil
+	}
+	return n
 }
 
-func initRedis() {
-	redisURL := getEnv("REDIS_URL", "localhost:6380")
-	
-	rdb = redis.NewClient(&redis.Options{
+// isUniqueViolation reports whether err is a UNIQUE constraint failure, or
+// an insert of a code held by a code reservation, which is taken just the
+// same. In Postgres the reservation trigger raises a unique violation.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return postgresErrorCode(err) == pgUniqueViolation
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintTrigger && strings.Contains(sqliteErr.Error(), codeReservedMessage)
+}
+
+// initRedis connects to s.cfg.RedisAddr.
+func (s *Server) initRedis() {
+	redisURL := s.cfg.RedisAddr
+
+	s.rdb = redis.NewClient(&redis.Options{
 		Addr:     redisURL,
 		Password: "", // no password
 		DB:       0,  // default DB
+		// Let per-call deadlines (the redirect budget) cut socket reads short.
+		ContextTimeoutEnabled: true,
+		// Bound every call even without a deadline, and don't stack retries
+		// on a Redis that isn't answering; the breaker handles outages.
+		DialTimeout:   getEnvDuration("REDIS_DIAL_TIMEOUT", time.Second),
+		ReadTimeout:   getEnvDuration("REDIS_READ_TIMEOUT", 500*time.Millisecond),
+		WriteTimeout:  getEnvDuration("REDIS_WRITE_TIMEOUT", 500*time.Millisecond),
+		PoolTimeout:   getEnvDuration("REDIS_POOL_TIMEOUT", time.Second),
+		MaxRetries:    1,
+		DialerRetries: 1,
 	})
 
-	// Test connection
-	_, err := rdb.Ping(ctx).Result()
-	if err != nil {
-		log.Printf("Warning: Redis connection failed: %v. Events will not be published.", err)
-		rdb = nil
+	s.rdb.AddHook(slowRedisHook{})
+	s.rdb.AddHook(redisBreakerHook{})
+	if chaosEnabled {
+		s.rdb.AddHook(chaosRedisHook{})
+	}
+
+	// Test connection. The client is kept either way: the breaker fails
+	// calls fast until a probe reaches Redis.
+	pingCtx, cancel := context.WithTimeout(context.Background(), readyProbeTimeout)
+	defer cancel()
+	if err := s.rdb.Ping(pingCtx).Err(); err != nil {
+		log.Printf("Warning: Redis connection failed: %v. Falling back to SQLite until it is reachable.", err)
+		redisCircuit.trip(time.Now())
 	} else {
 		log.Printf("Redis connected successfully at %s", redisURL)
 	}
@@ -87,179 +320,704 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func generateShortCode() string {
-	b := make([]byte, 6)
-	rand.Read(b)
-	encoded := base64.URLEncoding.EncodeToString(b)
-	// Take first 6 characters and remove any special chars
-	shortCode := encoded[:6]
-	return shortCode
+func getEnvInt(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		log.Printf("Warning: invalid integer for %s=%q, using %d", key, value, fallback)
+	}
+	return fallback
 }
 
-func createShortURL(c *gin.Context) {
+func getEnvFloat(key string, fallback float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+		log.Printf("Warning: invalid number for %s=%q, using %g", key, value, fallback)
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+		log.Printf("Warning: invalid boolean for %s=%q, using %t", key, value, fallback)
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Warning: invalid duration for %s=%q, using %s", key, value, fallback)
+	}
+	return fallback
+}
+
+// customAliasPattern is the shape of a requested alias; it is a subset of
+// shortCodePattern.
+var customAliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+// reservedAliases would shadow, or be confused with, the service's own
+// routes. They are compared case-insensitively.
+var reservedAliases = []string{"api", "admin", "health", "healthz", "readyz", "metrics", "static"}
+
+var errAliasTaken = errors.New("alias already taken")
+
+// shortCodeAttempts is how many generated codes are tried before giving up
+// with errNoFreeShortCode. Each collision is rare, so running out means the
+// code space is close to full.
+const shortCodeAttempts = 5
+
+var errNoFreeShortCode = errors.New("no free short code found")
+
+// validateCustomAlias returns a client-facing error for an unusable alias.
+func validateCustomAlias(alias string) error {
+	return validateCode("custom_alias", alias)
+}
+
+// validateCode checks a code a client chose, given as field.
+func validateCode(field, code string) error {
+	if !customAliasPattern.MatchString(code) {
+		return errors.New(field + " must be 3-32 letters, digits, '-' or '_'")
+	}
+	if slices.Contains(reservedAliases, strings.ToLower(code)) || reservedProbeAlias(code) {
+		return fmt.Errorf("%s %q is reserved", field, code)
+	}
+	return nil
+}
+
+func (s *Server) createShortURL(c *gin.Context) {
 	var req ShortenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	req.owner, req.tier, req.baseURL = c.GetString(ownerContextKey), callerTier(c), publicBaseURL(c)
+	defaultTimezone, err := s.ownerTimezone(c.Request.Context(), req.owner)
+	if err == nil {
+		req.canonical, err = s.ownerCanonicalProfile(c.Request.Context(), req.owner)
+	}
+	if err == nil {
+		err = s.applySettingsProfile(c.Request.Context(), &req, nil)
+	}
+	if errors.Is(err, errUnknownSettingsProfile) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "profile " + strconv.Quote(req.Profile) + " does not exist", "code": "unknown_profile"})
+		return
+	}
+	if errors.Is(err, errSettingsProfileNeedsOwner) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
 		return
 	}
-
-	shortCode := generateShortCode()
-
-	// Check if short code already exists (unlikely but possible)
-	var exists int
-	err := db.QueryRow("SELECT COUNT(*) FROM urls WHERE short_code = ?", shortCode).Scan(&exists)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-
-	// Regenerate if exists (very rare)
-	for exists > 0 {
-		shortCode = generateShortCode()
-		db.QueryRow("SELECT COUNT(*) FROM urls WHERE short_code = ?", shortCode).Scan(&exists)
+	if err := prepareShortenRequest(&req, defaultTimezone, time.Now()); err != nil {
+		var denial *policyDenial
+		if errors.As(err, &denial) {
+			writePolicyDenial(c, denial)
+			return
+		}
+		response := gin.H{"error": err.Error()}
+		if code := longURLErrorCode(err); code != "" {
+			response["code"] = code
+		}
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+	if !s.verifyShortenDestination(c, &req) {
+		return
 	}
 
-	_, err = db.Exec("INSERT INTO urls (short_code, long_url) VALUES (?, ?)", shortCode, req.LongURL)
+	response, err := s.storeShortURL(c.Request.Context(), req)
+	if errors.Is(err, errAliasTaken) {
+		if _, retained := s.resolveAlias(c.Request.Context(), req.CustomAlias); retained {
+			c.JSON(http.StatusConflict, gin.H{"error": "custom_alias " + strconv.Quote(req.CustomAlias) + " is held as another link's alias", "code": "alias_retained"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "custom_alias " + strconv.Quote(req.CustomAlias) + " is already taken"})
+		return
+	}
+	if errors.Is(err, errLinkWebhookLimit) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Owner already has " + strconv.Itoa(linkWebhooksPerOwner) + " links with a webhook_url", "code": "link_webhook_limit"})
+		return
+	}
+	if errors.Is(err, errDBBusy) || isBusyError(err) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	}
+	if errors.Is(err, errNoFreeShortCode) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Every generated short code collided with an existing one, try again", "code": "short_code_collision"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create short URL"})
 		return
 	}
+	if !response.Reused {
+		logSampledShorten(c, response.ShortCode, response.LongURL, req.owner)
+	}
+	writeQuotaHeaders(c)
+	c.JSON(http.StatusOK, response)
+}
+
+// prepareShortenRequest validates req and normalizes it in place, reading
+// local times in defaultTimezone when req names none. Its errors are
+// client-facing; a rejected long_url is a *longURLError.
+func prepareShortenRequest(req *ShortenRequest, defaultTimezone string, now time.Time) error {
+	longURL, err := normalizeLongURL(req.LongURL)
+	if err != nil {
+		return err
+	}
+	req.LongURL = longURL
+	if err := validateOpenGraph(req.OGTitle, req.OGDescription, req.OGImage); err != nil {
+		return err
+	}
+	if err := validateLinkAnnotations(req.Notes, req.Metadata); err != nil {
+		return err
+	}
+	if err := validateRedirectType(req.RedirectType); err != nil {
+		return err
+	}
+	if req.UTM != nil {
+		if err := validateLinkUTM(req.UTM); err != nil {
+			return err
+		}
+		if req.UTM.encode() == "" {
+			req.UTM = nil
+		}
+	}
+	if err := resolveTimezone(req, defaultTimezone); err != nil {
+		return err
+	}
+	if err := resolveExpiry(req, now); err != nil {
+		return err
+	}
+	if req.Password != "" {
+		if err := validateLinkPassword(req.Password); err != nil {
+			return err
+		}
+		hash, err := hashLinkPassword(req.Password)
+		if err != nil {
+			return err
+		}
+		req.passwordHash = hash
+	}
+	if req.CustomAlias != "" {
+		if err := validateCustomAlias(req.CustomAlias); err != nil {
+			return err
+		}
+	}
+	if req.WebhookURL != "" {
+		if err := validateLinkWebhook(req); err != nil {
+			return err
+		}
+	}
+	return applyTierPolicy(req, now)
+}
+
+// storeShortURL stores an already validated request, collapsing a request
+// that reusesExisting with identical ones in flight; see shortendedupe.go.
+func (s *Server) storeShortURL(ctx context.Context, req ShortenRequest) (ShortenResponse, error) {
+	if req.reusesExisting() {
+		return s.storeShortURLOnce(ctx, req)
+	}
+	return s.storeShortURLNow(ctx, req)
+}
 
+// storeShortURLNow inserts an already validated request under its custom
+// alias or a generated code, retrying while the database is busy. A taken
+// alias returns errAliasTaken; a generated code that is taken is replaced
+// and the insert retried, up to shortCodeAttempts times. A request that
+// reusesExisting gets the oldest matching link back instead, if there is one.
+func (s *Server) storeShortURLNow(ctx context.Context, req ShortenRequest) (ShortenResponse, error) {
+	req.claim = req.newLinkClaim(time.Now())
+	if req.WebhookURL != "" {
+		if err := s.checkLinkWebhookLimit(ctx, req.owner, 1); err != nil {
+			return ShortenResponse{}, err
+		}
+	}
+	if req.CustomAlias != "" {
+		response, err := s.insertShortURL(ctx, req, req.CustomAlias)
+		if errors.Is(err, errCodeTaken) {
+			return ShortenResponse{}, errAliasTaken
+		}
+		return response, err
+	}
+
+	for range shortCodeAttempts {
+		shortCode, err := drawShortCode(ctx, s.db)
+		if err != nil {
+			return ShortenResponse{}, err
+		}
+		response, err := s.insertShortURL(ctx, req, shortCode)
+		collided := errors.Is(err, errCodeTaken)
+		recordShortCodeDraw(collided)
+		if !collided {
+			return response, err
+		}
+	}
+	log.Printf("No free short code after %d attempts", shortCodeAttempts)
+	return ShortenResponse{}, errNoFreeShortCode
+}
+
+// insertShortURL stores req under shortCode and announces the new link.
+// The unique index on short_code is the only collision check, so
+// concurrent inserts can't both claim a code.
+func (s *Server) insertShortURL(ctx context.Context, req ShortenRequest, shortCode string) (ShortenResponse, error) {
+	link, err := s.store.Create(ctx, req, shortCode)
+	if err != nil {
+		return ShortenResponse{}, err
+	}
+	if link.Reused {
+		req.LongURL = link.LongURL
+		return s.shortenResponse(ctx, req, link.ShortCode, true), nil
+	}
+
+	log.Printf("Created short URL: %s -> %s", shortCode, redactURL(req.LongURL))
+	s.cacheNewLink(ctx, req, shortCode)
+	recordLinkCreated(req.owner)
+	if !req.isTest {
+		s.publishLifecycleEvent(context.WithoutCancel(ctx), eventURLCreated, shortCode)
+	}
+	response := s.shortenResponse(ctx, req, shortCode, false)
+	if req.claim != nil {
+		response.ClaimToken, response.ClaimTokenExpiresAt = req.claim.Token, req.claim.ExpiresAt
+	}
+	if req.WebhookURL != "" {
+		response.WebhookSecret = s.issueLinkWebhookSecret(ctx, req.owner)
+	}
+	return response, nil
+}
+
+// findReusableQuery finds the link a reusesExisting request gets back, and
+// the destination it keeps.
+const findReusableQuery = "SELECT short_code, long_url FROM urls WHERE canonical_hash = ? AND owner IS ? AND " + reusableLinkCondition + " ORDER BY id LIMIT 1"
+
+const (
+	shortenInsertQuery        = "INSERT INTO urls (short_code, long_url, og_title, og_description, og_image, challenge, active_from, expires_at, timezone, is_test, owner, hot, redirect_type, notes, scan_status, canonical_hash, resolved_url, resolved_status, destination_problem, password_hash, utm, destination_host, webhook_url) SELECT ?, ?, ?, ?, ?, CAST(? AS INTEGER), ?, ?, ?, CAST(? AS INTEGER), ?, CAST(? AS INTEGER), CAST(? AS INTEGER), ?, ?, ?, ?, CAST(? AS INTEGER), ?, ?, ?, ?, ?"
+	shortenInsertReusingQuery = shortenInsertQuery + " WHERE NOT EXISTS (SELECT 1 FROM urls WHERE canonical_hash = ? AND owner IS ? AND " + reusableLinkCondition + ")"
+)
+
+// shortenInsert builds the insert for a validated request. When reusing,
+// the existence check and the insert are one statement, so concurrent
+// requests for the same URL can't both create a link; no row is inserted
+// when a reusable one exists.
+func shortenInsert(req ShortenRequest, shortCode string) (string, []any) {
+	activeFrom, expiresAt := req.linkTimes()
+	canonicalHash := req.canonicalHash()
+	scanStatus := initialScanStatus(req.isTest)
+	var resolvedURL, resolvedStatus, destinationProblem any
+	if d := req.destination; d != nil && d.Skipped == "" {
+		resolvedURL, resolvedStatus, destinationProblem = d.ResolvedURL, nullIfZero(d.Status), nullIfEmpty(d.Problem)
+	}
+	if req.flagged() {
+		scanStatus = scanPending
+	}
+	query := shortenInsertQuery
+	args := []any{shortCode, req.LongURL, nullIfEmpty(req.OGTitle), nullIfEmpty(req.OGDescription), nullIfEmpty(req.OGImage), req.Challenge, nullIfEmpty(activeFrom), nullIfEmpty(expiresAt), nullIfEmpty(req.Timezone), req.isTest, nullIfEmpty(req.owner), req.Hot, nullIfZero(req.RedirectType), nullIfEmpty(req.Notes), scanStatus, canonicalHash, resolvedURL, resolvedStatus, destinationProblem, nullIfEmpty(req.passwordHash), nullIfEmpty(req.UTM.encode()), destinationHost(req.LongURL), nullIfEmpty(req.WebhookURL)}
+	if req.reusesExisting() {
+		query = shortenInsertReusingQuery
+		args = append(args, canonicalHash, nullIfEmpty(req.owner))
+	}
+	return query, args
+}
+
+// flagged reports whether the destination check found a problem the link
+// was stored with anyway.
+func (req ShortenRequest) flagged() bool {
+	return req.destination != nil && req.destination.Problem != ""
+}
+
+// linkTimes returns active_from and expires_at as stored, "" when unset.
+func (req ShortenRequest) linkTimes() (activeFrom, expiresAt string) {
+	if req.ActiveFrom != nil {
+		activeFrom = req.ActiveFrom.UTC().Format(time.RFC3339)
+	}
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return activeFrom, expiresAt
+}
+
+// shortenResponse describes the link stored for req under shortCode.
+func (s *Server) shortenResponse(ctx context.Context, req ShortenRequest, shortCode string, reused bool) ShortenResponse {
+	activeFrom, expiresAt := req.linkTimes()
 	response := ShortenResponse{
-		ShortCode: shortCode,
-		ShortURL:  "http://localhost:8000/" + shortCode,
-		LongURL:   req.LongURL,
+		ShortCode:    shortCode,
+		ShortURL:     shortURLFor(req.baseURL, shortCode),
+		LongURL:      req.LongURL,
+		ActiveFrom:   activeFrom,
+		ExpiresAt:    expiresAt,
+		Verified:     s.linkVerified(ctx, req.owner, req.LongURL),
+		RedirectType: req.RedirectType,
+		UTM:          req.UTM,
+		Reused:       reused,
+		Settings:     req.settings(),
+	}
+	if d := req.destination; d != nil && !reused {
+		if d.Skipped != "" {
+			response.DestinationCheckSkipped = d.Skipped
+		} else {
+			response.ResolvedURL, response.ResolvedStatus, response.DestinationProblem = d.ResolvedURL, d.Status, d.Problem
+		}
+	}
+	if loc, err := loadTimezone(req.Timezone); req.Timezone != "" && err == nil {
+		response.Timezone = req.Timezone
+		if req.ActiveFrom != nil {
+			response.ActiveFromLocal = req.ActiveFrom.In(loc).Format(time.RFC3339)
+		}
+		if req.ExpiresAt != nil {
+			response.ExpiresAtLocal = req.ExpiresAt.In(loc).Format(time.RFC3339)
+		}
 	}
+	return response
+}
 
-	log.Printf("Created short URL: %s -> %s", shortCode, req.LongURL)
-	c.JSON(http.StatusOK, response)
+// urlCacheKeyPrefix namespaces short code lookups in Redis.
+const urlCacheKeyPrefix = "url:"
+
+func urlCacheKey(shortCode string) string {
+	return urlCacheKeyPrefix + shortCode
 }
 
-func redirect(c *gin.Context) {
-	shortCode := c.Param("code")
-	var longURL string
+func (s *Server) redirect(c *gin.Context) {
+	s.serveRedirect(c, c.Param("code"))
+}
+
+// serveRedirect answers a redirect for shortCode: the code asked for or,
+// for an alias of a renamed link, the link's code.
+func (s *Server) serveRedirect(c *gin.Context, shortCode string) {
+	cacheKey := urlCacheKey(shortCode)
+
+	// Link-unfurling bots get the OpenGraph preview and are not counted.
+	if isPreviewCrawler(c.Request.UserAgent()) {
+		s.servePreview(c, shortCode)
+		return
+	}
+
+	budget := newLatencyBudget(time.Now())
+
+	// Hot codes are answered from the in-process cache, without a Redis
+	// round trip.
+	if link, ok := localLinks.get(shortCode, time.Now()); ok {
+		setRedirectOutcome(c, redirectOutcomeCacheHit)
+		s.serveCachedLink(c, shortCode, link, budget)
+		return
+	}
+	if localLinks.getMiss(shortCode, time.Now()) {
+		setRedirectOutcome(c, redirectOutcomeNegativeCacheHit)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	}
 
-	// Try Redis cache first (if available)
-	if rdb != nil {
-		cachedURL, err := rdb.Get(ctx, "url:"+shortCode).Result()
+	// Then the Redis cache (if available), within the cache budget
+	if s.rdb != nil {
+		cacheCtx, cancel := budget.cacheContext(c.Request.Context())
+		cached, err := s.rdb.Get(cacheCtx, cacheKey).Result()
+		cancel()
+		if err == nil && cached == notFoundSentinel {
+			cacheMissLocally(shortCode, notFoundTTL())
+			setRedirectOutcome(c, redirectOutcomeNegativeCacheHit)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return
+		}
 		if err == nil {
-			log.Printf("Cache hit for %s", shortCode)
-			longURL = cachedURL
-			// Publish click event to Redis
-			go publishClickEvent(shortCode)
-			c.Redirect(http.StatusMovedPermanently, longURL)
+			setRedirectOutcome(c, redirectOutcomeCacheHit)
+			link := decodeCachedLink(cached)
+			// The golden link has to keep exercising Redis.
+			if !isProbeCode(shortCode) {
+				localLinks.put(shortCode, link, time.Now())
+			}
+			s.serveCachedLink(c, shortCode, link, budget)
 			return
 		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			budget.degrade("cache_timeouts")
+		}
 	}
 
-	// Cache miss or Redis unavailable - query database
-	err := db.QueryRow("SELECT long_url FROM urls WHERE short_code = ?", shortCode).Scan(&longURL)
+	// Cache miss or Redis unavailable - query the store with what is left
+	storeCtx, cancel := budget.context(c.Request.Context())
+	stored, err := s.store.GetLongURL(storeCtx, shortCode)
+	cancel()
 	if err != nil {
 		if err == sql.ErrNoRows {
+			// Aliases are rare, so they are only looked up on a miss,
+			// and their hits are cached and counted as the link's.
+			if code, ok := s.resolveAlias(c.Request.Context(), shortCode); ok && code != shortCode {
+				s.serveRedirect(c, code)
+				return
+			}
+			if resolverOnly && resolverProxyMisses && proxyUpstreamLookup(c, shortCode) {
+				return
+			}
+			s.recordNotFound(c.Request.Context(), shortCode)
 			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
 			return
 		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			redirectBudgetStats.Add("db_timeouts", 1)
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable"})
+			return
+		}
+		if errors.Is(err, errDBBusy) {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	// Cache the URL in Redis (1 hour TTL)
-	if rdb != nil {
-		rdb.Set(ctx, "url:"+shortCode, longURL, 1*time.Hour)
-		log.Printf("Cached URL for %s", shortCode)
+	// Scheduled links look exactly like missing ones until they go live, and
+	// are only cached from then on, so no cache entry predates activation.
+	now := time.Now()
+	if !linkActive(stored.ActiveFrom, now) {
+		setRedirectOutcome(c, redirectOutcomeNotFound)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	}
+	setRedirectOutcome(c, redirectOutcomeCacheMiss)
+	// Disabled and deleted links are not cached; a status change purges
+	// the entry of an active one.
+	if stored.Status != linkStatusActive {
+		writeLinkUnavailable(c, stored.Status)
+		return
+	}
+	if linkExpired(stored.ExpiresAt, now) {
+		expiredAt, _ := time.Parse(time.RFC3339, stored.ExpiresAt.String)
+		writeLinkExpired(c, expiredAt)
+		return
+	}
+	// Quarantined links are not cached until a clean verdict releases them.
+	if scanBlocked(stored.ScanStatus) {
+		writeScanBlocked(c, stored.ScanStatus)
+		return
+	}
+	if stored.ActiveFrom.Valid && !stored.Activated {
+		go s.markActivated(context.WithoutCancel(c.Request.Context()), shortCode)
 	}
 
-	// Publish click event to Redis (or fallback to HTTP)
-	go publishClickEvent(shortCode)
-
-	// Redirect to the long URL
-	c.Redirect(http.StatusMovedPermanently, longURL)
-}
-
-func publishClickEvent(shortCode string) {
-	event := ClickEvent{
-		ShortCode: shortCode,
-		ClickedAt: time.Now().Format(time.RFC3339),
+	// Password-protected links are never cached either, and only unlocked
+	// hits are counted.
+	if stored.PasswordHash.Valid && !passesPassword(c, shortCode, stored.PasswordHash.String) {
+		return
 	}
 
-	// Try Redis Pub/Sub first
-	if rdb != nil {
-		jsonData, err := json.Marshal(event)
-		if err != nil {
-			log.Printf("Error marshaling event: %v", err)
-			return
+	// Challenge links are never cached, so every hit goes through the check,
+	// and only the post-challenge hit counts as a click.
+	if stored.Challenge {
+		if s.passesChallenge(c, shortCode) {
+			s.enqueueClick(c, shortCode, false, budget.degraded)
+			destination := utmDestination(c, stored.LongURL, stored.UTM.String)
+			s.shadowDestination(c, shortCode, stored.LongURL, stored.UTM.String, destination)
+			redirectPrivately(c, redirectStatus(int(stored.RedirectType.Int64), stored.ExpiresAt.Valid), destination)
 		}
+		return
+	}
 
-		err = rdb.Publish(ctx, "click_events", jsonData).Err()
-		if err != nil {
-			log.Printf("Redis publish error: %v, falling back to HTTP", err)
-			// Fallback to HTTP if Redis fails
-			sendClickEventHTTP(shortCode)
+	// Cache the URL in Redis (1 hour TTL, or until it expires), without
+	// the UTM parameters, which are merged in on every hit. This is
+	// optional work: skip it once the budget is spent, the next hit will
+	// try again.
+	if s.rdb != nil && !stored.PasswordHash.Valid {
+		if budget.spent() {
+			budget.degrade("skipped_cache_write")
 		} else {
-			log.Printf("✅ Click event published to Redis: %s", shortCode)
+			setCtx, cancel := budget.context(c.Request.Context())
+			s.rdb.Set(setCtx, cacheKey, encodeCachedLink(stored.LongURL, stored.Hot, int(stored.RedirectType.Int64), stored.ExpiresAt, stored.UTM.String), linkCacheTTL(stored.ExpiresAt, now))
+			cancel()
+			slog.Debug("cached URL", "short_code", shortCode)
 		}
-	} else {
-		// No Redis available, use HTTP fallback
-		sendClickEventHTTP(shortCode)
 	}
-}
+	if !stored.PasswordHash.Valid && !stored.IsTest {
+		localLinks.put(shortCode, newCachedLink(stored.LongURL, stored.Hot, int(stored.RedirectType.Int64), stored.ExpiresAt, stored.UTM.String), now)
+	}
 
-func sendClickEventHTTP(shortCode string) {
-	event := ClickEvent{
-		ShortCode: shortCode,
-		ClickedAt: time.Now().Format(time.RFC3339),
+	if stored.Hot || hotLinks.isHot(shortCode) {
+		sendEarlyHints(c, destinationOrigin(stored.LongURL))
 	}
 
-	jsonData, err := json.Marshal(event)
-	if err != nil {
-		log.Printf("Error marshaling event: %v", err)
-		return
+	// Publish click event to Redis (or fallback to HTTP). Self-test links
+	// are never counted.
+	if !stored.IsTest {
+		s.enqueueClick(c, shortCode, false, budget.degraded)
 	}
 
-	client := &http.Client{Timeout: 2 * time.Second}
-	resp, err := client.Post(pythonServiceURL+"/api/events", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("Error sending event to Python service: %v", err)
+	// Redirect to the long URL
+	destination := utmDestination(c, stored.LongURL, stored.UTM.String)
+	s.shadowDestination(c, shortCode, stored.LongURL, stored.UTM.String, destination)
+	redirectTo(c, redirectStatus(int(stored.RedirectType.Int64), stored.ExpiresAt.Valid), destination)
+}
+
+// serveCachedLink redirects to a link found in the local or Redis cache.
+func (s *Server) serveCachedLink(c *gin.Context, shortCode string, link cachedLink, budget *latencyBudget) {
+	if link.ExpiresAt != 0 && !time.Now().Before(time.Unix(link.ExpiresAt, 0)) {
+		writeLinkExpired(c, time.Unix(link.ExpiresAt, 0))
 		return
 	}
-	defer resp.Body.Close()
+	if link.Hot || hotLinks.isHot(shortCode) {
+		sendEarlyHints(c, link.Origin)
+	}
+	// Publish click event to Redis; the golden link is a test link,
+	// which the cache doesn't record.
+	if !isProbeCode(shortCode) {
+		s.enqueueClick(c, shortCode, true, budget.degraded)
+	}
+	destination := utmDestination(c, link.LongURL, link.UTM)
+	s.shadowDestination(c, shortCode, link.LongURL, link.UTM, destination)
+	redirectTo(c, redirectStatus(link.RedirectType, link.ExpiresAt != 0), destination)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Python service returned status: %d", resp.StatusCode)
-	} else {
-		log.Printf("Click event sent via HTTP for: %s", shortCode)
+// initSettings validates the configuration. Settings errors end the
+// process.
+func initSettings() {
+	initShortCodes()
+	initBaseURL()
+	initScanQuarantine()
+	initRedirectLimit()
+	initRedirectStatus()
+	initDestinationCheck()
+	initWebhooks()
+	initGRPC()
+
+	initLogging()
+	initLogSampling()
+	initMaintenance()
+	initOutboundProxy()
+}
+
+// start starts the background jobs and click publishers, and registers
+// the shutdown hooks that close Redis and the database after them.
+func (s *Server) start() {
+	app.OnShutdown("database", 5*time.Second, func(context.Context) error { return s.db.Close() })
+	if s.rdb != nil {
+		app.OnShutdown("redis", 5*time.Second, func(context.Context) error { return s.rdb.Close() })
+	}
+	s.initProbeLink()
+	s.startLocalCache()
+
+	s.registerPoolStatsCollector()
+	s.registerReplicaCheck()
+	s.registerStorageMigration()
+	if resolverOnly {
+		s.initResolver()
+		s.registerResolverSync()
+	}
+	s.startHTTPEventBatcher()
+	s.startWebhooks()
+	s.startClickRollups()
+	loadGeoIP()
+	s.startEventFanout()
+	registerOutboundPolicyReload()
+	s.startClickPublishers(4)
+	s.startClickStream()
+	s.registerClickCounterFlusher()
+	registerRealtimePruner()
+	if !resolverOnly {
+		s.registerDomainVerifier()
 	}
+	registerHotLinkTracker()
+	s.registerChangesCompactor()
+	s.registerExpiredLinkReaper()
+	s.registerIdempotencyKeyReaper()
+	s.registerScanTimeouts()
+	registerRateLimitPruner()
+	s.registerQuotaWarningPruner()
+	s.registerNamespaceMonitor()
+	s.registerRedisProbe()
+	s.registerRedisBreakerProbe()
+	s.registerClickExporter()
+	app.start()
 }
 
 func main() {
-	initDB()
-	defer db.Close()
-
-	initRedis()
-	if rdb != nil {
-		defer rdb.Close()
+	selfTest := flag.Bool("self-test", false, "run the pipeline self-test against the configured backends and exit")
+	verify := flag.Bool("verify", false, "check database and cache integrity, print a report and exit")
+	fix := flag.Bool("fix", false, "with --verify, repair orphaned rows and stale cache entries")
+	backfillCanonical := flag.Bool("backfill-canonical", false, "recompute every link's canonical URL hash under the current profiles and exit")
+	flag.Parse()
+	initSettings()
+	s, err := NewServer(configFromEnv())
+	if err != nil {
+		log.Fatalf("Error opening the database: %v", err)
 	}
+	s.start()
 
-	r := gin.Default()
+	if *selfTest {
+		os.Exit(s.runSelfTestCLI())
+	}
+	if *verify {
+		os.Exit(s.runVerifyCLI(*fix))
+	}
+	if *backfillCanonical {
+		os.Exit(s.runCanonicalBackfillCLI())
+	}
 
-	// CORS middleware
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	r := s.newRouter()
+	s.startCacheWarming()
+	s.startGRPC()
+	if resolverOnly {
+		log.Printf("Go service starting on :8000 (resolver-only, upstream %s)", resolverUpstreamURL)
+	} else {
+		log.Println("Go service starting on :8000")
+	}
+	serve(r)
+}
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(http.StatusOK)
-			return
-		}
+// shutdownTimeout bounds how long in-flight requests get to finish once
+// SIGTERM arrives; keep it under the orchestrator's kill grace period.
+var shutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second)
 
-		c.Next()
-	})
+// serve runs r on :8000 until SIGINT or SIGTERM.
+func serve(r *gin.Engine) {
+	ln, err := net.Listen("tcp", ":8000")
+	if err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+	serveOn(ln, r)
+}
 
-	// Routes
-	r.POST("/api/shorten", createShortURL)
-	r.GET("/:code", redirect)
+// serveOn runs r on ln until SIGINT or SIGTERM. It then stops accepting
+// connections, waits up to SHUTDOWN_TIMEOUT for in-flight requests, and
+// stops the app, whose shutdown hooks drain click events before Redis and
+// the database are closed. Requests still running at the timeout have their
+// contexts cancelled.
+func serveOn(ln net.Listener, r *gin.Engine) {
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := &http.Server{
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
+	}
 
-	log.Println("Go service starting on :8000")
-	r.Run(":8000")
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+	<-stopped.Done()
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Requests still running after %s, closing them: %v", shutdownTimeout, err)
+		cancelRequests()
+		srv.Close()
+	}
+	app.stop()
 }
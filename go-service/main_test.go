@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// testAdminToken is ADMIN_TOKEN for the tests.
+const testAdminToken = "test-admin-token"
+
+// testServer is the Server the tests run against.
+var testServer *Server
+
+// TestMain runs the tests against a throwaway SQLite database, or the
+// Postgres database at TEST_DATABASE_URL when it is set, without Redis
+// unless a test asks for one with useRedis, and with click events that
+// fall back to HTTP sent to a stub Python service.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	gin.SetMode(gin.TestMode)
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		redis.SetLogger(discardRedisLogger{})
+	}
+
+	dir, err := os.MkdirTemp("", "urlshortener-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	python := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	adminToken = testAdminToken
+	// Tests that shorten over HTTP would soon hit the limits, and the
+	// anonymous tier's expiry cap; the ones about them turn them back on.
+	shortenLimitPerMinute = 0
+	for tier, p := range tierPolicies {
+		p.ShortenPerMinute, p.MaxExpirySeconds = 0, 0
+		tierPolicies[tier] = p
+	}
+
+	initShortCodes()
+	initRedirectLimit()
+	databaseURL := filepath.Join(dir, "test.db")
+	if url := os.Getenv("TEST_DATABASE_URL"); url != "" {
+		databaseURL = url
+	}
+	testServer, err = NewServer(Config{DatabaseURL: databaseURL, PythonServiceURL: python.URL})
+	if err != nil {
+		log.Fatal(err)
+	}
+	testServer.startLocalCache()
+	testServer.startClickPublishers(4)
+
+	code := m.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	testServer.drainClickEvents(ctx)
+	cancel()
+	python.Close()
+	testServer.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type discardRedisLogger struct{}
+
+func (discardRedisLogger) Printf(context.Context, string, ...any) {}
+
+// useRedis points testServer.rdb at a fresh in-memory Redis for the rest of the test.
+// Clicks still being published are waited for first, before and after.
+func useRedis(tb testing.TB) *miniredis.Miniredis {
+	tb.Helper()
+	mr := miniredis.RunT(tb)
+	testServer.clickJobs.Wait()
+	testServer.rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	tb.Cleanup(func() {
+		testServer.clickJobs.Wait()
+		testServer.rdb.Close()
+		testServer.rdb = nil
+	})
+	return mr
+}
+
+// shortenForTest stores req as createShortURL would for owner.
+func shortenForTest(tb testing.TB, req ShortenRequest, owner string) ShortenResponse {
+	tb.Helper()
+	req.owner, req.baseURL = owner, "http://short.test"
+	if err := prepareShortenRequest(&req, "", time.Now()); err != nil {
+		tb.Fatalf("prepareShortenRequest(%q): %v", req.LongURL, err)
+	}
+	response, err := testServer.storeShortURL(context.Background(), req)
+	if err != nil {
+		tb.Fatalf("storeShortURL(%q): %v", req.LongURL, err)
+	}
+	return response
+}
+
+// serveTest sends a request with body (which may be empty) and headers, as
+// "Name: value" pairs, to h.
+func serveTest(h http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ": ")
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// newTestAPIKey creates an API key and returns its ID, which owns what it
+// creates, and the key to send.
+func newTestAPIKey(tb testing.TB, admin bool) (id, key string) {
+	tb.Helper()
+	id, secret := apiKeyIDPrefix+newRandomID()[:16], newRandomID()
+	_, err := testServer.db.Exec("INSERT INTO api_keys (id, name, secret_hash, admin, created_at) VALUES (?, ?, ?, ?, ?)",
+		id, tb.Name(), hashAPIKeySecret(secret), admin, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return id, id + "." + secret
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maintenance mode keeps redirects and read-only endpoints up while the
+// database is being moved: every mutating request gets a 503, and the
+// background jobs that write pause. Outbound click delivery keeps running,
+// since it writes nothing here.
+var maintenanceRetryAfter = getEnvDuration("MAINTENANCE_RETRY_AFTER", time.Minute)
+
+var maintenanceMode atomic.Bool
+
+// initMaintenance applies MAINTENANCE_MODE at startup; PUT
+// /admin/maintenance changes it at runtime.
+func initMaintenance() {
+	if getEnvBool("MAINTENANCE_MODE", false) {
+		maintenanceMode.Store(true)
+		slog.Warn("maintenance mode entered", "audit", true, "by", "MAINTENANCE_MODE")
+	}
+}
+
+func inMaintenance() bool {
+	return maintenanceMode.Load()
+}
+
+// maintenanceGuard refuses writes while maintenance mode is on. GET, HEAD
+// and OPTIONS pass, as does the admin API so the mode can be turned off.
+func maintenanceGuard(c *gin.Context) {
+	if !inMaintenance() || strings.HasPrefix(c.Request.URL.Path, "/admin/") {
+		c.Next()
+		return
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"error": "Service is in maintenance mode, try again later",
+		"code":  "maintenance",
+	})
+}
+
+type maintenanceRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+	// Reason is recorded in the audit log line.
+	Reason string `json:"reason"`
+}
+
+func getMaintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"enabled": inMaintenance()})
+}
+
+func putMaintenance(c *gin.Context) {
+	var req maintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if maintenanceMode.Swap(*req.Enabled) != *req.Enabled {
+		msg := "maintenance mode exited"
+		if *req.Enabled {
+			msg = "maintenance mode entered"
+		}
+		slog.Warn(msg, "audit", true, "by", clientIP(c), "reason", req.Reason)
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": *req.Enabled})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// GET /metrics serves Prometheus metrics. Like the probes it is
+// unauthenticated and left out of the access log; expvar's
+// /admin/debug/vars keeps the finer-grained internal counters.
+const metricsPath = "/metrics"
+
+// Outcomes of a redirect as labeled in urlshortener_redirects_total.
+// Handlers other than cache hits and misses are classified by status.
+const (
+	redirectOutcomeCacheHit         = "cache_hit"
+	redirectOutcomeCacheMiss        = "cache_miss"
+	redirectOutcomeNotFound         = "not_found"
+	redirectOutcomeNegativeCacheHit = "negative_cache_hit"
+	redirectOutcomeError            = "error"
+	redirectOutcomeOther            = "other"
+)
+
+const redirectOutcomeContextKey = "redirect_outcome"
+
+var (
+	shortenRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortener_shorten_requests_total",
+		Help: "Shorten requests by route and HTTP status.",
+	}, []string{"route", "status"})
+	redirectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortener_redirects_total",
+		Help: "Redirect requests by outcome: cache_hit, cache_miss, not_found (looked up in the database), negative_cache_hit (a cached not found), error or other.",
+	}, []string{"outcome"})
+	redirectDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "urlshortener_redirect_duration_seconds",
+		Help:    "Time to answer a redirect request.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	})
+	clickEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortener_click_events_total",
+		Help: "Click events by transport (redis, stream or http) and result (ok, error, queued for an HTTP batch, or buffered or spilled while the stream is unavailable).",
+	}, []string{"transport", "result"})
+	redisUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "urlshortener_redis_up",
+		Help: "Whether the last Redis ping succeeded (0 when Redis is not configured).",
+	})
+)
+
+var metricsHandler = gin.WrapH(promhttp.Handler())
+
+// shortenMetrics counts shorten requests by the status they got.
+func shortenMetrics(c *gin.Context) {
+	c.Next()
+	shortenRequestsTotal.WithLabelValues(c.FullPath(), strconv.Itoa(c.Writer.Status())).Inc()
+}
+
+// redirectMetrics times the redirect route and counts its outcome, as
+// redirect reported it with setRedirectOutcome or else by status.
+func redirectMetrics(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	elapsed := time.Since(start)
+	redirectDuration.Observe(elapsed.Seconds())
+
+	outcome := c.GetString(redirectOutcomeContextKey)
+	if outcome == "" {
+		switch status := c.Writer.Status(); {
+		case status == http.StatusNotFound:
+			outcome = redirectOutcomeNotFound
+		case status >= 500:
+			outcome = redirectOutcomeError
+		default:
+			outcome = redirectOutcomeOther
+		}
+	}
+	redirectsTotal.WithLabelValues(outcome).Inc()
+	logSampledRedirect(c, outcome, elapsed)
+}
+
+// setRedirectOutcome records where redirect found the link.
+func setRedirectOutcome(c *gin.Context, outcome string) {
+	c.Set(redirectOutcomeContextKey, outcome)
+}
+
+// countClickEvents counts n click events sent over transport.
+func countClickEvents(transport, result string, n int) {
+	clickEventsTotal.WithLabelValues(transport, result).Add(float64(n))
+}
+
+// registerRedisProbe keeps urlshortener_redis_up current.
+func (s *Server) registerRedisProbe() {
+	app.RegisterBackgroundJob("redis_probe", 15*time.Second, func(ctx context.Context) error {
+		if s.rdb == nil {
+			redisUp.Set(0)
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+		defer cancel()
+		if err := s.rdb.Ping(ctx).Err(); err != nil {
+			redisUp.Set(0)
+			if redisUnavailable(err) {
+				return nil
+			}
+			return err
+		}
+		redisUp.Set(1)
+		return nil
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	mr := useRedis(t)
+	withLocalCache(t, 0)
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	redirects := func(outcome string) float64 { return testutil.ToFloat64(redirectsTotal.WithLabelValues(outcome)) }
+	published := func() float64 { return testutil.ToFloat64(clickEventsTotal.WithLabelValues("redis", "ok")) }
+	shortens := func(status string) float64 {
+		return testutil.ToFloat64(shortenRequestsTotal.WithLabelValues("/api/shorten", status))
+	}
+
+	ok, bad := shortens("200"), shortens("400")
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/metrics","custom_alias":"metrics-hit"}`, "X-API-Key: "+key)
+	serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"not a url"}`, "X-API-Key: "+key)
+	if w.Code != http.StatusOK || shortens("200")-ok != 1 || shortens("400")-bad != 1 {
+		t.Errorf("shorten = %d; counted %v ok and %v bad, want 1 each", w.Code, shortens("200")-ok, shortens("400")-bad)
+	}
+
+	// The link was cached when it was created; with the entry gone the first
+	// redirect reads the database and caches it again, the second is a hit.
+	mr.Del(urlCacheKey("metrics-hit"))
+	hit, miss, notFound, events := redirects(redirectOutcomeCacheHit), redirects(redirectOutcomeCacheMiss), redirects(redirectOutcomeNotFound), published()
+	serveTest(r, http.MethodGet, "/metrics-hit", "")
+	if redirects(redirectOutcomeCacheMiss)-miss != 1 || redirects(redirectOutcomeCacheHit) != hit {
+		t.Errorf("first redirect counted %v misses and %v hits, want a miss", redirects(redirectOutcomeCacheMiss)-miss, redirects(redirectOutcomeCacheHit)-hit)
+	}
+	serveTest(r, http.MethodGet, "/metrics-hit", "")
+	if redirects(redirectOutcomeCacheHit)-hit != 1 || redirects(redirectOutcomeCacheMiss)-miss != 1 {
+		t.Errorf("second redirect counted %v hits, want 1", redirects(redirectOutcomeCacheHit)-hit)
+	}
+	serveTest(r, http.MethodGet, "/metrics-missing", "")
+	if redirects(redirectOutcomeNotFound)-notFound != 1 {
+		t.Errorf("missing code counted %v not_found, want 1", redirects(redirectOutcomeNotFound)-notFound)
+	}
+	testServer.clickJobs.Wait()
+	if got := published() - events; got != 2 {
+		t.Errorf("%v click events published to Redis, want 2", got)
+	}
+
+	saved := app
+	app = &App{}
+	t.Cleanup(func() { app = saved })
+	testServer.registerRedisProbe()
+	probe := app.jobs[0].run
+	if err := probe(context.Background()); err != nil || testutil.ToFloat64(redisUp) != 1 {
+		t.Errorf("probe with Redis up: %v, gauge %v", err, testutil.ToFloat64(redisUp))
+	}
+	mr.Close()
+	probe(context.Background())
+	if testutil.ToFloat64(redisUp) != 0 {
+		t.Errorf("gauge with Redis down = %v, want 0", testutil.ToFloat64(redisUp))
+	}
+
+	w = serveTest(r, http.MethodGet, metricsPath, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", w.Code)
+	}
+	for _, name := range []string{
+		"urlshortener_shorten_requests_total",
+		"urlshortener_redirects_total",
+		"urlshortener_redirect_duration_seconds_bucket",
+		"urlshortener_click_events_total",
+		"urlshortener_redis_up",
+		"go_goroutines",
+	} {
+		if !strings.Contains(w.Body.String(), "\n"+name) {
+			t.Errorf("/metrics has no %s", name)
+		}
+	}
+	if !strings.Contains(w.Body.String(), `urlshortener_redirects_total{outcome="cache_hit"}`) {
+		t.Error("/metrics has no cache_hit redirects")
+	}
+}
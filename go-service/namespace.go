@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A generated code collides with an existing one with probability equal to
+// the share of its length's namespace already in use, so the collision rate
+// is the early warning that SHORT_CODE_LENGTH is filling up. Draws and
+// collisions are counted per hour in memory; utilization is counted from
+// the urls table by GET /admin/namespace and the namespace_monitor job,
+// which logs a WARN alert once utilization of the generated length crosses
+// NAMESPACE_WARN_UTILIZATION. NAMESPACE_PRACTICAL_UTILIZATION is where the
+// length stops being practical: at 0.5, every other draw collides and
+// about 3% of creates exhaust shortCodeAttempts.
+var (
+	namespaceWarnUtilization      = getEnvFloat("NAMESPACE_WARN_UTILIZATION", 0.25)
+	namespacePracticalUtilization = getEnvFloat("NAMESPACE_PRACTICAL_UTILIZATION", 0.5)
+	namespaceMonitorInterval      = getEnvDuration("NAMESPACE_MONITOR_INTERVAL", 10*time.Minute)
+)
+
+const (
+	// namespaceWindowHours is how far back collision rates are kept.
+	namespaceWindowHours = 24
+	// namespaceGrowthWindow is the creation rate projections extrapolate.
+	namespaceGrowthWindow = 7 * 24 * time.Hour
+	// namespaceTopOwners is how many owners the report breaks out.
+	namespaceTopOwners = 10
+	// namespaceMaxProjection is as far out as a projected date is given.
+	namespaceMaxProjection = 100 * 365 * 24 * time.Hour
+)
+
+var namespaceStats = expvar.NewMap("short_code_namespace")
+
+// namespaceDraws counts generated codes and collisions per hour, in a ring
+// indexed by Unix hour.
+var namespaceDraws struct {
+	sync.Mutex
+	buckets [namespaceWindowHours]struct {
+		hour              int64
+		draws, collisions int64
+	}
+}
+
+// recordShortCodeDraw counts one generated code and whether it was taken.
+func recordShortCodeDraw(collided bool) {
+	namespaceStats.Add("draws", 1)
+	if collided {
+		namespaceStats.Add("collisions", 1)
+	}
+	hour := time.Now().Unix() / 3600
+	namespaceDraws.Lock()
+	b := &namespaceDraws.buckets[hour%namespaceWindowHours]
+	if b.hour != hour {
+		b.hour, b.draws, b.collisions = hour, 0, 0
+	}
+	b.draws++
+	if collided {
+		b.collisions++
+	}
+	namespaceDraws.Unlock()
+}
+
+// collisionRate sums the draws and collisions of the last hours.
+func collisionRate(hours int64, now time.Time) gin.H {
+	current := now.Unix() / 3600
+	var draws, collisions int64
+	namespaceDraws.Lock()
+	for _, b := range namespaceDraws.buckets {
+		if b.hour > current-hours && b.hour <= current {
+			draws += b.draws
+			collisions += b.collisions
+		}
+	}
+	namespaceDraws.Unlock()
+	rate := gin.H{"draws": draws, "collisions": collisions, "rate": nil}
+	if draws > 0 {
+		rate["rate"] = float64(collisions) / float64(draws)
+	}
+	return rate
+}
+
+// namespaceLength is the utilization of the codes of one length.
+type namespaceLength struct {
+	Length      int     `json:"length"`
+	Generated   bool    `json:"generated"`
+	Used        int64   `json:"used"`
+	Capacity    float64 `json:"capacity"`
+	Utilization float64 `json:"utilization"`
+	// CreatedPerDay is the average over namespaceGrowthWindow.
+	CreatedPerDay float64 `json:"created_per_day"`
+	// ImpracticalAt is when utilization reaches the practical limit at that
+	// rate; nil when it isn't growing or is more than a century away.
+	ImpracticalAt *time.Time `json:"impractical_at"`
+}
+
+// namespaceOwner is one owner's share of the generated length's namespace.
+type namespaceOwner struct {
+	Owner       *string `json:"owner"`
+	Used        int64   `json:"used"`
+	Utilization float64 `json:"utilization"`
+}
+
+// namespaceCapacity is the number of codes of length in the alphabet.
+func namespaceCapacity(length int) float64 {
+	return math.Pow(float64(len(shortCodeChars)), float64(length))
+}
+
+// namespaceLengths counts links per code length. Custom aliases share the
+// namespace of their length and are counted with generated codes.
+func (s *Server) namespaceLengths(ctx context.Context, now time.Time) ([]namespaceLength, error) {
+	since := now.UTC().Add(-namespaceGrowthWindow).Format("2006-01-02 15:04:05")
+	rows, err := s.db.QueryContext(ctx, `SELECT length(short_code), COUNT(*), COUNT(CASE WHEN datetime(created_at) >= ? THEN 1 END)
+		FROM urls GROUP BY length(short_code) ORDER BY length(short_code)`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lengths []namespaceLength
+	sawGenerated := false
+	for rows.Next() {
+		var l namespaceLength
+		var recent int64
+		if err := rows.Scan(&l.Length, &l.Used, &recent); err != nil {
+			return nil, err
+		}
+		l.CreatedPerDay = float64(recent) / namespaceGrowthWindow.Hours() * 24
+		lengths = append(lengths, l)
+		sawGenerated = sawGenerated || l.Length == *shortCodeLength
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !sawGenerated {
+		lengths = append(lengths, namespaceLength{Length: *shortCodeLength})
+	}
+
+	for i := range lengths {
+		l := &lengths[i]
+		l.Generated = l.Length == *shortCodeLength
+		l.Capacity = namespaceCapacity(l.Length)
+		l.Utilization = float64(l.Used) / l.Capacity
+		remaining := namespacePracticalUtilization*l.Capacity - float64(l.Used)
+		if l.CreatedPerDay > 0 {
+			days := max(remaining, 0) / l.CreatedPerDay
+			if days*24 < namespaceMaxProjection.Hours() {
+				at := now.Add(time.Duration(days * float64(24*time.Hour))).UTC()
+				l.ImpracticalAt = &at
+			}
+		}
+	}
+	return lengths, nil
+}
+
+// namespaceOwners lists the owners using the most of the generated length.
+func (s *Server) namespaceOwners(ctx context.Context) ([]namespaceOwner, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT owner, COUNT(*) FROM urls WHERE length(short_code) = ?
+		GROUP BY owner ORDER BY COUNT(*) DESC LIMIT ?`, *shortCodeLength, namespaceTopOwners)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	capacity := namespaceCapacity(*shortCodeLength)
+	owners := []namespaceOwner{}
+	for rows.Next() {
+		var o namespaceOwner
+		if err := rows.Scan(&o.Owner, &o.Used); err != nil {
+			return nil, err
+		}
+		o.Utilization = float64(o.Used) / capacity
+		owners = append(owners, o)
+	}
+	return owners, rows.Err()
+}
+
+// getNamespace serves GET /admin/namespace.
+func (s *Server) getNamespace(c *gin.Context) {
+	ctx, now := c.Request.Context(), time.Now()
+	lengths, err := s.namespaceLengths(ctx, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	owners, err := s.namespaceOwners(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"alphabet":              *shortCodeAlphabet,
+		"length":                *shortCodeLength,
+		"warn_utilization":      namespaceWarnUtilization,
+		"practical_utilization": namespacePracticalUtilization,
+		"lengths":               lengths,
+		"top_owners":            owners,
+		"collisions": gin.H{
+			"last_hour":     collisionRate(1, now),
+			"last_24_hours": collisionRate(namespaceWindowHours, now),
+		},
+	})
+}
+
+// registerNamespaceMonitor alerts when the generated length's utilization
+// crosses NAMESPACE_WARN_UTILIZATION, once per crossing. A resolver-only
+// edge mints no codes and leaves this to the primary.
+func (s *Server) registerNamespaceMonitor() {
+	if resolverOnly || namespaceMonitorInterval <= 0 {
+		return
+	}
+	warned := false
+	app.RegisterBackgroundJob("namespace_monitor", namespaceMonitorInterval, func(ctx context.Context) error {
+		lengths, err := s.namespaceLengths(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		for _, l := range lengths {
+			if !l.Generated {
+				continue
+			}
+			setGauge(namespaceStats, "used", l.Used)
+			over := l.Utilization >= namespaceWarnUtilization
+			if over && !warned {
+				attrs := []any{"alert", true, "length", l.Length, "alphabet", *shortCodeAlphabet,
+					"utilization", l.Utilization, "warn_utilization", namespaceWarnUtilization,
+					"created_per_day", l.CreatedPerDay}
+				if l.ImpracticalAt != nil {
+					attrs = append(attrs, "impractical_at", l.ImpracticalAt.Format(time.RFC3339))
+				}
+				slog.Warn("short code namespace filling up; raise SHORT_CODE_LENGTH", attrs...)
+			}
+			warned = over
+		}
+		return nil
+	})
+}
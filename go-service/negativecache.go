@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// A redirect for a code that doesn't exist leaves notFoundSentinel under
+// the code's cache key for NOT_FOUND_CACHE_TTL (0 turns it off), so bots
+// walking random codes are answered from Redis instead of sqlite. Only
+// missing codes are cached: scheduled links, quarantined ones and the 410
+// of an expired one are never answered from the sentinel. Creating a link
+// deletes the sentinel for its code.
+//
+// An enumeration attack asks for each junk code once, so a miss is only
+// cached once the same code has missed twice within
+// NOT_FOUND_ADMISSION_WINDOW, as a dead link still being shared does. The
+// codes seen once are remembered in a fixed table, where one may push out
+// another, so the memory it takes never grows. Misses are counted as
+// repeated or one_off in urlshortener_not_found_misses_total; a surge of
+// one_off misses is what enumeration looks like. When more than
+// NOT_FOUND_CACHE_MAX_KEYS sentinels were written, across instances, within
+// a TTL, new ones get a TTL shortened in proportion, down to a second, so
+// Redis holds about that many at most.
+var (
+	notFoundCacheTTL        = getEnvDuration("NOT_FOUND_CACHE_TTL", 60*time.Second)
+	notFoundAdmissionWindow = getEnvDuration("NOT_FOUND_ADMISSION_WINDOW", time.Minute)
+	notFoundCacheMaxKeys    = getEnvInt("NOT_FOUND_CACHE_MAX_KEYS", 100000)
+)
+
+// notFoundSentinel can't be mistaken for a cached link, whose values are
+// JSON objects or, from older versions, URLs.
+const notFoundSentinel = "__NOT_FOUND__"
+
+const (
+	// notFoundWrittenKeyPrefix counts the sentinels written per TTL-long
+	// period.
+	notFoundWrittenKeyPrefix = "notfound:written:"
+	// notFoundDoorkeeperSlots is the number of codes seen missing once that
+	// are remembered.
+	notFoundDoorkeeperSlots = 1 << 16
+)
+
+var (
+	notFoundMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortener_not_found_misses_total",
+		Help: "Redirects to missing codes looked up in the database, by pattern: repeated (missed before within NOT_FOUND_ADMISSION_WINDOW, and cached) or one_off.",
+	}, []string{"pattern"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "urlshortener_not_found_cache_ttl_seconds",
+		Help: "The TTL new not-found sentinels get, shortened while more than NOT_FOUND_CACHE_MAX_KEYS were written within NOT_FOUND_CACHE_TTL.",
+	}, func() float64 { return notFoundTTL().Seconds() })
+)
+
+func init() {
+	if notFoundAdmissionWindow <= 0 || notFoundCacheMaxKeys < 1 {
+		log.Fatalf("NOT_FOUND_ADMISSION_WINDOW and NOT_FOUND_CACHE_MAX_KEYS must be positive")
+	}
+}
+
+// notFoundWritten is how many sentinels were written within the last TTL,
+// as of the last one this instance wrote.
+var notFoundWritten atomic.Int64
+
+// notFoundTTL is the TTL for a new sentinel.
+func notFoundTTL() time.Duration {
+	written := notFoundWritten.Load()
+	if written <= int64(notFoundCacheMaxKeys) {
+		return notFoundCacheTTL
+	}
+	return max(time.Second, time.Duration(float64(notFoundCacheTTL)*float64(notFoundCacheMaxKeys)/float64(written)).Truncate(time.Second))
+}
+
+// missDoorkeeper remembers codes that missed once in the current window.
+type missDoorkeeper struct {
+	mu      sync.Mutex
+	seed    maphash.Seed
+	slots   []uint64
+	started time.Time
+}
+
+var notFoundDoorkeeper = newMissDoorkeeper()
+
+func newMissDoorkeeper() *missDoorkeeper {
+	return &missDoorkeeper{seed: maphash.MakeSeed(), slots: make([]uint64, notFoundDoorkeeperSlots)}
+}
+
+// seen records a miss of shortCode, reporting whether it missed before
+// within the window.
+func (d *missDoorkeeper) seen(shortCode string, now time.Time) bool {
+	h := maphash.String(d.seed, shortCode) | 1
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.started) >= notFoundAdmissionWindow {
+		clear(d.slots)
+		d.started = now
+	}
+	slot := &d.slots[h%uint64(len(d.slots))]
+	if *slot == h {
+		return true
+	}
+	*slot = h
+	return false
+}
+
+// recordNotFound counts a miss of shortCode in the database and caches it
+// once it repeats.
+func (s *Server) recordNotFound(ctx context.Context, shortCode string) {
+	if !notFoundDoorkeeper.seen(shortCode, time.Now()) {
+		notFoundMisses.WithLabelValues("one_off").Inc()
+		return
+	}
+	notFoundMisses.WithLabelValues("repeated").Inc()
+	s.cacheNotFound(ctx, shortCode)
+}
+
+// cacheNotFound records that shortCode doesn't exist. An entry written for
+// the code in the meantime is left alone.
+func (s *Server) cacheNotFound(ctx context.Context, shortCode string) {
+	if s.rdb == nil || notFoundCacheTTL <= 0 {
+		return
+	}
+	ttl := notFoundTTL()
+	period := time.Now().Unix() / max(1, int64(notFoundCacheTTL.Seconds()))
+	pipe := s.rdb.Pipeline()
+	set := pipe.SetNX(ctx, urlCacheKey(shortCode), notFoundSentinel, ttl)
+	current := pipe.Incr(ctx, notFoundWrittenKeyPrefix+strconv.FormatInt(period, 10))
+	pipe.Expire(ctx, notFoundWrittenKeyPrefix+strconv.FormatInt(period, 10), 2*notFoundCacheTTL)
+	previous := pipe.Get(ctx, notFoundWrittenKeyPrefix+strconv.FormatInt(period-1, 10))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		if !redisUnavailable(err) {
+			log.Printf("Error caching missing code %s: %v", shortCode, err)
+		}
+		return
+	}
+	written, _ := previous.Int64()
+	notFoundWritten.Store(current.Val() + written)
+	if set.Val() {
+		cacheMissLocally(shortCode, ttl)
+	}
+}
+
+// cacheMissLocally keeps shortCode as missing in the local cache, for no
+// longer than ttl.
+func cacheMissLocally(shortCode string, ttl time.Duration) {
+	localLinks.putMiss(shortCode, time.Now().Add(min(ttl, localCacheTTL)))
+}
+
+// forgetNotFound deletes the cache entries of newly created codes, so a
+// sentinel left by an earlier lookup doesn't hide them, here or, when there
+// was one, on any instance.
+func (s *Server) forgetNotFound(ctx context.Context, shortCodes ...string) {
+	if s.rdb == nil || len(shortCodes) == 0 {
+		return
+	}
+	keys := make([]string, len(shortCodes))
+	for i, code := range shortCodes {
+		keys[i] = urlCacheKey(code)
+	}
+	deleted, err := s.rdb.Del(ctx, keys...).Result()
+	if err != nil && !redisUnavailable(err) {
+		log.Printf("Error clearing cached misses for new links: %v", err)
+	}
+	if deleted > 0 || err != nil {
+		s.invalidateLocalLinks(ctx, shortCodes...)
+	}
+}
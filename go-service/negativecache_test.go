@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withFreshNegativeCache starts the rest of the test with no misses
+// remembered or written.
+func withFreshNegativeCache(tb testing.TB) {
+	saved := notFoundDoorkeeper
+	notFoundDoorkeeper = newMissDoorkeeper()
+	notFoundWritten.Store(0)
+	tb.Cleanup(func() {
+		notFoundDoorkeeper = saved
+		notFoundWritten.Store(0)
+	})
+}
+
+func TestNotFoundIsCachedOnceRepeated(t *testing.T) {
+	mr := useRedis(t)
+	withLocalCache(t, 100)
+	withFreshNegativeCache(t)
+	r := redirectEngine()
+	code := "gone-" + newRandomID()[:8]
+
+	if w := serveTest(r, http.MethodGet, "/"+code, ""); w.Code != http.StatusNotFound || mr.Exists(urlCacheKey(code)) {
+		t.Fatalf("first miss = %d, cached %v; want 404, not cached", w.Code, mr.Exists(urlCacheKey(code)))
+	}
+	serveTest(r, http.MethodGet, "/"+code, "")
+	if got, _ := mr.Get(urlCacheKey(code)); got != notFoundSentinel || !localLinks.getMiss(code, time.Now()) {
+		t.Fatalf("after a second miss Redis holds %q, local miss %v", got, localLinks.getMiss(code, time.Now()))
+	}
+
+	// Creating the link under the code clears both.
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/back", CustomAlias: code}, "")
+	if localLinks.getMiss(code, time.Now()) {
+		t.Error("the local miss outlived the link's creation")
+	}
+	if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, ""); w.Code != defaultRedirectStatus {
+		t.Errorf("new link = %d, want %d", w.Code, defaultRedirectStatus)
+	}
+}
+
+func TestNotFoundTTLShortensUnderPressure(t *testing.T) {
+	mr := useRedis(t)
+	withLocalCache(t, 100)
+	withFreshNegativeCache(t)
+	saved := notFoundCacheMaxKeys
+	notFoundCacheMaxKeys = 10
+	t.Cleanup(func() { notFoundCacheMaxKeys = saved })
+
+	ctx := context.Background()
+	for i := range 40 {
+		testServer.cacheNotFound(ctx, "pressure-"+strconv.Itoa(i))
+	}
+	if ttl := mr.TTL(urlCacheKey("pressure-0")); ttl != notFoundCacheTTL {
+		t.Errorf("first sentinel TTL = %s, want %s", ttl, notFoundCacheTTL)
+	}
+	last := mr.TTL(urlCacheKey("pressure-39"))
+	if last >= notFoundCacheTTL/3 || last < time.Second {
+		t.Errorf("sentinel TTL with 4 times the cap written = %s, want about a quarter of %s", last, notFoundCacheTTL)
+	}
+}
+
+// TestEnumerationKeepsHotLinks walks thousands of junk codes, each asked
+// for once, and a few dead links asked for twice, past links being
+// redirected to all along.
+func TestEnumerationKeepsHotLinks(t *testing.T) {
+	mr := useRedis(t)
+	withLocalCache(t, 50)
+	withFreshNegativeCache(t)
+	r := redirectEngine()
+	oneOff := func() float64 { return testutil.ToFloat64(notFoundMisses.WithLabelValues("one_off")) }
+	repeated := func() float64 { return testutil.ToFloat64(notFoundMisses.WithLabelValues("repeated")) }
+
+	var hot []string
+	for i := range 20 {
+		link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/hot/" + strconv.Itoa(i)}, "")
+		serveTest(r, http.MethodGet, "/"+link.ShortCode, "")
+		hot = append(hot, link.ShortCode)
+	}
+	oneOffBefore, repeatedBefore := oneOff(), repeated()
+
+	prefix := "junk" + newRandomID()[:6]
+	for i := range 3000 {
+		serveTest(r, http.MethodGet, "/"+prefix+strconv.Itoa(i), "")
+		if i%150 == 0 {
+			dead := prefix + "dead" + strconv.Itoa(i)
+			serveTest(r, http.MethodGet, "/"+dead, "")
+			serveTest(r, http.MethodGet, "/"+dead, "")
+		}
+		if i%100 == 0 {
+			serveTest(r, http.MethodGet, "/"+hot[i/100%len(hot)], "")
+		}
+	}
+
+	for _, code := range hot {
+		if _, ok := localLinks.get(code, time.Now()); !ok {
+			t.Errorf("hot link %s was pushed out of the local cache", code)
+		}
+	}
+	if n := localLinks.missLen(); n > 5 {
+		t.Errorf("%d misses cached locally, want at most the negative budget of 5", n)
+	}
+	sentinels := 0
+	for _, key := range mr.Keys() {
+		if v, _ := mr.Get(key); v == notFoundSentinel {
+			sentinels++
+		}
+	}
+	if sentinels != 20 {
+		t.Errorf("%d sentinels in Redis, want only the 20 repeated misses", sentinels)
+	}
+	if got := oneOff() - oneOffBefore; got != 3020 {
+		t.Errorf("%v one-off misses counted, want 3020", got)
+	}
+	if got := repeated() - repeatedBefore; got != 20 {
+		t.Errorf("%v repeated misses counted, want 20", got)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OAuth2 client-credentials mode: callers present a Bearer JWT issued by the
+// platform IdP and we verify it against the IdP's JWKS. The mode is off
+// unless OAUTH_JWKS_URL is set.
+var (
+	oauthJWKSURL        = getEnv("OAUTH_JWKS_URL", "")
+	oauthIssuer         = getEnv("OAUTH_ISSUER", "")
+	oauthAudience       = getEnv("OAUTH_AUDIENCE", "")
+	oauthOwnerClaim     = getEnv("OAUTH_OWNER_CLAIM", "sub")
+	oauthRequiredScopes = splitList(getEnv("OAUTH_REQUIRED_SCOPES", ""))
+	oauthClockSkew      = getEnvDuration("OAUTH_CLOCK_SKEW", time.Minute)
+	oauthJWKSRefresh    = getEnvDuration("OAUTH_JWKS_REFRESH", time.Hour)
+)
+
+// ownerContextKey holds the authenticated owner identity on the gin context.
+const ownerContextKey = "owner"
+
+var errInvalidToken = errors.New("invalid token")
+
+// jwksCache keeps the IdP's signing keys by kid. Keys are refreshed on a
+// timer and, rate limited, whenever a token names a kid we haven't seen,
+// which is how key rotation shows up.
+type jwksCache struct {
+	url     string
+	client  *http.Client
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var oauthKeys = &jwksCache{url: oauthJWKSURL, client: &http.Client{Timeout: 5 * time.Second, Transport: newOutboundTransport()}}
+
+// jwksMinRefetch stops unknown-kid tokens from hammering the IdP.
+const jwksMinRefetch = time.Minute
+
+func (j *jwksCache) key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stale := time.Since(j.fetched) > oauthJWKSRefresh
+	_, known := j.keys[kid]
+	if stale || (!known && time.Since(j.fetched) > jwksMinRefetch) {
+		if err := j.refresh(); err != nil {
+			log.Printf("Error refreshing JWKS from %s: %v", redactURL(j.url), err)
+			// Keep serving the keys we have until the IdP is back.
+		}
+	}
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key id", errInvalidToken)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j *jwksCache) refresh() error {
+	j.fetched = time.Now()
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	j.keys = keys
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifyJWT checks the signature and the registered claims and returns the
+// claims. Only RS256 and ES256 are accepted; "none" and HMAC algorithms are
+// rejected outright.
+func verifyJWT(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	key, err := oauthKeys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, errInvalidToken
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return nil, errInvalidToken
+		}
+	default:
+		return nil, errInvalidToken
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := checkJWTClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+func checkJWTClaims(claims map[string]any, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-oauthClockSkew).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oauthClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not yet valid", errInvalidToken)
+	}
+	if oauthIssuer != "" && claims["iss"] != oauthIssuer {
+		return fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	}
+	if oauthAudience != "" && !slices.Contains(claimStrings(claims["aud"]), oauthAudience) {
+		return fmt.Errorf("%w: wrong audience", errInvalidToken)
+	}
+
+	// Scopes come as a space-delimited "scope" (RFC 8693) or an "scp" array.
+	scopes := claimStrings(claims["scp"])
+	if s, ok := claims["scope"].(string); ok {
+		scopes = append(scopes, strings.Fields(s)...)
+	}
+	for _, required := range oauthRequiredScopes {
+		if !slices.Contains(scopes, required) {
+			return fmt.Errorf("%w: missing scope %s", errInvalidToken, required)
+		}
+	}
+	return nil
+}
+
+// claimStrings reads a claim that may be a single string or an array.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// requireOAuth authenticates API callers when OAuth mode is configured and
+// stores the owner identity under ownerContextKey. With OAUTH_JWKS_URL unset
+// it lets every request through, as before.
+func (s *Server) requireOAuth(c *gin.Context) {
+	if s.authenticateCaller(c) {
+		c.Next()
+	}
+}
+
+// authenticateCaller is requireOAuth without running the rest of the
+// chain: it reports whether the request may go on, having aborted it if
+// not.
+func (s *Server) authenticateCaller(c *gin.Context) bool {
+	if hasAdminToken(c) {
+		c.Set(apiKeyAdminContextKey, true)
+		c.Set(tierContextKey, tierAdmin)
+		return true
+	}
+	if key, ok := apiKeyFromRequest(c); ok {
+		return s.authenticateAPIKey(c, key)
+	}
+	if oauthJWKSURL == "" {
+		if apiKeysRequired {
+			c.Header("WWW-Authenticate", `Bearer`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing API key", "code": "unauthenticated"})
+			return false
+		}
+		return true
+	}
+
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		c.Header("WWW-Authenticate", `Bearer`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token", "code": "unauthenticated"})
+		return false
+	}
+
+	claims, err := verifyJWT(token, time.Now())
+	if err != nil {
+		log.Printf("Rejected bearer token from %s: %v", clientIP(c), err)
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid bearer token", "code": "invalid_token"})
+		return false
+	}
+	owner, _ := claims[oauthOwnerClaim].(string)
+	if owner == "" {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid bearer token", "code": "invalid_token"})
+		return false
+	}
+	c.Set(ownerContextKey, owner)
+	c.Set(tierContextKey, tierStandard)
+	return true
+}
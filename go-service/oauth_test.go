@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIdP serves a JWKS of the keys it signs tokens with.
+type fakeIdP struct {
+	mu      sync.Mutex
+	rsaKeys map[string]*rsa.PrivateKey
+	ecKeys  map[string]*ecdsa.PrivateKey
+	fetches int
+}
+
+func (idp *fakeIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.fetches++
+	enc := base64.RawURLEncoding.EncodeToString
+	var keys []jwk
+	for kid, k := range idp.rsaKeys {
+		keys = append(keys, jwk{Kty: "RSA", Kid: kid, Use: "sig", N: enc(k.N.Bytes()), E: enc(big.NewInt(int64(k.E)).Bytes())})
+	}
+	for kid, k := range idp.ecKeys {
+		keys = append(keys, jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: enc(k.X.FillBytes(make([]byte, 32))), Y: enc(k.Y.FillBytes(make([]byte, 32)))})
+	}
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+func (idp *fakeIdP) fetchCount() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.fetches
+}
+
+func (idp *fakeIdP) addRSA(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.rsaKeys[kid] = key
+}
+
+// sign makes a token with the key kid names, which may be unknown to the
+// IdP to test a kid it doesn't serve.
+func (idp *fakeIdP) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := enc(header) + "." + enc(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	var sig []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKeys[kid], crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, idp.ecKeys[kid], digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		mac := hmac.New(sha256.New, []byte("shared"))
+		mac.Write([]byte(signingInput))
+		sig = mac.Sum(nil)
+	}
+	return signingInput + "." + enc(sig)
+}
+
+// withOAuth turns OAuth mode on for the rest of the test, trusting a fake
+// IdP with one RSA key "rsa-1" and one EC key "ec-1".
+func withOAuth(t *testing.T) *fakeIdP {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{rsaKeys: map[string]*rsa.PrivateKey{}, ecKeys: map[string]*ecdsa.PrivateKey{"ec-1": ecKey}}
+	idp.addRSA(t, "rsa-1")
+	srv := httptest.NewServer(idp)
+	t.Cleanup(srv.Close)
+
+	savedURL, savedKeys, savedIssuer, savedAudience, savedScopes := oauthJWKSURL, oauthKeys, oauthIssuer, oauthAudience, oauthRequiredScopes
+	oauthJWKSURL, oauthIssuer, oauthAudience, oauthRequiredScopes = srv.URL, "https://idp.test", "shortener", []string{"links:write"}
+	oauthKeys = &jwksCache{url: srv.URL, client: srv.Client()}
+	t.Cleanup(func() {
+		oauthJWKSURL, oauthKeys, oauthIssuer, oauthAudience, oauthRequiredScopes = savedURL, savedKeys, savedIssuer, savedAudience, savedScopes
+	})
+	return idp
+}
+
+// validClaims are claims every check accepts, for sub.
+func validClaims(sub string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss": "https://idp.test", "aud": []string{"other", "shortener"}, "sub": sub,
+		"iat": now.Unix(), "nbf": now.Unix(), "exp": now.Add(time.Hour).Unix(), "scope": "links:read links:write",
+	}
+}
+
+func TestOAuthBearerTokens(t *testing.T) {
+	idp := withOAuth(t)
+	r := testServer.newRouter()
+	shorten := func(token string) (int, string) {
+		w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/oauth"}`, "Authorization: Bearer "+token)
+		return w.Code, w.Body.String()
+	}
+	with := func(change func(map[string]any)) map[string]any {
+		claims := validClaims("svc-billing")
+		change(claims)
+		return claims
+	}
+
+	code, body := shorten(idp.sign(t, "RS256", "rsa-1", validClaims("svc-billing")))
+	var created ShortenResponse
+	json.Unmarshal([]byte(body), &created)
+	if code != http.StatusOK {
+		t.Fatalf("shorten with a valid RS256 token = %d: %s", code, body)
+	}
+	var owner string
+	if err := testServer.db.QueryRow("SELECT owner FROM urls WHERE short_code = ?", created.ShortCode).Scan(&owner); err != nil || owner != "svc-billing" {
+		t.Errorf("owner = %q (%v), want the sub claim", owner, err)
+	}
+	if code, body := shorten(idp.sign(t, "ES256", "ec-1", validClaims("svc-billing"))); code != http.StatusOK {
+		t.Errorf("shorten with a valid ES256 token = %d: %s", code, body)
+	}
+	if code, body := shorten(idp.sign(t, "RS256", "rsa-1", with(func(c map[string]any) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }))); code != http.StatusOK {
+		t.Errorf("token expired within the clock skew = %d: %s", code, body)
+	}
+
+	rejected := map[string]string{
+		"expired":        idp.sign(t, "RS256", "rsa-1", with(func(c map[string]any) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() })),
+		"no exp":         idp.sign(t, "RS256", "rsa-1", with(func(c map[string]any) { delete(c, "exp") })),
+		"not yet valid":  idp.sign(t, "RS256", "rsa-1", with(func(c map[string]any) { c["nbf"] = time.Now().Add(5 * time.Minute).Unix() })),
+		"wrong issuer":   idp.sign(t, "RS256", "rsa-1", with(func(c map[string]any) { c["iss"] = "https://evil.test" })),
+		"wrong audience": idp.sign(t, "RS256", "rsa-1", with(func(c map[string]any) { c["aud"] = "other" })),
+		"missing scope":  idp.sign(t, "RS256", "rsa-1", with(func(c map[string]any) { c["scope"] = "links:read" })),
+		"no owner":       idp.sign(t, "RS256", "rsa-1", with(func(c map[string]any) { delete(c, "sub") })),
+		"unknown kid":    retag(idp.sign(t, "RS256", "rsa-1", validClaims("svc-billing")), "RS256", "rsa-9"),
+		"HS256":          idp.sign(t, "HS256", "rsa-1", validClaims("svc-billing")),
+		"none":           retag(idp.sign(t, "RS256", "rsa-1", validClaims("svc-billing")), "none", "rsa-1"),
+		"wrong alg":      retag(idp.sign(t, "RS256", "rsa-1", validClaims("svc-billing")), "ES256", "rsa-1"),
+		"tampered":       tamper(idp.sign(t, "RS256", "rsa-1", validClaims("svc-billing"))),
+		"malformed":      "not-a-jwt",
+	}
+	for name, token := range rejected {
+		code, body := shorten(token)
+		if code != http.StatusUnauthorized || !strings.Contains(body, `"code":"invalid_token"`) {
+			t.Errorf("%s token = %d: %s", name, code, body)
+		}
+	}
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/oauth"}`)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"code":"unauthenticated"`) || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("no token = %d: %s", w.Code, w.Body)
+	}
+
+	// API keys keep working next to tokens.
+	_, key := newTestAPIKey(t, false)
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/oauth-key"}`, "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Errorf("shorten with an API key in OAuth mode = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOAuthKeyRotation(t *testing.T) {
+	idp := withOAuth(t)
+	r := testServer.newRouter()
+	shorten := func(token string) int {
+		return serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/rotate"}`, "Authorization: Bearer "+token).Code
+	}
+
+	if code := shorten(idp.sign(t, "RS256", "rsa-1", validClaims("svc"))); code != http.StatusOK {
+		t.Fatalf("first token = %d", code)
+	}
+	shorten(idp.sign(t, "RS256", "rsa-1", validClaims("svc")))
+	if idp.fetchCount() != 1 {
+		t.Errorf("JWKS fetched %d times for two tokens, want once", idp.fetchCount())
+	}
+
+	// A token signed with a new key is refused until the cache may be
+	// refreshed, then the new key is fetched.
+	idp.addRSA(t, "rsa-2")
+	if code := shorten(idp.sign(t, "RS256", "rsa-2", validClaims("svc"))); code != http.StatusUnauthorized || idp.fetchCount() != 1 {
+		t.Errorf("new key right after a fetch = %d after %d fetches, want %d without refetching", code, idp.fetchCount(), http.StatusUnauthorized)
+	}
+	oauthKeys.mu.Lock()
+	oauthKeys.fetched = time.Now().Add(-2 * jwksMinRefetch)
+	oauthKeys.mu.Unlock()
+	if code := shorten(idp.sign(t, "RS256", "rsa-2", validClaims("svc"))); code != http.StatusOK || idp.fetchCount() != 2 {
+		t.Errorf("new key later = %d after %d fetches, want %d after 2", code, idp.fetchCount(), http.StatusOK)
+	}
+}
+
+// retag replaces token's header, leaving the signature.
+func retag(token, alg, kid string) string {
+	parts := strings.SplitN(token, ".", 2)
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	return base64.RawURLEncoding.EncodeToString(header) + "." + parts[1]
+}
+
+// tamper changes token's payload, leaving the signature.
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	var claims map[string]any
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(raw, &claims)
+	claims["sub"] = "someone-else"
+	payload, _ := json.Marshal(claims)
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+}
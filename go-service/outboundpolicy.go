@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// OUTBOUND_POLICY_FILE holds per-domain policies for the requests this
+// service makes to other people's sites: the destination check and the
+// domain verifier. Each applies to a domain and every host under it, the
+// most specific one winning, and may disallow requests to it entirely,
+// allow at most requests_per_minute, or send its own User-Agent:
+//
+//	domains:
+//	  - suffix: example.com
+//	    requests_per_minute: 30
+//	    user_agent: "url-shortener (+https://sho.rt/bot)"
+//	  - suffix: no-crawl.example
+//	    disallow: true
+//
+// The rate is a token bucket per host shared by every feature, allowing a
+// burst of a tenth of the minute's requests. A request the policy doesn't
+// allow is not made; the feature skips what it was doing, counted by reason
+// in urlshortener_outbound_policy_skips_total, instead of failing. The file
+// is re-read when it changes, checked every
+// OUTBOUND_POLICY_RELOAD_INTERVAL; a change that doesn't parse is logged
+// and the policies in force are kept.
+var (
+	outboundPolicyFile           = getEnv("OUTBOUND_POLICY_FILE", "")
+	outboundPolicyReloadInterval = getEnvDuration("OUTBOUND_POLICY_RELOAD_INTERVAL", 30*time.Second)
+)
+
+// Reasons a request is skipped.
+const (
+	outboundDisallowed  = "disallowed"
+	outboundRateLimited = "rate_limited"
+)
+
+var outboundPolicySkips = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "urlshortener_outbound_policy_skips_total",
+	Help: "Outbound requests not made because of OUTBOUND_POLICY_FILE, by feature and reason.",
+}, []string{"feature", "reason"})
+
+// outboundPolicy is one entry of OUTBOUND_POLICY_FILE.
+type outboundPolicy struct {
+	Suffix            string `yaml:"suffix"`
+	Disallow          bool   `yaml:"disallow"`
+	RequestsPerMinute int    `yaml:"requests_per_minute"`
+	UserAgent         string `yaml:"user_agent"`
+}
+
+// outboundPolicySet is the policies in force, most specific first, and
+// the modification time of the file they were read from.
+type outboundPolicySet struct {
+	policies []outboundPolicy
+	modTime  time.Time
+}
+
+var outboundPolicies atomic.Pointer[outboundPolicySet]
+
+// outboundSkip is the error of a request a policy didn't allow.
+type outboundSkip struct {
+	host   string
+	reason string
+}
+
+func (e *outboundSkip) Error() string {
+	return fmt.Sprintf("outbound policy for %s: %s", e.host, strings.ReplaceAll(e.reason, "_", " "))
+}
+
+// outboundSkipReason is why err, from a request, wasn't made, or "" when
+// it wasn't skipped.
+func outboundSkipReason(err error) string {
+	var skip *outboundSkip
+	if errors.As(err, &skip) {
+		return skip.reason
+	}
+	return ""
+}
+
+func parseOutboundPolicies(data []byte) ([]outboundPolicy, error) {
+	var doc struct {
+		Domains []outboundPolicy `yaml:"domains"`
+	}
+	if err := yaml.UnmarshalWithOptions(data, &doc, yaml.Strict()); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for i := range doc.Domains {
+		p := &doc.Domains[i]
+		p.Suffix = strings.Trim(strings.ToLower(strings.TrimSpace(p.Suffix)), ".")
+		switch {
+		case p.Suffix == "":
+			return nil, fmt.Errorf("domain %d: suffix is required", i+1)
+		case seen[p.Suffix]:
+			return nil, fmt.Errorf("domain %s is listed twice", p.Suffix)
+		case p.RequestsPerMinute < 0:
+			return nil, fmt.Errorf("domain %s: requests_per_minute must not be negative", p.Suffix)
+		}
+		seen[p.Suffix] = true
+	}
+	sort.SliceStable(doc.Domains, func(i, j int) bool { return len(doc.Domains[i].Suffix) > len(doc.Domains[j].Suffix) })
+	return doc.Domains, nil
+}
+
+// loadOutboundPolicies reads path, when it has changed since it was last
+// read, and puts its policies in force.
+func loadOutboundPolicies(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if current := outboundPolicies.Load(); current != nil && current.modTime.Equal(info.ModTime()) {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	policies, err := parseOutboundPolicies(data)
+	if err != nil {
+		return fmt.Errorf("invalid OUTBOUND_POLICY_FILE: %w", err)
+	}
+	outboundPolicies.Store(&outboundPolicySet{policies: policies, modTime: info.ModTime()})
+	log.Printf("Loaded %d outbound domain policies", len(policies))
+	return nil
+}
+
+// registerOutboundPolicyReload reads OUTBOUND_POLICY_FILE, when set, and
+// re-reads it as it changes.
+func registerOutboundPolicyReload() {
+	if outboundPolicyFile == "" {
+		return
+	}
+	if err := loadOutboundPolicies(outboundPolicyFile); err != nil {
+		log.Fatalf("Error reading OUTBOUND_POLICY_FILE: %v", err)
+	}
+	app.RegisterBackgroundJob("outbound_policy_reload", outboundPolicyReloadInterval, func(context.Context) error {
+		return loadOutboundPolicies(outboundPolicyFile)
+	})
+}
+
+// outboundPolicyFor is the most specific policy covering host.
+func outboundPolicyFor(host string) (outboundPolicy, bool) {
+	set := outboundPolicies.Load()
+	if set == nil {
+		return outboundPolicy{}, false
+	}
+	for _, p := range set.policies {
+		if host == p.Suffix || strings.HasSuffix(host, "."+p.Suffix) {
+			return p, true
+		}
+	}
+	return outboundPolicy{}, false
+}
+
+// outboundBuckets are the per-host token buckets of rate-limited hosts.
+var outboundBuckets = &outboundBucketSet{buckets: map[string]*outboundBucket{}}
+
+type outboundBucketSet struct {
+	mu      sync.Mutex
+	buckets map[string]*outboundBucket
+}
+
+type outboundBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends one of host's tokens at perMinute requests a minute,
+// reporting false when there are none left.
+func (s *outboundBucketSet) take(host string, perMinute int, now time.Time) bool {
+	burst := max(1, float64(perMinute)/10)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[host]
+	if !ok {
+		if len(s.buckets) >= 10000 {
+			clear(s.buckets)
+		}
+		b = &outboundBucket{tokens: burst, last: now}
+		s.buckets[host] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Minutes()*float64(perMinute))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// outboundPolicyTransport makes feature's requests, redirects included, as
+// the policies allow.
+type outboundPolicyTransport struct {
+	feature string
+	base    http.RoundTripper
+}
+
+func (t *outboundPolicyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.TrimSuffix(strings.ToLower(req.URL.Hostname()), ".")
+	p, ok := outboundPolicyFor(host)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	reason := ""
+	switch {
+	case p.Disallow:
+		reason = outboundDisallowed
+	case p.RequestsPerMinute > 0 && !outboundBuckets.take(host, p.RequestsPerMinute, time.Now()):
+		reason = outboundRateLimited
+	}
+	if reason != "" {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		outboundPolicySkips.WithLabelValues(t.feature, reason).Inc()
+		return nil, &outboundSkip{host: host, reason: reason}
+	}
+	if p.UserAgent != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+	return t.base.RoundTrip(req)
+}
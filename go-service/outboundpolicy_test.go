@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setOutboundPolicies puts the policies of doc in force, with fresh
+// buckets, for the rest of the test.
+func setOutboundPolicies(t *testing.T, doc string) {
+	t.Helper()
+	policies, err := parseOutboundPolicies([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := outboundPolicies.Load()
+	outboundPolicies.Store(&outboundPolicySet{policies: policies})
+	clear(outboundBuckets.buckets)
+	t.Cleanup(func() {
+		outboundPolicies.Store(saved)
+		clear(outboundBuckets.buckets)
+	})
+}
+
+func TestParseOutboundPolicies(t *testing.T) {
+	for _, doc := range []string{
+		"domains:\n  - disallow: true\n",
+		"domains:\n  - suffix: example.com\n  - suffix: Example.com.\n",
+		"domains:\n  - suffix: example.com\n    requests_per_minute: -1\n",
+		"domains:\n  - suffix: example.com\n    rpm: 10\n",
+	} {
+		if _, err := parseOutboundPolicies([]byte(doc)); err == nil {
+			t.Errorf("accepted %q", doc)
+		}
+	}
+}
+
+func TestOutboundPolicyMatching(t *testing.T) {
+	setOutboundPolicies(t, `
+domains:
+  - suffix: example.com
+    requests_per_minute: 30
+  - suffix: .Private.Example.com
+    disallow: true
+`)
+	for _, tt := range []struct {
+		host     string
+		ok       bool
+		disallow bool
+	}{
+		{"example.com", true, false},
+		{"www.example.com", true, false},
+		{"private.example.com", true, true},
+		{"a.private.example.com", true, true},
+		{"notexample.com", false, false},
+		{"example.org", false, false},
+	} {
+		p, ok := outboundPolicyFor(tt.host)
+		if ok != tt.ok || p.Disallow != tt.disallow {
+			t.Errorf("policy for %s = %+v, %v; want found %v, disallow %v", tt.host, p, ok, tt.ok, tt.disallow)
+		}
+	}
+}
+
+func TestOutboundBucketRefills(t *testing.T) {
+	buckets := &outboundBucketSet{buckets: map[string]*outboundBucket{}}
+	now := time.Now()
+	allowed := 0
+	for range 10 {
+		if buckets.take("example.com", 60, now) {
+			allowed++
+		}
+	}
+	if allowed != 6 {
+		t.Errorf("%d requests allowed at once at 60 a minute, want a burst of 6", allowed)
+	}
+	if !buckets.take("example.com", 60, now.Add(time.Second)) || buckets.take("example.com", 60, now.Add(time.Second)) {
+		t.Error("a second at 60 a minute didn't allow exactly one more request")
+	}
+	if !buckets.take("other.example.com", 60, now) {
+		t.Error("another host shared the bucket")
+	}
+}
+
+func TestOutboundPolicyBucketIsShared(t *testing.T) {
+	srv := withDestinationCheck(t, "reject")
+	var userAgents []string
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+	})
+	setOutboundPolicies(t, `
+domains:
+  - suffix: 127.0.0.1
+    requests_per_minute: 1
+    user_agent: polite-bot
+`)
+	skipsBefore := testutil.ToFloat64(outboundPolicySkips.WithLabelValues("domain_verifier", outboundRateLimited))
+
+	check := checkDestination(context.Background(), srv.URL+"/ok", nil)
+	if check.Skipped != "" || check.Problem != "" || len(userAgents) != 1 || userAgents[0] != "polite-bot" {
+		t.Fatalf("first check = %+v with User-Agents %q", check, userAgents)
+	}
+	// The verifier's request to the same host finds the bucket empty.
+	client := &http.Client{Transport: &outboundPolicyTransport{feature: "domain_verifier", base: &http.Transport{}}}
+	_, err := client.Get(srv.URL + "/")
+	if outboundSkipReason(err) != outboundRateLimited || len(userAgents) != 1 {
+		t.Errorf("second feature's request = %v, reaching the host %d times", err, len(userAgents))
+	}
+	if got := testutil.ToFloat64(outboundPolicySkips.WithLabelValues("domain_verifier", outboundRateLimited)) - skipsBefore; got != 1 {
+		t.Errorf("%v rate-limited skips counted, want 1", got)
+	}
+	if check := checkDestination(context.Background(), srv.URL+"/ok", nil); check.Skipped != outboundRateLimited || check.Problem != "" {
+		t.Errorf("check past the rate = %+v, want skipped", check)
+	}
+}
+
+func TestShortenSkipsDisallowedDestinationCheck(t *testing.T) {
+	srv := withDestinationCheck(t, "reject")
+	reached := false
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		http.NotFound(w, r)
+	})
+	setOutboundPolicies(t, "domains:\n  - suffix: 127.0.0.1\n    disallow: true\n")
+	_, key := newTestAPIKey(t, false)
+
+	// Checked, the destination would be refused for its 404.
+	w := serveTest(testServer.newRouter(), http.MethodPost, "/api/shorten", `{"long_url":"`+srv.URL+`/missing","reuse_existing":false}`, "X-API-Key: "+key)
+	var resp ShortenResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.DestinationCheckSkipped != outboundDisallowed || resp.ResolvedURL != "" || reached {
+		t.Fatalf("shorten to a disallowed host = %d: %s (reached %v)", w.Code, w.Body, reached)
+	}
+	var resolved, problem *string
+	if err := testServer.db.QueryRow("SELECT resolved_url, destination_problem FROM urls WHERE short_code = ?", resp.ShortCode).Scan(&resolved, &problem); err != nil {
+		t.Fatal(err)
+	}
+	if resolved != nil || problem != nil {
+		t.Errorf("a skipped check stored resolved_url %v, destination_problem %v", resolved, problem)
+	}
+}
+
+func TestOutboundPolicyReload(t *testing.T) {
+	saved := outboundPolicies.Load()
+	t.Cleanup(func() { outboundPolicies.Store(saved) })
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	write := func(doc string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	disallowed := func() bool {
+		p, _ := outboundPolicyFor("example.com")
+		return p.Disallow
+	}
+	start := time.Now().Add(-time.Hour)
+
+	write("domains:\n  - suffix: example.com\n    disallow: true\n", start)
+	if err := loadOutboundPolicies(path); err != nil || !disallowed() {
+		t.Fatalf("load = %v, disallowed %v", err, disallowed())
+	}
+	write("domains:\n  - suffix: example.com\n", start.Add(time.Minute))
+	if err := loadOutboundPolicies(path); err != nil || disallowed() {
+		t.Fatalf("reload = %v, still disallowed %v", err, disallowed())
+	}
+	// A change that doesn't parse keeps the policies in force.
+	write("domains:\n  - suffix: example.com\n    disallow: sometimes\n", start.Add(2*time.Minute))
+	if err := loadOutboundPolicies(path); err == nil || !strings.Contains(err.Error(), "OUTBOUND_POLICY_FILE") {
+		t.Errorf("reload of a broken file = %v", err)
+	}
+	if _, ok := outboundPolicyFor("example.com"); !ok || disallowed() {
+		t.Error("a broken file replaced the policies in force")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// testProxy is a forward proxy that sends every destination to upstream,
+// recording the requests it was asked to proxy.
+type testProxy struct {
+	*httptest.Server
+	upstream string
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newTestProxy(t *testing.T, upstream string) *testProxy {
+	p := &testProxy{upstream: upstream}
+	p.Server = httptest.NewServer(p)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.requests = append(p.requests, r.Method+" "+r.Host+" "+r.Header.Get("Proxy-Authorization"))
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", p.upstream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	if r.Method == http.MethodConnect {
+		w.WriteHeader(http.StatusOK)
+		client, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		go io.Copy(upstream, buf)
+		io.Copy(client, upstream)
+		return
+	}
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Authorization")
+	if err := r.Write(upstream); err != nil {
+		return
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(upstream), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *testProxy) seen() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+// withOutboundProxy replaces the proxy settings from the environment for
+// the rest of the test.
+func withOutboundProxy(tb testing.TB, cfg *httpproxy.Config) {
+	saved := loadOutboundProxy
+	loadOutboundProxy = func() outboundProxyConfig { return newOutboundProxyConfig(cfg) }
+	tb.Cleanup(func() { loadOutboundProxy = saved })
+}
+
+func TestOutboundProxy(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "plain") }))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "secure") }))
+	defer secure.Close()
+	httpProxy := newTestProxy(t, plain.Listener.Addr().String())
+	httpsProxy := newTestProxy(t, secure.Listener.Addr().String())
+	withOutboundProxy(t, &httpproxy.Config{
+		HTTPProxy:  "http://svc:s3cret@" + httpProxy.Listener.Addr().String(),
+		HTTPSProxy: "http://svc:s3cret@" + httpsProxy.Listener.Addr().String(),
+		NoProxy:    "internal.test",
+	})
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("svc:s3cret"))
+
+	// Hosts NO_PROXY names are dialed directly; example.com is in the test
+	// server's certificate.
+	var direct []string
+	transport := newOutboundTransport()
+	transport.TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !isOutboundProxyAddr(addr) {
+			direct = append(direct, addr)
+			addr = plain.Listener.Addr().String()
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	client := &http.Client{Transport: transport}
+	get := func(url string) string {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := get("http://example.com/page"); body != "plain" {
+		t.Errorf("plain HTTP through the proxy = %q", body)
+	}
+	if got := httpProxy.seen(); len(got) != 1 || got[0] != "GET example.com "+auth {
+		t.Errorf("HTTP proxy saw %q, want one authenticated GET", got)
+	}
+	if body := get("https://example.com/page"); body != "secure" {
+		t.Errorf("HTTPS through the proxy = %q", body)
+	}
+	if got := httpsProxy.seen(); len(got) != 1 || got[0] != "CONNECT example.com:443 "+auth {
+		t.Errorf("HTTPS proxy saw %q, want one authenticated CONNECT", got)
+	}
+	if body := get("http://api.internal.test/health"); body != "plain" || len(direct) != 1 || direct[0] != "api.internal.test:80" {
+		t.Errorf("NO_PROXY host = %q, dialed directly %q", body, direct)
+	}
+	if len(httpProxy.seen()) != 1 {
+		t.Errorf("the proxy was used for a NO_PROXY host: %q", httpProxy.seen())
+	}
+}
+
+func TestOutboundProxyKeepsSSRFGuard(t *testing.T) {
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer dest.Close()
+	proxy := newTestProxy(t, dest.Listener.Addr().String())
+	withOutboundProxy(t, &httpproxy.Config{HTTPProxy: proxy.URL, HTTPSProxy: proxy.URL})
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:       guardedProxy,
+		DialContext: guardedDialContext(&net.Dialer{}),
+	}}
+
+	// A private destination is refused before the proxy is asked for it...
+	if _, err := client.Get("http://10.1.2.3/admin"); !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("private destination through the proxy = %v, want %v", err, errNonPublicAddress)
+	}
+	if got := proxy.seen(); len(got) != 0 {
+		t.Errorf("the proxy was asked for %q", got)
+	}
+	// ...and loopback, which is never proxied, is refused by the dialer,
+	// while the proxy on loopback itself may be dialed.
+	if _, err := client.Get(dest.URL); err == nil || !strings.Contains(err.Error(), errNonPublicAddress.Error()) {
+		t.Errorf("loopback destination = %v, want it refused", err)
+	}
+	if !isOutboundProxyAddr(proxy.Listener.Addr().String()) {
+		t.Errorf("the proxy at %s is not recognized", proxy.Listener.Addr())
+	}
+}
+
+func TestProxyAddr(t *testing.T) {
+	tests := map[string]string{
+		"":                            "",
+		"proxy.corp:3128":             "proxy.corp:3128",
+		"http://u:p@proxy.corp:3128/": "proxy.corp:3128",
+		"http://proxy.corp":           "proxy.corp:80",
+		"https://proxy.corp":          "proxy.corp:443",
+		"socks5://[::1]":              "[::1]:1080",
+		"http://":                     "",
+	}
+	for in, want := range tests {
+		if got := proxyAddr(in); got != want {
+			t.Errorf("proxyAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
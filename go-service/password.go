@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A link created with a password only redirects once unlocked: GET /:code
+// answers 401 with a prompt, an HTML form for browsers, until the request
+// carries the password as ?pw= or the cookie POST /:code/unlock sets. The
+// cookie is signed with LINK_UNLOCK_SECRET and lasts LINK_UNLOCK_TTL.
+// Only a bcrypt hash of the password is stored. Protected links are never
+// cached, so every hit goes through the check, and only unlocked hits are
+// counted as clicks.
+var (
+	linkUnlockTTL = getEnvDuration("LINK_UNLOCK_TTL", 10*time.Minute)
+	// Without LINK_UNLOCK_SECRET a random per-process key is used, so
+	// unlocks don't survive restarts or carry over between instances.
+	linkUnlockSecret = []byte(getEnv("LINK_UNLOCK_SECRET", newRandomID()))
+)
+
+const (
+	linkPasswordMinLen = 4
+	// linkPasswordMaxLen is bcrypt's limit.
+	linkPasswordMaxLen = 72
+
+	linkUnlockCookieName = "sc_unlock"
+)
+
+//go:embed templates/password.html
+var passwordFS embed.FS
+
+var passwordTemplate = template.Must(template.ParseFS(passwordFS, "templates/password.html"))
+
+func validateLinkPassword(password string) error {
+	if len(password) < linkPasswordMinLen || len(password) > linkPasswordMaxLen {
+		return errors.New("password must be between " + strconv.Itoa(linkPasswordMinLen) + " and " + strconv.Itoa(linkPasswordMaxLen) + " bytes")
+	}
+	return nil
+}
+
+func hashLinkPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func checkLinkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// unlockToken binds an unlock to the code, the password hash and its
+// expiry, so changing the password locks the link again.
+func unlockToken(shortCode, passwordHash string, expires time.Time) string {
+	ts := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, linkUnlockSecret)
+	mac.Write([]byte(shortCode + "|" + passwordHash + "|" + ts))
+	return ts + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validUnlockToken(token, shortCode, passwordHash string, now time.Time) bool {
+	ts, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || !now.Before(time.Unix(unix, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(unlockToken(shortCode, passwordHash, time.Unix(unix, 0))))
+}
+
+// destinationVisible reports whether a caller may read a link's
+// destination without unlocking it: always for an unprotected link, and
+// for a protected one only when the caller is its owner or an admin. A
+// protected link without an owner shows its destination to admins alone.
+func destinationVisible(passwordHash, linkOwner sql.NullString, caller string, admin bool) bool {
+	return !passwordHash.Valid || admin || linkOwner.Valid && linkOwner.String == caller
+}
+
+// passesPassword reports whether the request may follow the protected link
+// shortCode. When it may not, the prompt has been written.
+func passesPassword(c *gin.Context, shortCode, passwordHash string) bool {
+	if token, err := c.Cookie(linkUnlockCookieName); err == nil && validUnlockToken(token, shortCode, passwordHash, time.Now()) {
+		return true
+	}
+	if password, ok := c.GetQuery("pw"); ok {
+		if checkLinkPassword(passwordHash, password) {
+			return true
+		}
+		log.Printf("Wrong password for %s from %s", shortCode, clientIP(c))
+		writePasswordPrompt(c, shortCode, "Incorrect password")
+		return false
+	}
+	writePasswordPrompt(c, shortCode, "")
+	return false
+}
+
+// writePasswordPrompt answers 401 for a locked link: a form for browsers,
+// JSON for everyone else. message is set after a wrong password.
+func writePasswordPrompt(c *gin.Context, shortCode, message string) {
+	action := "/" + shortCode + "/unlock"
+	c.Header("Cache-Control", "no-store")
+	if strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusUnauthorized)
+		if err := passwordTemplate.Execute(c.Writer, map[string]any{"Action": action, "Error": message}); err != nil {
+			log.Printf("Error rendering password prompt for %s: %v", shortCode, err)
+		}
+		return
+	}
+	if message == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Short URL is password protected", "code": "password_required", "unlock_url": action})
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": message, "code": "password_incorrect", "unlock_url": action})
+}
+
+// unlockLink serves POST /:code/unlock with the password as a form field
+// or JSON. A right password sets the unlock cookie and redirects back to
+// the link, which then counts the click.
+func (s *Server) unlockLink(c *gin.Context) {
+	shortCode := c.Param("code")
+	password := c.PostForm("password")
+	if password == "" && c.ContentType() == "application/json" {
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		password = body.Password
+	}
+
+	link, err := s.store.GetLongURL(c.Request.Context(), shortCode)
+	now := time.Now()
+	if err == nil && !linkActive(link.ActiveFrom, now) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if link.Status != linkStatusActive {
+		writeLinkUnavailable(c, link.Status)
+		return
+	}
+	if linkExpired(link.ExpiresAt, now) {
+		expiredAt, _ := time.Parse(time.RFC3339, link.ExpiresAt.String)
+		writeLinkExpired(c, expiredAt)
+		return
+	}
+	if scanBlocked(link.ScanStatus) {
+		writeScanBlocked(c, link.ScanStatus)
+		return
+	}
+	if link.PasswordHash.Valid {
+		if !checkLinkPassword(link.PasswordHash.String, password) {
+			log.Printf("Wrong password for %s from %s", shortCode, clientIP(c))
+			writePasswordPrompt(c, shortCode, "Incorrect password")
+			return
+		}
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(linkUnlockCookieName, unlockToken(shortCode, link.PasswordHash.String, now.Add(linkUnlockTTL)), int(linkUnlockTTL.Seconds()),
+			"/"+shortCode, "", strings.HasPrefix(publicBaseURL(c), "https://"), true)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusSeeOther, "/"+shortCode)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	pb "urlshortener/shortenerpb"
+)
+
+func TestGetURLHidesProtectedDestination(t *testing.T) {
+	r := testServer.newRouter()
+	anonymous := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/secret-anon", Password: "hunter22"}, "")
+	ownerID, ownerKey := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	owned := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/secret-owned", Password: "hunter22"}, ownerID)
+	plain := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/plain", ReuseExisting: new(bool)}, "")
+
+	tests := []struct {
+		name    string
+		code    string
+		headers []string
+		want    string
+	}{
+		{"protected, admin", anonymous.ShortCode, []string{"X-Admin-Token: " + testAdminToken}, "https://example.com/secret-anon"},
+		{"protected, other key", anonymous.ShortCode, []string{"X-API-Key: " + otherKey}, ""},
+		{"protected, owner", owned.ShortCode, []string{"X-API-Key: " + ownerKey}, "https://example.com/secret-owned"},
+		{"unprotected", plain.ShortCode, []string{"X-API-Key: " + otherKey}, "https://example.com/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(r, http.MethodGet, "/api/urls/"+tt.code, "", tt.headers...)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /api/urls/%s = %d: %s", tt.code, w.Code, w.Body)
+			}
+			var body map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := body["long_url"].(string)
+			if got != tt.want {
+				t.Errorf("long_url = %q, want %q", got, tt.want)
+			}
+			if tt.want == "" && body["resolved_url"] != nil {
+				t.Errorf("resolved_url = %v, want none", body["resolved_url"])
+			}
+		})
+	}
+}
+
+func TestGRPCResolveProtectedLink(t *testing.T) {
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/secret-grpc", Password: "hunter22"}, "owner-1")
+
+	for _, tt := range []struct {
+		name   string
+		caller grpcCaller
+		want   string
+	}{
+		{"anonymous", grpcCaller{}, ""},
+		{"owner", grpcCaller{owner: "owner-1"}, "https://example.com/secret-grpc"},
+		{"admin", grpcCaller{admin: true}, "https://example.com/secret-grpc"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), grpcCallerKey{}, tt.caller)
+			resp, err := grpcShortener{Server: testServer}.Resolve(ctx, &pb.ResolveRequest{ShortCode: link.ShortCode, RecordClick: true})
+			if tt.caller == (grpcCaller{}) {
+				// Someone else's link is not found at all.
+				if err == nil {
+					t.Fatalf("Resolve as %s = %v, want NotFound", tt.name, resp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.LongUrl != tt.want || !resp.PasswordProtected || resp.ClickRecorded {
+				t.Errorf("Resolve = long_url %q, protected %v, click %v; want %q, true, false",
+					resp.LongUrl, resp.PasswordProtected, resp.ClickRecorded, tt.want)
+			}
+		})
+	}
+
+	unowned := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/secret-grpc-unowned", Password: "hunter22"}, "")
+	resp, err := grpcShortener{Server: testServer}.Resolve(context.Background(), &pb.ResolveRequest{ShortCode: unowned.ShortCode, RecordClick: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.LongUrl != "" || resp.ClickRecorded {
+		t.Errorf("anonymous Resolve of an unowned protected link = long_url %q, click %v; want neither", resp.LongUrl, resp.ClickRecorded)
+	}
+}
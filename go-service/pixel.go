@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// transparentGIF is a 1x1 transparent GIF89a.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// shortCodePattern matches every code this service can hand out, generated
+// or imported, and is used to reject junk without touching the database.
+var shortCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var (
+	visitorHashSalt   = getEnv("VISITOR_HASH_SALT", "")
+	analyticsHonorDNT = getEnvBool("ANALYTICS_HONOR_DNT", true)
+)
+
+// visitorHash identifies a visitor for de-duplication without storing the IP.
+// It rotates daily so visitors cannot be followed across days.
+func visitorHash(c *gin.Context, day string) string {
+	sum := sha256.Sum256([]byte(visitorHashSalt + "|" + day + "|" + clientIP(c) + "|" + c.Request.UserAgent()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// trackingOptedOut reports whether the visitor asked not to be tracked.
+func trackingOptedOut(c *gin.Context) bool {
+	if !analyticsHonorDNT {
+		return false
+	}
+	return c.GetHeader("DNT") == "1" || c.GetHeader("Sec-GPC") == "1"
+}
+
+// conversionPixel serves GET /api/pixel/:code.gif. It always answers with the
+// GIF; recording happens asynchronously and unknown codes are dropped there.
+func (s *Server) conversionPixel(c *gin.Context) {
+	shortCode, ok := strings.CutSuffix(c.Param("file"), ".gif")
+
+	// The pixel is still served in maintenance mode; only the write is skipped.
+	if ok && shortCodePattern.MatchString(shortCode) && !trackingOptedOut(c) && !inMaintenance() {
+		now := time.Now().UTC()
+		day := now.Format("2006-01-02")
+		visitor := visitorHash(c, day)
+		go s.recordConversion(context.WithoutCancel(c.Request.Context()), shortCode, visitor, s.attributionVisitor(c), day, now)
+	}
+
+	c.Header("Cache-Control", "no-store, no-cache, must-revalidate, private")
+	c.Header("Pragma", "no-cache")
+	c.Data(http.StatusOK, "image/gif", transparentGIF)
+}
+
+// recordConversion stores at most one conversion per visitor, code and day,
+// attributed to the visitor's click when one is within the window, and
+// publishes a conversion event for each one stored.
+func (s *Server) recordConversion(ctx context.Context, shortCode, visitor, attributionVisitor, day string, at time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, clickPublishTimeout)
+	defer cancel()
+	var clickID, latencyMS any
+	conversion := &Conversion{}
+	if id, latency, ok := s.attributeConversion(ctx, shortCode, attributionVisitor, at); ok {
+		clickID, latencyMS = id, latency.Milliseconds()
+		conversion = &Conversion{Attributed: true, ClickID: id, ClickLatencyMS: latency.Milliseconds()}
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO conversions (short_code, visitor_hash, conversion_day, converted_at, click_id, click_latency_ms)
+		SELECT ?, ?, ?, ?, ?, CAST(? AS INTEGER) WHERE EXISTS (SELECT 1 FROM urls WHERE short_code = ?)`,
+		shortCode, visitor, day, at.Format(time.RFC3339), clickID, latencyMS, shortCode)
+	if err != nil {
+		log.Printf("Error recording conversion for %s: %v", shortCode, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		s.publishLifecycle(ctx, LifecycleEvent{Type: eventConversion, ShortCode: shortCode, Conversion: conversion})
+	}
+}
+
+// Conversion is what a conversion event reports: the click it was
+// attributed to, if any, and how long after that click it came.
+type Conversion struct {
+	Attributed     bool   `json:"attributed"`
+	ClickID        string `json:"click_id,omitempty"`
+	ClickLatencyMS int64  `json:"click_latency_ms,omitempty"`
+}
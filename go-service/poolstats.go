@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"time"
+)
+
+var (
+	dbPoolStats    = expvar.NewMap("db_pool")
+	redisPoolStats = expvar.NewMap("redis_pool")
+)
+
+// registerPoolStatsCollector periodically samples the sql.DB and go-redis
+// pool statistics into expvar so they show up in /admin/debug/vars.
+func (s *Server) registerPoolStatsCollector() {
+	interval := getEnvDuration("POOL_STATS_INTERVAL", 15*time.Second)
+	if interval <= 0 {
+		return
+	}
+	app.RegisterBackgroundJob("pool_stats", interval, func(context.Context) error {
+		s.samplePoolStats()
+		return nil
+	})
+}
+
+func (s *Server) samplePoolStats() {
+	if s.db != nil {
+		stats := s.db.Stats()
+		setGauge(dbPoolStats, "max_open", int64(stats.MaxOpenConnections))
+		setGauge(dbPoolStats, "open", int64(stats.OpenConnections))
+		setGauge(dbPoolStats, "in_use", int64(stats.InUse))
+		setGauge(dbPoolStats, "idle", int64(stats.Idle))
+		setGauge(dbPoolStats, "wait_count", stats.WaitCount)
+		setGauge(dbPoolStats, "wait_duration_ms", stats.WaitDuration.Milliseconds())
+		setGauge(dbPoolStats, "max_idle_closed", stats.MaxIdleClosed)
+		setGauge(dbPoolStats, "max_idle_time_closed", stats.MaxIdleTimeClosed)
+		setGauge(dbPoolStats, "max_lifetime_closed", stats.MaxLifetimeClosed)
+	}
+
+	// Redis is optional; report an explicit zeroed state rather than stale
+	// numbers when it is not connected.
+	client := s.rdb
+	if client == nil {
+		setGauge(redisPoolStats, "connected", 0)
+		return
+	}
+	stats := client.PoolStats()
+	setGauge(redisPoolStats, "connected", 1)
+	setGauge(redisPoolStats, "hits", int64(stats.Hits))
+	setGauge(redisPoolStats, "misses", int64(stats.Misses))
+	setGauge(redisPoolStats, "timeouts", int64(stats.Timeouts))
+	setGauge(redisPoolStats, "total_conns", int64(stats.TotalConns))
+	setGauge(redisPoolStats, "idle_conns", int64(stats.IdleConns))
+	setGauge(redisPoolStats, "stale_conns", int64(stats.StaleConns))
+}
+
+func setGauge(m *expvar.Map, key string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	m.Set(key, v)
+}
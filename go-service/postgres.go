@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// timedPostgresDriverName is Postgres through pgx, timed like SQLite. The
+// queries are written for SQLite; postgresConn rewrites the few places
+// where the dialects differ, and the schema defines SQLite's datetime and
+// strftime, so the rest of the service runs on either database unchanged.
+const timedPostgresDriverName = "postgres_timed"
+
+func init() {
+	sql.Register(timedPostgresDriverName, &timedDriver{base: postgresDriver{}})
+}
+
+// isPostgresURL reports whether DATABASE_URL names a Postgres database
+// rather than a SQLite file.
+func isPostgresURL(url string) bool {
+	return strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://")
+}
+
+// openPostgres opens the Postgres database at s.cfg.DatabaseURL, migrates
+// its schema and sets up the store on it.
+func (s *Server) openPostgres() error {
+	var err error
+	if s.db, err = sql.Open(timedPostgresDriverName, s.cfg.DatabaseURL); err != nil {
+		return err
+	}
+	configureDBPool(s.db)
+	if err := s.runMigrations(); err != nil {
+		s.db.Close()
+		return err
+	}
+	st, err := newPostgresStore(s.db)
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	if len(s.cfg.DatabaseReadURLs) > 0 {
+		if s.replicas, err = openReplicas(s.db, s.cfg.DatabaseReadURLs, s.cfg.ReplicaMaxLag); err != nil {
+			s.db.Close()
+			return err
+		}
+		st.reads = s.replicas
+	}
+	s.store = st
+	log.Printf("Postgres database initialized successfully, with %d read replica(s)", len(s.cfg.DatabaseReadURLs))
+	return nil
+}
+
+type postgresDriver struct{}
+
+func (postgresDriver) Open(name string) (driver.Conn, error) {
+	conn, err := stdlib.GetDefaultDriver().Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresConn{Conn: conn}, nil
+}
+
+// postgresConn rewrites queries and arguments for Postgres on their way to
+// pgx.
+type postgresConn struct {
+	driver.Conn
+}
+
+func (c *postgresConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *postgresConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, postgresQuery(query))
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStmt{Stmt: stmt}, nil
+}
+
+func (c *postgresConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, postgresQuery(query), postgresArgs(args))
+}
+
+func (c *postgresConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, postgresQuery(query), postgresArgs(args))
+}
+
+type postgresStmt struct {
+	driver.Stmt
+}
+
+func (s *postgresStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, postgresArgs(args))
+}
+
+func (s *postgresStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, postgresArgs(args))
+}
+
+// postgresQuery rewrites a query written for SQLite: ? placeholders become
+// $1, $2, ...; "IS ?" becomes IS NOT DISTINCT FROM, which is what SQLite's
+// IS means; and INSERT OR IGNORE becomes an insert that does nothing on
+// conflict. Placeholders inside quotes are left alone.
+func postgresQuery(query string) string {
+	ignore := strings.HasPrefix(query, "INSERT OR IGNORE ")
+	if ignore {
+		query = "INSERT " + strings.TrimPrefix(query, "INSERT OR IGNORE ")
+	}
+	query = strings.ReplaceAll(query, " IS ?", " IS NOT DISTINCT FROM ?")
+
+	var b strings.Builder
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	if ignore {
+		b.WriteString(" ON CONFLICT DO NOTHING")
+	}
+	return b.String()
+}
+
+// postgresArgs passes booleans as 1 and 0: the flag columns are integers,
+// as they are in SQLite.
+func postgresArgs(args []driver.NamedValue) []driver.NamedValue {
+	for i, arg := range args {
+		if v, ok := arg.Value.(bool); ok {
+			args[i].Value = int64(0)
+			if v {
+				args[i].Value = int64(1)
+			}
+		}
+	}
+	return args
+}
+
+// Postgres error codes the service tells apart; see isBusyError and
+// isUniqueViolation.
+const (
+	pgUniqueViolation      = "23505"
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+	pgLockNotAvailable     = "55P03"
+)
+
+// postgresErrorCode is err's SQLSTATE, "" when it isn't from Postgres.
+func postgresErrorCode(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// newPostgresStore is the URLStore in Postgres: sqlStore's queries, which
+// the driver rewrites, with a lock on what a reusing insert may reuse.
+// SQLite runs one writer at a time, so the insert's NOT EXISTS can't race
+// another; two Postgres transactions can both find nothing to reuse and
+// both insert, unless the second waits for the first.
+func newPostgresStore(db *sql.DB) (*sqlStore, error) {
+	st, err := newSQLStore(db)
+	if err != nil {
+		return nil, err
+	}
+	st.lockReusable = func(ctx context.Context, tx *sql.Tx, req ShortenRequest) error {
+		_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext(?))", req.canonicalHash()+" "+req.owner)
+		return err
+	}
+	return st, nil
+}
+
+// postgresMigrationLock is the advisory lock replicas take turns on to
+// migrate the schema.
+const postgresMigrationLock = 7_268_001
+
+// postgresSchemaMigrationsTable records the applied postgresMigrations.
+const postgresSchemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	applied_at TEXT DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);`
+
+// postgresMigrations are migrations for Postgres. The first is the SQLite
+// schema as of its migration 34, with SQLite's date functions; a schema
+// change after that appends an entry to both lists. Times are kept as text
+// in SQLite's formats, and flags as integers, so both databases answer the
+// same queries with the same values.
+var postgresMigrations = []string{
+	// 1: the SQLite schema through its migration 34
+	`CREATE FUNCTION datetime() RETURNS text LANGUAGE sql STABLE AS $$
+		SELECT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+	$$;
+	-- datetime(value) is value in UTC as YYYY-MM-DD HH:MM:SS, or NULL when
+	-- value is not a time, as in SQLite. It is only given stored times, so
+	-- it can be immutable and indexed.
+	CREATE FUNCTION datetime(value text) RETURNS text LANGUAGE plpgsql IMMUTABLE STRICT SET TimeZone = 'UTC' AS $$
+	BEGIN
+		RETURN to_char(value::timestamptz AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS');
+	EXCEPTION WHEN others THEN
+		RETURN NULL;
+	END
+	$$;
+	-- strftime supports the formats the queries use: %Y %m %d %H %M %S and
+	-- the literals T and Z.
+	CREATE FUNCTION strftime(format text, value text) RETURNS text LANGUAGE sql IMMUTABLE STRICT AS $$
+		SELECT to_char(datetime(value)::timestamp,
+			replace(replace(replace(replace(replace(replace(replace(replace(format,
+				'T', '"T"'), 'Z', '"Z"'), '%Y', 'YYYY'), '%m', 'MM'), '%d', 'DD'), '%H', 'HH24'), '%M', 'MI'), '%S', 'SS'))
+	$$;
+
+	CREATE TABLE urls (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		short_code TEXT UNIQUE NOT NULL,
+		long_url TEXT NOT NULL,
+		created_at TEXT DEFAULT datetime(),
+		imported_clicks BIGINT NOT NULL DEFAULT 0,
+		og_title TEXT,
+		og_description TEXT,
+		og_image TEXT,
+		challenge INTEGER NOT NULL DEFAULT 0,
+		challenged BIGINT NOT NULL DEFAULT 0,
+		active_from TEXT,
+		activated INTEGER NOT NULL DEFAULT 0,
+		is_test INTEGER NOT NULL DEFAULT 0,
+		owner TEXT,
+		hot INTEGER NOT NULL DEFAULT 0,
+		expires_at TEXT,
+		timezone TEXT,
+		notes TEXT,
+		scan_status TEXT,
+		canonical_hash TEXT,
+		redirect_type INTEGER,
+		resolved_url TEXT,
+		resolved_status INTEGER,
+		destination_problem TEXT,
+		password_hash TEXT,
+		status TEXT NOT NULL DEFAULT 'active',
+		utm TEXT
+	);
+	CREATE INDEX idx_urls_expires_at ON urls(expires_at) WHERE expires_at IS NOT NULL;
+	CREATE INDEX idx_urls_scan_pending ON urls(scan_status) WHERE scan_status = 'pending';
+	CREATE INDEX idx_urls_canonical_hash ON urls(canonical_hash, owner);
+	CREATE INDEX idx_urls_created_at ON urls(created_at, id);
+	CREATE INDEX idx_urls_owner_created_at ON urls(owner, created_at, id);
+	CREATE INDEX idx_urls_status ON urls(status) WHERE status != 'active';
+
+	CREATE TABLE clicks (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		click_id TEXT UNIQUE,
+		short_code TEXT NOT NULL,
+		clicked_at TEXT NOT NULL,
+		received_at TEXT DEFAULT datetime()
+	);
+	CREATE INDEX idx_clicks_short_code ON clicks(short_code, clicked_at);
+	CREATE INDEX idx_clicks_clicked_at ON clicks(datetime(clicked_at));
+
+	CREATE TABLE import_mappings (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		import_id TEXT NOT NULL,
+		old_url TEXT NOT NULL DEFAULT '',
+		long_url TEXT NOT NULL DEFAULT '',
+		short_code TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at TEXT DEFAULT datetime()
+	);
+	CREATE INDEX idx_import_mappings_import_id ON import_mappings(import_id);
+
+	CREATE TABLE conversions (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		short_code TEXT NOT NULL,
+		visitor_hash TEXT NOT NULL,
+		conversion_day TEXT NOT NULL,
+		converted_at TEXT NOT NULL,
+		click_id TEXT,
+		click_latency_ms BIGINT,
+		UNIQUE (short_code, visitor_hash, conversion_day)
+	);
+
+	CREATE TABLE domain_verifications (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		owner TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		token TEXT NOT NULL,
+		method TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		verified_at TEXT,
+		checked_at TEXT,
+		created_at TEXT DEFAULT datetime(),
+		UNIQUE (owner, domain)
+	);
+
+	-- The change feed. Its writers take turns, so seq is committed in order
+	-- and a reader that has seen seq n has seen everything before it, as
+	-- with the single SQLite writer.
+	CREATE TABLE url_changes (
+		seq BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		op TEXT NOT NULL,
+		short_code TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+	);
+	CREATE INDEX idx_url_changes_created_at ON url_changes(created_at);
+	CREATE FUNCTION url_changes_record() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		PERFORM pg_advisory_xact_lock(7268002);
+		IF TG_OP = 'DELETE' THEN
+			INSERT INTO url_changes (op, short_code, payload) VALUES ('delete', OLD.short_code, json_build_object('short_code', OLD.short_code)::text);
+			RETURN OLD;
+		END IF;
+		INSERT INTO url_changes (op, short_code, payload) VALUES (lower(TG_OP), NEW.short_code, json_build_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner, 'expires_at', NEW.expires_at, 'scan_status', NEW.scan_status,
+			'status', NEW.status)::text);
+		RETURN NEW;
+	END
+	$$;
+	CREATE TRIGGER url_changes_insert AFTER INSERT ON urls FOR EACH ROW WHEN (NEW.is_test = 0)
+		EXECUTE FUNCTION url_changes_record();
+	CREATE TRIGGER url_changes_update
+		AFTER UPDATE OF short_code, long_url, og_title, og_description, og_image, challenge, active_from, activated, hot, owner, expires_at, scan_status, status ON urls
+		FOR EACH ROW WHEN (NEW.is_test = 0) EXECUTE FUNCTION url_changes_record();
+	CREATE TRIGGER url_changes_delete AFTER DELETE ON urls FOR EACH ROW WHEN (OLD.is_test = 0)
+		EXECUTE FUNCTION url_changes_record();
+
+	CREATE TABLE resolver_sync_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		upstream TEXT NOT NULL,
+		cursor TEXT NOT NULL,
+		synced_at TEXT NOT NULL
+	);
+
+	CREATE TABLE stats_share_revocations (
+		jti TEXT PRIMARY KEY,
+		short_code TEXT NOT NULL,
+		revoked_at TEXT NOT NULL
+	);
+
+	CREATE TABLE click_counters (
+		short_code TEXT PRIMARY KEY,
+		clicks BIGINT NOT NULL DEFAULT 0,
+		last_clicked_at TEXT
+	);
+
+	CREATE TABLE owner_timezones (
+		owner TEXT PRIMARY KEY,
+		timezone TEXT NOT NULL,
+		updated_at TEXT DEFAULT datetime()
+	);
+
+	CREATE TABLE link_metadata (
+		short_code TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (short_code, key)
+	);
+	CREATE INDEX idx_link_metadata_key ON link_metadata(key, value);
+
+	CREATE TABLE owner_canonical_profiles (
+		owner TEXT PRIMARY KEY,
+		profile TEXT NOT NULL,
+		updated_at TEXT DEFAULT datetime()
+	);
+
+	CREATE TABLE link_claims (
+		short_code TEXT PRIMARY KEY,
+		token_hash TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		claimed_at TEXT,
+		claimed_by TEXT
+	);
+
+	CREATE TABLE pending_events (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		payload TEXT NOT NULL,
+		created_at TEXT DEFAULT datetime()
+	);
+
+	CREATE TABLE code_reservations (
+		short_code TEXT PRIMARY KEY,
+		batch_id TEXT NOT NULL,
+		created_at TEXT DEFAULT datetime(),
+		expires_at TEXT NOT NULL
+	);
+	CREATE INDEX idx_code_reservations_expires_at ON code_reservations(expires_at);
+	-- A reserved code is taken just as a stored one is.
+	CREATE FUNCTION urls_code_reservations() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM code_reservations WHERE short_code = NEW.short_code) THEN
+			RAISE EXCEPTION 'short code is reserved' USING ERRCODE = 'unique_violation';
+		END IF;
+		RETURN NEW;
+	END
+	$$;
+	CREATE TRIGGER urls_code_reservations BEFORE INSERT ON urls FOR EACH ROW EXECUTE FUNCTION urls_code_reservations();
+
+	CREATE TABLE api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		secret_hash TEXT NOT NULL,
+		admin INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL,
+		revoked_at TEXT,
+		trusted INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE idempotency_keys (
+		key TEXT PRIMARY KEY,
+		fingerprint TEXT NOT NULL,
+		status INTEGER,
+		content_type TEXT,
+		body BYTEA,
+		expires_at TEXT NOT NULL
+	);
+	CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+	CREATE TABLE webhooks (
+		id TEXT PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	CREATE TABLE webhook_deliveries (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		webhook_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		duration_ms BIGINT NOT NULL,
+		attempted_at TEXT NOT NULL
+	);
+	CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, id);
+
+	CREATE TABLE clicks_hourly (
+		short_code TEXT NOT NULL,
+		hour TEXT NOT NULL,
+		clicks BIGINT NOT NULL,
+		PRIMARY KEY (short_code, hour)
+	);
+	CREATE INDEX idx_clicks_hourly_hour ON clicks_hourly(hour);`,
+
+	// 2: SQLite migration 35
+	`ALTER TABLE urls ADD COLUMN status_changed_at TEXT;
+	ALTER TABLE urls ADD COLUMN legal_blocked INTEGER NOT NULL DEFAULT 0;
+	UPDATE urls SET status_changed_at = datetime() WHERE status != 'active';
+	CREATE TABLE recycled_codes (
+		short_code TEXT PRIMARY KEY,
+		recycled_at TEXT NOT NULL
+	);`,
+
+	// 3: SQLite migration 36
+	`ALTER TABLE urls ADD COLUMN destination_host TEXT;
+	UPDATE urls SET destination_host = lower(split_part(split_part(split_part(split_part(long_url, '://', 2), '/', 1), '?', 1), '#', 1));
+	CREATE INDEX idx_urls_owner_host ON urls(owner, destination_host, created_at, id);
+	CREATE INDEX idx_urls_owner_status ON urls(owner, status, created_at, id);
+	CREATE INDEX idx_urls_owner_expires_at ON urls(owner, expires_at);
+	CREATE INDEX idx_click_counters_last_clicked_at ON click_counters(last_clicked_at);`,
+
+	// 4: SQLite migration 37
+	`CREATE TABLE link_modified (
+		owner TEXT PRIMARY KEY,
+		version BIGINT NOT NULL,
+		modified_at TEXT NOT NULL
+	);
+	CREATE FUNCTION link_modified_bump() RETURNS trigger LANGUAGE plpgsql AS $$
+	DECLARE
+		owners text[] := ARRAY[''];
+	BEGIN
+		IF TG_TABLE_NAME = 'urls' THEN
+			IF TG_OP != 'DELETE' THEN
+				owners := owners || NEW.owner;
+			END IF;
+			IF TG_OP != 'INSERT' THEN
+				owners := owners || OLD.owner;
+			END IF;
+		ELSIF TG_OP = 'DELETE' THEN
+			owners := owners || (SELECT owner FROM urls WHERE short_code = OLD.short_code);
+		ELSE
+			owners := owners || (SELECT owner FROM urls WHERE short_code = NEW.short_code);
+		END IF;
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT DISTINCT o, 1, datetime() FROM unnest(owners) AS o WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+		RETURN NULL;
+	END
+	$$;
+	CREATE TRIGGER link_modified_urls_insert AFTER INSERT ON urls FOR EACH ROW WHEN (NEW.is_test = 0)
+		EXECUTE FUNCTION link_modified_bump();
+	CREATE TRIGGER link_modified_urls_update AFTER UPDATE ON urls FOR EACH ROW WHEN (NEW.is_test = 0)
+		EXECUTE FUNCTION link_modified_bump();
+	CREATE TRIGGER link_modified_urls_delete AFTER DELETE ON urls FOR EACH ROW WHEN (OLD.is_test = 0)
+		EXECUTE FUNCTION link_modified_bump();
+	CREATE TRIGGER link_modified_click_counters AFTER INSERT OR UPDATE ON click_counters FOR EACH ROW
+		EXECUTE FUNCTION link_modified_bump();
+	CREATE TRIGGER link_modified_link_metadata AFTER INSERT OR UPDATE OR DELETE ON link_metadata FOR EACH ROW
+		EXECUTE FUNCTION link_modified_bump();`,
+
+	// 5: SQLite migration 38
+	`ALTER TABLE api_keys ADD COLUMN tier TEXT NOT NULL DEFAULT 'standard';`,
+
+	// 6: SQLite migration 39
+	`CREATE TABLE key_usage_daily (
+		owner TEXT NOT NULL,
+		day TEXT NOT NULL,
+		links_created BIGINT NOT NULL DEFAULT 0,
+		clicks BIGINT NOT NULL DEFAULT 0,
+		api_calls BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (owner, day)
+	);
+	CREATE INDEX idx_key_usage_daily_day ON key_usage_daily(day);`,
+
+	// 7: SQLite migration 40
+	`ALTER TABLE webhook_deliveries ADD COLUMN request_body TEXT;
+	ALTER TABLE webhook_deliveries ADD COLUMN request_truncated INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE webhook_deliveries ADD COLUMN response_body TEXT;
+	ALTER TABLE webhook_deliveries ADD COLUMN response_truncated INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE webhook_deliveries ADD COLUMN replay_of BIGINT;
+	CREATE INDEX idx_webhook_deliveries_attempted_at ON webhook_deliveries(attempted_at);`,
+
+	// 8: SQLite migration 41
+	`ALTER TABLE urls ADD COLUMN expiry_warned_at TEXT;`,
+
+	// 9: SQLite migration 42
+	`ALTER TABLE clicks_hourly ADD COLUMN country TEXT NOT NULL DEFAULT '';
+	ALTER TABLE clicks_hourly DROP CONSTRAINT clicks_hourly_pkey;
+	ALTER TABLE clicks_hourly ADD PRIMARY KEY (short_code, hour, country);
+	ALTER TABLE clicks ADD COLUMN country TEXT;
+	ALTER TABLE clicks ADD COLUMN city TEXT;`,
+
+	// 10: SQLite migration 43
+	`CREATE TABLE link_aliases (
+		alias TEXT PRIMARY KEY,
+		short_code TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at TEXT
+	);
+	CREATE INDEX idx_link_aliases_short_code ON link_aliases(short_code);
+	-- A retained alias is taken just as a reserved code is.
+	CREATE FUNCTION urls_link_aliases() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM link_aliases WHERE alias = NEW.short_code AND (expires_at IS NULL OR datetime(expires_at) > datetime())) THEN
+			RAISE EXCEPTION 'short code is reserved' USING ERRCODE = 'unique_violation';
+		END IF;
+		RETURN NEW;
+	END
+	$$;
+	CREATE TRIGGER urls_link_aliases BEFORE INSERT ON urls FOR EACH ROW EXECUTE FUNCTION urls_link_aliases();`,
+
+	// 11: SQLite migration 44
+	`CREATE TABLE quota_warnings (
+		owner TEXT NOT NULL,
+		policy TEXT NOT NULL,
+		period TEXT NOT NULL,
+		threshold INTEGER NOT NULL,
+		sent_at TEXT NOT NULL,
+		PRIMARY KEY (owner, policy, period, threshold)
+	);
+	CREATE INDEX idx_quota_warnings_sent_at ON quota_warnings(sent_at);`,
+
+	// 12: SQLite migration 45
+	`ALTER TABLE urls ADD COLUMN webhook_url TEXT;
+	CREATE INDEX idx_urls_owner_webhook ON urls(owner) WHERE webhook_url IS NOT NULL;
+	CREATE TABLE link_webhook_secrets (
+		owner TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	ALTER TABLE webhook_deliveries ADD COLUMN short_code TEXT;
+	CREATE INDEX idx_webhook_deliveries_short_code ON webhook_deliveries(short_code, id);`,
+
+	// 13: SQLite migration 46
+	`CREATE TABLE shadow_mismatches (
+		id BIGSERIAL PRIMARY KEY,
+		selector TEXT NOT NULL,
+		short_code TEXT NOT NULL,
+		request_uri TEXT NOT NULL,
+		served TEXT NOT NULL,
+		candidate TEXT NOT NULL,
+		client_ip TEXT,
+		country TEXT,
+		city TEXT,
+		user_agent TEXT,
+		accept_language TEXT,
+		referrer TEXT,
+		recorded_at TEXT NOT NULL
+	);`,
+
+	// 14: SQLite migration 47
+	`CREATE TABLE settings_profiles (
+		owner TEXT NOT NULL,
+		name TEXT NOT NULL,
+		settings TEXT NOT NULL,
+		is_default INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY (owner, name)
+	);`,
+}
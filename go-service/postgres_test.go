@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestPostgresQuery(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT long_url FROM urls WHERE short_code = ?", "SELECT long_url FROM urls WHERE short_code = $1"},
+		{"UPDATE urls SET status = ? WHERE short_code = ? AND status != ?", "UPDATE urls SET status = $1 WHERE short_code = $2 AND status != $3"},
+		{"SELECT 1 FROM urls WHERE canonical_hash = ? AND owner IS ?", "SELECT 1 FROM urls WHERE canonical_hash = $1 AND owner IS NOT DISTINCT FROM $2"},
+		{"SELECT 1 FROM urls WHERE owner IS NULL", "SELECT 1 FROM urls WHERE owner IS NULL"},
+		{"SELECT '?', \"a?\" FROM t WHERE x = ?", "SELECT '?', \"a?\" FROM t WHERE x = $1"},
+		{"SELECT 'it''s ?' WHERE x = ?", "SELECT 'it''s ?' WHERE x = $1"},
+		{"INSERT OR IGNORE INTO conversions (short_code) VALUES (?)", "INSERT INTO conversions (short_code) VALUES ($1) ON CONFLICT DO NOTHING"},
+	}
+	for _, tt := range tests {
+		if got := postgresQuery(tt.query); got != tt.want {
+			t.Errorf("postgresQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPostgresArgs(t *testing.T) {
+	args := postgresArgs([]driver.NamedValue{{Ordinal: 1, Value: true}, {Ordinal: 2, Value: false}, {Ordinal: 3, Value: "x"}})
+	if args[0].Value != int64(1) || args[1].Value != int64(0) || args[2].Value != "x" {
+		t.Errorf("postgresArgs = %v, want bools as 1 and 0", args)
+	}
+}
+
+func TestIsPostgresURL(t *testing.T) {
+	for url, want := range map[string]bool{
+		"postgres://u:p@db/shortener":   true,
+		"postgresql://db/shortener":     true,
+		"go.db":                         false,
+		"/var/lib/shortener/go.db":      false,
+		"file:go.db?_busy_timeout=5000": false,
+	} {
+		if got := isPostgresURL(url); got != want {
+			t.Errorf("isPostgresURL(%q) = %v, want %v", url, got, want)
+		}
+	}
+}
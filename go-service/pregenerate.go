@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /admin/codes/pregenerate reserves a batch of codes, a fixed prefix
+// followed by a random suffix, before any destination exists, e.g. for
+// printing on cards. The reservations keep every other insert off those
+// codes, including custom aliases and imports of other links; a destination
+// is attached later with PUT /admin/codes/:code, or in bulk by importing
+// records whose short_code is the code. Reservations nobody attached a destination to
+// within CODE_RESERVATION_TTL are released by the expired link reaper.
+var (
+	codeReservationTTL  = getEnvDuration("CODE_RESERVATION_TTL", 90*24*time.Hour)
+	pregenerateMaxCodes = getEnvInt("PREGENERATE_MAX_CODES", 100000)
+)
+
+// codeReservedMessage is what the urls_code_reservations trigger aborts
+// with.
+const codeReservedMessage = "short code is reserved"
+
+// pregenerateBatch is how many codes one transaction reserves.
+const pregenerateBatch = 500
+
+// pregenerateMinSpace is how many times larger than the count the suffix
+// space must be, so that drawing rarely collides.
+const pregenerateMinSpace = 4
+
+var errCodeNotReserved = errors.New("code is not reserved")
+
+type pregenerateRequest struct {
+	Prefix string `json:"prefix"`
+	Count  int    `json:"count" binding:"required"`
+	// Alphabet is base64url, base62, or the suffix characters themselves,
+	// e.g. to leave out look-alikes; it defaults to SHORT_CODE_ALPHABET.
+	Alphabet string `json:"alphabet"`
+	// Length is the suffix length, defaulting to SHORT_CODE_LENGTH.
+	Length int `json:"length"`
+}
+
+// suffixChars resolves req's alphabet.
+func (req pregenerateRequest) suffixChars() (string, error) {
+	if req.Alphabet == "" {
+		return shortCodeChars, nil
+	}
+	if chars, ok := shortCodeAlphabets[req.Alphabet]; ok {
+		return chars, nil
+	}
+	seen := map[rune]bool{}
+	for _, r := range req.Alphabet {
+		if seen[r] || !shortCodePattern.MatchString(string(r)) {
+			return "", errors.New("alphabet must be base64url, base62, or distinct letters, digits, '-' or '_'")
+		}
+		seen[r] = true
+	}
+	if len(seen) < 2 {
+		return "", errors.New("alphabet needs at least 2 characters")
+	}
+	return req.Alphabet, nil
+}
+
+// postPregenerateCodes serves POST /admin/codes/pregenerate, answering
+// with the reserved codes as CSV. Should the run fail part way, the
+// batches it already reserved are released again.
+func (s *Server) postPregenerateCodes(c *gin.Context) {
+	var req pregenerateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Length == 0 {
+		req.Length = *shortCodeLength
+	}
+	chars, err := req.suffixChars()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch {
+	case req.Count < 1 || req.Count > pregenerateMaxCodes:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count must be between 1 and PREGENERATE_MAX_CODES"})
+		return
+	case req.Prefix != "" && !shortCodePattern.MatchString(req.Prefix):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prefix must be letters, digits, '-' or '_'"})
+		return
+	case req.Length < 1 || len(req.Prefix)+req.Length > 32:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prefix and suffix together must be at most 32 characters"})
+		return
+	case math.Pow(float64(len(chars)), float64(req.Length)) < pregenerateMinSpace*float64(req.Count):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "alphabet and length leave too few codes for count; use a longer suffix"})
+		return
+	}
+
+	batchID := newRandomID()
+	expiresAt := time.Now().Add(codeReservationTTL).UTC().Format(time.RFC3339)
+	codes, err := s.reserveCodes(c.Request.Context(), batchID, req.Prefix, chars, req.Length, req.Count, expiresAt)
+	if err != nil {
+		log.Printf("Error pregenerating codes: %v", err)
+		if _, err := s.execWithRetry(context.WithoutCancel(c.Request.Context()), "DELETE FROM code_reservations WHERE batch_id = ?", batchID); err != nil {
+			log.Printf("Error releasing partial code batch %s: %v", batchID, err)
+		}
+		if isBusyError(err) {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve codes"})
+		return
+	}
+	slog.Info("codes pregenerated", "audit", true, "by", clientIP(c), "batch_id", batchID, "prefix", req.Prefix, "count", len(codes))
+
+	base := publicBaseURL(c)
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="codes-`+batchID+`.csv"`)
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"short_code", "short_url", "expires_at"})
+	for _, code := range codes {
+		w.Write([]string{code, shortURLFor(base, code), expiresAt})
+	}
+	w.Flush()
+}
+
+// reserveCodes reserves count codes under batchID, pregenerateBatch per
+// transaction. A code that is already a link or reserved, by this run or
+// another, is skipped and another drawn.
+func (s *Server) reserveCodes(ctx context.Context, batchID, prefix, chars string, length, count int, expiresAt string) ([]string, error) {
+	codes := make([]string, 0, count)
+	attempts := 0
+	for len(codes) < count {
+		err := s.txWithRetry(ctx, func(tx *sql.Tx) error {
+			stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO code_reservations (short_code, batch_id, expires_at)
+				SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM urls WHERE short_code = ?)`)
+			if err != nil {
+				return err
+			}
+			defer stmt.Close()
+			var reserved []string
+			for want := min(count-len(codes), pregenerateBatch); len(reserved) < want; {
+				if attempts++; attempts > count*shortCodeAttempts {
+					return errors.New("too many collisions, the suffix space is nearly used up")
+				}
+				suffix, err := generateCode(chars, length)
+				if err != nil {
+					return err
+				}
+				code := prefix + suffix
+				res, err := stmt.ExecContext(ctx, code, batchID, expiresAt, code)
+				if err != nil {
+					return err
+				}
+				if n, _ := res.RowsAffected(); n == 1 {
+					reserved = append(reserved, code)
+				}
+			}
+			codes = append(codes, reserved...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// attachPregeneratedCode serves PUT /admin/codes/:code: the body is a
+// shorten request, whose link takes the reserved code. custom_alias is
+// ignored and the link is never answered with an existing one.
+func (s *Server) attachPregeneratedCode(c *gin.Context) {
+	code := c.Param("code")
+	var req ShortenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	reuse := false
+	req.CustomAlias, req.ReuseExisting, req.baseURL = "", &reuse, publicBaseURL(c)
+	if err := prepareShortenRequest(&req, "UTC", time.Now()); err != nil {
+		response := gin.H{"error": err.Error()}
+		if code := longURLErrorCode(err); code != "" {
+			response["code"] = code
+		}
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	ctx := c.Request.Context()
+	err := s.txWithRetry(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM code_reservations WHERE short_code = ?", code)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errCodeNotReserved
+		}
+		query, args := shortenInsert(req, code)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		if len(req.Metadata) > 0 {
+			return insertLinkMetadata(ctx, tx, code, req.Metadata)
+		}
+		return nil
+	})
+	if errors.Is(err, errCodeNotReserved) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Code is not reserved", "code": "code_not_reserved"})
+		return
+	}
+	if isBusyError(err) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error attaching %s: %v", code, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create short URL"})
+		return
+	}
+	s.forgetNotFound(ctx, code)
+	s.publishLifecycleEvent(context.WithoutCancel(ctx), eventURLCreated, code)
+	slog.Info("pregenerated code attached", "audit", true, "by", clientIP(c), "short_code", code, "long_url", redactURL(req.LongURL))
+	c.JSON(http.StatusOK, s.shortenResponse(ctx, req, code, false))
+}
+
+// reapCodeReservations releases reservations past their expiry.
+func (s *Server) reapCodeReservations(ctx context.Context) error {
+	res, err := s.execWithRetry(ctx, "DELETE FROM code_reservations WHERE expires_at < ?", time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Released %d unused code reservations", n)
+	}
+	return nil
+}
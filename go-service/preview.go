@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed templates/preview.html
+var previewFS embed.FS
+
+var previewTemplate = template.Must(template.ParseFS(previewFS, "templates/preview.html"))
+
+// ogImageAllowedHosts restricts og:image URLs to these host suffixes. Empty
+// means any http(s) host is accepted.
+var ogImageAllowedHosts = splitList(getEnv("OG_IMAGE_ALLOWED_HOSTS", ""))
+
+const (
+	maxOGTitleLen       = 200
+	maxOGDescriptionLen = 500
+	maxOGImageLen       = 2048
+)
+
+// crawlerUserAgents are link-unfurling bots that should see the preview page
+// instead of a redirect. Their hits are not counted as clicks.
+var crawlerUserAgents = []string{
+	"facebookexternalhit",
+	"facebot",
+	"twitterbot",
+	"slackbot",
+	"linkedinbot",
+	"discordbot",
+	"whatsapp",
+	"telegrambot",
+}
+
+func isPreviewCrawler(userAgent string) bool {
+	ua := strings.ToLower(userAgent)
+	for _, bot := range crawlerUserAgents {
+		if strings.Contains(ua, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// validateOpenGraph checks the optional per-link preview overrides.
+func validateOpenGraph(title, description, image string) error {
+	if len(title) > maxOGTitleLen {
+		return errors.New("og_title is too long")
+	}
+	if len(description) > maxOGDescriptionLen {
+		return errors.New("og_description is too long")
+	}
+	if image == "" {
+		return nil
+	}
+	if len(image) > maxOGImageLen {
+		return errors.New("og_image is too long")
+	}
+	u, err := url.Parse(image)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return errors.New("og_image must be an absolute http(s) URL")
+	}
+	if len(ogImageAllowedHosts) == 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range ogImageAllowedHosts {
+		allowed = strings.ToLower(strings.TrimPrefix(allowed, "."))
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return nil
+		}
+	}
+	return errors.New("og_image host is not allowed")
+}
+
+type previewPage struct {
+	ShortURL    string
+	LongURL     string
+	Title       string
+	Description string
+	Image       string
+}
+
+// servePreview renders the OpenGraph preview page for crawlers. It always
+// reads from the store because the cache only holds destinations.
+func (s *Server) servePreview(c *gin.Context, shortCode string) {
+	link, err := s.store.GetLongURL(c.Request.Context(), shortCode)
+	if err == nil && !linkActive(link.ActiveFrom, time.Now()) {
+		err = sql.ErrNoRows
+	}
+	if err == nil && link.Status != linkStatusActive {
+		writeLinkUnavailable(c, link.Status)
+		return
+	}
+	if err == nil && linkExpired(link.ExpiresAt, time.Now()) {
+		expiredAt, _ := time.Parse(time.RFC3339, link.ExpiresAt.String)
+		writeLinkExpired(c, expiredAt)
+		return
+	}
+	if err == nil && scanBlocked(link.ScanStatus) {
+		writeScanBlocked(c, link.ScanStatus)
+		return
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	// Crawlers can't unlock a protected link, so its preview would give
+	// the destination away.
+	if link.PasswordHash.Valid {
+		writePasswordPrompt(c, shortCode, "")
+		return
+	}
+
+	page := previewPage{
+		LongURL:     link.LongURL,
+		ShortURL:    shortURLFor(publicBaseURL(c), shortCode),
+		Title:       link.OGTitle.String,
+		Description: link.OGDescription.String,
+		Image:       link.OGImage.String,
+	}
+	if page.Title == "" {
+		page.Title = page.LongURL
+	}
+	// Only hand http(s) destinations to the meta refresh and links.
+	if u, err := url.Parse(page.LongURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		page.LongURL = ""
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	if err := previewTemplate.Execute(c.Writer, page); err != nil {
+		log.Printf("Error rendering preview for %s: %v", shortCode, err)
+	}
+}
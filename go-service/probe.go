@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// The golden link is PROBE_CODE redirecting to PROBE_DESTINATION, written
+// at startup when both are set. External monitors request it and check the
+// Location header; GET /admin/probe resolves it in-process and reports which
+// tier answered and how long each took. It is stored as a test link, so it
+// is never counted, cached links included, and it is never rate limited.
+var (
+	probeCode        = getEnv("PROBE_CODE", "_probe")
+	probeDestination = getEnv("PROBE_DESTINATION", "")
+)
+
+// probeEnabled reports whether the golden link is configured.
+func probeEnabled() bool {
+	return probeCode != "" && probeDestination != ""
+}
+
+// isProbeCode reports whether shortCode is the golden link.
+func isProbeCode(shortCode string) bool {
+	return probeEnabled() && shortCode == probeCode
+}
+
+// initProbeLink writes the golden link and drops any cached destination,
+// refusing to start if a real link already has the code.
+func (s *Server) initProbeLink() {
+	if !probeEnabled() {
+		return
+	}
+	if !shortCodePattern.MatchString(probeCode) {
+		log.Fatalf("Invalid PROBE_CODE %q: not a valid short code", probeCode)
+	}
+	destination, err := normalizeLongURL(probeDestination)
+	if err != nil {
+		log.Fatalf("Invalid PROBE_DESTINATION: %v", err)
+	}
+	probeDestination = destination
+
+	ctx := context.Background()
+	res, err := s.execWithRetry(ctx, `INSERT INTO urls (short_code, long_url, is_test) VALUES (?, ?, 1)
+		ON CONFLICT (short_code) DO UPDATE SET long_url = excluded.long_url WHERE urls.is_test = 1`, probeCode, probeDestination)
+	if err != nil {
+		log.Fatalf("Writing probe link: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Fatalf("PROBE_CODE %q is already used by a real link", probeCode)
+	}
+	if s.rdb != nil {
+		if err := s.rdb.Del(ctx, urlCacheKey(probeCode)).Err(); err != nil {
+			log.Printf("Error purging cached probe link: %v", err)
+		}
+	}
+}
+
+// probeStep is the outcome of looking the golden link up in one tier.
+type probeStep struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// getProbe serves GET /admin/probe. It times a cache read and a database
+// read of the golden link, then runs the redirect handler on it and
+// reports the tier that served it. ok is true when the redirect pointed at
+// PROBE_DESTINATION; the status is 503 otherwise.
+func (s *Server) getProbe(c *gin.Context) {
+	if !probeEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Probe link not configured; set PROBE_DESTINATION"})
+		return
+	}
+	reqCtx := c.Request.Context()
+
+	cache := probeStep{Status: "disabled"}
+	if s.rdb != nil {
+		cache = timeProbeStep(reqCtx, func(ctx context.Context) (string, error) {
+			err := s.rdb.Get(ctx, urlCacheKey(probeCode)).Err()
+			if errors.Is(err, redis.Nil) {
+				return "miss", nil
+			}
+			return "hit", err
+		})
+	}
+	database := timeProbeStep(reqCtx, func(ctx context.Context) (string, error) {
+		var longURL string
+		return "found", s.db.QueryRowContext(ctx, "SELECT long_url FROM urls WHERE short_code = ?", probeCode).Scan(&longURL)
+	})
+
+	w := httptest.NewRecorder()
+	rc, _ := gin.CreateTestContext(w)
+	rc.Request = httptest.NewRequestWithContext(reqCtx, http.MethodGet, "/"+probeCode, nil)
+	rc.Request.Header.Set("User-Agent", "url-shortener-probe")
+	rc.Params = gin.Params{{Key: "code", Value: probeCode}}
+	start := time.Now()
+	s.redirect(rc)
+	elapsed := time.Since(start)
+
+	servedBy := "none"
+	switch rc.GetString(redirectOutcomeContextKey) {
+	case redirectOutcomeCacheHit:
+		servedBy = "cache"
+	case redirectOutcomeCacheMiss:
+		servedBy = "database"
+	}
+	location := w.Header().Get("Location")
+	ok := location == probeDestination
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, gin.H{
+		"ok":          ok,
+		"code":        probeCode,
+		"destination": probeDestination,
+		"redirect": gin.H{
+			"status":     w.Code,
+			"location":   location,
+			"served_by":  servedBy,
+			"latency_ms": float64(elapsed.Microseconds()) / 1000,
+		},
+		"steps": gin.H{"cache": cache, "database": database},
+	})
+}
+
+// timeProbeStep runs lookup with readyProbeTimeout and times it.
+func timeProbeStep(ctx context.Context, lookup func(context.Context) (string, error)) probeStep {
+	ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	status, err := lookup(ctx)
+	step := probeStep{Status: status, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		step.Status, step.Error = "error", err.Error()
+	}
+	return step
+}
+
+// reservedProbeAlias reports whether alias would take the probe code.
+func reservedProbeAlias(alias string) bool {
+	return probeEnabled() && strings.EqualFold(alias, probeCode)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/skip2/go-qrcode"
+)
+
+// GET /api/qr/:code answers with a QR code of the code's public short URL.
+// The image only depends on the code, size, format and the base URL the
+// short URL is built on, so edits to the link never change it. Those four
+// make its strong ETag, a matching If-None-Match is answered 304, and
+// responses are immutable for browsers and CDNs for QR_MAX_AGE. Recently
+// rendered images are kept in an in-process LRU of QR_LOCAL_CACHE_SIZE
+// (0 turns it off) and images of the common sizes in Redis for
+// QR_CACHE_TTL, both keyed on the short URL as well, so a link served from
+// another domain never gets the image of the old one.
+var (
+	qrCacheTTL       = getEnvDuration("QR_CACHE_TTL", 24*time.Hour)
+	qrMaxAge         = getEnvDuration("QR_MAX_AGE", 30*24*time.Hour)
+	qrLocalCacheSize = getEnvInt("QR_LOCAL_CACHE_SIZE", 500)
+)
+
+const (
+	qrDefaultSize = 256
+	qrMinSize     = 64
+	qrMaxSize     = 1024
+
+	qrCacheKeyPrefix = "qr:"
+)
+
+// qrCachedSizes are the sizes worth keeping in Redis; others are rendered
+// on every request rather than filling the cache with one-offs.
+var qrCachedSizes = map[int]bool{128: true, 256: true, 300: true, 512: true, 1024: true}
+
+var qrContentTypes = map[string]string{
+	"png": "image/png",
+	"svg": "image/svg+xml",
+}
+
+func qrCacheKey(shortURL, format string, size int) string {
+	return qrCacheKeyPrefix + format + ":" + strconv.Itoa(size) + ":" + shortURL
+}
+
+// qrETag is the strong ETag of the image of shortCode under base.
+func qrETag(shortCode string, size int, format, base string) string {
+	sum := sha256.Sum256([]byte(shortCode + "\x00" + strconv.Itoa(size) + "\x00" + format + "\x00" + base))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// getQRCode serves GET /api/qr/:code.
+func (s *Server) getQRCode(c *gin.Context) {
+	shortCode := c.Param("code")
+	size := qrDefaultSize
+	if v := c.Query("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < qrMinSize || n > qrMaxSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "size must be between " + strconv.Itoa(qrMinSize) + " and " + strconv.Itoa(qrMaxSize)})
+			return
+		}
+		size = n
+	}
+	format := c.DefaultQuery("format", "png")
+	contentType, ok := qrContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be png or svg"})
+		return
+	}
+
+	if !shortCodePattern.MatchString(shortCode) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	}
+	ctx := c.Request.Context()
+	exists, err := s.store.Exists(ctx, shortCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	}
+
+	base := publicBaseURL(c)
+	etag := qrETag(shortCode, size, format, base)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		setQRCacheHeaders(c, etag)
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	body, err := s.qrImage(ctx, shortCode, shortURLFor(base, shortCode), format, size, etag)
+	if err != nil {
+		log.Printf("Error rendering QR code for %s: %v", shortCode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render QR code"})
+		return
+	}
+	setQRCacheHeaders(c, etag)
+	c.Header("Content-Disposition", `inline; filename="`+shortCode+`.`+format+`"`)
+	c.Data(http.StatusOK, contentType, body)
+}
+
+func setQRCacheHeaders(c *gin.Context, etag string) {
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(qrMaxAge.Seconds()))+", immutable")
+}
+
+// qrImage is the image of shortURL from the local cache, under etag, or
+// Redis, rendering it when neither has it.
+func (s *Server) qrImage(ctx context.Context, shortCode, shortURL, format string, size int, etag string) ([]byte, error) {
+	if body, ok := localQRImages.get(etag); ok {
+		return body, nil
+	}
+	cacheKey := qrCacheKey(shortURL, format, size)
+	cacheable := s.rdb != nil && qrCacheTTL > 0 && qrCachedSizes[size]
+	var body []byte
+	if cacheable {
+		cached, err := s.rdb.Get(ctx, cacheKey).Bytes()
+		if err == nil {
+			body = cached
+		} else if err != redis.Nil && !redisUnavailable(err) {
+			log.Printf("Error reading cached QR code for %s: %v", shortCode, err)
+		}
+	}
+	if body == nil {
+		var err error
+		if body, err = renderQR(shortURL, format, size); err != nil {
+			return nil, err
+		}
+		if cacheable {
+			if err := s.rdb.Set(ctx, cacheKey, body, qrCacheTTL).Err(); err != nil && !redisUnavailable(err) {
+				log.Printf("Error caching QR code for %s: %v", shortCode, err)
+			}
+		}
+	}
+	localQRImages.put(etag, body)
+	return body, nil
+}
+
+func renderQR(shortURL, format string, size int) ([]byte, error) {
+	code, err := qrcode.New(shortURL, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	if format == "svg" {
+		return qrSVG(code, size), nil
+	}
+	return code.PNG(size)
+}
+
+// qrSVG renders code as an SVG document size pixels square, one path of
+// unit squares on a white background.
+func qrSVG(code *qrcode.QRCode, size int) []byte {
+	bitmap := code.Bitmap()
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">
+<rect width="100%%" height="100%%" fill="#fff"/>
+<path fill="#000" d="`, size, size, len(bitmap), len(bitmap))
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d,%dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString("\"/>\n</svg>\n")
+	return []byte(b.String())
+}
+
+var qrLocalCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "urlshortener_qr_local_cache_lookups_total",
+	Help: "In-process QR image cache lookups by result (hit or miss).",
+}, []string{"result"})
+
+// qrLRU is a fixed-size LRU of rendered images by ETag. One of size 0
+// caches nothing.
+type qrLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type qrLRUEntry struct {
+	etag string
+	body []byte
+}
+
+var localQRImages = newQRLRU(qrLocalCacheSize)
+
+func newQRLRU(size int) *qrLRU {
+	return &qrLRU{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (l *qrLRU) get(etag string) ([]byte, bool) {
+	if l.size <= 0 {
+		return nil, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.entries[etag]
+	if !ok {
+		qrLocalCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	qrLocalCacheLookups.WithLabelValues("hit").Inc()
+	return el.Value.(*qrLRUEntry).body, true
+}
+
+func (l *qrLRU) put(etag string, body []byte) {
+	if l.size <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.entries[etag]; ok {
+		l.order.MoveToFront(el)
+		return
+	}
+	l.entries[etag] = l.order.PushFront(&qrLRUEntry{etag, body})
+	if l.order.Len() > l.size {
+		back := l.order.Back()
+		l.order.Remove(back)
+		delete(l.entries, back.Value.(*qrLRUEntry).etag)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// qrEngine serves only getQRCode, so the benchmarks measure the handler
+// rather than the middleware in front of it.
+func qrEngine() *gin.Engine {
+	r := gin.New()
+	r.GET("/api/qr/:code", testServer.getQRCode)
+	return r
+}
+
+// withQRCache replaces the in-process QR cache with an empty one of size
+// for the rest of the test.
+func withQRCache(tb testing.TB, size int) {
+	saved := localQRImages
+	localQRImages = newQRLRU(size)
+	tb.Cleanup(func() { localQRImages = saved })
+}
+
+// withBaseURL sets BASE_URL for the rest of the test.
+func withBaseURL(tb testing.TB, base string) {
+	saved := baseURL
+	baseURL = base
+	tb.Cleanup(func() { baseURL = saved })
+}
+
+func TestQRCodeConditionalRequests(t *testing.T) {
+	withQRCache(t, 10)
+	withBaseURL(t, "https://sho.rt")
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/qr-etag"}, "")
+	r := qrEngine()
+
+	w := serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("GET = %d with ETag %q", w.Code, etag)
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") || !strings.Contains(cc, "max-age=2592000") {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w := serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "", "If-None-Match: "+inm)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("If-None-Match %s = %d with %d bytes, ETag %q", inm, w.Code, w.Body.Len(), w.Header().Get("ETag"))
+		}
+	}
+	if w := serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "", `If-None-Match: "stale"`); w.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for _, query := range []string{"?size=512", "?format=svg"} {
+		if w := serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode+query, "", "If-None-Match: "+etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+			t.Errorf("%s with the default image's ETag = %d, ETag %q", query, w.Code, w.Header().Get("ETag"))
+		}
+	}
+	if w := serveTest(r, http.MethodGet, "/api/qr/no-such-code", "", "If-None-Match: *"); w.Code != http.StatusNotFound {
+		t.Errorf("missing code = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestQRCodeLocalCache(t *testing.T) {
+	withQRCache(t, 10)
+	withBaseURL(t, "https://sho.rt")
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/qr-lru"}, "")
+	r := qrEngine()
+	hits := func() float64 { return testutil.ToFloat64(qrLocalCacheLookups.WithLabelValues("hit")) }
+
+	before := hits()
+	first := serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "")
+	second := serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "")
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) || hits()-before != 1 {
+		t.Errorf("second fetch: same image %v, %v cache hits, want 1", bytes.Equal(first.Body.Bytes(), second.Body.Bytes()), hits()-before)
+	}
+
+	// The link served from another domain encodes another URL, so neither
+	// the ETag nor the cached image is reused.
+	withBaseURL(t, "https://links.example")
+	moved := serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "", "If-None-Match: "+first.Header().Get("ETag"))
+	if moved.Code != http.StatusOK || moved.Header().Get("ETag") == first.Header().Get("ETag") || bytes.Equal(moved.Body.Bytes(), first.Body.Bytes()) {
+		t.Errorf("after the domain changed = %d, ETag %q, same image %v", moved.Code, moved.Header().Get("ETag"), bytes.Equal(moved.Body.Bytes(), first.Body.Bytes()))
+	}
+}
+
+func TestQRLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newQRLRU(2)
+	l.put("a", []byte("a"))
+	l.put("b", []byte("b"))
+	l.get("a")
+	l.put("c", []byte("c"))
+	if _, ok := l.get("b"); ok {
+		t.Error("the least recently used image was kept")
+	}
+	if _, ok := l.get("a"); !ok {
+		t.Error("a recently used image was evicted")
+	}
+	off := newQRLRU(0)
+	off.put("a", []byte("a"))
+	if _, ok := off.get("a"); ok {
+		t.Error("a cache of size 0 kept an image")
+	}
+}
+
+// BenchmarkQRRender renders the default PNG, as every request did before
+// the local cache.
+func BenchmarkQRRender(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := renderQR("https://sho.rt/abc1234", "png", qrDefaultSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkQRCacheHit serves the default PNG from the local cache.
+func BenchmarkQRCacheHit(b *testing.B) {
+	withQRCache(b, 10)
+	link := shortenForTest(b, ShortenRequest{LongURL: "https://example.com/qr-bench"}, "")
+	r := qrEngine()
+	serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "")
+	}
+}
+
+// BenchmarkQRNotModified answers a revalidation with 304.
+func BenchmarkQRNotModified(b *testing.B) {
+	withQRCache(b, 10)
+	link := shortenForTest(b, ShortenRequest{LongURL: "https://example.com/qr-bench-304"}, "")
+	r := qrEngine()
+	etag := serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "").Header().Get("ETag")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		serveTest(r, http.MethodGet, "/api/qr/"+link.ShortCode, "", "If-None-Match: "+etag)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Callers get warned before a tier's quotas refuse them. The quotas are
+// the shorten rate limit, whose limit is the burst and whose period is the
+// minute, and links_per_day, the links an owner may create per UTC day. A
+// successful creation carries X-Quota-Remaining, what is left of each
+// quota ("rate_limit=3, link_quota=120"), and, once a quota's use has
+// passed one of QUOTA_WARNING_THRESHOLDS (percentages, 80 and 95 by
+// default), X-Quota-Warning with the highest threshold passed
+// ("link_quota=95"). The first request of an owner past a threshold also
+// sends a quota_warning event; quota_warnings records the ones sent, so
+// each goes out once per owner, quota, period and threshold.
+var quotaWarningThresholds = parseQuotaThresholds(getEnv("QUOTA_WARNING_THRESHOLDS", "80,95"))
+
+// quotaWarningRetention is how long sent warnings are remembered, past
+// the longest period.
+const quotaWarningRetention = 48 * time.Hour
+
+// quotaContextKey holds the []quotaUsage of the request's caller.
+const quotaContextKey = "quota_usage"
+
+// parseQuotaThresholds reads a comma-separated list of percentages.
+func parseQuotaThresholds(raw string) []int {
+	var thresholds []int
+	for _, field := range strings.Split(raw, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > 100 {
+			log.Fatalf("Invalid QUOTA_WARNING_THRESHOLDS: %q is not a percentage", field)
+		}
+		thresholds = append(thresholds, n)
+	}
+	slices.Sort(thresholds)
+	return slices.Compact(thresholds)
+}
+
+// quotaUsage is what a request left of one quota.
+type quotaUsage struct {
+	policy    string
+	limit     int
+	remaining int
+	// period names the period the quota is counted over.
+	period string
+}
+
+// warning is the highest threshold u's use has passed, 0 for none.
+func (u quotaUsage) warning() int {
+	used := (u.limit - u.remaining) * 100 / u.limit
+	warning := 0
+	for _, t := range quotaWarningThresholds {
+		if used >= t {
+			warning = t
+		}
+	}
+	return warning
+}
+
+// QuotaWarning is what a quota_warning event reports.
+type QuotaWarning struct {
+	Policy    string `json:"policy"`
+	Threshold int    `json:"threshold"`
+	Limit     int    `json:"limit"`
+	Remaining int    `json:"remaining"`
+	Period    string `json:"period"`
+}
+
+// linkQuotaPeriod is the UTC day links_per_day counts now in.
+func linkQuotaPeriod(now time.Time) string {
+	return now.UTC().Format(time.DateOnly)
+}
+
+// rateLimitPeriod is the minute the rate limit's use is reported for.
+func rateLimitPeriod(now time.Time) string {
+	return now.UTC().Format("2006-01-02T15:04")
+}
+
+// checkLinkQuota applies links_per_day to owner about to create links.
+// The count is taken before the request is read, so a batch started under
+// the quota is let through whole.
+func (s *Server) checkLinkQuota(ctx context.Context, tier, owner string, now time.Time) (*quotaUsage, *policyDenial) {
+	p := policyFor(tier)
+	if p.LinksPerDay <= 0 || owner == "" {
+		return nil, nil
+	}
+	day := now.UTC().Truncate(24 * time.Hour)
+	var created int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM urls WHERE owner = ? AND created_at >= ? AND is_test = 0",
+		owner, day.Format(time.DateTime)).Scan(&created); err != nil {
+		// The quota isn't worth failing the request over.
+		log.Printf("Error counting links of %s: %v", owner, err)
+		return nil, nil
+	}
+	if created >= p.LinksPerDay {
+		return nil, &policyDenial{tier: tier, policy: policyLinkQuota, status: http.StatusTooManyRequests, wait: day.Add(24 * time.Hour).Sub(now),
+			message: fmt.Sprintf("The %s tier may create %d links a day", tier, p.LinksPerDay)}
+	}
+	return &quotaUsage{policy: policyLinkQuota, limit: p.LinksPerDay, remaining: p.LinksPerDay - created - 1, period: linkQuotaPeriod(now)}, nil
+}
+
+// quotaWarnings remembers, in process, warnings known to be sent, so a
+// caller past a threshold doesn't write to quota_warnings on every
+// request.
+var quotaWarnings = &sentQuotaWarnings{sent: map[string]bool{}}
+
+type sentQuotaWarnings struct {
+	mu   sync.Mutex
+	sent map[string]bool
+}
+
+func (w *sentQuotaWarnings) seen(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sent[key]
+}
+
+func (w *sentQuotaWarnings) add(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.sent) >= 10000 {
+		clear(w.sent)
+	}
+	w.sent[key] = true
+}
+
+// warnQuotas sends owner's quota_warning events for the thresholds usages
+// passed that haven't been sent yet in their period.
+func (s *Server) warnQuotas(ctx context.Context, owner string, usages []quotaUsage, now time.Time) {
+	if owner == "" {
+		return
+	}
+	for _, u := range usages {
+		for _, threshold := range quotaWarningThresholds {
+			if threshold > u.warning() {
+				break
+			}
+			key := owner + "\x00" + u.policy + "\x00" + u.period + "\x00" + strconv.Itoa(threshold)
+			if quotaWarnings.seen(key) {
+				continue
+			}
+			res, err := s.execWithRetry(ctx, `INSERT INTO quota_warnings (owner, policy, period, threshold, sent_at) VALUES (?, ?, ?, CAST(? AS INTEGER), ?)
+				ON CONFLICT (owner, policy, period, threshold) DO NOTHING`, owner, u.policy, u.period, threshold, now.UTC().Format(time.RFC3339))
+			if err != nil {
+				log.Printf("Error recording quota warning for %s: %v", owner, err)
+				continue
+			}
+			quotaWarnings.add(key)
+			if n, _ := res.RowsAffected(); n == 0 {
+				continue
+			}
+			s.publishLifecycle(context.WithoutCancel(ctx), LifecycleEvent{Type: eventQuotaWarning, Owner: owner,
+				Quota: &QuotaWarning{Policy: u.policy, Threshold: threshold, Limit: u.limit, Remaining: u.remaining, Period: u.period}})
+		}
+	}
+}
+
+// noteQuotaUsage keeps usages for writeQuotaHeaders and sends the
+// warnings they call for.
+func (s *Server) noteQuotaUsage(c *gin.Context, usages []quotaUsage) {
+	if len(usages) == 0 {
+		return
+	}
+	c.Set(quotaContextKey, usages)
+	s.warnQuotas(c.Request.Context(), c.GetString(ownerContextKey), usages, time.Now())
+}
+
+// writeQuotaHeaders sets X-Quota-Remaining and X-Quota-Warning on a
+// successful response from the caller's usage.
+func writeQuotaHeaders(c *gin.Context) {
+	v, ok := c.Get(quotaContextKey)
+	if !ok {
+		return
+	}
+	var remaining, warnings []string
+	for _, u := range v.([]quotaUsage) {
+		remaining = append(remaining, u.policy+"="+strconv.Itoa(max(u.remaining, 0)))
+		if w := u.warning(); w > 0 {
+			warnings = append(warnings, u.policy+"="+strconv.Itoa(w))
+		}
+	}
+	c.Header("X-Quota-Remaining", strings.Join(remaining, ", "))
+	if len(warnings) > 0 {
+		c.Header("X-Quota-Warning", strings.Join(warnings, ", "))
+	}
+}
+
+// registerQuotaWarningPruner forgets warnings whose period is long over.
+func (s *Server) registerQuotaWarningPruner() {
+	app.RegisterBackgroundJob("quota_warning_pruner", time.Hour, func(ctx context.Context) error {
+		if inMaintenance() {
+			return nil
+		}
+		_, err := s.execWithRetry(ctx, "DELETE FROM quota_warnings WHERE sent_at < ?", time.Now().Add(-quotaWarningRetention).UTC().Format(time.RFC3339))
+		return err
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTierKey creates an API key in a new tier with policy p.
+func newTierKey(t *testing.T, p tierPolicy) (tier, id, key string) {
+	t.Helper()
+	tier = "q-" + newRandomID()[:8]
+	setTierPolicy(t, tier, p)
+	w := serveTest(testServer.newRouter(), http.MethodPost, "/admin/api-keys", `{"name":"quota","tier":"`+tier+`"}`, "Authorization: Bearer "+testAdminToken)
+	var created struct{ ID, Key string }
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create key = %d: %s", w.Code, w.Body)
+	}
+	return tier, created.ID, created.Key
+}
+
+// quotaWarningsFor is the quota_warning events sent for owner.
+func quotaWarningsFor(events *fakePublisher, owner string) []QuotaWarning {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	var warnings []QuotaWarning
+	for _, e := range events.lifecycle {
+		if e.Type == eventQuotaWarning && e.Owner == owner {
+			warnings = append(warnings, *e.Quota)
+		}
+	}
+	return warnings
+}
+
+func TestParseQuotaThresholds(t *testing.T) {
+	if got := parseQuotaThresholds(" 95, 80,,80"); !slices.Equal(got, []int{80, 95}) {
+		t.Errorf("thresholds = %v, want [80 95]", got)
+	}
+}
+
+func TestLinkQuotaWarnings(t *testing.T) {
+	s, _, events := newFakeServer(t)
+	r := s.newRouter()
+	tier, owner, key := newTierKey(t, tierPolicy{LinksPerDay: 10})
+	// The fake store doesn't write urls, so the links counted are added
+	// here.
+	created := 0
+	createLinks := func(n int) {
+		t.Helper()
+		for range n {
+			created++
+			if _, err := testServer.db.Exec("INSERT INTO urls (short_code, long_url, owner) VALUES (?, 'https://example.com/quota', ?)", "q-"+newRandomID()[:10], owner); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	shorten := func() (int, string, string) {
+		t.Helper()
+		w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/quota","reuse_existing":false}`, "X-API-Key: "+key)
+		return w.Code, w.Header().Get("X-Quota-Remaining"), w.Header().Get("X-Quota-Warning")
+	}
+
+	createLinks(6)
+	for _, tt := range []struct {
+		links              int
+		remaining, warning string
+		events             []int
+	}{
+		{0, "link_quota=3", "", nil},
+		{1, "link_quota=2", "link_quota=80", []int{80}},
+		{0, "link_quota=2", "link_quota=80", []int{80}},
+		{1, "link_quota=1", "link_quota=80", []int{80}},
+		{1, "link_quota=0", "link_quota=95", []int{80, 95}},
+	} {
+		createLinks(tt.links)
+		status, remaining, warning := shorten()
+		var thresholds []int
+		for _, w := range quotaWarningsFor(events, owner) {
+			thresholds = append(thresholds, w.Threshold)
+		}
+		if status != http.StatusOK || remaining != tt.remaining || warning != tt.warning || !slices.Equal(thresholds, tt.events) {
+			t.Errorf("shorten with %d links = %d, remaining %q, warning %q, warnings sent %v; want remaining %q, warning %q, warnings %v",
+				created, status, remaining, warning, thresholds, tt.remaining, tt.warning, tt.events)
+		}
+	}
+
+	createLinks(1)
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/quota"}`, "X-API-Key: "+key)
+	wantDenial(t, "shorten over the link quota", w, http.StatusTooManyRequests, tier, policyLinkQuota)
+}
+
+func TestRateLimitQuotaWarnings(t *testing.T) {
+	s, _, events := newFakeServer(t)
+	r := s.newRouter()
+	_, owner, key := newTierKey(t, tierPolicy{ShortenPerMinute: 1, ShortenBurst: 5})
+	var warnings []string
+	for range 5 {
+		w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/quota-rl"}`, "X-API-Key: "+key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+		}
+		warnings = append(warnings, w.Header().Get("X-Quota-Warning"))
+	}
+	if want := []string{"", "", "", "rate_limit=80", "rate_limit=95"}; !slices.Equal(warnings, want) {
+		t.Errorf("X-Quota-Warning = %q, want %q", warnings, want)
+	}
+	if got := quotaWarningsFor(events, owner); len(got) != 2 || got[0].Policy != policyRateLimit || got[1].Threshold != 95 || got[1].Remaining != 0 {
+		t.Errorf("warnings sent = %+v", got)
+	}
+}
+
+func TestQuotaWarningPeriods(t *testing.T) {
+	s, _, events := newFakeServer(t)
+	ctx := context.Background()
+	owner := "q-" + newRandomID()[:10]
+	usage := func(period string) []quotaUsage {
+		return []quotaUsage{{policy: policyLinkQuota, limit: 100, remaining: 10, period: period}}
+	}
+
+	s.warnQuotas(ctx, owner, usage("2026-01-01"), time.Now())
+	s.warnQuotas(ctx, owner, usage("2026-01-01"), time.Now())
+	if got := quotaWarningsFor(events, owner); len(got) != 1 || got[0].Threshold != 80 {
+		t.Fatalf("warnings after two requests in a period = %+v, want one at 80", got)
+	}
+	// What was sent is kept in the database, not only in this process.
+	clear(quotaWarnings.sent)
+	s.warnQuotas(ctx, owner, usage("2026-01-01"), time.Now())
+	if got := quotaWarningsFor(events, owner); len(got) != 1 {
+		t.Errorf("warnings after the in-process record was lost = %+v, want still one", got)
+	}
+
+	s.warnQuotas(ctx, owner, usage("2026-01-02"), time.Now())
+	if got := quotaWarningsFor(events, owner); len(got) != 2 || got[1].Period != "2026-01-02" {
+		t.Errorf("warnings after the period reset = %+v, want a second one", got)
+	}
+	s.warnQuotas(ctx, "", usage("2026-01-03"), time.Now())
+	if got := quotaWarningsFor(events, ""); len(got) != 0 {
+		t.Errorf("callers without an owner were sent %+v", got)
+	}
+}
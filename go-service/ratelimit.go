@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Rate limits are kept per scope ("redirect", "shorten") and client as
+// token buckets: a client may spend burst requests at once, and gets
+// per_minute back a minute. With Redis connected and RATE_LIMIT_REDIS on,
+// the bucket is a Redis hash shared by every replica; without Redis, or
+// when a Redis call fails, each instance keeps its own, which decides the
+// same way.
+var rateLimitRedis = getEnvBool("RATE_LIMIT_REDIS", true)
+
+// rateLimitStats counts Redis errors that fell back to local buckets.
+var rateLimitStats = expvar.NewMap("rate_limit")
+
+// rateLimitRedisTimeout bounds the Redis check, after which the local
+// bucket decides.
+const rateLimitRedisTimeout = 50 * time.Millisecond
+
+// rateLimitScript is bucketStore.take in Redis: the bucket is a hash of
+// tokens and ts, the time in milliseconds they are as of, that expires once
+// it would have refilled. ARGV is now, the refill rate per millisecond, the
+// burst and "1" to spend a token, "0" to only report. It returns {allowed,
+// remaining, ms until the next token}.
+var rateLimitScript = redis.NewScript(`
+local key, now, rate, burst = KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens, ts = tonumber(state[1]), tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens, ts = burst, now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+if tokens < 1 then
+	return {0, 0, math.ceil((1 - tokens) / rate)}
+end
+if ARGV[4] == '1' then
+	tokens = tokens - 1
+	redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', now)
+	redis.call('PEXPIRE', key, math.ceil((burst - tokens) / rate) + 1)
+end
+return {1, math.floor(tokens), 0}
+`)
+
+// tokenBucket is one client's bucket; tokens are as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketStore holds one scope's local token buckets.
+type bucketStore struct {
+	sync.Mutex
+	m map[string]*tokenBucket
+}
+
+// rateLimitBuckets holds each scope's local buckets, made on first use.
+var rateLimitBuckets sync.Map
+
+// bucketsFor is scope's local buckets.
+func bucketsFor(scope string) *bucketStore {
+	if b, ok := rateLimitBuckets.Load(scope); ok {
+		return b.(*bucketStore)
+	}
+	b, _ := rateLimitBuckets.LoadOrStore(scope, &bucketStore{m: map[string]*tokenBucket{}})
+	return b.(*bucketStore)
+}
+
+// take spends one of client's tokens if it has one. It returns the tokens
+// left, or else how long until the next one.
+func (s *bucketStore) take(client string, perMinute, burst int, now time.Time, spend bool) (bool, int, time.Duration) {
+	perSecond := float64(perMinute) / 60
+	s.Lock()
+	defer s.Unlock()
+	b := s.m[client]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		if spend {
+			s.m[client] = b
+		}
+	}
+	tokens := min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	if tokens < 1 {
+		wait := time.Duration((1 - tokens) / perSecond * float64(time.Second))
+		return false, 0, wait
+	}
+	if spend {
+		tokens--
+		b.tokens, b.last = tokens, now
+	}
+	return true, int(tokens), 0
+}
+
+// prune drops buckets that have refilled, so clients seen once don't stay
+// in memory, and returns how many are left.
+func (s *bucketStore) prune(perMinute, burst int, now time.Time) int {
+	s.Lock()
+	defer s.Unlock()
+	for client, b := range s.m {
+		if perMinute == 0 || b.tokens+now.Sub(b.last).Minutes()*float64(perMinute) >= float64(burst) {
+			delete(s.m, client)
+		}
+	}
+	return len(s.m)
+}
+
+// limitClient decides one request by client in scope; with spend false it
+// only reports what the decision would be. It returns whether the request
+// is allowed, how many more are, and otherwise how long to wait.
+func (s *Server) limitClient(ctx context.Context, scope, client string, perMinute, burst int, spend bool) (bool, int, time.Duration) {
+	now := time.Now()
+	if rateLimitRedis && s.rdb != nil {
+		ok, remaining, wait, err := s.limitClientRedis(ctx, scope, client, perMinute, burst, now, spend)
+		if err == nil {
+			return ok, remaining, wait
+		}
+		rateLimitStats.Add("redis_fallbacks", 1)
+	}
+	return bucketsFor(scope).take(client, perMinute, burst, now, spend)
+}
+
+func (s *Server) limitClientRedis(ctx context.Context, scope, client string, perMinute, burst int, now time.Time, spend bool) (bool, int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, rateLimitRedisTimeout)
+	defer cancel()
+	spendArg := "0"
+	if spend {
+		spendArg = "1"
+	}
+	res, err := rateLimitScript.Run(ctx, s.rdb, []string{"ratelimit:" + scope + ":" + client},
+		now.UnixMilli(), float64(perMinute)/float64(time.Minute.Milliseconds()), burst, spendArg).Int64Slice()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if len(res) != 3 {
+		return false, 0, 0, errors.New("unexpected rate limit script result")
+	}
+	return res[0] == 1, int(res[1]), time.Duration(res[2]) * time.Millisecond, nil
+}
+
+// rateLimitMode names the limiter that decides requests right now.
+func (s *Server) rateLimitMode() string {
+	if rateLimitRedis && s.rdb != nil {
+		return "shared-token-bucket"
+	}
+	return "token-bucket"
+}
+
+// abortRateLimited answers a limited request with 429 and when to retry.
+func abortRateLimited(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+}
+
+// SHORTEN_LIMIT_PER_MINUTE and SHORTEN_LIMIT_BURST are the standard
+// tier's default rate; tier.go applies it, and the other tiers' rates, per
+// client IP.
+var (
+	shortenLimitPerMinute = getEnvInt("SHORTEN_LIMIT_PER_MINUTE", 10)
+	shortenLimitBurst     = getEnvInt("SHORTEN_LIMIT_BURST", shortenLimitPerMinute)
+)
+
+var shortenLimitStats = expvar.NewMap("shorten_limiter")
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+)
+
+type rateLimitStep struct {
+	after     time.Duration
+	spend     bool
+	allowed   bool
+	remaining int
+	wait      time.Duration
+}
+
+// rateLimitSteps is a client limited to 60 a minute with a burst of 3:
+// the burst, then refill one token a second.
+var rateLimitSteps = []rateLimitStep{
+	{0, true, true, 2, 0},
+	{0, true, true, 1, 0},
+	{0, true, true, 0, 0},
+	{0, true, false, 0, time.Second},
+	{500 * time.Millisecond, true, false, 0, 500 * time.Millisecond},
+	{time.Second, true, true, 0, 0},
+	{10 * time.Second, false, true, 3, 0},
+	{10 * time.Second, true, true, 2, 0},
+}
+
+func TestRateLimitBucketsMatch(t *testing.T) {
+	start := time.Now()
+	local := &bucketStore{m: map[string]*tokenBucket{}}
+	useRedis(t)
+
+	deciders := map[string]func(now time.Time, spend bool) (bool, int, time.Duration){
+		"local": func(now time.Time, spend bool) (bool, int, time.Duration) {
+			return local.take("client", 60, 3, now, spend)
+		},
+		"redis": func(now time.Time, spend bool) (bool, int, time.Duration) {
+			ok, remaining, wait, err := testServer.limitClientRedis(context.Background(), "test", t.Name(), 60, 3, now, spend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ok, remaining, wait
+		},
+	}
+	for mode, decide := range deciders {
+		for i, step := range rateLimitSteps {
+			ok, remaining, wait := decide(start.Add(step.after), step.spend)
+			if ok != step.allowed || remaining != step.remaining || (wait-step.wait).Abs() > 2*time.Millisecond {
+				t.Errorf("%s step %d = %v, %d, %v; want %v, %d, %v", mode, i, ok, remaining, wait, step.allowed, step.remaining, step.wait)
+			}
+		}
+	}
+}
+
+func TestRateLimitFallsBackWhenRedisDrops(t *testing.T) {
+	mr := useRedis(t)
+	client := t.Name()
+	for range 3 {
+		if ok, _, _ := testServer.limitClient(context.Background(), "shorten", client, 60, 3, true); !ok {
+			t.Fatal("request within the burst limited")
+		}
+	}
+	if ok, _, _ := testServer.limitClient(context.Background(), "shorten", client, 60, 3, true); ok {
+		t.Fatal("request over the burst allowed")
+	}
+
+	fallbacks := func() int64 {
+		v, _ := rateLimitStats.Get("redis_fallbacks").(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	before := fallbacks()
+	mr.Close()
+	// The local bucket hasn't seen the client, so it starts full.
+	if ok, remaining, _ := testServer.limitClient(context.Background(), "shorten", client, 60, 3, true); !ok || remaining != 2 {
+		t.Errorf("after Redis dropped = %v, %d remaining; want allowed by a fresh local bucket", ok, remaining)
+	}
+	if fallbacks() != before+1 {
+		t.Errorf("redis_fallbacks = %d, want %d", fallbacks(), before+1)
+	}
+}
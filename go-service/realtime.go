@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The realtime counter keeps one bucket per second for the last minute,
+// globally and per code: INCR on short-lived Redis keys when Redis is
+// connected, an in-process ring otherwise.
+const (
+	realtimeWindow    = 60
+	realtimeKeyTTL    = 2 * time.Minute
+	realtimeKeyPrefix = "rt:"
+)
+
+func realtimeKey(code string, sec int64) string {
+	if code == "" {
+		return realtimeKeyPrefix + "all:" + strconv.FormatInt(sec, 10)
+	}
+	return realtimeKeyPrefix + "code:" + code + ":" + strconv.FormatInt(sec, 10)
+}
+
+// secondRing counts events per second over the last realtimeWindow seconds.
+type secondRing struct {
+	secs   [realtimeWindow]int64
+	counts [realtimeWindow]int64
+}
+
+func (r *secondRing) add(sec int64) {
+	i := sec % realtimeWindow
+	if r.secs[i] != sec {
+		r.secs[i] = sec
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+}
+
+func (r *secondRing) sum(now int64) int64 {
+	var total int64
+	for i := range r.secs {
+		if now-r.secs[i] < realtimeWindow {
+			total += r.counts[i]
+		}
+	}
+	return total
+}
+
+type localRealtime struct {
+	mu     sync.Mutex
+	all    secondRing
+	byCode map[string]*secondRing
+	last   map[string]int64
+}
+
+var realtimeLocal = &localRealtime{byCode: map[string]*secondRing{}, last: map[string]int64{}}
+
+func (l *localRealtime) record(code string, sec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.all.add(sec)
+	ring, ok := l.byCode[code]
+	if !ok {
+		ring = &secondRing{}
+		l.byCode[code] = ring
+	}
+	ring.add(sec)
+	l.last[code] = sec
+}
+
+func (l *localRealtime) count(code string, now int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if code == "" {
+		return l.all.sum(now)
+	}
+	if ring, ok := l.byCode[code]; ok {
+		return ring.sum(now)
+	}
+	return 0
+}
+
+// prune drops codes without a click in the window so memory stays bounded
+// by the number of recently active codes.
+func (l *localRealtime) prune(now int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for code, sec := range l.last {
+		if now-sec >= realtimeWindow {
+			delete(l.byCode, code)
+			delete(l.last, code)
+		}
+	}
+}
+
+func registerRealtimePruner() {
+	app.RegisterBackgroundJob("realtime_pruner", realtimeWindow*time.Second, func(context.Context) error {
+		realtimeLocal.prune(time.Now().Unix())
+		return nil
+	})
+}
+
+// recordRealtimeClick runs on the click publisher workers, never on the
+// request goroutine.
+func (s *Server) recordRealtimeClick(ctx context.Context, code string, at time.Time) {
+	sec := at.Unix()
+	if s.rdb == nil {
+		realtimeLocal.record(code, sec)
+		return
+	}
+	pipe := s.rdb.Pipeline()
+	for _, key := range []string{realtimeKey("", sec), realtimeKey(code, sec)} {
+		pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, realtimeKeyTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		// Keep counting locally rather than losing the click.
+		realtimeLocal.record(code, sec)
+	}
+}
+
+func (s *Server) realtimeCount(ctx context.Context, code string, now time.Time) (int64, string) {
+	sec := now.Unix()
+	if s.rdb == nil {
+		return realtimeLocal.count(code, sec), "local"
+	}
+
+	keys := make([]string, realtimeWindow)
+	for i := range keys {
+		keys[i] = realtimeKey(code, sec-int64(i))
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisRequestTimeout)
+	defer cancel()
+	values, err := s.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return realtimeLocal.count(code, sec), "local"
+	}
+	var total int64
+	for _, v := range values {
+		if str, ok := v.(string); ok {
+			n, _ := strconv.ParseInt(str, 10, 64)
+			total += n
+		}
+	}
+	// Clicks counted locally while Redis was failing still belong here.
+	return total + realtimeLocal.count(code, sec), "redis"
+}
+
+// realtimeLimiter allows a few requests per client per second; the
+// big-screen dashboards poll, they don't need more.
+type realtimeLimiter struct {
+	mu     sync.Mutex
+	second int64
+	hits   map[string]int
+}
+
+var (
+	realtimeRateLimit = getEnvInt("REALTIME_RATE_LIMIT", 5)
+	realtimeLimit     = &realtimeLimiter{hits: map[string]int{}}
+)
+
+func (l *realtimeLimiter) allow(client string, now int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now != l.second {
+		l.second = now
+		clear(l.hits)
+	}
+	l.hits[client]++
+	return l.hits[client] <= realtimeRateLimit
+}
+
+// getRealtimeStats serves GET /api/stats/realtime?code=. Without a code it
+// counts every link's clicks.
+func (s *Server) getRealtimeStats(c *gin.Context) {
+	now := time.Now()
+	if !realtimeLimit.allow(clientIP(c), now.Unix()) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+		return
+	}
+
+	code := c.Query("code")
+	if code != "" && !shortCodePattern.MatchString(code) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+	// One link's count is read as getStats reads it: by its owner or an
+	// admin.
+	if code != "" {
+		var activeFrom, owner sql.NullString
+		err := s.db.QueryRowContext(c.Request.Context(), "SELECT active_from, owner FROM urls WHERE short_code = ? AND is_test = 0", code).Scan(&activeFrom, &owner)
+		if err == nil && (!linkActive(activeFrom, now) || !s.statsReadable(c, owner)) {
+			err = sql.ErrNoRows
+		}
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	clicks, source := s.realtimeCount(c.Request.Context(), code, now)
+	response := gin.H{
+		"clicks":         clicks,
+		"window_seconds": realtimeWindow,
+		"as_of":          now.UTC().Format(time.RFC3339),
+		"source":         source,
+	}
+	// Without Redis configured, local counts are all there is; with it, a
+	// local answer means Redis failed and other instances are missing.
+	meta := newStatsMeta()
+	if s.rdb != nil {
+		if source == "redis" {
+			meta.ok(statsSourceRedisLive, now.UTC().Format(time.RFC3339))
+		} else {
+			meta.unavailable(statsSourceRedisLive, "Redis unavailable; only clicks served by this instance are counted")
+		}
+	}
+	response["meta"] = meta.json()
+	if code != "" {
+		response["short_code"] = code
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
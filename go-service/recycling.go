@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// With CODE_RECYCLING on, the codes of long-dead links go back to the
+// generator. A link soft-deleted, or expired, for CODE_TOMBSTONE_PERIOD is
+// deleted by the expired link reaper and its code pooled in
+// recycled_codes, which generated codes are drawn from first. Until then
+// the code keeps answering 410, so old printed links don't point somewhere
+// new too soon. A code that was ever under legal_block is never recycled.
+// Without recycling, soft-deleted codes are kept forever and expired ones
+// freed after EXPIRED_LINK_RETENTION, as before.
+var (
+	codeRecycling       = getEnvBool("CODE_RECYCLING", false)
+	codeTombstonePeriod = getEnvDuration("CODE_TOMBSTONE_PERIOD", 180*24*time.Hour)
+)
+
+var (
+	recycledCodesPool = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "urlshortener_recycled_codes",
+		Help: "Codes waiting in the recycled pool, as of the last reaper run.",
+	})
+	codesRecycledTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "urlshortener_codes_recycled_total",
+		Help: "Codes of dead links put in the recycled pool.",
+	})
+	recycledCodesReusedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "urlshortener_recycled_codes_reused_total",
+		Help: "Codes drawn from the recycled pool for new links.",
+	})
+)
+
+// recycleDeadLinks deletes the links whose tombstone period ended before
+// now and pools their codes, a batch at a time, returning how many it
+// recycled.
+func (s *Server) recycleDeadLinks(ctx context.Context, now time.Time) (int, error) {
+	cutoff := now.UTC().Add(-codeTombstonePeriod)
+	total := 0
+	for {
+		// status_changed_at is in datetime()'s format, expires_at in RFC 3339.
+		codes, err := s.queryStrings(ctx, `SELECT short_code FROM urls WHERE legal_blocked = 0
+			AND (status = 'deleted' AND status_changed_at < ? OR expires_at < ?) LIMIT ?`,
+			cutoff.Format(time.DateTime), cutoff.Format(time.RFC3339), expiredLinkReapBatch)
+		if err != nil || len(codes) == 0 {
+			return total, err
+		}
+		recycledAt := now.UTC().Format(time.RFC3339)
+		err = s.txWithRetry(ctx, func(tx *sql.Tx) error {
+			if _, err := deleteLinksTx(ctx, tx, codes); err != nil {
+				return err
+			}
+			for _, code := range codes {
+				if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO recycled_codes (short_code, recycled_at) VALUES (?, ?)", code, recycledAt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		for _, code := range codes {
+			s.purgeLinkCache(ctx, code)
+		}
+		total += len(codes)
+		codesRecycledTotal.Add(float64(len(codes)))
+		if len(codes) < expiredLinkReapBatch {
+			break
+		}
+	}
+
+	var pooled int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM recycled_codes").Scan(&pooled); err != nil {
+		return total, err
+	}
+	recycledCodesPool.Set(float64(pooled))
+	return total, nil
+}
+
+// drawShortCode is the next code to try for a new link: the oldest one in
+// the recycled pool when recycling is on, otherwise a random one. A pool
+// that can't be read is skipped.
+func drawShortCode(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}) (string, error) {
+	if codeRecycling {
+		var code string
+		err := q.QueryRowContext(ctx, `DELETE FROM recycled_codes WHERE short_code =
+			(SELECT short_code FROM recycled_codes ORDER BY recycled_at, short_code LIMIT 1) RETURNING short_code`).Scan(&code)
+		if err == nil {
+			recycledCodesReusedTotal.Inc()
+			return code, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error drawing from the recycled code pool: %v", err)
+		}
+	}
+	return generateShortCode()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func withCodeRecycling(tb testing.TB) {
+	tb.Helper()
+	saved := codeRecycling
+	codeRecycling = true
+	tb.Cleanup(func() { codeRecycling = saved })
+}
+
+func TestRecycleDeadLinks(t *testing.T) {
+	withCodeRecycling(t)
+	ctx := context.Background()
+	now := time.Now()
+	long := now.Add(-codeTombstonePeriod - time.Hour)
+	create := func(status string, changedAt time.Time, legalBlocked bool) string {
+		t.Helper()
+		code := "rc-" + newRandomID()[:10]
+		if _, err := testServer.store.Create(ctx, ShortenRequest{LongURL: "https://example.com/" + code}, code); err != nil {
+			t.Fatal(err)
+		}
+		_, err := testServer.db.Exec("UPDATE urls SET status = ?, status_changed_at = ?, legal_blocked = ? WHERE short_code = ?",
+			status, changedAt.UTC().Format(time.DateTime), legalBlocked, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	dead := create(linkStatusDeleted, long, false)
+	recent := create(linkStatusDeleted, now.Add(-time.Hour), false)
+	blocked := create(linkStatusDeleted, long, true)
+	expired := create(linkStatusActive, now, false)
+	if _, err := testServer.db.Exec("UPDATE urls SET expires_at = ? WHERE short_code = ?", long.UTC().Format(time.RFC3339), expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testServer.recycleDeadLinks(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[string]bool{dead: false, recent: true, blocked: true, expired: false} {
+		if ok, _ := testServer.store.Exists(ctx, code); ok != want {
+			t.Errorf("after recycling, link %s exists = %v, want %v", code, ok, want)
+		}
+	}
+	pooled, err := testServer.queryStrings(ctx, "SELECT short_code FROM recycled_codes ORDER BY short_code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pooled) != 2 {
+		t.Fatalf("recycled pool = %v, want %s and %s", pooled, dead, expired)
+	}
+
+	// New links take the pooled codes before random ones.
+	drawn := map[string]bool{}
+	for range 3 {
+		code, err := drawShortCode(ctx, testServer.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drawn[code] = true
+	}
+	if !drawn[dead] || !drawn[expired] || len(drawn) != 3 {
+		t.Errorf("drew %v, want %s, %s and a random code", drawn, dead, expired)
+	}
+}
+
+func TestLegalBlock(t *testing.T) {
+	r := testServer.newRouter()
+	_, ownerKey := newTestAPIKey(t, false)
+	admin := "Authorization: Bearer " + testAdminToken
+	code := "lb-" + newRandomID()[:10]
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/legal-block","custom_alias":"`+code+`"}`, "X-API-Key: "+ownerKey)
+	if w.Code != http.StatusOK {
+		t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+	}
+	path := "/api/urls/" + code
+
+	if w := serveTest(r, http.MethodPatch, path, `{"status":"legal_block"}`, "X-API-Key: "+ownerKey); w.Code != http.StatusForbidden {
+		t.Errorf("owner setting legal_block = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := serveTest(r, http.MethodPatch, path, `{"status":"legal_block"}`, admin); w.Code != http.StatusOK {
+		t.Fatalf("admin setting legal_block = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/"+code, ""); w.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("redirect of a blocked link = %d, want %d", w.Code, http.StatusUnavailableForLegalReasons)
+	}
+	if w := serveTest(r, http.MethodPatch, path, `{"status":"active"}`, "X-API-Key: "+ownerKey); w.Code != http.StatusForbidden {
+		t.Errorf("owner lifting legal_block = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := serveTest(r, http.MethodPatch, path, `{"status":"active"}`, admin); w.Code != http.StatusOK {
+		t.Fatalf("admin lifting legal_block = %d: %s", w.Code, w.Body)
+	}
+
+	var blocked bool
+	if err := testServer.db.QueryRow("SELECT legal_blocked FROM urls WHERE short_code = ?", code).Scan(&blocked); err != nil || !blocked {
+		t.Errorf("legal_blocked after the block was lifted = %v, %v; want it kept", blocked, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+const redactedValue = "REDACTED"
+
+// defaultRedactParams are query parameter names whose values never reach a
+// log line, event payload or debug capture. A trailing "*" matches by
+// prefix and a leading one by suffix, so *_token covers claim_token and
+// any other token field added later. share is a stats share token (see
+// statsshare.go).
+const defaultRedactParams = "token,*_token,key,api_key,apikey,signature,sig,code,password,pw,secret,auth,session,share,X-Amz-*,X-Goog-*"
+
+var (
+	redactParams = parseRedactParams(getEnv("REDACT_QUERY_PARAMS", defaultRedactParams))
+	// redactStrict replaces the whole query string with a hash in logs.
+	redactStrict = getEnvBool("REDACT_STRICT", false)
+)
+
+type redactRule struct {
+	name   string
+	prefix bool
+	suffix bool
+}
+
+func parseRedactParams(list string) []redactRule {
+	var rules []redactRule
+	for _, name := range splitList(list) {
+		name = strings.ToLower(name)
+		if strings.HasSuffix(name, "*") {
+			rules = append(rules, redactRule{name: strings.TrimSuffix(name, "*"), prefix: true})
+		} else if strings.HasPrefix(name, "*") {
+			rules = append(rules, redactRule{name: strings.TrimPrefix(name, "*"), suffix: true})
+		} else {
+			rules = append(rules, redactRule{name: name})
+		}
+	}
+	return rules
+}
+
+func isSensitiveParam(name string) bool {
+	return matchesParamRule(redactParams, name)
+}
+
+// matchesParamRule reports whether any of rules names the query parameter.
+func matchesParamRule(rules []redactRule, name string) bool {
+	name = strings.ToLower(name)
+	for _, rule := range rules {
+		if name == rule.name || (rule.prefix && strings.HasPrefix(name, rule.name)) || (rule.suffix && strings.HasSuffix(name, rule.name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns raw with sensitive query values and any userinfo
+// password masked. It is for logs and events only: the database keeps the
+// full URL so redirects still work.
+func redactURL(raw string) string {
+	base, fragment, hasFragment := strings.Cut(raw, "#")
+	base, query, hasQuery := strings.Cut(base, "?")
+
+	if u, err := url.Parse(base); err == nil && u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), redactedValue)
+			base = u.String()
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(base)
+	if hasQuery {
+		b.WriteByte('?')
+		b.WriteString(redactQuery(query))
+	}
+	if hasFragment {
+		// Fragments regularly carry OAuth tokens (implicit flow).
+		b.WriteByte('#')
+		b.WriteString(redactQuery(fragment))
+	}
+	return b.String()
+}
+
+func redactQuery(query string) string {
+	if query == "" {
+		return query
+	}
+	if redactStrict {
+		sum := sha256.Sum256([]byte(query))
+		return "sha256=" + hex.EncodeToString(sum[:8])
+	}
+
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		k, _, hasValue := strings.Cut(pair, "=")
+		if hasValue && isSensitiveParam(queryKey(k)) {
+			pairs[i] = k + "=" + redactedValue
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redirectEngine serves only redirect, so the benchmarks measure the
+// handler rather than the middleware in front of it.
+func redirectEngine() *gin.Engine {
+	r := gin.New()
+	r.GET("/:code", testServer.redirect)
+	return r
+}
+
+// BenchmarkRedirectCached redirects from the Redis cache with the local
+// cache off.
+func BenchmarkRedirectCached(b *testing.B) {
+	useRedis(b)
+	withLocalCache(b, 0)
+	link := shortenForTest(b, ShortenRequest{LongURL: "https://example.com/cached"}, "")
+	r := redirectEngine()
+	if w := serveTest(r, http.MethodGet, "/"+link.ShortCode, ""); w.Code != defaultRedirectStatus {
+		b.Fatalf("warm-up redirect = %d", w.Code)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		serveTest(r, http.MethodGet, "/"+link.ShortCode, "")
+	}
+}
+
+// BenchmarkRedirectLocalCache redirects from the in-process cache.
+func BenchmarkRedirectLocalCache(b *testing.B) {
+	useRedis(b)
+	withLocalCache(b, 100)
+	link := shortenForTest(b, ShortenRequest{LongURL: "https://example.com/local"}, "")
+	r := redirectEngine()
+	serveTest(r, http.MethodGet, "/"+link.ShortCode, "")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		serveTest(r, http.MethodGet, "/"+link.ShortCode, "")
+	}
+}
+
+// BenchmarkRedirectUncached looks every redirect up in SQLite: there is
+// no Redis and the local cache is off.
+func BenchmarkRedirectUncached(b *testing.B) {
+	withLocalCache(b, 0)
+	link := shortenForTest(b, ShortenRequest{LongURL: "https://example.com/uncached"}, "")
+	r := redirectEngine()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		serveTest(r, http.MethodGet, "/"+link.ShortCode, "")
+	}
+}
+
+// withLocalCache replaces the in-process link cache with an empty one of
+// size for the rest of the test.
+func withLocalCache(tb testing.TB, size int) {
+	saved := localLinks
+	localLinks = newLinkLRU(size, size/10)
+	tb.Cleanup(func() { localLinks = saved })
+}
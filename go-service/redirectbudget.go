@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"time"
+)
+
+// Redirect latency budget: the cache read gets at most
+// REDIRECT_CACHE_BUDGET, the database fallback gets whatever is left of
+// REDIRECT_BUDGET, and optional work is skipped once the budget is spent.
+var (
+	redirectBudget      = getEnvDuration("REDIRECT_BUDGET", 50*time.Millisecond)
+	redirectCacheBudget = getEnvDuration("REDIRECT_CACHE_BUDGET", 10*time.Millisecond)
+)
+
+// redirectBudgetStats counts cache_timeouts, db_timeouts, skipped optional
+// work (skipped_cache_write) and degraded redirects.
+var redirectBudgetStats = expvar.NewMap("redirect_budget")
+
+// latencyBudget tracks the deadline of one redirect.
+type latencyBudget struct {
+	deadline time.Time
+	degraded bool
+}
+
+func newLatencyBudget(start time.Time) *latencyBudget {
+	budget := redirectBudget
+	if budget <= 0 {
+		// Unset or zero disables the budget rather than failing every hit.
+		budget = time.Hour
+	}
+	return &latencyBudget{deadline: start.Add(budget)}
+}
+
+// cacheContext bounds the cache read by the cache budget and the overall
+// deadline.
+func (b *latencyBudget) cacheContext(parent context.Context) (context.Context, context.CancelFunc) {
+	deadline := b.deadline
+	if cacheDeadline := time.Now().Add(redirectCacheBudget); redirectCacheBudget > 0 && cacheDeadline.Before(deadline) {
+		deadline = cacheDeadline
+	}
+	return context.WithDeadline(parent, deadline)
+}
+
+// context bounds a step by what is left of the overall budget.
+func (b *latencyBudget) context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(parent, b.deadline)
+}
+
+func (b *latencyBudget) spent() bool {
+	return !time.Now().Before(b.deadline)
+}
+
+// degrade marks the redirect as degraded for reason.
+func (b *latencyBudget) degrade(reason string) {
+	redirectBudgetStats.Add(reason, 1)
+	if !b.degraded {
+		b.degraded = true
+		redirectBudgetStats.Add("degraded", 1)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// laggyRedisHook delays every command by delay, giving up when the
+// command's context ends, as a struggling Redis behind a client timeout
+// would.
+type laggyRedisHook struct{ delay time.Duration }
+
+func (h laggyRedisHook) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(h.delay):
+		return nil
+	}
+}
+
+func (h laggyRedisHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h laggyRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.wait(ctx); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h laggyRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := h.wait(ctx); err != nil {
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// withRedirectBudget sets the overall and cache budgets for the rest of the
+// test.
+func withRedirectBudget(tb testing.TB, overall, cache time.Duration) {
+	savedOverall, savedCache := redirectBudget, redirectCacheBudget
+	redirectBudget, redirectCacheBudget = overall, cache
+	tb.Cleanup(func() { redirectBudget, redirectCacheBudget = savedOverall, savedCache })
+}
+
+func budgetCount(name string) int64 {
+	if v, ok := redirectBudgetStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRedirectWithinBudgetWhenCacheIsSlow(t *testing.T) {
+	withRedirectBudget(t, 100*time.Millisecond, 20*time.Millisecond)
+	s, store, events := newFakeServer(t)
+	mr := miniredis.RunT(t)
+	s.rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	s.rdb.AddHook(laggyRedisHook{delay: time.Second})
+	t.Cleanup(func() { s.rdb.Close() })
+	store.links["budget"] = storedLink{LongURL: "https://example.com/budget", Status: linkStatusActive}
+	r := s.newRouter()
+	cacheTimeouts, degraded := budgetCount("cache_timeouts"), budgetCount("degraded")
+
+	start := time.Now()
+	w := serveTest(r, http.MethodGet, "/budget", "")
+	elapsed := time.Since(start)
+	if w.Code != defaultRedirectStatus || w.Header().Get("Location") != "https://example.com/budget" {
+		t.Fatalf("redirect with Redis taking a second = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if elapsed > redirectBudget+50*time.Millisecond {
+		t.Errorf("redirect took %s, want it within the %s budget", elapsed, redirectBudget)
+	}
+	if budgetCount("cache_timeouts") != cacheTimeouts+1 || budgetCount("degraded") != degraded+1 {
+		t.Errorf("cache_timeouts went up by %d and degraded by %d, want 1 each",
+			budgetCount("cache_timeouts")-cacheTimeouts, budgetCount("degraded")-degraded)
+	}
+
+	select {
+	case job := <-s.clickQueue:
+		s.publishClickEvent(context.Background(), job, "click-1")
+	default:
+		t.Fatal("the redirect queued no click")
+	}
+	if len(events.clicks) != 1 || !events.clicks[0].Degraded {
+		t.Errorf("click events = %+v, want one marked degraded", events.clicks)
+	}
+}
+
+func TestRedirectFailsFastWhenStoreIsSlow(t *testing.T) {
+	withRedirectBudget(t, 50*time.Millisecond, 10*time.Millisecond)
+	s, store, _ := newFakeServer(t)
+	store.links["slow-db"] = storedLink{LongURL: "https://example.com/slow-db", Status: linkStatusActive}
+	store.lookupDelay = time.Second
+	r := s.newRouter()
+	dbTimeouts := budgetCount("db_timeouts")
+
+	start := time.Now()
+	w := serveTest(r, http.MethodGet, "/slow-db", "")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("redirect with the store taking a second = %d (Retry-After %q)", w.Code, w.Header().Get("Retry-After"))
+	}
+	if elapsed := time.Since(start); elapsed > redirectBudget+50*time.Millisecond {
+		t.Errorf("gave up after %s, want about the %s budget", elapsed, redirectBudget)
+	}
+	if budgetCount("db_timeouts") != dbTimeouts+1 {
+		t.Errorf("db_timeouts went up by %d, want 1", budgetCount("db_timeouts")-dbTimeouts)
+	}
+}
+
+func TestLatencyBudget(t *testing.T) {
+	withRedirectBudget(t, 50*time.Millisecond, 10*time.Millisecond)
+	start := time.Now()
+	b := newLatencyBudget(start)
+	ctx, cancel := b.cacheContext(context.Background())
+	defer cancel()
+	if d, _ := ctx.Deadline(); d.Sub(start) > 20*time.Millisecond {
+		t.Errorf("cache deadline %s after the start, want the cache budget", d.Sub(start))
+	}
+	if b.spent() {
+		t.Error("a new budget is spent")
+	}
+	if !newLatencyBudget(start.Add(-time.Second)).spent() {
+		t.Error("a budget started a second ago is not spent")
+	}
+
+	degraded := budgetCount("degraded")
+	b.degrade("cache_timeouts")
+	b.degrade("skipped_cache_write")
+	if !b.degraded || budgetCount("degraded") != degraded+1 {
+		t.Errorf("degraded %v, counted %d times, want once", b.degraded, budgetCount("degraded")-degraded)
+	}
+
+	withRedirectBudget(t, 0, 0)
+	if newLatencyBudget(start.Add(-time.Minute)).spent() {
+		t.Error("a budget of 0 is spent, want it off")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Redirects are rate limited per client IP (see limitClient): a client may
+// make REDIRECT_LIMIT_PER_MINUTE redirects a minute, REDIRECT_LIMIT_BURST
+// of them at once. A rate of 0 (the default) turns limiting off.
+// Uptime monitors are exempt by address (REDIRECT_LIMIT_ALLOW_CIDRS) or
+// User-Agent regexp (REDIRECT_LIMIT_ALLOW_USER_AGENTS) and counted apart.
+// PUT /admin/redirect-limit replaces the settings without a restart.
+type redirectLimitConfig struct {
+	PerMinute       int      `json:"per_minute"`
+	Burst           int      `json:"burst"`
+	AllowCIDRs      []string `json:"allow_cidrs"`
+	AllowUserAgents []string `json:"allow_user_agents"`
+
+	allowNets cidrSet
+	allowUAs  []*regexp.Regexp
+}
+
+var redirectLimit atomic.Pointer[redirectLimitConfig]
+
+// redirectLimitStats counts allowed, limited and allowlisted redirects.
+var redirectLimitStats = expvar.NewMap("redirect_limiter")
+
+// initRedirectLimit loads the settings from the environment, refusing to
+// start with invalid ones.
+func initRedirectLimit() {
+	cfg := &redirectLimitConfig{
+		PerMinute:       getEnvInt("REDIRECT_LIMIT_PER_MINUTE", 0),
+		Burst:           getEnvInt("REDIRECT_LIMIT_BURST", 20),
+		AllowCIDRs:      splitList(getEnv("REDIRECT_LIMIT_ALLOW_CIDRS", "")),
+		AllowUserAgents: splitList(getEnv("REDIRECT_LIMIT_ALLOW_USER_AGENTS", "")),
+	}
+	if err := cfg.compile(); err != nil {
+		log.Fatalf("Invalid redirect limit settings: %v", err)
+	}
+	redirectLimit.Store(cfg)
+}
+
+// compile checks cfg and parses its allowlists.
+func (cfg *redirectLimitConfig) compile() error {
+	if cfg.PerMinute < 0 {
+		return errors.New("per_minute must not be negative")
+	}
+	if cfg.PerMinute > 0 && cfg.Burst < 1 {
+		return errors.New("burst must be at least 1")
+	}
+	nets, err := parseCIDRSet(strings.Join(cfg.AllowCIDRs, ","))
+	if err != nil {
+		return err
+	}
+	cfg.allowNets = nets
+	cfg.allowUAs = nil
+	for _, pattern := range cfg.AllowUserAgents {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid user agent pattern %q: %w", pattern, err)
+		}
+		cfg.allowUAs = append(cfg.allowUAs, re)
+	}
+	return nil
+}
+
+// allowlisted returns the rule that exempts a client, "" if none does.
+func (cfg *redirectLimitConfig) allowlisted(addr netip.Addr, userAgent string) string {
+	if addr.IsValid() && cfg.allowNets.Contains(addr) {
+		return "cidr"
+	}
+	for _, re := range cfg.allowUAs {
+		if re.MatchString(userAgent) {
+			return "user-agent:" + re.String()
+		}
+	}
+	return ""
+}
+
+// redirectLimiter guards the redirect route. The golden link is exempt. A
+// request with the admin token is never limited or counted; it gets the
+// decision that would have applied in an X-RateLimit-Policy header instead.
+func (s *Server) redirectLimiter(c *gin.Context) {
+	if isProbeCode(c.Param("code")) {
+		c.Next()
+		return
+	}
+	cfg := redirectLimit.Load()
+	debug := hasAdminToken(c)
+	if cfg.PerMinute == 0 {
+		if debug {
+			c.Header("X-RateLimit-Policy", "off")
+		}
+		c.Next()
+		return
+	}
+
+	addr := clientAddr(c)
+	if rule := cfg.allowlisted(addr, c.Request.UserAgent()); rule != "" {
+		if debug {
+			c.Header("X-RateLimit-Policy", "allowlist; rule="+rule)
+		} else {
+			redirectLimitStats.Add("allowlisted", 1)
+		}
+		c.Next()
+		return
+	}
+
+	ok, remaining, wait := s.limitClient(c.Request.Context(), "redirect", addr.String(), cfg.PerMinute, cfg.Burst, !debug)
+	if debug {
+		decision := "allow"
+		if !ok {
+			decision = "limit"
+		}
+		c.Header("X-RateLimit-Policy", fmt.Sprintf("%s; per_minute=%d; burst=%d; remaining=%d; decision=%s",
+			s.rateLimitMode(), cfg.PerMinute, cfg.Burst, remaining, decision))
+		c.Next()
+		return
+	}
+	if !ok {
+		redirectLimitStats.Add("limited", 1)
+		abortRateLimited(c, wait)
+		return
+	}
+	redirectLimitStats.Add("allowed", 1)
+	c.Next()
+}
+
+// registerRateLimitPruner drops local buckets that have refilled, so
+// clients seen once don't stay in memory.
+func registerRateLimitPruner() {
+	app.RegisterBackgroundJob("rate_limit_pruner", time.Minute, func(context.Context) error {
+		cfg := redirectLimit.Load()
+		now := time.Now()
+		setGauge(redirectLimitStats, "clients", int64(bucketsFor("redirect").prune(cfg.PerMinute, cfg.Burst, now)))
+		shortenClients := 0
+		for tier, p := range tierPolicies {
+			shortenClients += bucketsFor(shortenLimitScope(tier)).prune(p.ShortenPerMinute, max(p.ShortenBurst, 1), now)
+		}
+		setGauge(shortenLimitStats, "clients", int64(shortenClients))
+		return nil
+	})
+}
+
+func getRedirectLimit(c *gin.Context) {
+	c.JSON(http.StatusOK, redirectLimit.Load())
+}
+
+// putRedirectLimit replaces the redirect limit settings. Clients keep their
+// buckets, capped at the new burst.
+func putRedirectLimit(c *gin.Context) {
+	var cfg redirectLimitConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := cfg.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	redirectLimit.Store(&cfg)
+	slog.Warn("redirect limit changed", "audit", true, "by", clientIP(c), "per_minute", cfg.PerMinute, "burst", cfg.Burst,
+		"allow_cidrs", len(cfg.AllowCIDRs), "allow_user_agents", len(cfg.AllowUserAgents))
+	c.JSON(http.StatusOK, &cfg)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withRedirectLimit puts cfg in place for the rest of the test.
+func withRedirectLimit(tb testing.TB, cfg redirectLimitConfig) {
+	tb.Helper()
+	if err := cfg.compile(); err != nil {
+		tb.Fatal(err)
+	}
+	saved := redirectLimit.Load()
+	redirectLimit.Store(&cfg)
+	tb.Cleanup(func() { redirectLimit.Store(saved) })
+}
+
+// limitedEngine answers 204 to whatever redirectLimiter lets through from
+// addr.
+func limitedEngine(addr string) http.Handler {
+	r := gin.New()
+	r.GET("/:code", testServer.redirectLimiter, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.RemoteAddr = addr + ":4321"
+		r.ServeHTTP(w, req)
+	})
+}
+
+func redirectLimitCount(name string) int64 {
+	if v, ok := redirectLimitStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRedirectLimitBurstAndRefill(t *testing.T) {
+	// A token every 100ms, three at once.
+	withRedirectLimit(t, redirectLimitConfig{PerMinute: 600, Burst: 3})
+	h := limitedEngine("198.51.100.7")
+	allowed, limited := redirectLimitCount("allowed"), redirectLimitCount("limited")
+
+	for i := range 3 {
+		if w := serveTest(h, http.MethodGet, "/abc", ""); w.Code != http.StatusNoContent {
+			t.Fatalf("redirect %d of the burst = %d", i+1, w.Code)
+		}
+	}
+	w := serveTest(h, http.MethodGet, "/abc", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || !strings.Contains(w.Body.String(), "Too many requests") {
+		t.Errorf("redirect past the burst = %d (Retry-After %q): %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+	if w := serveTest(limitedEngine("198.51.100.8"), http.MethodGet, "/abc", ""); w.Code != http.StatusNoContent {
+		t.Errorf("another client = %d, want its own bucket", w.Code)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if w := serveTest(h, http.MethodGet, "/abc", ""); w.Code != http.StatusNoContent {
+		t.Errorf("redirect after a token refilled = %d", w.Code)
+	}
+	if w := serveTest(h, http.MethodGet, "/abc", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("redirect with the refilled token spent = %d", w.Code)
+	}
+	if got, want := redirectLimitCount("allowed")-allowed, int64(5); got != want {
+		t.Errorf("allowed went up by %d, want %d", got, want)
+	}
+	if got, want := redirectLimitCount("limited")-limited, int64(2); got != want {
+		t.Errorf("limited went up by %d, want %d", got, want)
+	}
+}
+
+func TestRedirectLimitAllowlist(t *testing.T) {
+	withRedirectLimit(t, redirectLimitConfig{
+		PerMinute:       60,
+		Burst:           1,
+		AllowCIDRs:      []string{"203.0.113.0/24"},
+		AllowUserAgents: []string{"^UptimeRobot/"},
+	})
+	allowlisted := redirectLimitCount("allowlisted")
+
+	for _, tt := range []struct {
+		name, addr, userAgent string
+		limited               bool
+	}{
+		{"monitor by address", "203.0.113.9", "curl/8.0", false},
+		{"monitor by user agent", "198.51.100.20", "UptimeRobot/2.0", false},
+		{"user agent not anchored at the start", "198.51.100.21", "Mozilla/5.0 UptimeRobot/2.0", true},
+		{"address outside the range", "203.0.114.9", "curl/8.0", true},
+	} {
+		h := limitedEngine(tt.addr)
+		codes := make([]int, 3)
+		for i := range codes {
+			codes[i] = serveTest(h, http.MethodGet, "/abc", "", "User-Agent: "+tt.userAgent).Code
+		}
+		if got := codes[2] == http.StatusTooManyRequests; got != tt.limited {
+			t.Errorf("%s: statuses %v, want limited past the burst: %v", tt.name, codes, tt.limited)
+		}
+	}
+	if got := redirectLimitCount("allowlisted") - allowlisted; got != 6 {
+		t.Errorf("allowlisted went up by %d, want 6", got)
+	}
+
+	// The admin token gets the decision in a header rather than a 429.
+	h := limitedEngine("203.0.114.9")
+	w := serveTest(h, http.MethodGet, "/abc", "", "Authorization: Bearer "+testAdminToken)
+	if policy := w.Header().Get("X-RateLimit-Policy"); w.Code != http.StatusNoContent || !strings.HasSuffix(policy, "decision=limit") {
+		t.Errorf("admin past the burst = %d with policy %q", w.Code, policy)
+	}
+	w = serveTest(limitedEngine("203.0.113.10"), http.MethodGet, "/abc", "", "Authorization: Bearer "+testAdminToken)
+	if policy := w.Header().Get("X-RateLimit-Policy"); policy != "allowlist; rule=cidr" {
+		t.Errorf("admin from a monitor's address got policy %q", policy)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Redirects answer with REDIRECT_STATUS, 302 by default. Browsers keep a
+// 301 or 308 and stop asking, so edits, deletions and click counts all miss
+// them; permanent redirects therefore carry an explicit Cache-Control with
+// REDIRECT_CACHE_MAX_AGE rather than leaving the lifetime to the browser.
+// A link created with redirect_type overrides the setting.
+var (
+	defaultRedirectStatus = getEnvInt("REDIRECT_STATUS", http.StatusFound)
+	redirectCacheMaxAge   = getEnvDuration("REDIRECT_CACHE_MAX_AGE", time.Hour)
+)
+
+func initRedirectStatus() {
+	if !validRedirectStatus(defaultRedirectStatus) {
+		log.Fatalf("Invalid REDIRECT_STATUS %d: must be 301, 302, 307 or 308", defaultRedirectStatus)
+	}
+	if redirectCacheMaxAge < 0 {
+		log.Fatalf("Invalid REDIRECT_CACHE_MAX_AGE %s: must not be negative", redirectCacheMaxAge)
+	}
+}
+
+func validRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func validateRedirectType(redirectType int) error {
+	if redirectType != 0 && !validRedirectStatus(redirectType) {
+		return errors.New("redirect_type must be 301, 302, 307 or 308")
+	}
+	return nil
+}
+
+// redirectStatus is the status for a link with redirectType, 0 meaning
+// REDIRECT_STATUS. Links that expire never get a permanent one, as browsers
+// would go on redirecting past the expiry; 308 becomes 307 so the method
+// is still kept.
+func redirectStatus(redirectType int, expires bool) int {
+	status := redirectType
+	if status == 0 {
+		status = defaultRedirectStatus
+	}
+	if expires {
+		switch status {
+		case http.StatusMovedPermanently:
+			return http.StatusFound
+		case http.StatusPermanentRedirect:
+			return http.StatusTemporaryRedirect
+		}
+	}
+	return status
+}
+
+// redirectTo redirects to location with status, bounding how long a
+// permanent redirect is cached.
+func redirectTo(c *gin.Context, status int, location string) {
+	redirectCaching(c, status, location, "public")
+}
+
+// redirectPrivately is redirectTo for a visitor who solved a challenge:
+// only their browser may keep the redirect, as a shared cache would hand
+// it to visitors who never solved one.
+func redirectPrivately(c *gin.Context, status int, location string) {
+	redirectCaching(c, status, location, "private")
+}
+
+func redirectCaching(c *gin.Context, status int, location, scope string) {
+	if status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect {
+		c.Header("Cache-Control", scope+", max-age="+strconv.Itoa(int(redirectCacheMaxAge.Seconds())))
+	}
+	c.Redirect(status, location)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withRedirectStatus sets REDIRECT_STATUS and REDIRECT_CACHE_MAX_AGE for the
+// rest of the test.
+func withRedirectStatus(tb testing.TB, status int, maxAge time.Duration) {
+	savedStatus, savedMaxAge := defaultRedirectStatus, redirectCacheMaxAge
+	defaultRedirectStatus, redirectCacheMaxAge = status, maxAge
+	tb.Cleanup(func() { defaultRedirectStatus, redirectCacheMaxAge = savedStatus, savedMaxAge })
+}
+
+// checkRedirect redirects to code from the database, the local cache and
+// Redis in turn, expecting status and cacheControl every time.
+func checkRedirect(t *testing.T, code, location string, status int, cacheControl string) {
+	t.Helper()
+	mr := useRedis(t)
+	withLocalCache(t, 100)
+	mr.Del(urlCacheKey(code))
+	r := redirectEngine()
+	for _, from := range []string{"database", "local cache", "Redis"} {
+		if from == "Redis" {
+			withLocalCache(t, 100)
+		}
+		w := serveTest(r, http.MethodGet, "/"+code, "")
+		if w.Code != status || w.Header().Get("Location") != location || w.Header().Get("Cache-Control") != cacheControl {
+			t.Errorf("from the %s = %d to %q with Cache-Control %q, want %d with %q",
+				from, w.Code, w.Header().Get("Location"), w.Header().Get("Cache-Control"), status, cacheControl)
+		}
+	}
+}
+
+func TestRedirectStatusSetting(t *testing.T) {
+	for _, tt := range []struct {
+		status       int
+		cacheControl string
+	}{
+		{http.StatusMovedPermanently, "public, max-age=600"},
+		{http.StatusFound, ""},
+		{http.StatusTemporaryRedirect, ""},
+		{http.StatusPermanentRedirect, "public, max-age=600"},
+	} {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			withRedirectStatus(t, tt.status, 10*time.Minute)
+			link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/status/" + strconv.Itoa(tt.status)}, "")
+			checkRedirect(t, link.ShortCode, "https://example.com/status/"+strconv.Itoa(tt.status), tt.status, tt.cacheControl)
+		})
+	}
+}
+
+func TestRedirectTypePerLink(t *testing.T) {
+	withRedirectStatus(t, http.StatusFound, time.Hour)
+	expires := &linkTime{Time: time.Now().Add(time.Hour)}
+	for _, tt := range []struct {
+		name         string
+		req          ShortenRequest
+		status       int
+		cacheControl string
+	}{
+		{"permanent", ShortenRequest{RedirectType: http.StatusMovedPermanently}, http.StatusMovedPermanently, "public, max-age=3600"},
+		{"temporary keeping the method", ShortenRequest{RedirectType: http.StatusTemporaryRedirect}, http.StatusTemporaryRedirect, ""},
+		// A browser would keep redirecting past the expiry.
+		{"permanent but expiring", ShortenRequest{RedirectType: http.StatusMovedPermanently, ExpiresAt: expires}, http.StatusFound, ""},
+		{"308 but expiring", ShortenRequest{RedirectType: http.StatusPermanentRedirect, ExpiresAt: expires}, http.StatusTemporaryRedirect, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.LongURL = "https://example.com/per-link/" + strconv.Itoa(tt.req.RedirectType)
+			link := shortenForTest(t, tt.req, "")
+			if link.RedirectType != tt.req.RedirectType {
+				t.Errorf("response redirect_type = %d, want %d", link.RedirectType, tt.req.RedirectType)
+			}
+			checkRedirect(t, link.ShortCode, tt.req.LongURL, tt.status, tt.cacheControl)
+		})
+	}
+
+	if err := validateRedirectType(http.StatusSeeOther); err == nil {
+		t.Error("redirect_type 303 was accepted")
+	}
+	withRedirectStatus(t, http.StatusMovedPermanently, 0)
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/no-cache"}, "")
+	checkRedirect(t, link.ShortCode, "https://example.com/no-cache", http.StatusMovedPermanently, "public, max-age=0")
+}
+
+func TestChallengeRedirectStatus(t *testing.T) {
+	expires := &linkTime{Time: time.Now().Add(time.Hour)}
+	for _, tt := range []struct {
+		name         string
+		mode         int
+		req          ShortenRequest
+		status       int
+		cacheControl string
+	}{
+		{"301 mode", http.StatusMovedPermanently, ShortenRequest{}, http.StatusMovedPermanently, "private, max-age=600"},
+		{"302 mode", http.StatusFound, ShortenRequest{}, http.StatusFound, ""},
+		{"307 mode", http.StatusTemporaryRedirect, ShortenRequest{}, http.StatusTemporaryRedirect, ""},
+		{"308 mode", http.StatusPermanentRedirect, ShortenRequest{}, http.StatusPermanentRedirect, "private, max-age=600"},
+		{"per-link 308", http.StatusFound, ShortenRequest{RedirectType: http.StatusPermanentRedirect}, http.StatusPermanentRedirect, "private, max-age=600"},
+		{"permanent but expiring", http.StatusMovedPermanently, ShortenRequest{ExpiresAt: expires}, http.StatusFound, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			withRedirectStatus(t, tt.mode, 10*time.Minute)
+			withLocalCache(t, 100)
+			tt.req.LongURL = "https://example.com/challenged-status/" + strconv.Itoa(tt.mode) + "/" + strconv.Itoa(tt.req.RedirectType)
+			tt.req.Challenge = true
+			link := shortenForTest(t, tt.req, "")
+			r := redirectEngine()
+			// Challenge links are never cached, so each visit solves one.
+			for range 2 {
+				w := serveTest(r, http.MethodGet, "/"+link.ShortCode, "")
+				m := challengeTokenInPage.FindStringSubmatch(w.Body.String())
+				if w.Code != http.StatusOK || m == nil {
+					t.Fatalf("challenge page = %d without a token: %s", w.Code, w.Body)
+				}
+				w = serveTest(r, http.MethodGet, "/"+link.ShortCode, "", "Cookie: "+challengeCookieName+"="+m[1])
+				if w.Code != tt.status || w.Header().Get("Location") != tt.req.LongURL || w.Header().Get("Cache-Control") != tt.cacheControl {
+					t.Errorf("solved challenge = %d to %q with Cache-Control %q, want %d with %q",
+						w.Code, w.Header().Get("Location"), w.Header().Get("Cache-Control"), tt.status, tt.cacheControl)
+				}
+			}
+		})
+	}
+}
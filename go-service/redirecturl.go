@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// mergeQueryParams adds params to the destination's query string and returns
+// the new URL. The destination is stored exactly as validated and must never
+// be re-encoded on the way out, so only the query component is rewritten:
+// net/url keeps the path and fragment as they were encoded (RawPath and
+// RawFragment), existing query pairs keep their original encoding, and only
+// the added pairs are escaped. When override is false, keys already present
+// on the destination win.
+func mergeQueryParams(dest string, params url.Values, override bool) (string, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", err
+	}
+	if len(params) == 0 {
+		return dest, nil
+	}
+
+	existing := splitRawQuery(u.RawQuery)
+	present := make(map[string]bool, len(existing))
+	for _, pair := range existing {
+		present[queryKey(pair)] = true
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := existing
+	if override {
+		pairs = pairs[:0:0]
+		for _, pair := range existing {
+			if _, replaced := params[queryKey(pair)]; !replaced {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+	for _, k := range keys {
+		if present[k] && !override {
+			continue
+		}
+		for _, v := range params[k] {
+			pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	u.RawQuery = strings.Join(pairs, "&")
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+func splitRawQuery(raw string) []string {
+	var pairs []string
+	for _, pair := range strings.Split(raw, "&") {
+		if pair != "" {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// queryKey returns the decoded key of a raw "k=v" query pair.
+func queryKey(pair string) string {
+	k, _, _ := strings.Cut(pair, "=")
+	if decoded, err := url.QueryUnescape(k); err == nil {
+		return decoded
+	}
+	return k
+}
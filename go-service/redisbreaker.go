@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is optional per request, not per process: the client is kept even
+// when Redis is down, and a circuit breaker in front of it fails commands
+// fast after REDIS_BREAKER_FAILURES consecutive connection failures. While
+// open, one command is let through as a probe once the backoff has passed,
+// starting at a second and doubling up to REDIS_BREAKER_MAX_BACKOFF; a
+// background job probes too, so Redis is picked up again without traffic.
+// Callers treat errRedisUnavailable like any other Redis error and fall
+// back to SQLite, but don't log it, so an outage logs once, not per request.
+var (
+	redisBreakerFailures   = getEnvInt("REDIS_BREAKER_FAILURES", 5)
+	redisBreakerMaxBackoff = getEnvDuration("REDIS_BREAKER_MAX_BACKOFF", 30*time.Second)
+	// redisRequestTimeout bounds Redis reads a handler makes besides the
+	// redirect, which has its own budget, before it answers from SQLite
+	// or local counts instead.
+	redisRequestTimeout = getEnvDuration("REDIS_REQUEST_TIMEOUT", 100*time.Millisecond)
+)
+
+const redisBreakerMinBackoff = time.Second
+
+var errRedisUnavailable = errors.New("redis unavailable")
+
+var redisBreakerStats = expvar.NewMap("redis_breaker")
+
+type redisBreaker struct {
+	mu       sync.Mutex
+	failures int
+	open     bool
+	probing  bool
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+var redisCircuit redisBreaker
+
+// allow reports whether a command may go to Redis now. While the circuit
+// is open, the first command after the backoff is the probe.
+func (b *redisBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || now.Before(b.retryAt) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker with a command's result.
+func (b *redisBreaker) record(err error, now time.Time) {
+	if !isRedisConnectionError(err) {
+		b.mu.Lock()
+		wasOpen := b.open
+		b.failures, b.open, b.probing = 0, false, false
+		b.mu.Unlock()
+		if wasOpen {
+			redisBreakerStats.Add("closed", 1)
+			setGauge(redisBreakerStats, "open", 0)
+			log.Printf("Redis reachable again, resuming cache and event use")
+		}
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	switch {
+	case b.probing:
+		b.probing = false
+		b.backoff = min(b.backoff*2, redisBreakerMaxBackoff)
+	case !b.open && b.failures >= redisBreakerFailures:
+		b.open = true
+		b.backoff = redisBreakerMinBackoff
+		redisBreakerStats.Add("opened", 1)
+		setGauge(redisBreakerStats, "open", 1)
+		log.Printf("Redis unavailable after %d failures, falling back to SQLite: %v", b.failures, err)
+	default:
+		return
+	}
+	b.retryAt = now.Add(b.backoff)
+}
+
+// trip opens the circuit at once, as when Redis is down at startup.
+func (b *redisBreaker) trip(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open, b.probing = true, false
+	b.backoff = redisBreakerMinBackoff
+	b.retryAt = now.Add(b.backoff)
+	setGauge(redisBreakerStats, "open", 1)
+}
+
+// isRedisConnectionError reports whether err means Redis could not be
+// reached in time, as opposed to a miss, an error reply or the caller
+// giving up.
+func isRedisConnectionError(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) || errors.Is(err, context.Canceled) || errors.Is(err, errRedisUnavailable) {
+		return false
+	}
+	var reply redis.Error
+	return !errors.As(err, &reply)
+}
+
+// redisUnavailable reports whether err only says the breaker is open, which
+// callers need not log.
+func redisUnavailable(err error) bool {
+	return errors.Is(err, errRedisUnavailable)
+}
+
+// redisBreakerHook puts redisCircuit in front of every command.
+type redisBreakerHook struct{}
+
+func (redisBreakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisBreakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !redisCircuit.allow(time.Now()) {
+			redisBreakerStats.Add("rejected", 1)
+			return errRedisUnavailable
+		}
+		err := next(ctx, cmd)
+		redisCircuit.record(err, time.Now())
+		return err
+	}
+}
+
+func (redisBreakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !redisCircuit.allow(time.Now()) {
+			redisBreakerStats.Add("rejected", 1)
+			for _, cmd := range cmds {
+				cmd.SetErr(errRedisUnavailable)
+			}
+			return errRedisUnavailable
+		}
+		err := next(ctx, cmds)
+		redisCircuit.record(err, time.Now())
+		return err
+	}
+}
+
+// registerRedisBreakerProbe pings Redis when the open circuit's backoff has
+// passed, so it recovers even with no requests using Redis.
+func (s *Server) registerRedisBreakerProbe() {
+	app.RegisterBackgroundJob("redis_breaker_probe", time.Second, func(ctx context.Context) error {
+		redisCircuit.mu.Lock()
+		due := redisCircuit.open && !redisCircuit.probing && !time.Now().Before(redisCircuit.retryAt)
+		redisCircuit.mu.Unlock()
+		if due {
+			ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+			defer cancel()
+			s.rdb.Ping(ctx)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// replicaCheckInterval is how often each read replica's lag is measured.
+const replicaCheckInterval = 5 * time.Second
+
+var replicaStats = expvar.NewMap("db_replicas")
+
+// replicaLagQuery is how far a Postgres replica's replay is behind, in
+// seconds. A replica that has replayed everything it received is not
+// behind, however long ago the primary last wrote.
+const replicaLagQuery = `SELECT CAST(CASE
+	WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END AS DOUBLE PRECISION)`
+
+// replicaSet splits reads between the primary and read replicas. Reads go
+// round-robin to the replicas that answered the last lag check within
+// maxLag, and to the primary when none did. Without replicas, as on
+// SQLite, everything goes to the primary.
+type replicaSet struct {
+	primary  *sql.DB
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint64
+}
+
+type replica struct {
+	db *sql.DB
+	// name identifies the replica in logs, without its credentials.
+	name    string
+	healthy atomic.Bool
+}
+
+// openReplicas opens a pool on each of urls, which are taken healthy until
+// the first lag check says otherwise.
+func openReplicas(primary *sql.DB, urls []string, maxLag time.Duration) (*replicaSet, error) {
+	rs := &replicaSet{primary: primary, maxLag: maxLag}
+	for i, url := range urls {
+		db, err := sql.Open(timedPostgresDriverName, url)
+		if err != nil {
+			rs.Close()
+			return nil, fmt.Errorf("opening read replica %d: %w", i, err)
+		}
+		configureDBPool(db)
+		r := &replica{db: db, name: fmt.Sprintf("replica-%d", i)}
+		r.healthy.Store(true)
+		rs.replicas = append(rs.replicas, r)
+	}
+	return rs, nil
+}
+
+// Close closes the replicas' pools, not the primary's.
+func (rs *replicaSet) Close() error {
+	var errs []error
+	for _, r := range rs.replicas {
+		errs = append(errs, r.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type primaryContextKey struct{}
+
+// primaryContext marks ctx's reads as ones that must see the caller's own
+// writes, so they go to the primary.
+func primaryContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+// pick returns the next healthy replica, or nil for the primary.
+func (rs *replicaSet) pick(ctx context.Context) *replica {
+	if len(rs.replicas) == 0 || ctx.Value(primaryContextKey{}) != nil {
+		return nil
+	}
+	start := rs.next.Add(1)
+	for i := range uint64(len(rs.replicas)) {
+		if r := rs.replicas[(start+i)%uint64(len(rs.replicas))]; r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// reader is the database for a read that tolerates replica lag.
+func (rs *replicaSet) reader(ctx context.Context) *sql.DB {
+	if r := rs.pick(ctx); r != nil {
+		return r.db
+	}
+	return rs.primary
+}
+
+// read runs fn on a replica, or on the primary when none is usable. A
+// replica that fails is taken out until the next lag check and fn rerun on
+// the primary; so is a read that found nothing, as the row may be one the
+// replica hasn't replayed yet.
+func (rs *replicaSet) read(ctx context.Context, fn func(db *sql.DB) error) error {
+	r := rs.pick(ctx)
+	if r == nil {
+		return fn(rs.primary)
+	}
+	err := fn(r.db)
+	switch {
+	case err == nil || ctx.Err() != nil:
+		return err
+	case errors.Is(err, sql.ErrNoRows):
+		replicaStats.Add("primary_rereads", 1)
+	default:
+		log.Printf("Read replica %s failed, reading from the primary: %v", r.name, err)
+		r.healthy.Store(false)
+		replicaStats.Add("fallbacks", 1)
+	}
+	return fn(rs.primary)
+}
+
+// check measures each replica's lag, taking out the ones that are too far
+// behind or don't answer and putting back the ones that caught up.
+func (rs *replicaSet) check(ctx context.Context) {
+	for _, r := range rs.replicas {
+		var lag float64
+		err := r.db.QueryRowContext(ctx, replicaLagQuery).Scan(&lag)
+		lagging := err == nil && time.Duration(lag*float64(time.Second)) > rs.maxLag
+		healthy := err == nil && !lagging
+		if was := r.healthy.Swap(healthy); was != healthy {
+			switch {
+			case healthy:
+				log.Printf("Read replica %s is back", r.name)
+			case lagging:
+				log.Printf("Read replica %s is %.1fs behind, over %s; reading from the others", r.name, lag, rs.maxLag)
+			default:
+				log.Printf("Read replica %s is down, reading from the others: %v", r.name, err)
+			}
+		}
+	}
+}
+
+func (s *Server) registerReplicaCheck() {
+	if s.replicas == nil {
+		return
+	}
+	app.OnShutdown("read_replicas", 5*time.Second, func(context.Context) error { return s.replicas.Close() })
+	app.RegisterBackgroundJob("replica_lag_check", replicaCheckInterval, func(ctx context.Context) error {
+		s.replicas.check(ctx)
+		return nil
+	})
+}
+
+// reader is the database for reads that may lag s's own writes a little:
+// a read replica when there are any, otherwise the primary.
+func (s *Server) reader(ctx context.Context) *sql.DB {
+	if s.replicas == nil {
+		return s.db
+	}
+	return s.replicas.reader(ctx)
+}
+
+// splitURLs splits a comma-separated list, dropping empty entries.
+func splitURLs(list string) []string {
+	var urls []string
+	for _, url := range strings.Split(list, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
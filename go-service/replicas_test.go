@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// testReplicaSet is a primary and two replicas, SQLite files each holding
+// their name in a one-row table, and the replica-only row "lagging" on the
+// primary alone.
+func testReplicaSet(t *testing.T) *replicaSet {
+	t.Helper()
+	open := func(name string) *sql.DB {
+		db, err := sql.Open(timedSQLiteDriverName, sqliteDSN(filepath.Join(t.TempDir(), name+".db")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if _, err := db.Exec("CREATE TABLE t (k TEXT, v TEXT); INSERT INTO t VALUES ('name', ?)", name); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	rs := &replicaSet{primary: open("primary")}
+	if _, err := rs.primary.Exec("INSERT INTO t VALUES ('lagging', 'primary')"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"replica-0", "replica-1"} {
+		r := &replica{db: open(name), name: name}
+		r.healthy.Store(true)
+		rs.replicas = append(rs.replicas, r)
+	}
+	return rs
+}
+
+func readFrom(ctx context.Context, rs *replicaSet, key string) (string, error) {
+	var v string
+	err := rs.read(ctx, func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, "SELECT v FROM t WHERE k = ?", key).Scan(&v)
+	})
+	return v, err
+}
+
+func TestReplicaSetRoundRobin(t *testing.T) {
+	rs := testReplicaSet(t)
+	ctx := context.Background()
+	seen := map[string]int{}
+	for range 4 {
+		v, err := readFrom(ctx, rs, "name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[v]++
+	}
+	if seen["replica-0"] != 2 || seen["replica-1"] != 2 {
+		t.Errorf("reads went to %v, want two to each replica", seen)
+	}
+	if v, _ := readFrom(primaryContext(ctx), rs, "name"); v != "primary" {
+		t.Errorf("read with primaryContext went to %s", v)
+	}
+}
+
+func TestReplicaSetFallsBackToPrimary(t *testing.T) {
+	rs := testReplicaSet(t)
+	ctx := context.Background()
+
+	// A row the replicas haven't got yet is read from the primary.
+	if v, err := readFrom(ctx, rs, "lagging"); err != nil || v != "primary" {
+		t.Errorf("read of a row only on the primary = %q, %v", v, err)
+	}
+	if !rs.replicas[0].healthy.Load() || !rs.replicas[1].healthy.Load() {
+		t.Error("a replica missing a row was taken out")
+	}
+
+	rs.replicas[0].db.Close()
+	rs.replicas[1].db.Close()
+	for range 2 {
+		if v, err := readFrom(ctx, rs, "name"); err != nil || v != "primary" {
+			t.Errorf("read with the replicas down = %q, %v; want the primary's", v, err)
+		}
+	}
+	if rs.replicas[0].healthy.Load() || rs.replicas[1].healthy.Load() {
+		t.Error("failing replicas are still taken healthy")
+	}
+	if rs.reader(ctx) != rs.primary {
+		t.Error("reader with every replica down isn't the primary")
+	}
+}
+
+func TestReplicaSetCheck(t *testing.T) {
+	rs := testReplicaSet(t)
+	// SQLite has no replay lag to report, so the check fails as it does
+	// for a replica that is down.
+	rs.check(context.Background())
+	for _, r := range rs.replicas {
+		if r.healthy.Load() {
+			t.Errorf("%s is healthy after a failed lag check", r.name)
+		}
+	}
+}
+
+func TestSplitURLs(t *testing.T) {
+	got := splitURLs(" postgres://a/db, ,postgres://b/db,")
+	if len(got) != 2 || got[0] != "postgres://a/db" || got[1] != "postgres://b/db" {
+		t.Errorf("splitURLs = %q", got)
+	}
+	if got := splitURLs(""); got != nil {
+		t.Errorf("splitURLs(\"\") = %q, want none", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route groups that request concurrency is tracked for.
+const (
+	routeGroupRedirect = "redirect"
+	routeGroupAPI      = "api"
+	routeGroupAdmin    = "admin"
+	routeGroupOther    = "other"
+)
+
+// routeGroupGauge counts one group's requests. highWater is the most that
+// were ever in flight at once since start (or the last reset).
+type routeGroupGauge struct {
+	inFlight  atomic.Int64
+	highWater atomic.Int64
+	total     atomic.Int64
+}
+
+var routeGroupGauges = map[string]*routeGroupGauge{
+	routeGroupRedirect: {},
+	routeGroupAPI:      {},
+	routeGroupAdmin:    {},
+	routeGroupOther:    {},
+}
+
+func init() {
+	expvar.Publish("requests", expvar.Func(func() any { return routeGroupSnapshot() }))
+}
+
+// routeGroup maps a matched route pattern to its group. Unmatched requests
+// (404s) have an empty pattern and land in "other".
+func routeGroup(fullPath string) string {
+	switch {
+	case fullPath == "/:code":
+		return routeGroupRedirect
+	case strings.HasPrefix(fullPath, "/api/"):
+		return routeGroupAPI
+	case strings.HasPrefix(fullPath, "/admin/"):
+		return routeGroupAdmin
+	}
+	return routeGroupOther
+}
+
+// requestConcurrencyMiddleware tracks in-flight requests per route group.
+// It runs before the maintenance guard, so refused requests count too.
+func requestConcurrencyMiddleware(c *gin.Context) {
+	g := routeGroupGauges[routeGroup(c.FullPath())]
+	g.total.Add(1)
+	n := g.inFlight.Add(1)
+	defer g.inFlight.Add(-1)
+	for {
+		hw := g.highWater.Load()
+		if n <= hw || g.highWater.CompareAndSwap(hw, n) {
+			break
+		}
+	}
+	c.Next()
+}
+
+func routeGroupSnapshot() map[string]gin.H {
+	out := make(map[string]gin.H, len(routeGroupGauges))
+	for name, g := range routeGroupGauges {
+		out[name] = gin.H{
+			"in_flight":     g.inFlight.Load(),
+			"in_flight_max": g.highWater.Load(),
+			"total":         g.total.Load(),
+		}
+	}
+	return out
+}
+
+// getAdminStats serves GET /admin/stats.
+func getAdminStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"route_groups": routeGroupSnapshot()})
+}
+
+// deleteAdminStatsHighWater serves DELETE /admin/stats/high-water. Each
+// mark restarts from the number currently in flight.
+func deleteAdminStatsHighWater(c *gin.Context) {
+	for _, g := range routeGroupGauges {
+		g.highWater.Store(g.inFlight.Load())
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resolver-only mode: a read-only edge that serves GET /:code from a local
+// SQLite copy of an upstream instance's links. The copy is kept current
+// from the upstream's /api/export/diff feed, clicks are forwarded to the
+// upstream's /api/events/batch, and every mutating route is left out.
+var (
+	resolverOnly         = getEnvBool("RESOLVER_ONLY", false)
+	resolverUpstreamURL  = strings.TrimRight(getEnv("UPSTREAM_URL", ""), "/")
+	resolverUpstreamAuth = getEnv("UPSTREAM_ADMIN_TOKEN", "")
+	resolverSyncInterval = getEnvDuration("RESOLVER_SYNC_INTERVAL", 30*time.Second)
+	resolverProxyMisses  = getEnvBool("RESOLVER_PROXY_MISSES", false)
+)
+
+var resolverStats = expvar.NewMap("resolver")
+
+// resolverClient talks to the upstream. It never follows redirects, so a
+// proxied lookup sees the upstream's 301/302 itself.
+var resolverClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: newOutboundTransport(),
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// errCursorGone means the upstream compacted its change feed past our
+// cursor, so the diff can no longer bring the local copy up to date.
+var errCursorGone = errors.New("sync cursor is older than the upstream's retained changes")
+
+// initResolver validates the configuration and brings the local copy up to
+// date before the server starts. It exits when the upstream can't be
+// reached and there is no earlier copy to serve from.
+func (s *Server) initResolver() {
+	if resolverUpstreamURL == "" {
+		log.Fatal("RESOLVER_ONLY requires UPSTREAM_URL")
+	}
+	if _, err := url.ParseRequestURI(resolverUpstreamURL); err != nil {
+		log.Fatalf("Invalid UPSTREAM_URL: %v", err)
+	}
+
+	// Clicks go upstream over the batch path; the local Redis channel
+	// has no consumer on an edge.
+	s.cfg.PythonServiceURL = resolverUpstreamURL
+	if eventBatchSize <= 1 {
+		eventBatchSize = 100
+	}
+
+	ctx := context.Background()
+	if err := s.syncFromUpstream(ctx); err != nil {
+		var syncedAt string
+		if s.db.QueryRowContext(ctx, "SELECT synced_at FROM resolver_sync_state WHERE id = 1 AND upstream = ?", resolverUpstreamURL).Scan(&syncedAt) != nil {
+			log.Fatalf("Resolver: initial sync from %s failed and there is no local copy: %v", resolverUpstreamURL, err)
+		}
+		log.Printf("Resolver: initial sync from %s failed, serving the copy synced at %s: %v", resolverUpstreamURL, syncedAt, err)
+	}
+}
+
+func (s *Server) registerResolverSync() {
+	app.RegisterBackgroundJob("resolver_sync", resolverSyncInterval, func(ctx context.Context) error {
+		if err := s.syncFromUpstream(ctx); err != nil {
+			return fmt.Errorf("sync from %s: %w", resolverUpstreamURL, err)
+		}
+		return nil
+	})
+}
+
+// syncFromUpstream pulls the diff since the stored cursor and applies it in
+// one transaction, together with the new cursor. A diff whose checksum or
+// summary doesn't check out is discarded whole.
+func (s *Server) syncFromUpstream(ctx context.Context) error {
+	cursor := "0"
+	var upstream string
+	err := s.db.QueryRowContext(ctx, "SELECT upstream, cursor FROM resolver_sync_state WHERE id = 1").Scan(&upstream, &cursor)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && upstream != resolverUpstreamURL {
+		return fmt.Errorf("local copy was synced from %s; remove go.db to switch upstreams", upstream)
+	}
+
+	records, next, err := fetchExportDiff(ctx, cursor)
+	if errors.Is(err, errCursorGone) {
+		resolverStats.Add("cursor_gone", 1)
+	}
+	if err != nil {
+		resolverStats.Add("sync_errors", 1)
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, rec := range records {
+		switch rec.Op {
+		case "upsert":
+			// activated is set locally so the edge never runs the
+			// activation bookkeeping; the upstream does that.
+			status := rec.Status
+			if status == "" {
+				status = linkStatusActive
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO urls (short_code, long_url, active_from, expires_at, challenge, hot, redirect_type, password_hash, utm, status, activated)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+				ON CONFLICT(short_code) DO UPDATE SET long_url = excluded.long_url, active_from = excluded.active_from,
+					expires_at = excluded.expires_at, challenge = excluded.challenge, hot = excluded.hot, redirect_type = excluded.redirect_type,
+					password_hash = excluded.password_hash, utm = excluded.utm, status = excluded.status`,
+				rec.ShortCode, rec.LongURL, rec.ActiveFrom, rec.ExpiresAt, rec.Challenge, rec.Hot, nullIfZero(rec.RedirectType), nullIfEmpty(rec.PasswordHash), nullIfEmpty(rec.UTM), status)
+		case "delete":
+			_, err = tx.ExecContext(ctx, "DELETE FROM urls WHERE short_code = ?", rec.ShortCode)
+		default:
+			err = fmt.Errorf("unknown op %q for %s", rec.Op, rec.ShortCode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO resolver_sync_state (id, upstream, cursor, synced_at) VALUES (1, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET cursor = excluded.cursor, synced_at = excluded.synced_at`,
+		resolverUpstreamURL, next, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Cached entries for changed codes would outlive the change. Every
+	// edge applies the same changes, so local entries are only evicted here.
+	if len(records) > 0 {
+		codes := make([]string, len(records))
+		keys := make([]string, len(records))
+		for i, rec := range records {
+			codes[i], keys[i] = rec.ShortCode, urlCacheKey(rec.ShortCode)
+		}
+		if s.rdb != nil {
+			s.rdb.Del(ctx, keys...)
+		}
+		localLinks.evict(codes...)
+	}
+
+	resolverStats.Add("syncs", 1)
+	resolverStats.Add("records_applied", int64(len(records)))
+	if len(records) > 0 {
+		log.Printf("Resolver: applied %d changes from %s (cursor %s)", len(records), resolverUpstreamURL, next)
+	}
+	return nil
+}
+
+// fetchExportDiff reads one diff export and returns its records and the
+// next cursor. It only succeeds when the summary line arrived and matches.
+func fetchExportDiff(ctx context.Context, cursor string) ([]exportDiffRecord, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resolverUpstreamURL+"/api/export/diff?since="+url.QueryEscape(cursor), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if resolverUpstreamAuth != "" {
+		req.Header.Set("X-Admin-Token", resolverUpstreamAuth)
+	}
+	resp, err := resolverClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return nil, "", errCursorGone
+	default:
+		io.Copy(io.Discard, resp.Body)
+		return nil, "", fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+
+	hash := sha256.New()
+	var records []exportDiffRecord
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bytes.Contains(line, []byte(`"summary":true`)) {
+			var summary exportDiffSummary
+			if err := json.Unmarshal(line, &summary); err != nil {
+				return nil, "", fmt.Errorf("invalid summary line: %w", err)
+			}
+			if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != summary.Checksum {
+				return nil, "", fmt.Errorf("checksum mismatch: got %s, summary says %s", got, summary.Checksum)
+			}
+			if summary.Count != len(records) {
+				return nil, "", fmt.Errorf("got %d records, summary says %d", len(records), summary.Count)
+			}
+			return records, summary.NextCursor, nil
+		}
+
+		hash.Write(line)
+		hash.Write([]byte{'\n'})
+		var rec exportDiffRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, "", fmt.Errorf("invalid diff line: %w", err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	return nil, "", errors.New("diff export ended without a summary line")
+}
+
+// proxyUpstreamLookup answers a local miss from the upstream, for links
+// created since the last sync. It reports whether it wrote a response; the
+// click is counted upstream, so nothing is enqueued here.
+func proxyUpstreamLookup(c *gin.Context, shortCode string) bool {
+	target := resolverUpstreamURL + "/" + url.PathEscape(shortCode)
+	// The upstream merges the link's UTM defaults with these.
+	overrides := url.Values{}
+	for _, key := range utmParams {
+		if v := c.Query(key); v != "" {
+			overrides.Set(key, v)
+		}
+	}
+	if len(overrides) > 0 {
+		target += "?" + overrides.Encode()
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, target, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", c.Request.UserAgent())
+	resp, err := resolverClient.Do(req)
+	if err != nil {
+		log.Printf("Resolver: upstream lookup for %s failed: %v", shortCode, err)
+		resolverStats.Add("proxy_errors", 1)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	location := resp.Header.Get("Location")
+	if !validRedirectStatus(resp.StatusCode) || location == "" {
+		resolverStats.Add("proxy_misses", 1)
+		return false
+	}
+	// 302 rather than a permanent status from the upstream: browsers would
+	// otherwise keep the answer for a link this edge hasn't synced yet.
+	resolverStats.Add("proxy_hits", 1)
+	c.Redirect(http.StatusFound, location)
+	return true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRouter builds the HTTP handler for s:
+// every route, or only redirects and the admin API on a resolver-only edge.
+// It starts nothing, so requests can be served through it with httptest.
+func (s *Server) newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(accessLogMiddleware, gin.Recovery(), requestConcurrencyMiddleware, debugCaptureMiddleware, requestTimeoutMiddleware, maintenanceGuard)
+	// Keep gin's ClientIP (used in access logs) consistent with clientAddr.
+	if err := r.SetTrustedProxies(trustedProxies.Strings()); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	// CORS middleware
+	r.Use(func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Idempotency-Key")
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(http.StatusOK)
+			return
+		}
+
+		c.Next()
+	})
+
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", s.readyz)
+	r.GET(metricsPath, metricsHandler)
+
+	// A resolver-only edge serves redirects and nothing that writes.
+	if resolverOnly {
+		r.GET("/:code", redirectMetrics, s.redirectLimiter, s.redirect)
+		r.POST("/:code/unlock", s.redirectLimiter, s.unlockLink)
+		s.registerAdminRoutes(r)
+		return r
+	}
+
+	// Routes
+	r.GET("/", homepage)
+	r.POST("/", s.shortenLimiter, s.homepageShorten)
+	r.POST("/api/shorten", shortenMetrics, s.requireOAuth, s.shortenLimiter, s.idempotency, s.createShortURL)
+	r.POST("/api/shorten/batch", shortenMetrics, s.requireOAuth, s.shortenLimiter, s.idempotency, s.createShortURLBatch)
+	r.GET("/api/settings/timezone", s.requireOAuth, s.getOwnerTimezone)
+	r.PUT("/api/settings/timezone", s.requireOAuth, s.putOwnerTimezone)
+	r.GET("/api/settings/canonical", s.requireOAuth, s.getCanonicalProfile)
+	r.PUT("/api/settings/canonical", s.requireOAuth, s.putCanonicalProfile)
+	r.DELETE("/api/settings/canonical", s.requireOAuth, s.deleteCanonicalProfile)
+	r.GET("/api/profiles", s.requireOAuth, s.listSettingsProfiles)
+	r.POST("/api/profiles", s.requireOAuth, s.createSettingsProfile)
+	r.GET("/api/profiles/:name", s.requireOAuth, s.getSettingsProfile)
+	r.PUT("/api/profiles/:name", s.requireOAuth, s.putSettingsProfile)
+	r.DELETE("/api/profiles/:name", s.requireOAuth, s.deleteSettingsProfile)
+	r.POST("/api/domains/verify", s.requireOAuth, s.requestDomainVerification)
+	r.GET("/api/domains", s.requireOAuth, s.listDomains)
+	r.GET("/:code", redirectMetrics, s.redirectLimiter, s.redirect)
+	r.POST("/:code/unlock", s.redirectLimiter, s.unlockLink)
+	// Events and scan results are signed by the calling service, and the
+	// pixel is fetched by browsers, so none of them take an API key.
+	r.POST("/api/events", s.ingestEvent)
+	r.POST("/api/events/batch", s.ingestEventBatch)
+	r.GET("/api/events/schema", s.requireOAuth, getEventSchemas)
+	r.POST("/api/scan-results", s.postScanResults)
+	r.GET("/api/pixel/:file", s.conversionPixel)
+	r.GET("/api/urls", s.requireOwnerOrAdmin, s.listURLs)
+	r.GET("/api/urls/:code", s.requireOAuth, s.getURL)
+	r.GET("/api/qr/:code", s.requireOAuth, s.getQRCode)
+	r.PATCH("/api/urls/:code", s.requireOAuth, s.patchURL)
+	r.DELETE("/api/urls/:code", s.requireOwnerOrAdmin, s.deleteURL)
+	r.POST("/api/urls/:code/claim", s.requireOAuth, s.claimURL)
+	r.POST("/api/urls/:code/transfer", s.requireOwnerOrAdmin, s.transferURL)
+	r.POST("/api/urls/:code/renew", s.requireOAuth, s.renewURL)
+	r.DELETE("/api/urls/:code/aliases/:alias", s.requireOAuth, s.releaseAlias)
+	r.POST("/api/keys/:id/transfer-all", s.requireAdmin, s.transferAllURLs)
+	r.GET("/api/keys/self/usage", s.requireOAuth, s.getOwnUsage)
+	r.GET("/api/stats/realtime", s.requireOAuth, s.getRealtimeStats)
+	r.GET("/api/stats/:code", s.requireStatsAuth, s.getStats)
+	r.GET("/api/stats/:code/timeseries", s.requireStatsAuth, s.getStatsTimeseries)
+	r.GET("/api/urls/:code/stats/countries", s.requireStatsAuth, s.getStatsCountries)
+	r.POST("/api/urls/:code/stats/share", s.requireOAuth, s.createStatsShare)
+	r.DELETE("/api/urls/:code/stats/share/:jti", s.requireOAuth, s.revokeStatsShare)
+	r.POST("/api/import", s.requireAdmin, s.importLinks)
+	r.GET("/api/import/:id/report", s.requireAdmin, s.importReport)
+	r.GET("/api/changes", s.requireAdmin, s.getChanges)
+	r.GET("/api/export", s.requireAdmin, s.exportLinks)
+	r.GET("/api/export/diff", s.requireAdmin, s.exportDiff)
+	r.GET("/api/webhooks", s.requireAdmin, listWebhooks)
+	r.POST("/api/webhooks", s.requireAdmin, s.createWebhook)
+	r.DELETE("/api/webhooks/:id", s.requireAdmin, s.deleteWebhook)
+	r.GET("/api/webhooks/:id/deliveries", s.requireAdmin, s.listWebhookDeliveries)
+	r.POST("/api/webhooks/:id/deliveries/:delivery_id/replay", s.requireAdmin, s.replayWebhookDelivery)
+	r.POST("/api/webhooks/:id/test", s.requireAdmin, s.testWebhook)
+	s.registerAdminRoutes(r)
+	app.registerRoutes(r)
+	return r
+}
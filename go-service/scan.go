@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With SCAN_QUARANTINE on, new links start as pending_scan and are not
+// served until the URL scanner, which follows the change feed, posts a
+// clean verdict to /api/scan-results. A link with no verdict after
+// SCAN_TIMEOUT gets SCAN_TIMEOUT_VERDICT: "active" serves it unscanned,
+// "rejected" keeps it blocked. A late verdict still applies.
+var (
+	scanQuarantine     = getEnvBool("SCAN_QUARANTINE", false)
+	scanTimeout        = getEnvDuration("SCAN_TIMEOUT", 10*time.Minute)
+	scanTimeoutVerdict = getEnv("SCAN_TIMEOUT_VERDICT", "active")
+)
+
+// Values of urls.scan_status; NULL for links created without quarantine.
+const (
+	scanPending         = "pending"
+	scanClean           = "clean"
+	scanMalicious       = "malicious"
+	scanTimeoutActive   = "timeout_active"
+	scanTimeoutRejected = "timeout_rejected"
+)
+
+// scanBlockedCondition matches links that must not be served.
+const scanBlockedCondition = "scan_status IN ('pending', 'malicious', 'timeout_rejected')"
+
+// initScanQuarantine rejects an unknown SCAN_TIMEOUT_VERDICT at startup.
+func initScanQuarantine() {
+	if scanTimeoutVerdict != "active" && scanTimeoutVerdict != "rejected" {
+		log.Fatalf("Invalid SCAN_TIMEOUT_VERDICT %q: must be active or rejected", scanTimeoutVerdict)
+	}
+}
+
+// initialScanStatus is the scan_status a new link is stored with.
+func initialScanStatus(isTest bool) any {
+	if !scanQuarantine || isTest {
+		return nil
+	}
+	return scanPending
+}
+
+func scanBlocked(status sql.NullString) bool {
+	switch status.String {
+	case scanPending, scanMalicious, scanTimeoutRejected:
+		return true
+	}
+	return false
+}
+
+// writeScanBlocked answers for a link scanBlocked holds back: 423 while the
+// scan is pending, 403 once it has been rejected.
+func writeScanBlocked(c *gin.Context, status sql.NullString) {
+	if status.String == scanPending {
+		c.Header("Retry-After", "30")
+		c.JSON(http.StatusLocked, gin.H{"error": "Short URL is waiting for a safety scan", "code": "pending_scan"})
+		return
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Short URL was blocked by a safety scan", "code": "scan_rejected"})
+}
+
+// postScanResults serves POST /api/scan-results, where the scanner delivers
+// {"short_code": "...", "verdict": "clean" | "malicious"} signed with the
+// service HMAC. A clean link is cached straight away; a malicious one is
+// purged from the cache.
+func (s *Server) postScanResults(c *gin.Context) {
+	body, status, err := readEventBody(c)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	var result struct {
+		ShortCode string `json:"short_code"`
+		Verdict   string `json:"verdict"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if result.Verdict != scanClean && result.Verdict != scanMalicious {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "verdict must be clean or malicious"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	res, err := s.execWithRetry(ctx, `UPDATE urls SET scan_status = ?
+		WHERE short_code = ? AND scan_status IN ('pending', 'timeout_active', 'timeout_rejected')`, result.Verdict, result.ShortCode)
+	if errors.Is(err, errDBBusy) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No link waiting for a scan verdict with that code"})
+		return
+	}
+
+	log.Printf("Scan verdict for %s: %s", result.ShortCode, result.Verdict)
+	if result.Verdict == scanClean {
+		s.cacheScannedLink(ctx, result.ShortCode)
+	} else {
+		if s.rdb != nil {
+			if err := s.rdb.Del(ctx, urlCacheKey(result.ShortCode)).Err(); err != nil && !redisUnavailable(err) {
+				log.Printf("Error purging cache for rejected %s: %v", result.ShortCode, err)
+			}
+		}
+		s.invalidateLocalLinks(ctx, result.ShortCode)
+	}
+	c.JSON(http.StatusOK, gin.H{"short_code": result.ShortCode, "scan_status": result.Verdict})
+}
+
+// cacheScannedLink writes the cache entry redirect would, for a link a
+// clean verdict just released. Links redirect never caches are skipped.
+func (s *Server) cacheScannedLink(ctx context.Context, shortCode string) {
+	if s.rdb == nil {
+		return
+	}
+	var longURL string
+	var challenge, hot bool
+	var activeFrom, expiresAt, utm sql.NullString
+	var redirectType sql.NullInt64
+	err := s.db.QueryRowContext(ctx, "SELECT long_url, challenge, hot, redirect_type, active_from, expires_at, utm FROM urls WHERE short_code = ? AND is_test = 0 AND password_hash IS NULL AND "+linkStatusCondition, shortCode).
+		Scan(&longURL, &challenge, &hot, &redirectType, &activeFrom, &expiresAt, &utm)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if challenge || !linkActive(activeFrom, now) || linkExpired(expiresAt, now) {
+		return
+	}
+	if err := s.rdb.Set(ctx, urlCacheKey(shortCode), encodeCachedLink(longURL, hot, int(redirectType.Int64), expiresAt, utm.String), linkCacheTTL(expiresAt, now)).Err(); err != nil && !redisUnavailable(err) {
+		log.Printf("Error caching scanned %s: %v", shortCode, err)
+	}
+}
+
+// registerScanTimeouts applies SCAN_TIMEOUT_VERDICT to links the scanner
+// has not answered for in time. A resolver-only edge has no quarantine of
+// its own; blocked links reach it as deletes.
+func (s *Server) registerScanTimeouts() {
+	if resolverOnly {
+		return
+	}
+	app.RegisterBackgroundJob("scan_timeouts", time.Minute, func(ctx context.Context) error {
+		if inMaintenance() {
+			return nil
+		}
+		verdict := scanTimeoutActive
+		if scanTimeoutVerdict == "rejected" {
+			verdict = scanTimeoutRejected
+		}
+		cutoff := time.Now().UTC().Add(-scanTimeout).Format("2006-01-02 15:04:05")
+		res, err := s.execWithRetry(ctx, "UPDATE urls SET scan_status = ? WHERE scan_status = 'pending' AND datetime(created_at) <= ?", verdict, cutoff)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Scan timed out for %d links, now %s", n, verdict)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migrations are applied in order on top of the base urls table. Never edit
+// or reorder an entry once released; append a new one instead.
+var migrations = []string{
+	// 1: locally ingested click events
+	`CREATE TABLE IF NOT EXISTS clicks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		click_id TEXT UNIQUE,
+		short_code TEXT NOT NULL,
+		clicked_at DATETIME NOT NULL,
+		received_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_clicks_short_code ON clicks(short_code, clicked_at);`,
+
+	// 2: links imported from other shorteners
+	`ALTER TABLE urls ADD COLUMN imported_clicks INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS import_mappings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		import_id TEXT NOT NULL,
+		old_url TEXT NOT NULL DEFAULT '',
+		long_url TEXT NOT NULL DEFAULT '',
+		short_code TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_import_mappings_import_id ON import_mappings(import_id);`,
+
+	// 3: per-link OpenGraph overrides for the crawler preview page
+	`ALTER TABLE urls ADD COLUMN og_title TEXT;
+	ALTER TABLE urls ADD COLUMN og_description TEXT;
+	ALTER TABLE urls ADD COLUMN og_image TEXT;`,
+
+	// 4: conversion pixel hits, one per visitor, code and day
+	`CREATE TABLE IF NOT EXISTS conversions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		short_code TEXT NOT NULL,
+		visitor_hash TEXT NOT NULL,
+		conversion_day TEXT NOT NULL,
+		converted_at DATETIME NOT NULL,
+		UNIQUE (short_code, visitor_hash, conversion_day)
+	);`,
+
+	// 5: click-fraud challenge mode and its counter of unsolved hits
+	`ALTER TABLE urls ADD COLUMN challenge INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE urls ADD COLUMN challenged INTEGER NOT NULL DEFAULT 0;`,
+
+	// 6: scheduled activation; activated guards the one-off url_activated event
+	`ALTER TABLE urls ADD COLUMN active_from TEXT;
+	ALTER TABLE urls ADD COLUMN activated INTEGER NOT NULL DEFAULT 0;`,
+
+	// 7: temporary links created by the self-test, excluded from stats
+	`ALTER TABLE urls ADD COLUMN is_test INTEGER NOT NULL DEFAULT 0;`,
+
+	// 8: link owners and the domains they have proven control of
+	`ALTER TABLE urls ADD COLUMN owner TEXT;
+	CREATE TABLE IF NOT EXISTS domain_verifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		token TEXT NOT NULL,
+		method TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		verified_at DATETIME,
+		checked_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (owner, domain)
+	);`,
+
+	// 9: links flagged for 103 Early Hints
+	`ALTER TABLE urls ADD COLUMN hot INTEGER NOT NULL DEFAULT 0;`,
+
+	// 10: append-only change feed of urls, written by triggers so every
+	// mutation lands in the same transaction. Counters and self-test links
+	// are left out.
+	`CREATE TABLE IF NOT EXISTS url_changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		op TEXT NOT NULL,
+		short_code TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+	);
+	CREATE INDEX IF NOT EXISTS idx_url_changes_created_at ON url_changes(created_at);
+	CREATE TRIGGER IF NOT EXISTS url_changes_insert AFTER INSERT ON urls WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('insert', NEW.short_code, json_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner));
+	END;
+	CREATE TRIGGER IF NOT EXISTS url_changes_update
+	AFTER UPDATE OF short_code, long_url, og_title, og_description, og_image, challenge, active_from, activated, hot, owner ON urls
+	WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('update', NEW.short_code, json_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner));
+	END;
+	CREATE TRIGGER IF NOT EXISTS url_changes_delete AFTER DELETE ON urls WHEN OLD.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('delete', OLD.short_code, json_object('short_code', OLD.short_code));
+	END;`,
+
+	// 11: diff-sync cursor of a resolver-only instance (a single row)
+	`CREATE TABLE IF NOT EXISTS resolver_sync_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		upstream TEXT NOT NULL,
+		cursor TEXT NOT NULL,
+		synced_at DATETIME NOT NULL
+	);`,
+
+	// 12: revoked stats share links, kept until they would have expired
+	`CREATE TABLE IF NOT EXISTS stats_share_revocations (
+		jti TEXT PRIMARY KEY,
+		short_code TEXT NOT NULL,
+		revoked_at DATETIME NOT NULL
+	);`,
+
+	// 13: click export pages through clicks by normalized time
+	`CREATE INDEX IF NOT EXISTS idx_clicks_clicked_at ON clicks(datetime(clicked_at));`,
+
+	// 14: shorten looks up an owner's existing link to the same long_url
+	`CREATE INDEX IF NOT EXISTS idx_urls_long_url ON urls(long_url, owner);`,
+
+	// 15: link expiry; the change feed triggers are recreated to carry it
+	`ALTER TABLE urls ADD COLUMN expires_at TEXT;
+	CREATE INDEX IF NOT EXISTS idx_urls_expires_at ON urls(expires_at) WHERE expires_at IS NOT NULL;
+	DROP TRIGGER IF EXISTS url_changes_insert;
+	DROP TRIGGER IF EXISTS url_changes_update;
+	CREATE TRIGGER url_changes_insert AFTER INSERT ON urls WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('insert', NEW.short_code, json_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner, 'expires_at', NEW.expires_at));
+	END;
+	CREATE TRIGGER url_changes_update
+	AFTER UPDATE OF short_code, long_url, og_title, og_description, og_image, challenge, active_from, activated, hot, owner, expires_at ON urls
+	WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('update', NEW.short_code, json_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner, 'expires_at', NEW.expires_at));
+	END;`,
+
+	// 16: the click a conversion is attributed to, NULL when unattributed
+	`ALTER TABLE conversions ADD COLUMN click_id TEXT;
+	ALTER TABLE conversions ADD COLUMN click_latency_ms INTEGER;`,
+
+	// 17: authoritative click counters, flushed in batches from Redis
+	`CREATE TABLE IF NOT EXISTS click_counters (
+		short_code TEXT PRIMARY KEY,
+		clicks INTEGER NOT NULL DEFAULT 0,
+		last_clicked_at TEXT
+	);`,
+
+	// 18: the timezone a link's schedule and expiry were given in, and
+	// owners' default timezones
+	`ALTER TABLE urls ADD COLUMN timezone TEXT;
+	CREATE TABLE IF NOT EXISTS owner_timezones (
+		owner TEXT PRIMARY KEY,
+		timezone TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`,
+
+	// 19: free-text notes and key-value metadata teams attach to links.
+	// Neither is in the change feed, which drives redirects.
+	`ALTER TABLE urls ADD COLUMN notes TEXT;
+	CREATE TABLE IF NOT EXISTS link_metadata (
+		short_code TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (short_code, key)
+	);
+	CREATE INDEX IF NOT EXISTS idx_link_metadata_key ON link_metadata(key, value);`,
+
+	// 20: malware scan quarantine; the change feed triggers are recreated
+	// so verdicts reach resolver edges
+	`ALTER TABLE urls ADD COLUMN scan_status TEXT;
+	CREATE INDEX IF NOT EXISTS idx_urls_scan_pending ON urls(scan_status) WHERE scan_status = 'pending';
+	DROP TRIGGER IF EXISTS url_changes_insert;
+	DROP TRIGGER IF EXISTS url_changes_update;
+	CREATE TRIGGER url_changes_insert AFTER INSERT ON urls WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('insert', NEW.short_code, json_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner, 'expires_at', NEW.expires_at, 'scan_status', NEW.scan_status));
+	END;
+	CREATE TRIGGER url_changes_update
+	AFTER UPDATE OF short_code, long_url, og_title, og_description, og_image, challenge, active_from, activated, hot, owner, expires_at, scan_status ON urls
+	WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('update', NEW.short_code, json_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner, 'expires_at', NEW.expires_at, 'scan_status', NEW.scan_status));
+	END;`,
+
+	// 21: reuse matches links by canonical hash instead of long_url. Links
+	// stored earlier have none until -backfill-canonical runs.
+	`ALTER TABLE urls ADD COLUMN canonical_hash TEXT;
+	DROP INDEX IF EXISTS idx_urls_long_url;
+	CREATE INDEX IF NOT EXISTS idx_urls_canonical_hash ON urls(canonical_hash, owner);
+	CREATE TABLE IF NOT EXISTS owner_canonical_profiles (
+		owner TEXT PRIMARY KEY,
+		profile TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`,
+
+	// 22: claim tokens for links created without an owner
+	`CREATE TABLE IF NOT EXISTS link_claims (
+		short_code TEXT PRIMARY KEY,
+		token_hash TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		claimed_at TEXT,
+		claimed_by TEXT
+	);`,
+
+	// 23: click events that couldn't reach the Redis stream
+	`CREATE TABLE IF NOT EXISTS pending_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		payload TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`,
+
+	// 24: per-link redirect status, NULL for REDIRECT_STATUS
+	`ALTER TABLE urls ADD COLUMN redirect_type INTEGER;`,
+
+	// 25: pregenerated codes held for links to be attached later; the
+	// trigger keeps every other insert off them
+	`CREATE TABLE IF NOT EXISTS code_reservations (
+		short_code TEXT PRIMARY KEY,
+		batch_id TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_code_reservations_expires_at ON code_reservations(expires_at);
+	CREATE TRIGGER IF NOT EXISTS urls_code_reservations BEFORE INSERT ON urls
+	WHEN EXISTS (SELECT 1 FROM code_reservations WHERE short_code = NEW.short_code)
+	BEGIN
+		SELECT RAISE(ABORT, 'short code is reserved');
+	END;`,
+
+	// 26: API keys; a key's ID is the owner of the links it creates
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		secret_hash TEXT NOT NULL,
+		admin INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL,
+		revoked_at TEXT
+	);`,
+
+	// 27: GET /api/urls pages through links by creation time
+	`CREATE INDEX IF NOT EXISTS idx_urls_created_at ON urls(created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_urls_owner_created_at ON urls(owner, created_at, id);`,
+
+	// 28: where VERIFY_DESTINATION found a new link's destination to end up,
+	// and what was wrong with it; trusted API keys may skip the check
+	`ALTER TABLE urls ADD COLUMN resolved_url TEXT;
+	ALTER TABLE urls ADD COLUMN resolved_status INTEGER;
+	ALTER TABLE urls ADD COLUMN destination_problem TEXT;
+	ALTER TABLE api_keys ADD COLUMN trusted INTEGER NOT NULL DEFAULT 0;`,
+
+	// 29: Idempotency-Key records while Redis is unavailable
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		fingerprint TEXT NOT NULL,
+		status INTEGER,
+		content_type TEXT,
+		body BLOB,
+		expires_at TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);`,
+
+	// 30: bcrypt hash of the password a link is protected with
+	`ALTER TABLE urls ADD COLUMN password_hash TEXT;`,
+
+	// 31: link lifecycle status, so deletes keep the row; the change feed
+	// triggers are recreated to carry it
+	`ALTER TABLE urls ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+	CREATE INDEX IF NOT EXISTS idx_urls_status ON urls(status) WHERE status != 'active';
+	DROP TRIGGER IF EXISTS url_changes_insert;
+	DROP TRIGGER IF EXISTS url_changes_update;
+	CREATE TRIGGER url_changes_insert AFTER INSERT ON urls WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('insert', NEW.short_code, json_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner, 'expires_at', NEW.expires_at, 'scan_status', NEW.scan_status,
+			'status', NEW.status));
+	END;
+	CREATE TRIGGER url_changes_update
+	AFTER UPDATE OF short_code, long_url, og_title, og_description, og_image, challenge, active_from, activated, hot, owner, expires_at, scan_status, status ON urls
+	WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO url_changes (op, short_code, payload) VALUES ('update', NEW.short_code, json_object(
+			'short_code', NEW.short_code, 'long_url', NEW.long_url, 'created_at', NEW.created_at,
+			'og_title', NEW.og_title, 'og_description', NEW.og_description, 'og_image', NEW.og_image,
+			'challenge', NEW.challenge, 'active_from', NEW.active_from, 'activated', NEW.activated,
+			'hot', NEW.hot, 'owner', NEW.owner, 'expires_at', NEW.expires_at, 'scan_status', NEW.scan_status,
+			'status', NEW.status));
+	END;`,
+
+	// 32: webhooks managed through the API and their recent deliveries
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id TEXT PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		duration_ms INTEGER NOT NULL,
+		attempted_at TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, id);`,
+
+	// 33: hourly click rollups per code, hour as the RFC3339 UTC hour start
+	`CREATE TABLE IF NOT EXISTS clicks_hourly (
+		short_code TEXT NOT NULL,
+		hour TEXT NOT NULL,
+		clicks INTEGER NOT NULL,
+		PRIMARY KEY (short_code, hour)
+	);
+	CREATE INDEX IF NOT EXISTS idx_clicks_hourly_hour ON clicks_hourly(hour);`,
+
+	// 34: a link's UTM defaults as an encoded query string, NULL for none
+	`ALTER TABLE urls ADD COLUMN utm TEXT;`,
+
+	// 35: when a link's status last changed, whether it was ever under a
+	// legal block, and the pool of recycled codes; see recycling.go
+	`ALTER TABLE urls ADD COLUMN status_changed_at TEXT;
+	ALTER TABLE urls ADD COLUMN legal_blocked INTEGER NOT NULL DEFAULT 0;
+	UPDATE urls SET status_changed_at = datetime() WHERE status != 'active';
+	CREATE TABLE IF NOT EXISTS recycled_codes (
+		short_code TEXT PRIMARY KEY,
+		recycled_at TEXT NOT NULL
+	);`,
+
+	// 36: the destination's host, for GET /api/urls?domain=, and indexes
+	// for the listing's common filters. Earlier links get a host parsed in
+	// SQL, without stripping a port or user info.
+	`ALTER TABLE urls ADD COLUMN destination_host TEXT;
+	UPDATE urls SET destination_host = lower(substr(
+		replace(replace(substr(long_url, instr(long_url, '://') + 3), '?', '/'), '#', '/') || '/', 1,
+		instr(replace(replace(substr(long_url, instr(long_url, '://') + 3), '?', '/'), '#', '/') || '/', '/') - 1));
+	CREATE INDEX IF NOT EXISTS idx_urls_owner_host ON urls(owner, destination_host, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_urls_owner_status ON urls(owner, status, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_urls_owner_expires_at ON urls(owner, expires_at);
+	CREATE INDEX IF NOT EXISTS idx_click_counters_last_clicked_at ON click_counters(last_clicked_at);`,
+
+	// 37: a version per owner, and one for everyone under the owner '',
+	// bumped in the transaction of every change to what GET /api/urls and
+	// /api/export return; see conditional.go
+	`CREATE TABLE IF NOT EXISTS link_modified (
+		owner TEXT PRIMARY KEY,
+		version INTEGER NOT NULL,
+		modified_at TEXT NOT NULL
+	);
+	CREATE TRIGGER link_modified_urls_insert AFTER INSERT ON urls WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT o, 1, datetime() FROM (SELECT '' AS o UNION SELECT NEW.owner) WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+	END;
+	CREATE TRIGGER link_modified_urls_update AFTER UPDATE ON urls WHEN NEW.is_test = 0
+	BEGIN
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT o, 1, datetime() FROM (SELECT '' AS o UNION SELECT NEW.owner UNION SELECT OLD.owner) WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+	END;
+	CREATE TRIGGER link_modified_urls_delete AFTER DELETE ON urls WHEN OLD.is_test = 0
+	BEGIN
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT o, 1, datetime() FROM (SELECT '' AS o UNION SELECT OLD.owner) WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+	END;
+	CREATE TRIGGER link_modified_click_counters_insert AFTER INSERT ON click_counters
+	BEGIN
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT o, 1, datetime() FROM (SELECT '' AS o UNION SELECT owner FROM urls WHERE short_code = NEW.short_code) WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+	END;
+	CREATE TRIGGER link_modified_click_counters_update AFTER UPDATE ON click_counters
+	BEGIN
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT o, 1, datetime() FROM (SELECT '' AS o UNION SELECT owner FROM urls WHERE short_code = NEW.short_code) WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+	END;
+	CREATE TRIGGER link_modified_link_metadata_insert AFTER INSERT ON link_metadata
+	BEGIN
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT o, 1, datetime() FROM (SELECT '' AS o UNION SELECT owner FROM urls WHERE short_code = NEW.short_code) WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+	END;
+	CREATE TRIGGER link_modified_link_metadata_update AFTER UPDATE ON link_metadata
+	BEGIN
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT o, 1, datetime() FROM (SELECT '' AS o UNION SELECT owner FROM urls WHERE short_code = NEW.short_code) WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+	END;
+	CREATE TRIGGER link_modified_link_metadata_delete AFTER DELETE ON link_metadata
+	BEGIN
+		INSERT INTO link_modified (owner, version, modified_at)
+		SELECT o, 1, datetime() FROM (SELECT '' AS o UNION SELECT owner FROM urls WHERE short_code = OLD.short_code) WHERE o IS NOT NULL
+		ON CONFLICT (owner) DO UPDATE SET version = link_modified.version + 1, modified_at = excluded.modified_at;
+	END;`,
+
+	// 38: the tier policy an API key's callers get
+	`ALTER TABLE api_keys ADD COLUMN tier TEXT NOT NULL DEFAULT 'standard';`,
+
+	// 39: daily usage counters per link owner, day as the UTC YYYY-MM-DD;
+	// see usage.go
+	`CREATE TABLE IF NOT EXISTS key_usage_daily (
+		owner TEXT NOT NULL,
+		day TEXT NOT NULL,
+		links_created INTEGER NOT NULL DEFAULT 0,
+		clicks INTEGER NOT NULL DEFAULT 0,
+		api_calls INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (owner, day)
+	);
+	CREATE INDEX IF NOT EXISTS idx_key_usage_daily_day ON key_usage_daily(day);`,
+
+	// 40: what webhook deliveries sent and got back, redacted and cut, and
+	// the delivery a replay re-sent; see webhookdebug.go
+	`ALTER TABLE webhook_deliveries ADD COLUMN request_body TEXT;
+	ALTER TABLE webhook_deliveries ADD COLUMN request_truncated INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE webhook_deliveries ADD COLUMN response_body TEXT;
+	ALTER TABLE webhook_deliveries ADD COLUMN response_truncated INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE webhook_deliveries ADD COLUMN replay_of INTEGER;
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_attempted_at ON webhook_deliveries(attempted_at);`,
+
+	// 41: when a link's url_expiring_soon event was sent, cleared by a
+	// renewal; see expiry.go
+	`ALTER TABLE urls ADD COLUMN expiry_warned_at TEXT;`,
+
+	// 42: the visitor's country in the hourly rollups, "" when unknown, and
+	// country and city on clicks; see geoip.go and statsgeo.go
+	`CREATE TABLE clicks_hourly_geo (
+		short_code TEXT NOT NULL,
+		hour TEXT NOT NULL,
+		country TEXT NOT NULL DEFAULT '',
+		clicks INTEGER NOT NULL,
+		PRIMARY KEY (short_code, hour, country)
+	);
+	INSERT INTO clicks_hourly_geo (short_code, hour, clicks) SELECT short_code, hour, clicks FROM clicks_hourly;
+	DROP TABLE clicks_hourly;
+	ALTER TABLE clicks_hourly_geo RENAME TO clicks_hourly;
+	CREATE INDEX IF NOT EXISTS idx_clicks_hourly_hour ON clicks_hourly(hour);
+	ALTER TABLE clicks ADD COLUMN country TEXT;
+	ALTER TABLE clicks ADD COLUMN city TEXT;`,
+
+	// 43: the old codes of renamed links, held for the link until they
+	// expire or are released; see aliases.go
+	`CREATE TABLE IF NOT EXISTS link_aliases (
+		alias TEXT PRIMARY KEY,
+		short_code TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_link_aliases_short_code ON link_aliases(short_code);
+	CREATE TRIGGER IF NOT EXISTS urls_link_aliases BEFORE INSERT ON urls
+	WHEN EXISTS (SELECT 1 FROM link_aliases WHERE alias = NEW.short_code AND (expires_at IS NULL OR datetime(expires_at) > datetime()))
+	BEGIN
+		SELECT RAISE(ABORT, 'short code is reserved');
+	END;`,
+
+	// 44: the quota_warning events sent, once per owner, quota, period and
+	// threshold; see quota.go
+	`CREATE TABLE IF NOT EXISTS quota_warnings (
+		owner TEXT NOT NULL,
+		policy TEXT NOT NULL,
+		period TEXT NOT NULL,
+		threshold INTEGER NOT NULL,
+		sent_at TEXT NOT NULL,
+		PRIMARY KEY (owner, policy, period, threshold)
+	);
+	CREATE INDEX IF NOT EXISTS idx_quota_warnings_sent_at ON quota_warnings(sent_at);`,
+
+	// 45: a link's own click webhook, the owner secrets signing them, and
+	// the link a webhook delivery was about; see linkwebhooks.go
+	`ALTER TABLE urls ADD COLUMN webhook_url TEXT;
+	CREATE INDEX IF NOT EXISTS idx_urls_owner_webhook ON urls(owner) WHERE webhook_url IS NOT NULL;
+	CREATE TABLE IF NOT EXISTS link_webhook_secrets (
+		owner TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	ALTER TABLE webhook_deliveries ADD COLUMN short_code TEXT;
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_short_code ON webhook_deliveries(short_code, id);`,
+
+	// 46: where a shadow destination selector disagreed with the one
+	// served; see shadoweval.go
+	`CREATE TABLE IF NOT EXISTS shadow_mismatches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		selector TEXT NOT NULL,
+		short_code TEXT NOT NULL,
+		request_uri TEXT NOT NULL,
+		served TEXT NOT NULL,
+		candidate TEXT NOT NULL,
+		client_ip TEXT,
+		country TEXT,
+		city TEXT,
+		user_agent TEXT,
+		accept_language TEXT,
+		referrer TEXT,
+		recorded_at TEXT NOT NULL
+	);`,
+
+	// 47: owners' named defaults for new links; see settingsprofiles.go
+	`CREATE TABLE IF NOT EXISTS settings_profiles (
+		owner TEXT NOT NULL,
+		name TEXT NOT NULL,
+		settings TEXT NOT NULL,
+		is_default INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY (owner, name)
+	);`,
+}
+
+// runMigrations brings the schema up to date: migrations on SQLite,
+// postgresMigrations on Postgres, where replicas starting together take
+// turns.
+func (s *Server) runMigrations() error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	steps, table := migrations, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+	if s.cfg.postgres() {
+		steps, table = postgresMigrations, postgresSchemaMigrationsTable
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(?)", postgresMigrationLock); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock(?)", postgresMigrationLock)
+	}
+	if _, err := conn.ExecContext(ctx, table); err != nil {
+		return err
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	for i := current; i < len(steps); i++ {
+		version := i + 1
+		if err := applyMigration(ctx, conn, version, steps[i]); err != nil {
+			return fmt.Errorf("migration %d failed: %w", version, err)
+		}
+		log.Printf("Applied schema migration %d", version)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, version int, stmt string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, stmt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+		return fmt.Errorf("recording version: %w", err)
+	}
+	return tx.Commit()
+}
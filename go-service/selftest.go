@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// selfTestLongURL is the destination of the temporary self-test link.
+const selfTestLongURL = "https://example.com/shortener-self-test"
+
+type selfTestStep struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type selfTestReport struct {
+	OK    bool           `json:"ok"`
+	Steps []selfTestStep `json:"steps"`
+}
+
+// runSelfTest exercises the create → resolve → cache → publish pipeline
+// against the configured backends and removes what it created. The link is
+// flagged is_test, so its redirect is never counted, and the synthetic event
+// carries is_test so consumers drop it.
+func (s *Server) runSelfTest(ctx context.Context) selfTestReport {
+	report := selfTestReport{OK: true}
+	step := func(name string, fn func() (string, error)) bool {
+		start := time.Now()
+		detail, err := fn()
+		step := selfTestStep{Name: name, OK: err == nil, LatencyMS: float64(time.Since(start).Microseconds()) / 1000, Detail: detail}
+		if err != nil {
+			step.Error = err.Error()
+			report.OK = false
+		}
+		report.Steps = append(report.Steps, step)
+		return err == nil
+	}
+
+	var shortCode string
+	created := step("create", func() (string, error) {
+		resp, err := s.storeShortURL(ctx, ShortenRequest{LongURL: selfTestLongURL, isTest: true})
+		shortCode = resp.ShortCode
+		return shortCode, err
+	})
+	if !created {
+		return report
+	}
+
+	step("resolve", func() (string, error) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/"+shortCode, nil)
+		c.Params = gin.Params{{Key: "code", Value: shortCode}}
+		s.redirect(c)
+		if w.Code != redirectStatus(0, false) || w.Header().Get("Location") != selfTestLongURL {
+			return "", fmt.Errorf("got %d to %q", w.Code, w.Header().Get("Location"))
+		}
+		return strconv.Itoa(w.Code), nil
+	})
+
+	step("cache", func() (string, error) {
+		if s.rdb == nil {
+			return "skipped: Redis not connected", nil
+		}
+		cached, err := s.rdb.Get(ctx, urlCacheKey(shortCode)).Result()
+		if err != nil {
+			return "", err
+		}
+		if link := decodeCachedLink(cached); link.LongURL != selfTestLongURL {
+			return "", fmt.Errorf("cached %q", link.LongURL)
+		}
+		return "hit", nil
+	})
+
+	step("publish", func() (string, error) {
+		return s.publishSelfTestEvent(ctx, shortCode)
+	})
+
+	step("cleanup", func() (string, error) {
+		localLinks.evict(shortCode)
+		if s.rdb != nil {
+			if err := s.rdb.Del(ctx, urlCacheKey(shortCode)).Err(); err != nil {
+				return "", err
+			}
+		}
+		_, err := s.db.ExecContext(ctx, "DELETE FROM urls WHERE short_code = ? AND is_test = 1", shortCode)
+		return "", err
+	})
+	return report
+}
+
+// publishSelfTestEvent sends one synthetic click synchronously over the
+// same transport real clicks use and reports whether it was accepted.
+func (s *Server) publishSelfTestEvent(ctx context.Context, shortCode string) (string, error) {
+	data, err := json.Marshal(ClickEvent{
+		ClickID:   newRandomID(),
+		ShortCode: shortCode,
+		ClickedAt: time.Now().Format(time.RFC3339),
+		IsTest:    true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if s.streamMode() {
+		if err := s.rdb.XAdd(ctx, xaddArgs(string(data))).Err(); err != nil {
+			return "", err
+		}
+		groups, err := s.rdb.XInfoGroups(ctx, clickStreamKey).Result()
+		if err != nil {
+			return "", err
+		}
+		if len(groups) == 0 {
+			return "", errors.New("redis: no consumer group on the click_events stream")
+		}
+		return fmt.Sprintf("redis stream: %d consumer group(s)", len(groups)), nil
+	}
+	if s.rdb != nil {
+		receivers, err := s.rdb.Publish(ctx, "click_events", data).Result()
+		if err != nil {
+			return "", err
+		}
+		if receivers == 0 {
+			return "", errors.New("redis: no subscribers on click_events")
+		}
+		return fmt.Sprintf("redis: %d subscriber(s)", receivers), nil
+	}
+
+	status, err := s.postEventPayload(ctx, "/api/events", data)
+	if err != nil {
+		return "", err
+	}
+	if status < 200 || status > 299 {
+		return "", fmt.Errorf("http: status %d", status)
+	}
+	return fmt.Sprintf("http: %d", status), nil
+}
+
+// runSelfTestCLI prints the report for `--self-test` and returns the exit
+// code.
+func (s *Server) runSelfTestCLI() int {
+	report := s.runSelfTest(context.Background())
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(os.Stdout, string(out))
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// postSelfTest serves POST /admin/self-test.
+func (s *Server) postSelfTest(c *gin.Context) {
+	report := s.runSelfTest(c.Request.Context())
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+		log.Printf("Self-test failed: %+v", report.Steps)
+	}
+	c.JSON(status, report)
+}
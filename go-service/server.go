@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Config is what NewServer connects to; configFromEnv reads it from the
+// environment.
+type Config struct {
+	// DatabaseURL is a postgres:// URL, or the SQLite database file.
+	DatabaseURL string
+	// DatabaseReadURLs are Postgres read replicas of DatabaseURL that
+	// redirect lookups, metadata and stats are read from; SQLite ignores
+	// them. A replica more than ReplicaMaxLag behind is read around.
+	DatabaseReadURLs []string
+	ReplicaMaxLag    time.Duration
+	// MigrateToURL, when set, is the database links are moving to; see
+	// storageMigration.
+	MigrateToURL string
+	// RedisAddr is Redis's host:port. Empty runs without Redis, with the
+	// database answering every lookup.
+	RedisAddr string
+	// PythonServiceURL is the analytics service click events fall back to
+	// over HTTP.
+	PythonServiceURL string
+}
+
+// postgres reports whether the database is Postgres rather than SQLite.
+func (cfg Config) postgres() bool {
+	return isPostgresURL(cfg.DatabaseURL)
+}
+
+// configFromEnv reads DATABASE_URL (or DB_PATH), DATABASE_READ_URLS
+// (comma-separated), REPLICA_MAX_LAG, STORAGE_MIGRATE_TO, REDIS_URL and
+// PYTHON_SERVICE_URL.
+func configFromEnv() Config {
+	return Config{
+		DatabaseURL:      databaseURL(),
+		DatabaseReadURLs: splitURLs(getEnv("DATABASE_READ_URLS", "")),
+		ReplicaMaxLag:    getEnvDuration("REPLICA_MAX_LAG", 5*time.Second),
+		MigrateToURL:     getEnv("STORAGE_MIGRATE_TO", ""),
+		RedisAddr:        getEnv("REDIS_URL", "localhost:6380"),
+		PythonServiceURL: getEnv("PYTHON_SERVICE_URL", "http://localhost:5000"),
+	}
+}
+
+// Server is the service: the database, Redis, the configuration and the
+// client for the Python service, with the handlers, the gRPC service and
+// the background jobs that use them as its methods. Settings that don't
+// depend on a connection stay package-level, read once at startup.
+type Server struct {
+	cfg Config
+
+	db *sql.DB
+	// replicas are the read replicas, nil without any.
+	replicas *replicaSet
+	// rdb is nil when running without Redis.
+	rdb *redis.Client
+	// python is shared by every outbound call to PYTHON_SERVICE_URL so
+	// connections are kept alive and reused instead of piling up in
+	// TIME_WAIT.
+	python *http.Client
+
+	// store keeps the links; see URLStore.
+	store URLStore
+	// migration is store while links move to another database, nil
+	// otherwise.
+	migration *storageMigration
+	// events carries click and lifecycle events to their consumers.
+	events EventPublisher
+
+	clickQueue chan clickJob
+	// clickJobs counts clicks accepted but not yet published, so shutdown
+	// can wait for them.
+	clickJobs sync.WaitGroup
+	outbox    clickOutbox
+}
+
+// NewServer opens and migrates the database and connects to Redis. A Redis
+// that doesn't answer is not an error: the breaker fails calls fast until
+// a probe reaches it. Nothing runs in the background until start.
+func NewServer(cfg Config) (*Server, error) {
+	s := &Server{cfg: cfg, clickQueue: make(chan clickJob, clickQueueSize)}
+	s.outbox = clickOutbox{s: s, wake: make(chan struct{}, 1)}
+	if err := s.openDB(); err != nil {
+		return nil, err
+	}
+	if cfg.MigrateToURL != "" {
+		if err := s.openStorageMigration(); err != nil {
+			s.db.Close()
+			return nil, err
+		}
+	}
+	if cfg.RedisAddr != "" {
+		s.initRedis()
+	}
+	s.initPythonClient()
+	s.events = redisPublisher{s}
+	return s, nil
+}
+
+// Close closes Redis and the database. start registers the same as
+// shutdown hooks; Close is for a Server that was never started.
+func (s *Server) Close() error {
+	var err error
+	if s.rdb != nil {
+		err = s.rdb.Close()
+	}
+	if s.replicas != nil {
+		err = errors.Join(err, s.replicas.Close())
+	}
+	if s.migration != nil {
+		err = errors.Join(err, s.migration.target.db.Close())
+	}
+	return errors.Join(err, s.db.Close())
+}
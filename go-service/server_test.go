@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore is a URLStore in a map, for tests about the handlers rather
+// than what the database does.
+type fakeStore struct {
+	mu    sync.Mutex
+	links map[string]storedLink
+	// err, when set, is returned by every call.
+	err error
+	// lookupDelay slows GetLongURL down, as a loaded database would.
+	lookupDelay time.Duration
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{links: map[string]storedLink{}}
+}
+
+func (f *fakeStore) Create(ctx context.Context, req ShortenRequest, code string) (createdLink, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return createdLink{}, f.err
+	}
+	if _, ok := f.links[code]; ok {
+		return createdLink{}, errCodeTaken
+	}
+	f.links[code] = storedLink{LongURL: req.LongURL, Status: linkStatusActive, Owner: sql.NullString{String: req.owner, Valid: req.owner != ""}}
+	return createdLink{ShortCode: code, LongURL: req.LongURL}, nil
+}
+
+func (f *fakeStore) CreateBatch(ctx context.Context, reqs []ShortenRequest, valid []bool, results []shortenBatchResult) error {
+	for i, req := range reqs {
+		if !valid[i] {
+			continue
+		}
+		code := req.CustomAlias
+		if code == "" {
+			code = newRandomID()[:8]
+		}
+		link, err := f.Create(ctx, req, code)
+		if errors.Is(err, errCodeTaken) {
+			results[i].Status, results[i].Code = "conflict", "alias_taken"
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		results[i].Status, results[i].ShortCode = "created", link.ShortCode
+	}
+	return nil
+}
+
+func (f *fakeStore) GetLongURL(ctx context.Context, code string) (storedLink, error) {
+	select {
+	case <-ctx.Done():
+		return storedLink{}, ctx.Err()
+	case <-time.After(f.lookupDelay):
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return storedLink{}, f.err
+	}
+	l, ok := f.links[code]
+	if !ok {
+		return storedLink{}, sql.ErrNoRows
+	}
+	return l, nil
+}
+
+func (f *fakeStore) Delete(ctx context.Context, code string, hard bool) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	l, ok := f.links[code]
+	if hard {
+		delete(f.links, code)
+		return ok, nil
+	}
+	if !ok || l.Status == linkStatusDeleted {
+		return false, nil
+	}
+	l.Status = linkStatusDeleted
+	f.links[code] = l
+	return true, nil
+}
+
+func (f *fakeStore) Exists(ctx context.Context, code string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.links[code]
+	return ok, f.err
+}
+
+func (f *fakeStore) Stats(ctx context.Context, code string) (linkStats, error) {
+	l, err := f.GetLongURL(ctx, code)
+	return linkStats{Status: l.Status, Owner: l.Owner}, err
+}
+
+func (f *fakeStore) MarkActivated(ctx context.Context, code string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, ok := f.links[code]
+	if !ok || l.Activated {
+		return false, f.err
+	}
+	l.Activated = true
+	f.links[code] = l
+	return true, f.err
+}
+
+func (f *fakeStore) AddChallenged(ctx context.Context, code string) error { return f.err }
+
+// fakePublisher records what it is asked to publish.
+type fakePublisher struct {
+	mu        sync.Mutex
+	clicks    []ClickEvent
+	lifecycle []LifecycleEvent
+}
+
+func (p *fakePublisher) PublishClick(ctx context.Context, event ClickEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clicks = append(p.clicks, event)
+}
+
+func (p *fakePublisher) PublishLifecycle(ctx context.Context, event LifecycleEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lifecycle = append(p.lifecycle, event)
+}
+
+func (p *fakePublisher) lifecycleTypes() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var types []string
+	for _, e := range p.lifecycle {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+// newFakeServer is a Server keeping links in a fakeStore and publishing to
+// a fakePublisher. What is kept around links (settings, keys, clicks) is
+// still in testServer's database.
+func newFakeServer(tb testing.TB) (*Server, *fakeStore, *fakePublisher) {
+	tb.Helper()
+	store, events := newFakeStore(), &fakePublisher{}
+	s := &Server{
+		cfg:        testServer.cfg,
+		db:         testServer.db,
+		python:     testServer.python,
+		store:      store,
+		events:     events,
+		clickQueue: make(chan clickJob, clickQueueSize),
+	}
+	s.outbox = clickOutbox{s: s, wake: make(chan struct{}, 1)}
+	withLocalCache(tb, 0)
+	return s, store, events
+}
+
+func TestShortenRedirectDeleteWithFakeStore(t *testing.T) {
+	s, store, events := newFakeServer(t)
+	r := s.newRouter()
+	admin := "Authorization: Bearer " + testAdminToken
+
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/fake-store","custom_alias":"fake-store"}`, admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+	}
+	var created ShortenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.ShortCode != "fake-store" {
+		t.Fatalf("shorten response = %s (%v)", w.Body, err)
+	}
+	if l, ok := store.links["fake-store"]; !ok || l.LongURL != "https://example.com/fake-store" {
+		t.Fatalf("store holds %+v after shortening", store.links)
+	}
+
+	w = serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/other","custom_alias":"fake-store"}`, admin)
+	if w.Code != http.StatusConflict {
+		t.Errorf("shorten with a taken alias = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	w = serveTest(r, http.MethodGet, "/fake-store", "")
+	if w.Code != defaultRedirectStatus || w.Header().Get("Location") != "https://example.com/fake-store" {
+		t.Errorf("redirect = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := serveTest(r, http.MethodGet, "/not-stored", ""); w.Code != http.StatusNotFound {
+		t.Errorf("redirect of a missing code = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if w := serveTest(r, http.MethodDelete, "/api/urls/fake-store", "", admin); w.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodGet, "/fake-store", ""); w.Code != http.StatusGone && w.Code != http.StatusNotFound {
+		t.Errorf("redirect after delete = %d", w.Code)
+	}
+	if w := serveTest(r, http.MethodDelete, "/api/urls/fake-store", "", admin); w.Code != http.StatusNotFound {
+		t.Errorf("second delete = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if got := events.lifecycleTypes(); len(got) != 2 || got[0] != eventURLCreated || got[1] != eventURLDeleted {
+		t.Errorf("lifecycle events = %v, want [%s %s]", got, eventURLCreated, eventURLDeleted)
+	}
+}
+
+func TestStoreErrorsWithFakeStore(t *testing.T) {
+	s, store, _ := newFakeServer(t)
+	r := s.newRouter()
+	admin := "Authorization: Bearer " + testAdminToken
+	store.links["fake-busy"] = storedLink{LongURL: "https://example.com/busy", Status: linkStatusActive}
+	store.err = errDBBusy
+
+	if w := serveTest(r, http.MethodDelete, "/api/urls/fake-busy", "", admin); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("delete with the store busy = %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	store.err = errors.New("disk on fire")
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/broken"}`, admin); w.Code != http.StatusInternalServerError {
+		t.Errorf("shorten with the store failing = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestCORSPreflightAllowsEveryRouteMethod(t *testing.T) {
+	r := testServer.newRouter()
+	w := serveTest(r, http.MethodOptions, "/api/urls/abc", "", "Origin: https://dashboard.example", "Access-Control-Request-Method: PATCH")
+	if w.Code != http.StatusOK {
+		t.Fatalf("preflight = %d", w.Code)
+	}
+	allowed := map[string]bool{}
+	for _, m := range strings.Split(w.Header().Get("Access-Control-Allow-Methods"), ",") {
+		allowed[strings.TrimSpace(m)] = true
+	}
+	for _, route := range r.Routes() {
+		if !allowed[route.Method] {
+			t.Errorf("%s %s is not in Access-Control-Allow-Methods %q", route.Method, route.Path, w.Header().Get("Access-Control-Allow-Methods"))
+		}
+	}
+}
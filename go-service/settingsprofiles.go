@@ -0,0 +1,325 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A settings profile is an owner's named defaults for new links, such as
+// 302 redirects, campaign UTM tags and a 90-day expiry for one team's links
+// and permanent 301s for another's. A shorten request picks one with
+// "profile"; without one, the owner's default profile, if they marked one,
+// applies. A profile only fills in what the request leaves unset, UTM tags
+// one by one, and is copied onto the link, so changing or deleting it later
+// leaves existing links alone. The creation response's "settings" shows
+// what the link ended up with and which of it came from the profile.
+// Profiles are managed under /api/profiles.
+type settingsProfile struct {
+	Name         string   `json:"name"`
+	RedirectType int      `json:"redirect_type,omitempty"`
+	TTLSeconds   int      `json:"ttl_seconds,omitempty"`
+	UTM          *linkUTM `json:"utm,omitempty"`
+	// Default applies the profile to the owner's requests that name none.
+	// Marking one profile default unmarks the others.
+	Default bool `json:"default"`
+}
+
+// linkSettings is what a link was created with, returned when a profile
+// applied.
+type linkSettings struct {
+	Profile      string   `json:"profile"`
+	RedirectType int      `json:"redirect_type"`
+	ExpiresAt    string   `json:"expires_at,omitempty"`
+	UTM          *linkUTM `json:"utm,omitempty"`
+	// FromProfile names the settings the profile filled in.
+	FromProfile []string `json:"from_profile"`
+}
+
+const maxSettingsProfiles = 50
+
+var settingsProfileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+var (
+	errUnknownSettingsProfile    = errors.New("no such settings profile")
+	errSettingsProfileExists     = errors.New("settings profile already exists")
+	errSettingsProfileNeedsOwner = errors.New("profile needs an API key")
+	errTooManySettingsProfiles   = fmt.Errorf("an owner may have at most %d settings profiles", maxSettingsProfiles)
+)
+
+func (p *settingsProfile) validate() error {
+	if !settingsProfileNamePattern.MatchString(p.Name) {
+		return errors.New("name must be 1-64 lowercase letters, digits, '-' or '_'")
+	}
+	if err := validateRedirectType(p.RedirectType); err != nil {
+		return err
+	}
+	if p.TTLSeconds < 0 {
+		return errors.New("ttl_seconds must be positive")
+	}
+	if p.UTM != nil {
+		if err := validateLinkUTM(p.UTM); err != nil {
+			return err
+		}
+		if p.UTM.encode() == "" {
+			p.UTM = nil
+		}
+	}
+	return nil
+}
+
+// apply fills in the settings req leaves unset.
+func (p *settingsProfile) apply(req *ShortenRequest) {
+	req.settingsProfile = p.Name
+	req.fromProfile = []string{}
+	if req.RedirectType == 0 && p.RedirectType != 0 {
+		req.RedirectType = p.RedirectType
+		req.fromProfile = append(req.fromProfile, "redirect_type")
+	}
+	if req.ExpiresAt == nil && req.TTLSeconds == 0 && p.TTLSeconds > 0 {
+		req.TTLSeconds = p.TTLSeconds
+		req.fromProfile = append(req.fromProfile, "ttl_seconds")
+	}
+	if p.UTM != nil {
+		utm := *p.UTM
+		if u := req.UTM; u != nil {
+			utm.Source = cmp.Or(u.Source, utm.Source)
+			utm.Medium = cmp.Or(u.Medium, utm.Medium)
+			utm.Campaign = cmp.Or(u.Campaign, utm.Campaign)
+			utm.Term = cmp.Or(u.Term, utm.Term)
+			utm.Content = cmp.Or(u.Content, utm.Content)
+		}
+		if req.UTM == nil || utm != *req.UTM {
+			req.fromProfile = append(req.fromProfile, "utm")
+		}
+		req.UTM = &utm
+	}
+}
+
+// settings is what the link for req was created with, nil when no profile
+// applied.
+func (req ShortenRequest) settings() *linkSettings {
+	if req.settingsProfile == "" {
+		return nil
+	}
+	settings := &linkSettings{Profile: req.settingsProfile, RedirectType: redirectStatus(req.RedirectType, req.ExpiresAt != nil),
+		UTM: req.UTM, FromProfile: req.fromProfile}
+	if req.ExpiresAt != nil {
+		settings.ExpiresAt = req.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return settings
+}
+
+// applySettingsProfile applies the profile req names, or its owner's
+// default one, to req. A profile that doesn't exist is
+// errUnknownSettingsProfile. A batch passes loaded to look each profile up
+// once; nil looks it up every time.
+func (s *Server) applySettingsProfile(ctx context.Context, req *ShortenRequest, loaded map[string]*settingsProfile) error {
+	if req.owner == "" {
+		if req.Profile != "" {
+			return errSettingsProfileNeedsOwner
+		}
+		return nil
+	}
+	p, ok := loaded[req.Profile]
+	if !ok {
+		var err error
+		p, err = s.settingsProfileFor(ctx, req.owner, req.Profile)
+		if err != nil && !errors.Is(err, errUnknownSettingsProfile) {
+			return err
+		}
+		if loaded != nil {
+			loaded[req.Profile] = p
+		}
+	}
+	switch {
+	case p != nil:
+		p.apply(req)
+	case req.Profile != "":
+		return errUnknownSettingsProfile
+	}
+	return nil
+}
+
+// settingsProfileFor loads owner's profile called name, or with name "",
+// their default profile, nil when they have none.
+func (s *Server) settingsProfileFor(ctx context.Context, owner, name string) (*settingsProfile, error) {
+	query, args := "SELECT settings, is_default FROM settings_profiles WHERE owner = ? AND name = ?", []any{owner, name}
+	if name == "" {
+		query, args = "SELECT settings, is_default FROM settings_profiles WHERE owner = ? AND is_default = 1 ORDER BY updated_at DESC LIMIT 1", []any{owner}
+	}
+	p, err := scanSettingsProfile(s.db.QueryRowContext(ctx, query, args...))
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && name != "":
+		return nil, errUnknownSettingsProfile
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("settings profile %s of %s: %w", name, owner, err)
+	}
+	return &p, nil
+}
+
+func scanSettingsProfile(row interface{ Scan(...any) error }) (settingsProfile, error) {
+	var raw string
+	var p settingsProfile
+	if err := row.Scan(&raw, &p.Default); err != nil {
+		return p, err
+	}
+	isDefault := p.Default
+	err := json.Unmarshal([]byte(raw), &p)
+	p.Default = isDefault
+	return p, err
+}
+
+// saveSettingsProfile stores p for owner, replacing any profile of that
+// name unless creating, when that is errSettingsProfileExists.
+func (s *Server) saveSettingsProfile(ctx context.Context, owner string, p settingsProfile, creating bool) error {
+	var have, named int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(CASE WHEN name = ? THEN 1 ELSE 0 END), 0) FROM settings_profiles WHERE owner = ?",
+		p.Name, owner).Scan(&have, &named)
+	switch {
+	case err != nil:
+		return err
+	case named > 0 && creating:
+		return errSettingsProfileExists
+	case named == 0 && have >= maxSettingsProfiles:
+		return errTooManySettingsProfiles
+	}
+	isDefault := p.Default
+	p.Default = false
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := s.execWithRetry(ctx, `INSERT INTO settings_profiles (owner, name, settings, is_default, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (owner, name) DO UPDATE SET settings = excluded.settings, is_default = excluded.is_default, updated_at = excluded.updated_at`,
+		owner, p.Name, string(raw), isDefault, now, now); err != nil {
+		return err
+	}
+	if !isDefault {
+		return nil
+	}
+	_, err = s.execWithRetry(ctx, "UPDATE settings_profiles SET is_default = 0 WHERE owner = ? AND name != ? AND is_default = 1", owner, p.Name)
+	return err
+}
+
+// listSettingsProfiles serves GET /api/profiles.
+func (s *Server) listSettingsProfiles(c *gin.Context) {
+	rows, err := s.db.QueryContext(c.Request.Context(), "SELECT settings, is_default FROM settings_profiles WHERE owner = ? ORDER BY name", c.GetString(ownerContextKey))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+	profiles := []settingsProfile{}
+	for rows.Next() {
+		p, err := scanSettingsProfile(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		profiles = append(profiles, p)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"profiles": profiles})
+}
+
+// getSettingsProfile serves GET /api/profiles/:name.
+func (s *Server) getSettingsProfile(c *gin.Context) {
+	p, err := s.settingsProfileFor(c.Request.Context(), c.GetString(ownerContextKey), c.Param("name"))
+	writeSettingsProfileResult(c, http.StatusOK, p, err)
+}
+
+// createSettingsProfile serves POST /api/profiles.
+func (s *Server) createSettingsProfile(c *gin.Context) {
+	s.storeSettingsProfile(c, "", true)
+}
+
+// putSettingsProfile serves PUT /api/profiles/:name, creating or replacing
+// the profile. Links created with it keep what they were created with.
+func (s *Server) putSettingsProfile(c *gin.Context) {
+	s.storeSettingsProfile(c, c.Param("name"), false)
+}
+
+func (s *Server) storeSettingsProfile(c *gin.Context, name string, creating bool) {
+	owner := c.GetString(ownerContextKey)
+	if owner == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A settings profile needs an authenticated owner", "code": "invalid_request"})
+		return
+	}
+	var p settingsProfile
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	if name != "" {
+		if p.Name != "" && p.Name != name {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name does not match the profile in the path", "code": "invalid_request"})
+			return
+		}
+		p.Name = name
+	}
+	if err := p.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	err := s.saveSettingsProfile(c.Request.Context(), owner, p, creating)
+	if err == nil {
+		slog.Info("settings profile saved", "audit", true, "by", clientIP(c), "owner", owner, "profile", p.Name)
+	}
+	status := http.StatusOK
+	if creating {
+		status = http.StatusCreated
+	}
+	writeSettingsProfileResult(c, status, &p, err)
+}
+
+// deleteSettingsProfile serves DELETE /api/profiles/:name.
+func (s *Server) deleteSettingsProfile(c *gin.Context) {
+	owner, name := c.GetString(ownerContextKey), c.Param("name")
+	res, err := s.execWithRetry(c.Request.Context(), "DELETE FROM settings_profiles WHERE owner = ? AND name = ?", owner, name)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = errUnknownSettingsProfile
+		}
+	}
+	if err != nil {
+		writeSettingsProfileResult(c, 0, nil, err)
+		return
+	}
+	slog.Info("settings profile deleted", "audit", true, "by", clientIP(c), "owner", owner, "profile", name)
+	c.Status(http.StatusNoContent)
+}
+
+func writeSettingsProfileResult(c *gin.Context, status int, p *settingsProfile, err error) {
+	switch {
+	case errors.Is(err, errUnknownSettingsProfile):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Settings profile not found", "code": "unknown_profile"})
+	case errors.Is(err, errSettingsProfileExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "A settings profile " + strconv.Quote(p.Name) + " already exists", "code": "profile_exists"})
+	case errors.Is(err, errTooManySettingsProfiles):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": "profile_limit"})
+	case errors.Is(err, errDBBusy) || isBusyError(err):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	default:
+		c.JSON(status, p)
+	}
+}
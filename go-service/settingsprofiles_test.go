@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettingsProfilesCRUD(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	auth := "X-API-Key: " + key
+
+	if w := serveTest(r, http.MethodPost, "/api/profiles", `{"name":"newsletter","redirect_type":302,"ttl_seconds":7776000}`, auth); w.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodPost, "/api/profiles", `{"name":"newsletter"}`, auth); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "profile_exists") {
+		t.Errorf("create twice = %d: %s", w.Code, w.Body)
+	}
+	for _, body := range []string{`{"name":"Bad Name"}`, `{"name":"x","redirect_type":200}`, `{"name":"x","ttl_seconds":-1}`} {
+		if w := serveTest(r, http.MethodPost, "/api/profiles", body, auth); w.Code != http.StatusBadRequest {
+			t.Errorf("create %s = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := serveTest(r, http.MethodPut, "/api/profiles/docs", `{"redirect_type":301,"default":true}`, auth); w.Code != http.StatusOK {
+		t.Fatalf("put = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodPut, "/api/profiles/docs", `{"name":"other"}`, auth); w.Code != http.StatusBadRequest {
+		t.Errorf("put with another name = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := serveTest(r, http.MethodGet, "/api/profiles", "", auth)
+	var list struct{ Profiles []settingsProfile }
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != http.StatusOK || len(list.Profiles) != 2 || list.Profiles[0].Name != "docs" || !list.Profiles[0].Default || list.Profiles[1].TTLSeconds != 7776000 {
+		t.Errorf("list = %d: %s", w.Code, w.Body)
+	}
+	// Marking another profile default unmarks the first.
+	serveTest(r, http.MethodPut, "/api/profiles/newsletter", `{"redirect_type":302,"default":true}`, auth)
+	w = serveTest(r, http.MethodGet, "/api/profiles/docs", "", auth)
+	var docs settingsProfile
+	json.Unmarshal(w.Body.Bytes(), &docs)
+	if w.Code != http.StatusOK || docs.Default || docs.RedirectType != 301 {
+		t.Errorf("docs after newsletter became default = %d: %s", w.Code, w.Body)
+	}
+
+	if w := serveTest(r, http.MethodGet, "/api/profiles/docs", "", "X-API-Key: "+otherKey); w.Code != http.StatusNotFound {
+		t.Errorf("another owner's profile = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodDelete, "/api/profiles/docs", "", auth); w.Code != http.StatusNoContent {
+		t.Errorf("delete = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodDelete, "/api/profiles/docs", "", auth); w.Code != http.StatusNotFound {
+		t.Errorf("delete twice = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestShortenAppliesSettingsProfile(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	auth := "X-API-Key: " + key
+	serveTest(r, http.MethodPost, "/api/profiles", `{"name":"newsletter","redirect_type":302,"ttl_seconds":7776000,"utm":{"source":"newsletter","medium":"email"}}`, auth)
+	serveTest(r, http.MethodPost, "/api/profiles", `{"name":"docs","redirect_type":301,"default":true}`, auth)
+	shorten := func(body string) ShortenResponse {
+		t.Helper()
+		w := serveTest(r, http.MethodPost, "/api/shorten", body, auth)
+		var resp ShortenResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("shorten %s = %d: %s", body, w.Code, w.Body)
+		}
+		return resp
+	}
+
+	// Explicit fields win, UTM tags one by one.
+	resp := shorten(`{"long_url":"https://example.com/issue-1","profile":"newsletter","redirect_type":307,"utm":{"campaign":"issue-1","medium":"web"}}`)
+	got := resp.Settings
+	if got == nil || got.Profile != "newsletter" || got.RedirectType != http.StatusTemporaryRedirect || !slices.Equal(got.FromProfile, []string{"ttl_seconds", "utm"}) {
+		t.Fatalf("settings = %+v", got)
+	}
+	if *got.UTM != (linkUTM{Source: "newsletter", Medium: "web", Campaign: "issue-1"}) {
+		t.Errorf("utm = %+v", got.UTM)
+	}
+	if expires, err := time.Parse(time.RFC3339, got.ExpiresAt); err != nil || time.Until(expires) < 89*24*time.Hour {
+		t.Errorf("expires_at = %q, want 90 days from now", got.ExpiresAt)
+	}
+
+	// Without a profile, the default one applies.
+	resp = shorten(`{"long_url":"https://example.com/guide"}`)
+	if resp.Settings == nil || resp.Settings.Profile != "docs" || resp.Settings.RedirectType != http.StatusMovedPermanently || resp.RedirectType != http.StatusMovedPermanently {
+		t.Errorf("default profile settings = %+v, redirect_type %d", resp.Settings, resp.RedirectType)
+	}
+
+	// Changing the profile leaves the links made with it alone.
+	serveTest(r, http.MethodPut, "/api/profiles/docs", `{"redirect_type":308,"default":true}`, auth)
+	var redirectType int
+	if err := testServer.db.QueryRow("SELECT redirect_type FROM urls WHERE short_code = ?", resp.ShortCode).Scan(&redirectType); err != nil || redirectType != http.StatusMovedPermanently {
+		t.Errorf("stored redirect_type after the profile changed = %d (%v), want %d", redirectType, err, http.StatusMovedPermanently)
+	}
+
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/x","profile":"missing"}`, auth)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown_profile") {
+		t.Errorf("shorten with an unknown profile = %d: %s", w.Code, w.Body)
+	}
+
+	w = serveTest(r, http.MethodPost, "/api/shorten/batch", `[{"long_url":"https://example.com/b1","profile":"newsletter"},{"long_url":"https://example.com/b2","profile":"missing"}]`, auth)
+	var batch struct{ Results []shortenBatchResult }
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	if w.Code != http.StatusOK || len(batch.Results) != 2 || batch.Results[0].Settings == nil || batch.Results[0].Settings.Profile != "newsletter" ||
+		batch.Results[0].RedirectType != http.StatusFound || batch.Results[1].Code != "unknown_profile" {
+		t.Errorf("batch with profiles = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// New ways of picking a redirect's destination, such as A/B splits or
+// geo-routing, can be tried in shadow before they serve anything. A
+// candidate selector, registered with app.RegisterShadowSelector, is run on
+// a SHADOW_EVAL_RATE sample of redirects (0 to 1, 0 by default) next to the
+// current selection, whose result is always the one served. The candidate
+// runs off the request goroutine once the destination is chosen, at most
+// shadowEvalConcurrency at a time, and gets SHADOW_EVAL_BUDGET (5ms by
+// default); one that is late is counted as a timeout and not compared, and
+// a sample that finds every slot busy is skipped, so a slow candidate never
+// holds up a redirect. A disagreement is recorded in shadow_mismatches with
+// the request's context, the visitor's as PRIVACY_MODE allows, keeping the
+// newest SHADOW_EVAL_HISTORY; GET /admin/shadow-mismatches lists them.
+// Turned off, or without a candidate, as in a build that registers none,
+// the harness costs a redirect a comparison or an atomic load.
+var (
+	shadowEvalRate    = getEnvFloat("SHADOW_EVAL_RATE", 0)
+	shadowEvalBudget  = getEnvDuration("SHADOW_EVAL_BUDGET", 5*time.Millisecond)
+	shadowEvalHistory = getEnvInt("SHADOW_EVAL_HISTORY", 1000)
+)
+
+// shadowEvalConcurrency bounds the candidate runs in flight.
+const shadowEvalConcurrency = 16
+
+// DestinationRequest is what a destination selector knows of a redirect.
+type DestinationRequest struct {
+	ShortCode string
+	// LongURL and UTM are the link's stored destination and campaign
+	// defaults.
+	LongURL string
+	UTM     string
+	// Query is the redirect's query string.
+	Query url.Values
+	// ClientIP, Country and City are unset for a visitor who opted out of
+	// tracking.
+	ClientIP       string
+	Country        string
+	City           string
+	AcceptLanguage string
+	UserAgent      string
+}
+
+// DestinationSelector picks where a redirect goes. A candidate should
+// return by the time ctx is done.
+type DestinationSelector func(ctx context.Context, req DestinationRequest) (string, error)
+
+type shadowSelector struct {
+	name     string
+	selector DestinationSelector
+}
+
+var (
+	shadowCandidate atomic.Pointer[shadowSelector]
+	shadowSlots     = make(chan struct{}, shadowEvalConcurrency)
+	// shadowEvalStats has sampled, matches, mismatches, timeouts, errors
+	// and skipped.
+	shadowEvalStats = expvar.NewMap("shadow_eval")
+)
+
+func init() {
+	if shadowEvalRate < 0 || shadowEvalRate > 1 {
+		log.Fatalf("Invalid SHADOW_EVAL_RATE %v: must be between 0 and 1", shadowEvalRate)
+	}
+	if shadowEvalBudget <= 0 || shadowEvalHistory < 1 {
+		log.Fatalf("SHADOW_EVAL_BUDGET and SHADOW_EVAL_HISTORY must be positive")
+	}
+}
+
+// RegisterShadowSelector makes sel the candidate destination selector run
+// in shadow, replacing any earlier one.
+func (a *App) RegisterShadowSelector(name string, sel DestinationSelector) {
+	shadowCandidate.Store(&shadowSelector{name, sel})
+}
+
+// shadowDestination runs the candidate on a sample of redirects to
+// shortCode, which were sent to served.
+func (s *Server) shadowDestination(c *gin.Context, shortCode, longURL, utm, served string) {
+	if shadowEvalRate <= 0 {
+		return
+	}
+	candidate := shadowCandidate.Load()
+	if candidate == nil || rand.Float64() >= shadowEvalRate {
+		return
+	}
+	select {
+	case shadowSlots <- struct{}{}:
+	default:
+		shadowEvalStats.Add("skipped", 1)
+		return
+	}
+	shadowEvalStats.Add("sampled", 1)
+	visitor := newClickVisitor(c)
+	req := DestinationRequest{ShortCode: shortCode, LongURL: longURL, UTM: utm, Query: c.Request.URL.Query(),
+		ClientIP: visitor.clientIP, AcceptLanguage: visitor.acceptLanguage, UserAgent: visitor.userAgent}
+	requestURI := redactURL(c.Request.URL.RequestURI())
+	go func() {
+		defer func() { <-shadowSlots }()
+		visitor.locate()
+		req.Country, req.City = visitor.country, visitor.city
+		got, err := runShadowSelector(candidate, req)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			shadowEvalStats.Add("timeouts", 1)
+		case err != nil:
+			shadowEvalStats.Add("errors", 1)
+		case got == served:
+			shadowEvalStats.Add("matches", 1)
+		default:
+			shadowEvalStats.Add("mismatches", 1)
+			var event ClickEvent
+			visitor.fill(&event)
+			s.recordShadowMismatch(candidate.name, shortCode, requestURI, served, got, event)
+		}
+	}()
+}
+
+// runShadowSelector runs candidate within SHADOW_EVAL_BUDGET. A candidate
+// that ignores its context is left to finish on its own.
+func runShadowSelector(candidate *shadowSelector, req DestinationRequest) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), shadowEvalBudget)
+	defer cancel()
+	type result struct {
+		destination string
+		err         error
+	}
+	done := make(chan result, 1)
+	go func() {
+		destination, err := candidate.selector(ctx, req)
+		done <- result{destination, err}
+	}()
+	select {
+	case r := <-done:
+		if ctx.Err() != nil {
+			return "", context.DeadlineExceeded
+		}
+		return r.destination, r.err
+	case <-ctx.Done():
+		return "", context.DeadlineExceeded
+	}
+}
+
+// recordShadowMismatch stores a disagreement and trims the table to
+// SHADOW_EVAL_HISTORY rows. In maintenance mode nothing is stored.
+func (s *Server) recordShadowMismatch(selector, shortCode, requestURI, served, candidate string, visitor ClickEvent) {
+	if inMaintenance() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.execWithRetry(ctx, `INSERT INTO shadow_mismatches (selector, short_code, request_uri, served, candidate, client_ip, country, city, user_agent, accept_language, referrer, recorded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		selector, shortCode, requestURI, redactURL(served), redactURL(candidate), nullIfEmpty(visitor.ClientIP), nullIfEmpty(visitor.Country), nullIfEmpty(visitor.City),
+		nullIfEmpty(visitor.UserAgent), nullIfEmpty(visitor.AcceptLanguage), nullIfEmpty(visitor.Referrer), time.Now().UTC().Format(time.RFC3339Nano))
+	if err == nil {
+		_, err = s.execWithRetry(ctx, "DELETE FROM shadow_mismatches WHERE id <= (SELECT id FROM shadow_mismatches ORDER BY id DESC LIMIT 1 OFFSET ?)", shadowEvalHistory)
+	}
+	if err != nil {
+		log.Printf("Error recording shadow mismatch for %s: %v", shortCode, err)
+	}
+}
+
+// listShadowMismatches serves GET /admin/shadow-mismatches?limit=, newest
+// first.
+func (s *Server) listShadowMismatches(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > shadowEvalHistory {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(shadowEvalHistory), "code": "invalid_request"})
+		return
+	}
+	rows, err := s.db.QueryContext(c.Request.Context(), `SELECT id, selector, short_code, request_uri, served, candidate, client_ip, country, city, user_agent, accept_language, referrer, recorded_at
+		FROM shadow_mismatches ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+	mismatches := []gin.H{}
+	for rows.Next() {
+		var id int64
+		var selector, shortCode, requestURI, served, candidate, recordedAt string
+		var clientIP, country, city, userAgent, acceptLanguage, referrer sql.NullString
+		if err := rows.Scan(&id, &selector, &shortCode, &requestURI, &served, &candidate, &clientIP, &country, &city, &userAgent, &acceptLanguage, &referrer, &recordedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		mismatches = append(mismatches, gin.H{
+			"id": id, "selector": selector, "short_code": shortCode, "request_uri": requestURI, "served": served, "candidate": candidate,
+			"client_ip": nullIfEmpty(clientIP.String), "country": nullIfEmpty(country.String), "city": nullIfEmpty(city.String),
+			"user_agent": nullIfEmpty(userAgent.String), "accept_language": nullIfEmpty(acceptLanguage.String), "referrer": nullIfEmpty(referrer.String),
+			"recorded_at": recordedAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"mismatches": mismatches})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withShadowCandidate runs sel in shadow on every redirect until the test
+// ends.
+func withShadowCandidate(t *testing.T, sel DestinationSelector) {
+	t.Helper()
+	savedRate := shadowEvalRate
+	shadowEvalRate = 1
+	app.RegisterShadowSelector("test", sel)
+	t.Cleanup(func() {
+		shadowEvalRate = savedRate
+		shadowCandidate.Store(nil)
+	})
+}
+
+func TestShadowDestinationMismatches(t *testing.T) {
+	withShadowCandidate(t, func(_ context.Context, req DestinationRequest) (string, error) {
+		if req.Query.Get("variant") == "b" {
+			return "https://example.com/variant-b", nil
+		}
+		return req.LongURL, nil
+	})
+	r := testServer.newRouter()
+	code := createOwnedLink(t, "shadow-owner")
+
+	if w := serveTest(r, http.MethodGet, "/"+code, ""); w.Header().Get("Location") != "https://example.com/"+code {
+		t.Fatalf("redirect = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	// The candidate's answer is only compared, never served.
+	if w := serveTest(r, http.MethodGet, "/"+code+"?variant=b", "", "User-Agent: shadow-test"); w.Header().Get("Location") != "https://example.com/"+code {
+		t.Fatalf("shadowed redirect = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	type mismatch struct {
+		ShortCode  string `json:"short_code"`
+		RequestURI string `json:"request_uri"`
+		Served     string
+		Candidate  string
+		UserAgent  string `json:"user_agent"`
+	}
+	var found []mismatch
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := serveTest(r, http.MethodGet, "/admin/shadow-mismatches", "", "Authorization: Bearer "+testAdminToken)
+		var page struct{ Mismatches []mismatch }
+		json.Unmarshal(w.Body.Bytes(), &page)
+		found = found[:0]
+		for _, m := range page.Mismatches {
+			if m.ShortCode == code {
+				found = append(found, m)
+			}
+		}
+		if len(found) > 0 {
+			break
+		}
+	}
+	if len(found) != 1 || found[0].RequestURI != "/"+code+"?variant=b" || found[0].Served != "https://example.com/"+code ||
+		found[0].Candidate != "https://example.com/variant-b" || found[0].UserAgent != "shadow-test" {
+		t.Errorf("mismatches recorded = %+v", found)
+	}
+}
+
+func TestShadowSelectorBudget(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := &shadowSelector{"slow", func(context.Context, DestinationRequest) (string, error) {
+		// Ignores its context.
+		<-release
+		return "https://example.com/late", nil
+	}}
+	start := time.Now()
+	if _, err := runShadowSelector(slow, DestinationRequest{}); err != context.DeadlineExceeded {
+		t.Errorf("slow candidate = %v, want a timeout", err)
+	}
+	if took := time.Since(start); took > shadowEvalBudget+100*time.Millisecond {
+		t.Errorf("slow candidate held the evaluation for %v", took)
+	}
+}
+
+func TestShadowMismatchHistory(t *testing.T) {
+	saved := shadowEvalHistory
+	shadowEvalHistory = 2
+	t.Cleanup(func() { shadowEvalHistory = saved })
+	for range 3 {
+		testServer.recordShadowMismatch("test", "shadow-history", "/shadow-history", "https://example.com/a", "https://example.com/b", ClickEvent{})
+	}
+	var n int
+	if err := testServer.db.QueryRow("SELECT COUNT(*) FROM shadow_mismatches").Scan(&n); err != nil || n != 2 {
+		t.Errorf("%d mismatches kept (%v), want 2", n, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+)
+
+// Generated codes are SHORT_CODE_LENGTH characters drawn uniformly from
+// SHORT_CODE_ALPHABET: base64url (the original, default) or base62, which
+// leaves out '-' and '_' for systems that mangle them. Both can also be set
+// with -short-code-length and -short-code-alphabet. Codes minted under an
+// earlier setting keep resolving, since shortCodePattern accepts either
+// alphabet at any length up to 32.
+var (
+	shortCodeLength   = flag.Int("short-code-length", getEnvInt("SHORT_CODE_LENGTH", 6), "length of generated short codes")
+	shortCodeAlphabet = flag.String("short-code-alphabet", getEnv("SHORT_CODE_ALPHABET", "base64url"), "alphabet of generated short codes: base64url or base62")
+)
+
+var shortCodeAlphabets = map[string]string{
+	"base64url": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_",
+	"base62":    "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+}
+
+// shortCodeChars is the configured alphabet, set by initShortCodes.
+var shortCodeChars = shortCodeAlphabets["base64url"]
+
+// initShortCodes checks the code settings once flags are parsed.
+func initShortCodes() {
+	chars, ok := shortCodeAlphabets[*shortCodeAlphabet]
+	if !ok {
+		log.Fatalf("Invalid SHORT_CODE_ALPHABET %q: must be base64url or base62", *shortCodeAlphabet)
+	}
+	// Shorter codes collide too often to allocate; longer ones would not
+	// match shortCodePattern.
+	if *shortCodeLength < 4 || *shortCodeLength > 32 {
+		log.Fatalf("Invalid SHORT_CODE_LENGTH %d: must be between 4 and 32", *shortCodeLength)
+	}
+	shortCodeChars = chars
+}
+
+func generateShortCode() (string, error) {
+	return generateCode(shortCodeChars, *shortCodeLength)
+}
+
+// generateCode draws length characters of chars independently. Random
+// bytes at or above the largest multiple of the alphabet size are thrown
+// away, so every character is equally likely whatever the alphabet.
+func generateCode(chars string, length int) (string, error) {
+	n := len(chars)
+	limit := 256 - 256%n
+	code := make([]byte, 0, length)
+	buf := make([]byte, length+8)
+	for len(code) < length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("generating short code: %w", err)
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(code) < length {
+				code = append(code, chars[int(b)%n])
+			}
+		}
+	}
+	return string(code), nil
+}
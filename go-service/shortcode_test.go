@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// shortenManyAtOnce sends n shorten requests at once, each for its own
+// URL, and returns the responses in order.
+func shortenManyAtOnce(t *testing.T, n int, prefix string) []*shortenOutcome {
+	t.Helper()
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	outcomes := make([]*shortenOutcome, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			longURL := "https://example.com/" + prefix + "/" + strconv.Itoa(i)
+			w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"`+longURL+`"}`, "X-API-Key: "+key)
+			o := &shortenOutcome{status: w.Code, longURL: longURL, retryAfter: w.Header().Get("Retry-After")}
+			json.Unmarshal(w.Body.Bytes(), &o.resp)
+			json.Unmarshal(w.Body.Bytes(), &o.err)
+			outcomes[i] = o
+		}()
+	}
+	wg.Wait()
+	return outcomes
+}
+
+type shortenOutcome struct {
+	status     int
+	longURL    string
+	retryAfter string
+	resp       ShortenResponse
+	err        struct{ Error, Code string }
+}
+
+func TestConcurrentShortenGivesUniqueCodes(t *testing.T) {
+	outcomes := shortenManyAtOnce(t, 100, "concurrent-"+newRandomID()[:6])
+	seen := map[string]bool{}
+	redirect := redirectEngine()
+	for _, o := range outcomes {
+		if o.status != http.StatusOK {
+			t.Errorf("shorten %s = %d: %+v", o.longURL, o.status, o.err)
+			continue
+		}
+		if seen[o.resp.ShortCode] {
+			t.Errorf("code %s returned twice", o.resp.ShortCode)
+		}
+		seen[o.resp.ShortCode] = true
+		if w := serveTest(redirect, http.MethodGet, "/"+o.resp.ShortCode, ""); w.Code != defaultRedirectStatus || w.Header().Get("Location") != o.longURL {
+			t.Errorf("%s redirects with %d to %q, want %s", o.resp.ShortCode, w.Code, w.Header().Get("Location"), o.longURL)
+		}
+	}
+}
+
+// TestShortenCodeCollisions shrinks the code space to 16 codes, so most of
+// the requests collide, some on every attempt.
+func TestShortenCodeCollisions(t *testing.T) {
+	savedChars, savedLength := shortCodeChars, *shortCodeLength
+	shortCodeChars, *shortCodeLength = "Qz", 4
+	t.Cleanup(func() { shortCodeChars, *shortCodeLength = savedChars, savedLength })
+
+	outcomes := shortenManyAtOnce(t, 40, "collide-"+newRandomID()[:6])
+	seen := map[string]bool{}
+	exhausted := 0
+	for _, o := range outcomes {
+		switch o.status {
+		case http.StatusOK:
+			if seen[o.resp.ShortCode] || strings.Trim(o.resp.ShortCode, "Qz") != "" {
+				t.Errorf("code %q returned twice or not from the alphabet", o.resp.ShortCode)
+			}
+			seen[o.resp.ShortCode] = true
+		case http.StatusServiceUnavailable:
+			exhausted++
+			if o.err.Code != "short_code_collision" || o.retryAfter != "1" {
+				t.Errorf("collision response = %+v, Retry-After %q", o.err, o.retryAfter)
+			}
+		default:
+			t.Errorf("shorten %s = %d: %+v", o.longURL, o.status, o.err)
+		}
+	}
+	if len(seen) > 16 || exhausted < 40-16 {
+		t.Errorf("%d codes created and %d requests out of codes, from 16 possible codes", len(seen), exhausted)
+	}
+}
+
+func TestGenerateCode(t *testing.T) {
+	counts := map[rune]int{}
+	for range 2000 {
+		code, err := generateCode("abc", 8)
+		if err != nil || len(code) != 8 {
+			t.Fatalf("generateCode = %q, %v", code, err)
+		}
+		for _, r := range code {
+			counts[r]++
+		}
+	}
+	for _, r := range "abc" {
+		// 16000 characters over 3 letters: about 5333 each.
+		if counts[r] < 5000 || counts[r] > 5700 {
+			t.Errorf("%c drawn %d times of 16000, want about a third", r, counts[r])
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("characters drawn = %v, want only the alphabet", counts)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var shortenBatchMax = getEnvInt("SHORTEN_BATCH_MAX", 1000)
+
+// shortenBatchCheckWorkers is how many destination checks of one batch run
+// at once.
+const shortenBatchCheckWorkers = 8
+
+type shortenBatchResult struct {
+	Index           int    `json:"index"`
+	Status          string `json:"status"`
+	ShortCode       string `json:"short_code,omitempty"`
+	ShortURL        string `json:"short_url,omitempty"`
+	LongURL         string `json:"long_url,omitempty"`
+	ActiveFrom      string `json:"active_from,omitempty"`
+	ExpiresAt       string `json:"expires_at,omitempty"`
+	Timezone        string `json:"timezone,omitempty"`
+	ActiveFromLocal string `json:"active_from_local,omitempty"`
+	ExpiresAtLocal  string `json:"expires_at_local,omitempty"`
+	Verified        bool   `json:"verified,omitempty"`
+	RedirectType    int    `json:"redirect_type,omitempty"`
+	// ClaimToken is set as in ShortenResponse.
+	ClaimToken          string        `json:"claim_token,omitempty"`
+	ClaimTokenExpiresAt string        `json:"claim_token_expires_at,omitempty"`
+	WebhookSecret       string        `json:"webhook_secret,omitempty"`
+	Settings            *linkSettings `json:"settings,omitempty"`
+	Error               string        `json:"error,omitempty"`
+	Code                string        `json:"code,omitempty"`
+}
+
+// createShortURLBatch shortens a JSON array of ShortenRequest objects in
+// one transaction. Each item succeeds or fails on its own: an invalid URL or
+// a taken alias is reported in that item's result and the rest are still
+// stored. With VERIFY_DESTINATION on, every item's destination is checked
+// as for POST /api/shorten, and a refused one is reported invalid. With
+// ?dry_run=true the items are only validated.
+func (s *Server) createShortURLBatch(c *gin.Context) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(c.Request.Body).Decode(&items); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body must be a JSON array of shorten requests", "code": "invalid_request"})
+		return
+	}
+	if len(items) > shortenBatchMax {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "At most " + strconv.Itoa(shortenBatchMax) + " items per batch"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+	owner, base := c.GetString(ownerContextKey), publicBaseURL(c)
+	defaultTimezone, err := s.ownerTimezone(c.Request.Context(), owner)
+	var canonical *canonicalProfile
+	if err == nil {
+		canonical, err = s.ownerCanonicalProfile(c.Request.Context(), owner)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	now := time.Now()
+	profiles := map[string]*settingsProfile{}
+	results := make([]shortenBatchResult, len(items))
+	reqs := make([]ShortenRequest, len(items))
+	valid := make([]bool, len(items))
+	for i, item := range items {
+		results[i].Index = i
+		if err := json.Unmarshal(item, &reqs[i]); err != nil {
+			results[i].Status, results[i].Error, results[i].Code = "invalid", "Invalid shorten request", "invalid_request"
+			continue
+		}
+		reqs[i].owner, reqs[i].tier, reqs[i].baseURL, reqs[i].canonical = owner, callerTier(c), base, canonical
+		if err := s.applySettingsProfile(c.Request.Context(), &reqs[i], profiles); err != nil {
+			switch {
+			case errors.Is(err, errUnknownSettingsProfile):
+				results[i].Status, results[i].Error, results[i].Code = "invalid", "profile "+strconv.Quote(reqs[i].Profile)+" does not exist", "unknown_profile"
+			case errors.Is(err, errSettingsProfileNeedsOwner):
+				results[i].Status, results[i].Error, results[i].Code = "invalid", err.Error(), "invalid_request"
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			continue
+		}
+		if err := prepareShortenRequest(&reqs[i], defaultTimezone, now); err != nil {
+			results[i].Status, results[i].Error, results[i].Code = "invalid", err.Error(), longURLErrorCode(err)
+			var denial *policyDenial
+			if errors.As(err, &denial) {
+				results[i].Code = "tier_policy"
+			}
+			results[i].LongURL = reqs[i].LongURL
+			continue
+		}
+		valid[i] = true
+		results[i].Status, results[i].LongURL = "valid", reqs[i].LongURL
+	}
+	if verifyDestination {
+		s.verifyBatchDestinations(c, reqs, valid, results)
+	}
+
+	if !dryRun {
+		err := s.storeShortURLBatch(c.Request.Context(), reqs, valid, results)
+		if isBusyError(err) {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error storing shorten batch: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create short URLs"})
+			return
+		}
+	}
+
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+		if r.Status == "created" {
+			logSampledShorten(c, r.ShortCode, r.LongURL, owner)
+		}
+	}
+	writeQuotaHeaders(c)
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run": dryRun,
+		"created": counts["created"],
+		"reused":  counts["reused"],
+		"valid":   counts["valid"],
+		"invalid": counts["invalid"],
+		"failed":  counts["conflict"] + counts["failed"],
+		"results": results,
+	})
+}
+
+// verifyBatchDestinations is verifyShortenDestination for each valid item,
+// with up to shortenBatchCheckWorkers checks at a time. Refused items are
+// marked invalid.
+func (s *Server) verifyBatchDestinations(c *gin.Context, reqs []ShortenRequest, valid []bool, results []shortenBatchResult) {
+	trusted := c.GetBool(apiKeyTrustedContextKey) || s.isAdminCaller(c)
+	hosts, from := shortenerHosts(c), clientIP(c)
+	pending := make(chan int)
+	var workers sync.WaitGroup
+	for range shortenBatchCheckWorkers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range pending {
+				if check, refused := runDestinationCheck(c.Request.Context(), &reqs[i], hosts, from); refused {
+					valid[i] = false
+					results[i].Status, results[i].Error, results[i].Code = "invalid", "long_url failed the destination check: "+check.Detail, check.Problem
+				}
+			}
+		}()
+	}
+	for i := range reqs {
+		if !valid[i] {
+			continue
+		}
+		if reqs[i].SkipVerification {
+			if !trusted {
+				valid[i] = false
+				results[i].Status, results[i].Error, results[i].Code = "invalid", "skip_verification requires a trusted API key", "skip_verification_forbidden"
+				continue
+			}
+			destinationChecksTotal.WithLabelValues("skipped").Inc()
+			continue
+		}
+		pending <- i
+	}
+	close(pending)
+	workers.Wait()
+}
+
+// storeShortURLBatch stores the valid requests in a single transaction and
+// fills in their results. An item that can't be stored is marked and
+// skipped; only errors that doom the whole transaction are returned.
+func (s *Server) storeShortURLBatch(ctx context.Context, reqs []ShortenRequest, valid []bool, results []shortenBatchResult) error {
+	if err := s.limitBatchLinkWebhooks(ctx, reqs, valid, results); err != nil {
+		return err
+	}
+	if err := s.store.CreateBatch(ctx, reqs, valid, results); err != nil {
+		return err
+	}
+
+	var codes []string
+	for _, r := range results {
+		if r.Status == "created" {
+			codes = append(codes, r.ShortCode)
+		}
+	}
+	s.forgetNotFound(ctx, codes...)
+
+	created := 0
+	for i, req := range reqs {
+		if results[i].ShortCode == "" {
+			continue
+		}
+		r := s.shortenResponse(ctx, req, results[i].ShortCode, results[i].Status == "reused")
+		results[i].ShortURL, results[i].ActiveFrom, results[i].ExpiresAt, results[i].Verified = r.ShortURL, r.ActiveFrom, r.ExpiresAt, r.Verified
+		results[i].Timezone, results[i].ActiveFromLocal, results[i].ExpiresAtLocal = r.Timezone, r.ActiveFromLocal, r.ExpiresAtLocal
+		results[i].RedirectType, results[i].Settings = r.RedirectType, r.Settings
+		if !r.Reused {
+			created++
+			recordLinkCreated(req.owner)
+			s.publishLifecycleEvent(context.WithoutCancel(ctx), eventURLCreated, results[i].ShortCode)
+			if req.WebhookURL != "" {
+				results[i].WebhookSecret = s.issueLinkWebhookSecret(ctx, req.owner)
+			}
+		}
+	}
+	log.Printf("Created %d short URLs in batch", created)
+	return nil
+}
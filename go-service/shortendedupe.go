@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"expvar"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Identical shorten requests in flight together, such as a client's retry
+// storm without an Idempotency-Key, are stored once. While a request that
+// reusesExisting is being stored, the same owner's requests for an
+// equivalent long_url on the same base URL wait for it and get its
+// response, instead of each checking for the link and racing to insert it.
+// Requests that can't reuse a link, reuse_existing false among them, are
+// never collapsed. A waiting request whose leader failed stores its link
+// itself, as it would have without the guard, and only the request that
+// made an ownerless link gets its claim token. The guard spans this
+// instance; across instances the store's reuse check still holds.
+var (
+	shortenFlights     singleflight.Group
+	shortenDedupeStats = expvar.NewMap("shorten_dedupe")
+)
+
+// shortenFlightKey is what identical requests share.
+func shortenFlightKey(req ShortenRequest) string {
+	return req.canonicalHash() + "\x00" + req.owner + "\x00" + req.baseURL
+}
+
+// storeShortURLOnce is storeShortURLNow, shared with identical requests in
+// flight.
+func (s *Server) storeShortURLOnce(ctx context.Context, req ShortenRequest) (ShortenResponse, error) {
+	// fn runs on the leader's goroutine, so only the leader sees led set.
+	led := false
+	v, err, _ := shortenFlights.Do(shortenFlightKey(req), func() (any, error) {
+		led = true
+		return s.storeShortURLNow(ctx, req)
+	})
+	if led {
+		return v.(ShortenResponse), err
+	}
+	if err != nil {
+		// The leader's error may be its own, such as its caller going
+		// away.
+		shortenDedupeStats.Add("fallbacks", 1)
+		return s.storeShortURLNow(ctx, req)
+	}
+	shortenDedupeStats.Add("collapsed", 1)
+	response := v.(ShortenResponse)
+	response.ClaimToken, response.ClaimTokenExpiresAt = "", ""
+	return response, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedStore holds every Create until release is closed, after telling
+// entered, and fails the first one when failFirst is set.
+type gatedStore struct {
+	*fakeStore
+	entered   chan struct{}
+	release   chan struct{}
+	creates   atomic.Int32
+	failFirst bool
+}
+
+func (g *gatedStore) Create(ctx context.Context, req ShortenRequest, code string) (createdLink, error) {
+	n := g.creates.Add(1)
+	g.entered <- struct{}{}
+	<-g.release
+	if g.failFirst && n == 1 {
+		return createdLink{}, errors.New("leader failed")
+	}
+	return g.fakeStore.Create(ctx, req, code)
+}
+
+// shortenConcurrently stores n copies of req at once, the first held in
+// the store until the others are waiting too.
+func shortenConcurrently(t *testing.T, s *Server, g *gatedStore, req ShortenRequest, n int) []ShortenResponse {
+	t.Helper()
+	responses := make([]ShortenResponse, n)
+	var wg sync.WaitGroup
+	store := func(i int) {
+		defer wg.Done()
+		resp, err := s.storeShortURL(context.Background(), req)
+		if err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+		responses[i] = resp
+	}
+	wg.Add(n)
+	go store(0)
+	<-g.entered
+	for i := 1; i < n; i++ {
+		go store(i)
+	}
+	// Gives the others time to join the first one's flight.
+	time.Sleep(50 * time.Millisecond)
+	close(g.release)
+	wg.Wait()
+	return responses
+}
+
+func newGatedServer(t *testing.T) (*Server, *gatedStore) {
+	s, store, _ := newFakeServer(t)
+	g := &gatedStore{fakeStore: store, entered: make(chan struct{}, 100), release: make(chan struct{})}
+	s.store = g
+	return s, g
+}
+
+func TestConcurrentShortensCollapse(t *testing.T) {
+	s, g := newGatedServer(t)
+	collapsed := func() int64 {
+		v, _ := shortenDedupeStats.Get("collapsed").(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	before := collapsed()
+	req := ShortenRequest{LongURL: "https://example.com/storm", owner: "storm-" + newRandomID()[:8]}
+	responses := shortenConcurrently(t, s, g, req, 20)
+	if n := g.creates.Load(); n != 1 {
+		t.Errorf("%d inserts for 20 identical requests, want 1", n)
+	}
+	for i, resp := range responses {
+		if resp != responses[0] {
+			t.Errorf("response %d = %+v, want %+v", i, resp, responses[0])
+		}
+	}
+	if got := collapsed() - before; got != 19 {
+		t.Errorf("%d requests counted as collapsed, want 19", got)
+	}
+}
+
+func TestShortensWithoutReuseAreNotCollapsed(t *testing.T) {
+	s, g := newGatedServer(t)
+	reuse := false
+	req := ShortenRequest{LongURL: "https://example.com/storm", owner: "storm-" + newRandomID()[:8], ReuseExisting: &reuse}
+	shortenConcurrently(t, s, g, req, 5)
+	if n := g.creates.Load(); n != 5 {
+		t.Errorf("%d inserts for 5 requests with reuse_existing false, want 5", n)
+	}
+}
+
+func TestCollapsedShortenFallsBackWhenLeaderFails(t *testing.T) {
+	s, g := newGatedServer(t)
+	g.failFirst = true
+	req := ShortenRequest{LongURL: "https://example.com/storm", owner: "storm-" + newRandomID()[:8]}
+	responses := make([]ShortenResponse, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		responses[0], errs[0] = s.storeShortURL(context.Background(), req)
+	}()
+	<-g.entered
+	go func() {
+		defer wg.Done()
+		responses[1], errs[1] = s.storeShortURL(context.Background(), req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(g.release)
+	wg.Wait()
+	if errs[0] == nil {
+		t.Error("the leader's failure was lost")
+	}
+	if errs[1] != nil || responses[1].ShortCode == "" {
+		t.Errorf("follower of a failed leader = %+v, %v; want its own link", responses[1], errs[1])
+	}
+}
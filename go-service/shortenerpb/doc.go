@@ -0,0 +1,8 @@
+// Package shortenerpb is the generated Go client and server code for the
+// Shortener gRPC service in shortener.proto.
+//
+//	conn, err := grpc.NewClient("shortener:9000", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	c := shortenerpb.NewShortenerClient(conn)
+//	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+apiKey)
+//	link, err := c.Shorten(ctx, &shortenerpb.ShortenRequest{LongUrl: "https://example.com/"})
+package shortenerpb
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestShutdownDrainsClickEvents serves a redirect whose click is still being
+// published, and a slow request, when SIGTERM arrives: both finish, and the
+// stores close only after the click went out.
+func TestShutdownDrainsClickEvents(t *testing.T) {
+	saved := app
+	app = &App{}
+	t.Cleanup(func() { app = saved })
+	s, _, events := newFakeServer(t)
+
+	var mu sync.Mutex
+	var delivered []string
+	closedAfter := -1
+	// Stands in for the database hook start registers first; the store is
+	// testServer's, which the other tests still need.
+	app.OnShutdown("database", time.Second, func(context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		closedAfter = len(delivered)
+		return nil
+	})
+	// The click outlasts the slow request, so only the drain waits for it.
+	app.RegisterPublisher("slow", func(ctx context.Context, event ClickEvent) error {
+		time.Sleep(800 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, event.ShortCode)
+		return nil
+	})
+	s.startClickPublishers(2)
+	app.start()
+
+	r := s.newRouter()
+	started := make(chan struct{})
+	r.GET("/test/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		c.String(http.StatusOK, "finished")
+	})
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/drain","custom_alias":"drain-on-exit"}`, "Authorization: Bearer "+testAdminToken); w.Code != http.StatusOK {
+		t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + ln.Addr().String()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		serveOn(ln, r)
+	}()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	// serveOn traps the signals before it accepts, so once this is answered
+	// SIGTERM no longer kills the test binary.
+	resp, err := client.Get(base + "/drain-on-exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != defaultRedirectStatus {
+		t.Fatalf("redirect = %d, want %d", resp.StatusCode, defaultRedirectStatus)
+	}
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := client.Get(base + "/test/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-started
+
+	self, _ := os.FindProcess(os.Getpid())
+	if err := self.Signal(syscall.SIGTERM); err != nil {
+		t.Skipf("can't signal the test process: %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("serveOn didn't return after SIGTERM")
+	}
+
+	if got := <-slow; got != "finished" {
+		t.Errorf("in-flight request got %q, want it to finish", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 1 || delivered[0] != "drain-on-exit" || closedAfter != 1 {
+		t.Errorf("delivered %v, %d of them before the stores closed; want the click, before", delivered, closedAfter)
+	}
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	if len(events.clicks) != 1 {
+		t.Errorf("%d clicks published, want 1", len(events.clicks))
+	}
+	if _, err := client.Get(base + "/drain-on-exit"); err == nil {
+		t.Error("a request after shutdown was served")
+	}
+}
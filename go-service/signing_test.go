@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// The vectors were computed apart from this code; the first is the one in
+// the README.
+const vectorBody = `{"short_code":"abc123","clicked_at":"2023-11-14T22:13:20Z"}`
+
+var vectorTime = time.Unix(1700000000, 0)
+
+func TestSignPayloadVectors(t *testing.T) {
+	tests := []struct {
+		secret string
+		ts     time.Time
+		body   string
+		want   string
+	}{
+		{"whsec_test_secret", vectorTime, vectorBody, "t=1700000000,v1=73caf8a0ee4b879b9a3327e011dda2fc58954b6cef847a18fe68cb4aba31e2a1"},
+		{"whsec_rotated_secret", vectorTime, vectorBody, "t=1700000000,v1=bcc0d6b0cc5a83ad4aeeb73fc4857f98dcd2052d0a25e45bdf325643083c1cbd"},
+		{"whsec_test_secret", vectorTime.Add(5 * time.Minute), "", "t=1700000300,v1=49ca03186ee559fe15b047c0f4d566e99c97958c2a580fbcf64c932a7c90de5d"},
+	}
+	for _, tt := range tests {
+		if got := SignPayload(tt.secret, tt.ts, []byte(tt.body)); got != tt.want {
+			t.Errorf("SignPayload(%q, %d, %q) = %q, want %q", tt.secret, tt.ts.Unix(), tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	const (
+		signed  = "t=1700000000,v1=73caf8a0ee4b879b9a3327e011dda2fc58954b6cef847a18fe68cb4aba31e2a1"
+		rotated = "t=1700000000,v1=bcc0d6b0cc5a83ad4aeeb73fc4857f98dcd2052d0a25e45bdf325643083c1cbd"
+	)
+	current := []string{"whsec_test_secret"}
+	tests := []struct {
+		name    string
+		header  string
+		body    string
+		secrets []string
+		now     time.Time
+		want    error
+	}{
+		{"valid", signed, vectorBody, current, vectorTime, nil},
+		{"at the edge of the tolerance", signed, vectorBody, current, vectorTime.Add(5 * time.Minute), nil},
+		{"clock behind the sender", signed, vectorBody, current, vectorTime.Add(-5 * time.Minute), nil},
+		{"stale", signed, vectorBody, current, vectorTime.Add(5*time.Minute + time.Second), ErrSignatureExpired},
+		{"from the future", signed, vectorBody, current, vectorTime.Add(-5*time.Minute - time.Second), ErrSignatureExpired},
+		{"body changed", signed, `{"short_code":"abc124","clicked_at":"2023-11-14T22:13:20Z"}`, current, vectorTime, ErrSignatureMismatch},
+		{"bad signature", "t=1700000000,v1=" + "00" + signed[18:], vectorBody, current, vectorTime, ErrSignatureMismatch},
+		{"timestamp changed", "t=1700000001" + signed[12:], vectorBody, current, vectorTime, ErrSignatureMismatch},
+		{"wrong secret", signed, vectorBody, []string{"whsec_other"}, vectorTime, ErrSignatureMismatch},
+		{"no secret configured", signed, vectorBody, []string{"", ""}, vectorTime, ErrSignatureMismatch},
+		{"missing", "", vectorBody, current, vectorTime, ErrSignatureMissing},
+		{"no v1", "t=1700000000", vectorBody, current, vectorTime, ErrSignatureMalformed},
+		{"no t", "v1=73caf8a0", vectorBody, current, vectorTime, ErrSignatureMalformed},
+		{"bad timestamp", "t=yesterday,v1=73caf8a0", vectorBody, current, vectorTime, ErrSignatureMalformed},
+		{"not key=value", "t=1700000000,v1", vectorBody, current, vectorTime, ErrSignatureMalformed},
+
+		// Rotation: the receiver holds the new secret and the previous one,
+		// the sender signs with either.
+		{"rotated, signed with the new secret", rotated, vectorBody, []string{"whsec_rotated_secret", "whsec_test_secret"}, vectorTime, nil},
+		{"rotated, signed with the previous secret", signed, vectorBody, []string{"whsec_rotated_secret", "whsec_test_secret"}, vectorTime, nil},
+		{"rotation over, previous secret dropped", signed, vectorBody, []string{"whsec_rotated_secret", ""}, vectorTime, ErrSignatureMismatch},
+		{"sender rotated first", "t=1700000000,v1=bcc0d6b0cc5a83ad4aeeb73fc4857f98dcd2052d0a25e45bdf325643083c1cbd,v1=73caf8a0ee4b879b9a3327e011dda2fc58954b6cef847a18fe68cb4aba31e2a1", vectorBody, current, vectorTime, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifySignature(tt.header, []byte(tt.body), tt.secrets, 5*time.Minute, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("VerifySignature = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceRequestRotation(t *testing.T) {
+	savedSecret, savedPrevious := serviceSigningSecret, serviceSigningSecretPrevious
+	t.Cleanup(func() { serviceSigningSecret, serviceSigningSecretPrevious = savedSecret, savedPrevious })
+	body := []byte(vectorBody)
+
+	serviceSigningSecret, serviceSigningSecretPrevious = "whsec_test_secret", ""
+	before := signServiceRequest(body)
+	if err := verifyServiceRequest(before, body); err != nil {
+		t.Fatalf("own signature: %v", err)
+	}
+	serviceSigningSecret, serviceSigningSecretPrevious = "whsec_rotated_secret", "whsec_test_secret"
+	if err := verifyServiceRequest(before, body); err != nil {
+		t.Errorf("signature from before the rotation: %v", err)
+	}
+	if err := verifyServiceRequest(signServiceRequest(body), body); err != nil {
+		t.Errorf("signature with the new secret: %v", err)
+	}
+	serviceSigningSecretPrevious = ""
+	if err := verifyServiceRequest(before, body); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("old signature once the previous secret is dropped = %v, want a mismatch", err)
+	}
+
+	serviceSigningSecret = ""
+	if got := signServiceRequest(body); got != "" {
+		t.Errorf("unsigned without a secret, got %q", got)
+	}
+}
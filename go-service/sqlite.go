@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// The database runs in WAL mode, so reads go on in parallel with the one
+// writer SQLite allows, and a write waits up to DB_BUSY_TIMEOUT_MS for the
+// lock inside SQLite before reporting busy; execWithRetry handles what is
+// left. DB_MAX_OPEN_CONNS bounds the pool; idle connections are kept, since
+// each holds its own copy of the prepared statements.
+var (
+	dbBusyTimeoutMS = getEnvInt("DB_BUSY_TIMEOUT_MS", 5000)
+	dbMaxOpenConns  = getEnvInt("DB_MAX_OPEN_CONNS", max(4, runtime.NumCPU()))
+)
+
+// sqliteDSN adds the connection settings to path, leaving any the path
+// already sets.
+func sqliteDSN(path string) string {
+	params := []struct{ key, value string }{
+		{"_journal_mode", "WAL"},
+		{"_busy_timeout", strconv.Itoa(dbBusyTimeoutMS)},
+		{"_foreign_keys", "on"},
+	}
+	for _, p := range params {
+		if strings.Contains(path, p.key+"=") {
+			continue
+		}
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + p.key + "=" + p.value
+	}
+	return path
+}
+
+// configureDBPool sizes the connection pool, for SQLite and Postgres alike.
+func configureDBPool(db *sql.DB) {
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxOpenConns)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLiteDSN(t *testing.T) {
+	defaults := "_journal_mode=WAL&_busy_timeout=" + strconv.Itoa(dbBusyTimeoutMS) + "&_foreign_keys=on"
+	tests := []struct{ in, want string }{
+		{"urls.db", "urls.db?" + defaults},
+		{"file:urls.db?cache=shared", "file:urls.db?cache=shared&" + defaults},
+		{"urls.db?_busy_timeout=0", "urls.db?_busy_timeout=0&_journal_mode=WAL&_foreign_keys=on"},
+		{"urls.db?_journal_mode=DELETE&_foreign_keys=off", "urls.db?_journal_mode=DELETE&_foreign_keys=off&_busy_timeout=" + strconv.Itoa(dbBusyTimeoutMS)},
+	}
+	for _, tt := range tests {
+		if got := sqliteDSN(tt.in); got != tt.want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSQLiteConnectionSettings(t *testing.T) {
+	if os.Getenv("TEST_DATABASE_URL") != "" {
+		t.Skip("runs against SQLite")
+	}
+	// Every connection in the pool has them, not just the first.
+	conns := make([]interface{ Close() error }, 0, 3)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for range 3 {
+		conn, err := testServer.db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		var mode string
+		var busyTimeout, foreignKeys int
+		conn.QueryRowContext(context.Background(), "PRAGMA journal_mode").Scan(&mode)
+		conn.QueryRowContext(context.Background(), "PRAGMA busy_timeout").Scan(&busyTimeout)
+		conn.QueryRowContext(context.Background(), "PRAGMA foreign_keys").Scan(&foreignKeys)
+		if mode != "wal" || busyTimeout != dbBusyTimeoutMS || foreignKeys != 1 {
+			t.Errorf("journal_mode %q, busy_timeout %d, foreign_keys %d", mode, busyTimeout, foreignKeys)
+		}
+	}
+	if max := testServer.db.Stats().MaxOpenConnections; max != dbMaxOpenConns {
+		t.Errorf("pool allows %d connections, want %d", max, dbMaxOpenConns)
+	}
+}
+
+// TestSQLiteUnderConcurrentLoad runs 200 redirects at once, every one read
+// from the database and each click counted into it, while links are
+// shortened: nothing may come back locked.
+func TestSQLiteUnderConcurrentLoad(t *testing.T) {
+	if os.Getenv("TEST_DATABASE_URL") != "" {
+		t.Skip("runs against SQLite")
+	}
+	saved := app
+	app = &App{}
+	t.Cleanup(func() { app = saved })
+	s, err := NewServer(Config{DatabaseURL: filepath.Join(t.TempDir(), "load.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.startClickPublishers(4)
+	withLocalCache(t, 0)
+	withRedirectBudget(t, 10*time.Second, time.Second)
+	r := s.newRouter()
+	admin := "Authorization: Bearer " + testAdminToken
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/load","custom_alias":"sqlite-load"}`, admin); w.Code != http.StatusOK {
+		t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+	}
+	exhausted := busyCount("exhausted")
+
+	const redirects, shortens = 200, 50
+	t.Run("load", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range redirects {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if w := serveTest(r, http.MethodGet, "/sqlite-load", ""); w.Code != defaultRedirectStatus {
+					t.Errorf("redirect = %d: %s", w.Code, w.Body)
+				}
+			}()
+		}
+		for i := range shortens {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				body := `{"long_url":"https://example.com/load/` + strconv.Itoa(i) + `"}`
+				if w := serveTest(r, http.MethodPost, "/api/shorten", body, admin); w.Code != http.StatusOK {
+					t.Errorf("shorten = %d: %s", w.Code, w.Body)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+	s.clickJobs.Wait()
+
+	var clicks, links int
+	s.db.QueryRow("SELECT clicks FROM click_counters WHERE short_code = 'sqlite-load'").Scan(&clicks)
+	s.db.QueryRow("SELECT COUNT(*) FROM urls").Scan(&links)
+	if clicks != redirects || links != shortens+1 {
+		t.Errorf("%d clicks and %d links stored, want %d and %d", clicks, links, redirects, shortens+1)
+	}
+	if busyCount("exhausted") != exhausted {
+		t.Errorf("%d writes gave up on a locked database", busyCount("exhausted")-exhausted)
+	}
+}
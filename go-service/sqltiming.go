@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// timedSQLiteDriver is registered as "sqlite3_timed". It wraps the regular
+// sqlite3 driver so every query and exec is checked against the slow DB
+// threshold (and chaos store faults) without touching call sites.
+const timedSQLiteDriverName = "sqlite3_timed"
+
+func init() {
+	sql.Register(timedSQLiteDriverName, &timedDriver{base: &sqlite3.SQLiteDriver{}})
+}
+
+type timedDriver struct {
+	base driver.Driver
+}
+
+func (d *timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: conn}, nil
+}
+
+type timedConn struct {
+	driver.Conn
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := chaosInject(ctx, chaosTargetStore); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	logIfSlow(&slowDBThreshold, "db", query, time.Since(start))
+	return res, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := chaosInject(ctx, chaosTargetStore); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	logIfSlow(&slowDBThreshold, "db", query, time.Since(start))
+	return rows, err
+}
+
+// timedStmt times prepared statements the way timedConn times plain
+// queries.
+type timedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		return nil, errors.New("statement does not support ExecContext")
+	}
+	if err := chaosInject(ctx, chaosTargetStore); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	res, err := e.ExecContext(ctx, args)
+	logIfSlow(&slowDBThreshold, "db", s.query, time.Since(start))
+	return res, err
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		return nil, errors.New("statement does not support QueryContext")
+	}
+	if err := chaosInject(ctx, chaosTargetStore); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, args)
+	logIfSlow(&slowDBThreshold, "db", s.query, time.Since(start))
+	return rows, err
+}
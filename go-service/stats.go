@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getStats serves GET /api/stats/:code with clicks and conversions. clicks
+// counts stored click rows; total_clicks is the authoritative counter of
+// clickcount.go, including clicks not flushed from Redis yet. When any
+// of from/to/granularity/tz is given, a "range" block with in-range totals
+// and per-bucket timeseries is added. Share links only see the parts their
+// scopes cover; without one, a link with an owner is only shown to that
+// owner and admins. meta says which sources the numbers came from; see
+// statsmeta.go.
+func (s *Server) getStats(c *gin.Context) {
+	shortCode := c.Param("code")
+	summary := statsScopeAllowed(c, statsScopeSummary)
+	if !summary && !hasStatsRangeParams(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Share link only covers timeseries; pass from, to or granularity"})
+		return
+	}
+
+	link, err := s.store.Stats(c.Request.Context(), shortCode)
+	// Scheduled links stay out of public stats until they are live.
+	if err == nil && (!linkActive(link.ActiveFrom, time.Now()) || !s.statsReadable(c, link.Owner)) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	meta := newStatsMeta()
+	if freshAsOf, err := s.rawClicksFreshness(ctx); err != nil {
+		meta.unavailable(statsSourceRawClicks, "database error reading clicks")
+	} else {
+		meta.ok(statsSourceRawClicks, freshAsOf)
+	}
+
+	response := gin.H{"short_code": shortCode}
+	if summary {
+		response["created_at"] = link.CreatedAt
+		response["status"] = effectiveLinkStatus(link.Status, link.ExpiresAt, now)
+		response["challenged"] = link.Challenged
+		s.summaryStats(ctx, shortCode, link.ImportedClicks, meta, now, response)
+	}
+
+	if hasStatsRangeParams(c) {
+		if !statsScopeAllowed(c, statsScopeTimeseries) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Share link does not cover timeseries"})
+			return
+		}
+		r, err := parseStatsRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		response["range"] = nil
+		if meta.usable(statsSourceRawClicks) {
+			rangeStats, err := s.statsInRange(ctx, shortCode, r)
+			if err != nil {
+				meta.unavailable(statsSourceRawClicks, "database error reading clicks")
+			} else {
+				response["range"] = rangeStats
+			}
+		}
+	}
+
+	response["meta"] = meta.json()
+	if !meta.available() {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, response)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// summaryStats fills in the summary fields from each source it can read,
+// leaving null the ones whose source failed.
+func (s *Server) summaryStats(ctx context.Context, shortCode string, importedClicks int64, meta *statsMeta, now time.Time, response gin.H) {
+	for _, key := range []string{"clicks", "conversions", "conversion_rate", "attributed_conversions",
+		"unattributed_conversions", "median_time_to_convert_seconds", "total_clicks", "last_clicked_at"} {
+		response[key] = nil
+	}
+
+	if meta.usable(statsSourceRawClicks) {
+		var clicks, conversions int64
+		err := s.reader(ctx).QueryRowContext(ctx, `SELECT
+			(SELECT COUNT(*) FROM clicks WHERE short_code = ?),
+			(SELECT COUNT(*) FROM conversions WHERE short_code = ?)`, shortCode, shortCode).
+			Scan(&clicks, &conversions)
+		if err == nil {
+			err = s.attributionStats(ctx, shortCode, conversions, response)
+		}
+		if err != nil {
+			meta.unavailable(statsSourceRawClicks, "database error reading clicks")
+		} else {
+			clicks += importedClicks
+			response["clicks"] = clicks
+			response["conversions"] = conversions
+			response["conversion_rate"] = conversionRate(conversions, clicks)
+		}
+	}
+
+	stored, lastClickedAt, err := s.storedClickTotals(ctx, shortCode)
+	if err != nil {
+		meta.unavailable(statsSourceRollups, "database error reading click counters")
+		return
+	}
+	direct := true
+	if s.clickCountersBuffered() {
+		pending, lastPending, err := s.pendingClickTotals(ctx, shortCode)
+		if err != nil {
+			meta.unavailable(statsSourceRedisLive, "Redis unavailable; total_clicks leaves out clicks not flushed yet")
+		} else {
+			direct = false
+			meta.ok(statsSourceRedisLive, now.UTC().Format(time.RFC3339))
+			stored += pending
+			lastClickedAt = max(lastClickedAt, lastPending)
+		}
+	}
+	meta.rollupsMeta(now, direct)
+	response["total_clicks"] = stored + importedClicks
+	response["last_clicked_at"] = nullIfEmpty(lastClickedAt)
+}
+
+func conversionRate(conversions, clicks int64) float64 {
+	if clicks == 0 {
+		return 0
+	}
+	return float64(conversions) / float64(clicks)
+}
+
+func hasStatsRangeParams(c *gin.Context) bool {
+	for _, key := range []string{"from", "to", "granularity", "tz"} {
+		if c.Query(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// statsInRange counts clicks and conversions for a code within r, bucketed
+// by r's granularity.
+func (s *Server) statsInRange(ctx context.Context, shortCode string, r statsRange) (gin.H, error) {
+	clickTimes, err := s.eventTimesInRange(ctx, `SELECT clicked_at FROM clicks
+		WHERE short_code = ? AND datetime(clicked_at) >= datetime(?) AND datetime(clicked_at) < datetime(?)`, shortCode, r)
+	if err != nil {
+		return nil, err
+	}
+	conversionTimes, err := s.eventTimesInRange(ctx, `SELECT converted_at FROM conversions
+		WHERE short_code = ? AND datetime(converted_at) >= datetime(?) AND datetime(converted_at) < datetime(?)`, shortCode, r)
+	if err != nil {
+		return nil, err
+	}
+
+	clicks, conversions := int64(len(clickTimes)), int64(len(conversionTimes))
+	return gin.H{
+		"meta":                   r.meta(),
+		"clicks":                 clicks,
+		"conversions":            conversions,
+		"conversion_rate":        conversionRate(conversions, clicks),
+		"clicks_timeseries":      r.bucketize(clickTimes),
+		"conversions_timeseries": r.bucketize(conversionTimes),
+	}, nil
+}
+
+func (s *Server) eventTimesInRange(ctx context.Context, query, shortCode string, r statsRange) ([]time.Time, error) {
+	rows, err := s.reader(ctx).QueryContext(ctx, query, shortCode, r.From.UTC().Format(time.RFC3339), r.To.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []time.Time
+	for rows.Next() {
+		var ts string
+		if err := rows.Scan(&ts); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339, ts); err == nil {
+			times = append(times, t)
+		}
+	}
+	return times, rows.Err()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withTableUnavailable renames table away for the rest of the test, so
+// every query on it fails.
+func withTableUnavailable(tb testing.TB, table string) {
+	tb.Helper()
+	testServer.clickJobs.Wait()
+	if _, err := testServer.db.Exec("ALTER TABLE " + table + " RENAME TO " + table + "_unavailable"); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if _, err := testServer.db.Exec("ALTER TABLE " + table + "_unavailable RENAME TO " + table); err != nil {
+			tb.Fatal(err)
+		}
+	})
+}
+
+// withClickCountersFlushedAt sets when the click counters were last flushed
+// for the rest of the test.
+func withClickCountersFlushedAt(tb testing.TB, at time.Time) {
+	saved := clickCountersFlushedAt.Load()
+	clickCountersFlushedAt.Store(at.Unix())
+	tb.Cleanup(func() { clickCountersFlushedAt.Store(saved) })
+}
+
+type statsSource struct {
+	Status    string
+	FreshAsOf *string `json:"fresh_as_of"`
+	Reason    *string
+}
+
+type statsResponse struct {
+	Clicks      *int64
+	Conversions *int64
+	TotalClicks *int64 `json:"total_clicks"`
+	Range       map[string]any
+	Meta        struct {
+		Partial bool
+		Sources map[string]statsSource
+	}
+}
+
+func TestStatsReportEachSourceUnavailable(t *testing.T) {
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/stats-sources"}, "")
+	if _, err := testServer.db.Exec("INSERT INTO clicks (short_code, clicked_at) VALUES (?, datetime())", link.ShortCode); err != nil {
+		t.Fatal(err)
+	}
+	target := "/api/stats/" + link.ShortCode + "?from=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T)
+		// want is each source's status; a source left out isn't reported.
+		want       map[string]string
+		partial    bool
+		status     int
+		rawNull    bool
+		totalsNull bool
+	}{
+		{
+			name:  "all sources",
+			setup: func(t *testing.T) { useRedis(t); withClickCountersFlushedAt(t, time.Now()) },
+			want:  map[string]string{statsSourceRawClicks: statsSourceOK, statsSourceRollups: statsSourceOK, statsSourceRedisLive: statsSourceOK},
+		},
+		{
+			name:  "no Redis configured",
+			setup: func(t *testing.T) {},
+			want:  map[string]string{statsSourceRawClicks: statsSourceOK, statsSourceRollups: statsSourceOK},
+		},
+		{
+			name:    "Redis down",
+			setup:   func(t *testing.T) { useRedis(t).Close() },
+			want:    map[string]string{statsSourceRawClicks: statsSourceOK, statsSourceRollups: statsSourceOK, statsSourceRedisLive: statsSourceUnavailable},
+			partial: true,
+		},
+		{
+			name: "rollups behind",
+			setup: func(t *testing.T) {
+				useRedis(t)
+				withClickCountersFlushedAt(t, time.Now().Add(-4*clickCounterFlushInterval))
+			},
+			want:    map[string]string{statsSourceRawClicks: statsSourceOK, statsSourceRollups: statsSourceDelayed, statsSourceRedisLive: statsSourceOK},
+			partial: true,
+		},
+		{
+			name:       "rollups unavailable",
+			setup:      func(t *testing.T) { withTableUnavailable(t, "click_counters") },
+			want:       map[string]string{statsSourceRawClicks: statsSourceOK, statsSourceRollups: statsSourceUnavailable},
+			partial:    true,
+			totalsNull: true,
+		},
+		{
+			name:    "raw clicks unavailable",
+			setup:   func(t *testing.T) { withTableUnavailable(t, "clicks") },
+			want:    map[string]string{statsSourceRawClicks: statsSourceUnavailable, statsSourceRollups: statsSourceOK},
+			partial: true,
+			rawNull: true,
+		},
+		{
+			name: "nothing readable",
+			setup: func(t *testing.T) {
+				withTableUnavailable(t, "clicks")
+				withTableUnavailable(t, "click_counters")
+			},
+			want:       map[string]string{statsSourceRawClicks: statsSourceUnavailable, statsSourceRollups: statsSourceUnavailable},
+			partial:    true,
+			status:     http.StatusServiceUnavailable,
+			rawNull:    true,
+			totalsNull: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(t)
+			if tt.status == 0 {
+				tt.status = http.StatusOK
+			}
+			w := serveTest(testServer.newRouter(), http.MethodGet, target, "", "Authorization: Bearer "+testAdminToken)
+			var got statsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != tt.status {
+				t.Fatalf("stats = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Error("a 503 without Retry-After")
+			}
+			if got.Meta.Partial != tt.partial || len(got.Meta.Sources) != len(tt.want) {
+				t.Errorf("meta = %s", w.Body)
+			}
+			for source, status := range tt.want {
+				s, ok := got.Meta.Sources[source]
+				if !ok || s.Status != status {
+					t.Errorf("%s = %+v, want %s", source, s, status)
+					continue
+				}
+				// An unavailable source says why; a delayed one also says as of when.
+				if (status != statsSourceOK) != (s.Reason != nil) || (status == statsSourceUnavailable) != (s.FreshAsOf == nil) {
+					t.Errorf("%s is %s with reason %v and fresh_as_of %v", source, status, s.Reason, s.FreshAsOf)
+				}
+			}
+			if rawNull := got.Clicks == nil && got.Conversions == nil && got.Range == nil; rawNull != tt.rawNull {
+				t.Errorf("clicks %v, conversions %v, range %v; want them null: %v", got.Clicks, got.Conversions, got.Range, tt.rawNull)
+			}
+			if !tt.rawNull && *got.Clicks != 1 {
+				t.Errorf("clicks = %d, want 1", *got.Clicks)
+			}
+			if (got.TotalClicks == nil) != tt.totalsNull {
+				t.Errorf("total_clicks = %v, want null: %v", got.TotalClicks, tt.totalsNull)
+			}
+		})
+	}
+}
+
+func TestRealtimeStatsReportRedis(t *testing.T) {
+	mr := useRedis(t)
+	r := testServer.newRouter()
+	realtime := func() statsResponse {
+		t.Helper()
+		w := serveTest(r, http.MethodGet, "/api/stats/realtime", "", "Authorization: Bearer "+testAdminToken)
+		var got statsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("realtime = %d: %s", w.Code, w.Body)
+		}
+		return got
+	}
+
+	if got := realtime(); got.Meta.Partial || got.Meta.Sources[statsSourceRedisLive].Status != statsSourceOK {
+		t.Errorf("with Redis up meta = %+v", got.Meta)
+	}
+	mr.Close()
+	if got := realtime(); !got.Meta.Partial || got.Meta.Sources[statsSourceRedisLive].Status != statsSourceUnavailable {
+		t.Errorf("with Redis down meta = %+v", got.Meta)
+	}
+}
+
+func TestRealtimeStatsForOwnerOnly(t *testing.T) {
+	saved := realtimeRateLimit
+	realtimeRateLimit = 100
+	t.Cleanup(func() { realtimeRateLimit = saved })
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	otherID, otherKey := newTestAPIKey(t, false)
+	mine := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/realtime-mine", ReuseExisting: new(bool)}, ownerID)
+	theirs := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/realtime-theirs", ReuseExisting: new(bool)}, otherID)
+	ownerless := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/realtime-ownerless", ReuseExisting: new(bool)}, "")
+
+	admin := "Authorization: Bearer " + testAdminToken
+	for _, tt := range []struct {
+		name, query, auth string
+		want              int
+	}{
+		{"own code", "?code=" + mine.ShortCode, "X-API-Key: " + key, http.StatusOK},
+		{"another owner's code", "?code=" + theirs.ShortCode, "X-API-Key: " + key, http.StatusNotFound},
+		{"ownerless code", "?code=" + ownerless.ShortCode, "X-API-Key: " + otherKey, http.StatusNotFound},
+		{"unknown code", "?code=no-such-code", "X-API-Key: " + key, http.StatusNotFound},
+		{"admin", "?code=" + theirs.ShortCode, admin, http.StatusOK},
+		{"no code", "", "X-API-Key: " + key, http.StatusOK},
+	} {
+		if w := serveTest(r, http.MethodGet, "/api/stats/realtime"+tt.query, "", tt.auth); w.Code != tt.want {
+			t.Errorf("realtime for %s = %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/urls/:code/stats/countries counts a code's clicks from and
+// before to (as parseStatsRange reads them, to the hour) by the visitor's
+// country, from the hourly rollups: most clicks first, then "unknown" for
+// clicks without one. With cities=true it adds the top geoCitiesLimit
+// cities, counted from the stored clicks, so only clicks ingested here
+// (see ingest.go) have one. Cities are left out, with cities_suppressed
+// set, unless PRIVACY_MODE is raw, and aren't available through a share
+// link, which never reaches raw clicks.
+const (
+	geoUnknownCountry = "unknown"
+	geoCitiesLimit    = 100
+)
+
+type countryCount struct {
+	Country string `json:"country"`
+	Clicks  int64  `json:"clicks"`
+}
+
+type cityCount struct {
+	Country string `json:"country"`
+	City    string `json:"city"`
+	Clicks  int64  `json:"clicks"`
+}
+
+// clicksByCountry is shortCode's clicks in [from, to) by country, unknown
+// last, including this instance's unflushed clicks.
+func (s *Server) clicksByCountry(ctx context.Context, shortCode string, from, to time.Time) ([]countryCount, error) {
+	rows, err := s.reader(ctx).QueryContext(ctx, "SELECT country, SUM(clicks) FROM clicks_hourly WHERE short_code = ? AND hour >= ? AND hour < ? GROUP BY country",
+		shortCode, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int64{}
+	for rows.Next() {
+		var country string
+		var n int64
+		if err := rows.Scan(&country, &n); err != nil {
+			return nil, err
+		}
+		counts[country] += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	clickRollups.pendingCountries(shortCode, from, to, counts)
+
+	countries := []countryCount{}
+	for country, n := range counts {
+		if country != "" {
+			countries = append(countries, countryCount{country, n})
+		}
+	}
+	slices.SortFunc(countries, func(a, b countryCount) int {
+		return cmp.Or(cmp.Compare(b.Clicks, a.Clicks), cmp.Compare(a.Country, b.Country))
+	})
+	return append(countries, countryCount{geoUnknownCountry, counts[""]}), nil
+}
+
+// clicksByCity is shortCode's top cities in r from the stored clicks.
+func (s *Server) clicksByCity(ctx context.Context, shortCode string, r statsRange) ([]cityCount, error) {
+	rows, err := s.reader(ctx).QueryContext(ctx, `SELECT COALESCE(country, ''), city, COUNT(*) FROM clicks
+		WHERE short_code = ? AND datetime(clicked_at) >= datetime(?) AND datetime(clicked_at) < datetime(?) AND city IS NOT NULL AND city != ''
+		GROUP BY country, city ORDER BY COUNT(*) DESC, country, city LIMIT `+strconv.Itoa(geoCitiesLimit),
+		shortCode, r.From.UTC().Format(time.RFC3339), r.To.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cities := []cityCount{}
+	for rows.Next() {
+		var c cityCount
+		if err := rows.Scan(&c.Country, &c.City, &c.Clicks); err != nil {
+			return nil, err
+		}
+		if c.Country == "" {
+			c.Country = geoUnknownCountry
+		}
+		cities = append(cities, c)
+	}
+	return cities, rows.Err()
+}
+
+// getStatsCountries serves GET /api/urls/:code/stats/countries.
+func (s *Server) getStatsCountries(c *gin.Context) {
+	shortCode := c.Param("code")
+	if !statsScopeAllowed(c, statsScopeCountries) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Share link does not cover countries"})
+		return
+	}
+	withCities := c.Query("cities") == "true"
+	if _, shared := c.Get(statsShareContextKey); shared && withCities {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Share links do not cover cities"})
+		return
+	}
+	r, err := parseStatsRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var activeFrom, owner sql.NullString
+	err = s.db.QueryRowContext(ctx, "SELECT active_from, owner FROM urls WHERE short_code = ?", shortCode).Scan(&activeFrom, &owner)
+	// Scheduled links stay out of public stats until they are live.
+	if err == nil && (!linkActive(activeFrom, time.Now()) || !s.statsReadable(c, owner)) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	countries, err := s.clicksByCountry(ctx, shortCode, r.From.UTC().Truncate(time.Hour), r.To.UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	var total int64
+	for _, cc := range countries {
+		total += cc.Clicks
+	}
+	response := gin.H{"short_code": shortCode, "meta": r.meta(), "total": total, "countries": countries}
+	if withCities {
+		if privacyMode != privacyModeRaw {
+			response["cities_suppressed"] = true
+		} else if response["cities"], err = s.clicksByCity(ctx, shortCode, r); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStatsCountries(t *testing.T) {
+	ctx := context.Background()
+	r := testServer.newRouter()
+	ownerID, key := newTestAPIKey(t, false)
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://example.com/geo", ReuseExisting: new(bool)}, ownerID)
+	code := link.ShortCode
+	now := time.Now()
+	for _, e := range []ClickEvent{
+		{ClickID: newRandomID(), Country: "DE", City: "Berlin"},
+		{ClickID: newRandomID(), Country: "DE", City: "Berlin"},
+		{ClickID: newRandomID(), Country: "DE", City: "Hamburg"},
+		{ClickID: newRandomID(), Country: "FR"},
+		{ClickID: newRandomID()},
+	} {
+		e.ShortCode, e.ClickedAt = code, now.Add(-time.Minute).UTC().Format(time.RFC3339)
+		if _, err := testServer.storeClickEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testServer.flushClickRollups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Unflushed clicks count too.
+	clickRollups.add(code, "US", now, 4)
+	t.Cleanup(func() { testServer.flushClickRollups(ctx) })
+
+	var body struct {
+		Total            int64
+		Countries        []countryCount
+		Cities           []cityCount
+		CitiesSuppressed bool `json:"cities_suppressed"`
+	}
+	get := func(query string, headers ...string) int {
+		t.Helper()
+		body.Cities, body.CitiesSuppressed = nil, false
+		w := serveTest(r, http.MethodGet, "/api/urls/"+code+"/stats/countries?"+query, "", headers...)
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code
+	}
+	if code := get("", "X-API-Key: "+key); code != http.StatusOK {
+		t.Fatalf("countries = %d", code)
+	}
+	want := []countryCount{{"US", 4}, {"DE", 3}, {"FR", 1}, {geoUnknownCountry, 1}}
+	if body.Total != 9 || len(body.Countries) != len(want) || body.Cities != nil {
+		t.Fatalf("countries = %+v", body)
+	}
+	for i := range want {
+		if body.Countries[i] != want[i] {
+			t.Errorf("countries[%d] = %+v, want %+v", i, body.Countries[i], want[i])
+		}
+	}
+
+	if code := get("cities=true", "X-API-Key: "+key); code != http.StatusOK || len(body.Cities) != 2 ||
+		body.Cities[0] != (cityCount{"DE", "Berlin", 2}) || body.Cities[1] != (cityCount{"DE", "Hamburg", 1}) {
+		t.Errorf("cities = %d: %+v", code, body.Cities)
+	}
+	saved := privacyMode
+	privacyMode = privacyModeTruncate
+	t.Cleanup(func() { privacyMode = saved })
+	if code := get("cities=true", "X-API-Key: "+key); code != http.StatusOK || body.Cities != nil || !body.CitiesSuppressed || body.Total != 9 {
+		t.Errorf("cities with truncated IPs = %d: %+v", code, body)
+	}
+	if code := get("from="+now.Add(time.Hour).UTC().Format(time.RFC3339)+"&to="+now.Add(2*time.Hour).UTC().Format(time.RFC3339), "X-API-Key: "+key); code != http.StatusOK || body.Total != 0 {
+		t.Errorf("countries in a later range = %d: %+v", code, body)
+	}
+
+	_, otherKey := newTestAPIKey(t, false)
+	if code := get("", "X-API-Key: "+otherKey); code != http.StatusNotFound {
+		t.Errorf("countries for another key = %d, want %d", code, http.StatusNotFound)
+	}
+	savedSecret := statsShareSecret
+	statsShareSecret = "test-share-secret"
+	t.Cleanup(func() { statsShareSecret = savedSecret })
+	share := url.QueryEscape(newStatsShareToken(code, newRandomID(), []string{statsScopeCountries}, now.Add(time.Hour)))
+	if code := get("share=" + share); code != http.StatusOK || body.Total != 9 {
+		t.Errorf("countries through a share link = %d: %+v", code, body)
+	}
+	if code := get("cities=true&share=" + share); code != http.StatusForbidden {
+		t.Errorf("cities through a share link = %d, want %d", code, http.StatusForbidden)
+	}
+	summary := url.QueryEscape(newStatsShareToken(code, newRandomID(), []string{statsScopeSummary}, now.Add(time.Hour)))
+	if code := get("share=" + summary); code != http.StatusForbidden {
+		t.Errorf("countries through a summary share link = %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestIngestGeoValidation(t *testing.T) {
+	for _, e := range []ClickEvent{
+		{ShortCode: "geo", ClickedAt: time.Now().UTC().Format(time.RFC3339), Country: "Germany"},
+		{ShortCode: "geo", ClickedAt: time.Now().UTC().Format(time.RFC3339), Country: "de"},
+		{ShortCode: "geo", ClickedAt: time.Now().UTC().Format(time.RFC3339), City: string(make([]byte, maxGeoCityLen+1))},
+	} {
+		if err := validateClickEvent(&e); err == nil {
+			t.Errorf("%+v was accepted", e)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stats responses carry a meta block naming the sources they were built
+// from and how fresh each is, so clients can show "data delayed" instead
+// of trusting a number that is missing part of the picture:
+//
+//   - redis_live: click counts in Redis not yet flushed to the database
+//   - rollups: click_counters, as the click_counter_flusher last left them
+//   - raw_clicks: the clicks and conversions tables
+//
+// A source that fails is "unavailable" with a reason and the fields built
+// from it are null; one that is behind is "delayed". Either makes the
+// response partial. Only when no source could be read is it a 503.
+const (
+	statsSourceRedisLive = "redis_live"
+	statsSourceRollups   = "rollups"
+	statsSourceRawClicks = "raw_clicks"
+)
+
+// Source statuses in the meta block.
+const (
+	statsSourceOK          = "ok"
+	statsSourceDelayed     = "delayed"
+	statsSourceUnavailable = "unavailable"
+)
+
+// statsRollupsDelayedAfter is how many flush intervals may pass without a
+// flush before rollups are reported as delayed.
+const statsRollupsDelayedAfter = 3
+
+// clickCountersFlushedAt is the unix time of the last flush that reached
+// Redis, 0 before the first.
+var clickCountersFlushedAt atomic.Int64
+
+type statsMeta struct {
+	sources map[string]gin.H
+	partial bool
+}
+
+func newStatsMeta() *statsMeta {
+	return &statsMeta{sources: map[string]gin.H{}}
+}
+
+// add records source's status; freshAsOf is "" when unknown.
+func (m *statsMeta) add(source, status, freshAsOf, reason string) {
+	m.sources[source] = gin.H{"status": status, "fresh_as_of": nullIfEmpty(freshAsOf), "reason": nullIfEmpty(reason)}
+	if status != statsSourceOK {
+		m.partial = true
+	}
+}
+
+func (m *statsMeta) ok(source, freshAsOf string) {
+	m.add(source, statsSourceOK, freshAsOf, "")
+}
+
+func (m *statsMeta) unavailable(source, reason string) {
+	m.add(source, statsSourceUnavailable, "", reason)
+}
+
+// usable reports whether source was read and hasn't failed since.
+func (m *statsMeta) usable(source string) bool {
+	s, ok := m.sources[source]
+	return ok && s["status"] != statsSourceUnavailable
+}
+
+// available reports whether any source could be read.
+func (m *statsMeta) available() bool {
+	for _, s := range m.sources {
+		if s["status"] != statsSourceUnavailable {
+			return true
+		}
+	}
+	return len(m.sources) == 0
+}
+
+func (m *statsMeta) json() gin.H {
+	return gin.H{"partial": m.partial, "sources": m.sources}
+}
+
+// rollupsMeta records the rollups source as read at now: current when
+// counts go straight to the database, as they do without Redis or while it
+// is unreachable, else as of the last flush.
+func (m *statsMeta) rollupsMeta(now time.Time, direct bool) {
+	if direct {
+		m.ok(statsSourceRollups, now.UTC().Format(time.RFC3339))
+		return
+	}
+	flushed := clickCountersFlushedAt.Load()
+	if flushed == 0 {
+		m.add(statsSourceRollups, statsSourceDelayed, "", "no flush from Redis yet")
+		return
+	}
+	at := time.Unix(flushed, 0).UTC()
+	if now.Sub(at) > statsRollupsDelayedAfter*clickCounterFlushInterval {
+		m.add(statsSourceRollups, statsSourceDelayed, at.Format(time.RFC3339), "click counter flush is behind")
+		return
+	}
+	m.ok(statsSourceRollups, at.Format(time.RFC3339))
+}
+
+// rawClicksFreshness is when the newest click row was received, "" if
+// there are none.
+func (s *Server) rawClicksFreshness(ctx context.Context) (string, error) {
+	var receivedAt sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT strftime('%Y-%m-%dT%H:%M:%SZ', received_at) FROM clicks ORDER BY id DESC LIMIT 1").Scan(&receivedAt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return receivedAt.String, err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"time"
+	// Embed the zone database: the alpine image ships without it.
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Supported stats bucket sizes.
+const (
+	granularityHour = "hour"
+	granularityDay  = "day"
+	granularityWeek = "week"
+)
+
+// maxStatsRange bounds query cost per granularity; longer ranges are clamped
+// to end at `to`.
+var maxStatsRange = map[string]time.Duration{
+	granularityHour: 7 * 24 * time.Hour,
+	granularityDay:  366 * 24 * time.Hour,
+	granularityWeek: 3 * 366 * 24 * time.Hour,
+}
+
+// statsRange is the validated from/to/granularity/tz of a stats request.
+type statsRange struct {
+	From        time.Time
+	To          time.Time
+	Granularity string
+	Location    *time.Location
+	Clamped     bool
+}
+
+// parseStatsRange reads from=, to=, granularity= and tz= the same way for
+// every stats endpoint. from/to accept RFC3339 or YYYY-MM-DD (interpreted
+// in tz). The default window is the last 30 days by day.
+func parseStatsRange(c *gin.Context) (statsRange, error) {
+	r := statsRange{Granularity: c.DefaultQuery("granularity", granularityDay), Location: time.UTC}
+
+	if _, ok := maxStatsRange[r.Granularity]; !ok {
+		return r, errors.New("granularity must be one of hour, day, week")
+	}
+	if tz := c.Query("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return r, errors.New("tz must be an IANA time zone name")
+		}
+		r.Location = loc
+	}
+
+	var err error
+	r.To = time.Now()
+	if to := c.Query("to"); to != "" {
+		if r.To, err = parseStatsTime(to, r.Location); err != nil {
+			return r, errors.New("to must be RFC3339 or YYYY-MM-DD")
+		}
+	}
+	r.From = r.To.Add(-30 * 24 * time.Hour)
+	if from := c.Query("from"); from != "" {
+		if r.From, err = parseStatsTime(from, r.Location); err != nil {
+			return r, errors.New("from must be RFC3339 or YYYY-MM-DD")
+		}
+	}
+	if !r.From.Before(r.To) {
+		return r, errors.New("from must be before to")
+	}
+
+	if limit := maxStatsRange[r.Granularity]; r.To.Sub(r.From) > limit {
+		r.From = r.To.Add(-limit)
+		r.Clamped = true
+	}
+	return r, nil
+}
+
+func parseStatsTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, loc)
+}
+
+// bucketStart truncates t to the start of its bucket in r's time zone.
+// Days and weeks follow local midnight, so DST days are 23 or 25 hours long.
+// Weeks start on Monday.
+func (r statsRange) bucketStart(t time.Time) time.Time {
+	t = t.In(r.Location)
+	switch r.Granularity {
+	case granularityHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, r.Location)
+	case granularityWeek:
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, r.Location)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, r.Location)
+	}
+}
+
+// nextBucket returns the start of the bucket after start.
+func (r statsRange) nextBucket(start time.Time) time.Time {
+	switch r.Granularity {
+	case granularityHour:
+		return start.Add(time.Hour)
+	case granularityWeek:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+type statsBucket struct {
+	Bucket string `json:"bucket"`
+	Count  int64  `json:"count"`
+}
+
+// bucketize counts timestamps into every bucket of the range, including
+// empty ones, in chronological order.
+func (r statsRange) bucketize(times []time.Time) []statsBucket {
+	counts := map[time.Time]int64{}
+	for _, t := range times {
+		counts[r.bucketStart(t)]++
+	}
+	return r.series(counts)
+}
+
+// series lists every bucket of the range, including empty ones, in
+// chronological order, with its count in counts, which is keyed by
+// bucketStart.
+func (r statsRange) series(counts map[time.Time]int64) []statsBucket {
+	var buckets []statsBucket
+	for b := r.bucketStart(r.From); b.Before(r.To); b = r.nextBucket(b) {
+		buckets = append(buckets, statsBucket{Bucket: b.Format(time.RFC3339), Count: counts[b]})
+	}
+	return buckets
+}
+
+// meta describes the effective range for responses.
+func (r statsRange) meta() gin.H {
+	return gin.H{
+		"from":        r.From.In(r.Location).Format(time.RFC3339),
+		"to":          r.To.In(r.Location).Format(time.RFC3339),
+		"granularity": r.Granularity,
+		"tz":          r.Location.String(),
+		"clamped":     r.Clamped,
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stats share links give an outside party read-only access to one code's
+// stats until they expire. The token is "<jti>.<expiry unix>.<scopes>.<hex
+// hmac>" with the HMAC over the code, jti, expiry and scopes, so it can't be
+// moved to another code or widened. Revoked jtis are kept in
+// stats_share_revocations until every token they could match has expired.
+var (
+	statsShareSecret         = getEnv("STATS_SHARE_SECRET", "")
+	statsShareSecretPrevious = getEnv("STATS_SHARE_SECRET_PREVIOUS", "")
+	statsShareDefaultTTL     = getEnvDuration("STATS_SHARE_DEFAULT_TTL", 7*24*time.Hour)
+	statsShareMaxTTL         = getEnvDuration("STATS_SHARE_MAX_TTL", 30*24*time.Hour)
+)
+
+// Stats scopes. A share token only ever carries shareableStatsScopes, so
+// anything outside them (raw clicks included) is never reachable through one.
+const (
+	statsScopeSummary    = "summary"
+	statsScopeTimeseries = "timeseries"
+	statsScopeCountries  = "countries"
+)
+
+var shareableStatsScopes = []string{statsScopeSummary, statsScopeTimeseries, statsScopeCountries}
+
+// statsShareContextKey holds the verified share on the gin context.
+const statsShareContextKey = "stats_share"
+
+var errInvalidShare = errors.New("invalid share token")
+
+// statsShare is a verified share token.
+type statsShare struct {
+	JTI       string
+	ShortCode string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+func signStatsShare(secret, shortCode, jti, exp, scopes string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(shortCode + "." + jti + "." + exp + "." + scopes))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newStatsShareToken returns a token for shortCode, signed with the current
+// secret.
+func newStatsShareToken(shortCode, jti string, scopes []string, expiresAt time.Time) string {
+	exp := strconv.FormatInt(expiresAt.Unix(), 10)
+	joined := strings.Join(scopes, ",")
+	return jti + "." + exp + "." + joined + "." + signStatsShare(statsShareSecret, shortCode, jti, exp, joined)
+}
+
+// verifyStatsShare checks a token's signature and expiry for shortCode and
+// that its jti hasn't been revoked. The previous secret is accepted so the
+// secret can be rotated without breaking links already handed out.
+func (s *Server) verifyStatsShare(ctx context.Context, shortCode, token string, now time.Time) (statsShare, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] == "" {
+		return statsShare{}, fmt.Errorf("%w: malformed", errInvalidShare)
+	}
+	jti, exp, scopes, sig := parts[0], parts[1], parts[2], parts[3]
+
+	matched := false
+	for _, secret := range []string{statsShareSecret, statsShareSecretPrevious} {
+		if secret != "" && hmac.Equal([]byte(sig), []byte(signStatsShare(secret, shortCode, jti, exp, scopes))) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return statsShare{}, fmt.Errorf("%w: signature mismatch", errInvalidShare)
+	}
+
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return statsShare{}, fmt.Errorf("%w: malformed", errInvalidShare)
+	}
+	share := statsShare{JTI: jti, ShortCode: shortCode, Scopes: strings.Split(scopes, ","), ExpiresAt: time.Unix(unix, 0)}
+	if !now.Before(share.ExpiresAt) {
+		return statsShare{}, fmt.Errorf("%w: expired", errInvalidShare)
+	}
+
+	var revoked int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM stats_share_revocations WHERE jti = ?", jti).Scan(&revoked); err != nil {
+		return statsShare{}, err
+	}
+	if revoked > 0 {
+		return statsShare{}, fmt.Errorf("%w: revoked", errInvalidShare)
+	}
+	return share, nil
+}
+
+// requireStatsAuth lets a stats request through on a valid ?share= token for
+// the requested code, and otherwise falls back to requireOAuth.
+func (s *Server) requireStatsAuth(c *gin.Context) {
+	token := c.Query("share")
+	if token == "" {
+		s.requireOAuth(c)
+		return
+	}
+
+	share, err := s.verifyStatsShare(c.Request.Context(), c.Param("code"), token, time.Now())
+	if err != nil {
+		if !errors.Is(err, errInvalidShare) {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		log.Printf("Rejected stats share token from %s: %v", clientIP(c), err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired share link"})
+		return
+	}
+	c.Set(statsShareContextKey, share)
+	c.Header("Cache-Control", "no-store")
+	c.Next()
+}
+
+// statsScopeAllowed reports whether the request may see scope. Requests
+// without a share token are limited only by requireOAuth and
+// statsReadable.
+func statsScopeAllowed(c *gin.Context, scope string) bool {
+	v, ok := c.Get(statsShareContextKey)
+	if !ok {
+		return true
+	}
+	return slices.Contains(v.(statsShare).Scopes, scope)
+}
+
+type statsShareRequest struct {
+	// TTL is how long the link stays valid, e.g. "72h"; defaults to
+	// STATS_SHARE_DEFAULT_TTL.
+	TTL string `json:"ttl"`
+	// Scopes defaults to every shareable scope.
+	Scopes []string `json:"scopes"`
+}
+
+// createStatsShare serves POST /api/urls/:code/stats/share.
+func (s *Server) createStatsShare(c *gin.Context) {
+	if statsShareSecret == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Stats sharing requires STATS_SHARE_SECRET"})
+		return
+	}
+	shortCode := c.Param("code")
+	if !s.statsShareLinkOwned(c, shortCode) {
+		return
+	}
+
+	var req statsShareRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ttl := statsShareDefaultTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive duration such as 72h"})
+			return
+		}
+		ttl = d
+	}
+	if ttl > statsShareMaxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl exceeds " + statsShareMaxTTL.String()})
+		return
+	}
+
+	scopes := shareableStatsScopes
+	if len(req.Scopes) > 0 {
+		scopes = nil
+		for _, scope := range req.Scopes {
+			if !slices.Contains(shareableStatsScopes, scope) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "scope " + strconv.Quote(scope) + " cannot be shared; use summary or timeseries"})
+				return
+			}
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	jti := newRandomID()
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	token := newStatsShareToken(shortCode, jti, scopes, expiresAt)
+	c.JSON(http.StatusCreated, gin.H{
+		"short_code": shortCode,
+		"jti":        jti,
+		"scopes":     scopes,
+		"expires_at": expiresAt.UTC().Format(time.RFC3339),
+		"token":      token,
+		"url":        publicBaseURL(c) + "/api/stats/" + url.PathEscape(shortCode) + "?share=" + url.QueryEscape(token),
+	})
+}
+
+// revokeStatsShare serves DELETE /api/urls/:code/stats/share/:jti.
+func (s *Server) revokeStatsShare(c *gin.Context) {
+	shortCode := c.Param("code")
+	if !s.statsShareLinkOwned(c, shortCode) {
+		return
+	}
+
+	// Rows older than the longest TTL can no longer match a live token.
+	now := time.Now().UTC()
+	s.db.ExecContext(c.Request.Context(), "DELETE FROM stats_share_revocations WHERE revoked_at < ?", now.Add(-statsShareMaxTTL).Format(time.RFC3339))
+	_, err := s.db.ExecContext(c.Request.Context(), "INSERT OR IGNORE INTO stats_share_revocations (jti, short_code, revoked_at) VALUES (?, ?, ?)",
+		c.Param("jti"), shortCode, now.Format(time.RFC3339))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// statsReadable reports whether c may read the stats of a link with owner:
+// any caller through a share link, else the owner and admins. Only admins
+// may read a link with no owner.
+func (s *Server) statsReadable(c *gin.Context, owner sql.NullString) bool {
+	if _, shared := c.Get(statsShareContextKey); shared {
+		return true
+	}
+	return owner.Valid && owner.String == c.GetString(ownerContextKey) || s.isAdminCaller(c)
+}
+
+// statsShareLinkOwned writes a 404 unless the link exists and the caller
+// is its owner or, when it has none, an admin.
+func (s *Server) statsShareLinkOwned(c *gin.Context, shortCode string) bool {
+	var owner sql.NullString
+	err := s.db.QueryRowContext(c.Request.Context(), "SELECT owner FROM urls WHERE short_code = ? AND is_test = 0", shortCode).Scan(&owner)
+	if err == nil && (owner.Valid && owner.String != c.GetString(ownerContextKey) || !owner.Valid && !s.isAdminCaller(c)) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	return true
+}
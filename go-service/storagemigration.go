@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storageMigration is the URLStore while links move from DATABASE_URL to
+// another database, STORAGE_MIGRATE_TO, without downtime. Writes go to the
+// store serving reads and are then copied to the other one; a copy that
+// fails is logged and queued for the copier, never failing the request.
+// The copier also backfills the links written before the migration
+// started. Once a reconciliation finds no drift, cutover flips reads (and
+// the copying) to the new store; abort goes back to the old store alone.
+//
+// Only links and their metadata are double-written. Everything recorded
+// around them (clicks, settings, keys) stays in DATABASE_URL.
+type storageMigration struct {
+	source, target *sqlStore
+
+	mu      sync.Mutex
+	cutOver bool
+	aborted bool
+	// pending are the codes whose copy failed, to be copied again.
+	pending map[string]struct{}
+	// cursor is the last source urls id the backfill copied.
+	cursor     int64
+	backfilled bool
+	report     *reconcileReport
+}
+
+var storageMigrationStats = expvar.NewMap("storage_migration")
+
+const (
+	storageCopyInterval  = time.Second
+	storageCopyBatch     = 500
+	storageMirrorTimeout = 2 * time.Second
+	// reconcileSamples is how many drifted codes a report lists.
+	reconcileSamples = 10
+)
+
+var (
+	errStorageMigrationAborted = errors.New("storage migration was aborted")
+	errStorageBackfillRunning  = errors.New("backfill has not finished")
+	errStorageDrift            = errors.New("stores have drifted")
+)
+
+// openStorageMigration opens and migrates the database at
+// cfg.MigrateToURL and puts a storageMigration in front of the store.
+func (s *Server) openStorageMigration() error {
+	source, ok := s.store.(*sqlStore)
+	if !ok {
+		return fmt.Errorf("store %T can't be migrated", s.store)
+	}
+	if s.cfg.MigrateToURL == s.cfg.DatabaseURL {
+		return errors.New("STORAGE_MIGRATE_TO is DATABASE_URL")
+	}
+	target := &Server{cfg: Config{DatabaseURL: s.cfg.MigrateToURL}}
+	if err := target.openDB(); err != nil {
+		return fmt.Errorf("opening STORAGE_MIGRATE_TO: %w", err)
+	}
+	s.migration = newStorageMigration(source, target.store.(*sqlStore))
+	s.store = s.migration
+	log.Println("Storage migration on: links are written to both databases, read from DATABASE_URL")
+	return nil
+}
+
+func newStorageMigration(source, target *sqlStore) *storageMigration {
+	return &storageMigration{source: source, target: target, pending: map[string]struct{}{}}
+}
+
+func (s *Server) registerStorageMigration() {
+	m := s.migration
+	if m == nil {
+		return
+	}
+	app.OnShutdown("storage_migration", 5*time.Second, func(context.Context) error { return m.target.db.Close() })
+	app.RegisterBackgroundJob("storage_migration_copier", storageCopyInterval, m.copyStep)
+}
+
+// stores returns the store a link is read from and written to first, and
+// the one its writes are copied to, nil once the migration is aborted.
+func (m *storageMigration) stores() (primary, mirror *sqlStore) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.aborted:
+		return m.source, nil
+	case m.cutOver:
+		return m.target, m.source
+	}
+	return m.source, m.target
+}
+
+// mirror copies codes from primary to mirror, queueing the ones it can't.
+func (m *storageMigration) mirror(ctx context.Context, primary, mirror *sqlStore, codes ...string) {
+	if mirror == nil || len(codes) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), storageMirrorTimeout)
+	defer cancel()
+	for _, code := range codes {
+		if err := copyLink(ctx, primary, mirror, code); err != nil {
+			log.Printf("Error copying %s to the other store, queued for reconciliation: %v", code, err)
+			storageMigrationStats.Add("mirror_failures", 1)
+			m.queue(code)
+		}
+	}
+}
+
+func (m *storageMigration) queue(codes ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.aborted {
+		return
+	}
+	for _, code := range codes {
+		m.pending[code] = struct{}{}
+	}
+	setGauge(storageMigrationStats, "pending", int64(len(m.pending)))
+}
+
+func (m *storageMigration) takePending() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := make([]string, 0, len(m.pending))
+	for code := range m.pending {
+		codes = append(codes, code)
+	}
+	clear(m.pending)
+	setGauge(storageMigrationStats, "pending", 0)
+	return codes
+}
+
+func (m *storageMigration) Create(ctx context.Context, req ShortenRequest, code string) (createdLink, error) {
+	primary, mirror := m.stores()
+	link, err := primary.Create(ctx, req, code)
+	if err == nil && !link.Reused {
+		m.mirror(ctx, primary, mirror, code)
+	}
+	return link, err
+}
+
+func (m *storageMigration) CreateBatch(ctx context.Context, reqs []ShortenRequest, valid []bool, results []shortenBatchResult) error {
+	primary, mirror := m.stores()
+	if err := primary.CreateBatch(ctx, reqs, valid, results); err != nil {
+		return err
+	}
+	var codes []string
+	for i, res := range results {
+		if valid[i] && res.Status == "created" {
+			codes = append(codes, res.ShortCode)
+		}
+	}
+	m.mirror(ctx, primary, mirror, codes...)
+	return nil
+}
+
+func (m *storageMigration) GetLongURL(ctx context.Context, code string) (storedLink, error) {
+	primary, _ := m.stores()
+	return primary.GetLongURL(ctx, code)
+}
+
+func (m *storageMigration) Delete(ctx context.Context, code string, hard bool) (bool, error) {
+	primary, mirror := m.stores()
+	deleted, err := primary.Delete(ctx, code, hard)
+	if err == nil && deleted {
+		m.mirror(ctx, primary, mirror, code)
+	}
+	return deleted, err
+}
+
+func (m *storageMigration) Exists(ctx context.Context, code string) (bool, error) {
+	primary, _ := m.stores()
+	return primary.Exists(ctx, code)
+}
+
+func (m *storageMigration) Stats(ctx context.Context, code string) (linkStats, error) {
+	primary, _ := m.stores()
+	return primary.Stats(ctx, code)
+}
+
+func (m *storageMigration) MarkActivated(ctx context.Context, code string) (bool, error) {
+	primary, mirror := m.stores()
+	first, err := primary.MarkActivated(ctx, code)
+	if err == nil && first {
+		m.mirror(ctx, primary, mirror, code)
+	}
+	return first, err
+}
+
+func (m *storageMigration) AddChallenged(ctx context.Context, code string) error {
+	primary, mirror := m.stores()
+	err := primary.AddChallenged(ctx, code)
+	if err == nil {
+		m.mirror(ctx, primary, mirror, code)
+	}
+	return err
+}
+
+// copyStep is the copier: it retries the queued copies, then backfills the
+// next batch of links from the old store until it has copied them all.
+func (m *storageMigration) copyStep(ctx context.Context) error {
+	primary, mirror := m.stores()
+	if mirror == nil {
+		return nil
+	}
+	pending := m.takePending()
+	for i, code := range pending {
+		if err := copyLink(ctx, primary, mirror, code); err != nil {
+			m.queue(pending[i:]...)
+			return err
+		}
+		storageMigrationStats.Add("recopied", 1)
+	}
+
+	m.mu.Lock()
+	cursor, done := m.cursor, m.backfilled
+	m.mu.Unlock()
+	if done {
+		return nil
+	}
+	rows, err := m.source.db.QueryContext(ctx, "SELECT id, short_code FROM urls WHERE id > ? ORDER BY id LIMIT ?", cursor, storageCopyBatch)
+	if err != nil {
+		return err
+	}
+	type link struct {
+		id   int64
+		code string
+	}
+	var batch []link
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(&l.id, &l.code); err != nil {
+			rows.Close()
+			return err
+		}
+		batch = append(batch, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Cutover waits for the backfill, so it always copies old to new.
+	for _, l := range batch {
+		if err := copyLink(ctx, m.source, m.target, l.code); err != nil {
+			return err
+		}
+		cursor = l.id
+		storageMigrationStats.Add("backfilled", 1)
+	}
+	m.mu.Lock()
+	m.cursor, m.backfilled = cursor, len(batch) < storageCopyBatch
+	if m.backfilled {
+		log.Println("Storage migration backfill finished")
+	}
+	m.mu.Unlock()
+	setGauge(storageMigrationStats, "backfill_cursor", cursor)
+	return nil
+}
+
+// migratedLinkColumns are the urls columns copied between stores; id is
+// left to each store's own sequence. The integer ones are in
+// migratedIntColumns.
+var migratedLinkColumns = []string{"short_code", "long_url", "created_at", "imported_clicks", "og_title", "og_description", "og_image",
+	"challenge", "challenged", "active_from", "activated", "is_test", "owner", "hot", "expires_at", "timezone", "notes", "scan_status",
+	"canonical_hash", "redirect_type", "resolved_url", "resolved_status", "destination_problem", "password_hash", "status", "utm",
+	"status_changed_at", "legal_blocked", "destination_host", "expiry_warned_at", "webhook_url"}
+
+var migratedIntColumns = map[string]bool{"imported_clicks": true, "challenge": true, "challenged": true, "activated": true,
+	"is_test": true, "hot": true, "redirect_type": true, "resolved_status": true, "legal_blocked": true}
+
+var migratedLinkSelect, migratedLinkUpsert = func() (string, string) {
+	selected := slices.Clone(migratedLinkColumns)
+	// Read as stored, not as the time SQLite's driver makes of DATETIME.
+	selected[slices.Index(selected, "created_at")] = "CAST(created_at AS TEXT)"
+	var set []string
+	for _, col := range migratedLinkColumns[1:] {
+		set = append(set, col+" = excluded."+col)
+	}
+	return "SELECT " + strings.Join(selected, ", ") + " FROM urls",
+		"INSERT INTO urls (" + strings.Join(migratedLinkColumns, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(migratedLinkColumns)-1) + ")" +
+			" ON CONFLICT (short_code) DO UPDATE SET " + strings.Join(set, ", ")
+}()
+
+// scanMigratedLink scans a migratedLinkSelect row into pointers to
+// nullable values, which are also the arguments of migratedLinkUpsert.
+func scanMigratedLink(row interface{ Scan(...any) error }) ([]any, error) {
+	values := make([]any, len(migratedLinkColumns))
+	for i, col := range migratedLinkColumns {
+		if migratedIntColumns[col] {
+			values[i] = new(sql.NullInt64)
+		} else {
+			values[i] = new(sql.NullString)
+		}
+	}
+	return values, row.Scan(values...)
+}
+
+// copyLink makes code's link in to what it is in from: the row and its
+// metadata, or nothing when from has no such link.
+func copyLink(ctx context.Context, from, to *sqlStore, code string) error {
+	values, err := scanMigratedLink(from.db.QueryRowContext(ctx, migratedLinkSelect+" WHERE short_code = ?", code))
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err := deleteLinks(ctx, to.db, []string{code})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	metadata, err := loadLinkMetadata(ctx, from.db, code)
+	if err != nil {
+		return err
+	}
+	return dbTxWithRetry(ctx, to.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, migratedLinkUpsert, values...); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM link_metadata WHERE short_code = ?", code); err != nil {
+			return err
+		}
+		return insertLinkMetadata(ctx, tx, code, metadata)
+	})
+}
+
+// reconcileReport compares the links in the two stores.
+type reconcileReport struct {
+	SourceLinks int `json:"source_links"`
+	TargetLinks int `json:"target_links"`
+	// Missing links are in the old store only, Extra ones in the new
+	// store only; Different ones are in both but not alike.
+	Missing   int `json:"missing"`
+	Extra     int `json:"extra"`
+	Different int `json:"different"`
+	Drift     int `json:"drift"`
+	// Pending copies are queued and not counted in Drift.
+	Pending    int      `json:"pending"`
+	Backfilled bool     `json:"backfilled"`
+	Samples    []string `json:"samples,omitempty"`
+	CheckedAt  string   `json:"checked_at"`
+}
+
+// linkDigests returns a digest of each link's row in db, by short code.
+func linkDigests(ctx context.Context, db *sql.DB) (map[string][sha256.Size]byte, error) {
+	rows, err := db.QueryContext(ctx, migratedLinkSelect)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	digests := map[string][sha256.Size]byte{}
+	for rows.Next() {
+		values, err := scanMigratedLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		for _, v := range values {
+			switch v := v.(type) {
+			case *sql.NullString:
+				fmt.Fprintf(&b, "%t%q,", v.Valid, v.String)
+			case *sql.NullInt64:
+				fmt.Fprintf(&b, "%t%d,", v.Valid, v.Int64)
+			}
+		}
+		digests[values[0].(*sql.NullString).String] = sha256.Sum256([]byte(b.String()))
+	}
+	return digests, rows.Err()
+}
+
+// reconcile compares the stores link by link. Once the backfill is done,
+// drifted links are queued to be copied again; the next reconciliation
+// should find them alike.
+func (m *storageMigration) reconcile(ctx context.Context) (reconcileReport, error) {
+	source, err := linkDigests(ctx, m.source.db)
+	if err != nil {
+		return reconcileReport{}, err
+	}
+	target, err := linkDigests(ctx, m.target.db)
+	if err != nil {
+		return reconcileReport{}, err
+	}
+	r := reconcileReport{SourceLinks: len(source), TargetLinks: len(target), CheckedAt: time.Now().UTC().Format(time.RFC3339)}
+	var drifted []string
+	for code, digest := range source {
+		switch t, ok := target[code]; {
+		case !ok:
+			r.Missing++
+		case t != digest:
+			r.Different++
+		default:
+			continue
+		}
+		drifted = append(drifted, code)
+	}
+	for code := range target {
+		if _, ok := source[code]; !ok {
+			r.Extra++
+			drifted = append(drifted, code)
+		}
+	}
+	r.Drift = len(drifted)
+	slices.Sort(drifted)
+	r.Samples = drifted[:min(len(drifted), reconcileSamples)]
+
+	m.mu.Lock()
+	r.Backfilled = m.backfilled
+	m.mu.Unlock()
+	if r.Backfilled {
+		m.queue(drifted...)
+	}
+	m.mu.Lock()
+	r.Pending = len(m.pending)
+	m.report = &r
+	m.mu.Unlock()
+	setGauge(storageMigrationStats, "drift", int64(r.Drift))
+	return r, nil
+}
+
+// cutover reconciles the stores and, when they are alike, with nothing
+// queued and the backfill done, flips reads to the new store.
+func (m *storageMigration) cutover(ctx context.Context) (reconcileReport, error) {
+	r, err := m.reconcile(ctx)
+	if err != nil {
+		return r, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.aborted:
+		return r, errStorageMigrationAborted
+	case m.cutOver:
+		return r, nil
+	case !m.backfilled:
+		return r, errStorageBackfillRunning
+	case r.Drift > 0 || len(m.pending) > 0:
+		return r, errStorageDrift
+	}
+	m.cutOver = true
+	setGauge(storageMigrationStats, "cut_over", 1)
+	log.Println("Storage migration cut over: links are read from STORAGE_MIGRATE_TO")
+	return r, nil
+}
+
+// abort ends the migration, leaving the old store alone. After a cutover,
+// the copies still queued are made to the old store first.
+func (m *storageMigration) abort(ctx context.Context) error {
+	if primary, mirror := m.stores(); mirror != nil && primary == m.target {
+		pending := m.takePending()
+		for i, code := range pending {
+			if err := copyLink(ctx, m.target, m.source, code); err != nil {
+				m.queue(pending[i:]...)
+				return fmt.Errorf("copying %s back to the old store: %w", code, err)
+			}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cutOver && len(m.pending) > 0 {
+		return fmt.Errorf("%d copies to the old store were queued meanwhile, try again", len(m.pending))
+	}
+	m.aborted, m.cutOver = true, false
+	clear(m.pending)
+	setGauge(storageMigrationStats, "pending", 0)
+	setGauge(storageMigrationStats, "cut_over", 0)
+	setGauge(storageMigrationStats, "aborted", 1)
+	log.Println("Storage migration aborted: links are read from and written to DATABASE_URL alone")
+	return nil
+}
+
+func (m *storageMigration) status() gin.H {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := "double_write"
+	switch {
+	case m.aborted:
+		state = "aborted"
+	case m.cutOver:
+		state = "cut_over"
+	}
+	return gin.H{"state": state, "backfilled": m.backfilled, "backfill_cursor": m.cursor, "pending": len(m.pending), "last_report": m.report}
+}
+
+// requireStorageMigration answers the storage migration routes when the
+// mode is off.
+func (s *Server) requireStorageMigration(c *gin.Context) {
+	if s.migration == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No storage migration configured; set STORAGE_MIGRATE_TO", "code": "storage_migration_off"})
+		return
+	}
+	c.Next()
+}
+
+// getStorageMigration serves GET /admin/storage/migration.
+func (s *Server) getStorageMigration(c *gin.Context) {
+	c.JSON(http.StatusOK, s.migration.status())
+}
+
+// postStorageReconcile serves POST /admin/storage/reconcile with a fresh
+// reconciliation report.
+func (s *Server) postStorageReconcile(c *gin.Context) {
+	r, err := s.migration.reconcile(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// postStorageCutover serves POST /admin/storage/cutover. It answers 409
+// with the report when the stores aren't alike yet; the drifted links are
+// queued, so trying again once the copier caught up should succeed. To
+// finish, restart with DATABASE_URL set to the new store and
+// STORAGE_MIGRATE_TO unset.
+func (s *Server) postStorageCutover(c *gin.Context) {
+	r, err := s.migration.cutover(c.Request.Context())
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"state": "cut_over", "report": r})
+	case errors.Is(err, errStorageMigrationAborted):
+		c.JSON(http.StatusConflict, gin.H{"error": "Storage migration was aborted", "code": "storage_migration_aborted"})
+	case errors.Is(err, errStorageBackfillRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": "Backfill has not finished", "code": "backfill_running", "report": r})
+	case errors.Is(err, errStorageDrift):
+		c.JSON(http.StatusConflict, gin.H{"error": "Stores have drifted; the drifted links were queued, try again", "code": "storage_drift", "report": r})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "code": "database_error"})
+	}
+}
+
+// postStorageAbort serves POST /admin/storage/abort.
+func (s *Server) postStorageAbort(c *gin.Context) {
+	if err := s.migration.abort(c.Request.Context()); err != nil {
+		log.Printf("Error aborting the storage migration: %v", err)
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": "storage_abort_failed"})
+		return
+	}
+	c.JSON(http.StatusOK, s.migration.status())
+}
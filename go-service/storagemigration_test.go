@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// newMigratingServer is a fake server whose links are migrating from
+// testServer's store to a fresh SQLite database.
+func newMigratingServer(t *testing.T) (*Server, *storageMigration) {
+	t.Helper()
+	target := &Server{cfg: Config{DatabaseURL: filepath.Join(t.TempDir(), "target.db")}}
+	if err := target.openDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.db.Close() })
+	s, _, _ := newFakeServer(t)
+	m := newStorageMigration(testServer.store.(*sqlStore), target.store.(*sqlStore))
+	s.store, s.migration = m, m
+	return s, m
+}
+
+func backfill(t *testing.T, m *storageMigration) {
+	t.Helper()
+	for !m.backfilled {
+		if err := m.copyStep(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStorageMigrationDoubleWrites(t *testing.T) {
+	_, m := newMigratingServer(t)
+	ctx := context.Background()
+	code := "mig-" + newRandomID()[:10]
+	if _, err := m.Create(ctx, ShortenRequest{LongURL: "https://example.com/" + code, Metadata: map[string]string{"team": "growth"}}, code); err != nil {
+		t.Fatal(err)
+	}
+	l, err := m.target.GetLongURL(ctx, code)
+	if err != nil || l.LongURL != "https://example.com/"+code {
+		t.Fatalf("new store has %+v, %v", l, err)
+	}
+	if md, _ := loadLinkMetadata(ctx, m.target.db, code); md["team"] != "growth" {
+		t.Errorf("new store has metadata %v", md)
+	}
+
+	if _, err := m.Delete(ctx, code, false); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := m.target.GetLongURL(ctx, code); l.Status != linkStatusDeleted {
+		t.Errorf("soft delete left status %q in the new store", l.Status)
+	}
+	if _, err := m.Delete(ctx, code, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := m.target.Exists(ctx, code); ok {
+		t.Error("hard delete left the link in the new store")
+	}
+}
+
+func TestStorageMigrationQueuesFailedCopies(t *testing.T) {
+	_, m := newMigratingServer(t)
+	ctx := context.Background()
+	if _, err := m.target.db.Exec("ALTER TABLE urls RENAME TO urls_away"); err != nil {
+		t.Fatal(err)
+	}
+	code := "mig-" + newRandomID()[:10]
+	if _, err := m.Create(ctx, ShortenRequest{LongURL: "https://example.com/" + code}, code); err != nil {
+		t.Fatalf("Create with the new store failing = %v, want it to succeed", err)
+	}
+	if _, ok := m.pending[code]; !ok {
+		t.Fatalf("failed copy of %s wasn't queued: %v", code, m.pending)
+	}
+
+	if _, err := m.target.db.Exec("ALTER TABLE urls_away RENAME TO urls"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.copyStep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := m.target.Exists(ctx, code); !ok || len(m.pending) != 0 {
+		t.Errorf("after the copier ran, new store has %s = %v with %d pending", code, ok, len(m.pending))
+	}
+}
+
+func TestStorageMigrationCutoverAndAbort(t *testing.T) {
+	s, m := newMigratingServer(t)
+	r := s.newRouter()
+	admin := "Authorization: Bearer " + testAdminToken
+	ctx := context.Background()
+	before := "mig-" + newRandomID()[:10]
+	if _, err := testServer.store.Create(ctx, ShortenRequest{LongURL: "https://example.com/" + before}, before); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveTest(r, http.MethodPost, "/admin/storage/cutover", "", admin)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("cutover before the backfill = %d: %s", w.Code, w.Body)
+	}
+
+	backfill(t, m)
+	// A link changed behind the migration's back is drift until copied.
+	if _, err := testServer.db.Exec("UPDATE urls SET notes = 'edited' WHERE short_code = ?", before); err != nil {
+		t.Fatal(err)
+	}
+	w = serveTest(r, http.MethodPost, "/admin/storage/cutover", "", admin)
+	var body struct {
+		Code   string          `json:"code"`
+		Report reconcileReport `json:"report"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusConflict || body.Code != "storage_drift" || body.Report.Different != 1 || body.Report.Samples[0] != before {
+		t.Fatalf("cutover with drift = %d: %s", w.Code, w.Body)
+	}
+	if err := m.copyStep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveTest(r, http.MethodPost, "/admin/storage/cutover", "", admin); w.Code != http.StatusOK {
+		t.Fatalf("cutover after the copier caught up = %d: %s", w.Code, w.Body)
+	}
+
+	// Reads now come from the new store, and writes are copied back.
+	if primary, _ := m.stores(); primary != m.target {
+		t.Fatal("reads still go to the old store after cutover")
+	}
+	after := "mig-" + newRandomID()[:10]
+	if _, err := m.Create(ctx, ShortenRequest{LongURL: "https://example.com/" + after}, after); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := m.source.Exists(ctx, after); !ok {
+		t.Error("link created after cutover wasn't copied to the old store")
+	}
+
+	if w := serveTest(r, http.MethodPost, "/admin/storage/abort", "", admin); w.Code != http.StatusOK {
+		t.Fatalf("abort = %d: %s", w.Code, w.Body)
+	}
+	if primary, mirror := m.stores(); primary != m.source || mirror != nil {
+		t.Error("abort didn't go back to the old store alone")
+	}
+	if w := serveTest(r, http.MethodPost, "/admin/storage/cutover", "", admin); w.Code != http.StatusConflict {
+		t.Errorf("cutover after abort = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestStorageMigrationRoutesOff(t *testing.T) {
+	if w := serveTest(testServer.newRouter(), http.MethodGet, "/admin/storage/migration", "", "Authorization: Bearer "+testAdminToken); w.Code != http.StatusNotFound {
+		t.Errorf("migration status without one = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
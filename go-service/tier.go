@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Callers of the routes that create links fall in tiers, resolved where
+// they authenticate: admin (the admin token and admin keys), the tier an
+// API key was created with (standard unless given another), standard for
+// OAuth owners, and anonymous for everyone else, which only exists where
+// API_KEYS_REQUIRED is off: callers without credentials and the homepage
+// form. What a tier may do is its tierPolicy, from the defaults below or
+// TIER_POLICIES, a JSON object of policies by tier name; each tier given
+// replaces that tier's defaults, and new names add tiers keys can be
+// given. The policies are enforced here and nowhere else: checkShortenCaller
+// before the request is read and applyTierPolicy once it has been. A
+// denial names its tier and policy, with code tier_policy.
+const (
+	tierAnonymous = "anonymous"
+	tierStandard  = "standard"
+	tierAdmin     = "admin"
+)
+
+// tierContextKey is set on the gin context to the caller's tier.
+const tierContextKey = "tier"
+
+// The policies a denial can name.
+const (
+	policyRateLimit   = "rate_limit"
+	policyCustomAlias = "custom_alias"
+	policyMaxExpiry   = "max_expiry"
+	policyBatch       = "batch"
+	policyCaptcha     = "captcha"
+	policyLinkQuota   = "link_quota"
+)
+
+// tierPolicy is what a tier may do when creating links.
+type tierPolicy struct {
+	// ShortenPerMinute and ShortenBurst limit link creation per client
+	// address; 0 is unlimited. A batch counts as one request.
+	ShortenPerMinute int `json:"shorten_per_minute"`
+	ShortenBurst     int `json:"shorten_burst"`
+	// MaxExpirySeconds, when set, caps how far off a link's expiry may
+	// be, and links asking for none get one that far off.
+	MaxExpirySeconds int64 `json:"max_expiry_seconds"`
+	CustomAlias      bool  `json:"custom_alias"`
+	Batch            bool  `json:"batch"`
+	// Captcha requires a solved CAPTCHA, once CAPTCHA_SECRET is set.
+	Captcha bool `json:"captcha"`
+	// LinksPerDay caps the links an owner creates per UTC day; 0 is
+	// unlimited. Callers without an owner aren't counted.
+	LinksPerDay int `json:"links_per_day"`
+}
+
+var tierPolicies = loadTierPolicies(getEnv("TIER_POLICIES", ""))
+
+// defaultTierPolicies keep SHORTEN_LIMIT_PER_MINUTE and
+// SHORTEN_LIMIT_BURST as the standard tier's rate.
+func defaultTierPolicies() map[string]tierPolicy {
+	return map[string]tierPolicy{
+		tierAnonymous: {ShortenPerMinute: 3, ShortenBurst: 3, MaxExpirySeconds: int64((30 * 24 * time.Hour).Seconds()), Captcha: true},
+		tierStandard:  {ShortenPerMinute: shortenLimitPerMinute, ShortenBurst: shortenLimitBurst, CustomAlias: true, Batch: true},
+		tierAdmin:     {CustomAlias: true, Batch: true},
+	}
+}
+
+func loadTierPolicies(raw string) map[string]tierPolicy {
+	policies := defaultTierPolicies()
+	if raw == "" {
+		return policies
+	}
+	var overrides map[string]tierPolicy
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		log.Fatalf("Invalid TIER_POLICIES: %v", err)
+	}
+	for tier, p := range overrides {
+		policies[tier] = p
+	}
+	return policies
+}
+
+// policyFor is tier's policy. A key left with a tier no longer configured
+// is treated as standard.
+func policyFor(tier string) tierPolicy {
+	if p, ok := tierPolicies[tier]; ok {
+		return p
+	}
+	return tierPolicies[tierStandard]
+}
+
+// callerTier is the tier authentication resolved for the request.
+func callerTier(c *gin.Context) string {
+	if tier := c.GetString(tierContextKey); tier != "" {
+		return tier
+	}
+	return tierAnonymous
+}
+
+// apiKeyTier is the tier a verified key's caller is in.
+func apiKeyTier(k apiKey) string {
+	if k.Admin {
+		return tierAdmin
+	}
+	return k.Tier
+}
+
+// policyDenial is a request a tier's policy refused.
+type policyDenial struct {
+	tier, policy, message string
+	status                int
+	// wait is when a rate-limited caller may retry.
+	wait time.Duration
+}
+
+func (d *policyDenial) Error() string { return d.message }
+
+// writePolicyDenial answers a denied request.
+func writePolicyDenial(c *gin.Context, d *policyDenial) {
+	if d.wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(max(1, int(d.wait.Round(time.Second).Seconds()))))
+	}
+	c.AbortWithStatusJSON(d.status, gin.H{"error": d.message, "code": "tier_policy", "tier": d.tier, "policy": d.policy})
+}
+
+// checkShortenCaller applies tier's policy to owner's caller about to
+// create links from client, before its request is read: whether it may
+// batch, its rate, its links per day and the CAPTCHA, solved with
+// captchaToken. It returns what is left of the quotas; see quota.go.
+func (s *Server) checkShortenCaller(ctx context.Context, tier, owner, client string, batch bool, captchaToken string) ([]quotaUsage, *policyDenial) {
+	p := policyFor(tier)
+	if batch && !p.Batch {
+		return nil, &policyDenial{tier: tier, policy: policyBatch, status: http.StatusForbidden,
+			message: "The " + tier + " tier may not use the batch endpoint"}
+	}
+	var usages []quotaUsage
+	now := time.Now()
+	if p.ShortenPerMinute > 0 {
+		burst := max(p.ShortenBurst, 1)
+		ok, remaining, wait := s.limitClient(ctx, shortenLimitScope(tier), client, p.ShortenPerMinute, burst, true)
+		if !ok {
+			shortenLimitStats.Add("limited", 1)
+			return nil, &policyDenial{tier: tier, policy: policyRateLimit, status: http.StatusTooManyRequests, wait: wait,
+				message: "Too many requests for the " + tier + " tier"}
+		}
+		shortenLimitStats.Add("allowed", 1)
+		usages = append(usages, quotaUsage{policy: policyRateLimit, limit: burst, remaining: remaining, period: rateLimitPeriod(now)})
+	}
+	usage, d := s.checkLinkQuota(ctx, tier, owner, now)
+	if d != nil {
+		return nil, d
+	}
+	if usage != nil {
+		usages = append(usages, *usage)
+	}
+	if p.Captcha && captchaSecret != "" {
+		ok, err := verifyCaptcha(ctx, captchaToken, client)
+		if err != nil {
+			log.Printf("Error verifying CAPTCHA: %v", err)
+			return nil, &policyDenial{tier: tier, policy: policyCaptcha, status: http.StatusServiceUnavailable, wait: time.Second,
+				message: "CAPTCHA could not be checked, try again"}
+		}
+		if !ok {
+			return nil, &policyDenial{tier: tier, policy: policyCaptcha, status: http.StatusForbidden,
+				message: "The " + tier + " tier must solve a CAPTCHA; send its token as " + captchaHeader}
+		}
+	}
+	return usages, nil
+}
+
+// applyTierPolicy applies the policy of req's tier to a validated
+// request, giving it the tier's default expiry. Requests without a tier
+// come from admins' own tools and are left alone.
+func applyTierPolicy(req *ShortenRequest, now time.Time) error {
+	if req.tier == "" {
+		return nil
+	}
+	p := policyFor(req.tier)
+	if req.CustomAlias != "" && !p.CustomAlias {
+		return &policyDenial{tier: req.tier, policy: policyCustomAlias, status: http.StatusForbidden,
+			message: "The " + req.tier + " tier may not choose a custom_alias"}
+	}
+	if p.MaxExpirySeconds > 0 {
+		limit := now.Add(time.Duration(p.MaxExpirySeconds) * time.Second)
+		if req.ExpiresAt == nil {
+			req.ExpiresAt = &linkTime{Time: limit}
+		} else if req.ExpiresAt.After(limit) {
+			return &policyDenial{tier: req.tier, policy: policyMaxExpiry, status: http.StatusForbidden,
+				message: fmt.Sprintf("The %s tier's links must expire within %s", req.tier, time.Duration(p.MaxExpirySeconds)*time.Second)}
+		}
+	}
+	return nil
+}
+
+// shortenLimitScope is the rate limit scope of tier's link creation.
+func shortenLimitScope(tier string) string {
+	return "shorten:" + tier
+}
+
+// shortenLimiter applies the caller's tier to the routes that create
+// links. It runs after authentication, which resolves the tier.
+func (s *Server) shortenLimiter(c *gin.Context) {
+	batch := c.FullPath() == "/api/shorten/batch"
+	usages, d := s.checkShortenCaller(c.Request.Context(), callerTier(c), c.GetString(ownerContextKey), clientAddr(c).String(), batch, captchaTokenFrom(c))
+	if d != nil {
+		writePolicyDenial(c, d)
+		return
+	}
+	s.noteQuotaUsage(c, usages)
+	c.Next()
+}
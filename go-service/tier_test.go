@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setTierPolicy replaces tier's policy for the test.
+func setTierPolicy(t *testing.T, tier string, p tierPolicy) {
+	t.Helper()
+	saved, ok := tierPolicies[tier]
+	tierPolicies[tier] = p
+	t.Cleanup(func() {
+		if ok {
+			tierPolicies[tier] = saved
+		} else {
+			delete(tierPolicies, tier)
+		}
+	})
+}
+
+// wantDenial checks w is a tier_policy denial of policy by tier.
+func wantDenial(t *testing.T, what string, w *httptest.ResponseRecorder, status int, tier, policy string) {
+	t.Helper()
+	var body struct {
+		Error, Code, Tier, Policy string
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != status || body.Code != "tier_policy" || body.Tier != tier || body.Policy != policy || body.Error == "" {
+		t.Errorf("%s = %d: %s, want a %d %s denial for the %s tier", what, w.Code, w.Body, status, policy, tier)
+	}
+}
+
+func TestAnonymousTierPolicy(t *testing.T) {
+	apiKeysRequired = false
+	t.Cleanup(func() { apiKeysRequired = true })
+	setTierPolicy(t, tierAnonymous, tierPolicy{MaxExpirySeconds: 3600})
+	r := testServer.newRouter()
+
+	w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/tier","custom_alias":"tier-`+newRandomID()[:8]+`"}`)
+	wantDenial(t, "anonymous custom_alias", w, http.StatusForbidden, tierAnonymous, policyCustomAlias)
+	w = serveTest(r, http.MethodPost, "/api/shorten/batch", `[{"long_url":"https://example.com/tier"}]`)
+	wantDenial(t, "anonymous batch", w, http.StatusForbidden, tierAnonymous, policyBatch)
+	w = serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/tier","ttl_seconds":7200}`)
+	wantDenial(t, "anonymous expiry past the cap", w, http.StatusForbidden, tierAnonymous, policyMaxExpiry)
+
+	w = serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/tier","reuse_existing":false}`)
+	var resp ShortenResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	expiresAt, err := time.Parse(time.RFC3339, resp.ExpiresAt)
+	if w.Code != http.StatusOK || err != nil || time.Until(expiresAt) > time.Hour || time.Until(expiresAt) < 59*time.Minute {
+		t.Errorf("anonymous shorten without an expiry = %d: %s, want one expiring in an hour", w.Code, w.Body)
+	}
+
+	// An API key's caller is standard, which may do all of that.
+	_, key := newTestAPIKey(t, false)
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/tier","custom_alias":"tier-`+newRandomID()[:8]+`"}`, "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Errorf("standard custom_alias = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTierRateLimit(t *testing.T) {
+	tier := "rl-" + newRandomID()[:8]
+	setTierPolicy(t, tier, tierPolicy{ShortenPerMinute: 1, ShortenBurst: 1})
+	r := testServer.newRouter()
+	w := serveTest(r, http.MethodPost, "/admin/api-keys", `{"name":"limited","tier":"`+tier+`"}`, "Authorization: Bearer "+testAdminToken)
+	var created struct{ Key, Tier string }
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if w.Code != http.StatusCreated || created.Tier != tier {
+		t.Fatalf("create key = %d: %s", w.Code, w.Body)
+	}
+
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/tier-rl"}`, "X-API-Key: "+created.Key); w.Code != http.StatusOK {
+		t.Fatalf("first shorten = %d: %s", w.Code, w.Body)
+	}
+	w = serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/tier-rl"}`, "X-API-Key: "+created.Key)
+	wantDenial(t, "second shorten", w, http.StatusTooManyRequests, tier, policyRateLimit)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("rate-limited shorten has no Retry-After")
+	}
+	w = serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/tier-rl","custom_alias":"tier-`+newRandomID()[:8]+`"}`, "X-API-Key: "+created.Key)
+	wantDenial(t, "custom_alias", w, http.StatusTooManyRequests, tier, policyRateLimit)
+
+	for _, bad := range []string{tierAnonymous, "no-such-tier"} {
+		if w := serveTest(r, http.MethodPost, "/admin/api-keys", `{"name":"bad","tier":"`+bad+`"}`, "Authorization: Bearer "+testAdminToken); w.Code != http.StatusBadRequest {
+			t.Errorf("create key with tier %s = %d: %s", bad, w.Code, w.Body)
+		}
+	}
+}
+
+func TestTierCaptcha(t *testing.T) {
+	providerUp := true
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !providerUp {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"success": r.PostFormValue("secret") == "s3cret" && r.PostFormValue("response") == "solved"})
+	}))
+	defer provider.Close()
+	savedSecret, savedURL := captchaSecret, captchaVerifyURL
+	captchaSecret, captchaVerifyURL = "s3cret", provider.URL
+	t.Cleanup(func() { captchaSecret, captchaVerifyURL = savedSecret, savedURL })
+	apiKeysRequired = false
+	t.Cleanup(func() { apiKeysRequired = true })
+	r := testServer.newRouter()
+
+	body := `{"long_url":"https://example.com/tier-captcha"}`
+	wantDenial(t, "without a token", serveTest(r, http.MethodPost, "/api/shorten", body), http.StatusForbidden, tierAnonymous, policyCaptcha)
+	wantDenial(t, "with a wrong token", serveTest(r, http.MethodPost, "/api/shorten", body, captchaHeader+": guessed"), http.StatusForbidden, tierAnonymous, policyCaptcha)
+	if w := serveTest(r, http.MethodPost, "/api/shorten", body, captchaHeader+": solved"); w.Code != http.StatusOK {
+		t.Errorf("with a solved token = %d: %s", w.Code, w.Body)
+	}
+	_, key := newTestAPIKey(t, false)
+	if w := serveTest(r, http.MethodPost, "/api/shorten", body, "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Errorf("standard caller without a token = %d: %s", w.Code, w.Body)
+	}
+
+	providerUp = false
+	w := serveTest(r, http.MethodPost, "/api/shorten", body, captchaHeader+": solved")
+	wantDenial(t, "with the provider down", w, http.StatusServiceUnavailable, tierAnonymous, policyCaptcha)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every request runs under a REQUEST_TIMEOUT deadline (0 turns it off) on
+// its context, which the database, Redis and HTTP calls it makes inherit.
+// A handler that runs past it answers 504 instead of whatever it had been
+// about to write. Nothing is interrupted mid-call: the deadline only helps
+// where it is passed down, so it relies on handlers using
+// c.Request.Context(). Long-polling and streaming routes are exempt.
+var requestTimeout = getEnvDuration("REQUEST_TIMEOUT", 10*time.Second)
+
+// requestTimeoutExempt are the routes allowed to run past requestTimeout.
+var requestTimeoutExempt = map[string]bool{
+	"/api/changes":              true,
+	"/api/export":               true,
+	"/api/export/diff":          true,
+	"/api/import":               true,
+	"/admin/export/clicks":      true,
+	"/admin/canonical/backfill": true,
+	"/admin/verify":             true,
+}
+
+// timeoutResponseWriter drops the handler's response once the request's
+// deadline has passed before anything was written. WriteHeader still goes
+// through, so middlewares see the status the handler meant.
+type timeoutResponseWriter struct {
+	gin.ResponseWriter
+	ctx      context.Context
+	timedOut bool
+}
+
+func (w *timeoutResponseWriter) expired() bool {
+	if !w.timedOut && !w.ResponseWriter.Written() && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.timedOut = true
+	}
+	return w.timedOut
+}
+
+func (w *timeoutResponseWriter) Write(p []byte) (int, error) {
+	if w.expired() {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *timeoutResponseWriter) WriteString(s string) (int, error) {
+	if w.expired() {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *timeoutResponseWriter) WriteHeaderNow() {
+	if !w.expired() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *timeoutResponseWriter) Flush() {
+	if !w.expired() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// requestTimeoutMiddleware puts the request under requestTimeout and
+// answers 504 when the handler overruns it; see above.
+func requestTimeoutMiddleware(c *gin.Context) {
+	if requestTimeout <= 0 || requestTimeoutExempt[c.FullPath()] {
+		c.Next()
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+	w := &timeoutResponseWriter{ResponseWriter: c.Writer, ctx: ctx}
+	c.Writer = w
+
+	c.Next()
+
+	c.Writer = w.ResponseWriter
+	if !w.expired() {
+		return
+	}
+	log.Printf("Request %s %s timed out after %s", c.Request.Method, c.Request.URL.Path, requestTimeout)
+	c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": "Request timed out", "code": "request_timeout"})
+}
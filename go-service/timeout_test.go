@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withRequestTimeout sets requestTimeout for the rest of the test.
+func withRequestTimeout(tb testing.TB, d time.Duration) {
+	saved := requestTimeout
+	requestTimeout = d
+	tb.Cleanup(func() { requestTimeout = saved })
+}
+
+func TestRequestTimeoutMiddleware(t *testing.T) {
+	withRequestTimeout(t, 50*time.Millisecond)
+	r := gin.New()
+	r.Use(requestTimeoutMiddleware)
+	handler := func(wait time.Duration) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			select {
+			case <-time.After(wait):
+			case <-c.Request.Context().Done():
+			}
+			c.JSON(http.StatusOK, gin.H{"ok": true})
+		}
+	}
+	r.GET("/fast", handler(0))
+	r.GET("/slow", handler(time.Second))
+	r.GET("/api/export", handler(100*time.Millisecond))
+
+	for _, tt := range []struct {
+		path string
+		want int
+		code string
+	}{
+		{"/fast", http.StatusOK, ""},
+		{"/slow", http.StatusGatewayTimeout, "request_timeout"},
+		{"/api/export", http.StatusOK, ""},
+	} {
+		start := time.Now()
+		w := serveTest(r, http.MethodGet, tt.path, "")
+		var body struct{ Code string }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != tt.want || body.Code != tt.code {
+			t.Errorf("%s = %d %s, want %d with code %q", tt.path, w.Code, w.Body, tt.want, tt.code)
+		}
+		if tt.path == "/slow" && time.Since(start) > 500*time.Millisecond {
+			t.Errorf("%s answered after %s, want about the %s timeout", tt.path, time.Since(start), requestTimeout)
+		}
+	}
+}
+
+func TestRequestTimeoutAbortsStoreLookup(t *testing.T) {
+	withRequestTimeout(t, 50*time.Millisecond)
+	withRedirectBudget(t, 5*time.Second, 10*time.Millisecond)
+	s, store, _ := newFakeServer(t)
+	store.links["timeout-db"] = storedLink{LongURL: "https://example.com/timeout-db", Status: linkStatusActive}
+	store.lookupDelay = 5 * time.Second
+
+	start := time.Now()
+	w := serveTest(s.newRouter(), http.MethodGet, "/timeout-db", "")
+	var body struct{ Code string }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusGatewayTimeout || body.Code != "request_timeout" {
+		t.Errorf("redirect with the store taking 5s = %d %s, want a 504 request_timeout", w.Code, w.Body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the lookup ran for %s, want it cut off at the %s timeout", elapsed, requestTimeout)
+	}
+	if len(s.clickQueue) != 0 {
+		t.Error("a timed out redirect queued a click")
+	}
+}
+
+// ctxPublisher records whether the context each click was published under
+// was still live.
+type ctxPublisher struct {
+	mu     sync.Mutex
+	clicks []error
+}
+
+func (p *ctxPublisher) PublishClick(ctx context.Context, event ClickEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clicks = append(p.clicks, ctx.Err())
+}
+
+func (p *ctxPublisher) PublishLifecycle(ctx context.Context, event LifecycleEvent) {}
+
+func TestClickPublishOutlivesRequest(t *testing.T) {
+	withRequestTimeout(t, 50*time.Millisecond)
+	s, store, _ := newFakeServer(t)
+	events := &ctxPublisher{}
+	s.events = events
+	store.links["timeout-click"] = storedLink{LongURL: "https://example.com/timeout-click", Status: linkStatusActive}
+
+	w := serveTest(s.newRouter(), http.MethodGet, "/timeout-click", "")
+	if w.Code != defaultRedirectStatus {
+		t.Fatalf("redirect = %d: %s", w.Code, w.Body)
+	}
+	// The handler has returned and the request is over; the worker only
+	// picks the click up past the request's deadline.
+	time.Sleep(2 * requestTimeout)
+	go func() {
+		for job := range s.clickQueue {
+			s.handleClickJob(job)
+		}
+	}()
+	t.Cleanup(func() { close(s.clickQueue) })
+	s.clickJobs.Wait()
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	if len(events.clicks) != 1 || events.clicks[0] != nil {
+		t.Errorf("published clicks with context errors %v, want one under a live context", events.clicks)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	// Timezone names must resolve the same on hosts without zoneinfo.
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+)
+
+// linkTime is an active_from or expires_at as sent by the client: an RFC
+// 3339 instant, or a local date ("2026-03-01", meaning its midnight) or
+// date-time ("2026-03-01T09:00") read in the link's timezone. Once the
+// request is prepared it always holds an instant.
+type linkTime struct {
+	time.Time
+	// local is set while Time's fields are a wall clock still to be
+	// placed in a timezone.
+	local bool
+}
+
+var localTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+func (t *linkTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if parsed, err := time.Parse(time.RFC3339, s); err == nil {
+		*t = linkTime{Time: parsed}
+		return nil
+	}
+	for _, layout := range localTimeLayouts {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			*t = linkTime{Time: parsed, local: true}
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not an RFC 3339 time, a local date-time or a date", s)
+}
+
+// localInstant is the instant at which loc's clocks show wall's date and
+// time (wall's own location is ignored). A wall time that happens twice when
+// clocks go back is its earlier instant; one skipped when clocks go forward
+// is read with the offset from before the gap, so 02:30 in a 02:00-03:00
+// gap becomes 03:30. This is the RFC 5545 rule.
+func localInstant(wall time.Time, loc *time.Location) time.Time {
+	naive := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), time.UTC)
+	// The offsets a day either side cover any single transition.
+	_, before := naive.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := naive.Add(24 * time.Hour).In(loc).Zone()
+
+	var instant time.Time
+	for _, offset := range []int{before, after} {
+		t := naive.Add(-time.Duration(offset) * time.Second)
+		if sameWallClock(t.In(loc), naive) && (instant.IsZero() || t.Before(instant)) {
+			instant = t
+		}
+	}
+	if instant.IsZero() {
+		instant = naive.Add(-time.Duration(before) * time.Second)
+	}
+	return instant.In(time.UTC)
+}
+
+func sameWallClock(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd && a.Hour() == b.Hour() && a.Minute() == b.Minute() &&
+		a.Second() == b.Second() && a.Nanosecond() == b.Nanosecond()
+}
+
+// resolveTimezone places req's local times in its timezone, or else the
+// owner's default, or else UTC. The timezone is kept on links with a
+// schedule or expiry, for showing those times locally; it is dropped
+// otherwise.
+func resolveTimezone(req *ShortenRequest, ownerDefault string) error {
+	name := req.Timezone
+	if name == "" {
+		name = ownerDefault
+	}
+	loc := time.UTC
+	if name != "" {
+		var err error
+		if loc, err = loadTimezone(name); err != nil {
+			return err
+		}
+	}
+	for _, t := range []*linkTime{req.ActiveFrom, req.ExpiresAt} {
+		if t != nil && t.local {
+			*t = linkTime{Time: localInstant(t.Time, loc)}
+		}
+	}
+
+	req.Timezone = ""
+	if req.ActiveFrom != nil || req.ExpiresAt != nil || req.TTLSeconds > 0 {
+		req.Timezone = name
+	}
+	return nil
+}
+
+// loadTimezone accepts IANA names only; "Local" would mean whatever the
+// server happens to run in.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return loc, nil
+}
+
+// localTimes adds the RFC 3339 rendering of each stored UTC time in tz to
+// response under "<key>_local". Nothing is added without a timezone.
+func localTimes(response gin.H, tz sql.NullString, times map[string]sql.NullString) {
+	if !tz.Valid {
+		return
+	}
+	loc, err := loadTimezone(tz.String)
+	if err != nil {
+		return
+	}
+	response["timezone"] = tz.String
+	for key, value := range times {
+		if t, err := time.Parse(time.RFC3339, value.String); value.Valid && err == nil {
+			response[key+"_local"] = t.In(loc).Format(time.RFC3339)
+		}
+	}
+}
+
+// ownerTimezone is the owner's default timezone, "" if none is set.
+func (s *Server) ownerTimezone(ctx context.Context, owner string) (string, error) {
+	if owner == "" {
+		return "", nil
+	}
+	var tz string
+	err := s.db.QueryRowContext(ctx, "SELECT timezone FROM owner_timezones WHERE owner = ?", owner).Scan(&tz)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return tz, err
+}
+
+// getOwnerTimezone serves GET /api/settings/timezone.
+func (s *Server) getOwnerTimezone(c *gin.Context) {
+	tz, err := s.ownerTimezone(c.Request.Context(), c.GetString(ownerContextKey))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"timezone": tz})
+}
+
+// putOwnerTimezone serves PUT /api/settings/timezone, which sets the
+// timezone the owner's new links use when they don't name one. An empty
+// timezone clears it. Existing links keep theirs.
+func (s *Server) putOwnerTimezone(c *gin.Context) {
+	owner := c.GetString(ownerContextKey)
+	if owner == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A default timezone needs an authenticated owner"})
+		return
+	}
+	var req struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var err error
+	if req.Timezone == "" {
+		_, err = s.execWithRetry(c.Request.Context(), "DELETE FROM owner_timezones WHERE owner = ?", owner)
+	} else {
+		if _, err := loadTimezone(req.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		_, err = s.execWithRetry(c.Request.Context(), `INSERT INTO owner_timezones (owner, timezone) VALUES (?, ?)
+			ON CONFLICT (owner) DO UPDATE SET timezone = excluded.timezone, updated_at = datetime()`, owner, req.Timezone)
+	}
+	if errors.Is(err, errDBBusy) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"timezone": req.Timezone})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLocalInstant(t *testing.T) {
+	tests := []struct {
+		name, zone, wall, want string
+	}{
+		{"midnight in summer", "Australia/Sydney", "2026-03-01T00:00:00", "2026-02-28T13:00:00Z"},
+		{"midnight in winter", "Australia/Sydney", "2026-07-01T00:00:00", "2026-06-30T14:00:00Z"},
+		// Clocks go from 02:00 to 03:00: 02:30 doesn't happen and is read
+		// as 03:30 daylight time.
+		{"skipped hour", "Australia/Sydney", "2026-10-04T02:30:00", "2026-10-03T16:30:00Z"},
+		{"after the skipped hour", "Australia/Sydney", "2026-10-04T03:30:00", "2026-10-03T16:30:00Z"},
+		// Clocks go from 03:00 back to 02:00: 02:30 happens twice and the
+		// first, daylight time, is taken.
+		{"repeated hour", "Australia/Sydney", "2026-04-05T02:30:00", "2026-04-04T15:30:00Z"},
+		{"after the repeated hour", "Australia/Sydney", "2026-04-05T03:30:00", "2026-04-04T17:30:00Z"},
+		{"skipped hour in New York", "America/New_York", "2026-03-08T02:30:00", "2026-03-08T07:30:00Z"},
+		{"repeated hour in New York", "America/New_York", "2026-11-01T01:30:00", "2026-11-01T05:30:00Z"},
+		{"no DST", "Asia/Tokyo", "2026-01-01T09:00:00", "2026-01-01T00:00:00Z"},
+		{"UTC", "UTC", "2026-01-01T09:00:00", "2026-01-01T09:00:00Z"},
+	}
+	for _, tt := range tests {
+		loc, err := loadTimezone(tt.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wall, _ := time.Parse("2006-01-02T15:04:05", tt.wall)
+		if got := localInstant(wall, loc).Format(time.RFC3339); got != tt.want {
+			t.Errorf("%s: %s in %s = %s, want %s", tt.name, tt.wall, tt.zone, got, tt.want)
+		}
+	}
+}
+
+func TestLinkTimeUnmarshal(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  string
+		local bool
+	}{
+		{`"2026-03-01T09:00:00+11:00"`, "2026-02-28T22:00:00Z", false},
+		{`"2026-03-01T09:00:00Z"`, "2026-03-01T09:00:00Z", false},
+		{`"2026-03-01T09:00:30"`, "2026-03-01T09:00:30Z", true},
+		{`"2026-03-01T09:00"`, "2026-03-01T09:00:00Z", true},
+		{`"2026-03-01"`, "2026-03-01T00:00:00Z", true},
+	}
+	for _, tt := range tests {
+		var got linkTime
+		if err := json.Unmarshal([]byte(tt.in), &got); err != nil {
+			t.Errorf("unmarshal %s: %v", tt.in, err)
+			continue
+		}
+		if got.UTC().Format(time.RFC3339) != tt.want || got.local != tt.local {
+			t.Errorf("unmarshal %s = %s, local %v; want %s, local %v", tt.in, got.UTC().Format(time.RFC3339), got.local, tt.want, tt.local)
+		}
+	}
+	for _, bad := range []string{`"01/03/2026"`, `"2026-13-01"`, `"tomorrow"`, `12`} {
+		var got linkTime
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("unmarshal %s = %v, want an error", bad, got)
+		}
+	}
+}
+
+func TestShortenInTimezone(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	auth := "X-API-Key: " + key
+	shorten := func(body string) (int, ShortenResponse) {
+		t.Helper()
+		w := serveTest(r, http.MethodPost, "/api/shorten", body, auth)
+		var resp ShortenResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	// A date-only expiry is midnight where the link's owner is.
+	status, resp := shorten(`{"long_url":"https://example.com/tz-xmas","expires_at":"2027-12-25","timezone":"Australia/Sydney"}`)
+	if status != http.StatusOK || resp.ExpiresAt != "2027-12-24T13:00:00Z" || resp.ExpiresAtLocal != "2027-12-25T00:00:00+11:00" || resp.Timezone != "Australia/Sydney" {
+		t.Errorf("date-only expiry = %d: %+v", status, resp)
+	}
+
+	// A day-long schedule across the end of daylight time lasts 25 hours.
+	status, resp = shorten(`{"long_url":"https://example.com/tz-dst","active_from":"2027-04-03T12:00","expires_at":"2027-04-04T12:00","timezone":"Australia/Sydney"}`)
+	from, _ := time.Parse(time.RFC3339, resp.ActiveFrom)
+	until, _ := time.Parse(time.RFC3339, resp.ExpiresAt)
+	if status != http.StatusOK || until.Sub(from) != 25*time.Hour ||
+		resp.ActiveFromLocal != "2027-04-03T12:00:00+11:00" || resp.ExpiresAtLocal != "2027-04-04T12:00:00+10:00" {
+		t.Errorf("schedule across the DST change = %d: %+v (%s long)", status, resp, until.Sub(from))
+	}
+
+	// An RFC 3339 time is an instant whatever the timezone.
+	status, resp = shorten(`{"long_url":"https://example.com/tz-instant","expires_at":"2027-06-01T00:00:00Z","timezone":"Australia/Sydney"}`)
+	if status != http.StatusOK || resp.ExpiresAt != "2027-06-01T00:00:00Z" || resp.ExpiresAtLocal != "2027-06-01T10:00:00+10:00" {
+		t.Errorf("RFC 3339 expiry = %d: %+v", status, resp)
+	}
+
+	// Without a timezone, the owner's default applies, then UTC.
+	status, resp = shorten(`{"long_url":"https://example.com/tz-utc","expires_at":"2027-12-25"}`)
+	if status != http.StatusOK || resp.ExpiresAt != "2027-12-25T00:00:00Z" || resp.Timezone != "" {
+		t.Errorf("expiry without any timezone = %d: %+v", status, resp)
+	}
+	if w := serveTest(r, http.MethodPut, "/api/settings/timezone", `{"timezone":"America/New_York"}`, auth); w.Code != http.StatusOK {
+		t.Fatalf("set the owner timezone = %d: %s", w.Code, w.Body)
+	}
+	status, resp = shorten(`{"long_url":"https://example.com/tz-owner","expires_at":"2027-03-14T02:30"}`)
+	if status != http.StatusOK || resp.ExpiresAt != "2027-03-14T07:30:00Z" || resp.Timezone != "America/New_York" {
+		t.Errorf("expiry in the owner's skipped hour = %d: %+v", status, resp)
+	}
+	// A link without times keeps no timezone.
+	if status, resp := shorten(`{"long_url":"https://example.com/tz-none"}`); status != http.StatusOK || resp.Timezone != "" {
+		t.Errorf("link without times = %d: %+v", status, resp)
+	}
+
+	for _, tz := range []string{"Local", "Mars/Olympus", "+10:00"} {
+		if status, _ := shorten(`{"long_url":"https://example.com/tz-bad","expires_at":"2027-12-25","timezone":"` + tz + `"}`); status != http.StatusBadRequest {
+			t.Errorf("timezone %q = %d, want %d", tz, status, http.StatusBadRequest)
+		}
+		if w := serveTest(r, http.MethodPut, "/api/settings/timezone", `{"timezone":"`+tz+`"}`, auth); w.Code != http.StatusBadRequest {
+			t.Errorf("owner timezone %q = %d, want %d", tz, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Links move between owners with POST /api/urls/:code/transfer (the
+// link's owner or an admin) and, when someone leaves, all at once with
+// POST /api/keys/:id/transfer-all (admins). The target must be an
+// unrevoked API key. A link keeps its code, clicks, rollups and stats
+// shares; its canonical hash is recomputed under the new owner's profile,
+// as a claim does, so reuse finds it. Per-owner counts are read from
+// urls.owner, so they follow the links. What belongs to the old owner
+// rather than to its links, its verified domains and its settings, stays
+// behind and is listed in the response as not_moved; webhooks are global,
+// so none are owned by a key.
+
+var (
+	errTransferTarget = errors.New("transfer target is not an active API key")
+	errTransferOwner  = errors.New("link already belongs to the transfer target")
+)
+
+// transferRequest is the body of both transfer routes.
+type transferRequest struct {
+	ToKeyID string `json:"to_key_id" binding:"required"`
+}
+
+// transferURL serves POST /api/urls/:code/transfer. Callers other than
+// admins get a 404 for links they don't own, as deleteURL does.
+func (s *Server) transferURL(c *gin.Context) {
+	var req transferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	shortCode := c.Param("code")
+	from, err := s.linkOwner(primaryContext(c.Request.Context()), shortCode)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !s.isAdminCaller(c) && from != c.GetString(ownerContextKey) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	moved, err := s.transferLinks(c.Request.Context(), "short_code = ?", shortCode, req.ToKeyID)
+	if !s.writeTransferError(c, err) {
+		return
+	}
+	if len(moved) == 0 {
+		// Deleted, or transferred elsewhere, since it was looked up.
+		c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+		return
+	}
+	notMoved, err := s.ownerLeftBehind(c.Request.Context(), from)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	slog.Info("link transferred", "audit", true, "by", clientIP(c), "owner", c.GetString(ownerContextKey),
+		"short_code", shortCode, "from", from, "to", req.ToKeyID)
+	c.JSON(http.StatusOK, gin.H{"short_code": shortCode, "from": nullIfEmpty(from), "to": req.ToKeyID, "not_moved": notMoved})
+}
+
+// transferAllURLs serves POST /api/keys/:id/transfer-all, which moves
+// every link the key owns, whatever its status.
+func (s *Server) transferAllURLs(c *gin.Context) {
+	var req transferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	from := c.Param("id")
+	if from == req.ToKeyID {
+		s.writeTransferError(c, errTransferOwner)
+		return
+	}
+	moved, err := s.transferLinks(c.Request.Context(), "owner = ?", from, req.ToKeyID)
+	if !s.writeTransferError(c, err) {
+		return
+	}
+	notMoved, err := s.ownerLeftBehind(c.Request.Context(), from)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	slog.Info("links transferred", "audit", true, "by", clientIP(c), "from", from, "to", req.ToKeyID, "count", len(moved))
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": req.ToKeyID, "transferred": len(moved), "short_codes": moved, "not_moved": notMoved})
+}
+
+// writeTransferError answers for a failed transfer and reports whether
+// err was nil.
+func (s *Server) writeTransferError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errTransferTarget):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "to_key_id is not an active API key", "code": "invalid_transfer_target"})
+	case errors.Is(err, errTransferOwner):
+		c.JSON(http.StatusConflict, gin.H{"error": "Link already belongs to to_key_id", "code": "already_owner"})
+	case isBusyError(err) || errors.Is(err, errDBBusy):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+	return false
+}
+
+// linkOwner is shortCode's owner, "" for a link without one.
+func (s *Server) linkOwner(ctx context.Context, shortCode string) (string, error) {
+	link, err := s.store.GetLongURL(ctx, shortCode)
+	return link.Owner.String, err
+}
+
+// transferLinks gives the links matching where (a condition on urls with
+// one argument) to the key to, in one transaction, and returns their
+// codes. The caches are purged afterwards so redirects see the new owner.
+func (s *Server) transferLinks(ctx context.Context, where string, arg any, to string) ([]string, error) {
+	profile, err := s.ownerCanonicalProfile(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	var moved []string
+	err = s.txWithRetry(ctx, func(tx *sql.Tx) error {
+		moved = nil
+		var active int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM api_keys WHERE id = ? AND revoked_at IS NULL", to).Scan(&active); err != nil {
+			return err
+		}
+		if active == 0 {
+			return errTransferTarget
+		}
+		rows, err := tx.QueryContext(ctx, "SELECT short_code, long_url, owner FROM urls WHERE "+where+" ORDER BY short_code", arg)
+		if err != nil {
+			return err
+		}
+		type link struct{ code, longURL string }
+		var links []link
+		for rows.Next() {
+			var l link
+			var owner sql.NullString
+			if err := rows.Scan(&l.code, &l.longURL, &owner); err != nil {
+				rows.Close()
+				return err
+			}
+			if owner.String == to {
+				rows.Close()
+				return errTransferOwner
+			}
+			links = append(links, l)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, l := range links {
+			if _, err := tx.ExecContext(ctx, "UPDATE urls SET owner = ?, canonical_hash = ? WHERE short_code = ?",
+				to, profile.hash(l.longURL), l.code); err != nil {
+				return err
+			}
+			moved = append(moved, l.code)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range moved {
+		s.purgeLinkCache(ctx, code)
+	}
+	if moved == nil {
+		moved = []string{}
+	}
+	return moved, nil
+}
+
+// ownerLeftBehind lists what owner keeps after its links moved: the
+// domains it verified and whether it set a timezone or canonical profile.
+func (s *Server) ownerLeftBehind(ctx context.Context, owner string) (gin.H, error) {
+	notMoved := gin.H{"verified_domains": []string{}, "timezone": false, "canonical_profile": false}
+	if owner == "" {
+		return notMoved, nil
+	}
+	domains, err := s.queryStrings(ctx, "SELECT domain FROM domain_verifications WHERE owner = ? AND status = ? ORDER BY domain", owner, domainStatusVerified)
+	if err != nil {
+		return nil, err
+	}
+	if domains != nil {
+		notMoved["verified_domains"] = domains
+	}
+	for key, table := range map[string]string{"timezone": "owner_timezones", "canonical_profile": "owner_canonical_profiles"} {
+		var n int
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE owner = ?", owner).Scan(&n); err != nil {
+			return nil, err
+		}
+		notMoved[key] = n > 0
+	}
+	return notMoved, nil
+}
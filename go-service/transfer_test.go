@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTransferURL(t *testing.T) {
+	r := testServer.newRouter()
+	_, ownerKey := newTestAPIKey(t, false)
+	toID, toKey := newTestAPIKey(t, false)
+	_, otherKey := newTestAPIKey(t, false)
+	code := "tr-" + newRandomID()[:10]
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/transfer","custom_alias":"`+code+`"}`, "X-API-Key: "+ownerKey); w.Code != http.StatusOK {
+		t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+	}
+	path := "/api/urls/" + code + "/transfer"
+	body := `{"to_key_id":"` + toID + `"}`
+
+	if w := serveTest(r, http.MethodPost, path, body, "X-API-Key: "+otherKey); w.Code != http.StatusNotFound {
+		t.Errorf("transfer by someone else = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodPost, path, `{"to_key_id":"ak_missing"}`, "X-API-Key: "+ownerKey); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("transfer to an unknown key = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	w := serveTest(r, http.MethodPost, path, body, "X-API-Key: "+ownerKey)
+	if w.Code != http.StatusOK {
+		t.Fatalf("transfer by the owner = %d: %s", w.Code, w.Body)
+	}
+	if owner, _ := testServer.linkOwner(context.Background(), code); owner != toID {
+		t.Errorf("owner after transfer = %q, want %q", owner, toID)
+	}
+	if w := serveTest(r, http.MethodGet, "/api/urls/"+code, "", "X-API-Key: "+toKey); w.Code != http.StatusOK {
+		t.Errorf("new owner reading the link = %d", w.Code)
+	}
+	if w := serveTest(r, http.MethodPost, path, body, "X-API-Key: "+ownerKey); w.Code != http.StatusNotFound {
+		t.Errorf("old owner transferring again = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodPost, path, body, "Authorization: Bearer "+testAdminToken); w.Code != http.StatusConflict {
+		t.Errorf("transfer to the current owner = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestTransferAllURLs(t *testing.T) {
+	r := testServer.newRouter()
+	ctx := context.Background()
+	fromID, fromKey := newTestAPIKey(t, false)
+	toID, _ := newTestAPIKey(t, false)
+	var codes []string
+	for range 3 {
+		code := "tra-" + newRandomID()[:10]
+		if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/`+code+`","custom_alias":"`+code+`"}`, "X-API-Key: "+fromKey); w.Code != http.StatusOK {
+			t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+		}
+		codes = append(codes, code)
+	}
+	if _, err := testServer.db.Exec("INSERT INTO clicks (short_code, clicked_at) VALUES (?, datetime('now'))", codes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testServer.db.Exec("INSERT INTO domain_verifications (owner, domain, token, method, status) VALUES (?, 'example.com', 't', 'dns', 'verified')", fromID); err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/api/keys/" + fromID + "/transfer-all"
+	if w := serveTest(r, http.MethodPost, path, `{"to_key_id":"`+toID+`"}`, "X-API-Key: "+fromKey); w.Code != http.StatusUnauthorized && w.Code != http.StatusForbidden {
+		t.Errorf("bulk transfer by the key itself = %d, want it refused", w.Code)
+	}
+	w := serveTest(r, http.MethodPost, path, `{"to_key_id":"`+toID+`"}`, "Authorization: Bearer "+testAdminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk transfer = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Transferred int `json:"transferred"`
+		NotMoved    struct {
+			VerifiedDomains []string `json:"verified_domains"`
+		} `json:"not_moved"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Transferred != 3 || len(resp.NotMoved.VerifiedDomains) != 1 || resp.NotMoved.VerifiedDomains[0] != "example.com" {
+		t.Errorf("bulk transfer reported %s", w.Body)
+	}
+	for _, code := range codes {
+		if owner, _ := testServer.linkOwner(ctx, code); owner != toID {
+			t.Errorf("owner of %s = %q, want %q", code, owner, toID)
+		}
+	}
+	var clicks int
+	if err := testServer.db.QueryRow("SELECT COUNT(*) FROM clicks WHERE short_code = ?", codes[0]).Scan(&clicks); err != nil || clicks != 1 {
+		t.Errorf("clicks of a transferred link = %d, %v; want them kept", clicks, err)
+	}
+}
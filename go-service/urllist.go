@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/urls lists links, newest first by default, a page at a time.
+// Admins see every link and its owner; anyone else only the links they
+// own. Deleted links are left out unless ?status=deleted asks for them.
+// ?sort= is created_at, clicks or last_accessed_at (the last click), in
+// ascending order, or descending with a leading "-"; ?order= still sets
+// the direction of an unprefixed sort. Filters combine: q, status,
+// domain (the destination's host, exactly), has_expiry, broken (links a
+// destination check flagged), created_after/created_before, scan_status
+// and meta.<key>, which covers tags and campaigns. Clicks are as of the
+// last click counter flush. Pages are keyset paginated: next_cursor,
+// passed back as ?cursor=, continues after the last row under the same
+// filters and sort, so rows created meanwhile neither repeat nor shift the
+// page. Conditional requests are answered as conditional.go describes.
+const (
+	urlListDefaultLimit = 20
+	urlListMaxLimit     = 100
+)
+
+// urlListSorts maps ?sort= to the column it orders by. Links never
+// clicked sort first by last_accessed_at.
+var urlListSorts = map[string]string{
+	"created_at":       "u.created_at",
+	"clicks":           "u.imported_clicks + COALESCE(cc.clicks, 0)",
+	"last_accessed_at": "COALESCE(cc.last_clicked_at, '')",
+}
+
+// parseURLListSort reads ?sort= and ?order= into a urlListSorts key and a
+// direction.
+func parseURLListSort(sort, order string) (string, string, error) {
+	if sort == "" {
+		sort = "-created_at"
+	}
+	field, desc := strings.CutPrefix(sort, "-")
+	if _, ok := urlListSorts[field]; !ok {
+		return "", "", errors.New("sort must be created_at, clicks or last_accessed_at, with an optional leading -")
+	}
+	switch {
+	case order != "" && order != "asc" && order != "desc":
+		return "", "", errors.New("order must be asc or desc")
+	case desc && order == "asc":
+		return "", "", errors.New("order=asc contradicts a descending sort")
+	case desc || order == "desc" || order == "" && sort == "-created_at":
+		return field, "desc", nil
+	}
+	return field, "asc", nil
+}
+
+// linkQuery builds the WHERE clause of a listing one condition at a time,
+// every value a parameter.
+type linkQuery struct {
+	where []string
+	args  []any
+}
+
+func (q *linkQuery) and(cond string, args ...any) {
+	q.where = append(q.where, cond)
+	q.args = append(q.args, args...)
+}
+
+func (q *linkQuery) sql() string {
+	return strings.Join(q.where, " AND ")
+}
+
+// urlListFilters adds the filters in c's query string to q.
+func urlListFilters(c *gin.Context, q *linkQuery, now time.Time) error {
+	if v := c.Query("q"); v != "" {
+		q.and(`lower(u.long_url) LIKE lower(?) ESCAPE '\'`, "%"+escapeLike(v)+"%")
+	}
+	for _, bound := range []struct{ param, op string }{{"created_after", ">"}, {"created_before", "<"}} {
+		v := c.Query(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := urlListTime(v)
+		if err != nil {
+			return errors.New(bound.param + " " + err.Error())
+		}
+		q.and("u.created_at "+bound.op+" ?", t)
+	}
+	if status := c.Query("scan_status"); status != "" {
+		q.and("u.scan_status = ?", status)
+	}
+	if status := c.Query("status"); status != "" {
+		cond, args := linkStatusFilter(status, now)
+		if cond == "" {
+			return errors.New("status must be active, disabled, legal_block, expired or deleted")
+		}
+		q.and(cond, args...)
+	} else {
+		q.and("u.status != ?", linkStatusDeleted)
+	}
+	if domain := c.Query("domain"); domain != "" {
+		if len(domain) > 253 || strings.ContainsAny(domain, "/?#") {
+			return errors.New("domain must be a host name")
+		}
+		q.and("u.destination_host = ?", strings.ToLower(domain))
+	}
+	for param, cond := range map[string][2]string{
+		"has_expiry": {"u.expires_at IS NOT NULL", "u.expires_at IS NULL"},
+		"broken":     {"u.destination_problem IS NOT NULL", "u.destination_problem IS NULL"},
+	} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New(param + " must be true or false")
+		}
+		if b {
+			q.and(cond[0])
+		} else {
+			q.and(cond[1])
+		}
+	}
+	for param, values := range c.Request.URL.Query() {
+		key, ok := strings.CutPrefix(param, "meta.")
+		if !ok {
+			continue
+		}
+		if !metadataKeyPattern.MatchString(key) {
+			return errors.New("invalid metadata key in " + param)
+		}
+		q.and("EXISTS (SELECT 1 FROM link_metadata m WHERE m.short_code = u.short_code AND m.key = ? AND m.value = ?)", key, values[0])
+	}
+	return nil
+}
+
+// destinationHost is what urls.destination_host holds for longURL.
+func destinationHost(longURL string) any {
+	u, err := url.Parse(longURL)
+	if err != nil {
+		return nil
+	}
+	return nullIfEmpty(strings.ToLower(u.Hostname()))
+}
+
+// urlListCursor is where a page ended: the sort value and id of its last
+// row.
+type urlListCursor struct {
+	Value any   `json:"v"`
+	ID    int64 `json:"id"`
+}
+
+func (cur urlListCursor) encode() string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeURLListCursor reads a cursor of a page sorted by sort.
+func decodeURLListCursor(s, sort string) (urlListCursor, error) {
+	var cur urlListCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &cur) != nil {
+		return cur, errors.New("invalid cursor")
+	}
+	switch cur.Value.(type) {
+	case string:
+		if sort == "created_at" || sort == "last_accessed_at" {
+			return cur, nil
+		}
+	case float64:
+		if sort == "clicks" {
+			return cur, nil
+		}
+	}
+	return cur, errors.New("invalid cursor for this sort")
+}
+
+// urlListTime reads a created_after/created_before bound, an RFC 3339 time
+// or a date, in the form created_at is stored in.
+func urlListTime(s string) (string, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, s)
+	}
+	if err != nil {
+		return "", errors.New("must be an RFC 3339 time or a YYYY-MM-DD date")
+	}
+	return t.UTC().Format(time.DateTime), nil
+}
+
+// escapeLike escapes s for a LIKE pattern with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// listURLs serves GET /api/urls.
+func (s *Server) listURLs(c *gin.Context) {
+	limit := urlListDefaultLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > urlListMaxLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(urlListMaxLimit), "code": "invalid_request"})
+			return
+		}
+		limit = n
+	}
+	sort, order, err := parseURLListSort(c.Query("sort"), c.Query("order"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	sortExpr := urlListSorts[sort]
+
+	admin := s.isAdminCaller(c)
+	q := &linkQuery{}
+	q.and("u.is_test = 0")
+	if !admin {
+		q.and("u.owner = ?", c.GetString(ownerContextKey))
+	}
+	now := time.Now()
+	if err := urlListFilters(c, q, now); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	owner := ""
+	if !admin {
+		owner = c.GetString(ownerContextKey)
+	}
+	version, err := s.loadLinkVersion(ctx, owner, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if notModified(c, version) {
+		return
+	}
+
+	from := " FROM urls u LEFT JOIN click_counters cc ON cc.short_code = u.short_code WHERE "
+	var total int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*)"+from+q.sql(), q.args...).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		cur, err := decodeURLListCursor(v, sort)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+			return
+		}
+		cmp := "<"
+		if order == "asc" {
+			cmp = ">"
+		}
+		q.and("("+sortExpr+" "+cmp+" ? OR "+sortExpr+" = ? AND u.id "+cmp+" ?)", cur.Value, cur.Value, cur.ID)
+	}
+	query := "SELECT u.id, u.short_code, u.long_url, strftime('%Y-%m-%d %H:%M:%S', u.created_at), u.owner, u.scan_status, u.status, u.expires_at, " + urlListSorts["clicks"] + ", " + urlListSorts["last_accessed_at"] +
+		from + q.sql() + " ORDER BY " + sortExpr + " " + order + ", u.id " + order + " LIMIT ?"
+	rows, err := s.db.QueryContext(ctx, query, append(q.args, limit+1)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	base := publicBaseURL(c)
+	urls := []gin.H{}
+	var last urlListCursor
+	more := false
+	for rows.Next() {
+		if len(urls) == limit {
+			more = true
+			break
+		}
+		var id, clicks int64
+		var shortCode, longURL, createdAt, status, lastAccessedAt string
+		var owner, scanStatus, expiresAt sql.NullString
+		if err := rows.Scan(&id, &shortCode, &longURL, &createdAt, &owner, &scanStatus, &status, &expiresAt, &clicks, &lastAccessedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		item := gin.H{
+			"short_code":       shortCode,
+			"short_url":        shortURLFor(base, shortCode),
+			"long_url":         longURL,
+			"clicks":           clicks,
+			"last_accessed_at": nullIfEmpty(lastAccessedAt),
+			"status":           effectiveLinkStatus(status, expiresAt, now),
+		}
+		if t, err := time.Parse(time.DateTime, createdAt); err == nil {
+			item["created_at"] = t.Format(time.RFC3339)
+		}
+		if scanStatus.Valid {
+			item["scan_status"] = scanStatus.String
+		}
+		if admin {
+			item["owner"] = nullIfEmpty(owner.String)
+		}
+		urls = append(urls, item)
+		last = urlListCursor{Value: createdAt, ID: id}
+		switch sort {
+		case "clicks":
+			last.Value = clicks
+		case "last_accessed_at":
+			last.Value = lastAccessedAt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var next any
+	if more {
+		next = last.encode()
+	}
+	c.JSON(http.StatusOK, gin.H{"urls": urls, "total": total, "limit": limit, "next_cursor": next})
+}
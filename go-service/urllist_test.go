@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// listCodes lists GET path as key and returns the codes, following
+// next_cursor to the end.
+func listCodes(t *testing.T, path, key string) []string {
+	t.Helper()
+	r := testServer.newRouter()
+	var codes []string
+	cursor := ""
+	for {
+		w := serveTest(r, http.MethodGet, path+"&limit=2"+cursor, "", "X-API-Key: "+key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", path, w.Code, w.Body)
+		}
+		var page struct {
+			URLs []struct {
+				ShortCode string `json:"short_code"`
+			} `json:"urls"`
+			NextCursor string `json:"next_cursor"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &page)
+		for _, u := range page.URLs {
+			codes = append(codes, u.ShortCode)
+		}
+		if page.NextCursor == "" {
+			return codes
+		}
+		cursor = "&cursor=" + page.NextCursor
+	}
+}
+
+func TestListURLsSortAndFilters(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	links := []struct {
+		code, longURL, extra string
+		clicks               int
+		lastClicked          string
+	}{
+		{"ls-a-" + newRandomID()[:8], "https://a.example.com/x", `,"ttl_seconds":86400`, 5, "2026-01-03T00:00:00Z"},
+		{"ls-b-" + newRandomID()[:8], "https://B.example.org/y?z=1", "", 9, "2026-01-01T00:00:00Z"},
+		{"ls-c-" + newRandomID()[:8], "https://a.example.com/z", "", 0, ""},
+	}
+	var codes []string
+	for _, l := range links {
+		w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"`+l.longURL+`","custom_alias":"`+l.code+`"`+l.extra+`}`, "X-API-Key: "+key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("shorten %s = %d: %s", l.code, w.Code, w.Body)
+		}
+		if l.clicks > 0 {
+			if _, err := testServer.db.Exec("INSERT INTO click_counters (short_code, clicks, last_clicked_at) VALUES (?, ?, ?)", l.code, l.clicks, l.lastClicked); err != nil {
+				t.Fatal(err)
+			}
+		}
+		codes = append(codes, l.code)
+	}
+	a, b, c := codes[0], codes[1], codes[2]
+	if _, err := testServer.db.Exec("UPDATE urls SET destination_problem = ? WHERE short_code = ?", destinationHTTPError, c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"sort=-clicks", []string{b, a, c}},
+		{"sort=clicks", []string{c, a, b}},
+		{"sort=-last_accessed_at", []string{a, b, c}},
+		{"sort=last_accessed_at", []string{c, b, a}},
+		{"sort=clicks&order=desc", []string{b, a, c}},
+		{"domain=a.example.com&sort=created_at", []string{a, c}},
+		{"domain=b.example.org", []string{b}},
+		{"has_expiry=true", []string{a}},
+		{"has_expiry=false&sort=-clicks", []string{b, c}},
+		{"broken=true", []string{c}},
+		{"broken=false&domain=a.example.com", []string{a}},
+		{"q=example.com&has_expiry=false", []string{c}},
+	} {
+		if got := listCodes(t, "/api/urls?"+tt.query, key); !slices.Equal(got, tt.want) {
+			t.Errorf("%s listed %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"sort=views", "sort=-clicks&order=asc", "order=sideways", "has_expiry=maybe", "broken=2x", "domain=a.com/x", "status=gone"} {
+		w := serveTest(r, http.MethodGet, "/api/urls?"+query, "", "X-API-Key: "+key)
+		var body struct {
+			Error, Code string
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusBadRequest || body.Code != "invalid_request" || body.Error == "" {
+			t.Errorf("%s = %d: %s, want a 400 invalid_request", query, w.Code, w.Body)
+		}
+	}
+}
+
+func TestDestinationHost(t *testing.T) {
+	for longURL, want := range map[string]any{
+		"https://Example.COM:8443/path": "example.com",
+		"http://user@host.test?q":       "host.test",
+		"mailto:someone":                nil,
+	} {
+		if got := destinationHost(longURL); got != want {
+			t.Errorf("destinationHost(%q) = %v, want %v", longURL, got, want)
+		}
+	}
+}
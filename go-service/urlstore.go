@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// URLStore keeps the links. The shorten and redirect paths read and write
+// links only through it; sqlStore keeps them in the database. Listings,
+// exports and everything recorded around a link (clicks, settings,
+// webhooks) are queried where they are used.
+type URLStore interface {
+	// Create stores req under code, with its metadata and claim, and
+	// returns errCodeTaken when code is in use. A request that
+	// reusesExisting and matches a stored link stores nothing and gets
+	// that link back with Reused set.
+	Create(ctx context.Context, req ShortenRequest, code string) (createdLink, error)
+	// CreateBatch stores the valid reqs in one transaction, under their
+	// custom aliases or generated codes, and fills in their results. An
+	// item that can't be stored is marked and skipped; only errors that
+	// doom the whole batch are returned.
+	CreateBatch(ctx context.Context, reqs []ShortenRequest, valid []bool, results []shortenBatchResult) error
+	// GetLongURL returns the link under code with what decides whether,
+	// and how, it redirects, or sql.ErrNoRows.
+	GetLongURL(ctx context.Context, code string) (storedLink, error)
+	// Delete marks the link under code deleted or, with hard, removes it
+	// with everything recorded for it. It reports whether there was a
+	// link to delete; a soft delete of a deleted link finds none.
+	Delete(ctx context.Context, code string, hard bool) (bool, error)
+	// Exists reports whether a link of any status is stored under code.
+	Exists(ctx context.Context, code string) (bool, error)
+	// Stats returns the counters kept with the link under code, or
+	// sql.ErrNoRows.
+	Stats(ctx context.Context, code string) (linkStats, error)
+	// MarkActivated sets the activated flag of a scheduled link that went
+	// live, reporting whether this call was the one to set it.
+	MarkActivated(ctx context.Context, code string) (bool, error)
+	// AddChallenged counts a hit that was served the challenge page.
+	AddChallenged(ctx context.Context, code string) error
+}
+
+// errCodeTaken is Create's error for a code that is already in use.
+var errCodeTaken = errors.New("short code already taken")
+
+// createdLink is the link Create stored, or the one it reused.
+type createdLink struct {
+	ShortCode string
+	LongURL   string
+	Reused    bool
+}
+
+// storedLink is a link as GetLongURL returns it.
+type storedLink struct {
+	LongURL      string
+	Status       string
+	Owner        sql.NullString
+	Challenge    bool
+	ActiveFrom   sql.NullString
+	ExpiresAt    sql.NullString
+	Activated    bool
+	IsTest       bool
+	Hot          bool
+	RedirectType sql.NullInt64
+	ScanStatus   sql.NullString
+	PasswordHash sql.NullString
+	UTM          sql.NullString
+	// The OpenGraph overrides shown to link-unfurling crawlers.
+	OGTitle       sql.NullString
+	OGDescription sql.NullString
+	OGImage       sql.NullString
+}
+
+// linkStats are the counters a link's row keeps, with what decides who may
+// read them. Clicks are counted apart; see stats.go.
+type linkStats struct {
+	CreatedAt      string
+	Status         string
+	ActiveFrom     sql.NullString
+	ExpiresAt      sql.NullString
+	Owner          sql.NullString
+	ImportedClicks int64
+	Challenged     int64
+}
+
+// storedLinkQuery reads a storedLink; it is prepared as the redirect's
+// lookup of links missing from the cache.
+const storedLinkQuery = `SELECT long_url, status, owner, challenge, active_from, expires_at, activated, is_test, hot, redirect_type,
+	scan_status, password_hash, utm, og_title, og_description, og_image FROM urls WHERE short_code = ?`
+
+// sqlStore is the URLStore in the database, with the hot-path queries
+// prepared once.
+type sqlStore struct {
+	db                   *sql.DB
+	lookup               *sql.Stmt
+	shortenInsert        *sql.Stmt
+	shortenInsertReusing *sql.Stmt
+	findReusable         *sql.Stmt
+	// reads are where GetLongURL and Stats read from; see replicaSet.
+	reads *replicaSet
+	// lockReusable, when set, runs first in a reusing insert's transaction;
+	// see newPostgresStore.
+	lockReusable func(ctx context.Context, tx *sql.Tx, req ShortenRequest) error
+}
+
+// newSQLStore prepares the store's statements on db, whose schema must be
+// migrated.
+func newSQLStore(db *sql.DB) (*sqlStore, error) {
+	st := &sqlStore{db: db, reads: &replicaSet{primary: db}}
+	for _, q := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&st.lookup, storedLinkQuery},
+		{&st.shortenInsert, shortenInsertQuery},
+		{&st.shortenInsertReusing, shortenInsertReusingQuery},
+		{&st.findReusable, findReusableQuery},
+	} {
+		stmt, err := db.Prepare(q.query)
+		if err != nil {
+			return nil, fmt.Errorf("preparing statement %q: %w", q.query, err)
+		}
+		*q.stmt = stmt
+	}
+	return st, nil
+}
+
+func (st *sqlStore) Create(ctx context.Context, req ShortenRequest, code string) (createdLink, error) {
+	_, args := shortenInsert(req, code)
+	stmt := st.shortenInsert
+	lock := req.reusesExisting() && st.lockReusable != nil
+	if req.reusesExisting() {
+		stmt = st.shortenInsertReusing
+	}
+	var res sql.Result
+	var err error
+	if len(req.Metadata) == 0 && req.claim == nil && !lock {
+		err = retryBusy(ctx, func() error {
+			var err error
+			res, err = stmt.ExecContext(ctx, args...)
+			return err
+		})
+	} else {
+		err = dbTxWithRetry(ctx, st.db, func(tx *sql.Tx) error {
+			if lock {
+				if err := st.lockReusable(ctx, tx, req); err != nil {
+					return err
+				}
+			}
+			var err error
+			if res, err = tx.StmtContext(ctx, stmt).ExecContext(ctx, args...); err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return nil
+			}
+			if err := insertLinkMetadata(ctx, tx, code, req.Metadata); err != nil {
+				return err
+			}
+			if req.claim != nil {
+				return req.claim.store(ctx, tx, code)
+			}
+			return nil
+		})
+	}
+	if isUniqueViolation(err) {
+		return createdLink{}, errCodeTaken
+	}
+	if err != nil {
+		return createdLink{}, err
+	}
+	if n, _ := res.RowsAffected(); req.reusesExisting() && n == 0 {
+		link := createdLink{Reused: true}
+		err := retryBusy(ctx, func() error {
+			return st.findReusable.QueryRowContext(ctx, req.canonicalHash(), nullIfEmpty(req.owner)).Scan(&link.ShortCode, &link.LongURL)
+		})
+		return link, err
+	}
+	return createdLink{ShortCode: code, LongURL: req.LongURL}, nil
+}
+
+func (st *sqlStore) CreateBatch(ctx context.Context, reqs []ShortenRequest, valid []bool, results []shortenBatchResult) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	findReusable := tx.StmtContext(ctx, st.findReusable)
+	insert := func(req ShortenRequest, shortCode string) (sql.Result, error) {
+		_, args := shortenInsert(req, shortCode)
+		stmt := st.shortenInsert
+		if req.reusesExisting() {
+			stmt = st.shortenInsertReusing
+		}
+		var res sql.Result
+		err := inSavepoint(ctx, tx, func() error {
+			var err error
+			res, err = tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+			return err
+		})
+		return res, err
+	}
+
+	for i, req := range reqs {
+		if !valid[i] {
+			continue
+		}
+		if req.reusesExisting() && st.lockReusable != nil {
+			if err := st.lockReusable(ctx, tx, req); err != nil {
+				return err
+			}
+		}
+		// As in storeShortURL, a taken generated code is replaced and the
+		// insert retried; the failed insert is rolled back on its own.
+		var shortCode string
+		var res sql.Result
+		var err error
+		if req.CustomAlias != "" {
+			shortCode = req.CustomAlias
+			res, err = insert(req, shortCode)
+			if isUniqueViolation(err) {
+				results[i].Status, results[i].Error, results[i].Code = "conflict", "custom_alias "+strconv.Quote(req.CustomAlias)+" is already taken", "alias_taken"
+				continue
+			}
+		} else {
+			for range shortCodeAttempts {
+				if shortCode, err = drawShortCode(ctx, tx); err != nil {
+					return err
+				}
+				res, err = insert(req, shortCode)
+				recordShortCodeDraw(isUniqueViolation(err))
+				if !isUniqueViolation(err) {
+					break
+				}
+			}
+			if isUniqueViolation(err) {
+				results[i].Status, results[i].Error, results[i].Code = "failed", "Every generated short code collided with an existing one", "short_code_collision"
+				continue
+			}
+		}
+		if isBusyError(err) || errors.Is(err, context.Canceled) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Error storing batch item %d: %v", i, err)
+			results[i].Status, results[i].Error = "failed", "Failed to create short URL"
+			continue
+		}
+
+		reused := false
+		if n, _ := res.RowsAffected(); req.reusesExisting() && n == 0 {
+			if err := findReusable.QueryRowContext(ctx, req.canonicalHash(), nullIfEmpty(req.owner)).Scan(&shortCode, &results[i].LongURL); err != nil {
+				return err
+			}
+			reused = true
+		} else {
+			if len(req.Metadata) > 0 {
+				if err := insertLinkMetadata(ctx, tx, shortCode, req.Metadata); err != nil {
+					return err
+				}
+			}
+			if claim := req.newLinkClaim(time.Now()); claim != nil {
+				if err := claim.store(ctx, tx, shortCode); err != nil {
+					return err
+				}
+				results[i].ClaimToken, results[i].ClaimTokenExpiresAt = claim.Token, claim.ExpiresAt
+			}
+		}
+		results[i].Status, results[i].ShortCode = "created", shortCode
+		if reused {
+			results[i].Status = "reused"
+		}
+	}
+	return tx.Commit()
+}
+
+func (st *sqlStore) GetLongURL(ctx context.Context, code string) (storedLink, error) {
+	var l storedLink
+	err := st.reads.read(ctx, func(db *sql.DB) error {
+		row := func() *sql.Row { return db.QueryRowContext(ctx, storedLinkQuery, code) }
+		if db == st.db {
+			row = func() *sql.Row { return st.lookup.QueryRowContext(ctx, code) }
+		}
+		return retryBusy(ctx, func() error {
+			return row().Scan(&l.LongURL, &l.Status, &l.Owner, &l.Challenge, &l.ActiveFrom, &l.ExpiresAt,
+				&l.Activated, &l.IsTest, &l.Hot, &l.RedirectType, &l.ScanStatus, &l.PasswordHash, &l.UTM, &l.OGTitle, &l.OGDescription, &l.OGImage)
+		})
+	})
+	return l, err
+}
+
+func (st *sqlStore) Delete(ctx context.Context, code string, hard bool) (bool, error) {
+	if hard {
+		n, err := deleteLinks(ctx, st.db, []string{code})
+		return n > 0, err
+	}
+	res, err := dbExecWithRetry(ctx, st.db, "UPDATE urls SET status = ?, status_changed_at = datetime() WHERE short_code = ? AND status != ?", linkStatusDeleted, code, linkStatusDeleted)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (st *sqlStore) Exists(ctx context.Context, code string) (bool, error) {
+	var exists bool
+	err := st.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM urls WHERE short_code = ?)", code).Scan(&exists)
+	return exists, err
+}
+
+func (st *sqlStore) Stats(ctx context.Context, code string) (linkStats, error) {
+	var l linkStats
+	err := st.reads.read(ctx, func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, "SELECT created_at, status, active_from, expires_at, owner, imported_clicks, challenged FROM urls WHERE short_code = ?", code).
+			Scan(&l.CreatedAt, &l.Status, &l.ActiveFrom, &l.ExpiresAt, &l.Owner, &l.ImportedClicks, &l.Challenged)
+	})
+	return l, err
+}
+
+func (st *sqlStore) MarkActivated(ctx context.Context, code string) (bool, error) {
+	res, err := st.db.ExecContext(ctx, "UPDATE urls SET activated = 1 WHERE short_code = ? AND activated = 0", code)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (st *sqlStore) AddChallenged(ctx context.Context, code string) error {
+	_, err := st.db.ExecContext(ctx, "UPDATE urls SET challenged = challenged + 1 WHERE short_code = ?", code)
+	return err
+}
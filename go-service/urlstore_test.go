@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// These run against testServer's store: SQLite, or Postgres with
+// TEST_DATABASE_URL. Codes and URLs are fresh each run, as a Postgres
+// database outlives it.
+
+func TestURLStoreCreateAndLookup(t *testing.T) {
+	ctx := context.Background()
+	st := testServer.store
+	code, longURL := "st-"+newRandomID()[:10], "https://example.com/store/"+newRandomID()
+
+	link, err := st.Create(ctx, ShortenRequest{LongURL: longURL, Challenge: true, RedirectType: 307}, code)
+	if err != nil || link.ShortCode != code || link.Reused {
+		t.Fatalf("Create = %+v, %v", link, err)
+	}
+	if _, err := st.Create(ctx, ShortenRequest{LongURL: longURL + "/other"}, code); !errors.Is(err, errCodeTaken) {
+		t.Errorf("Create of a taken code = %v, want errCodeTaken", err)
+	}
+
+	l, err := st.GetLongURL(ctx, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.LongURL != longURL || l.Status != linkStatusActive || !l.Challenge || l.Hot || l.RedirectType.Int64 != 307 {
+		t.Errorf("GetLongURL = %+v", l)
+	}
+	if _, err := st.GetLongURL(ctx, code+"-missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetLongURL of a missing code = %v, want sql.ErrNoRows", err)
+	}
+	if ok, err := st.Exists(ctx, code); !ok || err != nil {
+		t.Errorf("Exists = %v, %v", ok, err)
+	}
+
+	if err := st.AddChallenged(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := st.Stats(ctx, code); err != nil || stats.Challenged != 1 || stats.CreatedAt == "" {
+		t.Errorf("Stats = %+v, %v", stats, err)
+	}
+	if first, err := st.MarkActivated(ctx, code); !first || err != nil {
+		t.Errorf("first MarkActivated = %v, %v", first, err)
+	}
+	if again, err := st.MarkActivated(ctx, code); again || err != nil {
+		t.Errorf("second MarkActivated = %v, %v", again, err)
+	}
+}
+
+func TestURLStoreReusesExisting(t *testing.T) {
+	ctx := context.Background()
+	st := testServer.store
+	req := ShortenRequest{LongURL: "https://example.com/reuse/" + newRandomID()}
+	first, second := "st-"+newRandomID()[:10], "st-"+newRandomID()[:10]
+
+	if _, err := st.Create(ctx, req, first); err != nil {
+		t.Fatal(err)
+	}
+	link, err := st.Create(ctx, req, second)
+	if err != nil || !link.Reused || link.ShortCode != first {
+		t.Errorf("Create of the same URL = %+v, %v; want %s reused", link, err, first)
+	}
+	if ok, _ := st.Exists(ctx, second); ok {
+		t.Errorf("reusing Create stored %s", second)
+	}
+}
+
+func TestURLStoreDelete(t *testing.T) {
+	ctx := context.Background()
+	st := testServer.store
+	code := "st-" + newRandomID()[:10]
+	if _, err := st.Create(ctx, ShortenRequest{LongURL: "https://example.com/delete/" + code}, code); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := st.Delete(ctx, code, false); !ok || err != nil {
+		t.Fatalf("soft Delete = %v, %v", ok, err)
+	}
+	if l, err := st.GetLongURL(ctx, code); err != nil || l.Status != linkStatusDeleted {
+		t.Errorf("after soft Delete, GetLongURL = %+v, %v", l, err)
+	}
+	if ok, err := st.Delete(ctx, code, false); ok || err != nil {
+		t.Errorf("second soft Delete = %v, %v; want nothing deleted", ok, err)
+	}
+	if ok, err := st.Delete(ctx, code, true); !ok || err != nil {
+		t.Errorf("hard Delete = %v, %v", ok, err)
+	}
+	if ok, err := st.Exists(ctx, code); ok || err != nil {
+		t.Errorf("Exists after hard Delete = %v, %v", ok, err)
+	}
+}
+
+func TestURLStoreCreateBatch(t *testing.T) {
+	ctx := context.Background()
+	st := testServer.store
+	taken := "st-" + newRandomID()[:10]
+	if _, err := st.Create(ctx, ShortenRequest{LongURL: "https://example.com/batch/taken"}, taken); err != nil {
+		t.Fatal(err)
+	}
+	alias := "st-" + newRandomID()[:10]
+	reqs := []ShortenRequest{
+		{LongURL: "https://example.com/batch/" + alias, CustomAlias: alias},
+		{LongURL: "https://example.com/batch/other", CustomAlias: taken},
+		{LongURL: "https://example.com/batch/invalid"},
+		{LongURL: "https://example.com/batch/" + newRandomID(), ReuseExisting: new(bool)},
+	}
+	valid := []bool{true, true, false, true}
+	results := make([]shortenBatchResult, len(reqs))
+	if err := st.CreateBatch(ctx, reqs, valid, results); err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].Status != "created" || results[0].ShortCode != alias {
+		t.Errorf("alias item = %+v", results[0])
+	}
+	if results[1].Status != "conflict" || results[1].Code != "alias_taken" {
+		t.Errorf("taken alias item = %+v", results[1])
+	}
+	if results[2].Status != "" {
+		t.Errorf("invalid item = %+v, want it left alone", results[2])
+	}
+	if results[3].Status != "created" || results[3].ShortCode == "" {
+		t.Errorf("generated item = %+v", results[3])
+	}
+	// The conflict rolled back only its own insert.
+	for _, code := range []string{alias, results[3].ShortCode} {
+		if l, err := st.GetLongURL(ctx, code); err != nil || l.Status != linkStatusActive {
+			t.Errorf("GetLongURL(%s) after the batch = %+v, %v", code, l, err)
+		}
+	}
+}
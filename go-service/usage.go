@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Usage keeps daily counters per link owner in key_usage_daily, for
+// GET /api/keys/self/usage and the billing export at GET /admin/usage:
+// links created, clicks on the owner's links and, for API keys, API calls
+// made. Links and calls are counted in an in-process buffer as they
+// happen; clicks are attributed when the click rollups are flushed, to
+// whoever owns the link then, so a transferred link's later clicks count
+// for its new owner. Both are written by flushClickRollups, so the
+// counters trail by up to CLICK_ROLLUP_FLUSH_INTERVAL. Days are UTC, and
+// rows are kept for billing rather than pruned with the rollups.
+
+// maxUsageDays bounds the range of one usage request.
+const maxUsageDays = 366
+
+// apiCallCountedContextKey is set once a request's API call is counted, so
+// a request that checks its key twice counts once.
+const apiCallCountedContextKey = "api_call_counted"
+
+type keyUsageKey struct {
+	owner, day string
+}
+
+type keyUsageCounts struct {
+	links, apiCalls int64
+}
+
+// keyUsageBuffer counts links and API calls per owner and UTC day until
+// they are flushed.
+type keyUsageBuffer struct {
+	mu     sync.Mutex
+	counts map[keyUsageKey]keyUsageCounts
+}
+
+var keyUsage = &keyUsageBuffer{counts: map[keyUsageKey]keyUsageCounts{}}
+
+func (b *keyUsageBuffer) add(owner string, at time.Time, n keyUsageCounts) {
+	if owner == "" {
+		return
+	}
+	key := keyUsageKey{owner, at.UTC().Format(time.DateOnly)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.counts[key]
+	if !ok && len(b.counts) >= clickRollupMaxPending {
+		return
+	}
+	c.links += n.links
+	c.apiCalls += n.apiCalls
+	b.counts[key] = c
+}
+
+func (b *keyUsageBuffer) take() map[keyUsageKey]keyUsageCounts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counts := b.counts
+	b.counts = map[keyUsageKey]keyUsageCounts{}
+	return counts
+}
+
+// recordLinkCreated counts a link created for owner.
+func recordLinkCreated(owner string) {
+	keyUsage.add(owner, time.Now(), keyUsageCounts{links: 1})
+}
+
+// recordAPICall counts the request as an API call by keyID.
+func recordAPICall(c *gin.Context, keyID string) {
+	if c.GetBool(apiCallCountedContextKey) {
+		return
+	}
+	c.Set(apiCallCountedContextKey, true)
+	keyUsage.add(keyID, time.Now(), keyUsageCounts{apiCalls: 1})
+}
+
+// flushKeyUsage adds usage to key_usage_daily in tx.
+func flushKeyUsage(ctx context.Context, tx *sql.Tx, usage map[keyUsageKey]keyUsageCounts) error {
+	if len(usage) == 0 {
+		return nil
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO key_usage_daily (owner, day, links_created, api_calls) VALUES (?, ?, CAST(? AS INTEGER), CAST(? AS INTEGER))
+		ON CONFLICT (owner, day) DO UPDATE SET links_created = key_usage_daily.links_created + excluded.links_created, api_calls = key_usage_daily.api_calls + excluded.api_calls`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for key, n := range usage {
+		if _, err := stmt.ExecContext(ctx, key.owner, key.day, n.links, n.apiCalls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usageDay is one owner's counters for a day.
+type usageDay struct {
+	KeyID        string `json:"key_id,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Day          string `json:"day"`
+	LinksCreated int64  `json:"links_created"`
+	Clicks       int64  `json:"clicks"`
+	APICalls     int64  `json:"api_calls"`
+}
+
+// parseUsageRange reads from= and to=, UTC days given as YYYY-MM-DD and
+// both included. They default to this month so far.
+func parseUsageRange(c *gin.Context) (from, to time.Time, err error) {
+	to = time.Now().UTC().Truncate(24 * time.Hour)
+	if s := c.Query("to"); s != "" {
+		if to, err = time.Parse(time.DateOnly, s); err != nil {
+			return from, to, errors.New("to must be YYYY-MM-DD")
+		}
+	}
+	from = to.AddDate(0, 0, 1-to.Day())
+	if s := c.Query("from"); s != "" {
+		if from, err = time.Parse(time.DateOnly, s); err != nil {
+			return from, to, errors.New("from must be YYYY-MM-DD")
+		}
+	}
+	if to.Before(from) {
+		return from, to, errors.New("from must not be after to")
+	}
+	if to.Sub(from) >= maxUsageDays*24*time.Hour {
+		return from, to, errors.New("the range may span at most " + strconv.Itoa(maxUsageDays) + " days")
+	}
+	return from, to, nil
+}
+
+// queryUsage is the usage rows in [from, to], for owner or, for "", every
+// owner, ordered by owner and day.
+func (s *Server) queryUsage(ctx context.Context, owner string, from, to time.Time) ([]usageDay, error) {
+	query := `SELECT u.owner, COALESCE(k.name, ''), u.day, u.links_created, u.clicks, u.api_calls FROM key_usage_daily u
+		LEFT JOIN api_keys k ON k.id = u.owner WHERE u.day >= ? AND u.day <= ?`
+	args := []any{from.Format(time.DateOnly), to.Format(time.DateOnly)}
+	if owner != "" {
+		query, args = query+" AND u.owner = ?", append(args, owner)
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY u.owner, u.day", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := []usageDay{}
+	for rows.Next() {
+		var d usageDay
+		if err := rows.Scan(&d.KeyID, &d.Name, &d.Day, &d.LinksCreated, &d.Clicks, &d.APICalls); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+// getOwnUsage serves GET /api/keys/self/usage: the caller's counters for
+// every day in the range, with their totals.
+func (s *Server) getOwnUsage(c *gin.Context) {
+	owner := c.GetString(ownerContextKey)
+	if owner == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The admin token has no usage of its own; see /admin/usage", "code": "invalid_request"})
+		return
+	}
+	from, to, err := parseUsageRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	rows, err := s.queryUsage(c.Request.Context(), owner, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	byDay := map[string]usageDay{}
+	for _, d := range rows {
+		byDay[d.Day] = d
+	}
+	var totals usageDay
+	days := []usageDay{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		d := byDay[day.Format(time.DateOnly)]
+		d.KeyID, d.Name, d.Day = "", "", day.Format(time.DateOnly)
+		totals.LinksCreated += d.LinksCreated
+		totals.Clicks += d.Clicks
+		totals.APICalls += d.APICalls
+		days = append(days, d)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"key_id": owner,
+		"from":   from.Format(time.DateOnly),
+		"to":     to.Format(time.DateOnly),
+		"totals": gin.H{"links_created": totals.LinksCreated, "clicks": totals.Clicks, "api_calls": totals.APICalls},
+		"days":   days,
+	})
+}
+
+// getAdminUsage serves GET /admin/usage: every owner's days with usage in
+// the range, as JSON or, with format=csv, a CSV for billing.
+func (s *Server) getAdminUsage(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv", "code": "invalid_request"})
+		return
+	}
+	from, to, err := parseUsageRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_request"})
+		return
+	}
+	rows, err := s.queryUsage(c.Request.Context(), "", from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	if format == "json" {
+		c.JSON(http.StatusOK, gin.H{"from": from.Format(time.DateOnly), "to": to.Format(time.DateOnly), "usage": rows})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="usage-`+from.Format(time.DateOnly)+"-"+to.Format(time.DateOnly)+`.csv"`)
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"key_id", "name", "day", "links_created", "clicks", "api_calls"})
+	for _, d := range rows {
+		w.Write([]string{d.KeyID, d.Name, d.Day, strconv.FormatInt(d.LinksCreated, 10), strconv.FormatInt(d.Clicks, 10), strconv.FormatInt(d.APICalls, 10)})
+	}
+	w.Flush()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyUsage(t *testing.T) {
+	r := testServer.newRouter()
+	ctx := context.Background()
+	ownerID, key := newTestAPIKey(t, false)
+	toID, toKey := newTestAPIKey(t, false)
+	code := "us-" + newRandomID()[:10]
+	if w := serveTest(r, http.MethodPost, "/api/shorten", `{"long_url":"https://example.com/usage","custom_alias":"`+code+`"}`, "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Fatalf("shorten = %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(r, http.MethodPost, "/api/shorten/batch", `[{"long_url":"https://example.com/usage-1"},{"long_url":"https://example.com/usage-2"}]`, "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Fatalf("batch = %d: %s", w.Code, w.Body)
+	}
+	now := time.Now()
+	clickRollups.add(code, "", now, 3)
+	if err := testServer.flushClickRollups(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clicks after a transfer count for the new owner.
+	if w := serveTest(r, http.MethodPost, "/api/urls/"+code+"/transfer", `{"to_key_id":"`+toID+`"}`, "X-API-Key: "+key); w.Code != http.StatusOK {
+		t.Fatalf("transfer = %d: %s", w.Code, w.Body)
+	}
+	clickRollups.add(code, "", now, 2)
+	if err := testServer.flushClickRollups(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	today := now.UTC().Format(time.DateOnly)
+	usage := func(key string) (totals usageDay, days []usageDay) {
+		t.Helper()
+		w := serveTest(r, http.MethodGet, "/api/keys/self/usage?from="+now.UTC().AddDate(0, 0, -2).Format(time.DateOnly)+"&to="+today, "", "X-API-Key: "+key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("usage = %d: %s", w.Code, w.Body)
+		}
+		var body struct {
+			Totals usageDay
+			Days   []usageDay
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body.Totals, body.Days
+	}
+	totals, days := usage(key)
+	// The shorten, the batch and the transfer were API calls.
+	if totals.LinksCreated != 3 || totals.Clicks != 3 || totals.APICalls != 3 {
+		t.Errorf("owner's totals = %+v, want 3 links, 3 clicks, 3 calls", totals)
+	}
+	if len(days) != 3 || days[2].Day != today || days[2].LinksCreated != 3 || days[0].LinksCreated != 0 {
+		t.Errorf("owner's days = %+v", days)
+	}
+	if err := testServer.flushClickRollups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if totals, _ := usage(toKey); totals.LinksCreated != 0 || totals.Clicks != 2 || totals.APICalls != 0 {
+		t.Errorf("new owner's totals = %+v, want 2 clicks", totals)
+	}
+	// The first usage request was an API call too, flushed since.
+	if totals, _ := usage(key); totals.APICalls != 4 {
+		t.Errorf("owner's calls after reading usage = %d, want 4", totals.APICalls)
+	}
+
+	admin := "Authorization: Bearer " + testAdminToken
+	w := serveTest(r, http.MethodGet, "/admin/usage?format=csv&from="+today+"&to="+today, "", admin)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), ownerID+",TestKeyUsage,"+today+",3,3,") {
+		t.Errorf("admin CSV = %d: %s", w.Code, w.Body)
+	}
+	w = serveTest(r, http.MethodGet, "/admin/usage", "", admin)
+	var export struct{ Usage []usageDay }
+	json.Unmarshal(w.Body.Bytes(), &export)
+	found := false
+	for _, d := range export.Usage {
+		found = found || d.KeyID == toID && d.Clicks == 2
+	}
+	if w.Code != http.StatusOK || !found {
+		t.Errorf("admin JSON = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestKeyUsageRequests(t *testing.T) {
+	r := testServer.newRouter()
+	_, key := newTestAPIKey(t, false)
+	admin := "Authorization: Bearer " + testAdminToken
+	for _, tt := range []struct{ path, auth string }{
+		{"/api/keys/self/usage?from=2026-02-01&to=2026-01-01", "X-API-Key: " + key},
+		{"/api/keys/self/usage?from=2024-01-01&to=2026-01-01", "X-API-Key: " + key},
+		{"/api/keys/self/usage?from=yesterday", "X-API-Key: " + key},
+		{"/api/keys/self/usage", admin},
+		{"/admin/usage?format=xml", admin},
+	} {
+		if w := serveTest(r, http.MethodGet, tt.path, "", tt.auth); w.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d: %s, want %d", tt.path, w.Code, w.Body, http.StatusBadRequest)
+		}
+	}
+	if w := serveTest(r, http.MethodGet, "/admin/usage", "", "X-API-Key: "+key); w.Code != http.StatusUnauthorized {
+		t.Errorf("admin usage with a plain key = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// The range defaults to this month so far.
+	w := serveTest(r, http.MethodGet, "/api/keys/self/usage", "", "X-API-Key: "+key)
+	var body struct{ From, To string }
+	json.Unmarshal(w.Body.Bytes(), &body)
+	now := time.Now().UTC()
+	if w.Code != http.StatusOK || body.To != now.Format(time.DateOnly) || body.From != now.AddDate(0, 0, 1-now.Day()).Format(time.DateOnly) {
+		t.Errorf("default range = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// linkUTM is a link's campaign tracking defaults. They are stored beside
+// long_url, not in it, and merged into the destination on every redirect,
+// so a campaign can be renamed without touching the link. Parameters
+// already on long_url are never replaced; utm_* parameters on the short
+// link itself, e.g. /abc123?utm_source=twitter, take precedence over the
+// stored defaults. Links without utm pass nothing through.
+type linkUTM struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// utmParams are the query parameters a short link's own query may
+// override.
+var utmParams = []string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content"}
+
+const maxUTMValueLen = 200
+
+func (u *linkUTM) values() url.Values {
+	values := url.Values{}
+	for i, v := range []string{u.Source, u.Medium, u.Campaign, u.Term, u.Content} {
+		if v != "" {
+			values.Set(utmParams[i], v)
+		}
+	}
+	return values
+}
+
+func validateLinkUTM(u *linkUTM) error {
+	for key, values := range u.values() {
+		if len(values[0]) > maxUTMValueLen {
+			return fmt.Errorf("utm %s may be at most %d bytes", key[len("utm_"):], maxUTMValueLen)
+		}
+	}
+	return nil
+}
+
+// encode is u as stored in urls.utm: an encoded query string, "" when u
+// is nil or empty.
+func (u *linkUTM) encode() string {
+	if u == nil {
+		return ""
+	}
+	return u.values().Encode()
+}
+
+// decodeLinkUTM reads a stored utm column back, nil when there is none.
+func decodeLinkUTM(stored string) *linkUTM {
+	values, err := url.ParseQuery(stored)
+	if stored == "" || err != nil {
+		return nil
+	}
+	return &linkUTM{
+		Source:   values.Get("utm_source"),
+		Medium:   values.Get("utm_medium"),
+		Campaign: values.Get("utm_campaign"),
+		Term:     values.Get("utm_term"),
+		Content:  values.Get("utm_content"),
+	}
+}
+
+// utmDestination is where a link with the stored utm redirects c: longURL
+// with the defaults, overridden by c's own utm_* parameters, merged into
+// its query string; see linkUTM. A destination that can't be merged into
+// is used as it is.
+func utmDestination(c *gin.Context, longURL, utm string) string {
+	if utm == "" {
+		return longURL
+	}
+	params, err := url.ParseQuery(utm)
+	if err != nil {
+		return longURL
+	}
+	query := c.Request.URL.Query()
+	for _, key := range utmParams {
+		if v := query.Get(key); v != "" && len(v) <= maxUTMValueLen {
+			params.Set(key, v)
+		}
+	}
+	destination, err := mergeQueryParams(longURL, params, false)
+	if err != nil {
+		return longURL
+	}
+	return destination
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLinkUTMEncoding(t *testing.T) {
+	u := &linkUTM{Source: "news letter", Campaign: "50% off & more", Content: "é"}
+	stored := u.encode()
+	if stored != "utm_campaign=50%25+off+%26+more&utm_content=%C3%A9&utm_source=news+letter" {
+		t.Errorf("encode() = %q", stored)
+	}
+	if got := decodeLinkUTM(stored); got == nil || *got != *u {
+		t.Errorf("decodeLinkUTM(%q) = %+v, want %+v", stored, got, u)
+	}
+	if (*linkUTM)(nil).encode() != "" || (&linkUTM{}).encode() != "" || decodeLinkUTM("") != nil {
+		t.Error("an empty utm isn't stored as nothing")
+	}
+	if err := validateLinkUTM(&linkUTM{Term: strings.Repeat("x", maxUTMValueLen+1)}); err == nil || !strings.Contains(err.Error(), "term") {
+		t.Errorf("an overlong term gave %v", err)
+	}
+}
+
+func TestRedirectMergesUTM(t *testing.T) {
+	mr := useRedis(t)
+	utm := &linkUTM{Source: "newsletter", Medium: "email", Campaign: "spring sale/2025"}
+	tests := []struct {
+		name, longURL, query, want string
+	}{
+		{"plain", "https://shop.example/", "",
+			"https://shop.example/?utm_campaign=spring+sale%2F2025&utm_medium=email&utm_source=newsletter"},
+		{"existing query", "https://shop.example/list?page=2&sort=price", "",
+			"https://shop.example/list?page=2&sort=price&utm_campaign=spring+sale%2F2025&utm_medium=email&utm_source=newsletter"},
+		{"fragment", "https://shop.example/item#reviews", "",
+			"https://shop.example/item?utm_campaign=spring+sale%2F2025&utm_medium=email&utm_source=newsletter#reviews"},
+		{"query and fragment", "https://shop.example/item?id=7#specs", "",
+			"https://shop.example/item?id=7&utm_campaign=spring+sale%2F2025&utm_medium=email&utm_source=newsletter#specs"},
+		{"percent-encoded long URL", "https://shop.example/a%20b?q=caf%C3%A9%26tea", "",
+			"https://shop.example/a%20b?q=caf%C3%A9%26tea&utm_campaign=spring+sale%2F2025&utm_medium=email&utm_source=newsletter"},
+		{"long URL's own utm kept", "https://shop.example/?utm_source=partner", "",
+			"https://shop.example/?utm_source=partner&utm_campaign=spring+sale%2F2025&utm_medium=email"},
+		{"short link overrides", "https://shop.example/", "?utm_source=twitter&utm_term=caf%C3%A9+au+lait&ref=x",
+			"https://shop.example/?utm_campaign=spring+sale%2F2025&utm_medium=email&utm_source=twitter&utm_term=caf%C3%A9+au+lait"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withLocalCache(t, 100)
+			link := shortenForTest(t, ShortenRequest{LongURL: tt.longURL, UTM: utm}, "")
+			mr.Del(urlCacheKey(link.ShortCode))
+			r := redirectEngine()
+			for _, from := range []string{"database", "local cache", "Redis"} {
+				if from == "Redis" {
+					withLocalCache(t, 100)
+				}
+				w := serveTest(r, http.MethodGet, "/"+link.ShortCode+tt.query, "")
+				if w.Code != defaultRedirectStatus || w.Header().Get("Location") != tt.want {
+					t.Errorf("from the %s = %d to %q, want %q", from, w.Code, w.Header().Get("Location"), tt.want)
+				}
+			}
+			// The cache holds the base URL; the merge happens on each redirect.
+			cached, _ := mr.Get(urlCacheKey(link.ShortCode))
+			if got := decodeCachedLink(cached); got.LongURL != tt.longURL || got.UTM != utm.encode() {
+				t.Errorf("cached %+v, want the long URL and utm apart", got)
+			}
+		})
+	}
+
+	// A link without utm passes none through from the short link.
+	link := shortenForTest(t, ShortenRequest{LongURL: "https://shop.example/no-utm"}, "")
+	if w := serveTest(redirectEngine(), http.MethodGet, "/"+link.ShortCode+"?utm_source=twitter", ""); w.Header().Get("Location") != "https://shop.example/no-utm" {
+		t.Errorf("link without utm redirected to %q", w.Header().Get("Location"))
+	}
+}
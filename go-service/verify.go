@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Integrity verifier settings. Fixes run in transactions of at most
+// verifyFixBatch rows so a large repair doesn't hold the write lock for long.
+var (
+	verifyCacheSample = getEnvInt("VERIFY_CACHE_SAMPLE", 1000)
+	verifyFixBatch    = getEnvInt("VERIFY_FIX_BATCH", 500)
+)
+
+// Finding severities, most serious first.
+const (
+	verifySeverityError   = "error"
+	verifySeverityWarning = "warning"
+)
+
+// verifyMaxExamples caps the offending codes listed per check.
+const verifyMaxExamples = 10
+
+type verifyFinding struct {
+	Check    string   `json:"check"`
+	Severity string   `json:"severity"`
+	Count    int64    `json:"count"`
+	Fixable  bool     `json:"fixable"`
+	Fixed    int64    `json:"fixed,omitempty"`
+	Examples []string `json:"examples,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type verifyReport struct {
+	OK       bool            `json:"ok"`
+	Fix      bool            `json:"fix"`
+	Findings []verifyFinding `json:"findings"`
+}
+
+// orphanCheck is a table whose rows refer to urls by short_code and are
+// meaningless once the link is gone.
+type orphanCheck struct {
+	name  string
+	table string
+}
+
+var verifyOrphanChecks = []orphanCheck{
+	{"orphan_clicks", "clicks"},
+	{"orphan_conversions", "conversions"},
+	{"orphan_click_counters", "click_counters"},
+	{"orphan_click_rollups", "clicks_hourly"},
+}
+
+// runVerify checks the database and cache for damage. With fix set it
+// deletes orphaned rows and stale cache entries; the other checks only
+// report. The report is OK when nothing is left unrepaired.
+func (s *Server) runVerify(ctx context.Context, fix bool) verifyReport {
+	report := verifyReport{OK: true, Fix: fix}
+	add := func(f verifyFinding) {
+		if f.Error != "" || f.Count > f.Fixed {
+			report.OK = false
+		}
+		report.Findings = append(report.Findings, f)
+	}
+
+	if !s.cfg.postgres() {
+		add(s.verifyIntegrity(ctx))
+	}
+	for _, check := range verifyOrphanChecks {
+		add(s.verifyOrphans(ctx, check, fix))
+	}
+	add(s.verifyCodePolicy(ctx))
+	add(s.verifyCache(ctx, fix))
+	return report
+}
+
+// verifyIntegrity runs SQLite's own consistency check. Postgres has
+// none to run from here.
+func (s *Server) verifyIntegrity(ctx context.Context) verifyFinding {
+	f := verifyFinding{Check: "integrity", Severity: verifySeverityError}
+	rows, err := s.db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			f.Error = err.Error()
+			return f
+		}
+		if msg == "ok" {
+			continue
+		}
+		f.Count++
+		if len(f.Examples) < verifyMaxExamples {
+			f.Examples = append(f.Examples, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		f.Error = err.Error()
+	}
+	return f
+}
+
+func (s *Server) verifyOrphans(ctx context.Context, check orphanCheck, fix bool) verifyFinding {
+	f := verifyFinding{Check: check.name, Severity: verifySeverityWarning, Fixable: true}
+	orphaned := "FROM " + check.table + " t WHERE NOT EXISTS (SELECT 1 FROM urls u WHERE u.short_code = t.short_code)"
+
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) "+orphaned).Scan(&f.Count); err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	if f.Count == 0 {
+		return f
+	}
+	examples, err := s.queryStrings(ctx, "SELECT DISTINCT t.short_code "+orphaned+" LIMIT ?", verifyMaxExamples)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	f.Examples = examples
+	if !fix {
+		return f
+	}
+
+	for {
+		res, err := s.execWithRetry(ctx, "DELETE FROM "+check.table+" WHERE id IN (SELECT t.id "+orphaned+" LIMIT ?)", verifyFixBatch)
+		if err != nil {
+			f.Error = err.Error()
+			break
+		}
+		n, _ := res.RowsAffected()
+		f.Fixed += n
+		if n < int64(verifyFixBatch) {
+			break
+		}
+	}
+	if f.Fixed > 0 {
+		log.Printf("Verify: deleted %d orphaned %s rows", f.Fixed, check.table)
+	}
+	return f
+}
+
+// verifyCodePolicy finds stored codes the current code pattern would reject.
+// Such links still resolve, so they are reported for a human to decide.
+func (s *Server) verifyCodePolicy(ctx context.Context) verifyFinding {
+	f := verifyFinding{Check: "code_policy", Severity: verifySeverityWarning}
+	rows, err := s.db.QueryContext(ctx, "SELECT short_code FROM urls")
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			f.Error = err.Error()
+			return f
+		}
+		if shortCodePattern.MatchString(code) {
+			continue
+		}
+		f.Count++
+		if len(f.Examples) < verifyMaxExamples {
+			f.Examples = append(f.Examples, strconv.Quote(code))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		f.Error = err.Error()
+	}
+	return f
+}
+
+// verifyCache samples up to VERIFY_CACHE_SAMPLE cached links and flags those
+// whose code no longer exists. Deleting a cache entry is always safe.
+func (s *Server) verifyCache(ctx context.Context, fix bool) verifyFinding {
+	f := verifyFinding{Check: "stale_cache", Severity: verifySeverityWarning, Fixable: true}
+	if s.rdb == nil {
+		return f
+	}
+
+	var stale []string
+	var sampled int
+	iter := s.rdb.Scan(ctx, 0, urlCacheKeyPrefix+"*", 100).Iterator()
+	for sampled < verifyCacheSample && iter.Next(ctx) {
+		sampled++
+		key := iter.Val()
+		var exists int
+		err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM urls WHERE short_code = ?", strings.TrimPrefix(key, urlCacheKeyPrefix)).Scan(&exists)
+		if err != nil {
+			f.Error = err.Error()
+			return f
+		}
+		// Cached misses are meant to name codes that don't exist.
+		if exists == 0 && s.rdb.Get(ctx, key).Val() != notFoundSentinel {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		f.Error = err.Error()
+		return f
+	}
+
+	f.Count = int64(len(stale))
+	for _, key := range stale[:min(len(stale), verifyMaxExamples)] {
+		f.Examples = append(f.Examples, strings.TrimPrefix(key, urlCacheKeyPrefix))
+	}
+	if fix && len(stale) > 0 {
+		n, err := s.rdb.Del(ctx, stale...).Result()
+		if err != nil {
+			f.Error = err.Error()
+			return f
+		}
+		f.Fixed = n
+		log.Printf("Verify: deleted %d stale cache entries", n)
+	}
+	return f
+}
+
+func (s *Server) queryStrings(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			return nil, err
+		}
+		out = append(out, str)
+	}
+	return out, rows.Err()
+}
+
+// runVerifyCLI prints the report for `--verify` and returns the exit code.
+func (s *Server) runVerifyCLI(fix bool) int {
+	report := s.runVerify(context.Background(), fix)
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(os.Stdout, string(out))
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// postVerify serves POST /admin/verify; ?fix=true repairs what is safe to.
+func (s *Server) postVerify(c *gin.Context) {
+	fix := c.Query("fix") == "true"
+	if fix && inMaintenance() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service is in maintenance mode, try again later", "code": "maintenance"})
+		return
+	}
+	report := s.runVerify(c.Request.Context(), fix)
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The delivery log keeps what a webhook was sent and what it answered, so
+// a failing endpoint can be debugged: the bodies are redacted as debug
+// captures are, with the webhook's secret masked too, and cut to
+// WEBHOOK_DELIVERY_BODY_LIMIT bytes. A delivery can be re-sent with
+// POST /api/webhooks/:id/deliveries/:delivery_id/replay, and
+// POST /api/webhooks/:id/test sends a ping event. A replay sends the body
+// as stored, so one that was cut can't be replayed. Both make one attempt
+// while the caller waits, without retries, and log it like any other;
+// a replay carries X-Webhook-Replay: true and the original event ID.
+
+// eventPing is the event POST /api/webhooks/:id/test sends. Webhooks can't
+// subscribe to it.
+const eventPing = "ping"
+
+// webhookDeliverySucceeded is the condition for an attempt that got a 2xx.
+const webhookDeliverySucceeded = "error IS NULL AND COALESCE(status_code, 600) < 300"
+
+// webhookPingPayload is the body of a ping.
+type webhookPingPayload struct {
+	Type       string `json:"type"`
+	WebhookID  string `json:"webhook_id"`
+	OccurredAt string `json:"occurred_at"`
+}
+
+// storedWebhookBody is body as the delivery log keeps it, and whether it
+// had to be cut.
+func storedWebhookBody(body []byte, secret string) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+	stored := redactCapturedBody(body, "", "")
+	if secret != "" {
+		stored = strings.ReplaceAll(stored, secret, redactedValue)
+	}
+	if len(stored) <= webhookDeliveryBodyLimit {
+		return stored, false
+	}
+	return strings.ToValidUTF8(stored[:webhookDeliveryBodyLimit], ""), true
+}
+
+// pruneWebhookDeliveries deletes attempts older than
+// WEBHOOK_DELIVERY_RETENTION.
+func (s *Server) pruneWebhookDeliveries(ctx context.Context) error {
+	if inMaintenance() {
+		return nil
+	}
+	cutoff := time.Now().UTC().Add(-webhookDeliveryRetention).Format(time.RFC3339Nano)
+	res, err := s.execWithRetry(ctx, "DELETE FROM webhook_deliveries WHERE attempted_at < ?", cutoff)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Pruned %d webhook deliveries before %s", n, cutoff)
+	}
+	return nil
+}
+
+// sendWebhookNow makes one attempt at d, logs it and describes it.
+func (s *Server) sendWebhookNow(d webhookDelivery) gin.H {
+	start := time.Now()
+	status, response, err := postWebhook(d)
+	took := time.Since(start)
+	s.recordWebhookDelivery(d, status, response, err, took)
+	webhookStats.Add("attempts", 1)
+
+	responseBody, responseTruncated := storedWebhookBody(response, d.hook.secret)
+	result := gin.H{
+		"event_id":           d.eventID,
+		"event":              d.event,
+		"delivered":          err == nil && status < 300,
+		"status_code":        nullIfZero(status),
+		"error":              nil,
+		"duration_ms":        took.Milliseconds(),
+		"response_body":      nullIfEmpty(responseBody),
+		"response_truncated": responseTruncated,
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	if d.replayOf != 0 {
+		result["replay_of"] = d.replayOf
+	}
+	return result
+}
+
+// webhookForSend is the webhook a replay or ping goes to, answering the
+// request itself when there is none or webhooks aren't running here.
+func (s *Server) webhookForSend(c *gin.Context) (webhook, bool) {
+	hook, ok, err := s.lookupWebhook(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return hook, false
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return hook, false
+	}
+	if webhookClient == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Webhooks are not running on this instance"})
+		return hook, false
+	}
+	return hook, true
+}
+
+// replayWebhookDelivery serves
+// POST /api/webhooks/:id/deliveries/:delivery_id/replay.
+func (s *Server) replayWebhookDelivery(c *gin.Context) {
+	hook, ok := s.webhookForSend(c)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseInt(c.Param("delivery_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+	d := webhookDelivery{hook: hook, attempt: 1, replayOf: deliveryID}
+	var body, shortCode sql.NullString
+	var truncated bool
+	err = s.db.QueryRowContext(c.Request.Context(), "SELECT event_id, event, request_body, request_truncated, short_code FROM webhook_deliveries WHERE id = ? AND webhook_id = ?",
+		deliveryID, hook.ID).Scan(&d.eventID, &d.event, &body, &truncated, &shortCode)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if truncated || !body.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "The delivery's body was not kept in full, so it can't be replayed", "code": "body_truncated"})
+		return
+	}
+	d.body, d.shortCode = []byte(body.String), shortCode.String
+	result := s.sendWebhookNow(d)
+	slog.Info("webhook delivery replayed", "audit", true, "by", clientIP(c), "webhook_id", hook.ID, "delivery_id", deliveryID, "event_id", d.eventID)
+	c.JSON(http.StatusOK, result)
+}
+
+// testWebhook serves POST /api/webhooks/:id/test, sending a ping.
+func (s *Server) testWebhook(c *gin.Context) {
+	hook, ok := s.webhookForSend(c)
+	if !ok {
+		return
+	}
+	eventID := newRandomID()
+	body, _ := json.Marshal(webhookPingPayload{Type: eventPing, WebhookID: hook.ID, OccurredAt: time.Now().UTC().Format(time.RFC3339)})
+	result := s.sendWebhookNow(webhookDelivery{hook: hook, eventID: eventID, event: eventPing, body: body, attempt: 1})
+	slog.Info("webhook pinged", "audit", true, "by", clientIP(c), "webhook_id", hook.ID, "event_id", eventID)
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webhookDeliveryItem is an item of GET /api/webhooks/:id/deliveries.
+type webhookDeliveryItem struct {
+	ID               int64  `json:"id"`
+	EventID          string `json:"event_id"`
+	Event            string `json:"event"`
+	StatusCode       int    `json:"status_code"`
+	RequestBody      string `json:"request_body"`
+	RequestTruncated bool   `json:"request_truncated"`
+	ResponseBody     string `json:"response_body"`
+	ReplayOf         int64  `json:"replay_of"`
+}
+
+func TestWebhookDeliveryLog(t *testing.T) {
+	if webhookClient == nil {
+		webhookClient = newWebhookClient()
+		t.Cleanup(func() { webhookClient = nil })
+	}
+	var mu sync.Mutex
+	var received []*http.Request
+	status := http.StatusInternalServerError
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r)
+		w.WriteHeader(status)
+		io.WriteString(w, `{"echo":"`+r.Header.Get("X-Webhook-Event")+`","password":"hunter2","padding":"`+strings.Repeat("x", 100)+`"}`)
+	}))
+	defer endpoint.Close()
+	r := testServer.newRouter()
+	admin := "Authorization: Bearer " + testAdminToken
+	w := serveTest(r, http.MethodPost, "/api/webhooks", `{"url":"`+endpoint.URL+`"}`, admin)
+	var hook struct{ ID, Secret string }
+	json.Unmarshal(w.Body.Bytes(), &hook)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create webhook = %d: %s", w.Code, w.Body)
+	}
+	t.Cleanup(func() { serveTest(r, http.MethodDelete, "/api/webhooks/"+hook.ID, "", admin) })
+	h, _ := findWebhook(hook.ID)
+	savedLimit := webhookDeliveryBodyLimit
+	webhookDeliveryBodyLimit = 120
+	t.Cleanup(func() { webhookDeliveryBodyLimit = savedLimit })
+
+	// An event with a sensitive URL and one too long to keep, both on
+	// their last attempt, then a ping.
+	testServer.deliverWebhook(webhookDelivery{hook: h, eventID: "ev-1", event: eventURLCreated, attempt: webhookMaxAttempts,
+		body: []byte(`{"type":"url_created","long_url":"https://example.com/?token=abc","secret":"` + hook.Secret + `"}`)})
+	testServer.deliverWebhook(webhookDelivery{hook: h, eventID: "ev-2", event: eventURLCreated, attempt: webhookMaxAttempts,
+		body: []byte(`{"type":"url_created","notes":"` + strings.Repeat("n", 200) + `"}`)})
+	status = http.StatusOK
+	if w := serveTest(r, http.MethodPost, "/api/webhooks/"+hook.ID+"/test", "", admin); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"delivered":true`) {
+		t.Errorf("test = %d: %s", w.Code, w.Body)
+	}
+	if got := received[len(received)-1].Header.Get("X-Webhook-Event"); got != eventPing {
+		t.Errorf("test sent a %q event", got)
+	}
+
+	list := func(query string) (items []webhookDeliveryItem, next string) {
+		t.Helper()
+		w := serveTest(r, http.MethodGet, "/api/webhooks/"+hook.ID+"/deliveries?"+query, "", admin)
+		if w.Code != http.StatusOK {
+			t.Fatalf("deliveries?%s = %d: %s", query, w.Code, w.Body)
+		}
+		var page struct {
+			Deliveries []webhookDeliveryItem
+			NextCursor *string `json:"next_cursor"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &page)
+		if page.NextCursor != nil {
+			next = *page.NextCursor
+		}
+		return page.Deliveries, next
+	}
+	failed, _ := list("status=failed")
+	if len(failed) != 2 || failed[0].EventID != "ev-2" || failed[1].EventID != "ev-1" {
+		t.Fatalf("failed deliveries = %+v", failed)
+	}
+	first := failed[1]
+	if strings.Contains(first.RequestBody, "abc") || strings.Contains(first.RequestBody, hook.Secret) || first.RequestTruncated {
+		t.Errorf("stored request body %q is not redacted", first.RequestBody)
+	}
+	if strings.Contains(first.ResponseBody, "hunter2") || len(first.ResponseBody) > 120 || first.StatusCode != http.StatusInternalServerError {
+		t.Errorf("stored response %d %q", first.StatusCode, first.ResponseBody)
+	}
+	if !failed[0].RequestTruncated {
+		t.Errorf("long request body was kept in full: %q", failed[0].RequestBody)
+	}
+	if succeeded, _ := list("status=succeeded"); len(succeeded) != 1 || succeeded[0].Event != eventPing {
+		t.Errorf("succeeded deliveries = %+v", succeeded)
+	}
+	page, next := list("limit=2")
+	rest, last := list("limit=2&cursor=" + next)
+	if len(page) != 2 || next == "" || len(rest) != 1 || last != "" || rest[0].ID >= page[1].ID {
+		t.Errorf("pages %+v (next %q) and %+v (next %q)", page, next, rest, last)
+	}
+
+	// Replays re-send the stored body under the original event ID.
+	replay := "/api/webhooks/" + hook.ID + "/deliveries/" + strconv.FormatInt(first.ID, 10) + "/replay"
+	if w := serveTest(r, http.MethodPost, replay, "", admin); w.Code != http.StatusOK {
+		t.Fatalf("replay = %d: %s", w.Code, w.Body)
+	}
+	sent := received[len(received)-1]
+	if sent.Header.Get("X-Webhook-Delivery") != "ev-1" || sent.Header.Get("X-Webhook-Replay") != "true" {
+		t.Errorf("replay was sent with %v", sent.Header)
+	}
+	if latest, _ := list("limit=1"); len(latest) != 1 || latest[0].ReplayOf != first.ID || latest[0].StatusCode != http.StatusOK {
+		t.Errorf("latest delivery = %+v, want the replay of %d", latest, first.ID)
+	}
+	if w := serveTest(r, http.MethodPost, "/api/webhooks/"+hook.ID+"/deliveries/"+strconv.FormatInt(failed[0].ID, 10)+"/replay", "", admin); w.Code != http.StatusConflict {
+		t.Errorf("replay of a cut body = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := serveTest(r, http.MethodPost, "/api/webhooks/"+hook.ID+"/deliveries/999999999/replay", "", admin); w.Code != http.StatusNotFound {
+		t.Errorf("replay of an unknown delivery = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveTest(r, http.MethodGet, "/api/webhooks/"+hook.ID+"/deliveries?status=lost", "", admin); w.Code != http.StatusBadRequest {
+		t.Errorf("status=lost = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	savedRetention := webhookDeliveryRetention
+	webhookDeliveryRetention = 0
+	t.Cleanup(func() { webhookDeliveryRetention = savedRetention })
+	if err := testServer.pruneWebhookDeliveries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := list(""); len(left) != 0 {
+		t.Errorf("%d deliveries left after pruning everything", len(left))
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Webhooks push lifecycle events, and optionally a sample of clicks, to
+// external endpoints as signed JSON POSTs. Endpoints come from WEBHOOK_URLS
+// (comma-separated, signed with WEBHOOK_SECRET and sent WEBHOOK_EVENTS) and
+// from the webhooks table, managed through /api/webhooks. Deliveries wait in
+// a queue of WEBHOOK_QUEUE_SIZE drained by WEBHOOK_WORKERS workers, so a
+// slow endpoint never holds up a redirect; when the queue is full the
+// delivery is dropped and counted. A network error, timeout, 429 or 5xx is
+// retried with exponential backoff, up to WEBHOOK_MAX_ATTEMPTS attempts.
+// Retries still waiting at shutdown are lost. The last
+// WEBHOOK_DELIVERY_HISTORY attempts per webhook, none older than
+// WEBHOOK_DELIVERY_RETENTION (0 keeps them), are kept for debugging, with
+// the request and response bodies redacted and cut to
+// WEBHOOK_DELIVERY_BODY_LIMIT bytes; see webhookdebug.go.
+//
+// Every POST carries X-Webhook-Event, X-Webhook-Delivery (the event ID,
+// the same across retries), X-Webhook-Timestamp (Unix seconds) and
+// X-Webhook-Signature: "sha256=" and the hex HMAC-SHA256 of
+// "<timestamp>.<body>" under the webhook's secret. Secrets are stored in
+// the clear, since signing needs them.
+var (
+	webhookURLs              = getEnv("WEBHOOK_URLS", "")
+	webhookSecret            = getEnv("WEBHOOK_SECRET", "")
+	webhookEvents            = getEnv("WEBHOOK_EVENTS", eventURLCreated+","+eventURLDeleted)
+	webhookClickSampleRate   = getEnvFloat("WEBHOOK_CLICK_SAMPLE_RATE", 0)
+	webhookWorkers           = getEnvInt("WEBHOOK_WORKERS", 4)
+	webhookQueueSize         = getEnvInt("WEBHOOK_QUEUE_SIZE", 1000)
+	webhookMaxAttempts       = getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5)
+	webhookTimeout           = getEnvDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+	webhookDeliveryHistory   = getEnvInt("WEBHOOK_DELIVERY_HISTORY", 100)
+	webhookDeliveryRetention = getEnvDuration("WEBHOOK_DELIVERY_RETENTION", 7*24*time.Hour)
+	webhookDeliveryBodyLimit = getEnvInt("WEBHOOK_DELIVERY_BODY_LIMIT", 4096)
+	webhookInitialBackoff    = getEnvDuration("WEBHOOK_INITIAL_BACKOFF", time.Second)
+	webhookMaxBackoff        = getEnvDuration("WEBHOOK_MAX_BACKOFF", 5*time.Minute)
+	webhookRefreshInterval   = 30 * time.Second
+	webhookDefaultEventTypes = []string{eventURLCreated, eventURLDeleted}
+)
+
+const (
+	webhookIDPrefix = "wh_"
+	// eventClick is the webhook event for a sampled click.
+	eventClick = "click"
+)
+
+var webhookEventTypes = map[string]bool{
+	eventURLCreated:      true,
+	eventURLActivated:    true,
+	eventURLDeleted:      true,
+	eventURLExpiringSoon: true,
+	eventQuotaWarning:    true,
+	eventConversion:      true,
+	eventClick:           true,
+}
+
+// webhook is an endpoint events are sent to. Webhooks from WEBHOOK_URLS
+// have IDs env-1, env-2, ...
+type webhook struct {
+	ID     string
+	URL    string
+	Events []string
+	secret string
+	// shortCode and guarded are set for a link's webhook, which is only
+	// dialled at public addresses; see linkwebhooks.go.
+	shortCode string
+	guarded   bool
+}
+
+func (h webhook) wants(eventType string) bool {
+	for _, e := range h.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookDelivery is one event on its way to one webhook.
+type webhookDelivery struct {
+	hook    webhook
+	eventID string
+	event   string
+	// shortCode is the link a click or link event is about.
+	shortCode string
+	body      []byte
+	attempt   int
+	// replayOf is the delivery a manual replay re-sends.
+	replayOf int64
+}
+
+// webhookClickPayload is the body of a click webhook: the click event with
+// its type.
+type webhookClickPayload struct {
+	Type string `json:"type"`
+	ClickEvent
+}
+
+var (
+	envWebhooks []webhook
+	// webhookList is every webhook, refreshed from the table; nil while
+	// webhooks are off.
+	webhookList   atomic.Pointer[[]webhook]
+	webhookQueue  chan webhookDelivery
+	webhookClient *http.Client
+	// webhookPending counts deliveries queued or being sent.
+	webhookPending atomic.Int64
+
+	webhookStats = expvar.NewMap("webhooks")
+)
+
+// initWebhooks validates the WEBHOOK_* settings.
+func initWebhooks() {
+	if webhookClickSampleRate < 0 || webhookClickSampleRate > 1 {
+		log.Fatalf("Invalid WEBHOOK_CLICK_SAMPLE_RATE %v: must be between 0 and 1", webhookClickSampleRate)
+	}
+	if webhookWorkers < 1 || webhookQueueSize < 1 || webhookMaxAttempts < 1 || webhookDeliveryBodyLimit < 1 {
+		log.Fatalf("WEBHOOK_WORKERS, WEBHOOK_QUEUE_SIZE, WEBHOOK_MAX_ATTEMPTS and WEBHOOK_DELIVERY_BODY_LIMIT must be at least 1")
+	}
+	if linkWebhooksPerOwner < 0 {
+		log.Fatalf("Invalid LINK_WEBHOOKS_PER_OWNER %d: must be at least 0", linkWebhooksPerOwner)
+	}
+	if webhookURLs == "" {
+		return
+	}
+	if webhookSecret == "" {
+		log.Fatalf("WEBHOOK_SECRET is required with WEBHOOK_URLS")
+	}
+	events, err := parseWebhookEvents(strings.Split(webhookEvents, ","))
+	if err != nil {
+		log.Fatalf("Invalid WEBHOOK_EVENTS: %v", err)
+	}
+	for _, raw := range strings.Split(webhookURLs, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if err := validateWebhookURL(raw); err != nil {
+			log.Fatalf("Invalid WEBHOOK_URLS entry %q: %v", raw, err)
+		}
+		envWebhooks = append(envWebhooks, webhook{ID: "env-" + strconv.Itoa(len(envWebhooks)+1), URL: raw, Events: events, secret: webhookSecret})
+	}
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an http or https URL")
+	}
+	return nil
+}
+
+// parseWebhookEvents checks event types, dropping blanks and duplicates.
+func parseWebhookEvents(events []string) ([]string, error) {
+	seen := map[string]bool{}
+	var out []string
+	for _, e := range events {
+		e = strings.TrimSpace(e)
+		if e == "" || seen[e] {
+			continue
+		}
+		if !webhookEventTypes[e] {
+			return nil, errors.New("unknown event " + strconv.Quote(e) + ": must be url_created, url_activated, url_deleted, url_expiring_soon, quota_warning or click")
+		}
+		seen[e] = true
+		out = append(out, e)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("at least one event is required")
+	}
+	return out, nil
+}
+
+// startWebhooks loads the webhooks and starts the delivery workers. Their
+// shutdown hook has to be registered before the click publishers', so it
+// runs after the last clicks are published.
+func (s *Server) startWebhooks() {
+	if resolverOnly {
+		return
+	}
+	webhookClient, linkWebhookClient = newWebhookClient(), newLinkWebhookClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.refreshWebhooks(ctx); err != nil {
+		log.Fatalf("Error loading webhooks: %v", err)
+	}
+
+	webhookQueue = make(chan webhookDelivery, webhookQueueSize)
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for d := range webhookQueue {
+				s.deliverWebhook(d)
+			}
+		}()
+	}
+	app.OnShutdown("webhooks", 10*time.Second, drainWebhooks)
+	// Other instances may change the table.
+	app.RegisterBackgroundJob("webhook_refresh", webhookRefreshInterval, s.refreshWebhooks)
+	if webhookClickSampleRate > 0 {
+		app.RegisterPublisher("webhooks", publishClickWebhook)
+	}
+	if linkWebhooksPerOwner > 0 {
+		app.RegisterPublisher("link_webhooks", s.publishLinkWebhook)
+	}
+	if webhookDeliveryRetention > 0 {
+		app.RegisterBackgroundJob("webhook_delivery_pruner", time.Hour, s.pruneWebhookDeliveries)
+	}
+}
+
+func newWebhookClient() *http.Client {
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			Proxy:               outboundProxy,
+			DialContext:         (&net.Dialer{Timeout: webhookTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: webhookWorkers,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+		// A redirect is the endpoint's answer; POSTs aren't followed.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// refreshWebhooks reloads webhookList from WEBHOOK_URLS and the table.
+func (s *Server) refreshWebhooks(ctx context.Context) error {
+	hooks := append([]webhook(nil), envWebhooks...)
+	rows, err := s.db.QueryContext(ctx, "SELECT id, url, secret, events FROM webhooks ORDER BY created_at, id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h webhook
+		var events string
+		if err := rows.Scan(&h.ID, &h.URL, &h.secret, &events); err != nil {
+			return err
+		}
+		h.Events = strings.Split(events, ",")
+		hooks = append(hooks, h)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	webhookList.Store(&hooks)
+	return nil
+}
+
+// findWebhook returns the webhook with id from the last refresh.
+func findWebhook(id string) (webhook, bool) {
+	if hooks := webhookList.Load(); hooks != nil {
+		for _, h := range *hooks {
+			if h.ID == id {
+				return h, true
+			}
+		}
+	}
+	return webhook{}, false
+}
+
+// notifyWebhooks queues payload, about the link at shortCode if any, for
+// every webhook that wants eventType.
+func notifyWebhooks(eventType, eventID, shortCode string, payload any) {
+	hooks := webhookList.Load()
+	if hooks == nil {
+		return
+	}
+	var body []byte
+	for _, h := range *hooks {
+		if !h.wants(eventType) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(payload); err != nil {
+				log.Printf("Error marshaling %s webhook: %v", eventType, err)
+				return
+			}
+		}
+		enqueueWebhook(webhookDelivery{hook: h, eventID: eventID, event: eventType, shortCode: shortCode, body: body, attempt: 1})
+	}
+}
+
+// publishClickWebhook is the click publisher sending a
+// WEBHOOK_CLICK_SAMPLE_RATE sample of clicks to webhooks.
+func publishClickWebhook(_ context.Context, event ClickEvent) error {
+	if rand.Float64() < webhookClickSampleRate {
+		notifyWebhooks(eventClick, event.ClickID, event.ShortCode, webhookClickPayload{Type: eventClick, ClickEvent: event})
+	}
+	return nil
+}
+
+func enqueueWebhook(d webhookDelivery) {
+	webhookPending.Add(1)
+	select {
+	case webhookQueue <- d:
+	default:
+		webhookPending.Add(-1)
+		webhookStats.Add("dropped", 1)
+		log.Printf("Webhook queue full, dropping %s %s for %s", d.event, d.eventID, d.hook.ID)
+	}
+}
+
+// drainWebhooks waits for queued deliveries to be sent, without their
+// retries.
+func drainWebhooks(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for webhookPending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// deliverWebhook makes one attempt, records it, and schedules a retry when
+// the endpoint may succeed later.
+func (s *Server) deliverWebhook(d webhookDelivery) {
+	defer webhookPending.Add(-1)
+	start := time.Now()
+	status, response, err := postWebhook(d)
+	took := time.Since(start)
+	s.recordWebhookDelivery(d, status, response, err, took)
+
+	webhookStats.Add("attempts", 1)
+	if err == nil && status < 300 {
+		webhookStats.Add("delivered", 1)
+		return
+	}
+	if err == nil && status != http.StatusTooManyRequests && status < 500 {
+		webhookStats.Add("failed", 1)
+		log.Printf("Webhook %s rejected %s %s with %d", d.hook.ID, d.event, d.eventID, status)
+		return
+	}
+	if d.attempt >= webhookMaxAttempts {
+		webhookStats.Add("failed", 1)
+		log.Printf("Webhook %s gave up on %s %s after %d attempts", d.hook.ID, d.event, d.eventID, d.attempt)
+		return
+	}
+	webhookStats.Add("retries", 1)
+	backoff := min(webhookInitialBackoff<<(d.attempt-1), webhookMaxBackoff)
+	backoff += rand.N(backoff/2 + 1)
+	d.attempt++
+	time.AfterFunc(backoff, func() { enqueueWebhook(d) })
+}
+
+// postWebhook sends d, returning the status and the start of the
+// response body.
+func postWebhook(d webhookDelivery) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, nil, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "urlshortener-webhooks")
+	req.Header.Set("X-Webhook-Event", d.event)
+	req.Header.Set("X-Webhook-Delivery", d.eventID)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(d.hook.secret, ts, d.body))
+	if d.replayOf != 0 {
+		req.Header.Set("X-Webhook-Replay", "true")
+	}
+	client := webhookClient
+	if d.hook.guarded {
+		client = linkWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The whole of a short body is read, so it can be redacted before the
+	// log cuts it.
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return resp.StatusCode, response, nil
+}
+
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordWebhookDelivery stores an attempt, with its bodies as
+// storedWebhookBody keeps them, and trims the webhook's history to
+// webhookDeliveryHistory. In maintenance mode nothing is stored.
+func (s *Server) recordWebhookDelivery(d webhookDelivery, status int, response []byte, deliveryErr error, took time.Duration) {
+	if inMaintenance() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var errText sql.NullString
+	if deliveryErr != nil {
+		errText = sql.NullString{String: deliveryErr.Error(), Valid: true}
+	}
+	requestBody, requestTruncated := storedWebhookBody(d.body, d.hook.secret)
+	responseBody, responseTruncated := storedWebhookBody(response, d.hook.secret)
+	_, err := s.execWithRetry(ctx, `INSERT INTO webhook_deliveries (webhook_id, event_id, event, attempt, status_code, error, duration_ms, attempted_at, request_body, request_truncated, response_body, response_truncated, replay_of, short_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, CAST(? AS INTEGER), ?, CAST(? AS INTEGER), ?, ?)`,
+		d.hook.ID, d.eventID, d.event, d.attempt, nullIfZero(status), errText, took.Milliseconds(), time.Now().UTC().Format(time.RFC3339Nano),
+		requestBody, requestTruncated, nullIfEmpty(responseBody), responseTruncated, nullIfZero(int(d.replayOf)), nullIfEmpty(d.shortCode))
+	if err == nil {
+		_, err = s.execWithRetry(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = ? AND id <= (
+			SELECT id FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?)`,
+			d.hook.ID, d.hook.ID, webhookDeliveryHistory)
+	}
+	if err != nil {
+		log.Printf("Error recording webhook delivery for %s: %v", d.hook.ID, err)
+	}
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"`
+}
+
+// createWebhook serves POST /api/webhooks. The secret is only ever
+// returned here.
+func (s *Server) createWebhook(c *gin.Context) {
+	var req webhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url " + err.Error()})
+		return
+	}
+	if req.Events == nil {
+		req.Events = webhookDefaultEventTypes
+	}
+	events, err := parseWebhookEvents(req.Events)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, secret := webhookIDPrefix+newRandomID()[:16], newRandomID()+newRandomID()
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	ctx := c.Request.Context()
+	if _, err := s.execWithRetry(ctx, "INSERT INTO webhooks (id, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?)",
+		id, req.URL, secret, strings.Join(events, ","), createdAt); err != nil {
+		if isBusyError(err) {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database busy, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := s.refreshWebhooks(ctx); err != nil {
+		log.Printf("Error refreshing webhooks: %v", err)
+	}
+	slog.Info("webhook created", "audit", true, "by", clientIP(c), "webhook_id", id, "url", redactURL(req.URL), "events", events)
+	c.JSON(http.StatusCreated, gin.H{"id": id, "url": req.URL, "events": events, "secret": secret, "created_at": createdAt})
+}
+
+// listWebhooks serves GET /api/webhooks, without secrets.
+func listWebhooks(c *gin.Context) {
+	hooks := []gin.H{}
+	if list := webhookList.Load(); list != nil {
+		for _, h := range *list {
+			hooks = append(hooks, gin.H{"id": h.ID, "url": h.URL, "events": h.Events, "from_env": strings.HasPrefix(h.ID, "env-")})
+		}
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+}
+
+// deleteWebhook serves DELETE /api/webhooks/:id. Webhooks from
+// WEBHOOK_URLS can't be deleted here.
+func (s *Server) deleteWebhook(c *gin.Context) {
+	id := c.Param("id")
+	if strings.HasPrefix(id, "env-") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhooks from WEBHOOK_URLS can only be removed from the configuration"})
+		return
+	}
+	ctx := c.Request.Context()
+	res, err := s.execWithRetry(ctx, "DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if _, err := s.execWithRetry(ctx, "DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		log.Printf("Error deleting deliveries of webhook %s: %v", id, err)
+	}
+	if err := s.refreshWebhooks(ctx); err != nil {
+		log.Printf("Error refreshing webhooks: %v", err)
+	}
+	slog.Info("webhook deleted", "audit", true, "by", clientIP(c), "webhook_id", id)
+	c.Status(http.StatusNoContent)
+}
+
+// listWebhookDeliveries serves GET /api/webhooks/:id/deliveries?limit=,
+// newest attempt first, keyset paginated by next_cursor passed back as
+// ?cursor=. status=failed keeps the attempts that didn't get a 2xx, and
+// status=succeeded the others; short_code keeps those about one link.
+func (s *Server) listWebhookDeliveries(c *gin.Context) {
+	id := c.Param("id")
+	_, ok, err := s.lookupWebhook(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > webhookDeliveryHistory {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(webhookDeliveryHistory), "code": "invalid_request"})
+		return
+	}
+	query, args := `SELECT id, event_id, event, attempt, status_code, error, duration_ms, attempted_at, request_body, request_truncated, response_body, response_truncated, replay_of, short_code
+		FROM webhook_deliveries WHERE webhook_id = ?`, []any{id}
+	if v := c.Query("short_code"); v != "" {
+		query, args = query+" AND short_code = ?", append(args, v)
+	}
+	switch c.Query("status") {
+	case "":
+	case "succeeded":
+		query += " AND " + webhookDeliverySucceeded
+	case "failed":
+		query += " AND NOT (" + webhookDeliverySucceeded + ")"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be succeeded or failed", "code": "invalid_request"})
+		return
+	}
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || cursor < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor", "code": "invalid_request"})
+			return
+		}
+		query, args = query+" AND id < ?", append(args, cursor)
+	}
+
+	// One row past the page says whether there is another.
+	rows, err := s.db.QueryContext(c.Request.Context(), query+" ORDER BY id DESC LIMIT ?", append(args, limit+1)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+	deliveries := []gin.H{}
+	var last int64
+	more := false
+	for rows.Next() {
+		if len(deliveries) == limit {
+			more = true
+			break
+		}
+		var eventID, event, attemptedAt string
+		var attempt int
+		var deliveryID, durationMS int64
+		var requestTruncated, responseTruncated bool
+		var status, replayOf sql.NullInt64
+		var errText, requestBody, responseBody, shortCode sql.NullString
+		if err := rows.Scan(&deliveryID, &eventID, &event, &attempt, &status, &errText, &durationMS, &attemptedAt,
+			&requestBody, &requestTruncated, &responseBody, &responseTruncated, &replayOf, &shortCode); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		item := gin.H{
+			"id":                 deliveryID,
+			"event_id":           eventID,
+			"event":              event,
+			"short_code":         nullIfEmpty(shortCode.String),
+			"attempt":            attempt,
+			"status_code":        nil,
+			"error":              nullIfEmpty(errText.String),
+			"duration_ms":        durationMS,
+			"attempted_at":       attemptedAt,
+			"request_body":       nullIfEmpty(requestBody.String),
+			"request_truncated":  requestTruncated,
+			"response_body":      nullIfEmpty(responseBody.String),
+			"response_truncated": responseTruncated,
+			"replay_of":          nil,
+		}
+		if status.Valid {
+			item["status_code"] = status.Int64
+		}
+		if replayOf.Valid {
+			item["replay_of"] = replayOf.Int64
+		}
+		deliveries = append(deliveries, item)
+		last = deliveryID
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	var next any
+	if more {
+		next = strconv.FormatInt(last, 10)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries, "next_cursor": next})
+}
@@ -6,6 +6,10 @@ import logging
 import os
 import redis
 import json
+import gzip
+import hashlib
+import hmac
+import time
 import threading
 
 app = Flask(__name__)
@@ -14,9 +18,24 @@ logging.basicConfig(level=logging.INFO)
 # Use environment variables for Docker, fallback to localhost for local dev
 GO_SERVICE_URL = os.getenv("GO_SERVICE_URL", "http://localhost:8000")
 NODE_SERVICE_URL = os.getenv("NODE_SERVICE_URL", "http://localhost:3000")
+# The Go service requires an API key on /api/*; the dashboard has its own
+# non-admin key, issued through the Go service's /admin/api-keys
+GO_SERVICE_API_KEY = os.getenv("GO_SERVICE_API_KEY", "")
 REDIS_URL = os.getenv("REDIS_URL", "localhost:6380")
 DATABASE = "python.db"
 
+# "pubsub" subscribes to the click_events channel; "stream" reads the
+# click_events stream in a consumer group, so clicks added while this
+# service was down are processed when it comes back. Match the Go service.
+CLICK_EVENTS_MODE = os.getenv("CLICK_EVENTS_MODE", "pubsub")
+CLICK_EVENTS_GROUP = os.getenv("CLICK_EVENTS_GROUP", "analytics")
+CLICK_EVENTS_CONSUMER = os.getenv("CLICK_EVENTS_CONSUMER", os.getenv("HOSTNAME", "python-service"))
+
+# Shared secret used by the Go service to sign event deliveries (optional)
+SERVICE_SIGNING_SECRET = os.getenv("SERVICE_SIGNING_SECRET", "")
+SERVICE_SIGNING_SECRET_PREVIOUS = os.getenv("SERVICE_SIGNING_SECRET_PREVIOUS", "")
+SERVICE_SIGNING_TOLERANCE = int(os.getenv("SERVICE_SIGNING_TOLERANCE_SECONDS", "300"))
+
 # Initialize Redis client
 redis_client = None
 
@@ -35,9 +54,10 @@ def init_redis():
         logging.info(f"✅ Redis connected successfully at {REDIS_URL}")
 
         # Start Redis subscriber in background thread
-        subscriber_thread = threading.Thread(target=redis_subscriber, daemon=True)
+        target = stream_consumer if CLICK_EVENTS_MODE == "stream" else redis_subscriber
+        subscriber_thread = threading.Thread(target=target, daemon=True)
         subscriber_thread.start()
-        logging.info("Redis subscriber thread started")
+        logging.info(f"Redis {CLICK_EVENTS_MODE} consumer thread started")
 
     except Exception as e:
         logging.warning(f"Redis connection failed: {e}. Will use HTTP endpoint only.")
@@ -62,8 +82,50 @@ def redis_subscriber():
         logging.error(f"Redis subscriber error: {e}")
 
 
+def stream_consumer():
+    """Read the click_events stream as CLICK_EVENTS_GROUP.
+
+    Entries are acknowledged once stored, so delivery is at least once: the
+    first pass re-reads what this consumer was given but never acknowledged
+    before it stopped, then new entries follow. Redis errors are retried.
+    """
+    try:
+        redis_client.xgroup_create("click_events", CLICK_EVENTS_GROUP, id="0", mkstream=True)
+        logging.info(f"📡 Created consumer group '{CLICK_EVENTS_GROUP}' on 'click_events'")
+    except redis.exceptions.ResponseError as e:
+        if "BUSYGROUP" not in str(e):
+            raise
+
+    last_id = "0"
+    while True:
+        try:
+            entries = redis_client.xreadgroup(
+                CLICK_EVENTS_GROUP, CLICK_EVENTS_CONSUMER, {"click_events": last_id}, count=100, block=5000
+            )
+            messages = entries[0][1] if entries else []
+            if last_id == "0" and not messages:
+                last_id = ">"
+                continue
+            for message_id, fields in messages:
+                try:
+                    process_click_event(json.loads(fields["event"]))
+                except Exception as e:
+                    logging.error(f"Error processing stream event {message_id}: {e}")
+                redis_client.xack("click_events", CLICK_EVENTS_GROUP, message_id)
+                if last_id != ">":
+                    last_id = message_id
+        except redis.exceptions.RedisError as e:
+            logging.error(f"Redis stream consumer error: {e}, retrying")
+            time.sleep(5)
+
+
 def process_click_event(data):
     """Process click event from Redis or HTTP"""
+    if data.get("is_test"):
+        # Synthetic event from the Go service self-test; never counted.
+        logging.info(f"🧪 Ignored self-test event for: {data.get('short_code')}")
+        return
+
     short_code = data.get("short_code")
     clicked_at = data.get("clicked_at", datetime.now().isoformat())
 
@@ -157,8 +219,14 @@ def create_short_url():
 
     try:
         # Call Go service to create short URL
+        headers = {}
+        if GO_SERVICE_API_KEY:
+            headers["X-API-Key"] = GO_SERVICE_API_KEY
         response = requests.post(
-            f"{GO_SERVICE_URL}/api/shorten", json={"long_url": long_url}, timeout=5
+            f"{GO_SERVICE_URL}/api/shorten",
+            json={"long_url": long_url},
+            headers=headers,
+            timeout=5,
         )
 
         if response.status_code == 200:
@@ -230,10 +298,52 @@ def create_short_url():
         return jsonify({"error": "Go service unavailable"}), 503
 
 
+def verify_signature(header, body, now=None):
+    """Check an X-Signature header ("t=<ts>,v1=<hex>") the same way the Go service does"""
+    secrets = [s for s in (SERVICE_SIGNING_SECRET, SERVICE_SIGNING_SECRET_PREVIOUS) if s]
+    if not header:
+        return False
+    try:
+        parts = dict(p.strip().split("=", 1) for p in header.split(","))
+        ts = int(parts["t"])
+        signature = parts["v1"]
+    except (KeyError, ValueError):
+        return False
+    now = now if now is not None else time.time()
+    if abs(now - ts) > SERVICE_SIGNING_TOLERANCE:
+        return False
+    message = str(ts).encode() + b"." + body
+    for secret in secrets:
+        expected = hmac.new(secret.encode(), message, hashlib.sha256).hexdigest()
+        if hmac.compare_digest(expected, signature):
+            return True
+    return False
+
+
+def get_event_payload():
+    """Parse a JSON event payload, accepting gzip Content-Encoding.
+
+    Returns None when the body is invalid or, if signing is configured,
+    when the X-Signature check fails.
+    """
+    body = request.get_data()
+    if request.headers.get("Content-Encoding", "").lower() == "gzip":
+        body = gzip.decompress(body)
+    if SERVICE_SIGNING_SECRET and not verify_signature(
+        request.headers.get("X-Signature"), body
+    ):
+        logging.warning("Rejected event with missing or invalid signature")
+        return None
+    try:
+        return json.loads(body)
+    except ValueError:
+        return None
+
+
 @app.route("/api/events", methods=["POST"])
 def receive_event():
     """Receive click events from Go service (HTTP fallback)"""
-    data = request.get_json()
+    data = get_event_payload()
 
     if not data or "short_code" not in data:
         return jsonify({"error": "Invalid event data"}), 400
@@ -244,6 +354,23 @@ def receive_event():
     return jsonify({"status": "success"}), 200
 
 
+@app.route("/api/events/batch", methods=["POST"])
+def receive_event_batch():
+    """Receive a batch of click events from Go service (HTTP fallback)"""
+    data = get_event_payload()
+
+    if not isinstance(data, list):
+        return jsonify({"error": "Invalid event batch"}), 400
+
+    processed = 0
+    for event in data:
+        if isinstance(event, dict) and "short_code" in event:
+            process_click_event(event)
+            processed += 1
+
+    return jsonify({"status": "success", "processed": processed}), 200
+
+
 @app.route("/api/stats")
 def get_stats():
     """Get analytics statistics"""